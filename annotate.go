@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	annotationLanguage = "language"
+	annotationSafety   = "safety"
+	// maxAnnotationChars bounds how much of a completion the language detector inspects
+	maxAnnotationChars = 4096
+	// minStopwordHits is the number of stopword matches required before a Latin-script language is reported
+	minStopwordHits      = 2
+	undeterminedLanguage = "und"
+)
+
+// outputAnnotations holds the optional metadata attached to a completion
+type outputAnnotations struct {
+	Language    string             `json:"language,omitempty"`
+	Safety      map[string]float32 `json:"safety,omitempty"`
+	EconomyMode bool               `json:"economy_mode,omitempty"` // max_tokens was reduced close to the daily cap
+}
+
+// isEmpty reports whether no annotation was produced
+func (a outputAnnotations) isEmpty() bool {
+	return a.Language == "" && a.Safety == nil && !a.EconomyMode
+}
+
+// parseAnnotations parses the comma separated ANNOTATE_OUTPUT value into the enabled annotation flags
+func parseAnnotations(value string) (language bool, safety bool, err error) {
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(strings.ToLower(name)) {
+		case "":
+		case annotationLanguage:
+			language = true
+		case annotationSafety:
+			safety = true
+		default:
+			return false, false, fmt.Errorf("Unknown annotation %q in environment variable ANNOTATE_OUTPUT", name)
+		}
+	}
+	return language, safety, nil
+}
+
+// annotateOutput builds the enabled annotations for a completion. The safety summary is taken from the
+// moderation result of the request input; pass nil when the input wasn't moderated.
+func annotateOutput(cfg *Config, text string, moderation *openai.ModerationResponse) outputAnnotations {
+	var annotations outputAnnotations
+	if cfg.AnnotateLanguage {
+		annotations.Language = detectLanguage(text)
+	}
+	if cfg.AnnotateSafety && moderation != nil {
+		annotations.Safety = summarizeModeration(moderation)
+	}
+	return annotations
+}
+
+// summarizeModeration reduces a moderation result to the highest score seen for every category
+func summarizeModeration(moderation *openai.ModerationResponse) map[string]float32 {
+	summary := make(map[string]float32)
+	for _, result := range moderation.Results {
+		for category, score := range moderationScores(result) {
+			if score > summary[category] {
+				summary[category] = score
+			}
+		}
+	}
+	return summary
+}
+
+// getLanguageStopwords returns a read-only map of language codes to common words to imitate const map.
+func getLanguageStopwords() map[string][]string {
+	return map[string][]string{
+		"en": {"the", "and", "is", "of", "to", "in", "that", "it", "you", "for", "with", "are", "this"},
+		"es": {"el", "la", "de", "que", "y", "en", "los", "es", "por", "con", "una", "para", "las"},
+		"fr": {"le", "la", "les", "et", "est", "des", "que", "une", "pour", "dans", "pas", "vous", "du"},
+		"de": {"der", "die", "und", "das", "ist", "nicht", "ich", "sie", "mit", "den", "ein", "zu", "auch"},
+		"it": {"il", "di", "che", "e", "la", "non", "per", "un", "sono", "una", "con", "gli", "della"},
+		"pt": {"o", "de", "que", "e", "não", "os", "uma", "para", "com", "do", "da", "em", "você"},
+		"nl": {"de", "het", "een", "en", "van", "is", "niet", "dat", "ik", "je", "met", "op", "zijn"},
+	}
+}
+
+// getLanguageScripts returns a read-only map of language codes to the Unicode script identifying them to imitate const map.
+func getLanguageScripts() map[string]*unicode.RangeTable {
+	return map[string]*unicode.RangeTable{
+		"ru": unicode.Cyrillic,
+		"el": unicode.Greek,
+		"ar": unicode.Arabic,
+		"he": unicode.Hebrew,
+		"hi": unicode.Devanagari,
+		"th": unicode.Thai,
+		"ko": unicode.Hangul,
+		"zh": unicode.Han,
+	}
+}
+
+// detectLanguage makes a cheap guess of the language of s, first by script and then by stopword frequency.
+// It returns "und" when no language can be determined.
+func detectLanguage(s string) string {
+	if len(s) > maxAnnotationChars {
+		s = s[:maxAnnotationChars]
+	}
+
+	// Count letters per script
+	var letters, kana int
+	scriptCounts := make(map[string]int)
+	scripts := getLanguageScripts()
+	for _, ch := range s {
+		if !unicode.IsLetter(ch) {
+			continue
+		}
+		letters++
+		if unicode.In(ch, unicode.Hiragana, unicode.Katakana) {
+			kana++
+		}
+		for code, table := range scripts {
+			if unicode.Is(table, ch) {
+				scriptCounts[code]++
+			}
+		}
+	}
+	if letters == 0 {
+		return undeterminedLanguage
+	}
+	// Japanese text mixes kana with Han characters, so any kana decides between the two
+	if kana > 0 {
+		scriptCounts["ja"] = kana + scriptCounts["zh"]
+		delete(scriptCounts, "zh")
+	}
+	if code, count := maxCount(scriptCounts); count*2 > letters {
+		return code
+	}
+
+	// Fall back to stopword matching for Latin script languages
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	wordCounts := make(map[string]int)
+	for _, word := range words {
+		wordCounts[word]++
+	}
+	hits := make(map[string]int)
+	for code, stopwords := range getLanguageStopwords() {
+		for _, stopword := range stopwords {
+			hits[code] += wordCounts[stopword]
+		}
+	}
+	if code, count := maxCount(hits); count >= minStopwordHits {
+		return code
+	}
+	return undeterminedLanguage
+}
+
+// maxCount returns the key with the highest count, breaking ties by key order for deterministic results
+func maxCount(counts map[string]int) (string, int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var bestKey string
+	var best int
+	for _, key := range keys {
+		if counts[key] > best {
+			bestKey, best = key, counts[key]
+		}
+	}
+	return bestKey, best
+}
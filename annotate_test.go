@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	tests := []struct {
+		value        string
+		wantLanguage bool
+		wantSafety   bool
+		wantErr      bool
+	}{
+		{value: ""},
+		{value: "language", wantLanguage: true},
+		{value: "safety", wantSafety: true},
+		{value: " Language , SAFETY ", wantLanguage: true, wantSafety: true},
+		{value: "language,", wantLanguage: true},
+		{value: "language,sentiment", wantErr: true},
+	}
+	for _, tt := range tests {
+		language, safety, err := parseAnnotations(tt.value)
+		if (err != nil) != tt.wantErr || language != tt.wantLanguage || safety != tt.wantSafety {
+			t.Errorf("parseAnnotations(%q) = %v, %v, %v", tt.value, language, safety, err)
+		}
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "The answer is in the second part of the book", want: "en"},
+		{text: "La respuesta está en la segunda parte de los libros", want: "es"},
+		{text: "Die Antwort ist nicht in dem Buch und auch nicht hier", want: "de"},
+		{text: "Ответ находится во второй части книги", want: "ru"},
+		{text: "答えは本の第二部にあります", want: "ja"},
+		{text: "答案在书的第二部分", want: "zh"},
+		{text: "42", want: undeterminedLanguage},
+		{text: "Hello", want: undeterminedLanguage},
+		{text: "", want: undeterminedLanguage},
+		{text: strings.Repeat("x", maxAnnotationChars) + " the and the and", want: undeterminedLanguage},
+	}
+	for _, tt := range tests {
+		if got := detectLanguage(tt.text); got != tt.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestSummarizeModeration(t *testing.T) {
+	moderation := &openai.ModerationResponse{Results: []openai.Result{
+		{CategoryScores: openai.ResultCategoryScores{Hate: 0.2, Violence: 0.1}},
+		{CategoryScores: openai.ResultCategoryScores{Hate: 0.1, Violence: 0.7}},
+	}}
+	summary := summarizeModeration(moderation)
+	if summary["hate"] != 0.2 || summary["violence"] != 0.7 || summary["sexual"] != 0 {
+		t.Fatalf("summarizeModeration() = %v", summary)
+	}
+}
+
+// TestAnnotations checks that the safety summary comes from the moderation of the input, with exactly one
+// moderation call per completion when MODERATION is on and none when it is off
+func TestAnnotations(t *testing.T) {
+	tests := []struct {
+		name            string
+		annotate        string
+		moderation      bool
+		wantLanguage    string
+		wantSafety      bool
+		wantModerations int
+	}{
+		{name: "disabled"},
+		{name: "language", annotate: "language", wantLanguage: "en"},
+		{name: "safety", annotate: "safety", moderation: true, wantSafety: true, wantModerations: 1},
+		{name: "both", annotate: "language,safety", moderation: true, wantLanguage: "en", wantSafety: true, wantModerations: 1},
+		{name: "safety without moderation", annotate: "safety"},
+		{name: "moderation without safety", moderation: true, wantModerations: 1},
+	}
+	for _, tt := range tests {
+		for _, responseType := range []string{"full", "stream"} {
+			t.Run(tt.name+" "+responseType, func(t *testing.T) {
+				cfg := testConfig(t, func(cfg *Config) {
+					cfg.AnnotateLanguage, cfg.AnnotateSafety, _ = parseAnnotations(tt.annotate)
+					cfg.Moderation = tt.moderation
+				})
+				answer := "The answer is in the second part of the book"
+				chat := testsupport.NewScriptedCompleter(testsupport.Reply(answer))
+				chat.Moderation = openai.ModerationResponse{Results: []openai.Result{{CategoryScores: openai.ResultCategoryScores{Violence: 0.25}}}}
+				body := `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","include_usage":true,"messages":[{"role":"user","content":"Where is it?"}]}`
+				response, poster := runTestRequest(t, cfg, chat, body)
+				if response.StatusCode != statusCodeOK {
+					t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+				}
+
+				var usage usageFrame
+				for _, text := range poster.Texts() {
+					if strings.Contains(text, `"type":"usage"`) {
+						if err := json.Unmarshal([]byte(text), &usage); err != nil {
+							t.Fatalf("can't decode usage frame %s: %v", text, err)
+						}
+					}
+				}
+				if usage.Type == "" {
+					t.Fatalf("no usage frame in %q", poster.Texts())
+				}
+				var got outputAnnotations
+				if usage.Annotations != nil {
+					got = *usage.Annotations
+				}
+				if got.Language != tt.wantLanguage || (got.Safety != nil) != tt.wantSafety {
+					t.Fatalf("annotations = %+v", got)
+				}
+				if tt.wantSafety && got.Safety["violence"] != 0.25 {
+					t.Fatalf("safety = %v, want the scores of the moderation result", got.Safety)
+				}
+				moderations := chat.ModerationRequests()
+				if len(moderations) != tt.wantModerations {
+					t.Fatalf("%d moderation calls, want %d", len(moderations), tt.wantModerations)
+				}
+				if len(moderations) > 0 && !reflect.DeepEqual(moderations[0].Input, "Where is it?") {
+					t.Fatalf("moderated %v, want the user input", moderations[0].Input)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	providerAnthropic       = "anthropic"
+	defaultAnthropicModel   = "claude-3-5-sonnet-latest"
+	anthropicMessagesURL    = "https://api.anthropic.com/v1/messages"
+	anthropicAPIVersion     = "2023-06-01"
+	anthropicStatusOverload = 529
+	// maxAnthropicEventBytes bounds one line of the Anthropic event stream
+	maxAnthropicEventBytes = 1024 * 1024
+)
+
+// defaultAnthropicAllowedModels are the models ANTHROPIC_MODEL may name when ANTHROPIC_ALLOWED_MODELS isn't set
+var defaultAnthropicAllowedModels = []string{
+	"claude-3-5-sonnet-latest",
+	"claude-3-5-haiku-latest",
+	"claude-3-7-sonnet-latest",
+	"claude-sonnet-4-0",
+	"claude-opus-4-0",
+}
+
+// anthropicRequest is the body of an Anthropic messages request, sent to the Anthropic API or to Bedrock
+type anthropicRequest struct {
+	AnthropicVersion string             `json:"anthropic_version,omitempty"` // Set for Bedrock, the Anthropic API takes it as a header
+	Model            string             `json:"model,omitempty"`             // Set for the Anthropic API, Bedrock takes it in the URL
+	System           string             `json:"system,omitempty"`
+	Messages         []anthropicMessage `json:"messages"`
+	MaxTokens        int                `json:"max_tokens"`
+	Temperature      *float32           `json:"temperature,omitempty"`
+	TopP             *float32           `json:"top_p,omitempty"`
+	StopSequences    []string           `json:"stop_sequences,omitempty"`
+	Stream           bool               `json:"stream,omitempty"`
+}
+
+// anthropicMessage is one turn of an Anthropic conversation
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// anthropicUsage is the token usage reported by Anthropic models
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// anthropicResponse is the body of an Anthropic messages response
+type anthropicResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Content []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+// anthropicError is the error body of the Anthropic API, also sent as an error event in streams
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicStreamEvent is one event of an Anthropic messages stream
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Message struct {
+		Model string         `json:"model"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	Delta struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage anthropicUsage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// newAnthropicRequest converts a chat request to an Anthropic messages request. System messages, including the
+// resolved prompt template, are moved to the system field, and consecutive messages of the same role are merged
+// since Anthropic requires the roles to alternate. max_tokens is required by Anthropic, so maxTokens is used
+// when the chat request doesn't set it. A final assistant message is sent as a prefill.
+func newAnthropicRequest(request openai.ChatCompletionRequest, maxTokens int) anthropicRequest {
+	body := anthropicRequest{MaxTokens: maxTokens}
+	var system []string
+	for _, message := range request.Messages {
+		if message.Role == openai.ChatMessageRoleSystem || message.Role == openai.ChatMessageRoleDeveloper {
+			system = append(system, message.Content)
+			continue
+		}
+		if last := len(body.Messages) - 1; last >= 0 && body.Messages[last].Role == message.Role {
+			body.Messages[last].Content += "\n\n" + message.Content
+			continue
+		}
+		body.Messages = append(body.Messages, anthropicMessage{Role: message.Role, Content: message.Content})
+	}
+	// A final assistant message is a prefill the model continues from
+	if last := len(body.Messages) - 1; last >= 0 && body.Messages[last].Role == openai.ChatMessageRoleAssistant {
+		body.Messages[last].Content = anthropicPrefill(request)
+	}
+	body.System = strings.Join(system, "\n\n")
+	if request.MaxTokens > 0 {
+		body.MaxTokens = request.MaxTokens
+	} else if request.MaxCompletionTokens > 0 {
+		body.MaxTokens = request.MaxCompletionTokens
+	}
+	if request.Temperature != 0 {
+		temperature := request.Temperature
+		body.Temperature = &temperature
+	}
+	if request.TopP != 0 {
+		topP := request.TopP
+		body.TopP = &topP
+	}
+	body.StopSequences = request.Stop
+	return body
+}
+
+// anthropicFinishReason maps an Anthropic stop reason to the OpenAI finish reason
+func anthropicFinishReason(stopReason string) openai.FinishReason {
+	switch stopReason {
+	case "":
+		return ""
+	case "max_tokens":
+		return openai.FinishReasonLength
+	default:
+		return openai.FinishReasonStop
+	}
+}
+
+// parseAnthropicResponse converts an Anthropic messages response to a chat completion response. The answer
+// starts with the prefill, which Anthropic leaves out of the continuation.
+func parseAnthropicResponse(data []byte, prefill string) (openai.ChatCompletionResponse, error) {
+	var response anthropicResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't decode Anthropic response: %v", err)
+	}
+	var text strings.Builder
+	text.WriteString(prefill)
+	for _, block := range response.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return openai.ChatCompletionResponse{
+		ID:      response.ID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   response.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: text.String()},
+			FinishReason: anthropicFinishReason(response.StopReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     response.Usage.InputTokens,
+			CompletionTokens: response.Usage.OutputTokens,
+			TotalTokens:      response.Usage.InputTokens + response.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// anthropicStreamState converts the events of an Anthropic messages stream to the chunks of an OpenAI stream.
+// Text deltas become content chunks, the stop reason a finish reason chunk, and the token counts are delivered
+// in a final usage chunk without choices, as OpenAI does with include_usage.
+type anthropicStreamState struct {
+	model    string
+	prefill  string // Put in front of the first text delta, Anthropic streams only the continuation
+	usage    openai.Usage
+	finished bool
+}
+
+// handleEvent converts one stream event, reporting false for events without a chunk of their own
+func (s *anthropicStreamState) handleEvent(payload []byte) (openai.ChatCompletionStreamResponse, bool, error) {
+	var event anthropicStreamEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return openai.ChatCompletionStreamResponse{}, false, fmt.Errorf("Can't decode Anthropic stream event: %v", err)
+	}
+	chunk := openai.ChatCompletionStreamResponse{Object: "chat.completion.chunk", Model: s.model}
+	switch event.Type {
+	case "message_start":
+		if event.Message.Model != "" {
+			s.model = event.Message.Model
+		}
+		s.usage.PromptTokens = event.Message.Usage.InputTokens
+		return chunk, false, nil
+	case "content_block_delta":
+		if event.Delta.Type != "text_delta" {
+			return chunk, false, nil
+		}
+		text := s.prefill + event.Delta.Text
+		s.prefill = ""
+		chunk.Choices = []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: text}}}
+		return chunk, true, nil
+	case "message_delta":
+		s.usage.CompletionTokens = event.Usage.OutputTokens
+		chunk.Choices = []openai.ChatCompletionStreamChoice{{FinishReason: anthropicFinishReason(event.Delta.StopReason)}}
+		return chunk, true, nil
+	case "message_stop":
+		s.finished = true
+		s.usage.TotalTokens = s.usage.PromptTokens + s.usage.CompletionTokens
+		usage := s.usage
+		chunk.Usage = &usage
+		return chunk, true, nil
+	case "error":
+		return chunk, false, anthropicAPIError(http.StatusInternalServerError, event.Error.Type, event.Error.Message)
+	}
+	return chunk, false, nil
+}
+
+// anthropicAPIError normalises an Anthropic error into an OpenAI API error, so retries, fallbacks and the error
+// frames treat both providers alike. Overloaded errors are reported as 503.
+func anthropicAPIError(statusCode int, errorType string, message string) *openai.APIError {
+	if statusCode == anthropicStatusOverload || errorType == "overloaded_error" {
+		statusCode = http.StatusServiceUnavailable
+	}
+	return &openai.APIError{Code: errorType, Type: errorType, Message: message, HTTPStatusCode: statusCode}
+}
+
+// anthropicChatCompleter is the ChatCompleter backed by the Anthropic API. Every request goes to
+// ANTHROPIC_MODEL whatever model it names, so summaries and fallbacks stay on Anthropic too. Moderation
+// is left to the OpenAI moderation endpoint.
+type anthropicChatCompleter struct {
+	httpClient *http.Client
+	apiKey     string
+	model      string
+	maxTokens  int
+	moderator  ChatCompleter
+}
+
+// send posts an Anthropic messages request, turning error responses into OpenAI API errors
+func (c anthropicChatCompleter) send(ctx context.Context, request openai.ChatCompletionRequest, stream bool) (*http.Response, error) {
+	body := newAnthropicRequest(request, c.maxTokens)
+	body.Model = c.model
+	body.Stream = stream
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("Can't encode Anthropic request: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, anthropicMessagesURL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr anthropicError
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &apiErr); err != nil || apiErr.Error.Message == "" {
+			return nil, anthropicAPIError(resp.StatusCode, "", fmt.Sprintf("Anthropic API returned status %d", resp.StatusCode))
+		}
+		return nil, anthropicAPIError(resp.StatusCode, apiErr.Error.Type, apiErr.Error.Message)
+	}
+	return resp, nil
+}
+
+// CreateChatCompletion sends the chat request to the Anthropic API and waits for the complete answer
+func (c anthropicChatCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := c.send(ctx, request, false)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return parseAnthropicResponse(data, anthropicPrefill(request))
+}
+
+// CreateChatCompletionStream opens an Anthropic event stream
+func (c anthropicChatCompleter) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error) {
+	resp, err := c.send(ctx, request, true)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxAnthropicEventBytes)
+	return &anthropicStream{body: resp.Body, scanner: scanner, state: anthropicStreamState{model: c.model, prefill: anthropicPrefill(request)}}, nil
+}
+
+// ListModels lists the one Anthropic model requests are sent to
+func (c anthropicChatCompleter) ListModels(ctx context.Context) (openai.ModelsList, error) {
+	return openai.ModelsList{Models: []openai.Model{{ID: c.model}}}, nil
+}
+
+// Moderations sends the moderation request to the OpenAI moderation endpoint
+func (c anthropicChatCompleter) Moderations(ctx context.Context, request openai.ModerationRequest) (openai.ModerationResponse, error) {
+	return c.moderator.Moderations(ctx, request)
+}
+
+// anthropicStream reads the server-sent events of an Anthropic messages stream
+type anthropicStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	state   anthropicStreamState
+}
+
+// Recv returns the next chunk, or io.EOF after the usage chunk
+func (s *anthropicStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for !s.state.finished {
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return openai.ChatCompletionStreamResponse{}, err
+			}
+			return openai.ChatCompletionStreamResponse{}, io.ErrUnexpectedEOF
+		}
+		// Every event carries its type in the data too, so the event lines can be skipped
+		payload, ok := strings.CutPrefix(s.scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		chunk, emit, err := s.state.handleEvent([]byte(strings.TrimSpace(payload)))
+		if err != nil {
+			return openai.ChatCompletionStreamResponse{}, err
+		}
+		if emit {
+			return chunk, nil
+		}
+	}
+	return openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+// Close closes the Anthropic event stream
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
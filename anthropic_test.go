@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testAnthropicModel = "claude-3-5-haiku-latest"
+
+// anthropicFixture is a fake Anthropic messages API answering with text, streamed in two deltas, or with status
+// and an error body
+type anthropicFixture struct {
+	text      string
+	status    int
+	errorType string
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   []anthropicRequest
+}
+
+func (f *anthropicFixture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body anthropicRequest
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	f.bodies = append(f.bodies, body)
+	f.mu.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		fmt.Fprintf(w, `{"type":"error","error":{"type":%q,"message":"Anthropic failed"}}`, f.errorType)
+		return
+	}
+	if !body.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":          "msg-1",
+			"model":       testAnthropicModel,
+			"content":     []map[string]string{{"type": "text", "text": f.text}},
+			"stop_reason": "end_turn",
+			"usage":       anthropicUsage{InputTokens: 10, OutputTokens: 2},
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	event := func(payload string) {
+		var typed struct{ Type string }
+		json.Unmarshal([]byte(payload), &typed)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, payload)
+	}
+	event(`{"type":"message_start","message":{"model":"` + testAnthropicModel + `","usage":{"input_tokens":10}}}`)
+	event(`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`)
+	half := len(f.text) / 2
+	for _, text := range []string{f.text[:half], f.text[half:]} {
+		data, _ := json.Marshal(text)
+		event(`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":` + string(data) + `}}`)
+	}
+	event(`{"type":"content_block_stop","index":0}`)
+	event(`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`)
+	event(`{"type":"message_stop"}`)
+}
+
+// newAnthropicHandler returns a handler sending the requests of the anthropic provider to fixture
+func newAnthropicHandler(t *testing.T, fixture *anthropicFixture, chat ChatCompleter, poster ConnectionPoster) *WebsocketHandler {
+	t.Helper()
+	server := httptest.NewServer(fixture)
+	t.Cleanup(server.Close)
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.AllowedProviders = map[string]bool{providerOpenAI: true, providerAnthropic: true}
+		cfg.AnthropicKey = "sk-ant-test"
+		cfg.AnthropicModel = testAnthropicModel
+		cfg.ReservedCompletionTokens = 512
+		cfg.OpenAIMaxRetries = 0
+		cfg.EndStreamMessage = "<END>"
+		cfg.StreamFlushInterval = 0
+	})
+	h := newTestHandler(cfg, chat, poster, nil, nil)
+	base, _ := url.Parse(server.URL)
+	h.httpClient = &http.Client{Transport: rewriteTransport{base: base}}
+	return h
+}
+
+func TestAnthropicFinishReason(t *testing.T) {
+	tests := map[string]openai.FinishReason{
+		"":              "",
+		"end_turn":      openai.FinishReasonStop,
+		"stop_sequence": openai.FinishReasonStop,
+		"max_tokens":    openai.FinishReasonLength,
+	}
+	for stopReason, want := range tests {
+		if got := anthropicFinishReason(stopReason); got != want {
+			t.Errorf("anthropicFinishReason(%q) = %q, want %q", stopReason, got, want)
+		}
+	}
+}
+
+func TestAnthropicAPIError(t *testing.T) {
+	tests := []struct {
+		status     int
+		errorType  string
+		wantStatus int
+	}{
+		{status: http.StatusBadRequest, errorType: "invalid_request_error", wantStatus: http.StatusBadRequest},
+		{status: http.StatusTooManyRequests, errorType: "rate_limit_error", wantStatus: http.StatusTooManyRequests},
+		{status: anthropicStatusOverload, errorType: "overloaded_error", wantStatus: http.StatusServiceUnavailable},
+		// An overloaded error event of a stream arrives with the status of the opened stream
+		{status: http.StatusInternalServerError, errorType: "overloaded_error", wantStatus: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.errorType, func(t *testing.T) {
+			err := anthropicAPIError(tt.status, tt.errorType, "failed")
+			if err.HTTPStatusCode != tt.wantStatus || err.Code != tt.errorType || err.Message != "failed" {
+				t.Errorf("anthropicAPIError() = %+v, want status %d", err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestParseAnthropicResponse(t *testing.T) {
+	data := `{"id":"msg-1","model":"claude-test","content":[{"type":"text","text":"Hel"},{"type":"tool_use","id":"tool-1"},{"type":"text","text":"lo"}],"stop_reason":"max_tokens","usage":{"input_tokens":10,"output_tokens":2}}`
+	got, err := parseAnthropicResponse([]byte(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Model != "claude-test" || got.Choices[0].Message.Content != "Hello" || got.Choices[0].FinishReason != openai.FinishReasonLength {
+		t.Errorf("parseAnthropicResponse() = %+v, want Hello cut at the length", got)
+	}
+	if want := (openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}); got.Usage != want {
+		t.Errorf("usage = %+v, want %+v", got.Usage, want)
+	}
+	if _, err := parseAnthropicResponse([]byte("not JSON"), ""); err == nil {
+		t.Error("parseAnthropicResponse() accepted a body that isn't JSON")
+	}
+}
+
+func TestAnthropicStreamState(t *testing.T) {
+	state := anthropicStreamState{model: testAnthropicModel}
+	var texts []string
+	var finish openai.FinishReason
+	var usage *openai.Usage
+	for _, event := range []string{
+		`{"type":"message_start","message":{"model":"claude-test","usage":{"input_tokens":10}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"input_json_delta","partial_json":"{"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"lo"}}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":2}}`,
+		`{"type":"message_stop"}`,
+	} {
+		chunk, ok, err := state.handleEvent([]byte(event))
+		if err != nil {
+			t.Fatalf("handleEvent(%s) error = %v", event, err)
+		}
+		if !ok {
+			continue
+		}
+		if chunk.Model != "claude-test" {
+			t.Errorf("chunk model = %q, want the model of message_start", chunk.Model)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				texts = append(texts, choice.Delta.Content)
+			}
+			if choice.FinishReason != "" {
+				finish = choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	if !reflect.DeepEqual(texts, []string{"Hel", "lo"}) || finish != openai.FinishReasonStop || !state.finished {
+		t.Errorf("texts = %q, finish reason = %q, finished %v, want Hel lo stopped", texts, finish, state.finished)
+	}
+	if usage == nil || *usage != (openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}) {
+		t.Errorf("usage = %+v, want 10, 2 and 12", usage)
+	}
+
+	_, _, err := state.handleEvent([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("error event = %v, want a 503 API error", err)
+	}
+}
+
+// TestAnthropicRequests sends full and stream requests of the anthropic provider through the output pipeline
+func TestAnthropicRequests(t *testing.T) {
+	tests := []struct {
+		responseType string
+		wantFrames   []string
+	}{
+		{responseType: responseTypeFull, wantFrames: []string{`"Hello"`}},
+		{responseType: responseTypeStream, wantFrames: []string{`"He`, `llo"`, "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			fixture := &anthropicFixture{text: "“Hello”"}
+			chat := testsupport.NewScriptedCompleter()
+			poster := testsupport.NewRecordingPoster()
+			h := newAnthropicHandler(t, fixture, chat, poster)
+			body := `{"provider":"anthropic","response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[` +
+				`{"role":"user","content":"Hi"},{"role":"user","content":"Greet me"}]}`
+			response, err := h.Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+			}
+			// The confusables replacement and the end marker apply as for OpenAI
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the anthropic request reached OpenAI")
+			}
+			if len(fixture.requests) != 1 {
+				t.Fatalf("Anthropic requests = %d, want 1", len(fixture.requests))
+			}
+			request, sent := fixture.requests[0], fixture.bodies[0]
+			if request.URL.Path != "/v1/messages" || request.Header.Get("x-api-key") != "sk-ant-test" || request.Header.Get("anthropic-version") != anthropicAPIVersion {
+				t.Errorf("request = %s with x-api-key %q and anthropic-version %q", request.URL.Path, request.Header.Get("x-api-key"), request.Header.Get("anthropic-version"))
+			}
+			want := anthropicRequest{
+				Model:     testAnthropicModel,
+				System:    "You are a test assistant.",
+				Messages:  []anthropicMessage{{Role: "user", Content: "Hi\n\nGreet me"}},
+				MaxTokens: 512,
+				Stream:    tt.responseType == responseTypeStream,
+			}
+			sent.Temperature, sent.TopP = nil, nil
+			if !reflect.DeepEqual(sent, want) {
+				t.Errorf("Anthropic request = %+v, want %+v", sent, want)
+			}
+		})
+	}
+}
+
+// TestAnthropicErrors checks that Anthropic errors get the response and the frames of the same OpenAI errors
+func TestAnthropicErrors(t *testing.T) {
+	tests := []struct {
+		status    int
+		errorType string
+		openAIErr *openai.APIError
+	}{
+		{status: http.StatusBadRequest, errorType: "invalid_request_error", openAIErr: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}},
+		{status: http.StatusUnauthorized, errorType: "authentication_error", openAIErr: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}},
+		{status: http.StatusTooManyRequests, errorType: "rate_limit_error", openAIErr: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}},
+		{status: anthropicStatusOverload, errorType: "overloaded_error", openAIErr: &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}},
+		{status: http.StatusInternalServerError, errorType: "api_error", openAIErr: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}},
+	}
+	for _, tt := range tests {
+		for _, responseType := range []string{responseTypeFull, responseTypeStream} {
+			t.Run(tt.errorType+" "+responseType, func(t *testing.T) {
+				run := func(provider string, chat *testsupport.ScriptedCompleter) (events.APIGatewayProxyResponse, []string) {
+					t.Helper()
+					poster := testsupport.NewRecordingPoster()
+					h := newAnthropicHandler(t, &anthropicFixture{status: tt.status, errorType: tt.errorType}, chat, poster)
+					body := `{"provider":"` + provider + `","response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+					response, err := h.Handler(context.Background(), testMessage(body))
+					if err != nil {
+						t.Fatal(err)
+					}
+					return response, poster.Texts()
+				}
+				tt.openAIErr.Code, tt.openAIErr.Type, tt.openAIErr.Message = tt.errorType, tt.errorType, "Anthropic failed"
+				wantResponse, wantFrames := run(providerOpenAI, testsupport.NewScriptedCompleter(testsupport.Fail(tt.openAIErr)))
+				gotResponse, gotFrames := run(providerAnthropic, testsupport.NewScriptedCompleter())
+				if gotResponse.StatusCode != wantResponse.StatusCode || gotResponse.Body != wantResponse.Body {
+					t.Errorf("Handler() = %d %s, want %d %s as for OpenAI", gotResponse.StatusCode, gotResponse.Body, wantResponse.StatusCode, wantResponse.Body)
+				}
+				if !reflect.DeepEqual(gotFrames, wantFrames) || len(gotFrames) == 0 {
+					t.Errorf("frames = %q, want %q as for OpenAI", gotFrames, wantFrames)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadConfigAnthropic(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		wantModel string
+		wantErr   string
+	}{
+		{name: "default model", env: map[string]string{"ANTHROPIC_API_KEY": "sk-ant-test"}, wantModel: defaultAnthropicModel},
+		{name: "allowed model", env: map[string]string{"ANTHROPIC_API_KEY": "sk-ant-test", "ANTHROPIC_MODEL": "claude-3-5-haiku-latest"}, wantModel: "claude-3-5-haiku-latest"},
+		{name: "custom allow list", env: map[string]string{"ANTHROPIC_API_KEY": "sk-ant-test", "ANTHROPIC_MODEL": "claude-next", "ANTHROPIC_ALLOWED_MODELS": "claude-next"}, wantModel: "claude-next"},
+		{name: "model not allowed", env: map[string]string{"ANTHROPIC_API_KEY": "sk-ant-test", "ANTHROPIC_MODEL": "claude-next"}, wantErr: "ANTHROPIC_ALLOWED_MODELS"},
+		{name: "no key", env: map[string]string{}, wantErr: "ANTHROPIC_API_KEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_PROVIDERS", "openai,anthropic")
+			for _, name := range []string{"ANTHROPIC_API_KEY", "ANTHROPIC_MODEL", "ANTHROPIC_ALLOWED_MODELS"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadConfig() error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || cfg.AnthropicModel != tt.wantModel {
+				t.Errorf("loadConfig() = %q, %v, want %q", cfg.AnthropicModel, err, tt.wantModel)
+			}
+		})
+	}
+}
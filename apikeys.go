@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultOpenAIKeyCooldown = 60 * time.Second
+	// openAIKeySuffixLength is how much of a key logs and metrics show
+	openAIKeySuffixLength = 4
+)
+
+// openAIKeyPool spreads requests over the keys of OPENAI_API_KEYS round-robin. A key the OpenAI API rejected
+// or rate limited is skipped for OPENAI_KEY_COOLDOWN_SECONDS. Like the circuit breaker, the state lives in
+// the execution environment, so each Lambda container only skips the keys that failed its own requests.
+type openAIKeyPool struct {
+	mu       sync.Mutex
+	next     int
+	failedAt map[string]time.Time
+	nowFunc  func() time.Time
+}
+
+var openAIKeys = &openAIKeyPool{failedAt: map[string]time.Time{}, nowFunc: time.Now}
+
+// pick returns the key the next request is sent with, empty unless OPENAI_API_KEYS lists several keys.
+// When every key is cooling down, the key that failed the longest time ago is tried.
+func (p *openAIKeyPool) pick(cfg *Config) string {
+	keys := cfg.OpenAIKeys
+	if len(keys) < 2 {
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.nowFunc()
+	oldest := ""
+	for i := range keys {
+		key := keys[(p.next+i)%len(keys)]
+		failedAt, failed := p.failedAt[key]
+		if !failed || now.Sub(failedAt) >= cfg.OpenAIKeyCooldown {
+			p.next = (p.next + i + 1) % len(keys)
+			return key
+		}
+		if oldest == "" || failedAt.Before(p.failedAt[oldest]) {
+			oldest = key
+		}
+	}
+	return oldest
+}
+
+// record notes the outcome of a request sent with key. A 401 or 429 starts the cooldown of the key, an answer ends it.
+func (p *openAIKeyPool) record(key string, err error) {
+	if key == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case isKeyFailureError(err):
+		p.failedAt[key] = p.nowFunc()
+	case err == nil:
+		delete(p.failedAt, key)
+	}
+}
+
+// isKeyFailureError checks if the OpenAI API rejected or rate limited the key itself
+func isKeyFailureError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusUnauthorized || apiErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode == http.StatusUnauthorized || requestErr.HTTPStatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// openAIKeySuffix returns the last characters of a key, which is all of it logs and metrics may show
+func openAIKeySuffix(key string) string {
+	if len(key) <= 2*openAIKeySuffixLength {
+		return ""
+	}
+	return key[len(key)-openAIKeySuffixLength:]
+}
+
+// getKeyedChatCompleter returns the OpenAI client backed ChatCompleter sending requests with one of the keys of OPENAI_API_KEYS
+func (h *WebsocketHandler) getKeyedChatCompleter(cfg *Config, key string) ChatCompleter {
+	completers := h.openAIKeyClients.get(cfg, func(cfg *Config) map[string]ChatCompleter {
+		completers := make(map[string]ChatCompleter, len(cfg.OpenAIKeys))
+		for _, key := range cfg.OpenAIKeys {
+			keyed := *cfg
+			keyed.OpenAIKey = key
+			completers[key] = openAIChatCompleter{Client: openai.NewClientWithConfig(newOpenAIClientConfig(&keyed, h.httpClient))}
+		}
+		return completers
+	})
+	return completers[key]
+}
+
+// withOpenAIKey returns a copy of the request sent with the key picked from OPENAI_API_KEYS, logging with ctx
+func (h *WebsocketHandler) withOpenAIKey(ctx context.Context, openAIRequest openAIRequest, key string) openAIRequest {
+	openAIRequest.ctx = ctx
+	openAIRequest.apiKey = key
+	openAIRequest.chat = h.getKeyedChatCompleter(openAIRequest.config, key)
+	if openAIRequest.metrics != nil {
+		openAIRequest.metrics.apiKey = openAIKeySuffix(key)
+	}
+	return openAIRequest
+}
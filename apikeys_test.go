@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const (
+	testKeyA = "sk-test-key-aaaa1111"
+	testKeyB = "sk-test-key-bbbb2222"
+	testKeyC = "sk-test-key-cccc3333"
+)
+
+// useTestKeyPool replaces the key pool of the container by an empty one running on clock for the test
+func useTestKeyPool(t *testing.T, clock *testsupport.Clock) *openAIKeyPool {
+	t.Helper()
+	original := openAIKeys
+	t.Cleanup(func() { openAIKeys = original })
+	openAIKeys = &openAIKeyPool{failedAt: map[string]time.Time{}, nowFunc: clock.Now}
+	return openAIKeys
+}
+
+// keyStep is a step of a key pool test: a pick expecting want, a recorded outcome of key, or a clock advance
+type keyStep struct {
+	want    string
+	key     string
+	err     error
+	advance time.Duration
+}
+
+func pickStep(want string) keyStep                { return keyStep{want: want} }
+func recordKeyStep(key string, err error) keyStep { return keyStep{key: key, err: err} }
+func advanceStep(d time.Duration) keyStep         { return keyStep{advance: d} }
+
+func TestOpenAIKeyPool(t *testing.T) {
+	rateLimited := &openai.APIError{HTTPStatusCode: 429, Message: "rate limited"}
+	rejected := &openai.RequestError{HTTPStatusCode: 401}
+	tests := []struct {
+		name  string
+		keys  []string
+		steps []keyStep
+	}{
+		{name: "single key", keys: []string{testKeyA}, steps: []keyStep{pickStep(""), pickStep("")}},
+		{name: "round-robin", keys: []string{testKeyA, testKeyB, testKeyC}, steps: []keyStep{pickStep(testKeyA), pickStep(testKeyB), pickStep(testKeyC), pickStep(testKeyA)}},
+		{
+			// A rate limited key is skipped until its cooldown is over
+			name: "cooldown",
+			keys: []string{testKeyA, testKeyB},
+			steps: []keyStep{
+				pickStep(testKeyA), recordKeyStep(testKeyA, rateLimited),
+				pickStep(testKeyB), pickStep(testKeyB), advanceStep(59 * time.Second), pickStep(testKeyB),
+				advanceStep(time.Second), pickStep(testKeyA), pickStep(testKeyB),
+			},
+		},
+		{
+			name:  "rejected key",
+			keys:  []string{testKeyA, testKeyB},
+			steps: []keyStep{recordKeyStep(testKeyA, rejected), pickStep(testKeyB), pickStep(testKeyB)},
+		},
+		{
+			// When every key is cooling down the one that failed first is the likeliest to work again
+			name: "every key cooling down",
+			keys: []string{testKeyA, testKeyB, testKeyC},
+			steps: []keyStep{
+				recordKeyStep(testKeyB, rateLimited), advanceStep(time.Second), recordKeyStep(testKeyC, rateLimited),
+				advanceStep(time.Second), recordKeyStep(testKeyA, rateLimited), pickStep(testKeyB), pickStep(testKeyB),
+			},
+		},
+		{
+			name:  "answer ends the cooldown",
+			keys:  []string{testKeyA, testKeyB},
+			steps: []keyStep{recordKeyStep(testKeyA, rateLimited), recordKeyStep(testKeyA, nil), pickStep(testKeyA), pickStep(testKeyB), pickStep(testKeyA)},
+		},
+		{
+			// Other failures say nothing about the key
+			name:  "other failure",
+			keys:  []string{testKeyA, testKeyB},
+			steps: []keyStep{recordKeyStep(testKeyA, &openai.APIError{HTTPStatusCode: 500}), pickStep(testKeyA), pickStep(testKeyB), pickStep(testKeyA)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testsupport.NewClock(testStart)
+			pool := useTestKeyPool(t, clock)
+			cfg := &Config{OpenAIKeys: tt.keys, OpenAIKeyCooldown: time.Minute}
+			for i, step := range tt.steps {
+				switch {
+				case step.advance > 0:
+					clock.Advance(step.advance)
+				case step.key != "":
+					pool.record(step.key, step.err)
+				default:
+					if got := pool.pick(cfg); got != step.want {
+						t.Fatalf("step %d: pick() = %q, want %q", i, got, step.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestIsKeyFailureError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: &openai.APIError{HTTPStatusCode: 429}, want: true},
+		{err: &openai.APIError{HTTPStatusCode: 401}, want: true},
+		{err: &openai.RequestError{HTTPStatusCode: 429}, want: true},
+		{err: fmt.Errorf("%w: %w", ErrOpenAIRequest, &openai.APIError{HTTPStatusCode: 401}), want: true},
+		{err: &openai.APIError{HTTPStatusCode: 500}},
+		{err: &openai.RequestError{HTTPStatusCode: 403}},
+		{err: errors.New("connection reset")},
+		{err: nil},
+	}
+	for _, tt := range tests {
+		if got := isKeyFailureError(tt.err); got != tt.want {
+			t.Errorf("isKeyFailureError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestOpenAIKeySuffix(t *testing.T) {
+	tests := map[string]string{
+		testKeyA:    "1111",
+		"sk-123456": "3456",
+		// A key too short to show any of it safely shows nothing
+		"sk-12345": "",
+		"":         "",
+	}
+	for key, want := range tests {
+		if got := openAIKeySuffix(key); got != want {
+			t.Errorf("openAIKeySuffix(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+// keyedHandler returns a handler sending the requests of each key of OPENAI_API_KEYS to its own completer
+func keyedHandler(t *testing.T, completers map[string]*testsupport.ScriptedCompleter, update func(cfg *Config)) (*WebsocketHandler, *testsupport.RecordingPoster) {
+	t.Helper()
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.OpenAIMock = false
+		cfg.OpenAIKeys = []string{testKeyA, testKeyB}
+		cfg.OpenAIKey = testKeyA
+		cfg.OpenAIKeyCooldown = time.Minute
+		cfg.OpenAIMaxRetries = 0
+		if update != nil {
+			update(cfg)
+		}
+	})
+	keyed := make(map[string]ChatCompleter, len(completers))
+	for key, chat := range completers {
+		keyed[key] = chat
+	}
+	poster := testsupport.NewRecordingPoster()
+	// Requests without a picked key would use the default client
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), poster, nil, nil)
+	h.openAIKeyClients.generation, h.openAIKeyClients.value = cfg.Generation, keyed
+	return h, poster
+}
+
+// TestOpenAIKeyRateLimited simulates a 429 on key A: the requests during its cooldown go to key B
+func TestOpenAIKeyRateLimited(t *testing.T) {
+	clock := testsupport.NewClock(testStart)
+	useTestKeyPool(t, clock)
+	chatA := testsupport.NewScriptedCompleter(testsupport.Fail(&openai.APIError{HTTPStatusCode: 429, Message: "rate limited"}), testsupport.Reply("from A"))
+	chatB := testsupport.NewScriptedCompleter(testsupport.Reply("from B"), testsupport.Reply("from B"), testsupport.Reply("from B"))
+	h, poster := keyedHandler(t, map[string]*testsupport.ScriptedCompleter{testKeyA: chatA, testKeyB: chatB}, nil)
+	body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+
+	steps := []struct {
+		advance    time.Duration
+		wantStatus int
+		wantFrame  string
+	}{
+		{wantStatus: statusCodeServerError},
+		{wantStatus: statusCodeOK, wantFrame: "from B"},
+		{wantStatus: statusCodeOK, wantFrame: "from B"},
+		{advance: 30 * time.Second, wantStatus: statusCodeOK, wantFrame: "from B"},
+		// After the cooldown key A takes its turn again
+		{advance: 31 * time.Second, wantStatus: statusCodeOK, wantFrame: "from A"},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		before := len(poster.Texts())
+		response, err := h.Handler(context.Background(), testMessage(body))
+		if err != nil || response.StatusCode != step.wantStatus {
+			t.Fatalf("request %d: Handler() = %d %s, %v, want %d", i, response.StatusCode, response.Body, err, step.wantStatus)
+		}
+		if texts := poster.Texts(); step.wantFrame != "" && (len(texts) != before+1 || texts[before] != step.wantFrame) {
+			t.Fatalf("request %d: frames = %q, want %q", i, texts[before:], step.wantFrame)
+		}
+	}
+	if len(chatA.Requests()) != 2 || len(chatB.Requests()) != 3 {
+		t.Errorf("key A got %d requests and key B %d, want 2 and 3", len(chatA.Requests()), len(chatB.Requests()))
+	}
+}
+
+// TestOpenAIKeyRejected checks that a request rejected with a 401 runs again with the next key
+func TestOpenAIKeyRejected(t *testing.T) {
+	useTestKeyPool(t, testsupport.NewClock(testStart))
+	chatA := testsupport.NewScriptedCompleter(testsupport.Fail(&openai.APIError{HTTPStatusCode: 401, Message: "invalid key"}))
+	chatB := testsupport.NewScriptedCompleter(testsupport.Reply("from B"))
+	h, poster := keyedHandler(t, map[string]*testsupport.ScriptedCompleter{testKeyA: chatA, testKeyB: chatB}, nil)
+	response, err := h.Handler(context.Background(), testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+	}
+	if texts := poster.Texts(); !slices.Equal(texts, []string{"from B"}) {
+		t.Errorf("frames = %q, want only the answer with key B", texts)
+	}
+	if !openAIKeys.failedAt[testKeyA].Equal(testStart) {
+		t.Errorf("key A failed at %v, want it cooling down", openAIKeys.failedAt[testKeyA])
+	}
+}
+
+// TestOpenAIKeyRedacted checks that logs and metrics only show the last characters of the key
+func TestOpenAIKeyRedacted(t *testing.T) {
+	useTestKeyPool(t, testsupport.NewClock(testStart))
+	logs := captureLogs(t)
+	chatA := testsupport.NewScriptedCompleter(testsupport.Fail(&openai.APIError{HTTPStatusCode: 429, Message: "rate limited"}))
+	h, _ := keyedHandler(t, map[string]*testsupport.ScriptedCompleter{testKeyA: chatA}, func(cfg *Config) { cfg.MetricsEnabled = true })
+	output := captureStdout(t, func() {
+		h.Handler(context.Background(), testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+	})
+
+	if strings.Contains(logs.String(), testKeyA) || strings.Contains(output, testKeyA) {
+		t.Error("the full key was logged")
+	}
+	if !strings.Contains(logs.String(), `"openai_key":"1111"`) {
+		t.Errorf("logs %s don't name the key by its suffix", logs)
+	}
+	var blob struct {
+		emfBlob
+		OpenAIKey string
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, `"_aws"`) {
+			if err := json.Unmarshal([]byte(line), &blob); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if blob.OpenAIKey != "1111" || len(blob.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("metrics OpenAIKey = %q, want the key suffix: %s", blob.OpenAIKey, output)
+	}
+	if dimensions := blob.AWS.CloudWatchMetrics[0].Dimensions; !slices.ContainsFunc(dimensions, func(set []string) bool { return slices.Equal(set, []string{"OpenAIKey"}) }) {
+		t.Errorf("dimensions = %v, want an OpenAIKey dimension", dimensions)
+	}
+}
+
+func TestLoadConfigOpenAIKeys(t *testing.T) {
+	tests := []struct {
+		name         string
+		keys         string
+		secretARN    string
+		cooldown     string
+		wantKeys     []string
+		wantCooldown time.Duration
+		wantErr      bool
+	}{
+		{name: "keys", keys: testKeyA + ", " + testKeyB, wantKeys: []string{testKeyA, testKeyB}, wantCooldown: defaultOpenAIKeyCooldown},
+		{name: "cooldown", keys: testKeyA + "," + testKeyB, cooldown: "5", wantKeys: []string{testKeyA, testKeyB}, wantCooldown: 5 * time.Second},
+		{name: "keys and a secret", keys: testKeyA, secretARN: "arn:aws:secretsmanager:eu-west-1:123456789012:secret:openai", wantErr: true},
+		{name: "negative cooldown", keys: testKeyA, cooldown: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_MOCK", "")
+			t.Setenv("OPENAI_API_KEYS", tt.keys)
+			t.Setenv("OPENAI_API_KEY_SECRET_ARN", tt.secretARN)
+			t.Setenv("OPENAI_KEY_COOLDOWN_SECONDS", tt.cooldown)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !slices.Equal(cfg.OpenAIKeys, tt.wantKeys) || cfg.OpenAIKey != tt.wantKeys[0] || cfg.OpenAIKeyCooldown != tt.wantCooldown {
+				t.Errorf("keys = %q (%q), cooldown %v, want %q, %v", cfg.OpenAIKeys, cfg.OpenAIKey, cfg.OpenAIKeyCooldown, tt.wantKeys, tt.wantCooldown)
+			}
+		})
+	}
+}
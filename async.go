@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	statusCodeAccepted = 202
+	// frameTypeAccepted tells the client its async request was queued
+	frameTypeAccepted = "accepted"
+	// sqsEventSource marks the records of an SQS event
+	sqsEventSource = "aws:sqs"
+)
+
+// asyncJob is the SQS message of a request processed asynchronously. It carries what the websocket invocation
+// knew about the sender, so the worker answers and accounts the request like the original invocation would.
+type asyncJob struct {
+	ConnectionID string        `json:"connection_id"`
+	Request      Request       `json:"request"`
+	Principal    string        `json:"principal,omitempty"`
+	Identity     *userIdentity `json:"identity,omitempty"`
+	Tenant       string        `json:"tenant,omitempty"`   // Tenant of the connection, whose OpenAI API key answers the request
+	Endpoint     string        `json:"endpoint,omitempty"` // Management API endpoint of the websocket event, used without API_GW_ENDPOINT
+}
+
+// asyncWorkerKey is the context key marking requests served from the async queue
+type asyncWorkerKey struct{}
+
+// isAsyncWorker checks if the request of ctx is served from the async queue, where it already passed the rate limit
+func isAsyncWorker(ctx context.Context) bool {
+	worker, _ := ctx.Value(asyncWorkerKey{}).(bool)
+	return worker
+}
+
+// isSQSEvent checks if a Lambda invocation payload is an SQS event rather than a websocket request
+func isSQSEvent(payload json.RawMessage) bool {
+	var event struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	return json.Unmarshal(payload, &event) == nil && len(event.Records) > 0 && event.Records[0].EventSource == sqsEventSource
+}
+
+// Invoke is the Lambda entry point. It serves websocket requests with Handler, the async queue with handleAsyncJobs,
+// HTTP API requests with handleHTTP, direct invocations pushing to a connection with handlePush, and warm-ups
+// and health checks with handleWarmup and handleHealth.
+func (h *WebsocketHandler) Invoke(ctx context.Context, payload json.RawMessage) (any, error) {
+	refreshStaleConfig(ctx)
+	if isSQSEvent(payload) {
+		var event events.SQSEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("Can't decode SQS event: %v", err)
+		}
+		return h.handleAsyncJobs(ctx, getConfig(), event), nil
+	}
+	if isHTTPEvent(payload) {
+		var request events.APIGatewayV2HTTPRequest
+		if err := json.Unmarshal(payload, &request); err != nil {
+			return nil, fmt.Errorf("Can't decode HTTP request: %v", err)
+		}
+		return h.handleHTTP(ctx, getConfig(), request), nil
+	}
+	switch maintenanceAction(payload) {
+	case actionWarmup:
+		return h.handleWarmup(ctx, getConfig()), nil
+	case actionHealth:
+		return h.handleHealth(ctx, getConfig()), nil
+	}
+	if isPushEvent(payload) {
+		var event pushEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, fmt.Errorf("Can't decode push event: %v", err)
+		}
+		return h.handlePush(ctx, getConfig(), event), nil
+	}
+	var request events.APIGatewayWebsocketProxyRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return nil, fmt.Errorf("Can't decode websocket request: %v", err)
+	}
+	return h.Handler(ctx, request)
+}
+
+// getSQSClient returns the SQS client of the configuration snapshot
+func (h *WebsocketHandler) getSQSClient(cfg *Config) *sqs.SQS {
+	return h.sqsClients.get(cfg, func(cfg *Config) *sqs.SQS {
+		return sqs.New(h.awsSession)
+	})
+}
+
+// enqueueAsync sends the request to ASYNC_QUEUE_URL and tells the client it was accepted. request is the request
+// as the client sent it, before the conversation history was added, since the worker loads the history itself.
+func (h *WebsocketHandler) enqueueAsync(openAIRequest openAIRequest, request Request) (events.APIGatewayProxyResponse, error) {
+	request.Async = false
+	job, err := json.Marshal(asyncJob{
+		ConnectionID: openAIRequest.ConnectionId,
+		Request:      request,
+		Principal:    principalFrom(openAIRequest.ctx),
+		Identity:     openAIRequest.identity,
+		Tenant:       tenantFrom(openAIRequest.ctx),
+		Endpoint:     apiGatewayEndpointFrom(openAIRequest.ctx),
+	})
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode async request: %s", err), statusCodeServerError)
+	}
+	_, err = h.getSQSClient(openAIRequest.config).SendMessageWithContext(openAIRequest.ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(openAIRequest.config.AsyncQueueURL),
+		MessageBody: aws.String(string(job)),
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't enqueue async request", "error", err)
+		postErrorFrame(openAIRequest, errorCodeInternal, "Can't enqueue async request")
+		return errorResponse(fmt.Sprintf("Can't enqueue async request: %s", err), statusCodeServerError)
+	}
+	openAIRequest.logger().Info("Request queued for async processing")
+	if err := postControlFrame(openAIRequest, frameTypeAccepted); err != nil && !errors.Is(err, ErrClientGone) {
+		openAIRequest.logger().Warn("Can't post accepted frame", "error", err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeAccepted}, nil
+}
+
+// handleAsyncJobs serves the requests of an SQS event one after the other, posting the answers to the connections
+// that sent them. Failed requests were already reported to their client, and a connection that is gone makes
+// its answer undeliverable, so every message is consumed rather than retried.
+func (h *WebsocketHandler) handleAsyncJobs(ctx context.Context, cfg *Config, event events.SQSEvent) events.SQSEventResponse {
+	for _, record := range event.Records {
+		logger := loggerFrom(ctx).With("message_id", record.MessageId, "model", cfg.OpenAIModel)
+		var job asyncJob
+		if err := json.Unmarshal([]byte(record.Body), &job); err != nil || job.ConnectionID == "" {
+			logger.Error("Dropping malformed async request", "error", err)
+			continue
+		}
+		jobCtx := context.WithValue(ctx, asyncWorkerKey{}, true)
+		jobCtx = withLogger(jobCtx, logger.With("connection_id", job.ConnectionID, "client_request_id", job.Request.RequestID))
+		if job.Principal != "" {
+			jobCtx = withPrincipal(jobCtx, job.Principal)
+		}
+		if job.Identity != nil {
+			jobCtx = withIdentity(jobCtx, job.Identity)
+		}
+		if job.Tenant != "" {
+			jobCtx = withTenant(jobCtx, job.Tenant)
+		}
+		if job.Endpoint != "" {
+			jobCtx = withAPIGatewayEndpoint(jobCtx, job.Endpoint)
+		}
+		response, _ := h.serveRequest(jobCtx, cfg, job.Request, job.ConnectionID, h.getConnectionPoster(jobCtx, cfg))
+		loggerFrom(jobCtx).Info("Async request served", "status", response.StatusCode)
+	}
+	return events.SQSEventResponse{}
+}
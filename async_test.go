@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testQueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/async"
+
+// sqsFixture is a canned SQS queue recording the messages sent to it, failing every send with status when it
+// is set
+type sqsFixture struct {
+	server *httptest.Server
+	status int
+
+	mu       sync.Mutex
+	messages []sqs.SendMessageInput
+}
+
+func newSQSFixture(t *testing.T) *sqsFixture {
+	f := &sqsFixture{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input sqs.SendMessageInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("SendMessage body: %v", err)
+		}
+		f.mu.Lock()
+		f.messages = append(f.messages, input)
+		f.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		if f.status != 0 {
+			w.WriteHeader(f.status)
+			w.Write([]byte(`{"__type":"com.amazonaws.sqs#QueueDoesNotExist","message":"The specified queue does not exist."}`))
+			return
+		}
+		sum := md5.Sum([]byte(aws.StringValue(input.MessageBody)))
+		json.NewEncoder(w).Encode(map[string]string{"MessageId": "msg-1", "MD5OfMessageBody": hex.EncodeToString(sum[:])})
+	}))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// client returns an SQS client sending to the fixture, without retries so failing sends fail fast
+func (f *sqsFixture) client() *sqs.SQS {
+	return sqs.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(f.server.URL),
+		Credentials: credentials.NewStaticCredentials("AKIDTEST", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+}
+
+// jobs returns the async jobs sent to the fixture
+func (f *sqsFixture) jobs(t *testing.T) []asyncJob {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	jobs := make([]asyncJob, len(f.messages))
+	for i, message := range f.messages {
+		if aws.StringValue(message.QueueUrl) != testQueueURL {
+			t.Errorf("message %d went to %q, want %q", i, aws.StringValue(message.QueueUrl), testQueueURL)
+		}
+		if err := json.Unmarshal([]byte(aws.StringValue(message.MessageBody)), &jobs[i]); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	return jobs
+}
+
+// sqsEvent builds the SQS event delivering bodies
+func sqsEvent(bodies ...string) events.SQSEvent {
+	var event events.SQSEvent
+	for i, body := range bodies {
+		event.Records = append(event.Records, events.SQSMessage{MessageId: "msg-" + string(rune('1'+i)), EventSource: sqsEventSource, Body: body})
+	}
+	return event
+}
+
+// asyncJobBody encodes the job of connectionID asking for a full answer
+func asyncJobBody(t *testing.T, connectionID string) string {
+	t.Helper()
+	body, err := json.Marshal(asyncJob{
+		ConnectionID: connectionID,
+		Request: Request{
+			ResponseType:   responseTypeFull,
+			PromptTemplate: "PROMPT_TEST",
+			RequestID:      "req-" + connectionID,
+			Messages:       []chatMessage{{Role: "user", Content: "hi"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestIsSQSEvent(t *testing.T) {
+	tests := map[string]bool{
+		`{"Records":[{"messageId":"msg-1","eventSource":"aws:sqs","body":"{}"}]}`: true,
+		`{"Records":[{"eventSource":"aws:sns"}]}`:                                 false,
+		`{"Records":[]}`: false,
+		`{"requestContext":{"routeKey":"$default","connectionId":"conn-1"}}`: false,
+		`{"action":"warmup"}`: false,
+		`not json`:            false,
+	}
+	for payload, want := range tests {
+		if got := isSQSEvent(json.RawMessage(payload)); got != want {
+			t.Errorf("isSQSEvent(%s) = %v, want %v", payload, got, want)
+		}
+	}
+}
+
+func TestInvokeDispatch(t *testing.T) {
+	websocketPayload, _ := json.Marshal(testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+	tests := []struct {
+		name      string
+		payload   json.RawMessage
+		want      any
+		wantPosts []string
+	}{
+		{
+			name:      "SQS event",
+			payload:   json.RawMessage(`{"Records":[{"messageId":"msg-1","eventSource":"aws:sqs","body":` + jsonString(asyncJobBody(t, "conn-2")) + `}]}`),
+			want:      events.SQSEventResponse{},
+			wantPosts: []string{"conn-2 Hello"},
+		},
+		{
+			name:      "websocket request",
+			payload:   websocketPayload,
+			want:      events.APIGatewayProxyResponse{StatusCode: statusCodeOK},
+			wantPosts: []string{"conn-1 Hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			poster := testsupport.NewRecordingPoster()
+			got, err := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), poster, nil, nil).Invoke(context.Background(), tt.payload)
+			if err != nil {
+				t.Fatalf("Invoke() error = %v", err)
+			}
+			if response, ok := got.(events.APIGatewayProxyResponse); ok {
+				got = events.APIGatewayProxyResponse{StatusCode: response.StatusCode}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Invoke() = %#v, want %#v", got, tt.want)
+			}
+			if got := postedTo(poster); !reflect.DeepEqual(got, tt.wantPosts) {
+				t.Errorf("frames = %q, want %q", got, tt.wantPosts)
+			}
+		})
+	}
+}
+
+// postedTo lists the frames of poster as the connection they went to followed by their data
+func postedTo(poster *testsupport.RecordingPoster) []string {
+	var posts []string
+	for _, frame := range poster.Frames() {
+		posts = append(posts, frame.ConnectionID+" "+string(frame.Data))
+	}
+	return posts
+}
+
+// jsonString encodes s as a JSON string
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+func TestEnqueueAsync(t *testing.T) {
+	tests := []struct {
+		name       string
+		queueURL   string
+		sendStatus int
+		wantStatus int
+		wantFrames []string
+		wantJobs   int
+	}{
+		{name: "accepted", queueURL: testQueueURL, wantStatus: statusCodeAccepted, wantFrames: []string{`{"type":"accepted","request_id":"req-1"}`}, wantJobs: 1},
+		{name: "queue failure", queueURL: testQueueURL, sendStatus: http.StatusBadRequest, wantStatus: statusCodeServerError, wantFrames: []string{`{"type":"error","code":"internal_error","message":"Can't enqueue async request"}`}, wantJobs: 1},
+		{name: "no queue", wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.AsyncQueueURL = tt.queueURL })
+			queue := newSQSFixture(t)
+			queue.status = tt.sendStatus
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, nil, nil)
+			h.sqsClients.generation, h.sqsClients.value = cfg.Generation, queue.client()
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","request_id":"req-1","async":true,"messages":[{"role":"user","content":"hi"}]}`
+			response, err := h.Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the async request was answered by the websocket invocation")
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			jobs := queue.jobs(t)
+			if len(jobs) != tt.wantJobs {
+				t.Fatalf("queued %d jobs, want %d", len(jobs), tt.wantJobs)
+			}
+			if tt.wantJobs == 0 {
+				return
+			}
+			// The worker must not queue the request again
+			if jobs[0].ConnectionID != "conn-1" || jobs[0].Request.Async || jobs[0].Request.RequestID != "req-1" {
+				t.Errorf("job = %+v, want the request of conn-1 without async", jobs[0])
+			}
+		})
+	}
+}
+
+func TestHandleAsyncJobs(t *testing.T) {
+	tests := []struct {
+		name       string
+		bodies     []string
+		failAt     int // Index of the post failing with a gone connection, -1 for none
+		wantChats  int
+		wantFrames []string
+	}{
+		{
+			name:       "answers every job",
+			bodies:     []string{asyncJobBody(t, "conn-1"), asyncJobBody(t, "conn-2")},
+			failAt:     -1,
+			wantChats:  2,
+			wantFrames: []string{"conn-1 Hello", "conn-2 Hello"},
+		},
+		{
+			// The answer of the gone connection is dropped and the next job is still served
+			name:       "gone connection",
+			bodies:     []string{asyncJobBody(t, "conn-1"), asyncJobBody(t, "conn-2")},
+			failAt:     0,
+			wantChats:  2,
+			wantFrames: []string{"conn-2 Hello"},
+		},
+		{
+			name:       "malformed jobs",
+			bodies:     []string{"not json", `{"request":{"response_type":"full"}}`, asyncJobBody(t, "conn-2")},
+			failAt:     -1,
+			wantChats:  1,
+			wantFrames: []string{"conn-2 Hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"), testsupport.Reply("Hello"))
+			poster := testsupport.NewRecordingPoster()
+			if tt.failAt >= 0 {
+				poster.FailAt(tt.failAt, testsupport.ErrGone)
+			}
+			got := newTestHandler(cfg, chat, poster, nil, nil).handleAsyncJobs(context.Background(), cfg, sqsEvent(tt.bodies...))
+			// Every message is consumed, none is handed back to the queue for a retry
+			if len(got.BatchItemFailures) != 0 {
+				t.Errorf("batch item failures = %+v, want none", got.BatchItemFailures)
+			}
+			if len(chat.Requests()) != tt.wantChats {
+				t.Errorf("OpenAI requests = %d, want %d", len(chat.Requests()), tt.wantChats)
+			}
+			if got := postedTo(poster); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+)
+
+const (
+	auditTimeout    = 2 * time.Second
+	auditRetryDelay = 100 * time.Millisecond
+)
+
+// auditRecord is the document written to AUDIT_FIREHOSE_STREAM for every request that reached the OpenAI API,
+// one JSON object per line so the delivered files can be queried with Athena
+type auditRecord struct {
+	Timestamp        string             `json:"timestamp"`
+	ConnectionID     string             `json:"connection_id"`
+	Subject          string             `json:"subject"`
+	Tenant           string             `json:"tenant,omitempty"`
+	RequestID        string             `json:"request_id,omitempty"`
+	PromptTemplate   string             `json:"prompt_template,omitempty"`
+	PromptTemplates  []string           `json:"prompt_templates,omitempty"`
+	Provider         string             `json:"provider,omitempty"`
+	Model            string             `json:"model,omitempty"`
+	ResponseType     string             `json:"response_type"`
+	Result           string             `json:"result"`
+	PromptTokens     int                `json:"prompt_tokens"`
+	CompletionTokens int                `json:"completion_tokens"`
+	LatencyMs        int64              `json:"latency_ms"`
+	Annotations      *outputAnnotations `json:"annotations,omitempty"`
+	// Messages and Completion are set only with AUDIT_INCLUDE_CONTENT
+	Messages   []chatMessage `json:"messages,omitempty"`
+	Completion string        `json:"completion,omitempty"`
+}
+
+// auditTrail collects what the audit record needs besides the metrics of the request. It's shared by all
+// copies of the request, like requestMetrics, and nil without AUDIT_FIREHOSE_STREAM.
+type auditTrail struct {
+	client         firehoseiface.FirehoseAPI
+	includeContent bool
+	completion     string
+	annotations    *outputAnnotations
+}
+
+// newAuditTrail starts the audit trail of a request, nil without AUDIT_FIREHOSE_STREAM
+func (h *WebsocketHandler) newAuditTrail(cfg *Config) *auditTrail {
+	if cfg.AuditFirehoseStream == "" {
+		return nil
+	}
+	client := h.firehoseClients.get(cfg, func(cfg *Config) firehoseiface.FirehoseAPI {
+		return firehose.New(h.awsSession)
+	})
+	return &auditTrail{client: client, includeContent: cfg.AuditIncludeContent}
+}
+
+// recordCompletion keeps the complete model output and the output annotations of the answer.
+// Streamed output arrives reassembled, since streams accumulate their text for the audit.
+func (a *auditTrail) recordCompletion(completion string, annotations *outputAnnotations) {
+	if a == nil {
+		return
+	}
+	if a.includeContent {
+		a.completion = completion
+	}
+	a.annotations = annotations
+}
+
+// newAuditRecord builds the audit record of a request that ended with err
+func newAuditRecord(openAIRequest openAIRequest, err error) auditRecord {
+	cfg := openAIRequest.config
+	request := openAIRequest.request
+	record := auditRecord{
+		Timestamp:       time.Now().UTC().Format(time.RFC3339Nano),
+		ConnectionID:    openAIRequest.ConnectionId,
+		Subject:         requestSubject(openAIRequest),
+		Tenant:          tenantFrom(openAIRequest.ctx),
+		RequestID:       request.RequestID,
+		PromptTemplate:  request.PromptTemplate,
+		PromptTemplates: request.PromptTemplates,
+		Provider:        request.Provider,
+		ResponseType:    request.ResponseType,
+		Result:          metricResult(err),
+		Annotations:     openAIRequest.audit.annotations,
+	}
+	if m := openAIRequest.metrics; m != nil {
+		record.Model = m.model
+		record.PromptTokens = m.promptTokens
+		record.CompletionTokens = m.completionTokens
+		record.LatencyMs = time.Since(m.start).Milliseconds()
+	}
+	if record.Model == "" {
+		record.Model = requestModel(cfg, request)
+	}
+	if openAIRequest.audit.includeContent {
+		record.Messages = request.Messages
+		record.Completion = openAIRequest.audit.completion
+	}
+	return record
+}
+
+// sendAudit writes the audit record of the request to AUDIT_FIREHOSE_STREAM. The answer is delivered already,
+// so the write gets its own short deadline, a failed write is retried once and then only logged.
+func sendAudit(openAIRequest openAIRequest, err error) {
+	if openAIRequest.audit == nil {
+		return
+	}
+	data, encodeErr := json.Marshal(newAuditRecord(openAIRequest, err))
+	if encodeErr != nil {
+		openAIRequest.logger().Error("Can't encode audit record", "error", encodeErr)
+		return
+	}
+	// Firehose concatenates records as they are, the newline keeps them one per line
+	data = append(data, '\n')
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(openAIRequest.ctx), auditTimeout)
+	defer cancel()
+	input := &firehose.PutRecordInput{
+		DeliveryStreamName: aws.String(openAIRequest.config.AuditFirehoseStream),
+		Record:             &firehose.Record{Data: data},
+	}
+	_, putErr := openAIRequest.audit.client.PutRecordWithContext(ctx, input)
+	if putErr != nil && sleepContext(ctx, auditRetryDelay) {
+		_, putErr = openAIRequest.audit.client.PutRecordWithContext(ctx, input)
+	}
+	if putErr != nil {
+		openAIRequest.logger().Error("Can't write audit record, dropping it", "error", putErr)
+	}
+}
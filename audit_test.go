@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// fakeFirehose records the records put to it, failing the first failures calls
+type fakeFirehose struct {
+	firehoseiface.FirehoseAPI
+	failures int
+
+	mu      sync.Mutex
+	calls   int
+	streams []string
+	records [][]byte
+}
+
+func (f *fakeFirehose) PutRecordWithContext(ctx aws.Context, input *firehose.PutRecordInput, opts ...request.Option) (*firehose.PutRecordOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, errors.New("service unavailable")
+	}
+	f.streams = append(f.streams, aws.StringValue(input.DeliveryStreamName))
+	f.records = append(f.records, input.Record.Data)
+	return &firehose.PutRecordOutput{}, nil
+}
+
+// auditHandler returns a handler answering with chat whose audit records go to a fake Firehose
+func auditHandler(t *testing.T, includeContent bool, chat ChatCompleter, poster *testsupport.RecordingPoster) (*WebsocketHandler, *fakeFirehose) {
+	t.Helper()
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.AuditFirehoseStream = "audit"
+		cfg.AuditIncludeContent = includeContent
+		cfg.OpenAIModel = "gpt-test"
+		cfg.OpenAIMaxRetries = 0
+	})
+	stream := &fakeFirehose{}
+	h := newTestHandler(cfg, chat, poster, nil, nil)
+	h.firehoseClients.generation, h.firehoseClients.value = cfg.Generation, stream
+	return h, stream
+}
+
+func TestAuditRecords(t *testing.T) {
+	withUsage := testsupport.Reply("Hello")
+	withUsage.Response.Usage = openai.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}
+	messages := []any{map[string]any{"role": "user", "content": "hi"}}
+	tests := []struct {
+		name           string
+		responseType   string
+		includeContent bool
+		turn           testsupport.Turn
+		want           map[string]any // Fields of the record besides timestamp and latency_ms
+	}{
+		{
+			name:         "without content",
+			responseType: responseTypeFull,
+			turn:         withUsage,
+			want: map[string]any{
+				"connection_id": "conn-1", "subject": "connection#conn-1", "request_id": "req-1", "prompt_template": "PROMPT_TEST",
+				"model": "gpt-test", "response_type": responseTypeFull, "result": metricResultSuccess, "prompt_tokens": 12.0, "completion_tokens": 3.0,
+			},
+		},
+		{
+			name:           "with content",
+			responseType:   responseTypeFull,
+			includeContent: true,
+			turn:           withUsage,
+			want: map[string]any{
+				"connection_id": "conn-1", "subject": "connection#conn-1", "request_id": "req-1", "prompt_template": "PROMPT_TEST",
+				"model": "gpt-test", "response_type": responseTypeFull, "result": metricResultSuccess, "prompt_tokens": 12.0, "completion_tokens": 3.0,
+				"messages": messages, "completion": "Hello",
+			},
+		},
+		{
+			// The deltas of a stream are reassembled into the completion
+			name:           "stream with content",
+			responseType:   responseTypeStream,
+			includeContent: true,
+			turn: testsupport.Stream(
+				testsupport.Chunk{Content: "Hel"},
+				testsupport.Chunk{Content: "lo"},
+				testsupport.Chunk{Usage: &openai.Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9}},
+			),
+			want: map[string]any{
+				"connection_id": "conn-1", "subject": "connection#conn-1", "request_id": "req-1", "prompt_template": "PROMPT_TEST",
+				"model": "gpt-test", "response_type": responseTypeStream, "result": metricResultSuccess, "prompt_tokens": 7.0, "completion_tokens": 2.0,
+				"messages": messages, "completion": "Hello",
+			},
+		},
+		{
+			name:         "failed request",
+			responseType: responseTypeFull,
+			turn:         testsupport.Fail(&openai.APIError{HTTPStatusCode: 500, Message: "boom"}),
+			want: map[string]any{
+				"connection_id": "conn-1", "subject": "connection#conn-1", "request_id": "req-1", "prompt_template": "PROMPT_TEST",
+				"model": "gpt-test", "response_type": responseTypeFull, "result": metricResultOpenAI, "prompt_tokens": 0.0, "completion_tokens": 0.0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, stream := auditHandler(t, tt.includeContent, testsupport.NewScriptedCompleter(tt.turn), testsupport.NewRecordingPoster())
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","request_id":"req-1","messages":[{"role":"user","content":"hi"}]}`
+			h.Handler(context.Background(), testMessage(body))
+			if len(stream.records) != 1 || stream.streams[0] != "audit" {
+				t.Fatalf("put %d records to %q, want 1 to audit", len(stream.records), stream.streams)
+			}
+			data := stream.records[0]
+			// Records are newline-delimited JSON, one object per line
+			if !strings.HasSuffix(string(data), "\n") || strings.Count(string(data), "\n") != 1 {
+				t.Errorf("record %q isn't a single JSON line", data)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("record %s: %v", data, err)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, fields["timestamp"].(string)); err != nil {
+				t.Errorf("timestamp: %v", err)
+			}
+			if latency, ok := fields["latency_ms"].(float64); !ok || latency < 0 {
+				t.Errorf("latency_ms = %v, want a duration", fields["latency_ms"])
+			}
+			delete(fields, "timestamp")
+			delete(fields, "latency_ms")
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("record fields = %v, want %v", sortedKeys(fields), sortedKeys(tt.want))
+				for name, value := range tt.want {
+					if !reflect.DeepEqual(fields[name], value) {
+						t.Errorf("%s = %v, want %v", name, fields[name], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+// sortedKeys returns the keys of fields in order
+func sortedKeys(fields map[string]any) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestAuditFirehoseFailures checks that a failed write is retried once, then dropped without failing the request
+func TestAuditFirehoseFailures(t *testing.T) {
+	tests := []struct {
+		name        string
+		failures    int
+		wantCalls   int
+		wantRecords int
+		wantLogged  bool
+	}{
+		{name: "written", wantCalls: 1, wantRecords: 1},
+		{name: "retried", failures: 1, wantCalls: 2, wantRecords: 1},
+		{name: "dropped", failures: 2, wantCalls: 2, wantLogged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			poster := testsupport.NewRecordingPoster()
+			h, stream := auditHandler(t, false, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), poster)
+			stream.failures = tt.failures
+			response, err := h.Handler(context.Background(), testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+			if err != nil || response.StatusCode != statusCodeOK || !reflect.DeepEqual(poster.Texts(), []string{"Hello"}) {
+				t.Fatalf("Handler() = %d, %v with frames %q, want the answer", response.StatusCode, err, poster.Texts())
+			}
+			if stream.calls != tt.wantCalls || len(stream.records) != tt.wantRecords {
+				t.Errorf("PutRecord calls = %d with %d records, want %d with %d", stream.calls, len(stream.records), tt.wantCalls, tt.wantRecords)
+			}
+			if logged := strings.Contains(logs.String(), "Can't write audit record, dropping it"); logged != tt.wantLogged {
+				t.Errorf("drop logged = %v, want %v", logged, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	cfg := testConfig(t, nil)
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), testsupport.NewRecordingPoster(), nil, nil)
+	stream := &fakeFirehose{}
+	h.firehoseClients.generation, h.firehoseClients.value = cfg.Generation, stream
+	h.Handler(context.Background(), testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+	if stream.calls != 0 {
+		t.Errorf("PutRecord calls = %d without AUDIT_FIREHOSE_STREAM, want none", stream.calls)
+	}
+}
+
+func TestLoadConfigAudit(t *testing.T) {
+	tests := []struct {
+		name        string
+		stream      string
+		content     string
+		wantContent bool
+		wantErr     bool
+	}{
+		{name: "unset"},
+		{name: "stream", stream: "audit"},
+		{name: "with content", stream: "audit", content: "true", wantContent: true},
+		{name: "invalid content", stream: "audit", content: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AUDIT_FIREHOSE_STREAM", tt.stream)
+			t.Setenv("AUDIT_INCLUDE_CONTENT", tt.content)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (cfg.AuditFirehoseStream != tt.stream || cfg.AuditIncludeContent != tt.wantContent) {
+				t.Errorf("audit = %q, %v, want %q, %v", cfg.AuditFirehoseStream, cfg.AuditIncludeContent, tt.stream, tt.wantContent)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	authModeToken = "token"
+	// authQueryParameter is the query string parameter carrying the token on $connect
+	authQueryParameter = "auth"
+	// sharedSecretPrincipal is the principal of connections authorized with AUTH_SECRET itself
+	sharedSecretPrincipal = "shared-secret"
+)
+
+// errUnauthorized is returned when a connection or a message fails token authorization
+var errUnauthorized = errors.New("Unauthorized")
+
+// authClaims is the payload of a signed token
+type authClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp,omitempty"`    // Unix time after which the token is rejected, zero for no expiry
+	Admin     bool   `json:"admin,omitempty"`  // Allows the connection to broadcast
+	Tenant    string `json:"tenant,omitempty"` // Selects the OpenAI API key of TENANT_KEYS_TABLE
+}
+
+// principalKey is the context key of the principal of a request
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying the principal of the connection
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom returns the principal of ctx, or an empty string without AUTH_MODE=token
+func principalFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// connectionPrincipal is the authorization stored with a connection record
+type connectionPrincipal struct {
+	Subject   string
+	ExpiresAt int64
+	Admin     bool
+	Tenant    string
+}
+
+// authSignature returns the HMAC-SHA256 of the encoded claims
+func authSignature(secret string, encoded string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// validateAuthToken checks a token against AUTH_SECRET. A token without a dot must be the secret itself,
+// any other token must be signed with it and not be expired at now.
+func validateAuthToken(secret string, token string, now time.Time) (connectionPrincipal, error) {
+	if token == "" {
+		return connectionPrincipal{}, fmt.Errorf("%w: no token", errUnauthorized)
+	}
+	encoded, signature, signed := strings.Cut(token, ".")
+	if !signed {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return connectionPrincipal{}, fmt.Errorf("%w: invalid token", errUnauthorized)
+		}
+		return connectionPrincipal{Subject: sharedSecretPrincipal}, nil
+	}
+
+	decodedSignature, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(decodedSignature, authSignature(secret, encoded)) {
+		return connectionPrincipal{}, fmt.Errorf("%w: invalid token signature", errUnauthorized)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return connectionPrincipal{}, fmt.Errorf("%w: invalid token encoding", errUnauthorized)
+	}
+	var claims authClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return connectionPrincipal{}, fmt.Errorf("%w: invalid token claims", errUnauthorized)
+	}
+	principal := connectionPrincipal{Subject: claims.Subject, ExpiresAt: claims.ExpiresAt, Admin: claims.Admin, Tenant: claims.Tenant}
+	if principal.isExpired(now) {
+		return connectionPrincipal{}, fmt.Errorf("%w: token expired", errUnauthorized)
+	}
+	return principal, nil
+}
+
+// isExpired checks if the token behind the principal has expired at now
+func (p connectionPrincipal) isExpired(now time.Time) bool {
+	return p.ExpiresAt != 0 && now.Unix() >= p.ExpiresAt
+}
+
+// connectToken returns the token of a $connect request, from the auth query string parameter or a bearer Authorization header
+func connectToken(request events.APIGatewayWebsocketProxyRequest) string {
+	return requestToken(request.QueryStringParameters, request.Headers)
+}
+
+// requestToken returns the token of a request from its auth query string parameter or its Authorization header
+func requestToken(query map[string]string, headers map[string]string) string {
+	if token := query[authQueryParameter]; token != "" {
+		return token
+	}
+	for name, value := range headers {
+		if strings.EqualFold(name, "Authorization") {
+			scheme, token, found := strings.Cut(value, " ")
+			if found && strings.EqualFold(scheme, "Bearer") {
+				return strings.TrimSpace(token)
+			}
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// addPrincipal stores the principal in the record of a connection
+func addPrincipal(item map[string]*dynamodb.AttributeValue, principal connectionPrincipal) {
+	item["principal"] = &dynamodb.AttributeValue{S: aws.String(principal.Subject)}
+	if principal.ExpiresAt != 0 {
+		item["auth_expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(principal.ExpiresAt, 10))}
+	}
+	if principal.Admin {
+		item["admin"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	if principal.Tenant != "" {
+		item["tenant"] = &dynamodb.AttributeValue{S: aws.String(principal.Tenant)}
+	}
+}
+
+// connectionAuth is what the connection record says about the authorization of a connection
+type connectionAuth struct {
+	principal connectionPrincipal // Set with AUTH_MODE=token
+	identity  *userIdentity       // Set when Cognito is configured
+	tenant    string              // Tenant claim of the token or the ID token, if any
+}
+
+// requiresConnectionAuth checks if messages are only accepted on connections authorized on $connect
+func requiresConnectionAuth(cfg *Config) bool {
+	return cfg.AuthMode == authModeToken || cfg.CognitoPoolID != ""
+}
+
+// authorizeMessage looks up the authorization of the connection a message arrived on. Connections without
+// a record, which skipped the authorization on $connect, and connections whose token expired are rejected.
+func (h *WebsocketHandler) authorizeMessage(ctx context.Context, cfg *Config, connectionID string) (connectionAuth, error) {
+	output, err := h.getDynamoDBClient(cfg).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.ConnectionsTable),
+		Key:            connectionKey(connectionID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return connectionAuth{}, fmt.Errorf("Can't look up connection record: %v", err)
+	}
+
+	var auth connectionAuth
+	if cfg.AuthMode == authModeToken {
+		subject, ok := output.Item["principal"]
+		if !ok || aws.StringValue(subject.S) == "" {
+			return connectionAuth{}, fmt.Errorf("%w: connection has no principal", errUnauthorized)
+		}
+		auth.principal = connectionPrincipal{Subject: aws.StringValue(subject.S)}
+		if expiresAt, ok := output.Item["auth_expires_at"]; ok {
+			auth.principal.ExpiresAt, _ = strconv.ParseInt(aws.StringValue(expiresAt.N), 10, 64)
+		}
+		if auth.principal.isExpired(h.getClock().Now()) {
+			return connectionAuth{}, fmt.Errorf("%w: token expired", errUnauthorized)
+		}
+	}
+	if cfg.CognitoPoolID != "" {
+		sub, ok := output.Item["user_sub"]
+		if !ok || aws.StringValue(sub.S) == "" {
+			return connectionAuth{}, fmt.Errorf("%w: connection has no user identity", errUnauthorized)
+		}
+		auth.identity = &userIdentity{Sub: aws.StringValue(sub.S)}
+		if email, ok := output.Item["user_email"]; ok {
+			auth.identity.Email = aws.StringValue(email.S)
+		}
+	}
+	if tenant, ok := output.Item["tenant"]; ok {
+		auth.tenant = aws.StringValue(tenant.S)
+	}
+	return auth, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testAuthSecret = "test-secret"
+
+// signTestToken returns a token for claims signed with secret
+func signTestToken(t *testing.T, secret string, claims authClaims) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(authSignature(secret, encoded))
+}
+
+func TestValidateAuthToken(t *testing.T) {
+	valid := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Add(time.Hour).Unix(), Admin: true})
+	encoded, signature, _ := strings.Cut(valid, ".")
+	tampered := []byte(signature)
+	tampered[0] ^= 1
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","admin":true}`))
+	tests := []struct {
+		name    string
+		token   string
+		want    connectionPrincipal
+		wantErr string
+	}{
+		{name: "valid", token: valid, want: connectionPrincipal{Subject: "user-1", ExpiresAt: testStart.Add(time.Hour).Unix(), Admin: true}},
+		{name: "without expiry", token: signTestToken(t, testAuthSecret, authClaims{Subject: "user-2", Tenant: "acme"}), want: connectionPrincipal{Subject: "user-2", Tenant: "acme"}},
+		{name: "shared secret", token: testAuthSecret, want: connectionPrincipal{Subject: sharedSecretPrincipal}},
+		{name: "missing", token: "", wantErr: "no token"},
+		{name: "wrong shared secret", token: "guess", wantErr: "invalid token"},
+		{name: "expired", token: signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Unix()}), wantErr: "token expired"},
+		{name: "tampered signature", token: encoded + "." + string(tampered), wantErr: "invalid token signature"},
+		{name: "tampered claims", token: forged + "." + signature, wantErr: "invalid token signature"},
+		{name: "other secret", token: signTestToken(t, "other-secret", authClaims{Subject: "user-1"}), wantErr: "invalid token signature"},
+		{name: "signature not base64", token: encoded + ".!!", wantErr: "invalid token signature"},
+		{name: "no subject", token: signTestToken(t, testAuthSecret, authClaims{Admin: true}), wantErr: "invalid token claims"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := validateAuthToken(testAuthSecret, tt.token, testStart)
+			if tt.wantErr != "" {
+				if !errors.Is(err, errUnauthorized) || !strings.HasSuffix(err.Error(), tt.wantErr) {
+					t.Fatalf("validateAuthToken() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("validateAuthToken() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   map[string]string
+		headers map[string]string
+		want    string
+	}{
+		{name: "query parameter", query: map[string]string{"auth": "abc"}, headers: map[string]string{"Authorization": "Bearer def"}, want: "abc"},
+		{name: "bearer header", headers: map[string]string{"authorization": "bearer def "}, want: "def"},
+		{name: "bare header", headers: map[string]string{"Authorization": "def"}, want: "def"},
+		{name: "none", query: map[string]string{"lang": "en"}, headers: map[string]string{"Host": "example.com"}},
+	}
+	for _, tt := range tests {
+		if got := requestToken(tt.query, tt.headers); got != tt.want {
+			t.Errorf("requestToken(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.AuthMode = authModeToken
+		cfg.AuthSecret = testAuthSecret
+		cfg.ConnectionsTable = "connections"
+	})
+	valid := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Add(time.Hour).Unix()})
+	expired := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Add(-time.Minute).Unix()})
+	tests := []struct {
+		name        string
+		token       string
+		advance     time.Duration
+		wantConnect int
+		wantMessage int
+	}{
+		{name: "valid token", token: valid, wantConnect: statusCodeOK, wantMessage: statusCodeOK},
+		{name: "shared secret", token: testAuthSecret, wantConnect: statusCodeOK, wantMessage: statusCodeOK},
+		{name: "expired token", token: expired, wantConnect: statusCodeUnauthorized, wantMessage: statusCodeUnauthorized},
+		{name: "tampered token", token: valid[:len(valid)-2] + "xx", wantConnect: statusCodeUnauthorized, wantMessage: statusCodeUnauthorized},
+		{name: "missing token", wantConnect: statusCodeUnauthorized, wantMessage: statusCodeUnauthorized},
+		{name: "token expiring after the connect", token: valid, advance: 2 * time.Hour, wantConnect: statusCodeOK, wantMessage: statusCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			clock := testsupport.NewClock(testStart)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, clock)
+			ctx := context.Background()
+
+			query := map[string]string{}
+			if tt.token != "" {
+				query[authQueryParameter] = tt.token
+			}
+			response, err := h.Handler(ctx, connectRequest(query))
+			if err != nil || response.StatusCode != tt.wantConnect {
+				t.Fatalf("$connect = %d, %v, want %d", response.StatusCode, err, tt.wantConnect)
+			}
+			record := db.item("connections", connectionKey("conn-1"))
+			if tt.wantConnect != statusCodeOK {
+				if record != nil {
+					t.Errorf("refused connection recorded as %v", record)
+				}
+			} else if record == nil || aws.StringValue(record["principal"].S) == "" {
+				t.Errorf("connection record %v has no principal", record)
+			}
+
+			clock.Advance(tt.advance)
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err = h.Handler(ctx, testMessage(body))
+			if err != nil || response.StatusCode != tt.wantMessage {
+				t.Fatalf("message = %d, %v, want %d", response.StatusCode, err, tt.wantMessage)
+			}
+			if tt.wantMessage != statusCodeOK && len(chat.Requests()) != 0 {
+				t.Error("message of an unauthorized connection reached OpenAI")
+			}
+		})
+	}
+}
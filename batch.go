@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultMaxBatchSize = 10
+	// batchWorkers bounds the items of a batch processed at the same time
+	batchWorkers = 4
+)
+
+// batchBody is a websocket message carrying several independent requests
+type batchBody struct {
+	Batch []json.RawMessage `json:"batch"`
+	// Action is the route selection key of the API Gateway, accepted so batches may set it
+	Action string `json:"action,omitempty"`
+}
+
+// batchItemStatus reports the outcome of one item in the summary returned for a batch
+type batchItemStatus struct {
+	RequestID string `json:"request_id,omitempty"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// batchSummary is the response body of a batch
+type batchSummary struct {
+	Items []batchItemStatus `json:"items"`
+}
+
+// isBatchBody checks if a websocket message is a batch rather than a single request
+func isBatchBody(body string) bool {
+	var envelope struct {
+		Batch json.RawMessage `json:"batch"`
+	}
+	return json.Unmarshal([]byte(body), &envelope) == nil && envelope.Batch != nil
+}
+
+// handleBatch runs the items of a batch concurrently, at most batchWorkers at a time. Every item is answered with
+// protocol v2 envelopes carrying its request_id, so the client can tell the answers apart. An invalid item gets
+// an error envelope without failing the others. The response is 200 when at least one item succeeded, and its
+// body lists the status of every item.
+func (h *WebsocketHandler) handleBatch(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var batch batchBody
+	decoder := json.NewDecoder(bytes.NewReader([]byte(request.Body)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&batch); err != nil {
+		loggerFrom(ctx).Warn("Can't parse batch JSON", "error", err)
+		return errorResponse(fmt.Sprintf("Error parsing batch JSON: %s", err), statusCodeBadRequest)
+	}
+	if len(batch.Batch) == 0 {
+		return errorResponse("Invalid batch: batch must not be empty", statusCodeBadRequest)
+	}
+	if len(batch.Batch) > cfg.MaxBatchSize {
+		return errorResponse(fmt.Sprintf("Invalid batch: batch has %d items, at most %d are allowed", len(batch.Batch), cfg.MaxBatchSize), statusCodeBadRequest)
+	}
+
+	connectionID := request.RequestContext.ConnectionID
+	items := make([]Request, len(batch.Batch))
+	statuses := make([]batchItemStatus, len(batch.Batch))
+	seen := make(map[string]bool, len(batch.Batch))
+	for i, raw := range batch.Batch {
+		item, err := parseRequestBody(string(raw))
+		if err == nil {
+			item, err = withRouteResponseType(cfg, request.RequestContext.RouteKey, item)
+		}
+		if err == nil {
+			err = checkBatchItem(item, seen)
+		}
+		if err == nil {
+			err = validateRequestParams(cfg, withPromptProfile(cfg, item))
+		}
+		seen[item.RequestID] = true
+		item.Protocol = protocolV2
+		items[i] = item
+		statuses[i] = batchItemStatus{RequestID: item.RequestID}
+		if err != nil {
+			loggerFrom(ctx).Warn("Invalid batch item", "item", i, "client_request_id", item.RequestID, "error", err)
+			statuses[i].Status = statusCodeBadRequest
+			statuses[i].Error = fmt.Sprintf("Invalid request parameters: %s", err)
+			// Only an item with a request_id can be told apart by the client
+			if item.RequestID != "" {
+				postErrorFrame(h.createOpenAIRequest(ctx, cfg, item, connectionID), errorCodeInvalidRequest, statuses[i].Error)
+			}
+		}
+	}
+
+	runBounded(ctx, len(items), batchWorkers, func(i int) error {
+		if statuses[i].Status != 0 {
+			// Invalid items were answered already
+			return nil
+		}
+		itemCtx := withLogger(ctx, loggerFrom(ctx).With("client_request_id", items[i].RequestID))
+		response, _ := h.serveRequest(itemCtx, cfg, items[i], connectionID, h.getConnectionPoster(ctx, cfg))
+		statuses[i].Status = response.StatusCode
+		if response.StatusCode != statusCodeOK {
+			statuses[i].Error = response.Body
+		}
+		return nil
+	})
+
+	statusCode := statuses[0].Status
+	for i := range statuses {
+		if statuses[i].Status == 0 {
+			statuses[i].Status = statusCodeServerError
+			statuses[i].Error = "Batch item didn't start before the Lambda deadline"
+		}
+		if statuses[i].Status == statusCodeOK {
+			statusCode = statusCodeOK
+		}
+	}
+	body, err := json.Marshal(batchSummary{Items: statuses})
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode batch summary: %s", err), statusCodeServerError)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCode, Body: string(body)}, nil
+}
+
+// checkBatchItem checks the batch specific rules of an item: a unique request_id and no streaming
+func checkBatchItem(item Request, seen map[string]bool) error {
+	switch {
+	case item.RequestID == "":
+		return fmt.Errorf("request_id is required for batch items")
+	case seen[item.RequestID]:
+		return fmt.Errorf("request_id %s is used by another batch item", item.RequestID)
+	case item.ResponseType == responseTypeStream:
+		return fmt.Errorf("the %s response type is not supported in a batch", responseTypeStream)
+	case item.Protocol != "" && item.Protocol != protocolV2:
+		return fmt.Errorf("batch items are always answered with protocol %s", protocolV2)
+	}
+	return nil
+}
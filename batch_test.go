@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// echoCompleter answers every chat completion with the last message of the request, whatever order the
+// concurrent items of a batch arrive in
+type echoCompleter struct {
+	*testsupport.ScriptedCompleter
+}
+
+func (c echoCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	c.ScriptedCompleter.CreateChatCompletion(ctx, request)
+	response := testsupport.Reply("Re: " + request.Messages[len(request.Messages)-1].Content).Response
+	response.Model = request.Model
+	return response, nil
+}
+
+// batchItem is a full request of a batch with the request_id id, asking content
+func batchItem(id string, content string) string {
+	return `{"response_type":"full","prompt_template":"PROMPT_TEST","request_id":"` + id + `","messages":[{"role":"user","content":"` + content + `"}]}`
+}
+
+// framesByRequestID groups the envelopes posted for a batch by their request_id
+func framesByRequestID(t *testing.T, texts []string) map[string][]string {
+	t.Helper()
+	frames := make(map[string][]string)
+	for _, text := range texts {
+		var envelope frameEnvelope
+		if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+			t.Fatalf("can't decode envelope %s: %v", text, err)
+		}
+		frames[envelope.RequestID] = append(frames[envelope.RequestID], text)
+	}
+	return frames
+}
+
+func TestIsBatchBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{body: `{"batch":[]}`, want: true},
+		{body: `{"action":"sendmessage","batch":[{"response_type":"full"}]}`, want: true},
+		{body: `{"response_type":"full","messages":[]}`},
+		// Rejected as an empty batch rather than run as a request without messages
+		{body: `{"batch":null}`, want: true},
+		{body: `[{"batch":[]}]`},
+		{body: `not json`},
+	}
+	for _, tt := range tests {
+		if got := isBatchBody(tt.body); got != tt.want {
+			t.Errorf("isBatchBody(%s) = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBatchItem(t *testing.T) {
+	seen := map[string]bool{"q1": true}
+	tests := []struct {
+		name    string
+		item    Request
+		wantErr string
+	}{
+		{name: "full", item: Request{ResponseType: responseTypeFull, RequestID: "q2"}},
+		{name: "v2", item: Request{ResponseType: responseTypeInt, RequestID: "q2", Protocol: protocolV2}},
+		{name: "no request_id", item: Request{ResponseType: responseTypeFull}, wantErr: "request_id is required for batch items"},
+		{name: "duplicate request_id", item: Request{ResponseType: responseTypeFull, RequestID: "q1"}, wantErr: "request_id q1 is used by another batch item"},
+		{name: "stream", item: Request{ResponseType: responseTypeStream, RequestID: "q2"}, wantErr: "the stream response type is not supported in a batch"},
+		{name: "other protocol", item: Request{ResponseType: responseTypeFull, RequestID: "q2", Protocol: "v1"}, wantErr: "batch items are always answered with protocol v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkBatchItem(tt.item, seen)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("checkBatchItem() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestBatchRequests checks the envelopes of every item, tagged with its request_id, and the summary of the batch
+func TestBatchRequests(t *testing.T) {
+	final := func(id string, content string) string {
+		return `{"type":"final","seq":0,"data":"Re: ` + content + `","finish_reason":"stop","model":"gpt-test","request_id":"` + id + `"}`
+	}
+	tests := []struct {
+		name        string
+		items       []string
+		wantStatus  int
+		wantSummary batchSummary
+		wantFrames  map[string][]string
+		wantCalls   int
+	}{
+		{
+			name:        "all succeed",
+			items:       []string{batchItem("q1", "one"), batchItem("q2", "two"), batchItem("q3", "three"), batchItem("q4", "four"), batchItem("q5", "five")},
+			wantStatus:  statusCodeOK,
+			wantSummary: batchSummary{Items: []batchItemStatus{{RequestID: "q1", Status: 200}, {RequestID: "q2", Status: 200}, {RequestID: "q3", Status: 200}, {RequestID: "q4", Status: 200}, {RequestID: "q5", Status: 200}}},
+			wantFrames: map[string][]string{
+				"q1": {final("q1", "one")}, "q2": {final("q2", "two")}, "q3": {final("q3", "three")}, "q4": {final("q4", "four")}, "q5": {final("q5", "five")},
+			},
+			wantCalls: 5,
+		},
+		{
+			name:       "stream item",
+			items:      []string{batchItem("q1", "one"), `{"response_type":"stream","prompt_template":"PROMPT_TEST","request_id":"q2","messages":[{"role":"user","content":"two"}]}`},
+			wantStatus: statusCodeOK,
+			wantSummary: batchSummary{Items: []batchItemStatus{
+				{RequestID: "q1", Status: 200},
+				{RequestID: "q2", Status: 400, Error: "Invalid request parameters: the stream response type is not supported in a batch"},
+			}},
+			wantFrames: map[string][]string{
+				"q1": {final("q1", "one")},
+				"q2": {`{"type":"error","seq":0,"code":"invalid_request","data":"Invalid request parameters: the stream response type is not supported in a batch","request_id":"q2"}`},
+			},
+			wantCalls: 1,
+		},
+		{
+			// Without a request_id the client couldn't tell the error envelope apart, so none is posted
+			name:       "item without a request_id",
+			items:      []string{`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"one"}]}`, batchItem("q2", "two")},
+			wantStatus: statusCodeOK,
+			wantSummary: batchSummary{Items: []batchItemStatus{
+				{Status: 400, Error: "Invalid request parameters: request_id is required for batch items"},
+				{RequestID: "q2", Status: 200},
+			}},
+			wantFrames: map[string][]string{"q2": {final("q2", "two")}},
+			wantCalls:  1,
+		},
+		{
+			name:       "duplicate request_id",
+			items:      []string{batchItem("q1", "one"), batchItem("q1", "two")},
+			wantStatus: statusCodeOK,
+			wantSummary: batchSummary{Items: []batchItemStatus{
+				{RequestID: "q1", Status: 200},
+				{RequestID: "q1", Status: 400, Error: "Invalid request parameters: request_id q1 is used by another batch item"},
+			}},
+			wantFrames: map[string][]string{"q1": {
+				`{"type":"error","seq":0,"code":"invalid_request","data":"Invalid request parameters: request_id q1 is used by another batch item","request_id":"q1"}`,
+				final("q1", "one"),
+			}},
+			wantCalls: 1,
+		},
+		{
+			// The batch takes the status of the first item when none succeeded
+			name:       "no item succeeds",
+			items:      []string{`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[]}`, `{"response_type":"stream","prompt_template":"PROMPT_TEST","request_id":"q2","messages":[]}`},
+			wantStatus: statusCodeBadRequest,
+			wantSummary: batchSummary{Items: []batchItemStatus{
+				{Status: 400, Error: "Invalid request parameters: request_id is required for batch items"},
+				{RequestID: "q2", Status: 400, Error: "Invalid request parameters: the stream response type is not supported in a batch"},
+			}},
+			wantFrames: map[string][]string{"q2": {`{"type":"error","seq":0,"code":"invalid_request","data":"Invalid request parameters: the stream response type is not supported in a batch","request_id":"q2"}`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.MaxBatchSize = defaultMaxBatchSize
+			})
+			chat := echoCompleter{testsupport.NewScriptedCompleter()}
+			poster := testsupport.NewRecordingPoster()
+			body := `{"batch":[` + strings.Join(tt.items, ",") + `]}`
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantCalls {
+				t.Errorf("%d OpenAI requests, want %d", got, tt.wantCalls)
+			}
+			var summary batchSummary
+			if err := json.Unmarshal([]byte(response.Body), &summary); err != nil || !reflect.DeepEqual(summary, tt.wantSummary) {
+				t.Errorf("summary = %s, %v, want %+v", response.Body, err, tt.wantSummary)
+			}
+			if got := framesByRequestID(t, poster.Texts()); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantBody string
+	}{
+		{name: "empty", body: `{"batch":[]}`, wantBody: "Invalid batch: batch must not be empty"},
+		{name: "null", body: `{"batch":null}`, wantBody: "Invalid batch: batch must not be empty"},
+		{name: "too large", body: `{"batch":[` + strings.TrimSuffix(strings.Repeat(batchItem("q", "hi")+",", 3), ",") + `]}`, wantBody: "Invalid batch: batch has 3 items, at most 2 are allowed"},
+		{name: "unknown field", body: `{"batch":[` + batchItem("q1", "hi") + `],"response_type":"full"}`, wantBody: "Error parsing batch JSON"},
+		{name: "not an array", body: `{"batch":{"request_id":"q1"}}`, wantBody: "Error parsing batch JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.MaxBatchSize = 2 })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, poster := runTestRequest(t, cfg, chat, tt.body)
+			if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, tt.wantBody) {
+				t.Errorf("Handler() = %d %s, want 400 with %q", response.StatusCode, response.Body, tt.wantBody)
+			}
+			if len(chat.Requests()) != 0 || len(poster.Texts()) != 0 {
+				t.Errorf("the invalid batch reached OpenAI or posted %q", poster.Texts())
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxBatchSize(t *testing.T) {
+	t.Setenv("MAX_BATCH_SIZE", "")
+	cfg, err := loadConfig()
+	if err != nil || cfg.MaxBatchSize != defaultMaxBatchSize {
+		t.Fatalf("loadConfig() = %d, %v, want the default %d", cfg.MaxBatchSize, err, defaultMaxBatchSize)
+	}
+	t.Setenv("MAX_BATCH_SIZE", "25")
+	if cfg, err = loadConfig(); err != nil || cfg.MaxBatchSize != 25 {
+		t.Errorf("loadConfig() = %d, %v, want 25", cfg.MaxBatchSize, err)
+	}
+	t.Setenv("MAX_BATCH_SIZE", "many")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted MAX_BATCH_SIZE many")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	providerBedrock = "bedrock"
+	// anthropicBedrockVersion is the version of the Anthropic messages API on Bedrock
+	anthropicBedrockVersion = "bedrock-2023-05-31"
+)
+
+// isAnthropicModel checks if a Bedrock model ID, possibly with a cross-region inference prefix, names an Anthropic model
+func isAnthropicModel(modelID string) bool {
+	return strings.HasPrefix(modelID, "anthropic.") || strings.Contains(modelID, ".anthropic.")
+}
+
+// bedrockChatCompleter is the ChatCompleter backed by Anthropic models on Amazon Bedrock. Every request goes to
+// BEDROCK_MODEL_ID whatever model it names, so summaries and fallbacks stay on Bedrock too. Moderation
+// isn't offered by Bedrock and is left to the OpenAI moderation endpoint.
+type bedrockChatCompleter struct {
+	client    *bedrockruntime.BedrockRuntime
+	modelID   string
+	maxTokens int // max_tokens is required by Anthropic models, so this is used when the request doesn't set it
+	moderator ChatCompleter
+}
+
+// newBedrockBody encodes the chat request as the body of a Bedrock request for an Anthropic model
+func (c bedrockChatCompleter) newBedrockBody(request openai.ChatCompletionRequest) ([]byte, error) {
+	body := newAnthropicRequest(request, c.maxTokens)
+	body.AnthropicVersion = anthropicBedrockVersion
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("Can't encode Bedrock request: %v", err)
+	}
+	return data, nil
+}
+
+// CreateChatCompletion sends the chat request to Bedrock and waits for the complete answer
+func (c bedrockChatCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	body, err := c.newBedrockBody(request)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	output, err := c.client.InvokeModelWithContext(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(c.modelID),
+		Body:        body,
+		ContentType: aws.String("application/json"),
+		Accept:      aws.String("application/json"),
+	})
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return parseAnthropicResponse(output.Body, anthropicPrefill(request))
+}
+
+// CreateChatCompletionStream opens a Bedrock response stream
+func (c bedrockChatCompleter) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error) {
+	body, err := c.newBedrockBody(request)
+	if err != nil {
+		return nil, err
+	}
+	output, err := c.client.InvokeModelWithResponseStreamWithContext(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
+		ModelId:     aws.String(c.modelID),
+		Body:        body,
+		ContentType: aws.String("application/json"),
+		Accept:      aws.String("application/json"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	eventStream := output.GetStream()
+	return &bedrockStream{events: eventStream.Events(), stream: eventStream, state: anthropicStreamState{model: c.modelID, prefill: anthropicPrefill(request)}}, nil
+}
+
+// ListModels lists the one Bedrock model requests are sent to
+func (c bedrockChatCompleter) ListModels(ctx context.Context) (openai.ModelsList, error) {
+	return openai.ModelsList{Models: []openai.Model{{ID: c.modelID}}}, nil
+}
+
+// Moderations sends the moderation request to the OpenAI moderation endpoint
+func (c bedrockChatCompleter) Moderations(ctx context.Context, request openai.ModerationRequest) (openai.ModerationResponse, error) {
+	return c.moderator.Moderations(ctx, request)
+}
+
+// bedrockStream reads the Anthropic events of a Bedrock response stream
+type bedrockStream struct {
+	events <-chan bedrockruntime.ResponseStreamEvent
+	stream *bedrockruntime.InvokeModelWithResponseStreamEventStream
+	state  anthropicStreamState
+}
+
+// Recv returns the next chunk, or io.EOF after the usage chunk
+func (s *bedrockStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	for !s.state.finished {
+		event, ok := <-s.events
+		if !ok {
+			if err := s.stream.Err(); err != nil {
+				return openai.ChatCompletionStreamResponse{}, err
+			}
+			return openai.ChatCompletionStreamResponse{}, errors.New("Bedrock stream ended without message_stop")
+		}
+		part, ok := event.(*bedrockruntime.PayloadPart)
+		if !ok {
+			continue
+		}
+		chunk, emit, err := s.state.handleEvent(part.Bytes)
+		if err != nil {
+			return openai.ChatCompletionStreamResponse{}, err
+		}
+		if emit {
+			return chunk, nil
+		}
+	}
+	return openai.ChatCompletionStreamResponse{}, io.EOF
+}
+
+// Close closes the Bedrock response stream
+func (s *bedrockStream) Close() error {
+	return s.stream.Close()
+}
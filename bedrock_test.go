@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/eventstream"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testBedrockModel = "anthropic.claude-3-5-sonnet-20240620-v1:0"
+
+// bedrockFixture is a canned Bedrock runtime answering InvokeModel with the Anthropic message of text and
+// InvokeModelWithResponseStream with the events of the same message, one text delta per word
+type bedrockFixture struct {
+	server *httptest.Server
+	text   string
+
+	mu     sync.Mutex
+	paths  []string
+	bodies []anthropicRequest
+}
+
+func newBedrockFixture(t *testing.T, text string) *bedrockFixture {
+	f := &bedrockFixture{text: text}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *bedrockFixture) serve(w http.ResponseWriter, r *http.Request) {
+	var body anthropicRequest
+	data, _ := io.ReadAll(r.Body)
+	json.Unmarshal(data, &body)
+	f.mu.Lock()
+	f.paths = append(f.paths, r.URL.Path)
+	f.bodies = append(f.bodies, body)
+	f.mu.Unlock()
+
+	if !strings.HasSuffix(r.URL.Path, "/invoke-with-response-stream") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":          "msg_test",
+			"model":       testBedrockModel,
+			"content":     []map[string]string{{"type": "text", "text": f.text}},
+			"stop_reason": "end_turn",
+			"usage":       anthropicUsage{InputTokens: 12, OutputTokens: 3},
+		})
+		return
+	}
+	events := []string{`{"type":"message_start","message":{"model":"` + testBedrockModel + `","usage":{"input_tokens":12}}}`}
+	for i, word := range strings.SplitAfter(f.text, " ") {
+		delta, _ := json.Marshal(map[string]any{"type": "content_block_delta", "index": i, "delta": map[string]string{"type": "text_delta", "text": word}})
+		events = append(events, string(delta))
+	}
+	events = append(events,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":3}}`,
+		`{"type":"message_stop"}`,
+	)
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	encoder := eventstream.NewEncoder(w)
+	for _, event := range events {
+		payload, _ := json.Marshal(map[string][]byte{"bytes": []byte(event)})
+		encoder.Encode(eventstream.Message{
+			Headers: eventstream.Headers{
+				{Name: ":message-type", Value: eventstream.StringValue("event")},
+				{Name: ":event-type", Value: eventstream.StringValue("chunk")},
+				{Name: ":content-type", Value: eventstream.StringValue("application/json")},
+			},
+			Payload: payload,
+		})
+	}
+}
+
+// completer returns a Bedrock ChatCompleter sending its requests to the fixture
+func (f *bedrockFixture) completer(moderator ChatCompleter) bedrockChatCompleter {
+	awsSession := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Endpoint:    aws.String(f.server.URL),
+		Credentials: credentials.NewStaticCredentials("AKIDTEST", "secret", ""),
+	}))
+	return bedrockChatCompleter{client: bedrockruntime.New(awsSession), modelID: testBedrockModel, maxTokens: 256, moderator: moderator}
+}
+
+func (f *bedrockFixture) requests() ([]string, []anthropicRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.paths...), append([]anthropicRequest(nil), f.bodies...)
+}
+
+func TestIsAnthropicModel(t *testing.T) {
+	tests := map[string]bool{
+		testBedrockModel: true,
+		"eu.anthropic.claude-3-5-sonnet-20240620-v1:0": true,
+		"meta.llama3-70b-instruct-v1:0":                false,
+		"amazon.titan-text-express-v1":                 false,
+		"anthropic":                                    false,
+	}
+	for model, want := range tests {
+		if got := isAnthropicModel(model); got != want {
+			t.Errorf("isAnthropicModel(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestNewBedrockBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		request openai.ChatCompletionRequest
+		want    anthropicRequest
+	}{
+		{
+			name: "system prompt",
+			request: openai.ChatCompletionRequest{Model: "gpt-4o", Messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "Grade it."},
+				{Role: openai.ChatMessageRoleUser, Content: "hi"},
+				{Role: openai.ChatMessageRoleAssistant, Content: "yes?"},
+				{Role: openai.ChatMessageRoleUser, Content: "Grade my essay"},
+			}},
+			want: anthropicRequest{
+				AnthropicVersion: anthropicBedrockVersion,
+				System:           "Grade it.",
+				Messages:         []anthropicMessage{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "yes?"}, {Role: "user", Content: "Grade my essay"}},
+				MaxTokens:        256,
+			},
+		},
+		{
+			name: "consecutive roles and parameters",
+			request: openai.ChatCompletionRequest{
+				Messages: []openai.ChatCompletionMessage{
+					{Role: openai.ChatMessageRoleSystem, Content: "Grade it."},
+					{Role: openai.ChatMessageRoleDeveloper, Content: "Be brief."},
+					{Role: openai.ChatMessageRoleUser, Content: "first"},
+					{Role: openai.ChatMessageRoleUser, Content: "second"},
+				},
+				MaxTokens:   64,
+				Temperature: 0.5,
+				Stop:        []string{"\n\nHuman:"},
+			},
+			want: anthropicRequest{
+				AnthropicVersion: anthropicBedrockVersion,
+				System:           "Grade it.\n\nBe brief.",
+				Messages:         []anthropicMessage{{Role: "user", Content: "first\n\nsecond"}},
+				MaxTokens:        64,
+				Temperature:      aws.Float32(0.5),
+				StopSequences:    []string{"\n\nHuman:"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := (bedrockChatCompleter{maxTokens: 256}).newBedrockBody(tt.request)
+			if err != nil {
+				t.Fatalf("newBedrockBody() error = %v", err)
+			}
+			var got anthropicRequest
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("newBedrockBody() = %s: %v", data, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newBedrockBody() = %s, want %+v", data, tt.want)
+			}
+			if bytes.Contains(data, []byte(`"model"`)) {
+				t.Errorf("newBedrockBody() = %s, Bedrock takes the model in the URL", data)
+			}
+		})
+	}
+}
+
+// TestBedrockResponseTypes runs the same answer through OpenAI and Bedrock: every response type must post
+// the same frames, whichever provider wrote the answer
+func TestBedrockResponseTypes(t *testing.T) {
+	tests := []struct {
+		responseType string
+		answer       string
+		wantFrames   []string
+	}{
+		{responseType: responseTypeInt, answer: "The grade is [[42]].", wantFrames: []string{"42"}},
+		{responseType: responseTypeString, answer: "Colour: [[deep blue]]", wantFrames: []string{"deep blue"}},
+		{responseType: responseTypeJSON, answer: `{"grade": 42, "comment": "good"}`},
+		{responseType: responseTypeFull, answer: "Hello there", wantFrames: []string{"Hello there"}},
+		{responseType: responseTypeStream, answer: "Hello there friend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.AllowedProviders = map[string]bool{providerOpenAI: true, providerBedrock: true}
+				cfg.BedrockModelID = testBedrockModel
+			})
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Grade it"}]}`
+
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(tt.answer))
+			if tt.responseType == responseTypeStream {
+				chat = testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(0, "Hello ", "there ", "friend")...))
+			}
+			openAIResponse, openAIPoster := runTestRequest(t, cfg, chat, body)
+
+			fixture := newBedrockFixture(t, tt.answer)
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, nil, nil)
+			h.bedrockClients.generation, h.bedrockClients.value = cfg.Generation, fixture.completer(chat)
+			bedrockBody := strings.Replace(body, `{`, `{"provider":"bedrock",`, 1)
+			response, err := h.Handler(context.Background(), testMessage(bedrockBody))
+			if err != nil || response.StatusCode != statusCodeOK || openAIResponse.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, OpenAI %d, want both %d", response.StatusCode, response.Body, err, openAIResponse.StatusCode, statusCodeOK)
+			}
+			if !reflect.DeepEqual(poster.Texts(), openAIPoster.Texts()) {
+				t.Errorf("Bedrock frames = %q, OpenAI frames %q", poster.Texts(), openAIPoster.Texts())
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+
+			paths, requests := fixture.requests()
+			wantPath := "/model/" + testBedrockModel + "/invoke"
+			if tt.responseType == responseTypeStream {
+				wantPath += "-with-response-stream"
+			}
+			if len(paths) != 1 || paths[0] != wantPath {
+				t.Fatalf("Bedrock requests = %q, want %s", paths, wantPath)
+			}
+			if requests[0].System != "You are a test assistant." || len(requests[0].Messages) != 1 || requests[0].Messages[0].Content != "Grade it" {
+				t.Errorf("Bedrock request = %+v, want the prompt template as the system field", requests[0])
+			}
+		})
+	}
+}
+
+func TestBedrockProviderConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers string
+		modelID   string
+		want      map[string]bool
+		wantErr   bool
+	}{
+		{name: "default", want: map[string]bool{providerOpenAI: true}},
+		{name: "bedrock", providers: "openai, bedrock", modelID: testBedrockModel, want: map[string]bool{providerOpenAI: true, providerBedrock: true}},
+		{name: "bedrock only", providers: "bedrock", modelID: testBedrockModel, want: map[string]bool{providerBedrock: true}},
+		{name: "bedrock without a model", providers: "bedrock", wantErr: true},
+		{name: "bedrock with a llama model", providers: "bedrock", modelID: "meta.llama3-70b-instruct-v1:0", wantErr: true},
+		{name: "unknown provider", providers: "openai,cohere", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ALLOWED_PROVIDERS", tt.providers)
+			t.Setenv("BEDROCK_MODEL_ID", tt.modelID)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(cfg.AllowedProviders, tt.want) {
+				t.Errorf("AllowedProviders = %v, want %v", cfg.AllowedProviders, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckProvider(t *testing.T) {
+	penalty := float32(1)
+	cfg := &Config{AllowedProviders: map[string]bool{providerOpenAI: true, providerBedrock: true}}
+	tests := []struct {
+		name    string
+		request Request
+		wantErr string
+	}{
+		{name: "default", request: Request{Tools: []openai.Tool{{Type: openai.ToolTypeFunction}}}},
+		{name: "bedrock", request: Request{Provider: providerBedrock}},
+		{name: "not allowed", request: Request{Provider: providerAnthropic}, wantErr: `provider "anthropic" is not allowed`},
+		{name: "tools", request: Request{Provider: providerBedrock, Tools: []openai.Tool{{Type: openai.ToolTypeFunction}}}, wantErr: "tools are not supported by the bedrock provider"},
+		{name: "penalty", request: Request{Provider: providerBedrock, PresencePenalty: &penalty}, wantErr: "presence_penalty is not supported"},
+		{name: "n", request: Request{Provider: providerBedrock, N: 2}, wantErr: "n greater than 1 is not supported"},
+		{name: "seed", request: Request{Provider: providerBedrock, Seed: new(int)}, wantErr: "seed is not supported by the bedrock provider"},
+		{
+			name:    "images",
+			request: Request{Provider: providerBedrock, Messages: []chatMessage{{Role: openai.ChatMessageRoleUser, Parts: []contentPart{{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: "https://example.com/a.png"}}}}}},
+			wantErr: "images are not supported by the bedrock provider",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkProvider(cfg, tt.request)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkProvider() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkProvider() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
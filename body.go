@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// defaultMaxBodyBytes leaves room for a base64 encoded frame of 128 KB, the API Gateway message limit
+	defaultMaxBodyBytes = 256 * 1024
+	utf8BOM             = "\ufeff"
+)
+
+// decodeBody returns the text of a request body. Bodies over MAX_BODY_BYTES are rejected before they're
+// decoded, base64 encoded ones, like binary websocket frames, are decoded, and a leading UTF-8 byte order
+// mark is dropped, since the JSON decoder takes it for an invalid character.
+func decodeBody(cfg *Config, body string, base64Encoded bool) (string, error) {
+	if cfg.MaxBodyBytes > 0 && len(body) > cfg.MaxBodyBytes {
+		return "", fmt.Errorf("Request body exceeds %d bytes", cfg.MaxBodyBytes)
+	}
+	if base64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", fmt.Errorf("Error decoding request body: %s", err)
+		}
+		body = string(decoded)
+	}
+	return strings.TrimPrefix(body, utf8BOM), nil
+}
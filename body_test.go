@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testBody = `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+
+func TestDecodeBody(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(testBody))
+	tests := []struct {
+		name     string
+		body     string
+		base64   bool
+		maxBytes int
+		want     string
+		wantErr  string
+	}{
+		{name: "plain", body: testBody, want: testBody},
+		{name: "base64", body: encoded, base64: true, want: testBody},
+		{name: "base64 garbage", body: "not base64!", base64: true, wantErr: "Error decoding request body"},
+		{name: "byte order mark", body: "\ufeff" + testBody, want: testBody},
+		{name: "base64 with a byte order mark", body: base64.StdEncoding.EncodeToString([]byte("\ufeff" + testBody)), base64: true, want: testBody},
+		// Only a leading byte order mark is dropped
+		{name: "inner byte order mark", body: "{\"a\":\"\ufeff\"}", want: "{\"a\":\"\ufeff\"}"},
+		{name: "at the limit", body: testBody, maxBytes: len(testBody), want: testBody},
+		{name: "over the limit", body: testBody, maxBytes: len(testBody) - 1, wantErr: "Request body exceeds"},
+		// The limit applies to the encoded body, before anything is decoded
+		{name: "encoded over the limit", body: encoded, base64: true, maxBytes: len(testBody), wantErr: "Request body exceeds"},
+		{name: "no limit", body: strings.Repeat(" ", defaultMaxBodyBytes+1), want: strings.Repeat(" ", defaultMaxBodyBytes+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeBody(&Config{MaxBodyBytes: tt.maxBytes}, tt.body, tt.base64)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeBody() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("decodeBody() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestHandlerDecodesBody sends encoded and marked bodies through Handler
+func TestHandlerDecodesBody(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		base64       bool
+		wantStatus   int
+		wantRequests int
+		wantFrames   []string
+		wantPong     bool
+	}{
+		{name: "encoded valid request", body: base64.StdEncoding.EncodeToString([]byte(testBody)), base64: true, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"Hello"}},
+		{name: "encoded garbage", body: "\x00\x01garbage", base64: true, wantStatus: statusCodeBadRequest},
+		{name: "encoded invalid JSON", body: base64.StdEncoding.EncodeToString([]byte("garbage")), base64: true, wantStatus: statusCodeBadRequest},
+		{name: "byte order mark", body: "\ufeff" + testBody, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"Hello"}},
+		{name: "too large", body: testBody + strings.Repeat(" ", 1024), wantStatus: statusCodeBadRequest},
+		// The action of an encoded body is read after decoding too
+		{name: "encoded ping", body: base64.StdEncoding.EncodeToString([]byte(`{"action":"ping"}`)), base64: true, wantStatus: statusCodeOK, wantPong: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.MaxBodyBytes = len(testBody) + 512 })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			poster := testsupport.NewRecordingPoster()
+			request := testMessage(tt.body)
+			request.IsBase64Encoded = tt.base64
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(context.Background(), request)
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("completer got %d requests, want %d", got, tt.wantRequests)
+			}
+			if tt.wantFrames != nil && strings.Join(poster.Texts(), "|") != strings.Join(tt.wantFrames, "|") {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			if tt.wantPong && (len(poster.Texts()) != 1 || !strings.Contains(poster.Texts()[0], `"type":"pong"`)) {
+				t.Errorf("frames = %q, want a pong", poster.Texts())
+			}
+		})
+	}
+}
+
+// TestHTTPDecodesBody checks that the HTTP API decodes its bodies with the same rules
+func TestHTTPDecodesBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		base64     bool
+		wantStatus int
+	}{
+		{name: "encoded valid request", body: base64.StdEncoding.EncodeToString([]byte(testBody)), base64: true, wantStatus: statusCodeOK},
+		{name: "encoded garbage", body: "not base64!", base64: true, wantStatus: statusCodeBadRequest},
+		{name: "byte order mark", body: "\ufeff" + testBody, wantStatus: statusCodeOK},
+		{name: "too large", body: testBody + strings.Repeat(" ", 1024), wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.MaxBodyBytes = len(testBody) + 512 })
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), testsupport.NewRecordingPoster(), nil, nil)
+			request := events.APIGatewayV2HTTPRequest{Body: tt.body, IsBase64Encoded: tt.base64}
+			request.RequestContext.RequestID = "req-1"
+			if response := h.handleHTTP(context.Background(), cfg, request); response.StatusCode != tt.wantStatus {
+				t.Errorf("handleHTTP() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMaxBodyBytes(t *testing.T) {
+	t.Setenv("MAX_BODY_BYTES", "")
+	cfg, err := loadConfig()
+	if err != nil || cfg.MaxBodyBytes != defaultMaxBodyBytes {
+		t.Fatalf("loadConfig() = %d, %v, want the default %d", cfg.MaxBodyBytes, err, defaultMaxBodyBytes)
+	}
+	t.Setenv("MAX_BODY_BYTES", "1024")
+	if cfg, err := loadConfig(); err != nil || cfg.MaxBodyBytes != 1024 {
+		t.Errorf("loadConfig() = %d, %v, want 1024", cfg.MaxBodyBytes, err)
+	}
+	t.Setenv("MAX_BODY_BYTES", "lots")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an invalid MAX_BODY_BYTES")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	granularityToken     = "token"
+	granularitySentence  = "sentence"
+	granularityParagraph = "paragraph"
+	codeFence            = "```"
+	// sentenceEnders end a sentence when followed by whitespace, possibly after closing quotes or brackets
+	sentenceEnders  = ".!?…"
+	sentenceClosers = "\"')]”’»"
+)
+
+// lastStreamBoundary returns the byte offset just past the last sentence or paragraph boundary in text,
+// or 0 when text has none yet. Boundaries inside fenced code blocks are ignored.
+func lastStreamBoundary(text string, granularity string) int {
+	last := 0
+	inCode := false
+	for i := 0; i < len(text); {
+		if strings.HasPrefix(text[i:], codeFence) {
+			inCode = !inCode
+			i += len(codeFence)
+			continue
+		}
+		if !inCode {
+			if end := boundaryEnd(text, i, granularity); end > 0 {
+				last = end
+				i = end
+				continue
+			}
+		}
+		_, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+	}
+	return last
+}
+
+// boundaryEnd returns the offset just past the boundary starting at offset i of text, or 0 when there is none.
+// A sentence ends with punctuation and whitespace, so the period of a decimal number like 3.14 never ends one,
+// and an ending at the very end of text is only reported once the following whitespace has arrived.
+func boundaryEnd(text string, i int, granularity string) int {
+	if granularity == granularityParagraph {
+		if strings.HasPrefix(text[i:], "\n\n") {
+			return i + 2
+		}
+		return 0
+	}
+
+	j := i
+	ended := false
+	// Swallow runs of punctuation like "?!" or "..." as one ending
+	for j < len(text) {
+		r, size := utf8.DecodeRuneInString(text[j:])
+		if !strings.ContainsRune(sentenceEnders, r) {
+			break
+		}
+		ended = true
+		j += size
+	}
+	if !ended {
+		return 0
+	}
+	for j < len(text) {
+		r, size := utf8.DecodeRuneInString(text[j:])
+		if !strings.ContainsRune(sentenceClosers, r) {
+			break
+		}
+		j += size
+	}
+	if j == len(text) {
+		return 0
+	}
+	r, size := utf8.DecodeRuneInString(text[j:])
+	if !unicode.IsSpace(r) {
+		return 0
+	}
+	return j + size
+}
+
+// isValidGranularity checks if granularity is a supported stream_granularity value
+func isValidGranularity(granularity string) bool {
+	switch granularity {
+	case "", granularityToken, granularitySentence, granularityParagraph:
+		return true
+	}
+	return false
+}
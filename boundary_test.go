@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestLastStreamBoundary(t *testing.T) {
+	tests := []struct {
+		name        string
+		text        string
+		granularity string
+		want        string // Text up to the boundary
+	}{
+		{name: "no ending", text: "Hello there", granularity: granularitySentence, want: ""},
+		{name: "ending without whitespace yet", text: "Hello there.", granularity: granularitySentence, want: ""},
+		{name: "sentence", text: "Hello there. How", granularity: granularitySentence, want: "Hello there. "},
+		{name: "last of several", text: "One. Two! Three? Fo", granularity: granularitySentence, want: "One. Two! Three? "},
+		{name: "decimal number", text: "Pi is 3.14 and", granularity: granularitySentence, want: ""},
+		{name: "ellipsis", text: "Well... maybe", granularity: granularitySentence, want: "Well... "},
+		{name: "unicode ellipsis", text: "Well… maybe", granularity: granularitySentence, want: "Well… "},
+		{name: "punctuation run", text: "Really?! Yes", granularity: granularitySentence, want: "Really?! "},
+		{name: "quote after period", text: `He said "stop." Then`, granularity: granularitySentence, want: `He said "stop." `},
+		{name: "typographic quote", text: "She said “go.” Then", granularity: granularitySentence, want: "She said “go.” "},
+		{name: "bracket", text: "See (the note.) Next", granularity: granularitySentence, want: "See (the note.) "},
+		{name: "newline", text: "Done.\nNext", granularity: granularitySentence, want: "Done.\n"},
+		{name: "code block", text: "Run:\n```\nx = 1. y = 2. z\n", granularity: granularitySentence, want: ""},
+		{name: "after code block", text: "```\na. b\n``` Done. Next", granularity: granularitySentence, want: "```\na. b\n``` Done. "},
+		{name: "paragraph", text: "First line.\nSecond.\n\nThird", granularity: granularityParagraph, want: "First line.\nSecond.\n\n"},
+		{name: "no paragraph", text: "First. Second.\nThird", granularity: granularityParagraph, want: ""},
+		{name: "paragraph in code", text: "```\na\n\nb", granularity: granularityParagraph, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cut := lastStreamBoundary(tt.text, tt.granularity)
+			if got := tt.text[:cut]; got != tt.want {
+				t.Fatalf("lastStreamBoundary(%q) cuts at %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamGranularity(t *testing.T) {
+	deltas := []string{"The value ", "is 3.", "14. It ", "grows", "! Then\n", "\nmore", " text"}
+	tests := []struct {
+		granularity string
+		want        []string
+	}{
+		{granularity: "sentence", want: []string{"The value is 3.14. ", "It grows! ", "Then\n\nmore text"}},
+		{granularity: "paragraph", want: []string{"The value is 3.14. It grows! Then\n\n", "more text"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.granularity, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = "<END>" })
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(time.Second, deltas...)...))
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","stream_granularity":"` + tt.granularity + `","messages":[{"role":"user","content":"hi"}]}`
+			_, poster := runTestRequest(t, cfg, chat, body)
+			want := append(tt.want, "<END>")
+			if got := poster.Texts(); strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Fatalf("frames = %q, want %q", got, want)
+			}
+		})
+	}
+}
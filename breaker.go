@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	errorCodeProviderUnavailable = "provider_unavailable"
+	defaultCircuitWindow         = 60 * time.Second
+	defaultCircuitOpenDuration   = 30 * time.Second
+)
+
+// ErrProviderUnavailable is returned without calling the OpenAI API while its circuit is open
+var ErrProviderUnavailable = errors.New("OpenAI API is unavailable, try again later")
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fails requests fast while the OpenAI API keeps failing. CIRCUIT_FAILURE_THRESHOLD consecutive
+// outage failures within CIRCUIT_WINDOW_SECONDS open the circuit for CIRCUIT_OPEN_SECONDS, then a single probe
+// request is let through and closes the circuit again when the provider answers. The state lives in the execution
+// environment, so each Lambda container trips on its own failures rather than sharing a global state.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	since    time.Time // First failure of the current run of failures
+	openedAt time.Time
+	probing  bool // Set while the half-open probe is in flight
+	nowFunc  func() time.Time
+}
+
+var openAIBreaker = &circuitBreaker{nowFunc: time.Now}
+
+// allow reports whether a request may call the OpenAI API. Once the open duration passed, only the first
+// caller is allowed through as the probe and every other request keeps failing fast until it's recorded.
+func (b *circuitBreaker) allow(cfg *Config) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if b.nowFunc().Sub(b.openedAt) < cfg.CircuitOpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// record counts the outcome of an allowed request. Only outages count as failures, an error the provider
+// answered with, such as an invalid request, shows it's up. A request ended by its own context or by the
+// client leaving says nothing about the provider, so it only hands the probe over to the next request.
+func (b *circuitBreaker) record(cfg *Config, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.nowFunc()
+	switch {
+	case !isOutageError(err) && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrClientGone)):
+		b.probing = false
+	case !isOutageError(err):
+		if b.state == circuitHalfOpen {
+			slog.Info("OpenAI API circuit closed")
+		}
+		b.state, b.failures, b.probing = circuitClosed, 0, false
+	case b.state == circuitHalfOpen:
+		slog.Warn("OpenAI API circuit probe failed, opening the circuit again", "error", err)
+		b.state, b.openedAt, b.probing = circuitOpen, now, false
+	default:
+		if b.failures == 0 || now.Sub(b.since) > cfg.CircuitWindow {
+			b.failures, b.since = 0, now
+		}
+		b.failures++
+		if b.state == circuitClosed && b.failures >= cfg.CircuitFailureThreshold {
+			slog.Warn("OpenAI API circuit opened", "failures", b.failures, "open_duration", cfg.CircuitOpenDuration)
+			b.state, b.openedAt, b.failures = circuitOpen, now, 0
+		}
+	}
+}
+
+// isOutageError checks if err means the OpenAI API is unavailable: a server side error, a timeout, a broken
+// stream or a request that never got an answer. Requests ended by their own context or by the client don't say anything about it.
+func isOutageError(err error) bool {
+	if isTimeoutError(err) {
+		return true
+	}
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrClientGone) {
+		return false
+	}
+	if errors.Is(err, ErrStreamAborted) {
+		return true
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode >= 500
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode >= 500
+	}
+	return errors.Is(err, ErrOpenAIRequest)
+}
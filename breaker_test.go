@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// breakerStep is one step of a circuit breaker scenario: the clock advances, then the step either asks allow and
+// compares its answer with allowed, or records err when record is set
+type breakerStep struct {
+	advance time.Duration
+	record  bool
+	err     error
+	allowed bool
+}
+
+// allowStep asks the breaker to allow a request, expecting allowed
+func allowStep(advance time.Duration, allowed bool) breakerStep {
+	return breakerStep{advance: advance, allowed: allowed}
+}
+
+// recordStep records the outcome err of a request
+func recordStep(err error) breakerStep {
+	return breakerStep{record: true, err: err}
+}
+
+// newTestBreaker returns a closed circuit breaker running on clock
+func newTestBreaker(clock *testsupport.Clock) *circuitBreaker {
+	return &circuitBreaker{nowFunc: clock.Now}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	outage := &openai.APIError{HTTPStatusCode: 503, Message: "overloaded"}
+	invalid := &openai.APIError{HTTPStatusCode: 400, Message: "bad request"}
+	// openSteps opens the circuit with the three failures of the threshold
+	openSteps := []breakerStep{allowStep(0, true), recordStep(outage), allowStep(0, true), recordStep(outage), allowStep(0, true), recordStep(outage)}
+	tests := []struct {
+		name      string
+		steps     []breakerStep
+		wantState int
+	}{
+		{name: "closed", steps: []breakerStep{allowStep(0, true), recordStep(nil), allowStep(0, true)}, wantState: circuitClosed},
+		{name: "opens at the threshold", steps: append(openSteps, allowStep(time.Second, false)), wantState: circuitOpen},
+		{
+			name:      "below the threshold",
+			steps:     []breakerStep{recordStep(outage), recordStep(outage), allowStep(0, true)},
+			wantState: circuitClosed,
+		},
+		{
+			name:      "success resets the failures",
+			steps:     []breakerStep{recordStep(outage), recordStep(outage), recordStep(nil), recordStep(outage), recordStep(outage), allowStep(0, true)},
+			wantState: circuitClosed,
+		},
+		{
+			// An error the provider answered with shows it's up
+			name:      "client error resets the failures",
+			steps:     []breakerStep{recordStep(outage), recordStep(outage), recordStep(invalid), recordStep(outage), allowStep(0, true)},
+			wantState: circuitClosed,
+		},
+		{
+			name:      "canceled requests don't count",
+			steps:     []breakerStep{recordStep(outage), recordStep(outage), recordStep(context.Canceled), recordStep(ErrClientGone), allowStep(0, true)},
+			wantState: circuitClosed,
+		},
+		{
+			name: "failures outside the window",
+			steps: []breakerStep{
+				recordStep(outage), recordStep(outage),
+				allowStep(61*time.Second, true), recordStep(outage), recordStep(outage), allowStep(0, true),
+			},
+			wantState: circuitClosed,
+		},
+		{
+			name: "timeouts count",
+			steps: []breakerStep{
+				recordStep(ErrOpenAITimeout), recordStep(ErrFirstTokenTimeout), recordStep(fmt.Errorf("%w: EOF", ErrStreamAborted)),
+				allowStep(0, false),
+			},
+			wantState: circuitOpen,
+		},
+		{
+			// Once the open duration passed a single probe goes through, the other requests keep failing fast
+			name:      "half open",
+			steps:     append(openSteps, allowStep(29*time.Second, false), allowStep(time.Second, true), allowStep(0, false)),
+			wantState: circuitHalfOpen,
+		},
+		{name: "probe success closes", steps: append(openSteps, allowStep(30*time.Second, true), recordStep(nil), allowStep(0, true), allowStep(0, true)), wantState: circuitClosed},
+		{
+			name:      "probe failure opens again",
+			steps:     append(openSteps, allowStep(30*time.Second, true), recordStep(outage), allowStep(29*time.Second, false), allowStep(time.Second, true)),
+			wantState: circuitHalfOpen,
+		},
+		{
+			// A probe ended by its client hands the probe over to the next request
+			name:      "canceled probe",
+			steps:     append(openSteps, allowStep(30*time.Second, true), recordStep(context.Canceled), allowStep(0, true), allowStep(0, false)),
+			wantState: circuitHalfOpen,
+		},
+	}
+	cfg := &Config{CircuitFailureThreshold: 3, CircuitWindow: time.Minute, CircuitOpenDuration: 30 * time.Second}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testsupport.NewClock(testStart)
+			breaker := newTestBreaker(clock)
+			for i, step := range tt.steps {
+				clock.Advance(step.advance)
+				if step.record {
+					breaker.record(cfg, step.err)
+					continue
+				}
+				if got := breaker.allow(cfg); got != step.allowed {
+					t.Fatalf("step %d: allow() = %v, want %v", i, got, step.allowed)
+				}
+			}
+			if breaker.state != tt.wantState {
+				t.Errorf("state = %d, want %d", breaker.state, tt.wantState)
+			}
+		})
+	}
+}
+
+func TestIsOutageError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil"},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: 500}, want: true},
+		{name: "server request error", err: fmt.Errorf("wrapped: %w", &openai.RequestError{HTTPStatusCode: 502}), want: true},
+		{name: "rate limited", err: &openai.APIError{HTTPStatusCode: 429}},
+		{name: "invalid request", err: &openai.RequestError{HTTPStatusCode: 400}},
+		{name: "call timeout", err: ErrOpenAITimeout, want: true},
+		{name: "first token timeout", err: ErrFirstTokenTimeout, want: true},
+		{name: "stall", err: ErrStreamStalled, want: true},
+		{name: "broken stream", err: fmt.Errorf("%w: unexpected EOF", ErrStreamAborted), want: true},
+		{name: "no answer", err: fmt.Errorf("%w: connection refused", ErrOpenAIRequest), want: true},
+		{name: "canceled", err: context.Canceled},
+		{name: "deadline", err: context.DeadlineExceeded},
+		{name: "client gone", err: ErrClientGone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOutageError(tt.err); got != tt.want {
+				t.Errorf("isOutageError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCircuitBreakerHandler checks that an open circuit answers requests without calling OpenAI, and that the
+// probe closes it again once the provider answers
+func TestCircuitBreakerHandler(t *testing.T) {
+	clock := testsupport.NewClock(testStart)
+	original := openAIBreaker
+	t.Cleanup(func() { openAIBreaker = original })
+	openAIBreaker = newTestBreaker(clock)
+
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.OpenAIMaxRetries = 0
+		cfg.CircuitFailureThreshold = 2
+		cfg.CircuitWindow = time.Minute
+		cfg.CircuitOpenDuration = 30 * time.Second
+	})
+	outage := testsupport.Fail(&openai.APIError{HTTPStatusCode: 503, Message: "overloaded"})
+	chat := testsupport.NewScriptedCompleter(outage, outage, testsupport.Reply("Hello"))
+	chat.Clock = clock
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), nil, clock)
+	const body = `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+
+	tests := []struct {
+		name       string
+		advance    time.Duration
+		wantStatus int
+		wantFrames []string
+		wantCalls  int // OpenAI requests made so far
+	}{
+		{name: "first failure", wantStatus: statusCodeServerError, wantCalls: 1},
+		{name: "second failure opens", wantStatus: statusCodeServerError, wantCalls: 2},
+		{
+			name:       "fails fast",
+			advance:    10 * time.Second,
+			wantStatus: statusCodeUnavailable,
+			wantFrames: []string{`{"type":"error","code":"provider_unavailable","message":"` + ErrProviderUnavailable.Error() + `"}`},
+			wantCalls:  2,
+		},
+		{name: "probe", advance: 20 * time.Second, wantStatus: statusCodeOK, wantFrames: []string{"Hello"}, wantCalls: 3},
+		{name: "closed again", wantStatus: statusCodeOK, wantFrames: []string{"Hello"}, wantCalls: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			poster := testsupport.NewRecordingPoster()
+			h.localPoster = poster
+			response, err := h.Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			if got := len(chat.Requests()); got != tt.wantCalls {
+				t.Errorf("OpenAI requests = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCircuitBreaker(t *testing.T) {
+	tests := []struct {
+		name          string
+		threshold     string
+		window        string
+		open          string
+		wantThreshold int
+		wantWindow    time.Duration
+		wantOpen      time.Duration
+		wantErr       string
+	}{
+		{name: "defaults", wantWindow: defaultCircuitWindow, wantOpen: defaultCircuitOpenDuration},
+		{name: "set", threshold: "5", window: "120", open: "10", wantThreshold: 5, wantWindow: 2 * time.Minute, wantOpen: 10 * time.Second},
+		{name: "negative threshold", threshold: "-1", wantErr: "CIRCUIT_FAILURE_THRESHOLD"},
+		{name: "invalid window", window: "1m", wantErr: "CIRCUIT_WINDOW_SECONDS"},
+		{name: "invalid open duration", open: "soon", wantErr: "CIRCUIT_OPEN_SECONDS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CIRCUIT_FAILURE_THRESHOLD", tt.threshold)
+			t.Setenv("CIRCUIT_WINDOW_SECONDS", tt.window)
+			t.Setenv("CIRCUIT_OPEN_SECONDS", tt.open)
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.CircuitFailureThreshold != tt.wantThreshold || cfg.CircuitWindow != tt.wantWindow || cfg.CircuitOpenDuration != tt.wantOpen {
+				t.Errorf("breaker = %d, %v, %v, want %d, %v, %v", cfg.CircuitFailureThreshold, cfg.CircuitWindow, cfg.CircuitOpenDuration, tt.wantThreshold, tt.wantWindow, tt.wantOpen)
+			}
+		})
+	}
+}
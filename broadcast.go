@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	actionBroadcast           = "broadcast"
+	frameTypeBroadcast        = "broadcast"
+	frameTypeBroadcastSummary = "broadcast_summary"
+	maxBroadcastBytes         = 32 * 1024
+	defaultBroadcastWorkers   = 16
+	// maxBroadcastFailures caps the failed connection IDs listed in the summary
+	maxBroadcastFailures = 100
+)
+
+// broadcastRequest is sent by an admin connection to post message to every connection in CONNECTIONS_TABLE
+type broadcastRequest struct {
+	Action  string          `json:"action"`
+	Message json.RawMessage `json:"message"`
+	Secret  string          `json:"secret,omitempty"` // Authorizes connections without the admin flag when it matches BROADCAST_SECRET
+}
+
+// broadcastFrame is posted to every connection
+type broadcastFrame struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// broadcastSummary answers the sender once every connection was tried. Incomplete is set when the scan of
+// the connections table broke off, so the counts only cover the connections read until then.
+type broadcastSummary struct {
+	Type              string   `json:"type"`
+	Sent              int      `json:"sent"`
+	Gone              int      `json:"gone"`
+	Failed            int      `json:"failed"`
+	FailedConnections []string `json:"failed_connections,omitempty"`
+	Incomplete        bool     `json:"incomplete,omitempty"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// add counts the outcome of the post to connectionID
+func (s *broadcastSummary) add(connectionID string, err error) {
+	switch {
+	case err == nil:
+		s.Sent++
+	case errors.Is(err, ErrClientGone):
+		s.Gone++
+	default:
+		s.Failed++
+		if len(s.FailedConnections) < maxBroadcastFailures {
+			s.FailedConnections = append(s.FailedConnections, connectionID)
+		}
+	}
+}
+
+// handleBroadcast posts the message of an admin to all connections recorded in CONNECTIONS_TABLE, reading
+// the table page by page and posting every page with BROADCAST_WORKERS concurrent posts. The records of
+// connections that turn out to be gone are deleted. The sender gets a summary of the outcome.
+func (h *WebsocketHandler) handleBroadcast(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var broadcast broadcastRequest
+	if err := json.Unmarshal([]byte(request.Body), &broadcast); err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing broadcast JSON: %s", err), statusCodeBadRequest)
+	}
+	if cfg.ConnectionsTable == "" {
+		return errorResponse("Broadcast is not supported without a connections table", statusCodeBadRequest)
+	}
+	sender := request.RequestContext.ConnectionID
+	client := h.getDynamoDBClient(cfg)
+
+	authorized, err := isBroadcastAuthorized(ctx, client, cfg, sender, broadcast.Secret)
+	if err != nil {
+		loggerFrom(ctx).Error("Can't authorize broadcast", "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+	if !authorized {
+		loggerFrom(ctx).Warn("Broadcast audit", "result", "unauthorized")
+		return errorResponse("Broadcast requires an admin connection", statusCodeUnauthorized)
+	}
+
+	if len(broadcast.Message) == 0 || string(broadcast.Message) == "null" {
+		return errorResponse("Broadcast message is required", statusCodeBadRequest)
+	}
+	data, err := json.Marshal(broadcastFrame{Type: frameTypeBroadcast, Data: broadcast.Message})
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error encoding broadcast message: %s", err), statusCodeServerError)
+	}
+	if len(data) > maxBroadcastBytes {
+		return errorResponse(fmt.Sprintf("Broadcast message exceeds %d bytes", maxBroadcastBytes), statusCodeBadRequest)
+	}
+
+	summary := broadcastConnections(ctx, client, cfg, h.getConnectionPoster(ctx, cfg), data)
+	summary.Type = frameTypeBroadcastSummary
+	loggerFrom(ctx).Info("Broadcast audit", "bytes", len(data), "sent", summary.Sent, "gone", summary.Gone, "failed", summary.Failed, "incomplete", summary.Incomplete)
+
+	reply, err := json.Marshal(summary)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error encoding broadcast summary: %s", err), statusCodeServerError)
+	}
+	senderRequest := openAIRequest{ctx: ctx, config: cfg, poster: h.getConnectionPoster(ctx, cfg), ConnectionId: sender}
+	if err := postToConnection(senderRequest, reply); err != nil && !errors.Is(err, ErrClientGone) {
+		loggerFrom(ctx).Error("Can't post broadcast summary", "error", err)
+	}
+	if summary.Incomplete {
+		return errorResponse(fmt.Sprintf("Broadcast incomplete: %s", summary.Error), statusCodeServerError)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
+
+// isBroadcastAuthorized checks if the sender may broadcast: a secret matching BROADCAST_SECRET, or a
+// connection record carrying the admin flag of its token or Cognito group
+func isBroadcastAuthorized(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, connectionID string, secret string) (bool, error) {
+	if cfg.BroadcastSecret != "" && secret != "" {
+		return subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.BroadcastSecret)) == 1, nil
+	}
+	output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.ConnectionsTable),
+		Key:            connectionKey(connectionID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Can't look up connection record: %v", err)
+	}
+	admin, ok := output.Item["admin"]
+	return ok && aws.BoolValue(admin.BOOL), nil
+}
+
+// broadcastConnections posts data to every connection of the connections table. A failing scan ends the
+// broadcast with the pages read so far posted, and the summary marked incomplete.
+func broadcastConnections(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, poster ConnectionPoster, data []byte) broadcastSummary {
+	var summary broadcastSummary
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(cfg.ConnectionsTable),
+		ProjectionExpression: aws.String("connection_id"),
+	}
+	err := client.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		ids := make([]string, 0, len(page.Items))
+		for _, item := range page.Items {
+			if id, ok := item["connection_id"]; ok && aws.StringValue(id.S) != "" {
+				ids = append(ids, aws.StringValue(id.S))
+			}
+		}
+		errs := runBounded(ctx, len(ids), cfg.BroadcastWorkers, func(i int) error {
+			target := openAIRequest{ctx: ctx, config: cfg, poster: poster, ConnectionId: ids[i]}
+			err := postToConnection(target, data)
+			if errors.Is(err, ErrClientGone) {
+				deleteConnectionRecord(ctx, client, cfg, ids[i])
+			}
+			return err
+		})
+		for i, err := range errs {
+			summary.add(ids[i], err)
+		}
+		return ctx.Err() == nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		loggerFrom(ctx).Error("Can't scan connections table", "error", err)
+		summary.Incomplete = true
+		summary.Error = err.Error()
+	}
+	return summary
+}
+
+// deleteConnectionRecord removes the record of a connection that no longer exists. A failure is only logged,
+// the TTL removes the record eventually.
+func deleteConnectionRecord(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, connectionID string) {
+	_, err := client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(cfg.ConnectionsTable),
+		Key:       connectionKey(connectionID),
+	})
+	if err != nil {
+		loggerFrom(ctx).Warn("Can't delete connection record", "connection_id", connectionID, "error", err)
+	}
+}
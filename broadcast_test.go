@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// targetedPoster records the posts to connections, failing the ones to the connections of fails. It tracks
+// how many posts run at the same time.
+type targetedPoster struct {
+	*testsupport.RecordingPoster
+	fails map[string]error
+
+	mu          sync.Mutex
+	running     int
+	maxParallel int
+}
+
+func (p *targetedPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	p.mu.Lock()
+	p.running++
+	p.maxParallel = max(p.maxParallel, p.running)
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.running--
+		p.mu.Unlock()
+	}()
+	// Holding the post a moment lets the concurrent posts of a page overlap
+	time.Sleep(time.Millisecond)
+	if err := p.fails[connectionID]; err != nil {
+		return err
+	}
+	return p.RecordingPoster.PostToConnection(ctx, connectionID, data)
+}
+
+// received returns the frames posted to connectionID
+func (p *targetedPoster) received(connectionID string) []string {
+	var frames []string
+	for _, frame := range p.Frames() {
+		if frame.ConnectionID == connectionID {
+			frames = append(frames, string(frame.Data))
+		}
+	}
+	return frames
+}
+
+// broadcastTable returns a connections table recording conn-1 to conn-5, conn-1 with the admin flag when admin is set
+func broadcastTable(admin bool) *fakeDynamoDB {
+	db := newFakeDynamoDB().table("connections", "connection_id")
+	for _, id := range []string{"conn-1", "conn-2", "conn-3", "conn-4", "conn-5"} {
+		item := connectionKey(id)
+		if id == "conn-1" && admin {
+			item["admin"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+		}
+		db.put("connections", item)
+	}
+	return db
+}
+
+func TestBroadcast(t *testing.T) {
+	const frame = `{"type":"broadcast","data":"maintenance in 2 minutes"}`
+	serverError := &testsupport.StatusError{Code: http.StatusInternalServerError}
+	tests := []struct {
+		name        string
+		body        string
+		admin       bool
+		secret      string
+		noTable     bool
+		fails       map[string]error
+		scanErr     error // Failure of the scan after its first page
+		wantStatus  int
+		wantSummary string   // Frame answering the sender, empty for none
+		wantFrames  []string // Connections the broadcast frame reached
+		wantRecords int      // Connection records left in the table
+	}{
+		{
+			name:        "admin",
+			body:        `{"action":"broadcast","message":"maintenance in 2 minutes"}`,
+			admin:       true,
+			wantStatus:  statusCodeOK,
+			wantSummary: `{"type":"broadcast_summary","sent":5,"gone":0,"failed":0}`,
+			wantFrames:  []string{"conn-1", "conn-2", "conn-3", "conn-4", "conn-5"},
+			wantRecords: 5,
+		},
+		{
+			// Gone connections lose their record, failed ones are listed in the summary
+			name:        "partial failure",
+			body:        `{"action":"broadcast","message":"maintenance in 2 minutes"}`,
+			admin:       true,
+			fails:       map[string]error{"conn-3": testsupport.ErrGone, "conn-4": serverError},
+			wantStatus:  statusCodeOK,
+			wantSummary: `{"type":"broadcast_summary","sent":3,"gone":1,"failed":1,"failed_connections":["conn-4"]}`,
+			wantFrames:  []string{"conn-1", "conn-2", "conn-5"},
+			wantRecords: 4,
+		},
+		{
+			// The pages read before the scan broke off are posted, and the summary says it's incomplete
+			name:        "scan failure",
+			body:        `{"action":"broadcast","message":"maintenance in 2 minutes"}`,
+			admin:       true,
+			scanErr:     errors.New("throughput exceeded"),
+			wantStatus:  statusCodeServerError,
+			wantSummary: `{"type":"broadcast_summary","sent":2,"gone":0,"failed":0,"incomplete":true,"error":"throughput exceeded"}`,
+			wantFrames:  []string{"conn-1", "conn-2"},
+			wantRecords: 5,
+		},
+		{
+			name:        "broadcast secret",
+			body:        `{"action":"broadcast","message":"maintenance in 2 minutes","secret":"s3cret"}`,
+			secret:      "s3cret",
+			wantStatus:  statusCodeOK,
+			wantSummary: `{"type":"broadcast_summary","sent":5,"gone":0,"failed":0}`,
+			wantFrames:  []string{"conn-1", "conn-2", "conn-3", "conn-4", "conn-5"},
+			wantRecords: 5,
+		},
+		{name: "wrong secret", body: `{"action":"broadcast","message":"hi","secret":"guess"}`, admin: true, secret: "s3cret", wantStatus: statusCodeUnauthorized, wantRecords: 5},
+		{name: "not an admin", body: `{"action":"broadcast","message":"hi"}`, wantStatus: statusCodeUnauthorized, wantRecords: 5},
+		{name: "no message", body: `{"action":"broadcast"}`, admin: true, wantStatus: statusCodeBadRequest, wantRecords: 5},
+		{name: "message too large", body: `{"action":"broadcast","message":"` + strings.Repeat("x", maxBroadcastBytes) + `"}`, admin: true, wantStatus: statusCodeBadRequest, wantRecords: 5},
+		{name: "no connections table", body: `{"action":"broadcast","message":"hi"}`, admin: true, noTable: true, wantStatus: statusCodeBadRequest, wantRecords: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.ConnectionsTable = "connections"
+				if tt.noTable {
+					cfg.ConnectionsTable = ""
+				}
+				cfg.BroadcastSecret = tt.secret
+				cfg.BroadcastWorkers = 2
+			})
+			db := broadcastTable(tt.admin).paginate(2, 1, tt.scanErr)
+			poster := &targetedPoster{RecordingPoster: testsupport.NewRecordingPoster(), fails: tt.fails}
+			response, err := newTestHandler(cfg, testsupport.NewScriptedCompleter(), poster, db, nil).Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			var reached []string
+			for _, id := range []string{"conn-1", "conn-2", "conn-3", "conn-4", "conn-5"} {
+				if frames := poster.received(id); len(frames) > 0 && frames[0] == frame {
+					reached = append(reached, id)
+				}
+			}
+			if strings.Join(reached, ",") != strings.Join(tt.wantFrames, ",") {
+				t.Errorf("broadcast reached %q, want %q", reached, tt.wantFrames)
+			}
+			var summary string
+			if frames := poster.received("conn-1"); len(frames) > 0 && strings.Contains(frames[len(frames)-1], frameTypeBroadcastSummary) {
+				summary = frames[len(frames)-1]
+			}
+			if summary != tt.wantSummary {
+				t.Errorf("summary = %s, want %s", summary, tt.wantSummary)
+			}
+			if got := len(db.rows("connections")); got != tt.wantRecords {
+				t.Errorf("connection records = %d, want %d", got, tt.wantRecords)
+			}
+			if poster.maxParallel > cfg.BroadcastWorkers {
+				t.Errorf("%d posts ran at the same time, want at most %d", poster.maxParallel, cfg.BroadcastWorkers)
+			}
+		})
+	}
+}
+
+func TestBroadcastPagination(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 5} {
+		db := broadcastTable(true).paginate(size, 0, nil)
+		cfg := testConfig(t, func(cfg *Config) { cfg.ConnectionsTable = "connections" })
+		poster := testsupport.NewRecordingPoster()
+		summary := broadcastConnections(context.Background(), db, cfg, poster, []byte("hi"))
+		if summary.Sent != 5 || summary.Incomplete || len(poster.Frames()) != 5 {
+			t.Errorf("pages of %d: summary = %+v with %d frames, want every connection sent to", size, summary, len(poster.Frames()))
+		}
+	}
+}
+
+func TestLoadConfigBroadcastWorkers(t *testing.T) {
+	t.Setenv("BROADCAST_WORKERS", "")
+	cfg, err := loadConfig()
+	if err != nil || cfg.BroadcastWorkers != defaultBroadcastWorkers {
+		t.Fatalf("loadConfig() = %d, %v, want the default %d workers", cfg.BroadcastWorkers, err, defaultBroadcastWorkers)
+	}
+	t.Setenv("BROADCAST_WORKERS", "many")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an invalid BROADCAST_WORKERS")
+	}
+}
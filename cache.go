@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+)
+
+const defaultCacheTTL = time.Hour
+
+// responseCacheKey returns the SHA-256 of the complete chat request: the model, the resolved system prompt,
+// the messages and the sampling parameters
+func responseCacheKey(chatRequest openai.ChatCompletionRequest) (string, error) {
+	data, err := json.Marshal(chatRequest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// getCachedResponse looks up a cached OpenAI response. Items past their expiry count as misses even before
+// DynamoDB gets around to deleting them. Lookup failures are logged and count as misses too.
+func getCachedResponse(ctx context.Context, openAIRequest openAIRequest, key string) (openai.ChatCompletionResponse, bool) {
+	output, err := openAIRequest.dynamoDBClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(openAIRequest.config.CacheTable),
+		Key:       map[string]*dynamodb.AttributeValue{"cache_key": {S: aws.String(key)}},
+	})
+	if err != nil {
+		openAIRequest.logger().Warn("Can't read response cache", "error", err)
+		return openai.ChatCompletionResponse{}, false
+	}
+	cached, ok := output.Item["response"]
+	if !ok {
+		return openai.ChatCompletionResponse{}, false
+	}
+	if expiresAt, ok := output.Item["expires_at"]; ok {
+		expires, _ := strconv.ParseInt(aws.StringValue(expiresAt.N), 10, 64)
+		if openAIRequest.getClock().Now().Unix() >= expires {
+			return openai.ChatCompletionResponse{}, false
+		}
+	}
+	var response openai.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(aws.StringValue(cached.S)), &response); err != nil || len(response.Choices) == 0 {
+		openAIRequest.logger().Warn("Can't decode cached response", "error", err)
+		return openai.ChatCompletionResponse{}, false
+	}
+	// No tokens were spent on this answer
+	response.Usage = openai.Usage{}
+	return response, true
+}
+
+// storeCachedResponse caches an OpenAI response for CACHE_TTL_SECONDS. A failure is only logged.
+func storeCachedResponse(ctx context.Context, openAIRequest openAIRequest, key string, response openai.ChatCompletionResponse) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		openAIRequest.logger().Warn("Can't encode response for the cache", "error", err)
+		return
+	}
+	_, err = openAIRequest.dynamoDBClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(openAIRequest.config.CacheTable),
+		Item: map[string]*dynamodb.AttributeValue{
+			"cache_key":  {S: aws.String(key)},
+			"response":   {S: aws.String(string(data))},
+			"expires_at": {N: aws.String(strconv.FormatInt(openAIRequest.getClock().Now().Add(openAIRequest.config.CacheTTL).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		openAIRequest.logger().Warn("Can't write response cache", "error", err)
+	}
+}
+
+// createCachedChatCompletion serves the chat request from the response cache when the request sets cache,
+// and calls create and caches its response otherwise
+func createCachedChatCompletion(ctx context.Context, openAIRequest openAIRequest, chatRequest openai.ChatCompletionRequest, create func() (openai.ChatCompletionResponse, error)) (openai.ChatCompletionResponse, error) {
+	if !openAIRequest.request.Cache || openAIRequest.config.CacheTable == "" {
+		return create()
+	}
+	key, err := responseCacheKey(chatRequest)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't compute cache key: %v", err)
+	}
+	if response, ok := getCachedResponse(ctx, openAIRequest, key); ok {
+		openAIRequest.logger().Info("Response cache hit")
+		openAIRequest.metrics.countCache(true)
+		return response, nil
+	}
+	openAIRequest.metrics.countCache(false)
+
+	response, err := create()
+	if err != nil {
+		return response, err
+	}
+	storeCachedResponse(ctx, openAIRequest, key, response)
+	return response, nil
+}
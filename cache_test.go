@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestResponseCacheKey(t *testing.T) {
+	base := openai.ChatCompletionRequest{
+		Model:    "gpt-test",
+		Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "Grade it."}, {Role: openai.ChatMessageRoleUser, Content: "hi"}},
+	}
+	key, err := responseCacheKey(base)
+	if err != nil || len(key) != 64 {
+		t.Fatalf("responseCacheKey() = %q, %v, want a hex SHA-256", key, err)
+	}
+	if again, _ := responseCacheKey(base); again != key {
+		t.Error("responseCacheKey() differs for the same request")
+	}
+	changes := map[string]func(r *openai.ChatCompletionRequest){
+		"model":         func(r *openai.ChatCompletionRequest) { r.Model = "gpt-other" },
+		"system prompt": func(r *openai.ChatCompletionRequest) { r.Messages[0].Content = "Grade it strictly." },
+		"message":       func(r *openai.ChatCompletionRequest) { r.Messages[1].Content = "hello" },
+		"temperature":   func(r *openai.ChatCompletionRequest) { r.Temperature = 0.2 },
+	}
+	for name, change := range changes {
+		changed := base
+		changed.Messages = append([]openai.ChatCompletionMessage(nil), base.Messages...)
+		change(&changed)
+		if other, _ := responseCacheKey(changed); other == key {
+			t.Errorf("responseCacheKey() ignores the %s", name)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cached := `{"response_type":"int","prompt_template":"PROMPT_TEST","cache":true,"messages":[{"role":"user","content":"Grade it"}]}`
+	tests := []struct {
+		name         string
+		body         string
+		advance      time.Duration
+		wantRequests int
+		wantHits     float64
+		wantPuts     int
+	}{
+		{name: "hit", body: cached, wantRequests: 1, wantHits: 1, wantPuts: 1},
+		{name: "expired", body: cached, advance: 2 * time.Hour, wantRequests: 2, wantPuts: 2},
+		{name: "not requested", body: strings.Replace(cached, `"cache":true,`, "", 1), wantRequests: 2},
+		{name: "stream", body: strings.Replace(cached, `"int"`, `"stream"`, 1), wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.CacheTable = "cache"
+				cfg.CacheTTL = time.Hour
+				cfg.MetricsEnabled = true
+			})
+			reply := testsupport.Reply("[[42]]")
+			reply.Response.Usage = openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}
+			chat := testsupport.NewScriptedCompleter(reply)
+			clock := testsupport.NewClock(testStart)
+			chat.Clock = clock
+			db := newFakeDynamoDB().table("cache", "cache_key")
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, db, clock)
+
+			// values holds the metrics of the second request
+			var values map[string]any
+			for i := 0; i < 2; i++ {
+				if i > 0 {
+					clock.Advance(tt.advance)
+				}
+				values = nil
+				output := captureStdout(t, func() {
+					response, err := h.Handler(context.Background(), testMessage(tt.body))
+					if err != nil || response.StatusCode != statusCodeOK {
+						t.Errorf("request %d: Handler() = %d, %v", i, response.StatusCode, err)
+					}
+				})
+				for _, line := range strings.Split(output, "\n") {
+					if strings.Contains(line, `"_aws"`) {
+						json.Unmarshal([]byte(line), &values)
+					}
+				}
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("OpenAI got %d requests, want %d", got, tt.wantRequests)
+			}
+			if got := db.count("PutItem"); got != tt.wantPuts {
+				t.Errorf("PutItem calls = %d, want %d", got, tt.wantPuts)
+			}
+			if values["CacheHits"] != tt.wantHits {
+				t.Errorf("CacheHits of the second request = %v, want %v", values["CacheHits"], tt.wantHits)
+			}
+			if tt.wantHits > 0 && values["PromptTokens"] != float64(0) {
+				t.Errorf("PromptTokens of a cached answer = %v, want 0", values["PromptTokens"])
+			}
+			if texts := poster.Texts(); tt.body == cached && (len(texts) != 2 || texts[0] != "42" || texts[1] != "42") {
+				t.Errorf("frames = %q, want the answer twice", texts)
+			}
+		})
+	}
+}
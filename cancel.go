@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	actionCancel       = "cancel"
+	frameTypeCancelled = "cancelled"
+	maxRequestIDLength = 128
+	// cancelRecordTTL is how long a cancellation is kept before DynamoDB expires it
+	cancelRecordTTL = time.Hour
+)
+
+// errStreamCancelled stops a stream the client cancelled
+var errStreamCancelled = errors.New("Stream cancelled by the client")
+
+// cancelRequest is sent by the client to stop an in-flight stream
+type cancelRequest struct {
+	Action    string `json:"action"`
+	RequestID string `json:"request_id"`
+}
+
+// cancelKey returns the DynamoDB key of the cancellation of a request on a connection
+func cancelKey(connectionID string, requestID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"connection_id": {S: aws.String(connectionID)},
+		"request_id":    {S: aws.String(requestID)},
+	}
+}
+
+// handleCancel records the cancellation of a request so the Lambda serving its stream stops at the next flush
+func (h *WebsocketHandler) handleCancel(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var cancel cancelRequest
+	if err := json.Unmarshal([]byte(request.Body), &cancel); err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing cancel JSON: %s", err), statusCodeBadRequest)
+	}
+	if cfg.CancelTable == "" {
+		return errorResponse("Cancellation is not enabled", statusCodeBadRequest)
+	}
+	if cancel.RequestID == "" || len(cancel.RequestID) > maxRequestIDLength {
+		return errorResponse(fmt.Sprintf("Cancel request_id must be 1 to %d characters", maxRequestIDLength), statusCodeBadRequest)
+	}
+
+	item := cancelKey(request.RequestContext.ConnectionID, cancel.RequestID)
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(cancelRecordTTL).Unix(), 10))}
+	_, err := h.getDynamoDBClient(cfg).PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(cfg.CancelTable),
+		Item:      item,
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Can't record cancellation", "cancel_request_id", cancel.RequestID, "error", err)
+		return errorResponse(fmt.Sprintf("Can't record cancellation: %s", err), statusCodeServerError)
+	}
+
+	loggerFrom(ctx).Info("Cancellation recorded", "cancel_request_id", cancel.RequestID)
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
+
+// isCancellable checks if the stream of the request can be cancelled by the client
+func (r openAIRequest) isCancellable() bool {
+	return r.config.CancelTable != "" && r.request.RequestID != ""
+}
+
+// isCancelled checks if the client cancelled the request. Lookup failures are logged and treated as not cancelled,
+// so a DynamoDB hiccup doesn't abort the stream.
+func isCancelled(ctx context.Context, openAIRequest openAIRequest) bool {
+	output, err := openAIRequest.dynamoDBClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(openAIRequest.config.CancelTable),
+		Key:            cancelKey(openAIRequest.ConnectionId, openAIRequest.request.RequestID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		openAIRequest.logger().Warn("Can't check cancellation", "client_request_id", openAIRequest.request.RequestID, "error", err)
+		return false
+	}
+	return len(output.Item) > 0
+}
+
+// postCancelled tells the client that its stream was stopped
+func postCancelled(openAIRequest openAIRequest) error {
+	openAIRequest.logger().Info("Request cancelled by the client", "client_request_id", openAIRequest.request.RequestID)
+	return postControlFrame(openAIRequest, frameTypeCancelled)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// hookPoster records frames like RecordingPoster and calls afterPost once the frame with index after was posted
+type hookPoster struct {
+	*testsupport.RecordingPoster
+	after     int
+	afterPost func()
+}
+
+// PostToConnection posts data and runs the hook when it is due
+func (p *hookPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	err := p.RecordingPoster.PostToConnection(ctx, connectionID, data)
+	if p.RecordingPoster.Calls()-1 == p.after && p.afterPost != nil {
+		p.afterPost()
+	}
+	return err
+}
+
+func TestCancelStream(t *testing.T) {
+	deltas := make([]string, 10)
+	for i := range deltas {
+		deltas[i] = "word "
+	}
+	tests := []struct {
+		name        string
+		cancelAfter int // Frame index after which the cancel message arrives, -1 before the request
+		cancelID    string
+		wantChunks  int // Chunks read from the stream
+		wantEnd     string
+	}{
+		{name: "before start", cancelAfter: -1, cancelID: "req-1", wantChunks: 0, wantEnd: `{"type":"cancelled","request_id":"req-1"}`},
+		{name: "mid stream", cancelAfter: 1, cancelID: "req-1", wantChunks: 3, wantEnd: `{"type":"cancelled","request_id":"req-1"}`},
+		{name: "unknown request", cancelAfter: 1, cancelID: "req-9", wantChunks: 10, wantEnd: "<END>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.CancelTable = "cancels"
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval = 0
+			})
+			db := newFakeDynamoDB().table("cancels", "connection_id", "request_id")
+			clock := testsupport.NewClock(testStart)
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(time.Second, deltas...)...))
+			chat.Clock = clock
+			poster := &hookPoster{RecordingPoster: testsupport.NewRecordingPoster(), after: tt.cancelAfter}
+			h := newTestHandler(cfg, chat, poster, db, clock)
+			cancel := func() {
+				response, err := h.Handler(context.Background(), testMessage(`{"action":"cancel","request_id":"`+tt.cancelID+`"}`))
+				if err != nil || response.StatusCode != statusCodeOK {
+					t.Errorf("cancel = %d %s, %v", response.StatusCode, response.Body, err)
+				}
+			}
+			if tt.cancelAfter < 0 {
+				cancel()
+			} else {
+				poster.afterPost = cancel
+			}
+
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","request_id":"req-1","messages":[{"role":"user","content":"hi"}]}`
+			response, err := h.Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+			}
+			if read := int(clock.Now().Sub(testStart) / time.Second); read != tt.wantChunks {
+				t.Fatalf("read %d chunks, want %d", read, tt.wantChunks)
+			}
+			texts := poster.Texts()
+			if len(texts) == 0 || texts[len(texts)-1] != tt.wantEnd {
+				t.Fatalf("frames %q, want them to end with %s", texts, tt.wantEnd)
+			}
+			if tt.wantEnd != "<END>" && strings.Contains(strings.Join(texts, ""), "<END>") {
+				t.Fatalf("cancelled stream posted the end marker: %q", texts)
+			}
+		})
+	}
+}
+
+func TestCancelRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		table      string
+		body       string
+		wantStatus int
+	}{
+		{name: "recorded", table: "cancels", body: `{"action":"cancel","request_id":"req-1"}`, wantStatus: statusCodeOK},
+		{name: "not enabled", body: `{"action":"cancel","request_id":"req-1"}`, wantStatus: statusCodeBadRequest},
+		{name: "no request_id", table: "cancels", body: `{"action":"cancel"}`, wantStatus: statusCodeBadRequest},
+		{name: "long request_id", table: "cancels", body: `{"action":"cancel","request_id":"` + strings.Repeat("x", maxRequestIDLength+1) + `"}`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.CancelTable = tt.table })
+			db := newFakeDynamoDB().table("cancels", "connection_id", "request_id")
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), db, nil)
+			response, err := h.Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			recorded := db.item("cancels", cancelKey("conn-1", "req-1")) != nil
+			if recorded != (tt.wantStatus == statusCodeOK) {
+				t.Fatalf("cancellation recorded = %v", recorded)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultMaxN = 5
+	// frameTypeCandidate carries one of the answers of a request with n > 1 to v2 clients
+	frameTypeCandidate = "candidate"
+)
+
+// candidateFrame is the data of a candidate envelope
+type candidateFrame struct {
+	Index   int    `json:"index"`
+	Content string `json:"content"`
+}
+
+// checkCandidates checks that n is within MAX_N and only used where every candidate can be returned or voted on
+func checkCandidates(cfg *Config, request Request) error {
+	if request.N < 0 {
+		return fmt.Errorf("n must not be negative, got %d", request.N)
+	}
+	if request.N <= 1 {
+		return nil
+	}
+	if request.N > cfg.MaxN {
+		return fmt.Errorf("n is %d, at most %d are allowed", request.N, cfg.MaxN)
+	}
+	switch request.ResponseType {
+	case responseTypeFull, responseTypeInt, responseTypeString, responseTypeBool, responseTypeFloat:
+	default:
+		return fmt.Errorf("n greater than 1 is not supported for the %s response type", request.ResponseType)
+	}
+	switch {
+	case len(request.Tools) > 0:
+		return fmt.Errorf("n greater than 1 can't be combined with tools")
+	case request.ConversationID != "":
+		return fmt.Errorf("n greater than 1 can't be combined with conversation_id")
+	}
+	return nil
+}
+
+// deliverCandidates posts every answer of a full response with n > 1: legacy clients get a JSON array of the
+// answers, v2 clients one candidate envelope per answer followed by an end envelope
+func deliverCandidates(openAIRequest openAIRequest, response openai.ChatCompletionResponse) error {
+	candidates := make([]string, len(response.Choices))
+	for i, choice := range response.Choices {
+		candidates[i] = choice.Message.Content
+	}
+	info, err := newCompletionInfo(response)
+	if err != nil {
+		return err
+	}
+	reply := strings.Join(candidates, "\n\n")
+
+	if !openAIRequest.isV2() {
+		data, err := json.Marshal(candidates)
+		if err != nil {
+			return fmt.Errorf("Can't encode candidates: %v", err)
+		}
+		return deliverAnswer(openAIRequest, data, reply, info)
+	}
+
+	openAIRequest.metrics.recordCompletion(info)
+	recordTokenUsage(openAIRequest, info)
+	recordSessionTurn(openAIRequest, info)
+	annotations := computeAnnotations(openAIRequest, reply)
+	openAIRequest.audit.recordCompletion(reply, annotations)
+	for i, choice := range response.Choices {
+		envelope := frameEnvelope{Type: frameTypeCandidate, Data: candidateFrame{Index: choice.Index, Content: candidates[i]}, FinishReason: choice.FinishReason}
+		if err := postEnvelope(openAIRequest, envelope); err != nil {
+			return fmt.Errorf("Can't post candidate to websocket: %w", err)
+		}
+	}
+	if err := postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeEnd, Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model}); err != nil {
+		return fmt.Errorf("Can't post response to websocket: %w", err)
+	}
+	return postUsage(openAIRequest, info, annotations)
+}
+
+// voteAnswer extracts the answer of every choice and returns the index of the choice holding the most common answer.
+// Ties go to the answer that appears first, so with n = 2 and two different answers the first choice wins.
+// Choices stopped by the content filter or without an answer don't vote. ok is false when no choice has an answer.
+func voteAnswer(choices []openai.ChatCompletionChoice, extract extractFunc) (answer string, index int, ok bool) {
+	votes := make(map[string]int)
+	first := make(map[string]int)
+	best := 0
+	for i, choice := range choices {
+		if choice.FinishReason == openai.FinishReasonContentFilter {
+			continue
+		}
+		candidate, found := extract(choice.Message.Content)
+		if !found {
+			continue
+		}
+		if _, seen := first[candidate]; !seen {
+			first[candidate] = i
+		}
+		votes[candidate]++
+		if votes[candidate] > best || (votes[candidate] == best && first[candidate] < index) {
+			best, answer, index = votes[candidate], candidate, first[candidate]
+		}
+	}
+	return answer, index, best > 0
+}
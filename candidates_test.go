@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// candidatesTurn answers with one choice per content
+func candidatesTurn(contents ...string) testsupport.Turn {
+	turn := testsupport.Reply("")
+	turn.Response.Choices = nil
+	for i, content := range contents {
+		turn.Response.Choices = append(turn.Response.Choices, openai.ChatCompletionChoice{
+			Index:        i,
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+			FinishReason: openai.FinishReasonStop,
+		})
+	}
+	return turn
+}
+
+func TestCheckCandidates(t *testing.T) {
+	cfg := &Config{MaxN: 5}
+	tests := []struct {
+		name    string
+		request Request
+		wantErr string
+	}{
+		{name: "unset", request: Request{ResponseType: responseTypeStream}},
+		{name: "one", request: Request{ResponseType: responseTypeStream, N: 1}},
+		{name: "full", request: Request{ResponseType: responseTypeFull, N: 5}},
+		{name: "int", request: Request{ResponseType: responseTypeInt, N: 3}},
+		{name: "negative", request: Request{ResponseType: responseTypeFull, N: -1}, wantErr: "n must not be negative"},
+		{name: "above MAX_N", request: Request{ResponseType: responseTypeFull, N: 6}, wantErr: "n is 6, at most 5 are allowed"},
+		{name: "stream", request: Request{ResponseType: responseTypeStream, N: 2}, wantErr: "not supported for the stream response type"},
+		{name: "json", request: Request{ResponseType: responseTypeJSON, N: 2}, wantErr: "not supported for the json response type"},
+		{name: "tools", request: Request{ResponseType: responseTypeFull, N: 2, Tools: []openai.Tool{{Type: openai.ToolTypeFunction}}}, wantErr: "can't be combined with tools"},
+		{name: "conversation", request: Request{ResponseType: responseTypeFull, N: 2, ConversationID: "conv-1"}, wantErr: "can't be combined with conversation_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCandidates(cfg, tt.request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("checkCandidates() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVoteAnswer(t *testing.T) {
+	extract := func(content string) (string, bool) {
+		match := intPattern.FindStringSubmatch(content)
+		if match == nil {
+			return "", false
+		}
+		return match[1], true
+	}
+	tests := []struct {
+		name      string
+		contents  []string
+		filtered  int // Index of a choice stopped by the content filter, -1 for none
+		want      string
+		wantIndex int
+		wantOK    bool
+	}{
+		{name: "majority", contents: []string{"[[3]]", "[[4]]", "[[4]]"}, filtered: -1, want: "4", wantIndex: 1, wantOK: true},
+		{name: "unanimous", contents: []string{"[[4]]", "[[4]]", "[[4]]"}, filtered: -1, want: "4", wantIndex: 0, wantOK: true},
+		{name: "two way tie", contents: []string{"[[3]]", "[[4]]"}, filtered: -1, want: "3", wantIndex: 0, wantOK: true},
+		{name: "tie of pairs", contents: []string{"[[3]]", "[[4]]", "[[4]]", "[[3]]"}, filtered: -1, want: "3", wantIndex: 0, wantOK: true},
+		{name: "tie after an unparsable choice", contents: []string{"no idea", "[[5]]", "[[6]]"}, filtered: -1, want: "5", wantIndex: 1, wantOK: true},
+		{name: "filtered choices don't vote", contents: []string{"[[3]]", "[[4]]", "[[4]]"}, filtered: 2, want: "3", wantIndex: 0, wantOK: true},
+		{name: "no answer", contents: []string{"no idea", "maybe"}, filtered: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			choices := candidatesTurn(tt.contents...).Response.Choices
+			if tt.filtered >= 0 {
+				choices[tt.filtered].FinishReason = openai.FinishReasonContentFilter
+			}
+			answer, index, ok := voteAnswer(choices, extract)
+			if answer != tt.want || index != tt.wantIndex || ok != tt.wantOK {
+				t.Errorf("voteAnswer() = %q, %d, %v, want %q, %d, %v", answer, index, ok, tt.want, tt.wantIndex, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCandidateRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		extra        string
+		turn         testsupport.Turn
+		wantStatus   int
+		wantN        int
+		wantFrames   []string
+	}{
+		{
+			name:         "full",
+			responseType: responseTypeFull,
+			extra:        `,"n":3`,
+			turn:         candidatesTurn("Roses", "Violets", "Tulips"),
+			wantStatus:   statusCodeOK,
+			wantN:        3,
+			wantFrames:   []string{`["Roses","Violets","Tulips"]`},
+		},
+		{
+			name:         "full to v2 clients",
+			responseType: responseTypeFull,
+			extra:        `,"n":2,"protocol":"v2"`,
+			turn:         candidatesTurn("Roses", "Violets"),
+			wantStatus:   statusCodeOK,
+			wantN:        2,
+			wantFrames: []string{
+				`{"type":"candidate","seq":0,"data":{"index":0,"content":"Roses"},"finish_reason":"stop"}`,
+				`{"type":"candidate","seq":1,"data":{"index":1,"content":"Violets"},"finish_reason":"stop"}`,
+				`{"type":"end","seq":2,"finish_reason":"stop","model":"gpt-test"}`,
+			},
+		},
+		{name: "int majority", responseType: responseTypeInt, extra: `,"n":3`, turn: candidatesTurn("[[3]]", "[[4]]", "[[4]]"), wantStatus: statusCodeOK, wantN: 3, wantFrames: []string{"4"}},
+		{name: "int tie", responseType: responseTypeInt, extra: `,"n":2`, turn: candidatesTurn("[[3]]", "[[4]]"), wantStatus: statusCodeOK, wantN: 2, wantFrames: []string{"3"}},
+		{name: "string majority", responseType: responseTypeString, extra: `,"n":3`, turn: candidatesTurn("[[blue]]", "[[red]]", "[[red]]"), wantStatus: statusCodeOK, wantN: 3, wantFrames: []string{"red"}},
+		{name: "no choice has an answer", responseType: responseTypeInt, extra: `,"n":2`, turn: candidatesTurn("no idea", "maybe"), wantStatus: statusCodeBadGateway, wantN: 2},
+		{name: "stream", responseType: responseTypeStream, extra: `,"n":2`, turn: candidatesTurn("Roses", "Violets"), wantStatus: statusCodeBadRequest},
+		{name: "above MAX_N", responseType: responseTypeFull, extra: `,"n":6`, turn: candidatesTurn("Roses"), wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.MaxN = defaultMaxN
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]` + tt.extra + `}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if tt.wantN == 0 {
+				if len(requests) != 0 {
+					t.Fatal("an invalid n reached OpenAI")
+				}
+				return
+			}
+			if len(requests) != 1 || requests[0].N != tt.wantN {
+				t.Fatalf("OpenAI requests = %d, want one with n %d", len(requests), tt.wantN)
+			}
+			if tt.wantStatus != statusCodeOK {
+				return
+			}
+			if !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+		})
+	}
+}
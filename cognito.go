@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// idTokenQueryParameter is the query string parameter carrying the Cognito ID token on $connect
+	idTokenQueryParameter = "id_token"
+	jwksFetchTimeout      = 5 * time.Second
+	// jwksRefreshInterval limits how often an unknown key ID triggers a new JWKS fetch
+	jwksRefreshInterval = time.Minute
+)
+
+// errJWKSUnavailable is returned when the signing keys of the user pool can't be fetched
+var errJWKSUnavailable = errors.New("Cognito signing keys unavailable")
+
+// userIdentity is the Cognito user behind a connection
+type userIdentity struct {
+	Sub   string `json:"sub"`
+	Email string `json:"email,omitempty"`
+	Admin bool   `json:"admin,omitempty"` // Member of COGNITO_ADMIN_GROUP, allowed to broadcast
+	// Tenant is the custom:tenant_id attribute, stored with the connection and reported on its own
+	Tenant string `json:"-"`
+}
+
+// identityKey is the context key of the userIdentity of a request
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx carrying identity
+func withIdentity(ctx context.Context, identity *userIdentity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// identityFrom returns the user identity of ctx, or nil when the connection has none
+func identityFrom(ctx context.Context) *userIdentity {
+	identity, _ := ctx.Value(identityKey{}).(*userIdentity)
+	return identity
+}
+
+// cognitoIssuer returns the token issuer of a user pool, whose ID starts with its region
+func cognitoIssuer(poolID string) string {
+	region, _, _ := strings.Cut(poolID, "_")
+	return fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, poolID)
+}
+
+// jwksCache holds the signing keys of the user pool across invocations, keyed by key ID
+type jwksCache struct {
+	mu        sync.Mutex
+	url       string
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	client    *http.Client
+}
+
+var cognitoKeys = &jwksCache{client: &http.Client{Timeout: jwksFetchTimeout}}
+
+// key returns the signing key kid. The JWKS is fetched on first use, and again for an unknown key ID
+// at most once per jwksRefreshInterval, so rotated keys are picked up.
+func (c *jwksCache) key(ctx context.Context, url string, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.url == url {
+		if key, ok := c.keys[kid]; ok {
+			return key, nil
+		}
+		if time.Since(c.fetchedAt) < jwksRefreshInterval {
+			return nil, fmt.Errorf("unknown signing key %s", kid)
+		}
+	}
+
+	keys, err := fetchJWKS(ctx, c.client, url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errJWKSUnavailable, err)
+	}
+	c.url = url
+	c.keys = keys
+	c.fetchedAt = time.Now()
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	return key, nil
+}
+
+// fetchJWKS downloads a JSON Web Key Set and returns its RSA keys by key ID
+func fetchJWKS(ctx context.Context, client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS request returned %s", response.Status)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("Can't decode JWKS: %v", err)
+	}
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			return nil, fmt.Errorf("Invalid JWKS key %s", jwk.Kid)
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// idTokenClaims are the claims of a Cognito ID token checked on $connect
+type idTokenClaims struct {
+	Sub       string   `json:"sub"`
+	Email     string   `json:"email"`
+	Issuer    string   `json:"iss"`
+	Audience  string   `json:"aud"`
+	TokenUse  string   `json:"token_use"`
+	ExpiresAt int64    `json:"exp"`
+	Groups    []string `json:"cognito:groups"`
+	Tenant    string   `json:"custom:tenant_id"`
+}
+
+// verifyIDToken checks the RS256 signature of a Cognito ID token against the JWKS of the user pool,
+// and its issuer, audience, use and expiry
+func verifyIDToken(ctx context.Context, cfg *Config, token string, now time.Time) (*userIdentity, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: no id_token", errUnauthorized)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed id_token", errUnauthorized)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported id_token header", errUnauthorized)
+	}
+
+	issuer := cognitoIssuer(cfg.CognitoPoolID)
+	key, err := cognitoKeys.key(ctx, issuer+"/.well-known/jwks.json", header.Kid)
+	if errors.Is(err, errJWKSUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid id_token signature", errUnauthorized)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: invalid id_token signature", errUnauthorized)
+	}
+
+	var claims idTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid id_token claims", errUnauthorized)
+	}
+	switch {
+	case claims.Issuer != issuer:
+		return nil, fmt.Errorf("%w: id_token issuer %s doesn't match the user pool", errUnauthorized, claims.Issuer)
+	case claims.Audience != cfg.CognitoClientID:
+		return nil, fmt.Errorf("%w: id_token audience doesn't match the app client", errUnauthorized)
+	case claims.TokenUse != "id":
+		return nil, fmt.Errorf("%w: token is not an ID token", errUnauthorized)
+	case now.Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: id_token expired", errUnauthorized)
+	case claims.Sub == "":
+		return nil, fmt.Errorf("%w: id_token has no subject", errUnauthorized)
+	}
+	identity := &userIdentity{Sub: claims.Sub, Email: claims.Email, Tenant: claims.Tenant}
+	identity.Admin = cfg.CognitoAdminGroup != "" && slices.Contains(claims.Groups, cfg.CognitoAdminGroup)
+	return identity, nil
+}
+
+// decodeJWTPart decodes a base64url encoded JSON part of a JWT into v
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// addIdentity stores the user identity in the record of a connection
+func addIdentity(item map[string]*dynamodb.AttributeValue, identity *userIdentity) {
+	item["user_sub"] = &dynamodb.AttributeValue{S: aws.String(identity.Sub)}
+	if identity.Email != "" {
+		item["user_email"] = &dynamodb.AttributeValue{S: aws.String(identity.Email)}
+	}
+	if identity.Admin {
+		item["admin"] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	if identity.Tenant != "" {
+		item["tenant"] = &dynamodb.AttributeValue{S: aws.String(identity.Tenant)}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const (
+	testCognitoPool   = "eu-west-1_TestPool"
+	testCognitoClient = "test-client"
+	testCognitoKeyID  = "key-1"
+)
+
+// cognitoFixture serves the JWKS of a test user pool in place of Cognito
+type cognitoFixture struct {
+	key     *rsa.PrivateKey
+	fetches atomic.Int32
+	down    atomic.Bool // Makes the JWKS endpoint answer 503
+}
+
+// rewriteTransport sends every request to the test server at base
+type rewriteTransport struct{ base *url.URL }
+
+func (r rewriteTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme, request.URL.Host = r.base.Scheme, r.base.Host
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+// newCognitoFixture replaces the JWKS cache with an empty one fetching the keys of the fixture
+func newCognitoFixture(t *testing.T) *cognitoFixture {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := &cognitoFixture{key: key}
+	jwksPath := strings.TrimPrefix(cognitoIssuer(testCognitoPool), "https://cognito-idp.eu-west-1.amazonaws.com") + "/.well-known/jwks.json"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fixture.fetches.Add(1)
+		if fixture.down.Load() || r.URL.Path != jwksPath {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": testCognitoKeyID,
+			"kty": "RSA",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(server.Close)
+	base, _ := url.Parse(server.URL)
+	original := cognitoKeys
+	cognitoKeys = &jwksCache{client: &http.Client{Transport: rewriteTransport{base: base}}}
+	t.Cleanup(func() { cognitoKeys = original })
+	return fixture
+}
+
+// token returns an ID token of the test user pool for claims, signed with the key of the fixture.
+// The claims without a value in overrides are those of a valid token of the test client.
+func (f *cognitoFixture) token(t *testing.T, overrides map[string]any) string {
+	t.Helper()
+	claims := map[string]any{
+		"sub":       "user-sub-1",
+		"email":     "user@example.com",
+		"iss":       cognitoIssuer(testCognitoPool),
+		"aud":       testCognitoClient,
+		"token_use": "id",
+		"exp":       testStart.Add(time.Hour).Unix(),
+	}
+	header := map[string]any{"alg": "RS256", "kid": testCognitoKeyID}
+	for name, value := range overrides {
+		if name == "alg" || name == "kid" {
+			header[name] = value
+		} else if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// cognitoConfig is the test configuration with the test user pool required on $connect
+func cognitoConfig(t *testing.T) *Config {
+	return testConfig(t, func(cfg *Config) {
+		cfg.CognitoPoolID = testCognitoPool
+		cfg.CognitoClientID = testCognitoClient
+		cfg.CognitoAdminGroup = "admins"
+		cfg.ConnectionsTable = "connections"
+	})
+}
+
+func TestCognitoIssuer(t *testing.T) {
+	if got, want := cognitoIssuer(testCognitoPool), "https://cognito-idp.eu-west-1.amazonaws.com/eu-west-1_TestPool"; got != want {
+		t.Errorf("cognitoIssuer() = %q, want %q", got, want)
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	fixture := newCognitoFixture(t)
+	cfg := cognitoConfig(t)
+	valid := fixture.token(t, nil)
+	// The claims of one token with the signature of another
+	parts := strings.Split(valid, ".")
+	tamperedClaims := strings.Join([]string{parts[0], strings.Split(fixture.token(t, map[string]any{"sub": "user-sub-2"}), ".")[1], parts[2]}, ".")
+	tests := []struct {
+		name    string
+		token   string
+		want    *userIdentity
+		wantErr bool
+	}{
+		{name: "valid", token: valid, want: &userIdentity{Sub: "user-sub-1", Email: "user@example.com"}},
+		{name: "without an email", token: fixture.token(t, map[string]any{"email": nil}), want: &userIdentity{Sub: "user-sub-1"}},
+		{name: "admin group", token: fixture.token(t, map[string]any{"cognito:groups": []string{"readers", "admins"}}), want: &userIdentity{Sub: "user-sub-1", Email: "user@example.com", Admin: true}},
+		{name: "tenant", token: fixture.token(t, map[string]any{"custom:tenant_id": "acme"}), want: &userIdentity{Sub: "user-sub-1", Email: "user@example.com", Tenant: "acme"}},
+		{name: "no token", wantErr: true},
+		{name: "malformed", token: "not a token", wantErr: true},
+		{name: "tampered claims", token: tamperedClaims, wantErr: true},
+		{name: "tampered signature", token: valid[:len(valid)-4] + "AAAA", wantErr: true},
+		{name: "unsupported algorithm", token: fixture.token(t, map[string]any{"alg": "HS256"}), wantErr: true},
+		{name: "unknown key", token: fixture.token(t, map[string]any{"kid": "key-2"}), wantErr: true},
+		{name: "other user pool", token: fixture.token(t, map[string]any{"iss": cognitoIssuer("eu-west-1_OtherPool")}), wantErr: true},
+		{name: "other app client", token: fixture.token(t, map[string]any{"aud": "other-client"}), wantErr: true},
+		{name: "access token", token: fixture.token(t, map[string]any{"token_use": "access"}), wantErr: true},
+		{name: "expired", token: fixture.token(t, map[string]any{"exp": testStart.Unix()}), wantErr: true},
+		{name: "no subject", token: fixture.token(t, map[string]any{"sub": nil}), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyIDToken(context.Background(), cfg, tt.token, testStart)
+			if tt.wantErr {
+				if !errors.Is(err, errUnauthorized) {
+					t.Errorf("verifyIDToken() = %+v, %v, want an unauthorized error", got, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("verifyIDToken() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+	// The unknown key ID doesn't refetch the keys within jwksRefreshInterval
+	if got := fixture.fetches.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times, want once", got)
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	fixture := newCognitoFixture(t)
+	fixture.down.Store(true)
+	_, err := verifyIDToken(context.Background(), cognitoConfig(t), fixture.token(t, nil), testStart)
+	if !errors.Is(err, errJWKSUnavailable) || errors.Is(err, errUnauthorized) {
+		t.Errorf("verifyIDToken() error = %v, want %v", err, errJWKSUnavailable)
+	}
+	// A failed fetch isn't cached, the next connect tries again
+	fixture.down.Store(false)
+	if _, err := verifyIDToken(context.Background(), cognitoConfig(t), fixture.token(t, nil), testStart); err != nil {
+		t.Errorf("verifyIDToken() after the JWKS recovered = %v", err)
+	}
+}
+
+// TestCognitoAuth connects with an id_token and sends a message on the connection
+func TestCognitoAuth(t *testing.T) {
+	fixture := newCognitoFixture(t)
+	tests := []struct {
+		name        string
+		token       string
+		jwksDown    bool
+		wantConnect int
+		wantMessage int
+	}{
+		{name: "valid token", token: fixture.token(t, nil), wantConnect: statusCodeOK, wantMessage: statusCodeOK},
+		{name: "invalid token", token: fixture.token(t, map[string]any{"aud": "other-client"}), wantConnect: statusCodeUnauthorized, wantMessage: statusCodeUnauthorized},
+		{name: "missing token", wantConnect: statusCodeUnauthorized, wantMessage: statusCodeUnauthorized},
+		{name: "JWKS unavailable", token: fixture.token(t, nil), jwksDown: true, wantConnect: statusCodeUnavailable, wantMessage: statusCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cognitoKeys.keys, cognitoKeys.url = nil, ""
+			fixture.down.Store(tt.jwksDown)
+			logs := captureLogs(t)
+			cfg := cognitoConfig(t)
+			cfg.MetricsEnabled = true
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			chat := testsupport.NewScriptedCompleter(usageTurn())
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart))
+			ctx := context.Background()
+
+			query := map[string]string{}
+			if tt.token != "" {
+				query[idTokenQueryParameter] = tt.token
+			}
+			response, err := h.Handler(ctx, connectRequest(query))
+			if err != nil || response.StatusCode != tt.wantConnect {
+				t.Fatalf("$connect = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantConnect)
+			}
+			record := db.item("connections", connectionKey("conn-1"))
+			if tt.wantConnect != statusCodeOK {
+				if record != nil {
+					t.Errorf("refused connection recorded as %v", record)
+				}
+			} else if record == nil || aws.StringValue(record["user_sub"].S) != "user-sub-1" || aws.StringValue(record["user_email"].S) != "user@example.com" {
+				t.Errorf("connection record %v doesn't have the claims of the token", record)
+			}
+
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","include_usage":true,"messages":[{"role":"user","content":"hi"}]}`
+			output := captureStdout(t, func() { response, err = h.Handler(ctx, testMessage(body)) })
+			if err != nil || response.StatusCode != tt.wantMessage {
+				t.Fatalf("message = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantMessage)
+			}
+			if tt.wantMessage != statusCodeOK {
+				if len(chat.Requests()) != 0 {
+					t.Error("message of a connection without an identity reached OpenAI")
+				}
+				return
+			}
+			// The user is attributed in the usage frame, the metrics and the logs
+			frames := poster.Texts()
+			if len(frames) != 2 || !strings.Contains(frames[1], `"user":{"sub":"user-sub-1","email":"user@example.com"}`) {
+				t.Errorf("frames = %q, want a usage frame with the user", frames)
+			}
+			if !strings.Contains(output, `"UserSub":"user-sub-1"`) {
+				t.Errorf("metrics %q don't have the UserSub", output)
+			}
+			if !strings.Contains(logs.String(), `"user_sub":"user-sub-1"`) {
+				t.Errorf("logs %q don't have the user_sub", logs)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCognito(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "disabled", env: map[string]string{}},
+		{name: "enabled", env: map[string]string{"COGNITO_POOL_ID": testCognitoPool, "COGNITO_CLIENT_ID": testCognitoClient, "CONNECTIONS_TABLE": "connections"}},
+		{name: "no client", env: map[string]string{"COGNITO_POOL_ID": testCognitoPool, "CONNECTIONS_TABLE": "connections"}, wantErr: true},
+		{name: "no pool", env: map[string]string{"COGNITO_CLIENT_ID": testCognitoClient, "CONNECTIONS_TABLE": "connections"}, wantErr: true},
+		{name: "no connections table", env: map[string]string{"COGNITO_POOL_ID": testCognitoPool, "COGNITO_CLIENT_ID": testCognitoClient}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"COGNITO_POOL_ID", "COGNITO_CLIENT_ID", "CONNECTIONS_TABLE"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.CognitoPoolID != tt.env["COGNITO_POOL_ID"] {
+				t.Errorf("CognitoPoolID = %q, want %q", cfg.CognitoPoolID, tt.env["COGNITO_POOL_ID"])
+			}
+		})
+	}
+}
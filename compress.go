@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	encodingGzip = "gzip"
+	// frameEncodingGzip marks frames whose data is gzip compressed and base64 encoded, websocket frames being text
+	frameEncodingGzip       = "gzip+base64"
+	defaultCompressMinBytes = 4 * 1024
+	// maxCompressedFrameBytes is the largest encoded payload sent in one frame, leaving room for the envelope
+	maxCompressedFrameBytes = maxFrameBytes - 4*1024
+	// maxCompressedPieceBytes bounds the text compressed into one frame when the whole payload doesn't fit:
+	// even incompressible text only grows by a third in base64 and stays below maxCompressedFrameBytes
+	maxCompressedPieceBytes = maxFrameBytes / 2
+)
+
+// compressedFrame carries a compressed piece of an answer to legacy clients
+type compressedFrame struct {
+	Type     string `json:"type"`
+	Encoding string `json:"encoding"`
+	Data     string `json:"data"`
+}
+
+// compresses checks if data is posted compressed, for requests with accept_encoding gzip and payloads of at
+// least COMPRESS_MIN_BYTES
+func (r openAIRequest) compresses(data []byte) bool {
+	return r.request.AcceptEncoding == encodingGzip && len(data) >= r.config.CompressMinBytes
+}
+
+// gzipBase64 compresses data with gzip and encodes the result with base64
+func gzipBase64(data []byte) (string, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return "", fmt.Errorf("Can't compress frame: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return "", fmt.Errorf("Can't compress frame: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+// compressPieces compresses data into frames of at most maxCompressedFrameBytes. The whole payload is
+// compressed first, and split only when it doesn't fit one frame; then every piece is compressed on its
+// own, so each frame decompresses without the others.
+func compressPieces(data []byte) ([]string, error) {
+	encoded, err := gzipBase64(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) <= maxCompressedFrameBytes {
+		return []string{encoded}, nil
+	}
+	var pieces []string
+	for _, piece := range splitFrame(data, maxCompressedPieceBytes) {
+		encoded, err := gzipBase64(piece)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, encoded)
+	}
+	return pieces, nil
+}
+
+// postCompressedChunk posts data as compressed chunk frames, chunk envelopes for v2 clients
+func postCompressedChunk(openAIRequest openAIRequest, data []byte) error {
+	pieces, err := compressPieces(data)
+	if err != nil {
+		return err
+	}
+	for _, piece := range pieces {
+		if err := postCompressedPiece(openAIRequest, piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postCompressedPiece posts one compressed piece as a chunk frame
+func postCompressedPiece(openAIRequest openAIRequest, piece string) error {
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeChunk, Encoding: frameEncodingGzip, Data: piece})
+	}
+	payload, err := json.Marshal(compressedFrame{Type: frameTypeChunk, Encoding: frameEncodingGzip, Data: piece})
+	if err != nil {
+		return fmt.Errorf("Can't encode chunk frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
+
+// postCompressedFinal posts the complete answer of a non-stream response compressed. An answer fitting one
+// frame is a final envelope for v2 clients and a single chunk frame for legacy clients. Larger answers are
+// compressed chunk frames followed by the end envelope, or the end stream message for legacy clients.
+func postCompressedFinal(openAIRequest openAIRequest, data []byte, annotations *outputAnnotations, info completionInfo) error {
+	pieces, err := compressPieces(data)
+	if err != nil {
+		return err
+	}
+	if len(pieces) == 1 && openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeFinal, Encoding: frameEncodingGzip, Data: pieces[0], Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model})
+	}
+	for _, piece := range pieces {
+		if err := postCompressedPiece(openAIRequest, piece); err != nil {
+			return err
+		}
+	}
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeEnd, Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model})
+	}
+	if len(pieces) > 1 {
+		if err := postToConnection(openAIRequest, []byte(openAIRequest.config.EndStreamMessage)); err != nil {
+			return err
+		}
+	}
+	return postFinishReason(openAIRequest, info.FinishReason)
+}
+
+// checkAcceptEncoding rejects encodings other than gzip
+func checkAcceptEncoding(request Request) error {
+	if request.AcceptEncoding != "" && request.AcceptEncoding != encodingGzip {
+		return fmt.Errorf("accept_encoding must be %s", encodingGzip)
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// gunzipBase64 reverses gzipBase64, failing the test on data that isn't compressed
+func gunzipBase64(t *testing.T, data string) string {
+	t.Helper()
+	compressed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		t.Fatalf("compressed data isn't base64: %v", err)
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("compressed data isn't gzip: %v", err)
+	}
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Can't decompress data: %v", err)
+	}
+	return string(text)
+}
+
+// compressibleReply returns a summary-like answer of about size bytes
+func compressibleReply(size int) string {
+	var reply strings.Builder
+	for reply.Len() < size {
+		reply.WriteString("The document summarises the quarterly results ✓ für alle Regionen. ")
+	}
+	return reply.String()
+}
+
+// incompressibleReply returns random base64 text of about size bytes, which gzip can't shrink much
+func incompressibleReply(size int) string {
+	random := make([]byte, size*3/4)
+	rand.New(rand.NewSource(1)).Read(random)
+	return base64.StdEncoding.EncodeToString(random)
+}
+
+// decodeCompressedFrames reassembles the answer posted in frames, decompressing the compressed ones. It returns
+// the answer and the kind of every frame: gzip, text or the type of a v2 envelope without data.
+func decodeCompressedFrames(t *testing.T, frames []string, v2 bool, endMessage string) (string, []string) {
+	t.Helper()
+	var answer strings.Builder
+	var kinds []string
+	for _, frame := range frames {
+		if len(frame) > maxFrameBytes {
+			t.Fatalf("frame of %d bytes is over the limit", len(frame))
+		}
+		if v2 {
+			var envelope frameEnvelope
+			if err := json.Unmarshal([]byte(frame), &envelope); err != nil {
+				t.Fatalf("frame %q isn't an envelope: %v", frame, err)
+			}
+			switch {
+			case envelope.Type != frameTypeChunk && envelope.Type != frameTypeFinal:
+				kinds = append(kinds, envelope.Type)
+			case envelope.Encoding == frameEncodingGzip:
+				kinds = append(kinds, "gzip "+envelope.Type)
+				answer.WriteString(gunzipBase64(t, envelope.Data.(string)))
+			default:
+				kinds = append(kinds, "text "+envelope.Type)
+				answer.WriteString(envelope.Data.(string))
+			}
+			continue
+		}
+		var compressed compressedFrame
+		switch {
+		case frame == endMessage:
+			kinds = append(kinds, "end")
+		case json.Unmarshal([]byte(frame), &compressed) == nil && compressed.Encoding == frameEncodingGzip:
+			if compressed.Type != frameTypeChunk {
+				t.Fatalf("compressed frame has type %q, want chunk", compressed.Type)
+			}
+			kinds = append(kinds, "gzip")
+			answer.WriteString(gunzipBase64(t, compressed.Data))
+		default:
+			kinds = append(kinds, "text")
+			answer.WriteString(frame)
+		}
+	}
+	return answer.String(), kinds
+}
+
+func TestGzipBase64(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "empty"},
+		{name: "short", data: "Hello"},
+		{name: "compressible", data: compressibleReply(100 * 1024)},
+		{name: "incompressible", data: incompressibleReply(100 * 1024)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := gzipBase64([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("gzipBase64() error = %v", err)
+			}
+			if got := gunzipBase64(t, encoded); got != tt.data {
+				t.Errorf("round trip gave %d bytes, want the %d bytes compressed", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestCompressPieces(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantSplit bool
+	}{
+		{name: "small", data: "Hello"},
+		// Compressing first keeps an answer over the frame limit in one frame when it shrinks enough
+		{name: "compressible over the frame limit", data: compressibleReply(300 * 1024)},
+		{name: "incompressible over the frame limit", data: incompressibleReply(300 * 1024), wantSplit: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces, err := compressPieces([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("compressPieces() error = %v", err)
+			}
+			if got := len(pieces) > 1; got != tt.wantSplit {
+				t.Fatalf("compressPieces() = %d pieces, want split %v", len(pieces), tt.wantSplit)
+			}
+			// Every piece fits a frame and decompresses without the others
+			var joined strings.Builder
+			for i, piece := range pieces {
+				if len(piece) > maxCompressedFrameBytes {
+					t.Fatalf("piece %d of %d bytes is over %d", i, len(piece), maxCompressedFrameBytes)
+				}
+				joined.WriteString(gunzipBase64(t, piece))
+			}
+			if joined.String() != tt.data {
+				t.Errorf("reassembled %d bytes, want the %d bytes compressed", joined.Len(), len(tt.data))
+			}
+		})
+	}
+}
+
+// TestCompressedAnswers sends answers through Handler and checks that the decompressed frames give the reply back
+func TestCompressedAnswers(t *testing.T) {
+	const endMessage = "<END>"
+	large := compressibleReply(8 * 1024)
+	huge := compressibleReply(300 * 1024)
+	tests := []struct {
+		name           string
+		responseType   string
+		protocol       string
+		acceptEncoding string
+		turn           testsupport.Turn
+		want           string
+		wantKinds      []string
+	}{
+		{name: "full below the threshold", responseType: responseTypeFull, acceptEncoding: encodingGzip, turn: testsupport.Reply("Hello"), want: "Hello", wantKinds: []string{"text"}},
+		{name: "full", responseType: responseTypeFull, acceptEncoding: encodingGzip, turn: testsupport.Reply(large), want: large, wantKinds: []string{"gzip"}},
+		{name: "full without accept_encoding", responseType: responseTypeFull, turn: testsupport.Reply(large), want: large, wantKinds: []string{"text"}},
+		{name: "full over the frame limit", responseType: responseTypeFull, acceptEncoding: encodingGzip, turn: testsupport.Reply(huge), want: huge, wantKinds: []string{"gzip"}},
+		{name: "full v2", responseType: responseTypeFull, protocol: protocolV2, acceptEncoding: encodingGzip, turn: testsupport.Reply(large), want: large, wantKinds: []string{"gzip final"}},
+		{name: "full v2 below the threshold", responseType: responseTypeFull, protocol: protocolV2, acceptEncoding: encodingGzip, turn: testsupport.Reply("Hello"), want: "Hello", wantKinds: []string{"text final"}},
+		// Only the batches reaching the threshold are compressed
+		{
+			name:           "stream",
+			responseType:   responseTypeStream,
+			acceptEncoding: encodingGzip,
+			turn:           testsupport.Stream(testsupport.TextChunks(0, "Hello ", large)...),
+			want:           "Hello " + large,
+			wantKinds:      []string{"text", "gzip", "end"},
+		},
+		{
+			name:           "stream v2",
+			responseType:   responseTypeStream,
+			protocol:       protocolV2,
+			acceptEncoding: encodingGzip,
+			turn:           testsupport.Stream(testsupport.TextChunks(0, "Hello ", large)...),
+			want:           "Hello " + large,
+			wantKinds:      []string{"text chunk", "gzip chunk", frameTypeEnd},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = endMessage
+				cfg.StreamFlushInterval = 0
+				cfg.CompressMinBytes = defaultCompressMinBytes
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","protocol":"` + tt.protocol + `","accept_encoding":"` + tt.acceptEncoding + `","messages":[{"role":"user","content":"Summarise it"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+			}
+			answer, kinds := decodeCompressedFrames(t, poster.Texts(), tt.protocol == protocolV2, endMessage)
+			if !reflect.DeepEqual(kinds, tt.wantKinds) {
+				t.Errorf("frames = %q, want %q", kinds, tt.wantKinds)
+			}
+			if answer != tt.want {
+				t.Errorf("decompressed %d bytes, want the %d bytes of the reply", len(answer), len(tt.want))
+			}
+		})
+	}
+}
+
+// TestCompressedAnswerSplit checks that an answer too large for one frame even compressed is split into
+// compressed chunks followed by the end of the answer
+func TestCompressedAnswerSplit(t *testing.T) {
+	const endMessage = "<END>"
+	reply := incompressibleReply(300 * 1024)
+	tests := []struct {
+		name      string
+		protocol  string
+		wantChunk string
+		wantEnd   string
+	}{
+		{name: "legacy", wantChunk: "gzip", wantEnd: "end"},
+		{name: "v2", protocol: protocolV2, wantChunk: "gzip chunk", wantEnd: frameTypeEnd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = endMessage })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","protocol":"` + tt.protocol + `","accept_encoding":"gzip","messages":[{"role":"user","content":"Summarise it"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+			}
+			answer, kinds := decodeCompressedFrames(t, poster.Texts(), tt.protocol == protocolV2, endMessage)
+			if len(kinds) < 3 || kinds[len(kinds)-1] != tt.wantEnd {
+				t.Fatalf("frames = %q, want several compressed chunks and %s", kinds, tt.wantEnd)
+			}
+			for _, kind := range kinds[:len(kinds)-1] {
+				if kind != tt.wantChunk {
+					t.Fatalf("frames = %q, want only %s before the end", kinds, tt.wantChunk)
+				}
+			}
+			if answer != reply {
+				t.Errorf("decompressed %d bytes, want the %d bytes of the reply", len(answer), len(reply))
+			}
+		})
+	}
+}
+
+func TestAcceptEncodingValidation(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantStatus     int
+	}{
+		{name: "gzip", acceptEncoding: encodingGzip, wantStatus: statusCodeOK},
+		{name: "brotli", acceptEncoding: "br", wantStatus: statusCodeBadRequest},
+		{name: "upper case", acceptEncoding: "GZIP", wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, _ := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","accept_encoding":"`+tt.acceptEncoding+`","messages":[{"role":"user","content":"hi"}]}`)
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestHTTPRejectsAcceptEncoding(t *testing.T) {
+	cfg := testConfig(t, nil)
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), testsupport.NewRecordingPoster(), nil, nil)
+	request := events.APIGatewayV2HTTPRequest{Body: `{"response_type":"full","prompt_template":"PROMPT_TEST","accept_encoding":"gzip","messages":[{"role":"user","content":"hi"}]}`}
+	request.RequestContext.RequestID = "req-1"
+	response := h.handleHTTP(context.Background(), cfg, request)
+	if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, "accept_encoding") {
+		t.Errorf("handleHTTP() = %d %s, want 400 for accept_encoding", response.StatusCode, response.Body)
+	}
+}
+
+func TestLoadConfigCompressMinBytes(t *testing.T) {
+	t.Setenv("COMPRESS_MIN_BYTES", "")
+	cfg, err := loadConfig()
+	if err != nil || cfg.CompressMinBytes != defaultCompressMinBytes {
+		t.Fatalf("loadConfig() = %d, %v, want the default %d", cfg.CompressMinBytes, err, defaultCompressMinBytes)
+	}
+	t.Setenv("COMPRESS_MIN_BYTES", "512")
+	if cfg, err := loadConfig(); err != nil || cfg.CompressMinBytes != 512 {
+		t.Errorf("loadConfig() = %d, %v, want 512", cfg.CompressMinBytes, err)
+	}
+	t.Setenv("COMPRESS_MIN_BYTES", "small")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an invalid COMPRESS_MIN_BYTES")
+	}
+}
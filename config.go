@@ -0,0 +1,807 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is an immutable configuration snapshot. A new snapshot is built and swapped in as a whole on refresh,
+// so a request never mixes values from two snapshots.
+type Config struct {
+	Generation                  uint64 // Incremented for every stored snapshot, used to key derived caches
+	OpenAIKey                   string
+	OpenAIKeys                  []string      // Keys of OPENAI_API_KEYS requests are spread over, OpenAIKey is the first of them
+	OpenAIKeyCooldown           time.Duration // How long a key is skipped after a 401 or 429
+	OpenAIMock                  bool          // Answer with canned replies instead of calling OpenAI
+	OpenAIModel                 string
+	ModelValidation             bool                     // Check OpenAIModel against ListModels before using it
+	OpenAIFallbackModel         string                   // Model tried once when the primary model is overloaded or rejects the request
+	PromptProfiles              map[string]promptProfile // Model and parameter defaults per prompt template
+	ModelAliases                map[string]string        // Stable names clients and the configuration may use instead of model IDs
+	RouteMap                    map[string]string        // Response type served by each custom route key
+	OpenAIProvider              string                   // "openai" or "azure"
+	AllowedProviders            map[string]bool          // Completion backends requests may select with provider
+	AllowedLanguages            map[string]bool          // Lower case BCP-47 tags requests may select with language, empty allows every known language
+	BedrockModelID              string                   // Bedrock model serving requests of the bedrock provider
+	BedrockRegion               string                   // Region of the Bedrock runtime, empty for the region of the Lambda
+	AnthropicKey                string                   // Anthropic API key for requests of the anthropic provider
+	AnthropicModel              string                   // Anthropic model serving requests of the anthropic provider
+	OpenAIBaseURL               string                   // Base URL of an OpenAI-compatible gateway, empty for the OpenAI API
+	OpenAIOrgID                 string                   // Sent as the OpenAI-Organization header
+	OpenAIProjectID             string                   // Sent as the OpenAI-Project header
+	OpenAIExtraHeaders          map[string]string        // Additional headers sent with every OpenAI API request
+	AzureEndpoint               string                   // Endpoint of the Azure OpenAI resource
+	AzureDeployment             string                   // Azure deployment serving OPENAI_MODEL
+	AzureAPIVersion             string                   // Azure OpenAI API version, empty for the client default
+	OpenAIFallbackLargerContext bool                     // The fallback model has a larger context window, so context length errors fall back too
+	APIGatewayEndpoint          string
+	AnnotateLanguage            bool
+	AnnotateSafety              bool
+	OpenAIJSONRetries           int
+	MaxN                        int             // Largest n a request may ask for
+	MaxParallelPrompts          int             // Templates of a prompt_templates request running at the same time
+	MaxBatchSize                int             // Items of a batch message
+	AsyncQueueURL               string          // SQS queue of the requests answered asynchronously
+	FailedDeliveryQueueURL      string          // SQS queue URL or SNS topic ARN payloads that couldn't be posted are sent to
+	FailedDeliveryBucket        string          // S3 bucket of the failed delivery payloads too large for a message
+	AuditFirehoseStream         string          // Firehose delivery stream of the audit records, empty disables the audit
+	AuditIncludeContent         bool            // Include the messages and the completion in the audit records
+	FunctionURLStream           bool            // Serve a Function URL with RESPONSE_STREAM invoke mode instead of the websocket API
+	TextNormalization           string          // Normalization of streamed text: off, confusables or aggressive
+	Confusables                 map[rune]string // Replacements of the confusables text normalization
+	OutputFilters               []string        // Redaction filters of the output
+	InjectionCheck              string          // Handling of user input matching the injection patterns: block or annotate
+	InjectionPatterns           []injectionPattern
+	LocalDev                    bool              // Serve the websocket API from a local server instead of Lambda
+	LocalPort                   int               // Port of the local development server
+	OpenAIMaxRetries            int               // Retries of rate limited or failed OpenAI API requests
+	RelayCredentials            map[string]string // Service name to relay credential
+	RelayRateLimit              int               // Relays allowed per service and minute
+	BroadcastSecret             string            // Authorizes broadcasts from connections without the admin flag
+	BroadcastWorkers            int               // Concurrent posts of a broadcast
+	DebugRawAllowed             bool
+	StreamFlushInterval         time.Duration         // Longest time streamed deltas are buffered before they are posted
+	DeadlineMargin              time.Duration         // Time kept free before the Lambda deadline to end streams and skip retries
+	OpenAITimeout               time.Duration         // Bound of one blocking OpenAI API call, 0 for none
+	StreamFirstTokenTimeout     time.Duration         // Time allowed before the first token of a stream, 0 for none
+	StreamStallTimeout          time.Duration         // Longest gap between stream chunks after the first token, 0 for none
+	CircuitFailureThreshold     int                   // Consecutive OpenAI API outage failures that open the circuit, 0 disables the breaker
+	CircuitWindow               time.Duration         // Time the failures opening the circuit must fall within
+	CircuitOpenDuration         time.Duration         // Time requests fail fast before the circuit lets a probe through
+	StreamFlushBytes            int                   // Buffer size that triggers a flush regardless of the interval
+	StreamFlushAdaptive         bool                  // Adapt the flush interval and size to the PostToConnection latency
+	StreamFlushBounds           flushBounds           // Floor and ceiling the adaptive flush interval and size are kept within
+	CompressMinBytes            int                   // Smallest answer frame compressed for requests with accept_encoding
+	MaxBodyBytes                int                   // Largest request body accepted before decoding, 0 for no limit
+	CancelTable                 string                // DynamoDB table stream cancellations are recorded in, empty disables them
+	PromptTable                 string                // DynamoDB table prompt templates are read from before the environment
+	ConnectionsTable            string                // DynamoDB table open connections are recorded in, empty disables it
+	AuthMode                    string                // "token" requires a valid token on $connect, empty accepts every connection
+	AuthSecret                  string                // Shared secret tokens are compared with or signed with
+	CognitoPoolID               string                // User pool whose ID tokens are required on $connect, empty disables Cognito
+	CognitoClientID             string                // App client the ID tokens must be issued for
+	CognitoAdminGroup           string                // Cognito group whose members may broadcast
+	TenantKeysTable             string                // DynamoDB table of the KMS encrypted OpenAI API keys of tenants
+	FallbackToPlatformKey       bool                  // Send requests of connections without a tenant key with the platform key
+	RateLimitTable              string                // DynamoDB table of the per-user token buckets, empty disables rate limiting
+	RateLimitRPM                int                   // Tokens a bucket refills per minute
+	RateLimitBurst              int                   // Capacity of a bucket
+	RateLimitFailMode           string                // "open" lets requests through when the limiter fails, "closed" rejects them
+	UsageTable                  string                // DynamoDB table of the daily token usage per user, empty disables tracking
+	DailyTokenQuota             int                   // Tokens a user may use per UTC day, 0 for unlimited
+	SoftCapPercent              int                   // Percentage of DAILY_TOKEN_QUOTA where economy mode starts, 0 for never
+	EconomyResponseTypes        map[string]bool       // Response types whose max_tokens economy mode reduces
+	ConversationsTable          string                // DynamoDB table of the conversation histories, empty disables conversation_id
+	ModelPrices                 map[string]modelPrice // US dollars per million prompt and completion tokens, for the session summaries
+	MaxInflight                 int                   // Requests in flight per connection, 0 for unlimited
+	InflightStaleAfter          time.Duration         // Age after which an in-flight counter is assumed to be left by crashed Lambdas
+	MaxMessages                 int                   // Messages allowed in one request
+	MaxMessageChars             int                   // Characters allowed in the content of one message
+	MaxTotalChars               int                   // Characters allowed in the contents of all messages of a request
+	StrictValidation            bool                  // Reject message fields OpenAI ignores for the role instead of dropping them
+	ModelContextSizes           map[string]int        // Context window in tokens per model, used to trim long conversations
+	VisionModels                map[string]bool       // Models accepting image content in messages
+	ReasoningModels             []string              // Prefixes of the models that get reasoning model requests
+	ReservedCompletionTokens    int                   // Tokens kept free for the completion when max_tokens isn't set
+	SummaryModel                string                // Model condensing the dropped messages of the summarize history strategy
+	Moderation                  bool                  // Check the user messages with the OpenAI moderation endpoint before the chat call
+	ModerationFailMode          string                // "closed" rejects requests when moderation fails, "open" lets them through
+	AllowModerationBypass       bool                  // Honour skip_moderation in requests
+	CacheTable                  string                // DynamoDB table of cached OpenAI responses, empty disables the cache
+	CacheTTL                    time.Duration         // How long a cached response is served
+	IdempotencyTable            string                // DynamoDB table of the idempotency keys of requests, empty disables idempotency_key
+	IdempotencyTTL              time.Duration         // How long a completed request is replayed for its idempotency key
+	PromptEnvPrefix             string                // Prefix every prompt_template must start with
+	AllowInlinePrompts          bool                  // Accept a system_prompt in the request instead of a prompt template
+	EndStreamMessage            string                // Marker posted to legacy clients at the end of a stream or chunked answer
+	LogLevel                    slog.Level
+	LogPrompts                  bool          // Log prompts and model output, which are redacted otherwise
+	MetricsEnabled              bool          // Emit CloudWatch embedded metric format metrics for every request
+	ConfigRefreshInterval       time.Duration // Age after which the next invocation reloads the configuration, 0 for never
+}
+
+var (
+	// currentConfig holds the active configuration snapshot
+	currentConfig atomic.Pointer[Config]
+	// configGeneration is the generation of the last stored snapshot
+	configGeneration atomic.Uint64
+	// configLoadedAt is the Unix nanosecond time the active snapshot was stored at
+	configLoadedAt atomic.Int64
+	// configRefreshing is set while an invocation reloads the configuration, so concurrent ones don't pile on
+	configRefreshing atomic.Bool
+)
+
+// getConfig returns the active configuration snapshot
+func getConfig() *Config {
+	return currentConfig.Load()
+}
+
+// storeConfig assigns the next generation to cfg and makes it the active snapshot
+func storeConfig(cfg Config) *Config {
+	cfg.Generation = configGeneration.Add(1)
+	logLevel.Set(cfg.LogLevel)
+	currentConfig.Store(&cfg)
+	configLoadedAt.Store(time.Now().UnixNano())
+	return &cfg
+}
+
+// refreshConfig reloads the configuration and swaps it in atomically. On error the active snapshot is kept.
+func refreshConfig() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	storeConfig(cfg)
+	return nil
+}
+
+// refreshStaleConfig reloads the configuration when the active snapshot is older than CONFIG_REFRESH_SECONDS
+// and returns the snapshot the invocation has to use. Only one invocation reloads at a time, the others keep
+// the active snapshot meanwhile. A failed reload is logged and retried after another interval.
+func refreshStaleConfig(ctx context.Context) *Config {
+	cfg := getConfig()
+	if cfg.ConfigRefreshInterval == 0 || time.Since(time.Unix(0, configLoadedAt.Load())) < cfg.ConfigRefreshInterval {
+		return cfg
+	}
+	if !configRefreshing.CompareAndSwap(false, true) {
+		return cfg
+	}
+	defer configRefreshing.Store(false)
+	if err := refreshConfig(); err != nil {
+		loggerFrom(ctx).Error("Can't refresh configuration, keeping the active one", "error", err)
+		configLoadedAt.Store(time.Now().UnixNano())
+		return cfg
+	}
+	return getConfig()
+}
+
+// snapshotCache holds a value derived from a configuration snapshot and rebuilds it when the generation changes
+type snapshotCache[T any] struct {
+	mu         sync.Mutex
+	generation uint64
+	value      T
+}
+
+// get returns the cached value for cfg, building it with build when the cache belongs to another snapshot
+func (c *snapshotCache[T]) get(cfg *Config, build func(*Config) T) T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != cfg.Generation {
+		c.value = build(cfg)
+		c.generation = cfg.Generation
+	}
+	return c.value
+}
+
+// getChecked works like get, but a build that fails isn't cached so the next call tries again
+func (c *snapshotCache[T]) getChecked(cfg *Config, build func(*Config) (T, error)) (T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != cfg.Generation {
+		value, err := build(cfg)
+		if err != nil {
+			return value, err
+		}
+		c.value = value
+		c.generation = cfg.Generation
+	}
+	return c.value, nil
+}
+
+// loadConfig loads configuration from environment variables
+func loadConfig() (Config, error) {
+	cfg := Config{
+		OpenAIModel:         os.Getenv("OPENAI_MODEL"),
+		OpenAIFallbackModel: os.Getenv("OPENAI_FALLBACK_MODEL"),
+		OpenAIProvider:      os.Getenv("OPENAI_PROVIDER"),
+		OpenAIBaseURL:       os.Getenv("OPENAI_BASE_URL"),
+		OpenAIOrgID:         os.Getenv("OPENAI_ORG_ID"),
+		OpenAIProjectID:     os.Getenv("OPENAI_PROJECT_ID"),
+		AzureEndpoint:       os.Getenv("AZURE_OPENAI_ENDPOINT"),
+		AzureDeployment:     os.Getenv("AZURE_OPENAI_DEPLOYMENT"),
+		AzureAPIVersion:     os.Getenv("AZURE_API_VERSION"),
+		BedrockModelID:      os.Getenv("BEDROCK_MODEL_ID"),
+		BedrockRegion:       os.Getenv("BEDROCK_REGION"),
+		AnthropicKey:        os.Getenv("ANTHROPIC_API_KEY"),
+		AnthropicModel:      os.Getenv("ANTHROPIC_MODEL"),
+		APIGatewayEndpoint:  os.Getenv("API_GW_ENDPOINT"),
+		CancelTable:         os.Getenv("CANCEL_TABLE"),
+		PromptTable:         os.Getenv("PROMPT_TABLE"),
+		ConnectionsTable:    os.Getenv("CONNECTIONS_TABLE"),
+		AuthMode:            os.Getenv("AUTH_MODE"),
+		AuthSecret:          os.Getenv("AUTH_SECRET"),
+		CognitoPoolID:       os.Getenv("COGNITO_POOL_ID"),
+		CognitoClientID:     os.Getenv("COGNITO_CLIENT_ID"),
+		CognitoAdminGroup:   os.Getenv("COGNITO_ADMIN_GROUP"),
+		TenantKeysTable:     os.Getenv("TENANT_KEYS_TABLE"),
+		BroadcastSecret:     os.Getenv("BROADCAST_SECRET"),
+		RateLimitTable:      os.Getenv("RATE_LIMIT_TABLE"),
+		RateLimitFailMode:   os.Getenv("RATE_LIMIT_FAIL_MODE"),
+		UsageTable:          os.Getenv("USAGE_TABLE"),
+		ConversationsTable:  os.Getenv("CONVERSATIONS_TABLE"),
+		SummaryModel:        os.Getenv("SUMMARY_MODEL"),
+		CacheTable:          os.Getenv("CACHE_TABLE"),
+		IdempotencyTable:    os.Getenv("IDEMPOTENCY_TABLE"),
+		ModerationFailMode:  os.Getenv("MODERATION_FAIL_MODE"),
+		EndStreamMessage:    os.Getenv("END_STREAM_MESSAGE"),
+		TextNormalization:   os.Getenv("TEXT_NORMALIZATION"),
+		InjectionCheck:      os.Getenv("INJECTION_CHECK"),
+	}
+
+	var err error
+	cfg.OpenAIMock, err = getEnvBool("OPENAI_MOCK", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// The mock never calls OpenAI, so it runs without a key
+	if !cfg.OpenAIMock {
+		cfg.OpenAIKeys = splitList(os.Getenv("OPENAI_API_KEYS"), nil)
+		if len(cfg.OpenAIKeys) > 0 && openAIKeyFromSecret() {
+			return cfg, fmt.Errorf("Only one of the environment variables OPENAI_API_KEYS, OPENAI_API_KEY_SECRET_ARN and OPENAI_API_KEY_SSM_PARAM can be set")
+		}
+		if len(cfg.OpenAIKeys) > 0 {
+			cfg.OpenAIKey = cfg.OpenAIKeys[0]
+		} else {
+			cfg.OpenAIKey, err = loadOpenAIKey(false)
+			if err != nil {
+				return cfg, err
+			}
+		}
+	}
+
+	openAIKeyCooldown, err := getEnvInt("OPENAI_KEY_COOLDOWN_SECONDS", int(defaultOpenAIKeyCooldown/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	if openAIKeyCooldown < 0 {
+		return cfg, fmt.Errorf("Invalid value for environment variable OPENAI_KEY_COOLDOWN_SECONDS: %d", openAIKeyCooldown)
+	}
+	cfg.OpenAIKeyCooldown = time.Duration(openAIKeyCooldown) * time.Second
+
+	if cfg.OpenAIModel == "" {
+		cfg.OpenAIModel = defaultModel
+	}
+
+	cfg.PromptEnvPrefix = defaultPromptEnvPrefix
+	if prefix, ok := os.LookupEnv("PROMPT_ENV_PREFIX"); ok {
+		cfg.PromptEnvPrefix = prefix
+	}
+
+	if cfg.SummaryModel == "" {
+		cfg.SummaryModel = defaultSummaryModel
+	}
+
+	// Aliases are resolved once here, so validation, logs, metrics and usage frames all see the concrete model
+	cfg.ModelAliases, err = parseModelAliases(os.Getenv("MODEL_ALIASES"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.OpenAIModel = resolveModelAlias(cfg.ModelAliases, cfg.OpenAIModel)
+	cfg.OpenAIFallbackModel = resolveModelAlias(cfg.ModelAliases, cfg.OpenAIFallbackModel)
+	cfg.SummaryModel = resolveModelAlias(cfg.ModelAliases, cfg.SummaryModel)
+	cfg.ModelPrices, err = parseModelPrices(os.Getenv("MODEL_PRICES"), cfg.ModelAliases)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RouteMap, err = parseRouteMap(os.Getenv("ROUTE_MAP"))
+	if err != nil {
+		return cfg, err
+	}
+
+	allowedModels := splitList(os.Getenv("ALLOWED_MODELS"), nil)
+	if len(allowedModels) > 0 && !slices.Contains(allowedModels, cfg.OpenAIModel) {
+		return cfg, fmt.Errorf("Invalid value for environment variable OPENAI_MODEL, it is not listed in ALLOWED_MODELS: %s", cfg.OpenAIModel)
+	}
+	if len(allowedModels) > 0 && cfg.OpenAIFallbackModel != "" && !slices.Contains(allowedModels, cfg.OpenAIFallbackModel) {
+		return cfg, fmt.Errorf("Invalid value for environment variable OPENAI_FALLBACK_MODEL, it is not listed in ALLOWED_MODELS: %s", cfg.OpenAIFallbackModel)
+	}
+
+	if cfg.EndStreamMessage == "" {
+		cfg.EndStreamMessage = defaultEndStreamMessage
+	}
+
+	switch cfg.AuthMode {
+	case "":
+	case authModeToken:
+		if cfg.AuthSecret == "" {
+			return cfg, fmt.Errorf("AUTH_MODE=%s requires the environment variable AUTH_SECRET", authModeToken)
+		}
+		if cfg.ConnectionsTable == "" {
+			return cfg, fmt.Errorf("AUTH_MODE=%s requires the environment variable CONNECTIONS_TABLE", authModeToken)
+		}
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable AUTH_MODE: %s", cfg.AuthMode)
+	}
+
+	if cfg.CognitoPoolID != "" || cfg.CognitoClientID != "" {
+		if cfg.CognitoPoolID == "" || cfg.CognitoClientID == "" {
+			return cfg, fmt.Errorf("Cognito requires both environment variables COGNITO_POOL_ID and COGNITO_CLIENT_ID")
+		}
+		if cfg.ConnectionsTable == "" {
+			return cfg, fmt.Errorf("Cognito requires the environment variable CONNECTIONS_TABLE")
+		}
+	}
+
+	// The tenant of a connection comes from its token or ID token
+	if cfg.TenantKeysTable != "" && !requiresConnectionAuth(&cfg) {
+		return cfg, fmt.Errorf("TENANT_KEYS_TABLE requires AUTH_MODE=%s or the environment variable COGNITO_POOL_ID", authModeToken)
+	}
+	cfg.FallbackToPlatformKey, err = getEnvBool("FALLBACK_TO_PLATFORM_KEY", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.LocalDev, err = getEnvBool("LOCAL_DEV", false)
+	if err != nil {
+		return cfg, err
+	}
+	// The flag is checked here rather than parsed in main, since the configuration is loaded in init
+	cfg.LocalDev = cfg.LocalDev || slices.Contains(os.Args[1:], "-local") || slices.Contains(os.Args[1:], "--local")
+
+	cfg.LocalPort, err = getEnvInt("LOCAL_PORT", defaultLocalPort)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.OpenAIJSONRetries, err = getEnvInt("OPENAI_JSON_RETRIES", defaultJSONRetries)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.OpenAIMaxRetries, err = getEnvInt("OPENAI_MAX_RETRIES", defaultOpenAIMaxRetries)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxN, err = getEnvInt("MAX_N", defaultMaxN)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxParallelPrompts, err = getEnvInt("MAX_PARALLEL_PROMPTS", defaultMaxParallelPrompts)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxBatchSize, err = getEnvInt("MAX_BATCH_SIZE", defaultMaxBatchSize)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.AsyncQueueURL = os.Getenv("ASYNC_QUEUE_URL")
+
+	cfg.FailedDeliveryQueueURL = os.Getenv("FAILED_DELIVERY_QUEUE_URL")
+	cfg.FailedDeliveryBucket = os.Getenv("FAILED_DELIVERY_BUCKET")
+	if cfg.FailedDeliveryBucket != "" && cfg.FailedDeliveryQueueURL == "" {
+		return cfg, fmt.Errorf("FAILED_DELIVERY_BUCKET requires the environment variable FAILED_DELIVERY_QUEUE_URL")
+	}
+
+	cfg.AuditFirehoseStream = os.Getenv("AUDIT_FIREHOSE_STREAM")
+	cfg.AuditIncludeContent, err = getEnvBool("AUDIT_INCLUDE_CONTENT", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Confusables, err = parseConfusables(os.Getenv("CONFUSABLES_JSON"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.OutputFilters, err = parseOutputFilters(splitList(os.Getenv("OUTPUT_FILTERS"), nil))
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.InjectionCheck {
+	case "":
+	case injectionCheckBlock, injectionCheckAnnotate:
+		cfg.InjectionPatterns, err = loadInjectionPatterns()
+		if err != nil {
+			return cfg, err
+		}
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable INJECTION_CHECK: %s", cfg.InjectionCheck)
+	}
+
+	switch cfg.TextNormalization {
+	case "":
+		cfg.TextNormalization = textNormalizationConfusables
+	case textNormalizationOff, textNormalizationConfusables, textNormalizationAggressive:
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable TEXT_NORMALIZATION: %s", cfg.TextNormalization)
+	}
+
+	cfg.FunctionURLStream, err = getEnvBool("FUNCTION_URL_STREAM", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ModelValidation, err = getEnvBool("MODEL_VALIDATION", true)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.OpenAIFallbackLargerContext, err = getEnvBool("OPENAI_FALLBACK_LARGER_CONTEXT", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.AnnotateLanguage, cfg.AnnotateSafety, err = parseAnnotations(os.Getenv("ANNOTATE_OUTPUT"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RelayCredentials, err = parseRelayCredentials(os.Getenv("RELAY_CREDENTIALS"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RelayRateLimit, err = getEnvInt("RELAY_RATE_LIMIT", defaultRelayRateLimit)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.BroadcastWorkers, err = getEnvInt("BROADCAST_WORKERS", defaultBroadcastWorkers)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.DebugRawAllowed, err = getEnvBool("DEBUG_RAW_ALLOWED", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.LogLevel, err = parseLogLevel(os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.LogPrompts, err = getEnvBool("LOG_PROMPTS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MetricsEnabled, err = getEnvBool("METRICS_ENABLED", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	configRefresh, err := getEnvInt("CONFIG_REFRESH_SECONDS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.ConfigRefreshInterval = time.Duration(configRefresh) * time.Second
+
+	cfg.AllowInlinePrompts, err = getEnvBool("ALLOW_INLINE_PROMPTS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.RateLimitRPM, err = getEnvInt("RATE_LIMIT_RPM", defaultRateLimitRPM)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitRPM <= 0 {
+		return cfg, fmt.Errorf("Environment variable RATE_LIMIT_RPM must be greater than 0")
+	}
+
+	cfg.RateLimitBurst, err = getEnvInt("RATE_LIMIT_BURST", defaultRateLimitBurst)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.RateLimitBurst <= 0 {
+		return cfg, fmt.Errorf("Environment variable RATE_LIMIT_BURST must be greater than 0")
+	}
+
+	cfg.DailyTokenQuota, err = getEnvInt("DAILY_TOKEN_QUOTA", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.DailyTokenQuota > 0 && cfg.UsageTable == "" {
+		return cfg, fmt.Errorf("DAILY_TOKEN_QUOTA requires the environment variable USAGE_TABLE")
+	}
+
+	cfg.SoftCapPercent, err = getEnvInt("SOFT_CAP_PERCENT", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.SoftCapPercent >= 100 {
+		return cfg, fmt.Errorf("Environment variable SOFT_CAP_PERCENT must be less than 100")
+	}
+	if cfg.SoftCapPercent > 0 && cfg.DailyTokenQuota == 0 {
+		return cfg, fmt.Errorf("SOFT_CAP_PERCENT requires the environment variable DAILY_TOKEN_QUOTA")
+	}
+	cfg.EconomyResponseTypes, err = parseEconomyResponseTypes(os.Getenv("ECONOMY_RESPONSE_TYPES"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxMessages, err = getEnvInt("MAX_MESSAGES", defaultMaxMessages)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxMessageChars, err = getEnvInt("MAX_MESSAGE_CHARS", defaultMaxMessageChars)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxTotalChars, err = getEnvInt("MAX_TOTAL_CHARS", defaultMaxTotalChars)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.StrictValidation, err = getEnvBool("STRICT_VALIDATION", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ModelContextSizes, err = parseModelContextSizes(os.Getenv("MODEL_CONTEXT_SIZES"))
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.VisionModels = parseVisionModels(os.Getenv("VISION_MODELS"))
+	cfg.ReasoningModels = splitList(os.Getenv("REASONING_MODELS"), defaultReasoningModels)
+
+	cfg.PromptProfiles, err = parsePromptProfiles(&cfg, os.Getenv("PROMPT_PROFILES"), allowedModels)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.ReservedCompletionTokens, err = getEnvInt("RESERVED_COMPLETION_TOKENS", defaultReservedCompletionTokens)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Moderation, err = getEnvBool("MODERATION", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.AllowModerationBypass, err = getEnvBool("ALLOW_MODERATION_BYPASS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.OpenAIExtraHeaders, err = parseExtraHeaders(os.Getenv("OPENAI_EXTRA_HEADERS"))
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.OpenAIProvider {
+	case "":
+		cfg.OpenAIProvider = providerOpenAI
+	case providerOpenAI:
+	case providerAzure:
+		if cfg.AzureEndpoint == "" {
+			return cfg, fmt.Errorf("OPENAI_PROVIDER=%s requires the environment variable AZURE_OPENAI_ENDPOINT, e.g. https://RESOURCE.openai.azure.com/", providerAzure)
+		}
+		if cfg.AzureDeployment == "" {
+			return cfg, fmt.Errorf("OPENAI_PROVIDER=%s requires the environment variable AZURE_OPENAI_DEPLOYMENT naming the deployment of OPENAI_MODEL", providerAzure)
+		}
+		if cfg.Moderation {
+			return cfg, fmt.Errorf("MODERATION is not supported with OPENAI_PROVIDER=%s, whose content filters apply instead", providerAzure)
+		}
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable OPENAI_PROVIDER: %s", cfg.OpenAIProvider)
+	}
+
+	cfg.AllowedProviders = make(map[string]bool)
+	for _, provider := range splitList(os.Getenv("ALLOWED_PROVIDERS"), []string{providerOpenAI}) {
+		switch provider {
+		case providerOpenAI:
+		case providerAnthropic:
+			if cfg.AnthropicKey == "" {
+				return cfg, fmt.Errorf("ALLOWED_PROVIDERS with %s requires the environment variable ANTHROPIC_API_KEY", providerAnthropic)
+			}
+			if cfg.AnthropicModel == "" {
+				cfg.AnthropicModel = defaultAnthropicModel
+			}
+			if !slices.Contains(splitList(os.Getenv("ANTHROPIC_ALLOWED_MODELS"), defaultAnthropicAllowedModels), cfg.AnthropicModel) {
+				return cfg, fmt.Errorf("Invalid value for environment variable ANTHROPIC_MODEL, it is not listed in ANTHROPIC_ALLOWED_MODELS: %s", cfg.AnthropicModel)
+			}
+		case providerBedrock:
+			if cfg.BedrockModelID == "" {
+				return cfg, fmt.Errorf("ALLOWED_PROVIDERS with %s requires the environment variable BEDROCK_MODEL_ID", providerBedrock)
+			}
+			if !isAnthropicModel(cfg.BedrockModelID) {
+				return cfg, fmt.Errorf("Invalid value for environment variable BEDROCK_MODEL_ID, only Anthropic models are supported: %s", cfg.BedrockModelID)
+			}
+		default:
+			return cfg, fmt.Errorf("Invalid provider in environment variable ALLOWED_PROVIDERS: %s", provider)
+		}
+		cfg.AllowedProviders[provider] = true
+	}
+
+	cfg.AllowedLanguages, err = parseAllowedLanguages(os.Getenv("ALLOWED_LANGUAGES"))
+	if err != nil {
+		return cfg, err
+	}
+
+	switch cfg.ModerationFailMode {
+	case "":
+		cfg.ModerationFailMode = moderationFailClosed
+	case moderationFailOpen, moderationFailClosed:
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable MODERATION_FAIL_MODE: %s", cfg.ModerationFailMode)
+	}
+
+	cacheTTL, err := getEnvInt("CACHE_TTL_SECONDS", int(defaultCacheTTL/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CacheTTL = time.Duration(cacheTTL) * time.Second
+
+	idempotencyTTL, err := getEnvInt("IDEMPOTENCY_TTL_SECONDS", int(defaultIdempotencyTTL/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.IdempotencyTTL = time.Duration(idempotencyTTL) * time.Second
+
+	cfg.MaxInflight, err = getEnvInt("MAX_INFLIGHT_PER_CONNECTION", defaultMaxInflight)
+	if err != nil {
+		return cfg, err
+	}
+
+	inflightStaleAfter, err := getEnvInt("INFLIGHT_STALE_SECONDS", int(defaultInflightStaleAfter/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.InflightStaleAfter = time.Duration(inflightStaleAfter) * time.Second
+
+	switch cfg.RateLimitFailMode {
+	case "":
+		cfg.RateLimitFailMode = rateLimitFailOpen
+	case rateLimitFailOpen, rateLimitFailClosed:
+	default:
+		return cfg, fmt.Errorf("Invalid value for environment variable RATE_LIMIT_FAIL_MODE: %s", cfg.RateLimitFailMode)
+	}
+
+	flushInterval, err := getEnvInt("STREAM_FLUSH_INTERVAL_MS", int(defaultStreamFlushInterval/time.Millisecond))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StreamFlushInterval = time.Duration(flushInterval) * time.Millisecond
+
+	openAITimeout, err := getEnvInt("OPENAI_TIMEOUT_MS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.OpenAITimeout = time.Duration(openAITimeout) * time.Millisecond
+
+	streamFirstTokenTimeout, err := getEnvInt("OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StreamFirstTokenTimeout = time.Duration(streamFirstTokenTimeout) * time.Millisecond
+
+	streamStallTimeout, err := getEnvInt("OPENAI_STREAM_STALL_TIMEOUT_MS", 0)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StreamStallTimeout = time.Duration(streamStallTimeout) * time.Millisecond
+
+	cfg.CircuitFailureThreshold, err = getEnvInt("CIRCUIT_FAILURE_THRESHOLD", 0)
+	if err != nil {
+		return cfg, err
+	}
+	if cfg.CircuitFailureThreshold < 0 {
+		return cfg, fmt.Errorf("Invalid value for environment variable CIRCUIT_FAILURE_THRESHOLD: %d", cfg.CircuitFailureThreshold)
+	}
+
+	circuitWindow, err := getEnvInt("CIRCUIT_WINDOW_SECONDS", int(defaultCircuitWindow/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CircuitWindow = time.Duration(circuitWindow) * time.Second
+
+	circuitOpenDuration, err := getEnvInt("CIRCUIT_OPEN_SECONDS", int(defaultCircuitOpenDuration/time.Second))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.CircuitOpenDuration = time.Duration(circuitOpenDuration) * time.Second
+
+	deadlineMargin, err := getEnvInt("STREAM_DEADLINE_MARGIN_MS", int(defaultDeadlineMargin/time.Millisecond))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.DeadlineMargin = time.Duration(deadlineMargin) * time.Millisecond
+
+	cfg.StreamFlushBytes, err = getEnvInt("STREAM_FLUSH_BYTES", defaultStreamFlushBytes)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.StreamFlushAdaptive, err = getEnvBool("STREAM_FLUSH_ADAPTIVE", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.StreamFlushBounds, err = getAdaptiveFlushBounds()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.CompressMinBytes, err = getEnvInt("COMPRESS_MIN_BYTES", defaultCompressMinBytes)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MaxBodyBytes, err = getEnvInt("MAX_BODY_BYTES", defaultMaxBodyBytes)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// splitList splits a comma separated environment variable value, returning defaultValue when it is empty
+func splitList(value string, defaultValue []string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return defaultValue
+	}
+	return items
+}
+
+// getEnvInt reads a non-negative integer from the environment variable name, returning defaultValue when it is unset
+func getEnvInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("Invalid non-negative integer in environment variable %s: %s", name, value)
+	}
+	return number, nil
+}
+
+// getEnvBool reads a boolean from the environment variable name, returning defaultValue when it is unset
+func getEnvBool(name string, defaultValue bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	flag, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid boolean in environment variable %s: %s", name, value)
+	}
+	return flag, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConfigSnapshotsAreNotTorn swaps snapshots while readers use them, the way refreshes and requests in
+// flight do. Run with -race: every reader must see the model and the key of the same snapshot.
+func TestConfigSnapshotsAreNotTorn(t *testing.T) {
+	original := *getConfig()
+	defer storeConfig(original)
+
+	const writers, readers, rounds = 4, 8, 500
+	var done atomic.Bool
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				cfg := original
+				cfg.OpenAIModel = fmt.Sprintf("model-%d-%d", w, i)
+				cfg.OpenAIKey = fmt.Sprintf("key-%d-%d", w, i)
+				storeConfig(cfg)
+			}
+		}(w)
+	}
+	// A full reload races the writers as well
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := refreshConfig(); err != nil {
+				t.Errorf("refreshConfig() error = %v", err)
+				return
+			}
+		}
+	}()
+
+	var cache snapshotCache[string]
+	var readersDone sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readersDone.Add(1)
+		go func() {
+			defer readersDone.Done()
+			for !done.Load() {
+				cfg := getConfig()
+				model, key := cfg.OpenAIModel, cfg.OpenAIKey
+				if strings.HasPrefix(model, "model-") && strings.TrimPrefix(model, "model-") != strings.TrimPrefix(key, "key-") {
+					t.Errorf("torn snapshot: model %q with key %q", model, key)
+					return
+				}
+				// A derived value is built from, and handed out for, the snapshot it was asked for
+				derived := cache.get(cfg, func(cfg *Config) string { return cfg.OpenAIModel })
+				if derived != model {
+					t.Errorf("derived value %q for snapshot of model %q", derived, model)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	done.Store(true)
+	readersDone.Wait()
+}
+
+func TestRefreshStaleConfig(t *testing.T) {
+	original := *getConfig()
+	defer storeConfig(original)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+		age      time.Duration
+		reloaded bool
+	}{
+		{name: "disabled", interval: 0, age: time.Hour},
+		{name: "fresh", interval: time.Minute, age: time.Second},
+		{name: "stale", interval: time.Minute, age: 2 * time.Minute, reloaded: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := original
+			cfg.ConfigRefreshInterval = tt.interval
+			stored := storeConfig(cfg)
+			configLoadedAt.Store(time.Now().Add(-tt.age).UnixNano())
+
+			got := refreshStaleConfig(context.Background())
+			if reloaded := got.Generation != stored.Generation; reloaded != tt.reloaded {
+				t.Fatalf("refreshStaleConfig() reloaded = %v, want %v", reloaded, tt.reloaded)
+			}
+			if got != getConfig() {
+				t.Fatal("refreshStaleConfig() didn't return the active snapshot")
+			}
+		})
+	}
+}
+
+func TestLoadConfigEndStreamMessage(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "", want: defaultEndStreamMessage},
+		{value: "[[DONE]]", want: "[[DONE]]"},
+	}
+	for _, tt := range tests {
+		t.Setenv("END_STREAM_MESSAGE", tt.value)
+		cfg, err := loadConfig()
+		if err != nil {
+			t.Fatalf("loadConfig() error = %v", err)
+		}
+		if cfg.EndStreamMessage != tt.want {
+			t.Errorf("END_STREAM_MESSAGE %q loads %q, want %q", tt.value, cfg.EndStreamMessage, tt.want)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	defaults := []string{"o1"}
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{value: "", want: defaults},
+		{value: " , ", want: defaults},
+		{value: "o3", want: []string{"o3"}},
+		{value: "o3, my-reasoner ,", want: []string{"o3", "my-reasoner"}},
+	}
+	for _, tt := range tests {
+		if got := splitList(tt.value, defaults); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// connectionRecordTTL is how long after the connect, or the last ping, a connection record is kept if the
+	// disconnect never removes it
+	connectionRecordTTL = 2 * time.Hour
+	actionPing          = "ping"
+	frameTypePong       = "pong"
+)
+
+// pongFrame answers a ping with the server time in Unix milliseconds
+type pongFrame struct {
+	Type string `json:"type"`
+	TS   int64  `json:"ts"`
+}
+
+// connectionKey returns the DynamoDB key of the record of a connection
+func connectionKey(connectionID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"connection_id": {S: aws.String(connectionID)},
+	}
+}
+
+// connectionItem returns the record stored for a new connection
+func connectionItem(request events.APIGatewayWebsocketProxyRequest, now time.Time) map[string]*dynamodb.AttributeValue {
+	item := connectionKey(request.RequestContext.ConnectionID)
+	item["connected_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(connectionRecordTTL).Unix(), 10))}
+	// Pushes have no request context, they post to the endpoint the connection was opened on
+	if endpoint := requestContextEndpoint(request.RequestContext); endpoint != "" {
+		item["endpoint"] = &dynamodb.AttributeValue{S: aws.String(endpoint)}
+	}
+	if sourceIP := request.RequestContext.Identity.SourceIP; sourceIP != "" {
+		item["source_ip"] = &dynamodb.AttributeValue{S: aws.String(sourceIP)}
+	}
+	if userAgent := request.RequestContext.Identity.UserAgent; userAgent != "" {
+		item["user_agent"] = &dynamodb.AttributeValue{S: aws.String(userAgent)}
+	}
+	// The tokens are credentials, the shared secret itself in the shared-secret mode, and are never stored
+	params := make(map[string]*dynamodb.AttributeValue, len(request.QueryStringParameters))
+	for name, value := range request.QueryStringParameters {
+		if name == authQueryParameter || name == idTokenQueryParameter {
+			continue
+		}
+		params[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	if len(params) > 0 {
+		item["query_params"] = &dynamodb.AttributeValue{M: params}
+	}
+	return item
+}
+
+// handleConnection records connections in CONNECTIONS_TABLE on $connect and removes them on $disconnect.
+// With AUTH_MODE=token a $connect without a valid token is refused, and the principal is stored in the record.
+// With Cognito configured the same goes for the id_token, whose sub and email claims are stored.
+// A failed write refuses the connection too, so no socket is left untracked.
+func (h *WebsocketHandler) handleConnection(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if cfg.ConnectionsTable == "" {
+		return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+	}
+	client := h.getDynamoDBClient(cfg)
+
+	if request.RequestContext.RouteKey == disconnectRouteKey {
+		output, err := client.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName:    aws.String(cfg.ConnectionsTable),
+			Key:          connectionKey(request.RequestContext.ConnectionID),
+			ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+		})
+		if err != nil {
+			// The connection is gone either way, and the TTL removes the record eventually
+			loggerFrom(ctx).Warn("Can't delete connection record", "error", err)
+			return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+		}
+		if sessions, ok := output.Attributes["sessions"]; ok {
+			closeSessions(ctx, client, cfg, request.RequestContext.ConnectionID, sessions.SS, h.getClock().Now())
+		}
+		return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+	}
+
+	now := h.getClock().Now()
+	item := connectionItem(request, now)
+	if cfg.AuthMode == authModeToken {
+		principal, err := validateAuthToken(cfg.AuthSecret, connectToken(request), now)
+		if err != nil {
+			loggerFrom(ctx).Warn("Connection refused", "error", err)
+			return errorResponse(err.Error(), statusCodeUnauthorized)
+		}
+		addPrincipal(item, principal)
+	}
+	if cfg.CognitoPoolID != "" {
+		identity, err := verifyIDToken(ctx, cfg, request.QueryStringParameters[idTokenQueryParameter], now)
+		if errors.Is(err, errJWKSUnavailable) {
+			loggerFrom(ctx).Error("Can't verify id_token", "error", err)
+			return errorResponse(err.Error(), statusCodeUnavailable)
+		}
+		if err != nil {
+			loggerFrom(ctx).Warn("Connection refused", "error", err)
+			return errorResponse(err.Error(), statusCodeUnauthorized)
+		}
+		addIdentity(item, identity)
+	}
+
+	_, err := client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(cfg.ConnectionsTable),
+		Item:      item,
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Can't record connection", "error", err)
+		return errorResponse(fmt.Sprintf("Can't record connection: %s", err), statusCodeServerError)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
+
+// handlePing answers a keepalive ping of the client with a pong, so a connection idle while its user reads an
+// answer isn't dropped by API Gateway after 10 minutes. The record in CONNECTIONS_TABLE gets its last_seen
+// time and TTL refreshed. A ping never builds an OpenAI request, and a failed refresh is only logged.
+func (h *WebsocketHandler) handlePing(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	connectionID := request.RequestContext.ConnectionID
+	now := h.getClock().Now()
+	if cfg.ConnectionsTable != "" {
+		_, err := h.getDynamoDBClient(cfg).UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(cfg.ConnectionsTable),
+			Key:                 connectionKey(connectionID),
+			UpdateExpression:    aws.String("SET last_seen = :now, expires_at = :expires"),
+			ConditionExpression: aws.String("attribute_exists(connection_id)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+				":expires": {N: aws.String(strconv.FormatInt(now.Add(connectionRecordTTL).Unix(), 10))},
+			},
+		})
+		// A connection without a record isn't recorded by the ping either
+		if err != nil && !isConditionalCheckFailed(err) {
+			loggerFrom(ctx).Warn("Can't refresh connection record", "error", err)
+		}
+	}
+
+	payload, err := json.Marshal(pongFrame{Type: frameTypePong, TS: now.UnixMilli()})
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode pong frame: %s", err), statusCodeServerError)
+	}
+	target := openAIRequest{ctx: ctx, config: cfg, poster: h.getConnectionPoster(ctx, cfg), ConnectionId: connectionID}
+	if err := postToConnection(target, payload); err != nil && !errors.Is(err, ErrClientGone) {
+		loggerFrom(ctx).Error("Can't post pong frame", "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// connectRequest is a $connect of conn-1 with query string parameters query
+func connectRequest(query map[string]string) events.APIGatewayWebsocketProxyRequest {
+	request := testMessage("")
+	request.RequestContext.RouteKey = connectRouteKey
+	request.RequestContext.DomainName = "abc123.execute-api.eu-west-1.amazonaws.com"
+	request.RequestContext.Stage = "prod"
+	request.RequestContext.Identity.SourceIP = "203.0.113.7"
+	request.RequestContext.Identity.UserAgent = "test-client/1.0"
+	request.QueryStringParameters = query
+	return request
+}
+
+func TestConnectionItem(t *testing.T) {
+	got := connectionItem(connectRequest(map[string]string{"lang": "en"}), testStart)
+	want := map[string]*dynamodb.AttributeValue{
+		"connection_id": {S: aws.String("conn-1")},
+		"connected_at":  {N: aws.String(strconv.FormatInt(testStart.Unix(), 10))},
+		"expires_at":    {N: aws.String(strconv.FormatInt(testStart.Add(2*time.Hour).Unix(), 10))},
+		"endpoint":      {S: aws.String("https://abc123.execute-api.eu-west-1.amazonaws.com/prod")},
+		"source_ip":     {S: aws.String("203.0.113.7")},
+		"user_agent":    {S: aws.String("test-client/1.0")},
+		"query_params":  {M: map[string]*dynamodb.AttributeValue{"lang": {S: aws.String("en")}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connectionItem() = %v, want %v", got, want)
+	}
+
+	bare := connectionItem(testMessage(""), testStart)
+	for _, name := range []string{"endpoint", "source_ip", "user_agent", "query_params"} {
+		if _, ok := bare[name]; ok {
+			t.Errorf("connectionItem() of a bare request has %s", name)
+		}
+	}
+}
+
+// TestConnectionItemOmitsTokens checks that the auth token and the Cognito ID token are never stored, even in
+// the record of an authorized connection
+func TestConnectionItemOmitsTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		query map[string]string
+		want  map[string]*dynamodb.AttributeValue
+	}{
+		{name: "tokens only", query: map[string]string{authQueryParameter: testAuthSecret, idTokenQueryParameter: "eyJ.id.token"}},
+		{
+			name:  "tokens and settings",
+			query: map[string]string{authQueryParameter: testAuthSecret, idTokenQueryParameter: "eyJ.id.token", "lang": "en"},
+			want:  map[string]*dynamodb.AttributeValue{"lang": {S: aws.String("en")}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := connectionItem(connectRequest(tt.query), testStart)
+			params, ok := item["query_params"]
+			if tt.want == nil {
+				if ok {
+					t.Errorf("query_params = %v, want none", params.M)
+				}
+				return
+			}
+			if !ok || !reflect.DeepEqual(params.M, tt.want) {
+				t.Errorf("query_params = %v, want %v", params, tt.want)
+			}
+		})
+	}
+
+	// The shared secret of an authorized $connect doesn't reach the table
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.AuthMode = authModeToken
+		cfg.AuthSecret = testAuthSecret
+		cfg.ConnectionsTable = "connections"
+	})
+	db := newFakeDynamoDB().table("connections", "connection_id")
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), db, testsupport.NewClock(testStart))
+	response, err := h.Handler(context.Background(), connectRequest(map[string]string{authQueryParameter: testAuthSecret, "lang": "en"}))
+	if err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("$connect = %d, %v", response.StatusCode, err)
+	}
+	record := db.item("connections", connectionKey("conn-1"))
+	if params := record["query_params"]; params == nil || !reflect.DeepEqual(params.M, map[string]*dynamodb.AttributeValue{"lang": {S: aws.String("en")}}) {
+		t.Errorf("stored query_params = %v, want only lang", params)
+	}
+}
+
+func TestHandleConnection(t *testing.T) {
+	tests := []struct {
+		name        string
+		table       string
+		route       string
+		failing     string
+		wantStatus  int
+		wantRecord  bool
+		wantPuts    int
+		wantDeletes int
+	}{
+		{name: "connect", table: "connections", route: connectRouteKey, wantStatus: statusCodeOK, wantRecord: true, wantPuts: 1},
+		{name: "connect without a table", route: connectRouteKey, wantStatus: statusCodeOK},
+		{name: "failed connect", table: "connections", route: connectRouteKey, failing: "PutItem", wantStatus: statusCodeServerError, wantPuts: 1},
+		{name: "disconnect", table: "connections", route: disconnectRouteKey, wantStatus: statusCodeOK, wantDeletes: 1},
+		// The TTL removes the record eventually
+		{name: "failed disconnect", table: "connections", route: disconnectRouteKey, failing: "DeleteItem", wantStatus: statusCodeOK, wantRecord: true, wantDeletes: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.ConnectionsTable = tt.table })
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			if tt.route == disconnectRouteKey {
+				db.put("connections", connectionItem(connectRequest(nil), testStart))
+			}
+			if tt.failing != "" {
+				db.fail(tt.failing, errors.New("ProvisionedThroughputExceededException"))
+			}
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), db, testsupport.NewClock(testStart))
+			request := connectRequest(map[string]string{"lang": "en"})
+			request.RequestContext.RouteKey = tt.route
+
+			response, err := h.Handler(context.Background(), request)
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d, %v, want %d", response.StatusCode, err, tt.wantStatus)
+			}
+			record := db.item("connections", connectionKey("conn-1"))
+			if (record != nil) != tt.wantRecord {
+				t.Errorf("connection record = %v, want recorded %v", record, tt.wantRecord)
+			}
+			if tt.route == connectRouteKey && tt.wantRecord {
+				if got := aws.StringValue(record["expires_at"].N); got != strconv.FormatInt(testStart.Add(connectionRecordTTL).Unix(), 10) {
+					t.Errorf("expires_at = %s, want 2 hours after the connect", got)
+				}
+			}
+			if db.count("PutItem") != tt.wantPuts || db.count("DeleteItem") != tt.wantDeletes {
+				t.Errorf("PutItem, DeleteItem calls = %d, %d, want %d, %d", db.count("PutItem"), db.count("DeleteItem"), tt.wantPuts, tt.wantDeletes)
+			}
+		})
+	}
+}
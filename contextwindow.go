@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultReservedCompletionTokens = 1024
+	// messageTokenOverhead approximates the tokens the chat format adds around every message
+	messageTokenOverhead     = 4
+	historyStrategyTrim      = "trim"
+	historyStrategySummarize = "summarize"
+	defaultSummaryModel      = openai.GPT4oMini
+	// summaryMaxTokens bounds the summary of the dropped messages, and is reserved for it when trimming
+	summaryMaxTokens = 256
+	summaryTimeout   = 10 * time.Second
+	summaryPrefix    = "Conversation summary: "
+	summaryPrompt    = "Condense the following conversation into a short summary that keeps every fact, name, number and decision the user stated. Answer with the summary only."
+)
+
+// ErrContextTooLarge is returned when even the trimmed conversation doesn't fit the context window of the model
+var ErrContextTooLarge = errors.New("Conversation doesn't fit the context window of the model")
+
+// defaultModelContextSizes are the context windows in tokens of common models, extended by MODEL_CONTEXT_SIZES
+var defaultModelContextSizes = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-32k":     32768,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4o-mini":   128000,
+}
+
+// tokenEstimator estimates the number of tokens of a text
+type tokenEstimator interface {
+	estimate(text string) int
+}
+
+// charsPerTokenEstimator uses the rule of thumb of about four characters per token for English text
+type charsPerTokenEstimator struct{}
+
+func (charsPerTokenEstimator) estimate(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// promptEstimator is the token estimator used to fit conversations into the context window
+var promptEstimator tokenEstimator = charsPerTokenEstimator{}
+
+// parseModelContextSizes merges the model=tokens JSON object of MODEL_CONTEXT_SIZES into the default sizes
+func parseModelContextSizes(value string) (map[string]int, error) {
+	sizes := maps.Clone(defaultModelContextSizes)
+	if strings.TrimSpace(value) == "" {
+		return sizes, nil
+	}
+	var configured map[string]int
+	if err := json.Unmarshal([]byte(value), &configured); err != nil {
+		return nil, fmt.Errorf("Invalid JSON object in environment variable MODEL_CONTEXT_SIZES: %v", err)
+	}
+	for model, size := range configured {
+		if size <= 0 {
+			return nil, fmt.Errorf("Invalid context size for model %s in environment variable MODEL_CONTEXT_SIZES: %d", model, size)
+		}
+		sizes[model] = size
+	}
+	return sizes, nil
+}
+
+// estimateMessageTokens estimates the prompt tokens of one message
+func estimateMessageTokens(estimator tokenEstimator, content string) int {
+	return estimator.estimate(content) + messageTokenOverhead
+}
+
+// estimateChatMessageTokens estimates the prompt tokens of a message including its name and images
+func estimateChatMessageTokens(estimator tokenEstimator, message chatMessage) int {
+	tokens := estimateMessageTokens(estimator, message.text()) + message.imageCount()*imageTokenEstimate
+	if message.Name != "" {
+		tokens += estimator.estimate(message.Name)
+	}
+	return tokens
+}
+
+// trimHistory drops the oldest messages until the system prompt, the messages and the completion budget fit
+// within contextSize tokens. System messages and the messages from the most recent user message on are never dropped,
+// and tool results are dropped together with the assistant message calling the tools.
+// It returns the kept and the dropped messages.
+func trimHistory(estimator tokenEstimator, systemPrompt string, messages []chatMessage, contextSize int, completionTokens int) ([]chatMessage, []chatMessage, error) {
+	budget := contextSize - completionTokens - estimateMessageTokens(estimator, systemPrompt)
+	lastUser := -1
+	total := 0
+	for i, message := range messages {
+		total += estimateChatMessageTokens(estimator, message)
+		if message.Role == openai.ChatMessageRoleUser {
+			lastUser = i
+		}
+	}
+	if total <= budget {
+		return messages, nil, nil
+	}
+
+	drop := make([]bool, len(messages))
+	var dropped []chatMessage
+	for i, message := range messages {
+		// Tool results can't be sent without the assistant message that called the tools
+		orphaned := message.Role == openai.ChatMessageRoleTool && i > 0 && drop[i-1]
+		if total <= budget && !orphaned {
+			break
+		}
+		if !orphaned && (message.Role == openai.ChatMessageRoleSystem || (lastUser >= 0 && i >= lastUser)) {
+			continue
+		}
+		drop[i] = true
+		dropped = append(dropped, message)
+		total -= estimateChatMessageTokens(estimator, message)
+	}
+	if total > budget {
+		return nil, nil, fmt.Errorf("%w: about %d prompt tokens remain after trimming, but only %d of the %d tokens are left after the system prompt and %d completion tokens",
+			ErrContextTooLarge, total, max(budget, 0), contextSize, completionTokens)
+	}
+
+	kept := make([]chatMessage, 0, len(messages)-len(dropped))
+	for i, message := range messages {
+		if !drop[i] {
+			kept = append(kept, message)
+		}
+	}
+	return kept, dropped, nil
+}
+
+// fitContextWindow trims the messages of request to the context window of model. With the summarize history
+// strategy the dropped messages are replaced by a summary; if that fails they are simply dropped.
+// Models without a known context size are sent as they are.
+func fitContextWindow(ctx context.Context, openAIRequest openAIRequest, model string, systemPrompt string, request Request) ([]chatMessage, error) {
+	cfg := openAIRequest.config
+	contextSize, ok := cfg.ModelContextSizes[model]
+	if !ok {
+		return request.Messages, nil
+	}
+	completionTokens := cfg.ReservedCompletionTokens
+	if request.MaxTokens != nil {
+		completionTokens = *request.MaxTokens
+	}
+
+	if request.HistoryStrategy == historyStrategySummarize {
+		// Trim with room for the summary, so the summarized conversation still fits
+		kept, dropped, err := trimHistory(promptEstimator, systemPrompt, request.Messages, contextSize, completionTokens+summaryMaxTokens+messageTokenOverhead)
+		if err == nil && len(dropped) == 0 {
+			return kept, nil
+		}
+		if err == nil {
+			summary, err := summarizeMessages(ctx, openAIRequest, dropped)
+			if err == nil {
+				openAIRequest.logger().Info("Summarized conversation to fit the context window", "summarized_messages", len(dropped), "context_size", contextSize)
+				openAIRequest.metrics.addDroppedMessages(len(dropped))
+				return append([]chatMessage{{Role: openai.ChatMessageRoleSystem, Content: summaryPrefix + summary}}, kept...), nil
+			}
+			openAIRequest.logger().Warn("Can't summarize conversation, trimming it instead", "error", err)
+		}
+	}
+
+	messages, dropped, err := trimHistory(promptEstimator, systemPrompt, request.Messages, contextSize, completionTokens)
+	if err != nil {
+		return nil, err
+	}
+	if len(dropped) > 0 {
+		openAIRequest.logger().Info("Trimmed conversation to the context window", "dropped_messages", len(dropped), "context_size", contextSize)
+		openAIRequest.metrics.addDroppedMessages(len(dropped))
+	}
+	return messages, nil
+}
+
+// summarizeMessages condenses messages into a short summary with a cheap model, bounded by summaryMaxTokens and summaryTimeout
+func summarizeMessages(ctx context.Context, openAIRequest openAIRequest, messages []chatMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, summaryTimeout)
+	defer cancel()
+
+	var transcript strings.Builder
+	for _, message := range messages {
+		speaker := message.Role
+		if message.Name != "" {
+			speaker += " " + message.Name
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", speaker, message.text())
+	}
+	chatRequest := openai.ChatCompletionRequest{
+		Model: openAIRequest.config.SummaryModel,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: transcript.String()},
+		},
+		MaxTokens: summaryMaxTokens,
+	}
+	adaptReasoningRequest(openAIRequest.config, &chatRequest)
+	response, err := openAIRequest.chat.CreateChatCompletion(ctx, chatRequest)
+	if err != nil {
+		return "", err
+	}
+	if len(response.Choices) == 0 || strings.TrimSpace(response.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("empty summary")
+	}
+	return strings.TrimSpace(response.Choices[0].Message.Content), nil
+}
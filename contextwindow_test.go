@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// byteEstimator counts every byte as a token, so the tests can size messages exactly
+type byteEstimator struct{}
+
+func (byteEstimator) estimate(text string) int {
+	return len(text)
+}
+
+// sized returns a message of role whose content is estimated at tokens prompt tokens by byteEstimator
+func sized(role string, tokens int, label string) chatMessage {
+	return chatMessage{Role: role, Content: label + strings.Repeat(".", tokens-messageTokenOverhead-len(label))}
+}
+
+func TestCharsPerTokenEstimator(t *testing.T) {
+	tests := []struct {
+		text string
+		want int
+	}{
+		{text: "", want: 0},
+		{text: "a", want: 1},
+		{text: "abcd", want: 1},
+		{text: "abcde", want: 2},
+		{text: "héllo wörld", want: 3},
+	}
+	for _, tt := range tests {
+		if got := (charsPerTokenEstimator{}).estimate(tt.text); got != tt.want {
+			t.Errorf("estimate(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseModelContextSizes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]int
+		wantErr bool
+	}{
+		{value: "", want: map[string]int{"gpt-4": 8192}},
+		{value: `{"gpt-4":4096,"my-fine-tune":2048}`, want: map[string]int{"gpt-4": 4096, "my-fine-tune": 2048, "gpt-4o": 128000}},
+		{value: `{"gpt-4":0}`, wantErr: true},
+		{value: `["gpt-4"]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseModelContextSizes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseModelContextSizes(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		for model, size := range tt.want {
+			if got[model] != size {
+				t.Errorf("parseModelContextSizes(%q)[%s] = %d, want %d", tt.value, model, got[model], size)
+			}
+		}
+	}
+	if defaultModelContextSizes["gpt-4"] != 8192 {
+		t.Error("parseModelContextSizes() changed the default sizes")
+	}
+}
+
+func TestTrimHistory(t *testing.T) {
+	user, assistant, tool, system := openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleTool, openai.ChatMessageRoleSystem
+	// The system prompt takes 7 and the completion 20 of the 100 tokens, leaving 73 for the messages
+	tests := []struct {
+		name        string
+		messages    []chatMessage
+		wantKept    []string
+		wantDropped []string
+		wantErr     bool
+	}{
+		{
+			name:     "fits",
+			messages: []chatMessage{sized(user, 20, "u1"), sized(assistant, 20, "a1"), sized(user, 20, "u2")},
+			wantKept: []string{"u1", "a1", "u2"},
+		},
+		{
+			name:        "oldest first",
+			messages:    []chatMessage{sized(user, 20, "u1"), sized(assistant, 20, "a1"), sized(user, 20, "u2"), sized(assistant, 20, "a2"), sized(user, 20, "u3")},
+			wantKept:    []string{"u2", "a2", "u3"},
+			wantDropped: []string{"u1", "a1"},
+		},
+		{
+			name:        "system messages stay",
+			messages:    []chatMessage{sized(system, 20, "s1"), sized(user, 20, "u1"), sized(assistant, 20, "a1"), sized(user, 20, "u2")},
+			wantKept:    []string{"s1", "a1", "u2"},
+			wantDropped: []string{"u1"},
+		},
+		{
+			name:        "tool results go with their call",
+			messages:    []chatMessage{sized(user, 20, "u1"), sized(assistant, 20, "a1"), sized(tool, 20, "t1"), sized(assistant, 20, "a2"), sized(user, 20, "u2")},
+			wantKept:    []string{"a2", "u2"},
+			wantDropped: []string{"u1", "a1", "t1"},
+		},
+		{
+			name:        "messages after the last user message stay",
+			messages:    []chatMessage{sized(user, 30, "u1"), sized(user, 30, "u2"), sized(assistant, 30, "a1")},
+			wantKept:    []string{"u2", "a1"},
+			wantDropped: []string{"u1"},
+		},
+		{
+			name:     "last user message too large",
+			messages: []chatMessage{sized(user, 20, "u1"), sized(user, 80, "u2")},
+			wantErr:  true,
+		},
+	}
+	labels := func(messages []chatMessage) []string {
+		var labels []string
+		for _, message := range messages {
+			labels = append(labels, strings.TrimRight(message.Content, "."))
+		}
+		return labels
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, dropped, err := trimHistory(byteEstimator{}, "sys", tt.messages, 100, 20)
+			if tt.wantErr {
+				if !errors.Is(err, ErrContextTooLarge) {
+					t.Fatalf("trimHistory() error = %v, want ErrContextTooLarge", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("trimHistory() error = %v", err)
+			}
+			if got := labels(kept); !reflect.DeepEqual(got, tt.wantKept) {
+				t.Errorf("kept = %q, want %q", got, tt.wantKept)
+			}
+			if got := labels(dropped); !reflect.DeepEqual(got, tt.wantDropped) {
+				t.Errorf("dropped = %q, want %q", got, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestContextWindowRequests(t *testing.T) {
+	// 80 characters are 20 tokens, 24 with the message overhead
+	long := strings.Repeat("x", 80)
+	tests := []struct {
+		name         string
+		messages     string
+		wantStatus   int
+		wantMessages int
+	}{
+		{
+			name:         "fits",
+			messages:     `[{"role":"user","content":"` + long + `"}]`,
+			wantStatus:   statusCodeOK,
+			wantMessages: 2,
+		},
+		{
+			// The two oldest messages are dropped
+			name:         "trimmed",
+			messages:     `[{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"last"}]`,
+			wantStatus:   statusCodeOK,
+			wantMessages: 4,
+		},
+		{
+			name:       "too large",
+			messages:   `[{"role":"user","content":"` + strings.Repeat(long, 4) + `"}]`,
+			wantStatus: statusCodeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.ModelContextSizes = map[string]int{"gpt-test": 100}
+				cfg.ReservedCompletionTokens = 20
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":` + tt.messages + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d, want %d, body %s", response.StatusCode, tt.wantStatus, response.Body)
+			}
+			if tt.wantStatus != statusCodeOK {
+				if len(chat.Requests()) != 0 {
+					t.Error("a conversation too large for the context window reached OpenAI")
+				}
+				return
+			}
+			messages := chat.Requests()[0].Messages
+			if len(messages) != tt.wantMessages || messages[0].Role != openai.ChatMessageRoleSystem || messages[len(messages)-1].Role != openai.ChatMessageRoleUser {
+				t.Fatalf("messages = %+v, want the system prompt and %d more", messages, tt.wantMessages-1)
+			}
+		})
+	}
+}
+
+func TestSummarizeHistory(t *testing.T) {
+	// A long message is about 104 tokens. Plain trimming drops the oldest to fit 369 tokens, the summary
+	// strategy keeps 260 more free for the summary and drops the three oldest.
+	long := strings.Repeat("x", 400)
+	messages := `[{"role":"user","content":"My name is Ada` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},{"role":"user","content":"last"}]`
+	tests := []struct {
+		name         string
+		summary      testsupport.Turn
+		wantMessages []string
+		wantSummary  string
+	}{
+		{
+			name:         "summarized",
+			summary:      testsupport.Reply(" The user is called Ada. "),
+			wantSummary:  summaryPrefix + "The user is called Ada.",
+			wantMessages: []string{openai.ChatMessageRoleSystem, openai.ChatMessageRoleSystem, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleUser},
+		},
+		{
+			name:         "summary fails",
+			summary:      testsupport.Fail(&openai.APIError{HTTPStatusCode: 500, Message: "overloaded"}),
+			wantMessages: []string{openai.ChatMessageRoleSystem, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleUser},
+		},
+		{
+			name:         "empty summary",
+			summary:      testsupport.Reply("  "),
+			wantMessages: []string{openai.ChatMessageRoleSystem, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleUser},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.SummaryModel = "gpt-test-mini"
+				cfg.ModelContextSizes = map[string]int{"gpt-test": 400}
+				cfg.ReservedCompletionTokens = 20
+				cfg.OpenAIMaxRetries = 0
+			})
+			chat := testsupport.NewScriptedCompleter(tt.summary, testsupport.Reply("Hello Ada"))
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","history_strategy":"summarize","messages":` + messages + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("StatusCode = %d, want %d, body %s", response.StatusCode, statusCodeOK, response.Body)
+			}
+			requests := chat.Requests()
+			if len(requests) != 2 {
+				t.Fatalf("OpenAI got %d requests, want the summary and the answer", len(requests))
+			}
+			summaryRequest := requests[0]
+			if summaryRequest.Model != "gpt-test-mini" || summaryRequest.MaxTokens != summaryMaxTokens || !strings.Contains(summaryRequest.Messages[1].Content, "user: My name is Ada") {
+				t.Errorf("summary request = %s with %d max tokens, transcript %.40q", summaryRequest.Model, summaryRequest.MaxTokens, summaryRequest.Messages[1].Content)
+			}
+
+			var roles []string
+			for _, message := range requests[1].Messages {
+				roles = append(roles, message.Role)
+			}
+			if !reflect.DeepEqual(roles, tt.wantMessages) {
+				t.Fatalf("roles = %q, want %q", roles, tt.wantMessages)
+			}
+			if tt.wantSummary != "" && requests[1].Messages[1].Content != tt.wantSummary {
+				t.Errorf("message after the system prompt = %q, want %q", requests[1].Messages[1].Content, tt.wantSummary)
+			}
+		})
+	}
+}
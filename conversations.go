@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// conversationTTL is how long a conversation is kept after its last turn before DynamoDB expires it
+const conversationTTL = 24 * time.Hour
+
+// conversationKey returns the DynamoDB key of a conversation. Conversations are scoped to the request subject,
+// so one user can't read or extend the conversations of another.
+func conversationKey(openAIRequest openAIRequest, conversationID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"conversation_key": {S: aws.String(requestSubject(openAIRequest) + "#" + conversationID)},
+	}
+}
+
+// loadConversation returns the stored messages of the conversation of the request
+func loadConversation(ctx context.Context, openAIRequest openAIRequest) ([]chatMessage, error) {
+	cfg := openAIRequest.config
+	output, err := openAIRequest.dynamoDBClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.ConversationsTable),
+		Key:            conversationKey(openAIRequest, openAIRequest.request.ConversationID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't load conversation %s: %v", openAIRequest.request.ConversationID, err)
+	}
+	stored, ok := output.Item["messages"]
+	if !ok {
+		return nil, nil
+	}
+	var messages []chatMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(stored.S)), &messages); err != nil {
+		return nil, fmt.Errorf("Can't decode conversation %s: %v", openAIRequest.request.ConversationID, err)
+	}
+	return messages, nil
+}
+
+// withConversationHistory puts the stored history of the conversation in front of the messages of the request.
+// With reset set the stored history is ignored, and replaced when the answer is saved.
+func withConversationHistory(ctx context.Context, openAIRequest openAIRequest) (openAIRequest, error) {
+	if openAIRequest.request.Reset {
+		return openAIRequest, nil
+	}
+	history, err := loadConversation(ctx, openAIRequest)
+	if err != nil {
+		return openAIRequest, err
+	}
+	openAIRequest.request.Messages = append(history, openAIRequest.request.Messages...)
+	return openAIRequest, nil
+}
+
+// saveConversation stores the messages of the request and the answer as the new history of the conversation.
+// Only the last MAX_MESSAGES messages are kept; older ones would be trimmed from the prompt anyway.
+// A failure is logged but doesn't fail the request, since the answer has already been delivered.
+func saveConversation(openAIRequest openAIRequest, reply chatMessage) {
+	cfg := openAIRequest.config
+	conversationID := openAIRequest.request.ConversationID
+	if conversationID == "" || cfg.ConversationsTable == "" {
+		return
+	}
+	messages := append(openAIRequest.request.Messages, reply)
+	if len(messages) > cfg.MaxMessages {
+		messages = messages[len(messages)-cfg.MaxMessages:]
+	}
+
+	data, err := json.Marshal(messages)
+	if err != nil {
+		openAIRequest.logger().Error("Can't encode conversation", "conversation_id", conversationID, "error", err)
+		return
+	}
+	item := conversationKey(openAIRequest, conversationID)
+	item["messages"] = &dynamodb.AttributeValue{S: aws.String(string(data))}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(conversationTTL).Unix(), 10))}
+	_, err = openAIRequest.dynamoDBClient.PutItemWithContext(context.WithoutCancel(openAIRequest.ctx), &dynamodb.PutItemInput{
+		TableName: aws.String(cfg.ConversationsTable),
+		Item:      item,
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't save conversation history, the next turn will miss this one", "conversation_id", conversationID, "messages", len(messages), "error", err)
+	}
+}
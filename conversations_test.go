@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// conversationTurn is the body of a turn of the conversation chat-1 sending the user message content
+func conversationTurn(responseType string, content string, extra string) string {
+	return `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","conversation_id":"chat-1","messages":[{"role":"user","content":"` + content + `"}]` + extra + `}`
+}
+
+// conversationContents returns the role and the content of every message
+func conversationContents(messages []chatMessage) []string {
+	contents := make([]string, 0, len(messages))
+	for _, message := range messages {
+		contents = append(contents, message.Role+": "+message.Content)
+	}
+	return contents
+}
+
+// storedConversation returns the stored messages of the conversation chat-1 of connection conn-1
+func storedConversation(t *testing.T, db *fakeDynamoDB) []chatMessage {
+	t.Helper()
+	item := db.item("conversations", conversationKey(openAIRequest{ConnectionId: "conn-1", ctx: context.Background()}, "chat-1"))
+	if item == nil {
+		return nil
+	}
+	expiresAt, _ := strconv.ParseInt(aws.StringValue(item["expires_at"].N), 10, 64)
+	if time.Until(time.Unix(expiresAt, 0)) <= conversationTTL-time.Minute {
+		t.Errorf("conversation expires at %d, want %s from now", expiresAt, conversationTTL)
+	}
+	var messages []chatMessage
+	if err := json.Unmarshal([]byte(aws.StringValue(item["messages"].S)), &messages); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// TestConversationHistory runs two turns of a conversation and checks the prompt of the second and the history
+func TestConversationHistory(t *testing.T) {
+	tests := []struct {
+		responseType string
+		turns        []testsupport.Turn
+	}{
+		{responseType: responseTypeFull, turns: []testsupport.Turn{testsupport.Reply("Hello"), testsupport.Reply("Fine")}},
+		// The streamed text is saved as one assistant message
+		{responseType: responseTypeStream, turns: []testsupport.Turn{testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...), testsupport.Stream(testsupport.TextChunks(0, "Fi", "ne")...)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.ConversationsTable = "conversations"
+				cfg.StreamFlushInterval = 0
+			})
+			db := newFakeDynamoDB().table("conversations", "conversation_key")
+			chat := testsupport.NewScriptedCompleter(tt.turns...)
+			h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+			for _, content := range []string{"Hi", "How are you?"} {
+				if response, err := h.Handler(context.Background(), testMessage(conversationTurn(tt.responseType, content, ""))); err != nil || response.StatusCode != statusCodeOK {
+					t.Fatalf("turn %q = %d %s, %v", content, response.StatusCode, response.Body, err)
+				}
+			}
+			requests := chat.Requests()
+			if len(requests) != 2 {
+				t.Fatalf("%d requests, want 2", len(requests))
+			}
+			var prompt []string
+			for _, message := range requests[1].Messages[1:] {
+				prompt = append(prompt, message.Role+": "+message.Content)
+			}
+			want := []string{"user: Hi", "assistant: Hello", "user: How are you?"}
+			if !reflect.DeepEqual(prompt, want) {
+				t.Errorf("prompt of the second turn = %q, want %q", prompt, want)
+			}
+			if got := conversationContents(storedConversation(t, db)); !reflect.DeepEqual(got, append(want, "assistant: Fine")) {
+				t.Errorf("stored conversation = %q, want both turns", got)
+			}
+		})
+	}
+}
+
+func TestConversationReset(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = "conversations" })
+	db := newFakeDynamoDB().table("conversations", "conversation_key")
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"), testsupport.Reply("Hello again"))
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+	for _, body := range []string{conversationTurn(responseTypeFull, "Hi", ""), conversationTurn(responseTypeFull, "Start over", `,"reset":true`)} {
+		if response, err := h.Handler(context.Background(), testMessage(body)); err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+		}
+	}
+	if got := len(chat.Requests()[1].Messages); got != 2 {
+		t.Errorf("reset turn sent %d messages, want the system prompt and its own", got)
+	}
+	want := []string{"user: Start over", "assistant: Hello again"}
+	if got := conversationContents(storedConversation(t, db)); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored conversation = %q, want %q", got, want)
+	}
+}
+
+// TestConversationScope checks that a conversation ID of one connection doesn't reach the history of another
+func TestConversationScope(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = "conversations" })
+	db := newFakeDynamoDB().table("conversations", "conversation_key")
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"), testsupport.Reply("Who are you?"))
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+	for _, connectionID := range []string{"conn-1", "conn-2"} {
+		request := testMessage(conversationTurn(responseTypeFull, "Hi", ""))
+		request.RequestContext.ConnectionID = connectionID
+		if response, err := h.Handler(context.Background(), request); err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("turn of %s = %d %s, %v", connectionID, response.StatusCode, response.Body, err)
+		}
+	}
+	if got := len(chat.Requests()[1].Messages); got != 2 {
+		t.Errorf("other connection sent %d messages, want none of the first conversation", got)
+	}
+}
+
+func TestConversationIsCapped(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConversationsTable = "conversations"
+		cfg.MaxMessages = 3
+	})
+	db := newFakeDynamoDB().table("conversations", "conversation_key")
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("one"), testsupport.Reply("two"))
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+	for _, content := range []string{"1", "2"} {
+		if response, err := h.Handler(context.Background(), testMessage(conversationTurn(responseTypeFull, content, ""))); err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("turn %q = %d %s, %v", content, response.StatusCode, response.Body, err)
+		}
+	}
+	want := []string{"assistant: one", "user: 2", "assistant: two"}
+	if got := conversationContents(storedConversation(t, db)); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored conversation = %q, want the last %d messages %q", got, cfg.MaxMessages, want)
+	}
+}
+
+func TestConversationStoreFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		failing    string
+		wantStatus int
+		wantFrames []string
+		wantLog    string
+	}{
+		// The answer is delivered even though the next turn will miss it
+		{name: "save", failing: "PutItem", wantStatus: statusCodeOK, wantFrames: []string{"Hello"}, wantLog: "Can't save conversation history"},
+		{name: "load", failing: "GetItem", wantStatus: statusCodeServerError, wantFrames: []string{}, wantLog: "Can't load conversation history"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = "conversations" })
+			db := newFakeDynamoDB().table("conversations", "conversation_key").fail(tt.failing, errors.New("ProvisionedThroughputExceededException"))
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			poster := testsupport.NewRecordingPoster()
+			response, err := newTestHandler(cfg, chat, poster, db, nil).Handler(context.Background(), testMessage(conversationTurn(responseTypeFull, "Hi", "")))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			if !strings.Contains(logs.String(), `"level":"ERROR","msg":"`+tt.wantLog) {
+				t.Errorf("logs %q don't have the error %q", logs, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestConversationValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    string
+		extra    string
+		wantBody string
+	}{
+		{name: "no table", extra: `,"conversation_id":"chat-1"`, wantBody: "conversation_id is not supported"},
+		{name: "long ID", table: "conversations", extra: `,"conversation_id":"` + strings.Repeat("c", maxRequestIDLength+1) + `"`, wantBody: "conversation_id is longer than"},
+		{name: "reset without a conversation", table: "conversations", extra: `,"reset":true`, wantBody: "reset requires a conversation_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = tt.table })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, _ := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]`+tt.extra+`}`)
+			if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, tt.wantBody) {
+				t.Errorf("Handler() = %d %s, want 400 with %q", response.StatusCode, response.Body, tt.wantBody)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the invalid request reached OpenAI")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// maxDeadLetterPayloadBytes keeps the failed delivery message below the 256KB limit of SQS and SNS,
+	// larger payloads are written to FAILED_DELIVERY_BUCKET
+	maxDeadLetterPayloadBytes = 200 * 1024
+	deadLetterTimeout         = 5 * time.Second
+	deadLetterKeyPrefix       = "failed-deliveries/"
+)
+
+// failedDelivery is the message sent to FAILED_DELIVERY_QUEUE_URL for a payload that couldn't be posted to its connection
+type failedDelivery struct {
+	ConnectionID string `json:"connection_id"`
+	RequestID    string `json:"request_id,omitempty"`
+	ResponseType string `json:"response_type"`
+	Payload      string `json:"payload,omitempty"`
+	PayloadKey   string `json:"payload_key,omitempty"` // S3 key of a payload too large for the message
+	// PayloadDropped is set when the payload was too large for the message and no FAILED_DELIVERY_BUCKET is set
+	PayloadDropped bool   `json:"payload_dropped,omitempty"`
+	Error          string `json:"error"`
+	Timestamp      string `json:"timestamp"`
+}
+
+// awsDeadLetterSink sends failed deliveries to an SQS queue, or to an SNS topic when the target is an ARN
+type awsDeadLetterSink struct {
+	target string
+	bucket string
+	sqs    sqsiface.SQSAPI
+	sns    snsiface.SNSAPI
+	s3     s3iface.S3API
+}
+
+// getDeadLetterSink returns the DeadLetterSink for the configuration snapshot, nil without FAILED_DELIVERY_QUEUE_URL
+func (h *WebsocketHandler) getDeadLetterSink(cfg *Config) DeadLetterSink {
+	if cfg.FailedDeliveryQueueURL == "" {
+		return nil
+	}
+	return h.deadLetterSinks.get(cfg, func(cfg *Config) DeadLetterSink {
+		sink := awsDeadLetterSink{target: cfg.FailedDeliveryQueueURL, bucket: cfg.FailedDeliveryBucket}
+		if isSNSTopicARN(sink.target) {
+			sink.sns = sns.New(h.awsSession)
+		} else {
+			sink.sqs = sqs.New(h.awsSession)
+		}
+		if sink.bucket != "" {
+			sink.s3 = s3.New(h.awsSession)
+		}
+		return sink
+	})
+}
+
+// isSNSTopicARN checks if the failed delivery target is the ARN of an SNS topic rather than the URL of an SQS queue
+func isSNSTopicARN(target string) bool {
+	parsed, err := arn.Parse(target)
+	return err == nil && parsed.Service == sns.ServiceName
+}
+
+// SendFailedDelivery writes an oversized payload to the bucket, then sends the message to the queue or topic
+func (s awsDeadLetterSink) SendFailedDelivery(ctx context.Context, delivery failedDelivery) error {
+	if len(delivery.Payload) > maxDeadLetterPayloadBytes {
+		if s.s3 == nil {
+			delivery.Payload, delivery.PayloadDropped = "", true
+		} else {
+			key := fmt.Sprintf("%s%s/%s-%s.json", deadLetterKeyPrefix, time.Now().UTC().Format(usageDayLayout), delivery.ConnectionID, localID())
+			_, err := s.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(s.bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader([]byte(delivery.Payload)),
+				ContentType: aws.String(contentTypeJSON),
+			})
+			if err != nil {
+				return fmt.Errorf("Can't write failed delivery payload to S3: %v", err)
+			}
+			delivery.Payload, delivery.PayloadKey = "", key
+		}
+	}
+	message, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("Can't encode failed delivery: %v", err)
+	}
+	if s.sns != nil {
+		_, err = s.sns.PublishWithContext(ctx, &sns.PublishInput{TopicArn: aws.String(s.target), Message: aws.String(string(message))})
+	} else {
+		_, err = s.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(s.target), MessageBody: aws.String(string(message))})
+	}
+	if err != nil {
+		return fmt.Errorf("Can't send failed delivery: %v", err)
+	}
+	return nil
+}
+
+// deadLetter hands the payload of a PostToConnection call that failed for good to the DeadLetterSink of the
+// request, so a paid for answer can still be replayed. A departed client isn't a failed delivery, and a
+// failure to dead-letter is only logged. It returns err unchanged.
+func deadLetter(openAIRequest openAIRequest, payload []byte, err error) error {
+	if openAIRequest.deadLetters == nil || errors.Is(err, ErrClientGone) {
+		return err
+	}
+	ctx := openAIRequest.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// The invocation may be out of time already, as a timed out post is one of the failures
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), deadLetterTimeout)
+	defer cancel()
+	sendErr := openAIRequest.deadLetters.SendFailedDelivery(ctx, failedDelivery{
+		ConnectionID: openAIRequest.ConnectionId,
+		RequestID:    openAIRequest.request.RequestID,
+		ResponseType: openAIRequest.request.ResponseType,
+		Payload:      strings.ToValidUTF8(string(payload), "�"),
+		Error:        err.Error(),
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+	})
+	if sendErr != nil {
+		openAIRequest.logger().Error("Can't dead-letter failed delivery", "error", sendErr)
+	} else {
+		openAIRequest.logger().Warn("Failed delivery dead-lettered", "bytes", len(payload))
+	}
+	return err
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const (
+	testDeadLetterQueueURL = "https://sqs.eu-west-1.amazonaws.com/123456789012/failed-deliveries"
+	testDeadLetterTopicARN = "arn:aws:sns:eu-west-1:123456789012:failed-deliveries"
+)
+
+// fakeSQS records the messages sent to it, failing them with err when it is set
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	err     error
+	queue   string
+	message string
+}
+
+func (f *fakeSQS) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, opts ...request.Option) (*sqs.SendMessageOutput, error) {
+	f.queue, f.message = aws.StringValue(input.QueueUrl), aws.StringValue(input.MessageBody)
+	return &sqs.SendMessageOutput{}, f.err
+}
+
+// fakeSNS records the message published to it
+type fakeSNS struct {
+	snsiface.SNSAPI
+	topic   string
+	message string
+}
+
+func (f *fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, opts ...request.Option) (*sns.PublishOutput, error) {
+	f.topic, f.message = aws.StringValue(input.TopicArn), aws.StringValue(input.Message)
+	return &sns.PublishOutput{}, nil
+}
+
+// fakeS3 records the object written to it, failing the write with err when it is set
+type fakeS3 struct {
+	s3iface.S3API
+	err    error
+	bucket string
+	key    string
+	body   string
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	body, _ := io.ReadAll(input.Body)
+	f.bucket, f.key, f.body = aws.StringValue(input.Bucket), aws.StringValue(input.Key), string(body)
+	return &s3.PutObjectOutput{}, nil
+}
+
+// recordingSink records the failed deliveries handed to it
+type recordingSink struct {
+	mu         sync.Mutex
+	deliveries []failedDelivery
+}
+
+func (s *recordingSink) SendFailedDelivery(ctx context.Context, delivery failedDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+func TestSendFailedDelivery(t *testing.T) {
+	large := strings.Repeat("x", maxDeadLetterPayloadBytes+1)
+	tests := []struct {
+		name        string
+		target      string
+		bucket      bool
+		payload     string
+		sendErr     error
+		s3Err       error
+		wantErr     string
+		wantPayload string
+		wantKey     bool // The message carries the S3 key of the payload
+		wantDropped bool
+	}{
+		{name: "queue", target: testDeadLetterQueueURL, payload: "Hello", wantPayload: "Hello"},
+		{name: "topic", target: testDeadLetterTopicARN, payload: "Hello", wantPayload: "Hello"},
+		{name: "large payload to S3", target: testDeadLetterQueueURL, bucket: true, payload: large, wantKey: true},
+		{name: "large payload without a bucket", target: testDeadLetterQueueURL, payload: large, wantDropped: true},
+		{name: "small payload with a bucket", target: testDeadLetterQueueURL, bucket: true, payload: "Hello", wantPayload: "Hello"},
+		{name: "S3 failure", target: testDeadLetterQueueURL, bucket: true, payload: large, s3Err: errors.New("access denied"), wantErr: "Can't write failed delivery payload to S3"},
+		{name: "queue failure", target: testDeadLetterQueueURL, payload: "Hello", sendErr: errors.New("queue gone"), wantErr: "Can't send failed delivery"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue, topic, bucket := &fakeSQS{err: tt.sendErr}, &fakeSNS{}, &fakeS3{err: tt.s3Err}
+			sink := awsDeadLetterSink{target: tt.target}
+			if isSNSTopicARN(tt.target) {
+				sink.sns = topic
+			} else {
+				sink.sqs = queue
+			}
+			if tt.bucket {
+				sink.bucket, sink.s3 = "deliveries", bucket
+			}
+			err := sink.SendFailedDelivery(context.Background(), failedDelivery{
+				ConnectionID: "conn-1",
+				RequestID:    "req-1",
+				ResponseType: responseTypeFull,
+				Payload:      tt.payload,
+				Error:        "post failed",
+				Timestamp:    "2026-10-14T08:00:00Z",
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("SendFailedDelivery() error = %v, want %q", err, tt.wantErr)
+				}
+				if tt.s3Err != nil && queue.message != "" {
+					t.Error("the message was sent without its payload in S3")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, target := queue.message, queue.queue
+			if sink.sns != nil {
+				message, target = topic.message, topic.topic
+			}
+			if target != tt.target {
+				t.Errorf("sent to %q, want %q", target, tt.target)
+			}
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(message), &fields); err != nil {
+				t.Fatalf("message %q: %v", message, err)
+			}
+			want := map[string]any{
+				"connection_id": "conn-1",
+				"request_id":    "req-1",
+				"response_type": responseTypeFull,
+				"error":         "post failed",
+				"timestamp":     "2026-10-14T08:00:00Z",
+			}
+			if tt.wantPayload != "" {
+				want["payload"] = tt.wantPayload
+			}
+			if tt.wantDropped {
+				want["payload_dropped"] = true
+			}
+			if tt.wantKey {
+				if !strings.HasPrefix(bucket.key, deadLetterKeyPrefix) || !strings.HasSuffix(bucket.key, ".json") || bucket.bucket != "deliveries" || bucket.body != tt.payload {
+					t.Errorf("S3 object %s/%s with %d bytes, want the payload under %s", bucket.bucket, bucket.key, len(bucket.body), deadLetterKeyPrefix)
+				}
+				want["payload_key"] = bucket.key
+			} else if bucket.key != "" {
+				t.Errorf("wrote S3 object %s for a payload fitting the message", bucket.key)
+			}
+			if len(fields) != len(want) {
+				t.Errorf("message fields = %v, want %v", fields, want)
+			}
+			for name, value := range want {
+				if fields[name] != value {
+					t.Errorf("message %s = %v, want %v", name, fields[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestIsSNSTopicARN(t *testing.T) {
+	tests := map[string]bool{
+		testDeadLetterTopicARN:                                 true,
+		testDeadLetterQueueURL:                                 false,
+		"arn:aws:sqs:eu-west-1:123456789012:failed-deliveries": false,
+		"": false,
+	}
+	for target, want := range tests {
+		if got := isSNSTopicARN(target); got != want {
+			t.Errorf("isSNSTopicARN(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+// TestDeadLetterFailedPosts checks which failed posts of an answer are handed to FAILED_DELIVERY_QUEUE_URL
+func TestDeadLetterFailedPosts(t *testing.T) {
+	large := strings.Repeat("word ", maxFrameBytes/5+1000)
+	tests := []struct {
+		name        string
+		queue       string
+		answer      string
+		failAt      int
+		failErr     error
+		wantPayload string // Payload of the single expected delivery, empty for none
+	}{
+		{name: "failed post", queue: testDeadLetterQueueURL, answer: "Hello", failAt: 0, failErr: &testsupport.StatusError{Code: http.StatusInternalServerError}, wantPayload: "Hello"},
+		{name: "gone client", queue: testDeadLetterQueueURL, answer: "Hello", failAt: 0, failErr: testsupport.ErrGone},
+		{name: "no queue", answer: "Hello", failAt: 0, failErr: &testsupport.StatusError{Code: http.StatusInternalServerError}},
+		{
+			// A failed frame of a split answer dead-letters the whole answer once
+			name:        "split answer",
+			queue:       testDeadLetterQueueURL,
+			answer:      large,
+			failAt:      1,
+			failErr:     &testsupport.StatusError{Code: http.StatusInternalServerError},
+			wantPayload: large,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.FailedDeliveryQueueURL = tt.queue })
+			sink := &recordingSink{}
+			poster := testsupport.NewRecordingPoster().FailAt(tt.failAt, tt.failErr)
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply(tt.answer)), poster, nil, nil)
+			h.deadLetterSinks.generation, h.deadLetterSinks.value = cfg.Generation, sink
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","request_id":"req-1","messages":[{"role":"user","content":"hi"}]}`
+			h.Handler(context.Background(), testMessage(body))
+
+			if tt.wantPayload == "" {
+				if len(sink.deliveries) != 0 {
+					t.Errorf("dead-lettered %d deliveries, want none", len(sink.deliveries))
+				}
+				return
+			}
+			if len(sink.deliveries) != 1 {
+				t.Fatalf("dead-lettered %d deliveries, want 1", len(sink.deliveries))
+			}
+			delivery := sink.deliveries[0]
+			if delivery.ConnectionID != "conn-1" || delivery.RequestID != "req-1" || delivery.ResponseType != responseTypeFull || delivery.Payload != tt.wantPayload {
+				t.Errorf("delivery = %s %s %s with %d payload bytes, want conn-1 req-1 full with %d", delivery.ConnectionID, delivery.RequestID, delivery.ResponseType, len(delivery.Payload), len(tt.wantPayload))
+			}
+			if !strings.Contains(delivery.Error, "500") {
+				t.Errorf("delivery error = %q, want the failure of the post", delivery.Error)
+			}
+			if _, err := time.Parse(time.RFC3339, delivery.Timestamp); err != nil {
+				t.Errorf("delivery timestamp %q: %v", delivery.Timestamp, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFailedDelivery(t *testing.T) {
+	tests := []struct {
+		name    string
+		queue   string
+		bucket  string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "queue", queue: testDeadLetterQueueURL},
+		{name: "queue and bucket", queue: testDeadLetterQueueURL, bucket: "deliveries"},
+		{name: "bucket without a queue", bucket: "deliveries", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FAILED_DELIVERY_QUEUE_URL", tt.queue)
+			t.Setenv("FAILED_DELIVERY_BUCKET", tt.bucket)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (cfg.FailedDeliveryQueueURL != tt.queue || cfg.FailedDeliveryBucket != tt.bucket) {
+				t.Errorf("failed delivery = %q, %q, want %q, %q", cfg.FailedDeliveryQueueURL, cfg.FailedDeliveryBucket, tt.queue, tt.bucket)
+			}
+		})
+	}
+}
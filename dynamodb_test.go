@@ -0,0 +1,671 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB is an in-memory DynamoDB for tests. It evaluates the update, condition and filter expressions
+// the handler uses, so atomic counters and conditional writes behave like on a real table. Calls of
+// operations it doesn't implement panic, so an unexpected table access fails the test.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]map[string]map[string]*dynamodb.AttributeValue
+	keys   map[string][]string // Key attribute names per table, needed to store the items of PutItem
+	calls  map[string]int
+	fails  map[string]error // Errors returned by the operations instead of running them
+
+	scanPageSize  int   // Items per page of a scan, 0 for a single page
+	scanFailAfter int   // Pages a scan delivers before failing with scanErr
+	scanErr       error // Failure of a scan after scanFailAfter pages, nil for none
+}
+
+// newFakeDynamoDB creates an empty fake. Tables are created on first use, with the key attributes given
+// by table for the ones PutItem writes to.
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		tables: make(map[string]map[string]map[string]*dynamodb.AttributeValue),
+		keys:   make(map[string][]string),
+		calls:  make(map[string]int),
+		fails:  make(map[string]error),
+	}
+}
+
+// table declares the key attributes of a table
+func (db *fakeDynamoDB) table(name string, keys ...string) *fakeDynamoDB {
+	db.keys[name] = keys
+	return db
+}
+
+// item returns a copy of the stored item with key, nil when there is none
+func (db *fakeDynamoDB) item(table string, key map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return copyItem(db.tables[table][fakeItemKey(key)])
+}
+
+// put stores a copy of item in table, for seeding tests
+func (db *fakeDynamoDB) put(table string, item map[string]*dynamodb.AttributeValue) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.store(table, item)
+}
+
+// fail makes every call of operation fail with err, or run again when err is nil
+func (db *fakeDynamoDB) fail(operation string, err error) *fakeDynamoDB {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.fails[operation] = err
+	return db
+}
+
+// paginate splits scans into pages of size items, failing the scan with err after failAfter pages when err is set
+func (db *fakeDynamoDB) paginate(size int, failAfter int, err error) *fakeDynamoDB {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.scanPageSize, db.scanFailAfter, db.scanErr = size, failAfter, err
+	return db
+}
+
+// count returns how often operation was called
+func (db *fakeDynamoDB) count(operation string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.calls[operation]
+}
+
+// store keeps item under the key attributes declared for table
+func (db *fakeDynamoDB) store(table string, item map[string]*dynamodb.AttributeValue) {
+	names, ok := db.keys[table]
+	if !ok {
+		panic(fmt.Sprintf("fakeDynamoDB: no key attributes declared for table %s", table))
+	}
+	key := make(map[string]*dynamodb.AttributeValue, len(names))
+	for _, name := range names {
+		key[name] = item[name]
+	}
+	db.rows(table)[fakeItemKey(key)] = copyItem(item)
+}
+
+// rows returns the items of table, creating it
+func (db *fakeDynamoDB) rows(table string) map[string]map[string]*dynamodb.AttributeValue {
+	if db.tables[table] == nil {
+		db.tables[table] = make(map[string]map[string]*dynamodb.AttributeValue)
+	}
+	return db.tables[table]
+}
+
+// fakeItemKey returns the map key of a DynamoDB key
+func fakeItemKey(key map[string]*dynamodb.AttributeValue) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s;", name, key[name].String())
+	}
+	return b.String()
+}
+
+func (db *fakeDynamoDB) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls["GetItem"]++
+	if err := db.fails["GetItem"]; err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{Item: copyItem(db.rows(aws.StringValue(input.TableName))[fakeItemKey(input.Key)])}, nil
+}
+
+func (db *fakeDynamoDB) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, opts ...request.Option) (*dynamodb.PutItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls["PutItem"]++
+	if err := db.fails["PutItem"]; err != nil {
+		return nil, err
+	}
+	return db.putItem(input)
+}
+
+func (db *fakeDynamoDB) putItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	table := aws.StringValue(input.TableName)
+	names := db.keys[table]
+	key := make(map[string]*dynamodb.AttributeValue, len(names))
+	for _, name := range names {
+		key[name] = input.Item[name]
+	}
+	old := db.rows(table)[fakeItemKey(key)]
+	expr := newFakeExpression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if input.ConditionExpression != nil && !expr.condition(aws.StringValue(input.ConditionExpression), old) {
+		return nil, fakeConditionFailed()
+	}
+	db.store(table, input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (db *fakeDynamoDB) UpdateItemWithContext(ctx aws.Context, input *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls["UpdateItem"]++
+	if err := db.fails["UpdateItem"]; err != nil {
+		return nil, err
+	}
+	return db.updateItem(input)
+}
+
+func (db *fakeDynamoDB) updateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	rows := db.rows(aws.StringValue(input.TableName))
+	id := fakeItemKey(input.Key)
+	old := rows[id]
+	expr := newFakeExpression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if input.ConditionExpression != nil && !expr.condition(aws.StringValue(input.ConditionExpression), old) {
+		return nil, fakeConditionFailed()
+	}
+	item := copyItem(old)
+	if item == nil {
+		item = copyItem(input.Key)
+	}
+	updated := expr.update(aws.StringValue(input.UpdateExpression), item)
+	rows[id] = item
+
+	output := &dynamodb.UpdateItemOutput{}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllNew:
+		output.Attributes = copyItem(item)
+	case dynamodb.ReturnValueAllOld:
+		output.Attributes = copyItem(old)
+	case dynamodb.ReturnValueUpdatedNew:
+		output.Attributes = make(map[string]*dynamodb.AttributeValue)
+		for _, name := range updated {
+			if value, ok := item[name]; ok {
+				output.Attributes[name] = copyAttribute(value)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (db *fakeDynamoDB) DeleteItemWithContext(ctx aws.Context, input *dynamodb.DeleteItemInput, opts ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls["DeleteItem"]++
+	if err := db.fails["DeleteItem"]; err != nil {
+		return nil, err
+	}
+	return db.deleteItem(input)
+}
+
+func (db *fakeDynamoDB) deleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	rows := db.rows(aws.StringValue(input.TableName))
+	id := fakeItemKey(input.Key)
+	old := rows[id]
+	expr := newFakeExpression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if input.ConditionExpression != nil && !expr.condition(aws.StringValue(input.ConditionExpression), old) {
+		return nil, fakeConditionFailed()
+	}
+	delete(rows, id)
+	output := &dynamodb.DeleteItemOutput{}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		output.Attributes = copyItem(old)
+	}
+	return output, nil
+}
+
+func (db *fakeDynamoDB) ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool, opts ...request.Option) error {
+	db.mu.Lock()
+	db.calls["Scan"]++
+	if err := db.fails["Scan"]; err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	expr := newFakeExpression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	rows := db.rows(aws.StringValue(input.TableName))
+	keys := make([]string, 0, len(rows))
+	for key := range rows {
+		keys = append(keys, key)
+	}
+	// Items are scanned in key order, so tests know which page an item is on
+	sort.Strings(keys)
+	var items []map[string]*dynamodb.AttributeValue
+	for _, key := range keys {
+		if input.FilterExpression == nil || expr.condition(aws.StringValue(input.FilterExpression), rows[key]) {
+			items = append(items, copyItem(rows[key]))
+		}
+	}
+	size, failAfter, scanErr := db.scanPageSize, db.scanFailAfter, db.scanErr
+	db.mu.Unlock()
+	if size <= 0 {
+		size = max(len(items), 1)
+	}
+	for start, pages := 0, 0; ; start, pages = start+size, pages+1 {
+		if scanErr != nil && pages >= failAfter {
+			return scanErr
+		}
+		page := &dynamodb.ScanOutput{Items: items[start:min(start+size, len(items))]}
+		page.Count = aws.Int64(int64(len(page.Items)))
+		last := start+size >= len(items)
+		if !fn(page, last) || last {
+			return nil
+		}
+	}
+}
+
+// TransactWriteItemsWithContext applies all writes or, when the condition of one of them fails, none
+func (db *fakeDynamoDB) TransactWriteItemsWithContext(ctx aws.Context, input *dynamodb.TransactWriteItemsInput, opts ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls["TransactWriteItems"]++
+	if err := db.fails["TransactWriteItems"]; err != nil {
+		return nil, err
+	}
+	backup := make(map[string]map[string]map[string]*dynamodb.AttributeValue, len(db.tables))
+	for table, rows := range db.tables {
+		backup[table] = make(map[string]map[string]*dynamodb.AttributeValue, len(rows))
+		for id, item := range rows {
+			backup[table][id] = copyItem(item)
+		}
+	}
+	for _, write := range input.TransactItems {
+		var err error
+		switch {
+		case write.Put != nil:
+			_, err = db.putItem(&dynamodb.PutItemInput{
+				TableName: write.Put.TableName, Item: write.Put.Item, ConditionExpression: write.Put.ConditionExpression,
+				ExpressionAttributeNames: write.Put.ExpressionAttributeNames, ExpressionAttributeValues: write.Put.ExpressionAttributeValues,
+			})
+		case write.Update != nil:
+			_, err = db.updateItem(&dynamodb.UpdateItemInput{
+				TableName: write.Update.TableName, Key: write.Update.Key, UpdateExpression: write.Update.UpdateExpression,
+				ConditionExpression: write.Update.ConditionExpression, ExpressionAttributeNames: write.Update.ExpressionAttributeNames,
+				ExpressionAttributeValues: write.Update.ExpressionAttributeValues,
+			})
+		case write.Delete != nil:
+			_, err = db.deleteItem(&dynamodb.DeleteItemInput{
+				TableName: write.Delete.TableName, Key: write.Delete.Key, ConditionExpression: write.Delete.ConditionExpression,
+				ExpressionAttributeNames: write.Delete.ExpressionAttributeNames, ExpressionAttributeValues: write.Delete.ExpressionAttributeValues,
+			})
+		default:
+			panic("fakeDynamoDB: unsupported transaction write")
+		}
+		if err != nil {
+			db.tables = backup
+			return nil, awserr.New(dynamodb.ErrCodeTransactionCanceledException, "Transaction cancelled, please refer cancellation reasons for specific reasons [ConditionalCheckFailed]", nil)
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// fakeConditionFailed is the error of a write whose condition doesn't hold
+func fakeConditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// copyItem deep copies an item, nil stays nil
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	copied := make(map[string]*dynamodb.AttributeValue, len(item))
+	for name, value := range item {
+		copied[name] = copyAttribute(value)
+	}
+	return copied
+}
+
+// copyAttribute deep copies an attribute value
+func copyAttribute(value *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if value == nil {
+		return nil
+	}
+	copied := *value
+	if value.M != nil {
+		copied.M = copyItem(value.M)
+	}
+	if value.L != nil {
+		copied.L = make([]*dynamodb.AttributeValue, len(value.L))
+		for i, element := range value.L {
+			copied.L[i] = copyAttribute(element)
+		}
+	}
+	if value.SS != nil {
+		copied.SS = append([]*string(nil), value.SS...)
+	}
+	if value.NS != nil {
+		copied.NS = append([]*string(nil), value.NS...)
+	}
+	return &copied
+}
+
+// fakeExpression evaluates DynamoDB expressions against an item. It supports top level attributes only,
+// which is all the handler uses.
+type fakeExpression struct {
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+	tokens []string
+	pos    int
+}
+
+func newFakeExpression(names map[string]*string, values map[string]*dynamodb.AttributeValue) *fakeExpression {
+	return &fakeExpression{names: names, values: values}
+}
+
+// tokenize splits an expression into names, placeholders, numbers and operators
+func (e *fakeExpression) tokenize(expression string) {
+	e.tokens, e.pos = nil, 0
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),=+-", c):
+			e.tokens = append(e.tokens, string(c))
+			i++
+		case c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(runes) && (runes[i+1] == '=' || (c == '<' && runes[i+1] == '>')) {
+				op += string(runes[i+1])
+			}
+			e.tokens = append(e.tokens, op)
+			i += len(op)
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("(),=+-<>", runes[i]) {
+				i++
+			}
+			e.tokens = append(e.tokens, string(runes[start:i]))
+		}
+	}
+}
+
+func (e *fakeExpression) peek() string {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return ""
+}
+
+func (e *fakeExpression) next() string {
+	token := e.peek()
+	e.pos++
+	return token
+}
+
+func (e *fakeExpression) expect(token string) {
+	if got := e.next(); got != token {
+		panic(fmt.Sprintf("fakeDynamoDB: expected %q, got %q in %v", token, got, e.tokens))
+	}
+}
+
+// name resolves an attribute name token
+func (e *fakeExpression) name(token string) string {
+	if strings.HasPrefix(token, "#") {
+		name, ok := e.names[token]
+		if !ok {
+			panic(fmt.Sprintf("fakeDynamoDB: undefined attribute name %s", token))
+		}
+		return aws.StringValue(name)
+	}
+	return token
+}
+
+// placeholder resolves a value token
+func (e *fakeExpression) placeholder(token string) *dynamodb.AttributeValue {
+	value, ok := e.values[token]
+	if !ok {
+		panic(fmt.Sprintf("fakeDynamoDB: undefined attribute value %s", token))
+	}
+	return value
+}
+
+// update applies an update expression to item, returning the names of the attributes it changed
+func (e *fakeExpression) update(expression string, item map[string]*dynamodb.AttributeValue) []string {
+	e.tokenize(expression)
+	var updated []string
+	clause := ""
+	for e.peek() != "" {
+		switch token := strings.ToUpper(e.peek()); token {
+		case "SET", "ADD", "REMOVE", "DELETE":
+			clause = token
+			e.next()
+			continue
+		case ",":
+			e.next()
+			continue
+		}
+		name := e.name(e.next())
+		updated = append(updated, name)
+		switch clause {
+		case "SET":
+			e.expect("=")
+			value := e.operand(item)
+			for e.peek() == "+" || e.peek() == "-" {
+				op := e.next()
+				value = fakeArithmetic(value, e.operand(item), op)
+			}
+			item[name] = value
+		case "ADD":
+			value := e.placeholder(e.next())
+			current, ok := item[name]
+			switch {
+			case !ok:
+				item[name] = copyAttribute(value)
+			case value.N != nil:
+				item[name] = fakeArithmetic(current, value, "+")
+			case value.SS != nil:
+				merged := copyAttribute(current)
+				for _, element := range value.SS {
+					if !fakeContains(merged.SS, element) {
+						merged.SS = append(merged.SS, element)
+					}
+				}
+				item[name] = merged
+			}
+		case "REMOVE":
+			delete(item, name)
+		case "DELETE":
+			value := e.placeholder(e.next())
+			if current, ok := item[name]; ok {
+				var kept []*string
+				for _, element := range current.SS {
+					if !fakeContains(value.SS, element) {
+						kept = append(kept, element)
+					}
+				}
+				if len(kept) == 0 {
+					delete(item, name)
+				} else {
+					item[name] = &dynamodb.AttributeValue{SS: kept}
+				}
+			}
+		default:
+			panic(fmt.Sprintf("fakeDynamoDB: update expression %q has no clause", expression))
+		}
+	}
+	return updated
+}
+
+// operand evaluates a value of a SET action
+func (e *fakeExpression) operand(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	token := e.next()
+	switch {
+	case strings.HasPrefix(token, ":"):
+		return copyAttribute(e.placeholder(token))
+	case token == "if_not_exists":
+		e.expect("(")
+		name := e.name(e.next())
+		e.expect(",")
+		fallback := e.operand(item)
+		e.expect(")")
+		if current, ok := item[name]; ok {
+			return copyAttribute(current)
+		}
+		return fallback
+	case token == "list_append":
+		e.expect("(")
+		first := e.operand(item)
+		e.expect(",")
+		second := e.operand(item)
+		e.expect(")")
+		return &dynamodb.AttributeValue{L: append(append([]*dynamodb.AttributeValue{}, first.L...), second.L...)}
+	default:
+		current, ok := item[e.name(token)]
+		if !ok {
+			panic(fmt.Sprintf("fakeDynamoDB: attribute %s doesn't exist", token))
+		}
+		return copyAttribute(current)
+	}
+}
+
+// condition evaluates a condition or filter expression against item, which is nil when there is none
+func (e *fakeExpression) condition(expression string, item map[string]*dynamodb.AttributeValue) bool {
+	e.tokenize(expression)
+	result := e.or(item)
+	if e.peek() != "" {
+		panic(fmt.Sprintf("fakeDynamoDB: unexpected %q in condition %q", e.peek(), expression))
+	}
+	return result
+}
+
+func (e *fakeExpression) or(item map[string]*dynamodb.AttributeValue) bool {
+	result := e.and(item)
+	for strings.EqualFold(e.peek(), "OR") {
+		e.next()
+		right := e.and(item)
+		result = result || right
+	}
+	return result
+}
+
+func (e *fakeExpression) and(item map[string]*dynamodb.AttributeValue) bool {
+	result := e.not(item)
+	for strings.EqualFold(e.peek(), "AND") {
+		e.next()
+		right := e.not(item)
+		result = result && right
+	}
+	return result
+}
+
+func (e *fakeExpression) not(item map[string]*dynamodb.AttributeValue) bool {
+	if strings.EqualFold(e.peek(), "NOT") {
+		e.next()
+		return !e.not(item)
+	}
+	if e.peek() == "(" {
+		e.next()
+		result := e.or(item)
+		e.expect(")")
+		return result
+	}
+	switch token := e.peek(); token {
+	case "attribute_exists", "attribute_not_exists":
+		e.next()
+		e.expect("(")
+		_, ok := item[e.name(e.next())]
+		e.expect(")")
+		return ok == (token == "attribute_exists")
+	case "begins_with":
+		e.next()
+		e.expect("(")
+		value, ok := item[e.name(e.next())]
+		e.expect(",")
+		prefix := e.placeholder(e.next())
+		e.expect(")")
+		return ok && strings.HasPrefix(aws.StringValue(value.S), aws.StringValue(prefix.S))
+	}
+	left := e.comparand(item)
+	op := e.next()
+	right := e.comparand(item)
+	if left == nil || right == nil {
+		return false
+	}
+	return fakeCompare(left, right, op)
+}
+
+// comparand evaluates a side of a comparison, nil for a missing attribute
+func (e *fakeExpression) comparand(item map[string]*dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	token := e.next()
+	switch {
+	case strings.HasPrefix(token, ":"):
+		return e.placeholder(token)
+	case token == "size":
+		e.expect("(")
+		value, ok := item[e.name(e.next())]
+		e.expect(")")
+		if !ok {
+			return nil
+		}
+		size := len(aws.StringValue(value.S)) + len(value.L) + len(value.M) + len(value.SS) + len(value.NS)
+		return &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(size))}
+	default:
+		return item[e.name(token)]
+	}
+}
+
+// fakeArithmetic adds or subtracts two number attributes
+func fakeArithmetic(left, right *dynamodb.AttributeValue, op string) *dynamodb.AttributeValue {
+	a, _ := strconv.ParseFloat(aws.StringValue(left.N), 64)
+	b, _ := strconv.ParseFloat(aws.StringValue(right.N), 64)
+	if op == "-" {
+		b = -b
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatFloat(a+b, 'f', -1, 64))}
+}
+
+// fakeCompare compares two number or two string attributes
+func fakeCompare(left, right *dynamodb.AttributeValue, op string) bool {
+	var cmp int
+	if left.N != nil && right.N != nil {
+		a, _ := strconv.ParseFloat(aws.StringValue(left.N), 64)
+		b, _ := strconv.ParseFloat(aws.StringValue(right.N), 64)
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	} else if left.S != nil && right.S != nil {
+		cmp = strings.Compare(aws.StringValue(left.S), aws.StringValue(right.S))
+	} else {
+		return op == "<>"
+	}
+	switch op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	panic(fmt.Sprintf("fakeDynamoDB: unsupported comparison %q", op))
+}
+
+func fakeContains(set []*string, element *string) bool {
+	for _, member := range set {
+		if aws.StringValue(member) == aws.StringValue(element) {
+			return true
+		}
+	}
+	return false
+}
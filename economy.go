@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// economyBaseMaxTokens is the completion budget reduced in economy mode when the request doesn't set max_tokens
+	economyBaseMaxTokens = 1024
+	// economyMinFactor is the fraction of the budget left when the spend reaches the hard cap
+	economyMinFactor = 0.25
+	// economyMinTokens is the smallest completion budget economy mode ever applies
+	economyMinTokens = 64
+)
+
+// defaultEconomyResponseTypes are the response types economy mode applies to without ECONOMY_RESPONSE_TYPES
+var defaultEconomyResponseTypes = []string{responseTypeFull, responseTypeStream}
+
+// economyMaxTokens computes the effective max_tokens for a request when the daily spend is close to the cap.
+// utilization is the used fraction of the daily cap and softCap the fraction where economy mode starts.
+// Below the soft cap the requested budget is returned unchanged; between the soft cap and the hard cap it is
+// reduced linearly down to economyMinFactor of the budget, never below economyMinTokens.
+// The second return value reports whether economy mode applies.
+func economyMaxTokens(requested int, utilization float64, softCap float64) (int, bool) {
+	if softCap <= 0 || softCap >= 1 || utilization < softCap {
+		return requested, false
+	}
+	base := requested
+	if base <= 0 {
+		base = economyBaseMaxTokens
+	}
+	progress := (utilization - softCap) / (1 - softCap)
+	if progress > 1 {
+		progress = 1
+	}
+	factor := 1 - progress*(1-economyMinFactor)
+	tokens := int(float64(base) * factor)
+	if tokens < economyMinTokens {
+		tokens = economyMinTokens
+	}
+	// Never raise a budget that was already smaller than the floor
+	if requested > 0 && tokens > requested {
+		tokens = requested
+	}
+	return tokens, true
+}
+
+// parseEconomyResponseTypes parses the comma separated ECONOMY_RESPONSE_TYPES. The extracting response types
+// and list answer in a few tokens already, so they are always exempt and can't be listed.
+func parseEconomyResponseTypes(value string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	for _, responseType := range splitList(value, defaultEconomyResponseTypes) {
+		if !routeResponseTypes[responseType] {
+			return nil, fmt.Errorf("Unknown response type in environment variable ECONOMY_RESPONSE_TYPES: %s", responseType)
+		}
+		if isExtractorResponseType(responseType) || responseType == responseTypeList {
+			return nil, fmt.Errorf("Response type %s in environment variable ECONOMY_RESPONSE_TYPES is always exempt from economy mode", responseType)
+		}
+		types[responseType] = true
+	}
+	return types, nil
+}
+
+// softCap returns SOFT_CAP_PERCENT as a fraction of the daily cap
+func softCap(cfg *Config) float64 {
+	return float64(cfg.SoftCapPercent) / 100
+}
+
+// economyMode checks if the max_tokens of the request are reduced: its response type isn't exempt and the
+// daily usage of its subject has passed SOFT_CAP_PERCENT
+func (r openAIRequest) economyMode() bool {
+	return r.config.SoftCapPercent > 0 && r.config.EconomyResponseTypes[r.request.ResponseType] && r.quotaUtilization >= softCap(r.config)
+}
+
+// applyEconomyMode reduces the max_tokens of chatRequest in economy mode
+func applyEconomyMode(openAIRequest openAIRequest, chatRequest *openai.ChatCompletionRequest) {
+	if !openAIRequest.economyMode() {
+		return
+	}
+	tokens, _ := economyMaxTokens(chatRequest.MaxTokens, openAIRequest.quotaUtilization, softCap(openAIRequest.config))
+	openAIRequest.logger().Debug("Economy mode reduces max_tokens", "requested", chatRequest.MaxTokens, "max_tokens", tokens, "utilization", openAIRequest.quotaUtilization)
+	chatRequest.MaxTokens = tokens
+}
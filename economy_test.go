@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestEconomyMaxTokens(t *testing.T) {
+	tests := []struct {
+		name        string
+		requested   int
+		utilization float64
+		softCap     float64
+		want        int
+		wantEconomy bool
+	}{
+		{name: "below soft cap", requested: 800, utilization: 0.5, softCap: 0.8, want: 800},
+		{name: "at soft cap", requested: 800, utilization: 0.8, softCap: 0.8, want: 800, wantEconomy: true},
+		{name: "halfway", requested: 800, utilization: 0.9, softCap: 0.8, want: 500, wantEconomy: true},
+		{name: "at cap", requested: 800, utilization: 1, softCap: 0.8, want: 200, wantEconomy: true},
+		{name: "over cap", requested: 800, utilization: 1.5, softCap: 0.8, want: 200, wantEconomy: true},
+		{name: "unset budget", requested: 0, utilization: 1, softCap: 0.8, want: economyBaseMaxTokens / 4, wantEconomy: true},
+		{name: "floor", requested: 100, utilization: 1, softCap: 0.8, want: economyMinTokens, wantEconomy: true},
+		{name: "small budget not raised", requested: 32, utilization: 1, softCap: 0.8, want: 32, wantEconomy: true},
+		{name: "disabled", requested: 800, utilization: 1, softCap: 0, want: 800},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, economy := economyMaxTokens(tt.requested, tt.utilization, tt.softCap)
+			if got != tt.want || economy != tt.wantEconomy {
+				t.Fatalf("economyMaxTokens() = %d, %v, want %d, %v", got, economy, tt.want, tt.wantEconomy)
+			}
+		})
+	}
+}
+
+func TestParseEconomyResponseTypes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: []string{responseTypeFull, responseTypeStream}},
+		{value: "json, full", want: []string{responseTypeJSON, responseTypeFull}},
+		{value: "int", wantErr: true},
+		{value: "list", wantErr: true},
+		{value: "essay", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseEconomyResponseTypes(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEconomyResponseTypes() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parseEconomyResponseTypes() = %v, want %v", got, tt.want)
+			}
+			for _, responseType := range tt.want {
+				if !got[responseType] {
+					t.Fatalf("parseEconomyResponseTypes() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyEconomyMode(t *testing.T) {
+	cfg := *getConfig()
+	cfg.SoftCapPercent = 80
+	cfg.EconomyResponseTypes = map[string]bool{responseTypeFull: true}
+	tests := []struct {
+		name         string
+		responseType string
+		utilization  float64
+		want         int
+	}{
+		{name: "under soft cap", responseType: responseTypeFull, utilization: 0.5, want: 800},
+		{name: "reduced", responseType: responseTypeFull, utilization: 1, want: 200},
+		{name: "type not listed", responseType: responseTypeStream, utilization: 1, want: 800},
+		{name: "extraction exempt", responseType: responseTypeInt, utilization: 1, want: 800},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openAIRequest := openAIRequest{config: &cfg, request: Request{ResponseType: tt.responseType}, quotaUtilization: tt.utilization}
+			chatRequest := openai.ChatCompletionRequest{MaxTokens: 800}
+			applyEconomyMode(openAIRequest, &chatRequest)
+			if chatRequest.MaxTokens != tt.want {
+				t.Fatalf("max_tokens = %d, want %d", chatRequest.MaxTokens, tt.want)
+			}
+			if annotations := computeAnnotations(openAIRequest, "answer"); (annotations != nil && annotations.EconomyMode) != (tt.want != 800) {
+				t.Fatalf("annotations = %+v, want economy_mode %v", annotations, tt.want != 800)
+			}
+		})
+	}
+}
+
+func TestEconomyModeNearDailyCap(t *testing.T) {
+	tests := []struct {
+		name          string
+		used          string
+		responseType  string
+		wantMaxTokens int
+		wantEconomy   bool
+	}{
+		{name: "under soft cap", used: "100", responseType: "full", wantMaxTokens: 800},
+		{name: "close to the cap", used: "900", responseType: "full", wantMaxTokens: 500, wantEconomy: true},
+		{name: "stream close to the cap", used: "900", responseType: "stream", wantMaxTokens: 500, wantEconomy: true},
+		{name: "exempt type", used: "900", responseType: "int", wantMaxTokens: 800},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.UsageTable = "usage"
+				cfg.DailyTokenQuota = 1000
+				cfg.SoftCapPercent = 80
+				cfg.EconomyResponseTypes = map[string]bool{responseTypeFull: true, responseTypeStream: true}
+			})
+			db := newFakeDynamoDB().table("usage", "usage_key")
+			item := usageKey("connection#conn-1", usageDay(testStart))
+			item["tokens"] = &dynamodb.AttributeValue{N: aws.String(tt.used)}
+			db.put("usage", item)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("[[3]]"))
+			poster := testsupport.NewRecordingPoster()
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","max_tokens":800,"include_usage":true,"messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart)).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+			}
+			if requests := chat.Requests(); len(requests) != 1 || requests[0].MaxTokens != tt.wantMaxTokens {
+				t.Fatalf("requests = %+v, want max_tokens %d", requests, tt.wantMaxTokens)
+			}
+			economy := false
+			for _, text := range poster.Texts() {
+				if strings.Contains(text, `"type":"usage"`) {
+					var usage usageFrame
+					if err := json.Unmarshal([]byte(text), &usage); err != nil {
+						t.Fatalf("can't decode usage frame %s: %v", text, err)
+					}
+					economy = usage.Annotations != nil && usage.Annotations.EconomyMode
+				}
+			}
+			if economy != tt.wantEconomy {
+				t.Fatalf("economy_mode annotation = %v, want %v in %q", economy, tt.wantEconomy, poster.Texts())
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-lambda-go/events"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+)
+
+// ErrAPIGatewayEndpointMissing is returned by posts to a connection whose management API endpoint is unknown,
+// without API_GW_ENDPOINT and outside a websocket event, an async job or a push to a recorded connection
+var ErrAPIGatewayEndpointMissing = errors.New("API Gateway Endpoint not found in environment variable API_GW_ENDPOINT or the request context")
+
+// apiGatewayEndpointKey is the context key of the management API endpoint derived from the websocket event
+type apiGatewayEndpointKey struct{}
+
+// withAPIGatewayEndpoint returns a copy of ctx carrying the management API endpoint of the connection
+func withAPIGatewayEndpoint(ctx context.Context, endpoint string) context.Context {
+	return context.WithValue(ctx, apiGatewayEndpointKey{}, endpoint)
+}
+
+// apiGatewayEndpointFrom returns the management API endpoint of ctx, or an empty string when it carries none
+func apiGatewayEndpointFrom(ctx context.Context) string {
+	endpoint, _ := ctx.Value(apiGatewayEndpointKey{}).(string)
+	return endpoint
+}
+
+// requestContextEndpoint returns the management API endpoint of the API that sent a websocket event,
+// https://{domain}/{stage} for execute-api domains. A custom domain already maps to the stage, so its
+// endpoint has no stage suffix.
+func requestContextEndpoint(requestContext events.APIGatewayWebsocketProxyRequestContext) string {
+	if requestContext.DomainName == "" {
+		return ""
+	}
+	endpoint := "https://" + requestContext.DomainName
+	if strings.Contains(requestContext.DomainName, ".execute-api.") && requestContext.Stage != "" {
+		endpoint += "/" + requestContext.Stage
+	}
+	return endpoint
+}
+
+// resolveAPIGatewayEndpoint returns the management API endpoint posts of ctx go to. API_GW_ENDPOINT takes
+// precedence over the endpoint of the request context, as before the endpoint could be derived.
+func resolveAPIGatewayEndpoint(ctx context.Context, cfg *Config) string {
+	if cfg.APIGatewayEndpoint != "" {
+		return apiGatewayBaseEndpoint(cfg.APIGatewayEndpoint)
+	}
+	return apiGatewayEndpointFrom(ctx)
+}
+
+// apiGatewayBaseEndpoint returns API_GW_ENDPOINT as a URL. The v1 SDK accepted a bare host name and added
+// the scheme itself, the v2 SDK needs it spelled out.
+func apiGatewayBaseEndpoint(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	return "https://" + endpoint
+}
+
+// connectionPosters holds an API Gateway backed ConnectionPoster per management API endpoint of a
+// configuration snapshot, since every stage deployed from the same artifact has its own
+type connectionPosters struct {
+	mu         sync.Mutex
+	byEndpoint map[string]ConnectionPoster
+}
+
+// missingEndpointPoster is the ConnectionPoster of requests whose endpoint couldn't be resolved
+type missingEndpointPoster struct{}
+
+// PostToConnection fails with ErrAPIGatewayEndpointMissing
+func (missingEndpointPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	return ErrAPIGatewayEndpointMissing
+}
+
+// getConnectionPoster returns the API Gateway backed ConnectionPoster for the configuration snapshot and the
+// endpoint of ctx, or the local one
+func (h *WebsocketHandler) getConnectionPoster(ctx context.Context, cfg *Config) ConnectionPoster {
+	if h.localPoster != nil {
+		return h.localPoster
+	}
+	endpoint := resolveAPIGatewayEndpoint(ctx, cfg)
+	if endpoint == "" {
+		return missingEndpointPoster{}
+	}
+	posters := h.apiGatewayClients.get(cfg, func(cfg *Config) *connectionPosters {
+		return &connectionPosters{byEndpoint: map[string]ConnectionPoster{}}
+	})
+	posters.mu.Lock()
+	defer posters.mu.Unlock()
+	if poster, ok := posters.byEndpoint[endpoint]; ok {
+		return poster
+	}
+	client := apigatewaymanagementapi.NewFromConfig(h.awsConfig, func(o *apigatewaymanagementapi.Options) {
+		o.BaseEndpoint = awsv2.String(endpoint)
+	})
+	poster := apiGatewayPoster{client: client}
+	posters.byEndpoint[endpoint] = poster
+	return poster
+}
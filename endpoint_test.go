@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const (
+	testExecuteAPIDomain = "abc123.execute-api.eu-west-1.amazonaws.com"
+	testCustomDomain     = "ws.example.com"
+)
+
+// recordingHTTPClient answers every call of the v2 SDK with 200, recording the URLs it was sent to
+type recordingHTTPClient struct {
+	mu   sync.Mutex
+	urls []string
+}
+
+func (c *recordingHTTPClient) Do(request *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.urls = append(c.urls, request.URL.String())
+	c.mu.Unlock()
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: request}, nil
+}
+
+func (c *recordingHTTPClient) posted() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.urls...)
+}
+
+// newEndpointHandler returns a handler posting through API Gateway backed clients whose calls go to an
+// HTTP client recording their URLs
+func newEndpointHandler(cfg *Config, chat ChatCompleter, db *fakeDynamoDB) (*WebsocketHandler, *recordingHTTPClient) {
+	httpClient := &recordingHTTPClient{}
+	h := newTestHandler(cfg, chat, nil, db, nil)
+	h.localPoster = nil
+	h.awsConfig = awsv2.Config{
+		Region:     "eu-west-1",
+		HTTPClient: httpClient,
+		Retryer:    func() awsv2.Retryer { return awsv2.NopRetryer{} },
+		Credentials: awsv2.CredentialsProviderFunc(func(ctx context.Context) (awsv2.Credentials, error) {
+			return awsv2.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	}
+	return h, httpClient
+}
+
+func TestRequestContextEndpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		stage  string
+		want   string
+	}{
+		{name: "execute-api domain", domain: testExecuteAPIDomain, stage: "prod", want: "https://" + testExecuteAPIDomain + "/prod"},
+		// The base path mapping of a custom domain already selects the stage
+		{name: "custom domain", domain: testCustomDomain, stage: "prod", want: "https://" + testCustomDomain},
+		{name: "execute-api domain without a stage", domain: testExecuteAPIDomain, want: "https://" + testExecuteAPIDomain},
+		{name: "no domain", stage: "prod", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := requestContextEndpoint(events.APIGatewayWebsocketProxyRequestContext{DomainName: tt.domain, Stage: tt.stage})
+			if got != tt.want {
+				t.Errorf("requestContextEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAPIGatewayEndpoint(t *testing.T) {
+	derived := "https://" + testExecuteAPIDomain + "/prod"
+	tests := []struct {
+		name    string
+		env     string
+		fromCtx string
+		want    string
+	}{
+		// API_GW_ENDPOINT wins over the request context for backward compatibility
+		{name: "environment variable", env: "env123.execute-api.eu-west-1.amazonaws.com/dev", fromCtx: derived, want: "https://env123.execute-api.eu-west-1.amazonaws.com/dev"},
+		{name: "environment variable with a scheme", env: "https://env123.execute-api.eu-west-1.amazonaws.com/dev", want: "https://env123.execute-api.eu-west-1.amazonaws.com/dev"},
+		{name: "request context", fromCtx: derived, want: derived},
+		{name: "neither", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.fromCtx != "" {
+				ctx = withAPIGatewayEndpoint(ctx, tt.fromCtx)
+			}
+			if got := resolveAPIGatewayEndpoint(ctx, &Config{APIGatewayEndpoint: tt.env}); got != tt.want {
+				t.Errorf("resolveAPIGatewayEndpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestEndpointResolution sends a request through Handler and checks where its answer is posted
+func TestEndpointResolution(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		domain  string
+		stage   string
+		wantURL string
+	}{
+		{
+			name:    "execute-api domain",
+			domain:  testExecuteAPIDomain,
+			stage:   "prod",
+			wantURL: "https://" + testExecuteAPIDomain + "/prod/@connections/conn-1",
+		},
+		{
+			name:    "custom domain",
+			domain:  testCustomDomain,
+			stage:   "prod",
+			wantURL: "https://" + testCustomDomain + "/@connections/conn-1",
+		},
+		{
+			name:    "environment variable",
+			env:     "env123.execute-api.eu-west-1.amazonaws.com/dev",
+			domain:  testExecuteAPIDomain,
+			stage:   "prod",
+			wantURL: "https://env123.execute-api.eu-west-1.amazonaws.com/dev/@connections/conn-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.APIGatewayEndpoint = tt.env })
+			h, httpClient := newEndpointHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), nil)
+			request := testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+			request.RequestContext.DomainName, request.RequestContext.Stage = tt.domain, tt.stage
+			response, err := h.Handler(context.Background(), request)
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+			}
+			if urls := httpClient.posted(); len(urls) != 1 || urls[0] != tt.wantURL {
+				t.Errorf("posted to %q, want %s", urls, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestEndpointMissing(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.APIGatewayEndpoint = "" })
+	h, httpClient := newEndpointHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), nil)
+	err := h.getConnectionPoster(context.Background(), cfg).PostToConnection(context.Background(), "conn-1", []byte("Hello"))
+	if !errors.Is(err, ErrAPIGatewayEndpointMissing) {
+		t.Errorf("PostToConnection() error = %v, want ErrAPIGatewayEndpointMissing", err)
+	}
+	if len(httpClient.posted()) != 0 {
+		t.Errorf("posted to %q without an endpoint", httpClient.posted())
+	}
+}
+
+// TestConnectionPosterPerEndpoint checks that each stage gets its own client, built once per configuration
+func TestConnectionPosterPerEndpoint(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.APIGatewayEndpoint = "" })
+	h, _ := newEndpointHandler(cfg, testsupport.NewScriptedCompleter(), nil)
+	prod := withAPIGatewayEndpoint(context.Background(), "https://"+testExecuteAPIDomain+"/prod")
+	dev := withAPIGatewayEndpoint(context.Background(), "https://"+testExecuteAPIDomain+"/dev")
+	first := h.getConnectionPoster(prod, cfg).(apiGatewayPoster)
+	if again := h.getConnectionPoster(prod, cfg).(apiGatewayPoster); again.client != first.client {
+		t.Error("getConnectionPoster() built a second client for the same endpoint")
+	}
+	if other := h.getConnectionPoster(dev, cfg).(apiGatewayPoster); other.client == first.client {
+		t.Error("getConnectionPoster() reused the client of another endpoint")
+	}
+}
+
+// TestEndpointWithoutRequestContext checks that pushes and async jobs post to the endpoint the connection was opened on
+func TestEndpointWithoutRequestContext(t *testing.T) {
+	const endpoint = "https://" + testExecuteAPIDomain + "/prod"
+	const answer = `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	t.Run("connection record", func(t *testing.T) {
+		request := events.APIGatewayWebsocketProxyRequest{RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			ConnectionID: "conn-2", DomainName: testExecuteAPIDomain, Stage: "prod",
+		}}
+		item := connectionItem(request, testStart)
+		if got := aws.StringValue(item["endpoint"].S); got != endpoint {
+			t.Errorf("recorded endpoint = %q, want %s", got, endpoint)
+		}
+	})
+	t.Run("push", func(t *testing.T) {
+		cfg := testConfig(t, func(cfg *Config) {
+			cfg.APIGatewayEndpoint = ""
+			cfg.ConnectionsTable = "connections"
+		})
+		db := newFakeDynamoDB().table("connections", "connection_id")
+		item := connectionKey("conn-2")
+		item["endpoint"] = &dynamodb.AttributeValue{S: aws.String(endpoint)}
+		db.put("connections", item)
+		h, httpClient := newEndpointHandler(cfg, testsupport.NewScriptedCompleter(), db)
+		got, err := h.Invoke(context.Background(), json.RawMessage(`{"action":"push","connection_id":"conn-2","data":"workflow done"}`))
+		if err != nil || got.(pushResponse).StatusCode != statusCodeOK {
+			t.Fatalf("Invoke() = %+v, %v, want 200", got, err)
+		}
+		if urls := httpClient.posted(); len(urls) != 1 || urls[0] != endpoint+"/@connections/conn-2" {
+			t.Errorf("posted to %q, want the recorded endpoint", urls)
+		}
+	})
+	t.Run("async job", func(t *testing.T) {
+		cfg := testConfig(t, func(cfg *Config) { cfg.APIGatewayEndpoint = "" })
+		var request Request
+		if err := json.Unmarshal([]byte(answer), &request); err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(asyncJob{ConnectionID: "conn-2", Request: request, Endpoint: endpoint})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, httpClient := newEndpointHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), nil)
+		h.handleAsyncJobs(context.Background(), cfg, sqsEvent(string(body)))
+		if urls := httpClient.posted(); len(urls) != 1 || urls[0] != endpoint+"/@connections/conn-2" {
+			t.Errorf("posted to %q, want the endpoint of the job", urls)
+		}
+	})
+}
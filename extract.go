@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	maxChoices              = 26
+	maxChoiceLength         = 16
+	maxExtractPatternLength = 256
+	// maxExtractReplyChars caps how much of a reply a request supplied pattern is run against
+	maxExtractReplyChars = 32 * 1024
+)
+
+var (
+	intPattern    = regexp.MustCompile(`\[\[(\d+)\]\]`)
+	stringPattern = regexp.MustCompile(`\[\[((\w+\s*)+)\]\]`)
+	boolPattern   = regexp.MustCompile(`(?i)\[\[\s*(yes|no|true|false|0|1)\s*\]\]`)
+	// floatPattern matches an optional sign, an integer part and an optional decimal part; exponents are not accepted
+	floatPattern = regexp.MustCompile(`\[\[\s*([+-]?\d+(?:\.\d+)?)\s*\]\]`)
+	// listPattern matches every bracketed item of a list answer like [[a]] [[b]]
+	listPattern = regexp.MustCompile(`\[\[([^\[\]]+)\]\]`)
+	// choiceValuePattern matches the labels allowed for the choices of a choice request
+	choiceValuePattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	// choicePattern matches a bracketed answer like [[B]] or a line starting with "Answer: B"
+	choicePattern = regexp.MustCompile(`(?im)\[\[\s*([a-z0-9]+)\s*\]\]|^\s*answer\s*:\s*([a-z0-9]+)\b`)
+)
+
+// extractFunc extracts the answer from an OpenAI reply, reporting false if the reply doesn't contain one
+type extractFunc func(reply string) (string, bool)
+
+// matchFirst returns an extractFunc posting the first capture group of the first match of re
+func matchFirst(re *regexp.Regexp) extractFunc {
+	return func(reply string) (string, bool) {
+		match := re.FindStringSubmatch(reply)
+		if len(match) < 2 {
+			return "", false
+		}
+		return match[1], true
+	}
+}
+
+// compileExtractPattern compiles a request supplied extraction pattern, which must have exactly one capture group
+func compileExtractPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > maxExtractPatternLength {
+		return nil, fmt.Errorf("extract_pattern is longer than %d characters", maxExtractPatternLength)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("extract_pattern doesn't compile: %v", err)
+	}
+	if re.NumSubexp() != 1 {
+		return nil, fmt.Errorf("extract_pattern must have exactly one capture group, got %d", re.NumSubexp())
+	}
+	return re, nil
+}
+
+// patternExtractor returns the extractFunc for the request's extract_pattern, or defaultPattern when none was supplied
+func patternExtractor(request Request, defaultPattern *regexp.Regexp) (extractFunc, error) {
+	if request.ExtractPattern == "" {
+		return matchFirst(defaultPattern), nil
+	}
+	re, err := compileExtractPattern(request.ExtractPattern)
+	if err != nil {
+		return nil, err
+	}
+	match := matchFirst(re)
+	return func(reply string) (string, bool) {
+		if len(reply) > maxExtractReplyChars {
+			reply = reply[:maxExtractReplyChars]
+		}
+		return match(reply)
+	}, nil
+}
+
+// extractBool finds a yes/no style answer in reply and normalises it to "true" or "false"
+func extractBool(reply string) (string, bool) {
+	answer, ok := matchFirst(boolPattern)(reply)
+	if !ok {
+		return "", false
+	}
+	switch strings.ToLower(answer) {
+	case "yes", "true", "1":
+		return "true", true
+	default:
+		return "false", true
+	}
+}
+
+// extractFloat finds the first bracketed number in reply and canonicalises it, e.g. "07.50" becomes "7.5".
+// Markdown around the brackets such as **[[7.5]]** is ignored, and when several numbers are bracketed the first one wins.
+func extractFloat(reply string) (string, bool) {
+	answer, ok := matchFirst(floatPattern)(reply)
+	if !ok {
+		return "", false
+	}
+	value, err := strconv.ParseFloat(answer, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64), true
+}
+
+// listExtractor returns an extractFunc collecting every bracketed item as a JSON array.
+// Items are trimmed and de-duplicated in order of appearance, and maxItems caps the list when positive.
+func listExtractor(maxItems int) extractFunc {
+	return func(reply string) (string, bool) {
+		var items []string
+		seen := make(map[string]bool)
+		for _, match := range listPattern.FindAllStringSubmatch(reply, -1) {
+			item := strings.TrimSpace(match[1])
+			if item == "" || seen[item] {
+				continue
+			}
+			seen[item] = true
+			items = append(items, item)
+			if maxItems > 0 && len(items) == maxItems {
+				break
+			}
+		}
+		if len(items) == 0 {
+			return "", false
+		}
+		list, err := json.Marshal(items)
+		if err != nil {
+			return "", false
+		}
+		return string(list), true
+	}
+}
+
+// checkContentFilter returns ErrContentFiltered when the answer was cut off by the OpenAI content filter,
+// since whatever is left of it can't be trusted to contain the answer, and ErrNoChoices when there is no answer
+func checkContentFilter(openAIRequest openAIRequest, response openai.ChatCompletionResponse) error {
+	if len(response.Choices) == 0 {
+		return ErrNoChoices
+	}
+	if response.Choices[0].FinishReason == openai.FinishReasonContentFilter {
+		openAIRequest.logger().Warn("OpenAI API response was stopped by the content filter", "reply", loggedPayload(openAIRequest.config, response.Choices[0].Message.Content))
+		return ErrContentFiltered
+	}
+	return nil
+}
+
+// getExtractedOpenAIResponse gets a response from OpenAI, extracts the answer with extract, and sends it to the client.
+// With n > 1 the answer is the majority vote of the choices.
+func getExtractedOpenAIResponse(ctx context.Context, openAIRequest openAIRequest, extract extractFunc) error {
+	response, err := initPrefilledRequest(ctx, openAIRequest, openAIRequest.request)
+	if err != nil {
+		return err
+	}
+	if len(response.Choices) > 1 {
+		return deliverVote(openAIRequest, response, extract)
+	}
+	answer, err := extractReply(openAIRequest, response, extract)
+	if err != nil {
+		return err
+	}
+	info, err := newCompletionInfo(response)
+	if err != nil {
+		return err
+	}
+	return deliverAnswer(openAIRequest, []byte(answer), response.Choices[0].Message.Content, info)
+}
+
+// extractReply extracts the answer from the first choice of response
+func extractReply(openAIRequest openAIRequest, response openai.ChatCompletionResponse, extract extractFunc) (string, error) {
+	if err := checkContentFilter(openAIRequest, response); err != nil {
+		return "", err
+	}
+
+	// Parse the response and extract the answer
+	reply := response.Choices[0].Message.Content
+	answer, ok := extract(reply)
+	if !ok {
+		openAIRequest.logger().Warn("Can't parse OpenAI API response", "reply", loggedPayload(openAIRequest.config, reply))
+		return "", ErrUnparsableResponse
+	}
+
+	openAIRequest.logger().Debug("Extracted answer", "answer", loggedPayload(openAIRequest.config, answer))
+	return answer, nil
+}
+
+// deliverVote sends the majority answer of the choices of response, failing like a single choice would
+// when none of them has an answer
+func deliverVote(openAIRequest openAIRequest, response openai.ChatCompletionResponse, extract extractFunc) error {
+	answer, index, ok := voteAnswer(response.Choices, extract)
+	if !ok {
+		filtered := true
+		for _, choice := range response.Choices {
+			filtered = filtered && choice.FinishReason == openai.FinishReasonContentFilter
+		}
+		if filtered {
+			openAIRequest.logger().Warn("OpenAI API response was stopped by the content filter")
+			return ErrContentFiltered
+		}
+		openAIRequest.logger().Warn("Can't parse any of the OpenAI API choices", "choices", len(response.Choices))
+		return ErrUnparsableResponse
+	}
+
+	openAIRequest.logger().Debug("Extracted answer", "answer", loggedPayload(openAIRequest.config, answer), "choice", index, "choices", len(response.Choices))
+	info, err := newCompletionInfo(response)
+	if err != nil {
+		return err
+	}
+	info.FinishReason = response.Choices[index].FinishReason
+	return deliverAnswer(openAIRequest, []byte(answer), response.Choices[index].Message.Content, info)
+}
+
+// getIntOpenAIResponse gets an integer response from OpenAI, extracts the integer, and sends it to the client
+func getIntOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	extract, err := patternExtractor(openAIRequest.request, intPattern)
+	if err != nil {
+		return err
+	}
+	if openAIRequest.request.Votes > 0 {
+		return getVotedIntResponse(ctx, openAIRequest, extract)
+	}
+	return getExtractedOpenAIResponse(ctx, openAIRequest, extract)
+}
+
+// getStringOpenAIResponse gets a string response from OpenAI, extracts the string, and sends it to the client
+func getStringOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	extract, err := patternExtractor(openAIRequest.request, stringPattern)
+	if err != nil {
+		return err
+	}
+	return getExtractedOpenAIResponse(ctx, openAIRequest, extract)
+}
+
+// getBoolOpenAIResponse gets a yes/no response from OpenAI, normalises it to "true"/"false", and sends it to the client
+func getBoolOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	return getExtractedOpenAIResponse(ctx, openAIRequest, extractBool)
+}
+
+// getFloatOpenAIResponse gets a decimal number response from OpenAI, canonicalises the number, and sends it to the client
+func getFloatOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	return getExtractedOpenAIResponse(ctx, openAIRequest, extractFloat)
+}
+
+// getListOpenAIResponse gets a response from OpenAI, collects every bracketed item, and sends them to the client as a JSON array
+func getListOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	return getExtractedOpenAIResponse(ctx, openAIRequest, listExtractor(openAIRequest.request.MaxItems))
+}
+
+// getDefaultChoices returns the choices used when the request doesn't supply any
+func getDefaultChoices() []string {
+	return []string{"A", "B", "C", "D"}
+}
+
+// validateChoices checks the allowed choices supplied in a request
+func validateChoices(choices []string) error {
+	if len(choices) > maxChoices {
+		return fmt.Errorf("choices can't have more than %d entries", maxChoices)
+	}
+	for i, choice := range choices {
+		if choice == "" || len(choice) > maxChoiceLength || !choiceValuePattern.MatchString(choice) {
+			return fmt.Errorf("choices[%d] must be 1 to %d letters or digits", i, maxChoiceLength)
+		}
+	}
+	return nil
+}
+
+// extractChoice finds the answer in reply and returns its canonical uppercase form.
+// The second value is the raw answer found, so the caller can tell a missing answer from one outside the allowed set.
+func extractChoice(reply string, choices []string) (string, string, bool) {
+	match := choicePattern.FindStringSubmatch(reply)
+	if match == nil {
+		return "", "", false
+	}
+	answer := match[1]
+	if answer == "" {
+		answer = match[2]
+	}
+	for _, choice := range choices {
+		if strings.EqualFold(answer, choice) {
+			return strings.ToUpper(choice), answer, true
+		}
+	}
+	return "", answer, false
+}
+
+// getChoiceOpenAIResponse gets a multiple-choice answer from OpenAI and sends the canonical choice to the client.
+// An answer outside the allowed set is retried once with a corrective message.
+func getChoiceOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	request := openAIRequest.request
+	choices := request.Choices
+	if len(choices) == 0 {
+		choices = getDefaultChoices()
+	}
+	// Copy the messages so the corrective turn doesn't leak into the caller's request
+	request.Messages = append([]chatMessage(nil), request.Messages...)
+	var usage openai.Usage
+
+	for attempt := 0; ; attempt++ {
+		response, err := initPrefilledRequest(ctx, openAIRequest, request)
+		if err != nil {
+			return err
+		}
+		addUsage(&usage, response.Usage)
+		if err := checkContentFilter(openAIRequest, response); err != nil {
+			return err
+		}
+
+		reply := response.Choices[0].Message.Content
+		choice, answer, ok := extractChoice(reply, choices)
+		if ok {
+			openAIRequest.logger().Debug("Extracted answer", "answer", choice)
+			info, err := newCompletionInfo(response)
+			if err != nil {
+				return err
+			}
+			info.Usage = usage
+			return deliverAnswer(openAIRequest, []byte(choice), reply, info)
+		}
+
+		openAIRequest.logger().Warn("Can't parse OpenAI API response", "attempt", attempt+1, "reply", loggedPayload(openAIRequest.config, reply))
+		if answer == "" || attempt > 0 {
+			return ErrUnparsableResponse
+		}
+
+		request.Messages = append(request.Messages,
+			chatMessage{Role: openai.ChatMessageRoleAssistant, Content: reply},
+			chatMessage{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("%s is not a valid answer. Answer with exactly one of: %s", answer, strings.Join(choices, ", "))},
+		)
+	}
+}
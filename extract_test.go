@@ -0,0 +1,403 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestExtractFloat(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		want   string
+		wantOK bool
+	}{
+		{name: "decimal", reply: "Score: [[7.5]]", want: "7.5", wantOK: true},
+		{name: "canonicalised", reply: "[[07.50]]", want: "7.5", wantOK: true},
+		{name: "integer", reply: "[[8]]", want: "8", wantOK: true},
+		{name: "negative", reply: "[[-0.25]]", want: "-0.25", wantOK: true},
+		{name: "plus sign", reply: "[[+3.0]]", want: "3", wantOK: true},
+		{name: "spaces", reply: "[[ 4.2 ]]", want: "4.2", wantOK: true},
+		{name: "markdown", reply: "The grade is **[[7.5]]**.", want: "7.5", wantOK: true},
+		{name: "first match wins", reply: "[[6.5]] or maybe [[9]]", want: "6.5", wantOK: true},
+		{name: "scientific notation", reply: "[[7.5e1]]"},
+		{name: "trailing dot", reply: "[[7.]]"},
+		{name: "words", reply: "[[seven]]"},
+		{name: "unbracketed", reply: "7.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := extractFloat(tt.reply)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("extractFloat(%q) = %q, %v, want %q, %v", tt.reply, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// testExtractorRequest runs a request of responseType answered with reply and returns its status and first frame
+func testExtractorRequest(t *testing.T, responseType string, extra string, replies ...string) (int, string, *testsupport.ScriptedCompleter) {
+	t.Helper()
+	cfg := testConfig(t, nil)
+	turns := make([]testsupport.Turn, len(replies))
+	for i, reply := range replies {
+		turns[i] = testsupport.Reply(reply)
+	}
+	chat := testsupport.NewScriptedCompleter(turns...)
+	body := `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Grade it"}]` + extra + `}`
+	response, poster := runTestRequest(t, cfg, chat, body)
+	var frame string
+	if texts := poster.Texts(); len(texts) > 0 {
+		frame = texts[0]
+	}
+	return response.StatusCode, frame, chat
+}
+
+func TestFloatResponse(t *testing.T) {
+	tests := []struct {
+		reply      string
+		wantStatus int
+		wantFrame  string
+	}{
+		{reply: "I'd say **[[07.50]]**", wantStatus: statusCodeOK, wantFrame: "7.5"},
+		{reply: "[[1e3]]", wantStatus: statusCodeBadGateway},
+	}
+	for _, tt := range tests {
+		status, frame, _ := testExtractorRequest(t, responseTypeFloat, "", tt.reply)
+		if status != tt.wantStatus || tt.wantFrame != "" && frame != tt.wantFrame {
+			t.Errorf("float answer to %q = %d %q, want %d %q", tt.reply, status, frame, tt.wantStatus, tt.wantFrame)
+		}
+	}
+}
+
+func TestExtractBool(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  string
+		want   string
+		wantOK bool
+	}{
+		{name: "yes", reply: "Abusive: [[yes]]", want: "true", wantOK: true},
+		{name: "no", reply: "[[no]]", want: "false", wantOK: true},
+		{name: "true", reply: "[[true]]", want: "true", wantOK: true},
+		{name: "false", reply: "[[false]]", want: "false", wantOK: true},
+		{name: "one", reply: "[[1]]", want: "true", wantOK: true},
+		{name: "zero", reply: "[[0]]", want: "false", wantOK: true},
+		{name: "upper case", reply: "[[YES]]", want: "true", wantOK: true},
+		{name: "mixed case", reply: "[[False]]", want: "false", wantOK: true},
+		{name: "spaces", reply: "[[ no ]]", want: "false", wantOK: true},
+		{name: "first match wins", reply: "[[no]], on reflection [[yes]]", want: "false", wantOK: true},
+		{name: "unrecognised token", reply: "[[maybe]]"},
+		{name: "other number", reply: "[[2]]"},
+		{name: "unbracketed", reply: "yes"},
+		{name: "word containing yes", reply: "[[yesterday]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := extractBool(tt.reply)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("extractBool(%q) = %q, %v, want %q, %v", tt.reply, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestBoolResponse(t *testing.T) {
+	tests := []struct {
+		reply      string
+		wantStatus int
+		wantFrame  string
+	}{
+		{reply: "The message is abusive: [[Yes]]", wantStatus: statusCodeOK, wantFrame: "true"},
+		{reply: "[[0]]", wantStatus: statusCodeOK, wantFrame: "false"},
+		{reply: "I can't tell [[maybe]]", wantStatus: statusCodeBadGateway},
+	}
+	for _, tt := range tests {
+		status, frame, _ := testExtractorRequest(t, responseTypeBool, "", tt.reply)
+		if status != tt.wantStatus || tt.wantFrame != "" && frame != tt.wantFrame {
+			t.Errorf("bool answer to %q = %d %q, want %d %q", tt.reply, status, frame, tt.wantStatus, tt.wantFrame)
+		}
+	}
+}
+
+// TestBoolParseErrorLogsReply checks that the reply without a yes/no answer is logged for debugging
+func TestBoolParseErrorLogsReply(t *testing.T) {
+	const reply = "It depends on the context [[perhaps]]"
+	logs := captureLogs(t)
+	cfg := testConfig(t, func(cfg *Config) { cfg.LogPrompts = true })
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+	body := `{"response_type":"bool","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Is it abusive?"}]}`
+	if response, _ := runTestRequest(t, cfg, chat, body); response.StatusCode != statusCodeBadGateway {
+		t.Fatalf("StatusCode = %d, want %d", response.StatusCode, statusCodeBadGateway)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, "Can't parse OpenAI API response") && strings.Contains(line, reply) {
+			return
+		}
+	}
+	t.Errorf("logs %s don't have the parse error with the reply", logs)
+}
+
+func TestListExtractor(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		maxItems int
+		want     string
+		wantOK   bool
+	}{
+		{name: "items", reply: "Buy [[milk]], [[eggs]] and [[bread]]", want: `["milk","eggs","bread"]`, wantOK: true},
+		{name: "whitespace trimmed", reply: "[[  milk ]] [[\teggs\n]]", want: `["milk","eggs"]`, wantOK: true},
+		{name: "duplicates dropped in order", reply: "[[eggs]] [[milk]] [[eggs]] [[ milk]] [[bread]]", want: `["eggs","milk","bread"]`, wantOK: true},
+		{name: "empty items skipped", reply: "[[ ]] [[milk]] [[   ]]", want: `["milk"]`, wantOK: true},
+		{name: "capped", reply: "[[a]] [[b]] [[c]] [[d]]", maxItems: 2, want: `["a","b"]`, wantOK: true},
+		{name: "duplicates don't count against the cap", reply: "[[a]] [[a]] [[b]] [[c]]", maxItems: 2, want: `["a","b"]`, wantOK: true},
+		{name: "cap above the items", reply: "[[a]] [[b]]", maxItems: 5, want: `["a","b"]`, wantOK: true},
+		{name: "no matches", reply: "Nothing to buy"},
+		{name: "only empty items", reply: "[[ ]] [[  ]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := listExtractor(tt.maxItems)(tt.reply)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("listExtractor(%d)(%q) = %q, %v, want %q, %v", tt.maxItems, tt.reply, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestListResponse(t *testing.T) {
+	tests := []struct {
+		reply      string
+		extra      string
+		wantStatus int
+		wantFrame  string
+	}{
+		{reply: "[[milk]] [[eggs]] [[milk]]", wantStatus: statusCodeOK, wantFrame: `["milk","eggs"]`},
+		{reply: "[[a]] [[b]] [[c]]", extra: `,"max_items":2`, wantStatus: statusCodeOK, wantFrame: `["a","b"]`},
+		{reply: "Nothing to buy", wantStatus: statusCodeBadGateway},
+	}
+	for _, tt := range tests {
+		status, frame, _ := testExtractorRequest(t, responseTypeList, tt.extra, tt.reply)
+		if status != tt.wantStatus || tt.wantFrame != "" && frame != tt.wantFrame {
+			t.Errorf("list answer to %q = %d %q, want %d %q", tt.reply, status, frame, tt.wantStatus, tt.wantFrame)
+		}
+	}
+}
+
+// TestListParseErrorLogsReply checks that the reply without bracketed items is logged for debugging
+func TestListParseErrorLogsReply(t *testing.T) {
+	const reply = "I would rather not make a list [[ ]]"
+	logs := captureLogs(t)
+	cfg := testConfig(t, func(cfg *Config) { cfg.LogPrompts = true })
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+	body := `{"response_type":"list","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"What should I buy?"}]}`
+	if response, _ := runTestRequest(t, cfg, chat, body); response.StatusCode != statusCodeBadGateway {
+		t.Fatalf("StatusCode = %d, want %d", response.StatusCode, statusCodeBadGateway)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, "Can't parse OpenAI API response") && strings.Contains(line, reply) {
+			return
+		}
+	}
+	t.Errorf("logs %s don't have the parse error with the reply", logs)
+}
+
+func TestExtractChoice(t *testing.T) {
+	tests := []struct {
+		name       string
+		reply      string
+		choices    []string
+		want       string
+		wantAnswer string
+		wantOK     bool
+	}{
+		{name: "bracketed", reply: "[[B]]", choices: getDefaultChoices(), want: "B", wantAnswer: "B", wantOK: true},
+		{name: "lowercase", reply: "[[c]]", choices: getDefaultChoices(), want: "C", wantAnswer: "c", wantOK: true},
+		{name: "in a sentence", reply: "I think the right one is [[ d ]] because of the date.", choices: getDefaultChoices(), want: "D", wantAnswer: "d", wantOK: true},
+		{name: "answer line", reply: "Let me think.\nanswer: a\nThat's it.", choices: getDefaultChoices(), want: "A", wantAnswer: "a", wantOK: true},
+		{name: "custom choices", reply: "[[yes]]", choices: []string{"YES", "NO"}, want: "YES", wantAnswer: "yes", wantOK: true},
+		{name: "out of set", reply: "[[E]]", choices: getDefaultChoices(), wantAnswer: "E"},
+		{name: "no answer", reply: "I don't know", choices: getDefaultChoices()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, answer, ok := extractChoice(tt.reply, tt.choices)
+			if got != tt.want || answer != tt.wantAnswer || ok != tt.wantOK {
+				t.Fatalf("extractChoice(%q) = %q, %q, %v, want %q, %q, %v", tt.reply, got, answer, ok, tt.want, tt.wantAnswer, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestValidateChoices(t *testing.T) {
+	tests := []struct {
+		choices []string
+		wantErr bool
+	}{
+		{choices: []string{"A", "B"}},
+		{choices: []string{"yes", "no", "42"}},
+		{choices: []string{""}, wantErr: true},
+		{choices: []string{"A B"}, wantErr: true},
+		{choices: []string{strings.Repeat("A", maxChoiceLength+1)}, wantErr: true},
+		{choices: make([]string, maxChoices+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateChoices(tt.choices); (err != nil) != tt.wantErr {
+			t.Errorf("validateChoices(%q) error = %v, want error %v", tt.choices, err, tt.wantErr)
+		}
+	}
+}
+
+func TestChoiceResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		replies      []string
+		extra        string
+		wantStatus   int
+		wantFrame    string
+		wantRequests int
+	}{
+		{name: "first answer", replies: []string{"It is [[b]]."}, wantStatus: statusCodeOK, wantFrame: "B", wantRequests: 1},
+		{name: "corrected", replies: []string{"[[E]]", "Sorry, [[A]]"}, wantStatus: statusCodeOK, wantFrame: "A", wantRequests: 2},
+		{name: "out of set twice", replies: []string{"[[E]]", "[[F]]"}, wantStatus: statusCodeBadGateway, wantRequests: 2},
+		{name: "no answer is not retried", replies: []string{"No idea"}, wantStatus: statusCodeBadGateway, wantRequests: 1},
+		{name: "custom choices", replies: []string{"Answer: no"}, extra: `,"choices":["yes","no"]`, wantStatus: statusCodeOK, wantFrame: "NO", wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, frame, chat := testExtractorRequest(t, responseTypeChoice, tt.extra, tt.replies...)
+			if status != tt.wantStatus || tt.wantFrame != "" && frame != tt.wantFrame {
+				t.Fatalf("choice answer = %d %q, want %d %q", status, frame, tt.wantStatus, tt.wantFrame)
+			}
+			requests := chat.Requests()
+			if len(requests) != tt.wantRequests {
+				t.Fatalf("%d requests, want %d", len(requests), tt.wantRequests)
+			}
+			if len(requests) == 2 {
+				last := requests[1].Messages[len(requests[1].Messages)-1].Content
+				if !strings.Contains(last, "is not a valid answer. Answer with exactly one of: A, B, C, D") {
+					t.Fatalf("corrective message = %q", last)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileExtractPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		wantErr string
+	}{
+		{name: "answer tags", pattern: `<answer>(.+?)</answer>`},
+		{name: "non-capturing groups", pattern: `(?:score|grade)=(\d+)`},
+		{name: "at the length cap", pattern: "(a)" + strings.Repeat("b", maxExtractPatternLength-3)},
+		{name: "over the length cap", pattern: "(a)" + strings.Repeat("b", maxExtractPatternLength-2), wantErr: "longer than"},
+		{name: "doesn't compile", pattern: `<answer>(.+</answer>`, wantErr: "doesn't compile"},
+		{name: "no group", pattern: `\d+`, wantErr: "exactly one capture group, got 0"},
+		{name: "two groups", pattern: `(\w+)=(\d+)`, wantErr: "exactly one capture group, got 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileExtractPattern(tt.pattern)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("compileExtractPattern() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("compileExtractPattern() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPatternExtractor(t *testing.T) {
+	// An answer past the first maxExtractReplyChars of the reply isn't searched by a custom pattern
+	late := strings.Repeat(" ", maxExtractReplyChars) + "<answer>42</answer>"
+	tests := []struct {
+		name    string
+		pattern string
+		reply   string
+		want    string
+		wantOK  bool
+	}{
+		{name: "default pattern", reply: "[[42]]", want: "42", wantOK: true},
+		{name: "custom pattern", pattern: `<answer>(\d+)</answer>`, reply: "<answer>42</answer> [[7]]", want: "42", wantOK: true},
+		{name: "custom pattern ignores brackets", pattern: `<answer>(\d+)</answer>`, reply: "[[7]]"},
+		{name: "default pattern on a long reply", reply: strings.Repeat(" ", maxExtractReplyChars) + "[[42]]", want: "42", wantOK: true},
+		{name: "custom pattern on a long reply", pattern: `<answer>(\d+)</answer>`, reply: late},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extract, err := patternExtractor(Request{ExtractPattern: tt.pattern}, intPattern)
+			if err != nil {
+				t.Fatalf("patternExtractor() error = %v", err)
+			}
+			got, ok := extract(tt.reply)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("extract() = %q, %v, want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestExtractPatternValidation checks that invalid patterns are rejected before OpenAI is called
+func TestExtractPatternValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		pattern      string
+	}{
+		{name: "doesn't compile", responseType: responseTypeInt, pattern: `(\\d+`},
+		{name: "two groups", responseType: responseTypeString, pattern: `(\\w+) (\\w+)`},
+		{name: "too long", responseType: responseTypeInt, pattern: "(a)" + strings.Repeat("b", maxExtractPatternLength)},
+		{name: "unsupported response type", responseType: responseTypeFloat, pattern: `(\\d+)`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _, chat := testExtractorRequest(t, tt.responseType, `,"extract_pattern":"`+tt.pattern+`"`, "[[1]]")
+			if status != statusCodeBadRequest {
+				t.Errorf("status = %d, want %d", status, statusCodeBadRequest)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the invalid request reached OpenAI")
+			}
+		})
+	}
+}
+
+func TestIntAndStringResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		extra        string
+		reply        string
+		wantStatus   int
+		wantFrame    string
+	}{
+		{name: "int", responseType: responseTypeInt, reply: "The answer is [[42]].", wantStatus: statusCodeOK, wantFrame: "42"},
+		{name: "first int", responseType: responseTypeInt, reply: "[[7]] or maybe [[8]]", wantStatus: statusCodeOK, wantFrame: "7"},
+		{name: "negative int", responseType: responseTypeInt, reply: "[[-3]]", wantStatus: statusCodeBadGateway},
+		{name: "unbracketed int", responseType: responseTypeInt, reply: "42", wantStatus: statusCodeBadGateway},
+		{name: "string", responseType: responseTypeString, reply: "Colour: [[blue]]", wantStatus: statusCodeOK, wantFrame: "blue"},
+		{name: "string of words", responseType: responseTypeString, reply: "[[deep blue sea]]", wantStatus: statusCodeOK, wantFrame: "deep blue sea"},
+		{name: "punctuated string", responseType: responseTypeString, reply: "[[blue!]]", wantStatus: statusCodeBadGateway},
+		{name: "custom pattern", responseType: responseTypeInt, extra: `,"extract_pattern":"score=(\\d+)"`, reply: "score=9 [[3]]", wantStatus: statusCodeOK, wantFrame: "9"},
+		{name: "custom pattern without a group", responseType: responseTypeString, extra: `,"extract_pattern":"\\w+"`, reply: "[[blue]]", wantStatus: statusCodeBadRequest},
+		{name: "answer tags", responseType: responseTypeString, extra: `,"extract_pattern":"<answer>(.+?)</answer>"`, reply: "<answer>deep blue</answer>", wantStatus: statusCodeOK, wantFrame: "deep blue"},
+		{name: "custom pattern not matching", responseType: responseTypeInt, extra: `,"extract_pattern":"<answer>(\\d+)</answer>"`, reply: "[[3]]", wantStatus: statusCodeBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, frame, _ := testExtractorRequest(t, tt.responseType, tt.extra, tt.reply)
+			if status != tt.wantStatus || tt.wantFrame != "" && frame != tt.wantFrame {
+				t.Errorf("%s answer to %q = %d %q, want %d %q", tt.responseType, tt.reply, status, frame, tt.wantStatus, tt.wantFrame)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultMaxParallelPrompts = 3
+	// maxPromptTemplates caps the templates of one request, each costing a completion
+	maxPromptTemplates = 10
+)
+
+// promptResult is the outcome of one template of a prompt_templates request, posted under the template name
+type promptResult struct {
+	Answer any    `json:"answer,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// runBounded calls run for every index from 0 to count-1, at most limit at a time, and waits for all of them.
+// Calls that haven't started when ctx is done are skipped, with ctx.Err() reported for them.
+func runBounded(ctx context.Context, count int, limit int, run func(i int) error) []error {
+	errs := make([]error, count)
+	semaphore := make(chan struct{}, max(limit, 1))
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			errs[i] = run(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// mergeConcurrentMetrics adds the metrics of completions that ran concurrently for one request to its metrics.
+// The latency and the dropped messages are the ones of the slowest call, and cache lookups add up.
+func mergeConcurrentMetrics(metrics *requestMetrics, parts []*requestMetrics) {
+	if metrics == nil {
+		return
+	}
+	var latency time.Duration
+	dropped := 0
+	for _, part := range parts {
+		if part == nil {
+			continue
+		}
+		latency = max(latency, part.openAILatency)
+		dropped = max(dropped, part.droppedMessages)
+		metrics.cacheHits += part.cacheHits
+		metrics.cacheMisses += part.cacheMisses
+	}
+	metrics.addOpenAILatency(latency)
+	metrics.addDroppedMessages(dropped)
+}
+
+// checkPromptTemplates checks the templates of a prompt_templates request and the features it can be combined with
+func checkPromptTemplates(cfg *Config, request Request) error {
+	if request.PromptTemplate != "" || request.SystemPrompt != "" {
+		return fmt.Errorf("prompt_templates can't be combined with prompt_template or system_prompt")
+	}
+	if len(request.PromptTemplates) > maxPromptTemplates {
+		return fmt.Errorf("prompt_templates has %d entries, at most %d are allowed", len(request.PromptTemplates), maxPromptTemplates)
+	}
+	seen := make(map[string]bool, len(request.PromptTemplates))
+	for i, name := range request.PromptTemplates {
+		if err := checkPromptTemplateName(cfg, name); err != nil {
+			return fmt.Errorf("prompt_templates[%d]: %v", i, err)
+		}
+		if seen[name] {
+			return fmt.Errorf("prompt_templates[%d] repeats %s", i, name)
+		}
+		seen[name] = true
+	}
+	switch request.ResponseType {
+	case responseTypeInt, responseTypeString, responseTypeJSON:
+	default:
+		return fmt.Errorf("prompt_templates is not supported for the %s response type", request.ResponseType)
+	}
+	switch {
+	case request.Votes > 0:
+		return fmt.Errorf("prompt_templates can't be combined with votes")
+	case request.N > 1:
+		return fmt.Errorf("prompt_templates can't be combined with n")
+	case request.ConversationID != "":
+		return fmt.Errorf("prompt_templates can't be combined with conversation_id")
+	}
+	return nil
+}
+
+// getMultiPromptResponse runs every template of prompt_templates against the messages of the request, at most
+// MAX_PARALLEL_PROMPTS at a time, and posts one JSON object of the results keyed by template name. A failing
+// template is reported by its error in the object, only when every template fails the request fails.
+func getMultiPromptResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	templates := openAIRequest.request.PromptTemplates
+	results := make([]promptResult, len(templates))
+	replies := make([]string, len(templates))
+	infos := make([]completionInfo, len(templates))
+	metrics := make([]*requestMetrics, len(templates))
+
+	errs := runBounded(ctx, len(templates), openAIRequest.config.MaxParallelPrompts, func(i int) error {
+		// Every call records into its own metrics, merged below, as requestMetrics isn't safe for concurrent use
+		sub := openAIRequest
+		sub.metrics = newRequestMetrics(openAIRequest.getClock())
+		metrics[i] = sub.metrics
+		sub.ctx = withLogger(openAIRequest.ctx, loggerFrom(openAIRequest.ctx).With("prompt_template", templates[i]))
+		sub.request.PromptTemplate = templates[i]
+		sub.request.PromptTemplates = nil
+		sub.request = withPromptProfile(sub.config, sub.request)
+
+		var err error
+		replies[i], infos[i], err = runPromptTemplate(withLogger(ctx, sub.logger()), sub)
+		if err != nil {
+			return err
+		}
+		results[i].Answer = replies[i]
+		if sub.request.ResponseType == responseTypeJSON {
+			results[i].Answer = json.RawMessage(replies[i])
+		}
+		return nil
+	})
+	mergeConcurrentMetrics(openAIRequest.metrics, metrics)
+
+	var info completionInfo
+	succeeded := 0
+	output := make(map[string]promptResult, len(templates))
+	for i, name := range templates {
+		addUsage(&info.Usage, infos[i].Usage)
+		if errs[i] != nil {
+			openAIRequest.logger().Warn("Prompt template failed", "prompt_template", name, "error", errs[i])
+			results[i] = promptResult{Error: errs[i].Error(), Code: errorCode(errs[i])}
+		} else {
+			succeeded++
+			if info.Model == "" {
+				info.Model = infos[i].Model
+			}
+		}
+		output[name] = results[i]
+	}
+	if succeeded == 0 {
+		return errs[0]
+	}
+	info.FinishReason = openai.FinishReasonStop
+
+	data, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("Can't encode prompt template results: %v", err)
+	}
+	return deliverAnswer(openAIRequest, data, strings.Join(replies, "\n\n"), info)
+}
+
+// runPromptTemplate returns the answer of one template of a prompt_templates request, which names the template
+// in prompt_template
+func runPromptTemplate(ctx context.Context, openAIRequest openAIRequest) (string, completionInfo, error) {
+	request := openAIRequest.request
+	if request.ResponseType == responseTypeJSON {
+		return generateJSON(ctx, openAIRequest, request)
+	}
+	pattern := intPattern
+	if request.ResponseType == responseTypeString {
+		pattern = stringPattern
+	}
+	extract, err := patternExtractor(request, pattern)
+	if err != nil {
+		return "", completionInfo{}, err
+	}
+	response, err := initPrefilledRequest(ctx, openAIRequest, request)
+	if err != nil {
+		return "", completionInfo{}, err
+	}
+	answer, err := extractReply(openAIRequest, response, extract)
+	if err != nil {
+		return "", completionInfo{}, err
+	}
+	info, err := newCompletionInfo(response)
+	return answer, info, err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// templateAnswer is how templateCompleter answers the requests of one system prompt
+type templateAnswer struct {
+	delay time.Duration
+	reply string
+	err   error
+}
+
+// templateCompleter answers chat completions by their system prompt, whatever order the concurrent calls of a
+// prompt_templates request arrive in
+type templateCompleter struct {
+	*testsupport.ScriptedCompleter
+	answers map[string]templateAnswer
+}
+
+func (c templateCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	answer, ok := c.answers[request.Messages[0].Content]
+	if !ok {
+		return openai.ChatCompletionResponse{}, errors.New("unexpected system prompt " + request.Messages[0].Content)
+	}
+	time.Sleep(answer.delay)
+	if answer.err != nil {
+		return openai.ChatCompletionResponse{}, answer.err
+	}
+	response := testsupport.Reply(answer.reply).Response
+	response.Model = request.Model
+	return response, nil
+}
+
+func TestRunBounded(t *testing.T) {
+	var running, peak atomic.Int32
+	errs := runBounded(context.Background(), 6, 2, func(i int) error {
+		now := running.Add(1)
+		defer running.Add(-1)
+		for {
+			seen := peak.Load()
+			if now <= seen || peak.CompareAndSwap(seen, now) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		if i%3 == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if got := peak.Load(); got != 2 {
+		t.Errorf("peak concurrency = %d, want 2", got)
+	}
+	for i, err := range errs {
+		if (err != nil) != (i%3 == 0) {
+			t.Errorf("errs[%d] = %v", i, err)
+		}
+	}
+
+	// The first call cancels while it holds the only slot, so the waiting calls are skipped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var calls atomic.Int32
+	canceled := 0
+	for _, err := range runBounded(ctx, 3, 1, func(i int) error {
+		calls.Add(1)
+		cancel()
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}) {
+		if errors.Is(err, context.Canceled) {
+			canceled++
+		}
+	}
+	if calls.Load() != 1 || canceled != 2 {
+		t.Errorf("runBounded() ran %d calls and skipped %d after the context was canceled, want 1 and 2", calls.Load(), canceled)
+	}
+}
+
+func TestCheckPromptTemplates(t *testing.T) {
+	cfg := &Config{PromptEnvPrefix: "PROMPT_"}
+	many := make([]string, maxPromptTemplates+1)
+	for i := range many {
+		many[i] = "PROMPT_" + strings.Repeat("A", i+1)
+	}
+	tests := []struct {
+		name    string
+		request Request
+		wantErr string
+	}{
+		{name: "int", request: Request{ResponseType: responseTypeInt, PromptTemplates: []string{"PROMPT_CLARITY", "PROMPT_TONE"}}},
+		{name: "json", request: Request{ResponseType: responseTypeJSON, PromptTemplates: []string{"PROMPT_CLARITY"}}},
+		{name: "with prompt_template", request: Request{ResponseType: responseTypeInt, PromptTemplate: "PROMPT_TONE", PromptTemplates: []string{"PROMPT_CLARITY"}}, wantErr: "can't be combined with prompt_template"},
+		{name: "too many", request: Request{ResponseType: responseTypeInt, PromptTemplates: many}, wantErr: "prompt_templates has 11 entries, at most 10 are allowed"},
+		{name: "invalid name", request: Request{ResponseType: responseTypeInt, PromptTemplates: []string{"PROMPT_CLARITY", "prompt_tone"}}, wantErr: "prompt_templates[1]: prompt_template may only contain"},
+		{name: "repeated", request: Request{ResponseType: responseTypeInt, PromptTemplates: []string{"PROMPT_TONE", "PROMPT_TONE"}}, wantErr: "prompt_templates[1] repeats PROMPT_TONE"},
+		{name: "stream", request: Request{ResponseType: responseTypeStream, PromptTemplates: []string{"PROMPT_TONE"}}, wantErr: "not supported for the stream response type"},
+		{name: "votes", request: Request{ResponseType: responseTypeInt, Votes: 3, PromptTemplates: []string{"PROMPT_TONE"}}, wantErr: "can't be combined with votes"},
+		{name: "n", request: Request{ResponseType: responseTypeInt, N: 2, PromptTemplates: []string{"PROMPT_TONE"}}, wantErr: "can't be combined with n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPromptTemplates(cfg, tt.request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("checkPromptTemplates() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMultiPromptRequests(t *testing.T) {
+	rubrics := map[string]string{"PROMPT_CLARITY": "Rate the clarity.", "PROMPT_ACCURACY": "Rate the accuracy.", "PROMPT_TONE": "Rate the tone."}
+	tests := []struct {
+		name         string
+		responseType string
+		templates    []string
+		answers      map[string]templateAnswer
+		wantStatus   int
+		want         map[string]promptResult
+	}{
+		{
+			// The first template answers last, the results are keyed by template all the same
+			name:         "all answered",
+			responseType: responseTypeInt,
+			templates:    []string{"PROMPT_CLARITY", "PROMPT_ACCURACY", "PROMPT_TONE"},
+			answers: map[string]templateAnswer{
+				"Rate the clarity.":  {delay: 20 * time.Millisecond, reply: "[[4]]"},
+				"Rate the accuracy.": {reply: "[[2]]"},
+				"Rate the tone.":     {delay: 10 * time.Millisecond, reply: "[[5]]"},
+			},
+			wantStatus: statusCodeOK,
+			want:       map[string]promptResult{"PROMPT_CLARITY": {Answer: "4"}, "PROMPT_ACCURACY": {Answer: "2"}, "PROMPT_TONE": {Answer: "5"}},
+		},
+		{
+			name:         "other order",
+			responseType: responseTypeInt,
+			templates:    []string{"PROMPT_TONE", "PROMPT_CLARITY", "PROMPT_ACCURACY"},
+			answers: map[string]templateAnswer{
+				"Rate the clarity.":  {reply: "[[4]]"},
+				"Rate the accuracy.": {delay: 20 * time.Millisecond, reply: "[[2]]"},
+				"Rate the tone.":     {reply: "[[5]]"},
+			},
+			wantStatus: statusCodeOK,
+			want:       map[string]promptResult{"PROMPT_CLARITY": {Answer: "4"}, "PROMPT_ACCURACY": {Answer: "2"}, "PROMPT_TONE": {Answer: "5"}},
+		},
+		{
+			name:         "partial failure",
+			responseType: responseTypeInt,
+			templates:    []string{"PROMPT_CLARITY", "PROMPT_ACCURACY", "PROMPT_TONE"},
+			answers: map[string]templateAnswer{
+				"Rate the clarity.":  {reply: "[[4]]"},
+				"Rate the accuracy.": {reply: "I can't rate this"},
+				"Rate the tone.":     {err: &openai.APIError{HTTPStatusCode: 400, Message: "bad request"}},
+			},
+			wantStatus: statusCodeOK,
+			want: map[string]promptResult{
+				"PROMPT_CLARITY":  {Answer: "4"},
+				"PROMPT_ACCURACY": {Error: ErrUnparsableResponse.Error(), Code: errorCodeParse},
+				"PROMPT_TONE":     {Code: errorCodeOpenAI},
+			},
+		},
+		{
+			name:         "json",
+			responseType: responseTypeJSON,
+			templates:    []string{"PROMPT_CLARITY", "PROMPT_TONE"},
+			answers: map[string]templateAnswer{
+				"Rate the clarity.": {reply: `{"score":4}`},
+				"Rate the tone.":    {reply: `{"score":5}`},
+			},
+			wantStatus: statusCodeOK,
+			want:       map[string]promptResult{"PROMPT_CLARITY": {Answer: map[string]any{"score": float64(4)}}, "PROMPT_TONE": {Answer: map[string]any{"score": float64(5)}}},
+		},
+		{
+			name:         "all fail",
+			responseType: responseTypeInt,
+			templates:    []string{"PROMPT_CLARITY", "PROMPT_TONE"},
+			answers: map[string]templateAnswer{
+				"Rate the clarity.": {reply: "no idea"},
+				"Rate the tone.":    {reply: "no idea"},
+			},
+			wantStatus: statusCodeBadGateway,
+		},
+		{name: "stream", responseType: responseTypeStream, templates: []string{"PROMPT_CLARITY"}, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, prompt := range rubrics {
+				t.Setenv(name, prompt)
+			}
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.MaxParallelPrompts = defaultMaxParallelPrompts
+				cfg.OpenAIMaxRetries = 0
+				cfg.OpenAIJSONRetries = 0
+			})
+			chat := templateCompleter{ScriptedCompleter: testsupport.NewScriptedCompleter(), answers: tt.answers}
+			templates, _ := json.Marshal(tt.templates)
+			body := `{"response_type":"` + tt.responseType + `","prompt_templates":` + string(templates) + `,"messages":[{"role":"user","content":"My essay"}]}`
+			poster := testsupport.NewRecordingPoster()
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if tt.want == nil {
+				return
+			}
+			texts := poster.Texts()
+			if len(texts) != 1 {
+				t.Fatalf("frames = %q, want one object", texts)
+			}
+			var got map[string]promptResult
+			if err := json.Unmarshal([]byte(texts[0]), &got); err != nil {
+				t.Fatalf("frame %s: %v", texts[0], err)
+			}
+			// OpenAI error messages carry the status, only their code is compared
+			for name, result := range got {
+				if tt.want[name].Code == errorCodeOpenAI && tt.want[name].Error == "" && result.Error != "" {
+					result.Error = ""
+					got[name] = result
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("results = %s, want %+v", texts[0], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
+
+const (
+	filterPIIEmail  = "pii_email"
+	filterPIIPhone  = "pii_phone"
+	filterPIICard   = "pii_card"
+	filterProfanity = "profanity"
+	redactedText    = "[REDACTED]"
+)
+
+// outputFilterPatterns are the redaction patterns of OUTPUT_FILTERS. Card numbers are 13 to 19 digits, possibly
+// grouped by spaces or dashes, and phone numbers have ten digits after an optional country code, so a card
+// number is never taken for a phone number.
+var outputFilterPatterns = map[string]*regexp.Regexp{
+	filterPIIEmail:  regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+	filterPIIPhone:  regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{3}\)|\b\d{3})[ .-]?\d{3}[ .-]?\d{4}\b`),
+	filterPIICard:   regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+	filterProfanity: regexp.MustCompile(`(?i)\b(?:motherfuck|fuck|shit|bullshit|bitch|bastard|asshole|cunt|dickhead|wanker)(?:s|es|ed|er|ers|ing|y)?\b`),
+}
+
+// outputFilterOrder is the order the filters run in, cards before phone numbers so a card isn't redacted in parts
+var outputFilterOrder = []string{filterPIICard, filterPIIEmail, filterPIIPhone, filterProfanity}
+
+// parseOutputFilters checks the filter names of OUTPUT_FILTERS
+func parseOutputFilters(names []string) ([]string, error) {
+	for _, name := range names {
+		if _, ok := outputFilterPatterns[name]; !ok {
+			return nil, fmt.Errorf("Invalid value for environment variable OUTPUT_FILTERS, unknown filter: %s", name)
+		}
+	}
+	return names, nil
+}
+
+// outputFilterStages returns a redaction stage for every filter of OUTPUT_FILTERS, in outputFilterOrder
+func outputFilterStages(cfg *Config) outputPipeline {
+	var stages outputPipeline
+	for _, name := range outputFilterOrder {
+		if !slices.Contains(cfg.OutputFilters, name) {
+			continue
+		}
+		pattern := outputFilterPatterns[name]
+		stages = append(stages, func(text string) string { return pattern.ReplaceAllString(text, redactedText) })
+	}
+	return stages
+}
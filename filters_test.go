@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// TestOutputFilters runs every filter on its own, over matches and over text that must be left alone
+func TestOutputFilters(t *testing.T) {
+	tests := []struct {
+		filter string
+		text   string
+		want   string
+	}{
+		{filter: filterPIIEmail, text: "Write to jane.doe+tag@mail.example.co.uk today", want: "Write to [REDACTED] today"},
+		{filter: filterPIIEmail, text: "a@b.io and c_d@e-f.com", want: "[REDACTED] and [REDACTED]"},
+		{filter: filterPIIEmail, text: "Mention @support or user@localhost", want: "Mention @support or user@localhost"},
+		{filter: filterPIIPhone, text: "Call 555-123-4567 now", want: "Call [REDACTED] now"},
+		{filter: filterPIIPhone, text: "Call (555) 123-4567 or 555.123.4567", want: "Call [REDACTED] or [REDACTED]"},
+		{filter: filterPIIPhone, text: "Call +44 555 123 4567", want: "Call [REDACTED]"},
+		{filter: filterPIIPhone, text: "Order 12345 of 2024-05-01, version 1.2.3", want: "Order 12345 of 2024-05-01, version 1.2.3"},
+		{filter: filterPIICard, text: "Card 4111 1111 1111 1111 expires", want: "Card [REDACTED] expires"},
+		{filter: filterPIICard, text: "Card 4111-1111-1111-1111 or 378282246310005", want: "Card [REDACTED] or [REDACTED]"},
+		{filter: filterPIICard, text: "Order 123456789012 and 2024-05-01", want: "Order 123456789012 and 2024-05-01"},
+		{filter: filterProfanity, text: "Shit happens, fucking bastards", want: "[REDACTED] happens, [REDACTED] [REDACTED]"},
+		{filter: filterProfanity, text: "Scunthorpe is a classic passage", want: "Scunthorpe is a classic passage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			stages := outputFilterStages(&Config{OutputFilters: []string{tt.filter}})
+			if got := stages.apply(tt.text); got != tt.want {
+				t.Errorf("%s(%q) = %q, want %q", tt.filter, tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOutputFilterOrder checks that a card number is redacted whole rather than as a phone number and digits
+func TestOutputFilterOrder(t *testing.T) {
+	cfg := &Config{OutputFilters: []string{filterPIIPhone, filterPIICard}}
+	if got := outputFilterStages(cfg).apply("Card 4111 1111 1111 1111, phone 555-123-4567"); got != "Card [REDACTED], phone [REDACTED]" {
+		t.Errorf("filters = %q, want the card and the phone number redacted", got)
+	}
+	if stages := outputFilterStages(&Config{}); len(stages) != 0 {
+		t.Errorf("%d stages without OUTPUT_FILTERS, want none", len(stages))
+	}
+}
+
+func TestStreamBatcherWholeLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		deltas   []string
+		final    bool
+		wantDue  bool
+		wantText string
+	}{
+		{name: "no line yet", deltas: []string{"Call 555-123-"}},
+		{name: "line ended", deltas: []string{"Call 555-123-", "4567.\nBye"}, wantDue: true, wantText: "Call 555-123-4567.\n"},
+		{name: "end of the stream", deltas: []string{"Call 555-123-", "4567"}, final: true, wantText: "Call 555-123-4567"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newStreamBatcher(&Config{}, granularityToken, testStart)
+			b.wholeLines = true
+			for _, delta := range tt.deltas {
+				b.add(delta)
+			}
+			if got := b.due(testStart.Add(time.Second)); got != tt.wantDue {
+				t.Fatalf("due() = %v, want %v", got, tt.wantDue)
+			}
+			if !tt.wantDue && !tt.final {
+				return
+			}
+			if got := b.take(testStart.Add(time.Second), tt.final); got != tt.wantText {
+				t.Errorf("take() = %q, want %q", got, tt.wantText)
+			}
+		})
+	}
+}
+
+// TestOutputFiltersRedactAnswers checks the redaction of full answers and of streams splitting a phone number
+// over two deltas
+func TestOutputFiltersRedactAnswers(t *testing.T) {
+	chunks := testsupport.TextChunks(0, "Call 555-123-", "4567 today.\nOr mail ", "jane@example.com")
+	tests := []struct {
+		name         string
+		responseType string
+		filters      []string
+		raw          bool
+		wantFrames   []string
+	}{
+		{name: "full", responseType: responseTypeFull, filters: []string{filterPIIPhone, filterPIIEmail}, wantFrames: []string{"Call [REDACTED] today.\nOr mail [REDACTED]"}},
+		{name: "stream", responseType: responseTypeStream, filters: []string{filterPIIPhone, filterPIIEmail}, wantFrames: []string{"Call [REDACTED] today.\n", "Or mail [REDACTED]", "<END>"}},
+		// Without filters every delta is posted on its own, the phone number in two parts
+		{name: "stream without filters", responseType: responseTypeStream, wantFrames: []string{"Call 555-123-", "4567 today.\nOr mail ", "jane@example.com", "<END>"}},
+		{name: "raw output", responseType: responseTypeFull, filters: []string{filterPIIPhone}, raw: true, wantFrames: []string{"Call 555-123-4567 today.\nOr mail jane@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OutputFilters = tt.filters
+				cfg.DebugRawAllowed = true
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval = 0
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(chunks...))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]`
+			if tt.raw {
+				body += `,"raw_output":true`
+			}
+			response, poster := runTestRequest(t, cfg, chat, body+"}")
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestOutputFiltersOfJSONAnswers(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.OutputFilters = []string{filterPIIEmail} })
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply(`{"contact":"jane@example.com","id":"a@b.io"}`))
+	response, poster := runTestRequest(t, cfg, chat, `{"response_type":"json","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+	want := []string{`{"contact":"[REDACTED]","id":"[REDACTED]"}`}
+	if response.StatusCode != statusCodeOK || !reflect.DeepEqual(poster.Texts(), want) {
+		t.Errorf("Handler() = %d %s, frames %q, want %q", response.StatusCode, response.Body, poster.Texts(), want)
+	}
+}
+
+func TestLoadConfigOutputFilters(t *testing.T) {
+	t.Setenv("OUTPUT_FILTERS", "pii_email, profanity")
+	cfg, err := loadConfig()
+	if err != nil || !reflect.DeepEqual(cfg.OutputFilters, []string{filterPIIEmail, filterProfanity}) {
+		t.Fatalf("loadConfig() = %q, %v, want pii_email and profanity", cfg.OutputFilters, err)
+	}
+	t.Setenv("OUTPUT_FILTERS", "pii_email,pii_ssn")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted the unknown filter pii_ssn")
+	}
+	t.Setenv("OUTPUT_FILTERS", "")
+	if cfg, err = loadConfig(); err != nil || len(cfg.OutputFilters) != 0 {
+		t.Errorf("loadConfig() = %q, %v, want no filters", cfg.OutputFilters, err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStreamFlushInterval = 150 * time.Millisecond
+	defaultStreamFlushBytes    = 4096
+	// maxStreamFlushBytes keeps a flushed batch small enough for one v2 envelope
+	maxStreamFlushBytes = maxFrameBytes / 2
+	// Defaults of the floor and ceiling of STREAM_FLUSH_ADAPTIVE, the ceiling of the size is maxStreamFlushBytes
+	defaultFlushMinInterval = 50 * time.Millisecond
+	defaultFlushMaxInterval = time.Second
+	defaultFlushMinBytes    = 512
+	// flushEWMAAlpha is the weight of the newest latency sample in the moving average
+	flushEWMAAlpha = 0.2
+	// flushMinSamples is the number of latency samples required before the controller adjusts anything
+	flushMinSamples = 5
+	// flushLatencyFactor is how many post latencies fit into one flush interval
+	flushLatencyFactor = 4
+	// flushDeadband is the relative difference to the current interval ignored to avoid oscillation
+	flushDeadband = 0.2
+)
+
+// getAdaptiveFlushBounds reads the floor and ceiling used by STREAM_FLUSH_ADAPTIVE from the environment
+func getAdaptiveFlushBounds() (flushBounds, error) {
+	minInterval, err := getEnvInt("STREAM_FLUSH_MIN_INTERVAL_MS", int(defaultFlushMinInterval/time.Millisecond))
+	if err != nil {
+		return flushBounds{}, err
+	}
+	maxInterval, err := getEnvInt("STREAM_FLUSH_MAX_INTERVAL_MS", int(defaultFlushMaxInterval/time.Millisecond))
+	if err != nil {
+		return flushBounds{}, err
+	}
+	minBytes, err := getEnvInt("STREAM_FLUSH_MIN_BYTES", defaultFlushMinBytes)
+	if err != nil {
+		return flushBounds{}, err
+	}
+	maxBytes, err := getEnvInt("STREAM_FLUSH_MAX_BYTES", maxStreamFlushBytes)
+	if err != nil {
+		return flushBounds{}, err
+	}
+	switch {
+	case minInterval <= 0:
+		return flushBounds{}, fmt.Errorf("Environment variable STREAM_FLUSH_MIN_INTERVAL_MS must be greater than 0")
+	case maxInterval < minInterval:
+		return flushBounds{}, fmt.Errorf("Environment variable STREAM_FLUSH_MAX_INTERVAL_MS must be at least STREAM_FLUSH_MIN_INTERVAL_MS")
+	case minBytes <= 0:
+		return flushBounds{}, fmt.Errorf("Environment variable STREAM_FLUSH_MIN_BYTES must be greater than 0")
+	case maxBytes < minBytes:
+		return flushBounds{}, fmt.Errorf("Environment variable STREAM_FLUSH_MAX_BYTES must be at least STREAM_FLUSH_MIN_BYTES")
+	case maxBytes > maxStreamFlushBytes:
+		return flushBounds{}, fmt.Errorf("Environment variable STREAM_FLUSH_MAX_BYTES must be at most %d", maxStreamFlushBytes)
+	}
+	return flushBounds{
+		MinInterval: time.Duration(minInterval) * time.Millisecond,
+		MaxInterval: time.Duration(maxInterval) * time.Millisecond,
+		MinBytes:    minBytes,
+		MaxBytes:    maxBytes,
+	}, nil
+}
+
+// flushBounds holds the floor and ceiling the adaptive flush settings are kept within
+type flushBounds struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	MinBytes    int
+	MaxBytes    int
+}
+
+// flushController adapts the stream flush interval and size to the observed PostToConnection latency.
+// Slow posts lead to more batching, fast posts to snappier flushing.
+type flushController struct {
+	bounds   flushBounds
+	interval time.Duration
+	bytes    int
+	ewma     float64 // Moving average of the post latency in milliseconds
+	samples  int
+}
+
+// newFlushController creates a flushController starting from the given interval and size
+func newFlushController(bounds flushBounds, interval time.Duration, bytes int) *flushController {
+	c := &flushController{bounds: bounds}
+	c.interval = c.clampInterval(interval)
+	c.bytes = c.bytesFor(c.interval)
+	if bytes > 0 {
+		c.bytes = clampInt(bytes, bounds.MinBytes, bounds.MaxBytes)
+	}
+	return c
+}
+
+// observe records the latency of one PostToConnection call and adjusts the effective values when needed
+func (c *flushController) observe(latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+	if c.samples == 0 {
+		c.ewma = ms
+	} else {
+		c.ewma = flushEWMAAlpha*ms + (1-flushEWMAAlpha)*c.ewma
+	}
+	c.samples++
+	if c.samples < flushMinSamples {
+		return
+	}
+
+	target := c.clampInterval(time.Duration(c.ewma * flushLatencyFactor * float64(time.Millisecond)))
+	diff := float64(target - c.interval)
+	if diff < 0 {
+		diff = -diff
+	}
+	// Ignore small changes so noisy measurements don't make the interval oscillate
+	if diff <= flushDeadband*float64(c.interval) {
+		return
+	}
+	c.interval = target
+	c.bytes = c.bytesFor(target)
+}
+
+// effective returns the current flush interval and size
+func (c *flushController) effective() (time.Duration, int) {
+	return c.interval, c.bytes
+}
+
+// clampInterval keeps an interval within the configured bounds
+func (c *flushController) clampInterval(interval time.Duration) time.Duration {
+	if interval < c.bounds.MinInterval {
+		return c.bounds.MinInterval
+	}
+	if interval > c.bounds.MaxInterval {
+		return c.bounds.MaxInterval
+	}
+	return interval
+}
+
+// bytesFor scales the flush size with the position of the interval between its floor and ceiling
+func (c *flushController) bytesFor(interval time.Duration) int {
+	span := c.bounds.MaxInterval - c.bounds.MinInterval
+	if span <= 0 {
+		return c.bounds.MinBytes
+	}
+	fraction := float64(interval-c.bounds.MinInterval) / float64(span)
+	return c.bounds.MinBytes + int(fraction*float64(c.bounds.MaxBytes-c.bounds.MinBytes))
+}
+
+// clampInt keeps v within [lo, hi]
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// streamBatcher buffers streamed deltas until the flush interval has passed or the buffer reaches the flush size.
+// With sentence or paragraph granularity it instead holds text back until a complete sentence or paragraph is buffered.
+type streamBatcher struct {
+	buffer      strings.Builder
+	granularity string
+	interval    time.Duration
+	bytes       int
+	lastFlush   time.Time
+	controller  *flushController // Adjusts interval and bytes when adaptive flushing is enabled
+	wholeLines  bool             // Only flush complete lines with token granularity, for the output filters
+	deltas      int
+	flushes     int
+}
+
+// newStreamBatcher creates a streamBatcher with the flush settings of the configuration snapshot
+func newStreamBatcher(cfg *Config, granularity string, now time.Time) *streamBatcher {
+	if granularity == "" {
+		granularity = granularityToken
+	}
+	b := &streamBatcher{
+		granularity: granularity,
+		interval:    cfg.StreamFlushInterval,
+		bytes:       cfg.StreamFlushBytes,
+		lastFlush:   now,
+	}
+	if cfg.StreamFlushAdaptive {
+		b.controller = newFlushController(cfg.StreamFlushBounds, b.interval, b.bytes)
+		b.interval, b.bytes = b.controller.effective()
+	}
+	return b
+}
+
+// add appends a delta to the buffer
+func (b *streamBatcher) add(delta string) {
+	b.buffer.WriteString(delta)
+	b.deltas++
+}
+
+// pending checks if there is buffered text left to flush
+func (b *streamBatcher) pending() bool {
+	return b.buffer.Len() > 0
+}
+
+// due checks if the buffered text should be flushed now
+func (b *streamBatcher) due(now time.Time) bool {
+	if !b.pending() {
+		return false
+	}
+	if b.granularity != granularityToken {
+		return b.buffer.Len() >= maxStreamFlushBytes || lastStreamBoundary(b.buffer.String(), b.granularity) > 0
+	}
+	limit := b.bytes
+	if limit <= 0 || limit > maxStreamFlushBytes {
+		limit = maxStreamFlushBytes
+	}
+	ready := b.buffer.Len() >= limit || now.Sub(b.lastFlush) >= b.interval
+	if b.wholeLines {
+		return b.buffer.Len() >= maxStreamFlushBytes || ready && strings.Contains(b.buffer.String(), "\n")
+	}
+	return ready
+}
+
+// take returns the buffered text to flush. With sentence or paragraph granularity the text after the last
+// boundary stays buffered, unless final is set or the buffer has grown too large for one frame.
+func (b *streamBatcher) take(now time.Time, final bool) string {
+	text := b.buffer.String()
+	cut := len(text)
+	if b.granularity != granularityToken && !final && len(text) < maxStreamFlushBytes {
+		cut = lastStreamBoundary(text, b.granularity)
+	} else if b.wholeLines && !final && len(text) < maxStreamFlushBytes {
+		cut = strings.LastIndexByte(text, '\n') + 1
+	}
+	b.buffer.Reset()
+	b.buffer.WriteString(text[cut:])
+	b.lastFlush = now
+	b.flushes++
+	return text[:cut]
+}
+
+// observe feeds the latency of a flush into the adaptive controller, if there is one
+func (b *streamBatcher) observe(latency time.Duration) {
+	if b.controller == nil {
+		return
+	}
+	b.controller.observe(latency)
+	b.interval, b.bytes = b.controller.effective()
+}
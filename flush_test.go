@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// testFlushBounds are the default bounds of STREAM_FLUSH_ADAPTIVE
+var testFlushBounds = flushBounds{MinInterval: defaultFlushMinInterval, MaxInterval: defaultFlushMaxInterval, MinBytes: defaultFlushMinBytes, MaxBytes: maxStreamFlushBytes}
+
+// latencies returns n copies of latency
+func latencies(n int, latency time.Duration) []time.Duration {
+	sequence := make([]time.Duration, n)
+	for i := range sequence {
+		sequence[i] = latency
+	}
+	return sequence
+}
+
+func TestFlushController(t *testing.T) {
+	bounds := testFlushBounds
+	start := defaultStreamFlushInterval
+	tests := []struct {
+		name      string
+		latencies []time.Duration
+		want      func(interval time.Duration) bool
+	}{
+		{name: "too few samples", latencies: latencies(flushMinSamples-1, 500*time.Millisecond), want: func(interval time.Duration) bool { return interval == start }},
+		{name: "slow posts batch more", latencies: latencies(20, 150*time.Millisecond), want: func(interval time.Duration) bool { return interval > start }},
+		{name: "fast posts flush sooner", latencies: latencies(20, 5*time.Millisecond), want: func(interval time.Duration) bool { return interval < start }},
+		{name: "ceiling", latencies: latencies(50, 5*time.Second), want: func(interval time.Duration) bool { return interval == bounds.MaxInterval }},
+		{name: "floor", latencies: latencies(50, 0), want: func(interval time.Duration) bool { return interval == bounds.MinInterval }},
+		{name: "latency matching the interval", latencies: latencies(20, start/flushLatencyFactor), want: func(interval time.Duration) bool { return interval == start }},
+		{name: "single outlier", latencies: append(latencies(20, start/flushLatencyFactor), 60*time.Millisecond), want: func(interval time.Duration) bool { return interval == start }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFlushController(bounds, start, 0)
+			for _, latency := range tt.latencies {
+				c.observe(latency)
+				interval, bytes := c.effective()
+				if interval < bounds.MinInterval || interval > bounds.MaxInterval || bytes < bounds.MinBytes || bytes > bounds.MaxBytes {
+					t.Fatalf("effective() = %v, %d, out of bounds %+v", interval, bytes, bounds)
+				}
+			}
+			if interval, _ := c.effective(); !tt.want(interval) {
+				t.Fatalf("interval = %v after %d samples, started at %v", interval, len(tt.latencies), start)
+			}
+		})
+	}
+}
+
+func TestFlushControllerDoesNotOscillate(t *testing.T) {
+	c := newFlushController(testFlushBounds, defaultStreamFlushInterval, 0)
+	// Noise around 40ms settles the interval, and alternating samples don't move it back and forth
+	for i := 0; i < 20; i++ {
+		c.observe(40 * time.Millisecond)
+	}
+	settled, _ := c.effective()
+	changes := 0
+	for i := 0; i < 100; i++ {
+		latency := 30 * time.Millisecond
+		if i%2 == 0 {
+			latency = 50 * time.Millisecond
+		}
+		c.observe(latency)
+		if interval, _ := c.effective(); interval != settled {
+			changes++
+			settled = interval
+		}
+	}
+	if changes > 0 {
+		t.Fatalf("interval changed %d times on noisy latencies", changes)
+	}
+}
+
+func TestFlushControllerBytesFollowInterval(t *testing.T) {
+	bounds := testFlushBounds
+	tests := []struct {
+		latency time.Duration
+		want    int
+	}{
+		{latency: 0, want: bounds.MinBytes},
+		{latency: 5 * time.Second, want: bounds.MaxBytes},
+	}
+	for _, tt := range tests {
+		c := newFlushController(bounds, defaultStreamFlushInterval, defaultStreamFlushBytes)
+		if _, bytes := c.effective(); bytes != defaultStreamFlushBytes {
+			t.Fatalf("initial bytes = %d, want the configured %d", bytes, defaultStreamFlushBytes)
+		}
+		for i := 0; i < 50; i++ {
+			c.observe(tt.latency)
+		}
+		if _, bytes := c.effective(); bytes != tt.want {
+			t.Errorf("bytes after %v posts = %d, want %d", tt.latency, bytes, tt.want)
+		}
+	}
+}
+
+func TestStreamBatcherDue(t *testing.T) {
+	cfg := &Config{StreamFlushInterval: 100 * time.Millisecond, StreamFlushBytes: 10}
+	tests := []struct {
+		name    string
+		deltas  []string
+		elapsed time.Duration
+		want    bool
+	}{
+		{name: "empty", elapsed: time.Second},
+		{name: "small and early", deltas: []string{"abc"}, elapsed: 50 * time.Millisecond},
+		{name: "interval passed", deltas: []string{"abc"}, elapsed: 100 * time.Millisecond, want: true},
+		{name: "size reached", deltas: []string{"abcde", "fghij"}, elapsed: time.Millisecond, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newStreamBatcher(cfg, "", testStart)
+			for _, delta := range tt.deltas {
+				b.add(delta)
+			}
+			if got := b.due(testStart.Add(tt.elapsed)); got != tt.want {
+				t.Fatalf("due() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamBatching(t *testing.T) {
+	deltas := make([]string, 50)
+	var want strings.Builder
+	for i := range deltas {
+		deltas[i] = fmt.Sprintf("tök%d ", i)
+		want.WriteString(deltas[i])
+	}
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		bytes     int
+		maxFrames int
+	}{
+		{name: "by interval", interval: 150 * time.Millisecond, bytes: 4096, maxFrames: 10},
+		{name: "by size", interval: time.Hour, bytes: 64, maxFrames: 10},
+		{name: "every delta", interval: 0, bytes: 1, maxFrames: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.StreamFlushInterval = tt.interval
+				cfg.StreamFlushBytes = tt.bytes
+				cfg.EndStreamMessage = "<END>"
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(20*time.Millisecond, deltas...)...))
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			_, poster := runTestRequest(t, cfg, chat, body)
+			texts := poster.Texts()
+			if len(texts) == 0 || texts[len(texts)-1] != "<END>" {
+				t.Fatalf("frames %q don't end with the end marker", texts)
+			}
+			frames := texts[:len(texts)-1]
+			if len(frames) > tt.maxFrames {
+				t.Fatalf("%d frames for %d deltas, want at most %d", len(frames), len(deltas), tt.maxFrames)
+			}
+			if got := strings.Join(frames, ""); got != want.String() {
+				t.Fatalf("streamed %q, want %q", got, want.String())
+			}
+		})
+	}
+}
+
+func TestLoadConfigFlushBounds(t *testing.T) {
+	cfg, err := loadConfig()
+	if err != nil || cfg.StreamFlushBounds != testFlushBounds {
+		t.Fatalf("loadConfig() = %+v, %v, want the default bounds", cfg.StreamFlushBounds, err)
+	}
+	t.Setenv("STREAM_FLUSH_MIN_INTERVAL_MS", "100")
+	t.Setenv("STREAM_FLUSH_MAX_INTERVAL_MS", "400")
+	t.Setenv("STREAM_FLUSH_MIN_BYTES", "1024")
+	t.Setenv("STREAM_FLUSH_MAX_BYTES", "8192")
+	want := flushBounds{MinInterval: 100 * time.Millisecond, MaxInterval: 400 * time.Millisecond, MinBytes: 1024, MaxBytes: 8192}
+	if cfg, err = loadConfig(); err != nil || cfg.StreamFlushBounds != want {
+		t.Fatalf("loadConfig() = %+v, %v, want %+v", cfg.StreamFlushBounds, err, want)
+	}
+
+	tests := []struct {
+		name  string
+		env   string
+		value string
+	}{
+		{name: "interval floor above the ceiling", env: "STREAM_FLUSH_MIN_INTERVAL_MS", value: "500"},
+		{name: "no interval floor", env: "STREAM_FLUSH_MIN_INTERVAL_MS", value: "0"},
+		{name: "size floor above the ceiling", env: "STREAM_FLUSH_MIN_BYTES", value: "9000"},
+		{name: "size ceiling over one envelope", env: "STREAM_FLUSH_MAX_BYTES", value: "70000"},
+		{name: "not a number", env: "STREAM_FLUSH_MAX_INTERVAL_MS", value: "1s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			if _, err := loadConfig(); err == nil {
+				t.Errorf("loadConfig() accepted %s=%s", tt.env, tt.value)
+			}
+		})
+	}
+}
+
+// TestStreamBatcherFlushBounds checks that adaptive flushing starts within the configured bounds
+func TestStreamBatcherFlushBounds(t *testing.T) {
+	cfg := &Config{
+		StreamFlushInterval: defaultStreamFlushInterval,
+		StreamFlushBytes:    defaultStreamFlushBytes,
+		StreamFlushAdaptive: true,
+		StreamFlushBounds:   flushBounds{MinInterval: 300 * time.Millisecond, MaxInterval: 600 * time.Millisecond, MinBytes: 8192, MaxBytes: 16384},
+	}
+	b := newStreamBatcher(cfg, granularityToken, testStart)
+	if b.interval != 300*time.Millisecond || b.bytes != 8192 {
+		t.Errorf("interval, bytes = %v, %d, want the floor of 300ms and 8192", b.interval, b.bytes)
+	}
+}
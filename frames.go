@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// maxFrameBytes keeps frames safely below the 128KB PostToConnection payload limit
+	maxFrameBytes  = 120 * 1024
+	protocolV2     = "v2"
+	frameTypeChunk = "chunk"
+	frameTypeFinal = "final"
+	frameTypeError = "error"
+	frameTypeEnd   = "end"
+	frameTypeAck   = "ack"
+	// frameTypeFinishReason reports an unusual finish reason to legacy clients that set report_finish_reason
+	frameTypeFinishReason = "finish_reason"
+	// truncatedMarker precedes the end marker of a legacy stream cut short by the Lambda deadline
+	truncatedMarker = "[truncated]"
+)
+
+// maxEnvelopeTextBytes is the encoded size of the text of one envelope, leaving room for its other fields
+const maxEnvelopeTextBytes = maxFrameBytes - 4*1024
+
+// Machine-readable error codes sent in error frames
+const (
+	errorCodeOpenAI         = "openai_error"
+	errorCodeParse          = "parse_error"
+	errorCodeStream         = "stream_error"
+	errorCodeInvalidRequest = "invalid_request"
+	errorCodeContentFilter  = "content_filter"
+	errorCodeInternal       = "internal_error"
+)
+
+// frameEnvelope wraps every frame posted to protocol v2 clients
+type frameEnvelope struct {
+	Type         string              `json:"type"`
+	Seq          int                 `json:"seq"`
+	Code         string              `json:"code,omitempty"`
+	Data         any                 `json:"data,omitempty"`
+	Annotations  *outputAnnotations  `json:"annotations,omitempty"`
+	FinishReason openai.FinishReason `json:"finish_reason,omitempty"`
+	Model        string              `json:"model,omitempty"`
+	Raw          bool                `json:"raw,omitempty"`
+	Encoding     string              `json:"encoding,omitempty"`   // gzip+base64 when Data is compressed for accept_encoding
+	RequestID    string              `json:"request_id,omitempty"` // Client request_id, telling the answers of a batch apart
+	Truncated    bool                `json:"truncated,omitempty"`  // Set on the end envelope of a stream cut short by the Lambda deadline
+}
+
+// errorFrame is the error frame posted to legacy clients
+type errorFrame struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// controlFrame is posted to legacy clients to signal a change of the request state
+type controlFrame struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// completionInfo holds what is known about the completion behind an answer besides its text
+type completionInfo struct {
+	Usage        openai.Usage
+	FinishReason openai.FinishReason
+	Model        string // Model that actually answered, which differs from the configured one after a fallback
+	ToolCalls    []toolCall
+	// SystemFingerprint identifies the OpenAI backend configuration, a change explains drifting answers
+	SystemFingerprint string
+	// Truncated marks a stream ended early because the Lambda deadline was close
+	Truncated bool
+}
+
+// newCompletionInfo returns the completionInfo of a non-stream response, taking the finish reason and the tool
+// calls from its first choice
+func newCompletionInfo(response openai.ChatCompletionResponse) (completionInfo, error) {
+	if len(response.Choices) == 0 {
+		return completionInfo{}, ErrNoChoices
+	}
+	return completionInfo{
+		Usage:             response.Usage,
+		FinishReason:      response.Choices[0].FinishReason,
+		Model:             response.Model,
+		ToolCalls:         fromOpenAIToolCalls(response.Choices[0].Message.ToolCalls),
+		SystemFingerprint: response.SystemFingerprint,
+	}, nil
+}
+
+// finishFrame carries the finish reason to legacy clients, ending the stream for structured_end
+type finishFrame struct {
+	Type         string              `json:"type"`
+	FinishReason openai.FinishReason `json:"finish_reason,omitempty"`
+	Truncated    bool                `json:"truncated,omitempty"`
+}
+
+// frameSequence hands out the sequence numbers of the envelopes of one request
+type frameSequence struct {
+	next int
+}
+
+// take returns the next sequence number
+func (s *frameSequence) take() int {
+	seq := s.next
+	s.next++
+	return seq
+}
+
+// isV2 checks if the client asked for the v2 envelope protocol
+func (r openAIRequest) isV2() bool {
+	return r.request.Protocol == protocolV2
+}
+
+// postEnvelope numbers a v2 envelope and posts it
+func postEnvelope(openAIRequest openAIRequest, envelope frameEnvelope) error {
+	envelope.Seq = openAIRequest.sequence.take()
+	envelope.Raw = openAIRequest.request.RawOutput
+	envelope.RequestID = openAIRequest.request.RequestID
+	// Without HTML escaping <, > and & keep their size, as splitEnvelopeText counts them
+	var payload bytes.Buffer
+	encoder := json.NewEncoder(&payload)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(envelope); err != nil {
+		return fmt.Errorf("Can't encode %s frame: %v", envelope.Type, err)
+	}
+	return postToConnection(openAIRequest, bytes.TrimSuffix(payload.Bytes(), []byte("\n")))
+}
+
+// escapedLen returns the size of a rune of width bytes in a JSON string written by postEnvelope
+func escapedLen(r rune, width int) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '\u2028' || r == '\u2029':
+		return 6
+	case r == utf8.RuneError && width == 1:
+		// Invalid bytes are replaced by an escaped U+FFFD
+		return 6
+	default:
+		return width
+	}
+}
+
+// splitEnvelopeText splits text into chunks whose JSON encoding takes at most limit bytes, without cutting
+// UTF-8 encoded runes. Escaping grows control characters up to six times, so the raw size can't be used.
+func splitEnvelopeText(data []byte, limit int) [][]byte {
+	var chunks [][]byte
+	start, size := 0, 0
+	for i := 0; i < len(data); {
+		r, width := utf8.DecodeRune(data[i:])
+		n := escapedLen(r, width)
+		if size+n > limit && i > start {
+			chunks = append(chunks, data[start:i])
+			start, size = i, 0
+		}
+		size += n
+		i += width
+	}
+	return append(chunks, data[start:])
+}
+
+// splitFrame splits data into chunks of at most limit bytes without cutting UTF-8 encoded runes
+func splitFrame(data []byte, limit int) [][]byte {
+	var chunks [][]byte
+	for len(data) > limit {
+		cut := limit
+		// Move the cut back to the start of the rune it falls into
+		for cut > 0 && !utf8.RuneStart(data[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = limit
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	return append(chunks, data)
+}
+
+// postFrames posts data to the connection of the request. Payloads over maxFrameBytes are split into
+// several frames followed by the end stream message, so the client knows when reassembly is complete.
+func postFrames(openAIRequest openAIRequest, data []byte) error {
+	if len(data) <= maxFrameBytes {
+		return postToConnection(openAIRequest, data)
+	}
+	// A failed frame dead-letters the whole payload, the frames before it are of no use on their own
+	frameRequest := openAIRequest
+	frameRequest.deadLetters = nil
+	chunks := splitFrame(data, maxFrameBytes)
+	for i, chunk := range chunks {
+		if err := postToConnection(frameRequest, chunk); err != nil {
+			return deadLetter(openAIRequest, data, fmt.Errorf("Can't post frame %d of %d: %w", i+1, len(chunks), err))
+		}
+	}
+	return postToConnection(openAIRequest, []byte(openAIRequest.config.EndStreamMessage))
+}
+
+// postChunk posts one piece of a streamed answer. A piece too large for one frame, such as a pathologically
+// large delta, is split into several frames; the end of the stream is marked by postEnd as usual. Pieces of
+// requests with accept_encoding are compressed once they reach COMPRESS_MIN_BYTES.
+func postChunk(openAIRequest openAIRequest, data []byte) error {
+	if openAIRequest.compresses(data) {
+		return postCompressedChunk(openAIRequest, data)
+	}
+	if openAIRequest.isV2() {
+		for _, chunk := range splitEnvelopeText(data, maxEnvelopeTextBytes) {
+			if err := postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeChunk, Data: string(chunk)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, chunk := range splitFrame(data, maxFrameBytes) {
+		if err := postToConnection(openAIRequest, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postFinal posts the complete answer of a non-stream response. For v2 clients an answer too large for
+// one envelope is sent as chunk envelopes followed by an end envelope carrying the annotations.
+// Answers of requests with accept_encoding are compressed once they reach COMPRESS_MIN_BYTES.
+func postFinal(openAIRequest openAIRequest, data []byte, annotations *outputAnnotations, info completionInfo) error {
+	if openAIRequest.compresses(data) {
+		return postCompressedFinal(openAIRequest, data, annotations, info)
+	}
+	if !openAIRequest.isV2() {
+		if err := postFrames(openAIRequest, data); err != nil {
+			return err
+		}
+		return postFinishReason(openAIRequest, info.FinishReason)
+	}
+	chunks := splitEnvelopeText(data, maxEnvelopeTextBytes)
+	if len(chunks) == 1 {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeFinal, Data: string(data), Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model})
+	}
+	for _, chunk := range chunks {
+		if err := postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeChunk, Data: string(chunk)}); err != nil {
+			return err
+		}
+	}
+	return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeEnd, Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model})
+}
+
+// postFinishReason tells legacy clients that set report_finish_reason that the answer was cut short.
+// Nothing is posted for a regular stop, and v2 clients find the finish reason on the final or end envelope.
+func postFinishReason(openAIRequest openAIRequest, finishReason openai.FinishReason) error {
+	if openAIRequest.isV2() || !openAIRequest.request.ReportFinishReason || finishReason == "" || finishReason == openai.FinishReasonStop {
+		return nil
+	}
+	payload, err := json.Marshal(finishFrame{Type: frameTypeFinishReason, FinishReason: finishReason})
+	if err != nil {
+		return fmt.Errorf("Can't encode finish reason frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
+
+// postEnd posts the end of a streamed answer. Legacy clients get the end stream message, or with structured_end
+// a JSON end frame carrying the finish reason.
+func postEnd(openAIRequest openAIRequest, annotations *outputAnnotations, info completionInfo) error {
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeEnd, Annotations: annotations, FinishReason: info.FinishReason, Model: info.Model, Truncated: info.Truncated})
+	}
+	if !openAIRequest.request.StructuredEnd {
+		if info.Truncated {
+			if err := postToConnection(openAIRequest, []byte(truncatedMarker)); err != nil {
+				return err
+			}
+		}
+		return postToConnection(openAIRequest, []byte(openAIRequest.config.EndStreamMessage))
+	}
+	payload, err := json.Marshal(finishFrame{Type: frameTypeEnd, FinishReason: info.FinishReason, Truncated: info.Truncated})
+	if err != nil {
+		return fmt.Errorf("Can't encode end frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
+
+// postControlFrame posts a frame of frameType echoing the request ID. For v2 clients the request ID is the envelope data.
+func postControlFrame(openAIRequest openAIRequest, frameType string) error {
+	requestID := openAIRequest.request.RequestID
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameType, Data: requestID})
+	}
+	payload, err := json.Marshal(controlFrame{Type: frameType, RequestID: requestID})
+	if err != nil {
+		return fmt.Errorf("Can't encode %s frame: %v", frameType, err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
+
+// postErrorFrame tells the client that the request failed, carrying code and a human readable message.
+// A failure to post is only logged, since the error is already being reported.
+func postErrorFrame(openAIRequest openAIRequest, code string, message string) {
+	var err error
+	if openAIRequest.isV2() {
+		err = postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeError, Code: code, Data: message})
+	} else {
+		var payload []byte
+		payload, err = json.Marshal(errorFrame{Type: frameTypeError, Code: code, Message: message})
+		if err == nil {
+			err = postToConnection(openAIRequest, payload)
+		}
+	}
+	if err != nil {
+		openAIRequest.logger().Error("Can't post error frame", "error", err)
+	}
+}
+
+// reportError posts the error frame for a failed request. Errors that are themselves
+// PostToConnection failures are only logged, as posting again would most likely fail too.
+func reportError(openAIRequest openAIRequest, err error) {
+	var postErr *postError
+	if errors.As(err, &postErr) {
+		openAIRequest.logger().Warn("Not posting error frame after a failed post", "error", err)
+		return
+	}
+	postErrorFrame(openAIRequest, errorCode(err), err.Error())
+}
+
+// errorCode classifies a handler error into the code sent to the client
+func errorCode(err error) string {
+	switch {
+	case isTimeoutError(err):
+		return errorCodeTimeout
+	case errors.Is(err, ErrStreamAborted):
+		return errorCodeStream
+	case errors.Is(err, ErrContentFiltered):
+		return errorCodeContentFilter
+	case errors.Is(err, ErrUnparsableResponse):
+		return errorCodeParse
+	case errors.Is(err, ErrTenantKeyInvalid):
+		return errorCodeTenantKeyInvalid
+	case errors.Is(err, ErrOpenAIRequest):
+		return errorCodeOpenAI
+	case errors.Is(err, ErrTemplateVarsMissing), errors.Is(err, ErrContextTooLarge):
+		return errorCodeInvalidRequest
+	default:
+		return errorCodeInternal
+	}
+}
+
+// deliverAnswer posts the answer of a non-stream response followed by the optional usage frame.
+// reply is the complete model output the annotations are computed on. When the model invoked tools
+// their calls are posted instead of the answer.
+func deliverAnswer(openAIRequest openAIRequest, answer []byte, reply string, info completionInfo) error {
+	openAIRequest.metrics.recordCompletion(info)
+	recordTokenUsage(openAIRequest, info)
+	recordSessionTurn(openAIRequest, info)
+	saveConversation(openAIRequest, chatMessage{Role: openai.ChatMessageRoleAssistant, Content: reply, ToolCalls: info.ToolCalls})
+	annotations := computeAnnotations(openAIRequest, reply)
+	openAIRequest.audit.recordCompletion(reply, annotations)
+	if len(info.ToolCalls) > 0 {
+		if err := postToolCalls(openAIRequest, info); err != nil {
+			return fmt.Errorf("Can't post tool calls to websocket: %w", err)
+		}
+	} else if err := postFinal(openAIRequest, answer, annotations, info); err != nil {
+		return fmt.Errorf("Can't post response to websocket: %w", err)
+	}
+	return postUsage(openAIRequest, info, annotations)
+}
+
+// finishStream posts the tool calls of the model and the optional usage frame, followed by the end of a streamed answer.
+// text is the streamed output the annotations are computed on.
+func finishStream(openAIRequest openAIRequest, text string, info completionInfo) error {
+	openAIRequest.metrics.recordCompletion(info)
+	recordTokenUsage(openAIRequest, info)
+	recordSessionTurn(openAIRequest, info)
+	saveConversation(openAIRequest, chatMessage{Role: openai.ChatMessageRoleAssistant, Content: text, ToolCalls: info.ToolCalls})
+	annotations := computeAnnotations(openAIRequest, text)
+	openAIRequest.audit.recordCompletion(text, annotations)
+	// Tool call arguments are JSON, so they are posted in one frame once the stream has delivered them completely
+	if len(info.ToolCalls) > 0 {
+		if err := postToolCalls(openAIRequest, info); err != nil {
+			return fmt.Errorf("Can't post tool calls to websocket: %w", err)
+		}
+	}
+	// structured_end already carries the finish reason in the end frame
+	if !openAIRequest.request.StructuredEnd {
+		if err := postFinishReason(openAIRequest, info.FinishReason); err != nil {
+			return fmt.Errorf("Can't post finish reason to websocket: %w", err)
+		}
+	}
+	if err := postUsage(openAIRequest, info, annotations); err != nil {
+		return err
+	}
+	if err := postEnd(openAIRequest, annotations, info); err != nil {
+		return fmt.Errorf("Can't post end of stream to websocket: %w", err)
+	}
+	return nil
+}
+
+// computeAnnotations computes and logs the output annotations, returning nil when none are enabled
+func computeAnnotations(openAIRequest openAIRequest, text string) *outputAnnotations {
+	// The safety summary reuses the moderation of the input, it never costs a moderation call of its own
+	var moderation *openai.ModerationResponse
+	if openAIRequest.config.Moderation {
+		moderation = openAIRequest.moderation
+	}
+	annotations := annotateOutput(openAIRequest.config, text, moderation)
+	annotations.EconomyMode = openAIRequest.economyMode()
+	if annotations.isEmpty() {
+		return nil
+	}
+	openAIRequest.logger().Info("Output annotations", "language", annotations.Language, "safety", annotations.Safety, "economy_mode", annotations.EconomyMode)
+	return &annotations
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// decodeEnvelopes decodes v2 frames, failing the test on anything else
+func decodeEnvelopes(t *testing.T, frames []string) []frameEnvelope {
+	t.Helper()
+	envelopes := make([]frameEnvelope, len(frames))
+	for i, frame := range frames {
+		if err := json.Unmarshal([]byte(frame), &envelopes[i]); err != nil {
+			t.Fatalf("frame %d %q isn't an envelope: %v", i, frame, err)
+		}
+	}
+	return envelopes
+}
+
+// envelopeTypes returns the types of envelopes in order
+func envelopeTypes(envelopes []frameEnvelope) []string {
+	types := make([]string, len(envelopes))
+	for i, envelope := range envelopes {
+		types[i] = envelope.Type
+	}
+	return types
+}
+
+func TestV2Envelopes(t *testing.T) {
+	tests := []struct {
+		responseType string
+		turn         testsupport.Turn
+		wantTypes    []string
+		wantData     string
+	}{
+		{responseType: "full", turn: testsupport.Reply("Hello"), wantTypes: []string{"final", "usage"}, wantData: "Hello"},
+		{responseType: "int", turn: testsupport.Reply("[[42]]"), wantTypes: []string{"final", "usage"}, wantData: "42"},
+		{responseType: "string", turn: testsupport.Reply("[[blue sky]]"), wantTypes: []string{"final", "usage"}, wantData: "blue sky"},
+		{responseType: "bool", turn: testsupport.Reply("[[yes]]"), wantTypes: []string{"final", "usage"}, wantData: "true"},
+		{responseType: "float", turn: testsupport.Reply("[[0.5]]"), wantTypes: []string{"final", "usage"}, wantData: "0.5"},
+		{responseType: "choice", turn: testsupport.Reply("[[b]]"), wantTypes: []string{"final", "usage"}, wantData: "B"},
+		{responseType: "list", turn: testsupport.Reply("[[a]] [[b]]"), wantTypes: []string{"final", "usage"}, wantData: `["a","b"]`},
+		{responseType: "json", turn: testsupport.Reply(`{"a":1}`), wantTypes: []string{"final", "usage"}, wantData: `{"a":1}`},
+		{
+			responseType: "stream",
+			turn:         testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...),
+			wantTypes:    []string{"chunk", "usage", "end"},
+			wantData:     "Hello",
+		},
+		{
+			responseType: "stream",
+			turn:         testsupport.Stream(testsupport.Chunk{Content: "Hel"}, testsupport.Chunk{Delay: time.Second, Content: "lo"}, testsupport.Chunk{Err: openai.ErrTooManyEmptyStreamMessages}),
+			wantTypes:    []string{"chunk", "error"},
+			wantData:     "Hello",
+		},
+		{responseType: "full", turn: testsupport.Fail(&openai.APIError{HTTPStatusCode: 400, Message: "bad request"}), wantTypes: []string{"error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType+" "+tt.wantTypes[len(tt.wantTypes)-1], func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","protocol":"v2","include_usage":true,"messages":[{"role":"user","content":"hi"}]}`
+			_, poster := runTestRequest(t, cfg, chat, body)
+			envelopes := decodeEnvelopes(t, poster.Texts())
+
+			// Consecutive chunks can be flushed together, so the chunk envelopes are counted as one
+			var types []string
+			var data string
+			for i, envelope := range envelopes {
+				if envelope.Seq != i {
+					t.Fatalf("envelope %d has seq %d", i, envelope.Seq)
+				}
+				if len(types) == 0 || types[len(types)-1] != envelope.Type || envelope.Type != frameTypeChunk {
+					types = append(types, envelope.Type)
+				}
+				if envelope.Type == frameTypeChunk || envelope.Type == frameTypeFinal {
+					data += envelope.Data.(string)
+				}
+			}
+			if len(types) != len(tt.wantTypes) {
+				t.Fatalf("envelopes %v, want %v", envelopeTypes(envelopes), tt.wantTypes)
+			}
+			for i := range types {
+				if types[i] != tt.wantTypes[i] {
+					t.Fatalf("envelopes %v, want %v", envelopeTypes(envelopes), tt.wantTypes)
+				}
+			}
+			if data != tt.wantData {
+				t.Fatalf("data = %q, want %q", data, tt.wantData)
+			}
+			if last := envelopes[len(envelopes)-1]; last.Type == frameTypeError && (last.Code == "" || last.Data == "") {
+				t.Fatalf("error envelope %+v has no code or message", last)
+			}
+		})
+	}
+}
+
+func TestLegacyFramesStayBare(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = "<END>" })
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("[[42]]"))
+	_, poster := runTestRequest(t, cfg, chat, `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+	if texts := poster.Texts(); len(texts) != 1 || texts[0] != "42" {
+		t.Fatalf("frames = %q, want the bare answer", texts)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		turn         testsupport.Turn
+		failPost     error
+		wantStatus   int
+		wantCode     string
+	}{
+		{name: "OpenAI failure", responseType: "full", turn: testsupport.Fail(&openai.APIError{HTTPStatusCode: 400, Message: "bad request"}), wantStatus: statusCodeServerError, wantCode: errorCodeOpenAI},
+		{name: "OpenAI stream failure", responseType: "stream", turn: testsupport.Fail(&openai.APIError{HTTPStatusCode: 400, Message: "bad request"}), wantStatus: statusCodeServerError, wantCode: errorCodeOpenAI},
+		{name: "unparsable answer", responseType: "int", turn: testsupport.Reply("forty-two"), wantStatus: statusCodeBadGateway, wantCode: errorCodeParse},
+		{name: "aborted stream", responseType: "stream", turn: testsupport.Stream(testsupport.Chunk{Content: "Hel"}, testsupport.Chunk{Err: openai.ErrTooManyEmptyStreamMessages}), wantStatus: statusCodeServerError, wantCode: errorCodeStream},
+		{name: "failed post", responseType: "full", turn: testsupport.Reply("Hello"), failPost: &testsupport.StatusError{Code: 400}, wantStatus: statusCodeServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			clock := testsupport.NewClock(testStart)
+			chat.Clock = clock
+			poster := testsupport.NewRecordingPoster()
+			if tt.failPost != nil {
+				poster.FailAt(0, tt.failPost)
+			}
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, nil, clock).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+
+			var frames []errorFrame
+			for _, text := range poster.Texts() {
+				var frame errorFrame
+				if json.Unmarshal([]byte(text), &frame) == nil && frame.Type == frameTypeError {
+					frames = append(frames, frame)
+				}
+			}
+			if tt.wantCode == "" {
+				// The failed post is not followed by an error frame; the recorder only keeps posts that succeeded
+				if poster.Calls() != 1 {
+					t.Fatalf("%d posts after a failed post, want none", poster.Calls()-1)
+				}
+				return
+			}
+			if len(frames) != 1 || frames[0].Code != tt.wantCode || frames[0].Message == "" {
+				t.Fatalf("error frames = %+v, want one with code %s", frames, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSplitFrame(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       string
+		limit      int
+		wantChunks int
+	}{
+		{name: "under the limit", data: "hello", limit: 10, wantChunks: 1},
+		{name: "at the limit", data: "0123456789", limit: 10, wantChunks: 1},
+		{name: "ascii", data: "0123456789abc", limit: 5, wantChunks: 3},
+		{name: "runes across the cut", data: strings.Repeat("é", 10), limit: 5, wantChunks: 5},
+		{name: "four byte runes", data: strings.Repeat("😀", 3), limit: 6, wantChunks: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitFrame([]byte(tt.data), tt.limit)
+			if len(chunks) != tt.wantChunks {
+				t.Fatalf("splitFrame() gave %d chunks, want %d", len(chunks), tt.wantChunks)
+			}
+			var joined []byte
+			for _, chunk := range chunks {
+				if len(chunk) > tt.limit || !utf8.Valid(chunk) {
+					t.Fatalf("chunk %q is over the limit or cuts a rune", chunk)
+				}
+				joined = append(joined, chunk...)
+			}
+			if string(joined) != tt.data {
+				t.Fatalf("chunks join to %q", joined)
+			}
+		})
+	}
+}
+
+// largeReply is a 300KB reply mixing one, two and three byte runes, so frame cuts land inside runes
+func largeReply() string {
+	var reply strings.Builder
+	for reply.Len() < 300*1024 {
+		reply.WriteString("Frame splitting ✓ für größere Antworten. ")
+	}
+	return reply.String()
+}
+
+func TestLargeAnswersAreSplit(t *testing.T) {
+	reply := largeReply()
+	tests := []struct {
+		name         string
+		responseType string
+		protocol     string
+	}{
+		{name: "full", responseType: "full"},
+		{name: "full v2", responseType: "full", protocol: "v2"},
+		{name: "stream with one huge delta", responseType: "stream"},
+		{name: "stream v2 with one huge delta", responseType: "stream", protocol: "v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = "<END>" })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","protocol":"` + tt.protocol + `","messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			var joined strings.Builder
+			frames := poster.Texts()
+			for _, frame := range frames {
+				if len(frame) > maxFrameBytes {
+					t.Fatalf("frame of %d bytes is over the limit", len(frame))
+				}
+			}
+			if tt.protocol == "" {
+				if frames[len(frames)-1] != "<END>" {
+					t.Fatalf("frames don't end with the end marker")
+				}
+				for _, frame := range frames[:len(frames)-1] {
+					if !utf8.ValidString(frame) {
+						t.Fatal("frame cuts a rune")
+					}
+					joined.WriteString(frame)
+				}
+			} else {
+				envelopes := decodeEnvelopes(t, frames)
+				if envelopes[len(envelopes)-1].Type != frameTypeEnd {
+					t.Fatalf("envelopes %v don't end with end", envelopeTypes(envelopes))
+				}
+				for _, envelope := range envelopes[:len(envelopes)-1] {
+					joined.WriteString(envelope.Data.(string))
+				}
+			}
+			if joined.String() != reply {
+				t.Fatalf("reassembled %d bytes, want the %d bytes of the reply", joined.Len(), len(reply))
+			}
+			if min := len(reply)/maxFrameBytes + 1; len(frames)-1 < min {
+				t.Fatalf("%d frames, want at least %d", len(frames)-1, min)
+			}
+		})
+	}
+}
+
+// TestEscapedAnswersFitFrames checks that envelopes stay within maxFrameBytes when JSON escaping grows the
+// text, and that HTML characters aren't escaped at all
+func TestEscapedAnswersFitFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		piece string
+	}{
+		{name: "html", piece: `<a href="x">&amp;</a> `},
+		{name: "control characters", piece: "\x01\x02\x1f\t\"\\\u2028"},
+	}
+	for _, tt := range tests {
+		for _, responseType := range []string{"full", "stream"} {
+			t.Run(tt.name+" "+responseType, func(t *testing.T) {
+				reply := strings.Repeat(tt.piece, 200*1024/len(tt.piece))
+				cfg := testConfig(t, nil)
+				chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+				body := `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","protocol":"v2","messages":[{"role":"user","content":"hi"}]}`
+				response, poster := runTestRequest(t, cfg, chat, body)
+				if response.StatusCode != statusCodeOK {
+					t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+				}
+				frames := poster.Texts()
+				for _, frame := range frames {
+					if len(frame) > maxFrameBytes {
+						t.Fatalf("frame of %d bytes is over the limit", len(frame))
+					}
+					if strings.Contains(frame, `\u003c`) || strings.Contains(frame, `\u0026`) {
+						t.Fatal("frame escapes HTML characters")
+					}
+				}
+				var joined strings.Builder
+				envelopes := decodeEnvelopes(t, frames)
+				for _, envelope := range envelopes[:len(envelopes)-1] {
+					joined.WriteString(envelope.Data.(string))
+				}
+				if joined.String() != reply {
+					t.Fatalf("reassembled %d bytes, want the %d bytes of the reply", joined.Len(), len(reply))
+				}
+			})
+		}
+	}
+}
+
+func TestSplitEnvelopeText(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{name: "empty", data: "", want: []string{""}},
+		{name: "fits", data: "abcd", want: []string{"abcd"}},
+		{name: "plain", data: "abcdef", want: []string{"abcd", "ef"}},
+		{name: "quotes", data: `a"b"c`, want: []string{`a"b`, `"c`}},
+		{name: "control character", data: "a\x01b", want: []string{"a", "\x01", "b"}},
+		{name: "html", data: "<&>", want: []string{"<&>"}},
+		{name: "runes", data: "äöü", want: []string{"äö", "ü"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, chunk := range splitEnvelopeText([]byte(tt.data), 4) {
+				got = append(got, string(chunk))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitEnvelopeText(%q) = %q, want %q", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEnd(t *testing.T) {
+	tests := []struct {
+		name       string
+		structured bool
+		finish     openai.FinishReason
+		wantEnd    string
+	}{
+		{name: "configured marker", finish: openai.FinishReasonStop, wantEnd: "[[DONE]]"},
+		{name: "marker after length", finish: openai.FinishReasonLength, wantEnd: "[[DONE]]"},
+		{name: "structured stop", structured: true, finish: openai.FinishReasonStop, wantEnd: `{"type":"end","finish_reason":"stop"}`},
+		{name: "structured length", structured: true, finish: openai.FinishReasonLength, wantEnd: `{"type":"end","finish_reason":"length"}`},
+		{name: "structured content filter", structured: true, finish: openai.FinishReasonContentFilter, wantEnd: `{"type":"end","finish_reason":"content_filter"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = "[[DONE]]" })
+			// The finish reason comes from the last choice carrying one, followed by a usage chunk without choices
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(
+				testsupport.Chunk{Content: "Hello"},
+				testsupport.Chunk{FinishReason: tt.finish},
+				testsupport.Chunk{Usage: &openai.Usage{TotalTokens: 3}},
+			))
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]`
+			if tt.structured {
+				body += `,"structured_end":true`
+			}
+			_, poster := runTestRequest(t, cfg, chat, body+"}")
+			texts := poster.Texts()
+			if len(texts) != 2 || texts[0] != "Hello" || texts[1] != tt.wantEnd {
+				t.Fatalf("frames = %q, want Hello and %s", texts, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestAckFrame(t *testing.T) {
+	tests := []struct {
+		name         string
+		ack          bool
+		protocol     string
+		failAck      error
+		wantStatus   int
+		wantFrames   []string
+		wantRequests int
+	}{
+		{name: "no ack", wantStatus: statusCodeOK, wantFrames: []string{"Hello"}, wantRequests: 1},
+		{name: "ack", ack: true, wantStatus: statusCodeOK, wantFrames: []string{`{"type":"ack","request_id":"req-7"}`, "Hello"}, wantRequests: 1},
+		{
+			name:         "ack v2",
+			ack:          true,
+			protocol:     protocolV2,
+			wantStatus:   statusCodeOK,
+			wantFrames:   []string{"ack req-7", "final Hello"},
+			wantRequests: 1,
+		},
+		// A client that can't be reached doesn't get an OpenAI call made for it
+		{name: "connection gone", ack: true, failAck: testsupport.ErrGone, wantStatus: statusCodeOK, wantFrames: []string{}},
+		{name: "post failure", ack: true, failAck: errors.New("connection reset"), wantStatus: statusCodeServerError, wantFrames: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			poster := testsupport.NewRecordingPoster()
+			if tt.failAck != nil {
+				poster.FailAt(0, tt.failAck)
+			}
+			body := fmt.Sprintf(`{"response_type":"full","prompt_template":"PROMPT_TEST","request_id":"req-7","ack":%v,"protocol":%q,"messages":[{"role":"user","content":"hi"}]}`, tt.ack, tt.protocol)
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			got := poster.Texts()
+			if tt.protocol == protocolV2 {
+				// Envelopes are compared by their type and data
+				for i, envelope := range decodeEnvelopes(t, got) {
+					got[i] = envelope.Type + " " + envelope.Data.(string)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("OpenAI requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestFinishReasonFrames(t *testing.T) {
+	const lengthFrame = `{"type":"finish_reason","finish_reason":"length"}`
+	tests := []struct {
+		name         string
+		responseType string
+		protocol     string
+		report       bool
+		finish       openai.FinishReason
+		wantFrames   []string // Frames of legacy clients, or the type and finish reason of each envelope
+	}{
+		{name: "full", responseType: responseTypeFull, finish: openai.FinishReasonLength, wantFrames: []string{"Hello"}},
+		{name: "full reported", responseType: responseTypeFull, report: true, finish: openai.FinishReasonLength, wantFrames: []string{"Hello", lengthFrame}},
+		{name: "full reported stop", responseType: responseTypeFull, report: true, finish: openai.FinishReasonStop, wantFrames: []string{"Hello"}},
+		{name: "stream", responseType: responseTypeStream, finish: openai.FinishReasonLength, wantFrames: []string{"Hello", "<END>"}},
+		{name: "stream reported", responseType: responseTypeStream, report: true, finish: openai.FinishReasonLength, wantFrames: []string{"Hello", lengthFrame, "<END>"}},
+		{name: "full v2", responseType: responseTypeFull, protocol: protocolV2, finish: openai.FinishReasonLength, wantFrames: []string{"final length"}},
+		{name: "full v2 stop", responseType: responseTypeFull, protocol: protocolV2, finish: openai.FinishReasonStop, wantFrames: []string{"final stop"}},
+		// v2 clients get the finish reason in the envelopes, report_finish_reason adds no frame
+		{name: "stream v2", responseType: responseTypeStream, protocol: protocolV2, report: true, finish: openai.FinishReasonLength, wantFrames: []string{"chunk ", "end length"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval = 0
+			})
+			turn := testsupport.Reply("Hello")
+			turn.Response.Choices[0].FinishReason = tt.finish
+			turn.Chunks[1].FinishReason = tt.finish
+			chat := testsupport.NewScriptedCompleter(turn)
+			body := fmt.Sprintf(`{"response_type":%q,"prompt_template":"PROMPT_TEST","protocol":%q,"report_finish_reason":%v,"messages":[{"role":"user","content":"hi"}]}`, tt.responseType, tt.protocol, tt.report)
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+			}
+			got := poster.Texts()
+			if tt.protocol == protocolV2 {
+				for i, envelope := range decodeEnvelopes(t, got) {
+					got[i] = envelope.Type + " " + string(envelope.FinishReason)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+// TestContentFilteredExtractors checks that an answer cut off by the content filter is a content_filter error
+// rather than a parse failure, even when the partial reply has an answer
+func TestContentFilteredExtractors(t *testing.T) {
+	for _, responseType := range []string{responseTypeInt, responseTypeString, responseTypeBool, responseTypeFloat, responseTypeList, responseTypeChoice} {
+		t.Run(responseType, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			turn := testsupport.Reply("[[1]]")
+			turn.Response.Choices[0].FinishReason = openai.FinishReasonContentFilter
+			chat := testsupport.NewScriptedCompleter(turn)
+			body := `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeBadGateway {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, statusCodeBadGateway)
+			}
+			var frame errorFrame
+			texts := poster.Texts()
+			if len(texts) != 1 || json.Unmarshal([]byte(texts[0]), &frame) != nil || frame.Code != errorCodeContentFilter {
+				t.Errorf("frames = %q, want a content_filter error frame", texts)
+			}
+		})
+	}
+}
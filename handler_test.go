@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+var (
+	_ ChatCompleter    = (*testsupport.ScriptedCompleter)(nil)
+	_ ConnectionPoster = (*testsupport.RecordingPoster)(nil)
+	_ Clock            = (*testsupport.Clock)(nil)
+)
+
+// testStart is the time the test clocks start at
+var testStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testConfig activates a copy of the configuration changed by update for the test, restoring the original after
+// it. Requests of the test can use the prompt template PROMPT_TEST.
+func testConfig(t *testing.T, update func(cfg *Config)) *Config {
+	t.Helper()
+	t.Setenv("PROMPT_TEST", "You are a test assistant.")
+	original := *getConfig()
+	t.Cleanup(func() { storeConfig(original) })
+	cfg := original
+	cfg.ModelValidation = false
+	if update != nil {
+		update(&cfg)
+	}
+	return storeConfig(cfg)
+}
+
+// newTestHandler creates a handler answering with chat, posting to poster and keeping its tables in db, timed
+// by clock. A nil db is an empty fake.
+func newTestHandler(cfg *Config, chat ChatCompleter, poster ConnectionPoster, db *fakeDynamoDB, clock *testsupport.Clock) *WebsocketHandler {
+	if db == nil {
+		db = newFakeDynamoDB()
+	}
+	h := &WebsocketHandler{localPoster: poster}
+	h.openAIClients.generation, h.openAIClients.value = cfg.Generation, chat
+	h.dynamoDBClients.generation, h.dynamoDBClients.value = cfg.Generation, db
+	if clock != nil {
+		h.clock = clock
+	}
+	return h
+}
+
+// testMessage builds the websocket message of connection conn-1 with body
+func testMessage(body string) events.APIGatewayWebsocketProxyRequest {
+	return events.APIGatewayWebsocketProxyRequest{
+		Body:           body,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{RouteKey: "$default", ConnectionID: "conn-1"},
+	}
+}
+
+// runTestRequest sends body from conn-1 to a handler answering with chat and returns the response and the
+// frames posted back
+func runTestRequest(t *testing.T, cfg *Config, chat *testsupport.ScriptedCompleter, body string) (events.APIGatewayProxyResponse, *testsupport.RecordingPoster) {
+	t.Helper()
+	clock := testsupport.NewClock(testStart)
+	chat.Clock = clock
+	poster := testsupport.NewRecordingPoster()
+	response, err := newTestHandler(cfg, chat, poster, nil, clock).Handler(context.Background(), testMessage(body))
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	return response, poster
+}
+
+func TestHandlerWithScriptedCompleter(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		turn       testsupport.Turn
+		failAt     int
+		wantStatus int
+		wantFrames []string
+	}{
+		{
+			name:       "full",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:       testsupport.Reply("Hello there"),
+			failAt:     -1,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hello there"},
+		},
+		{
+			name:       "stream",
+			body:       `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:       testsupport.Stream(testsupport.TextChunks(time.Second, "Hel", "lo")...),
+			failAt:     -1,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hel", "lo"},
+		},
+		{
+			name:       "client gone",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:       testsupport.Reply("Hello there"),
+			failAt:     0,
+			wantStatus: statusCodeOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			clock := testsupport.NewClock(testStart)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			chat.Clock = clock
+			poster := testsupport.NewRecordingPoster()
+			if tt.failAt >= 0 {
+				poster.FailAt(tt.failAt, testsupport.ErrGone)
+			}
+			h := newTestHandler(cfg, chat, poster, nil, clock)
+
+			response, err := h.Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d, %v, want %d", response.StatusCode, err, tt.wantStatus)
+			}
+			if len(chat.Requests()) != 1 {
+				t.Fatalf("completer got %d requests, want 1", len(chat.Requests()))
+			}
+			texts := strings.Join(poster.Texts(), "\n")
+			for _, want := range tt.wantFrames {
+				if !strings.Contains(texts, want) {
+					t.Fatalf("frames %q don't contain %q", poster.Texts(), want)
+				}
+			}
+			if tt.failAt == 0 && len(poster.Frames()) != 0 {
+				t.Fatalf("frames %q posted to a gone connection", poster.Texts())
+			}
+		})
+	}
+}
+
+func TestStreamTimeoutsOnClock(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunks    []testsupport.Chunk
+		wantError string
+	}{
+		{name: "in time", chunks: append([]testsupport.Chunk{{Delay: 4 * time.Second, Content: "a"}}, testsupport.TextChunks(time.Second, "b", "c")...)},
+		{name: "first token late", chunks: testsupport.TextChunks(6*time.Second, "a"), wantError: ErrFirstTokenTimeout.Error()},
+		{name: "stall after first token", chunks: append(testsupport.TextChunks(time.Second, "a")[:1], testsupport.Chunk{Delay: 3 * time.Second, Content: "b"}), wantError: ErrStreamStalled.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.StreamFirstTokenTimeout = 5 * time.Second
+				cfg.StreamStallTimeout = 2 * time.Second
+			})
+			clock := testsupport.NewClock(testStart)
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(tt.chunks...))
+			chat.Clock = clock
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, nil, clock)
+
+			h.Handler(context.Background(), testMessage(`{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+			texts := strings.Join(poster.Texts(), "\n")
+			if tt.wantError != "" && !strings.Contains(texts, tt.wantError) {
+				t.Fatalf("frames %q don't report %q", poster.Texts(), tt.wantError)
+			}
+			if tt.wantError == "" && (strings.Contains(texts, ErrFirstTokenTimeout.Error()) || strings.Contains(texts, ErrStreamStalled.Error())) {
+				t.Fatalf("frames %q report a timeout", poster.Texts())
+			}
+			if clock.Pending() != 0 {
+				t.Fatalf("%d timers left running after the stream", clock.Pending())
+			}
+		})
+	}
+}
+
+func TestPingPongUsesClock(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConnectionsTable = "" })
+	clock := testsupport.NewClock(testStart)
+	poster := testsupport.NewRecordingPoster()
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), poster, nil, clock)
+
+	for i := 0; i < 2; i++ {
+		response, err := h.Handler(context.Background(), testMessage(`{"action":"ping"}`))
+		if err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("Handler() = %d, %v", response.StatusCode, err)
+		}
+		clock.Advance(30 * time.Second)
+	}
+	frames := poster.Texts()
+	want := []string{
+		`{"type":"pong","ts":` + strconv.FormatInt(testStart.UnixMilli(), 10) + `}`,
+		`{"type":"pong","ts":` + strconv.FormatInt(testStart.Add(30*time.Second).UnixMilli(), 10) + `}`,
+	}
+	if strings.Join(frames, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("pong frames = %q, want %q", frames, want)
+	}
+}
+
+func TestHandlerResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		turn         testsupport.Turn
+		wantStatus   int
+		wantRequests int
+		wantFrames   []string
+	}{
+		{
+			name:         "stream ending without a finish reason",
+			body:         `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:         testsupport.Stream(testsupport.Chunk{Content: "Hel"}, testsupport.Chunk{Delay: time.Second, Content: "lo"}),
+			wantStatus:   statusCodeOK,
+			wantRequests: 1,
+			wantFrames:   []string{"Hel", "lo", defaultEndStreamMessage},
+		},
+		{
+			name:         "full response without choices",
+			body:         `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:         testsupport.Turn{Response: openai.ChatCompletionResponse{}},
+			wantStatus:   statusCodeBadGateway,
+			wantRequests: 1,
+		},
+		{
+			name:         "int response without choices",
+			body:         `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:         testsupport.Turn{Response: openai.ChatCompletionResponse{}},
+			wantStatus:   statusCodeBadGateway,
+			wantRequests: 1,
+		},
+		{
+			name:       "malformed body",
+			body:       `{"response_type":`,
+			wantStatus: statusCodeBadRequest,
+		},
+		{
+			// Answered as a server error since the first release, despite the invalid_request error frame
+			name:       "unknown response type",
+			body:       `{"response_type":"poem","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: statusCodeServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.StreamFlushInterval = 0 })
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			response, poster := runTestRequest(t, cfg, chat, tt.body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("completer got %d requests, want %d", got, tt.wantRequests)
+			}
+			if tt.wantFrames != nil && strings.Join(poster.Texts(), "|") != strings.Join(tt.wantFrames, "|") {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+		})
+	}
+}
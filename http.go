@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// httpRequestKey is the context key marking requests received through an HTTP API instead of a websocket
+type httpRequestKey struct{}
+
+// isHTTPRequest checks if the request of ctx came through an HTTP API
+func isHTTPRequest(ctx context.Context) bool {
+	marked, _ := ctx.Value(httpRequestKey{}).(bool)
+	return marked
+}
+
+// isHTTPEvent checks if a Lambda invocation payload is an API Gateway HTTP API request. Websocket requests
+// carry no HTTP method in their request context.
+func isHTTPEvent(payload json.RawMessage) bool {
+	var event struct {
+		RequestContext struct {
+			HTTP struct {
+				Method string `json:"method"`
+			} `json:"http"`
+		} `json:"requestContext"`
+	}
+	return json.Unmarshal(payload, &event) == nil && event.RequestContext.HTTP.Method != ""
+}
+
+// httpCollector is the ConnectionPoster of HTTP requests. The request is answered with protocol v2 envelopes,
+// which the collector gathers into the HTTP response body instead of posting them.
+type httpCollector struct {
+	body       strings.Builder
+	candidates []string
+	toolCalls  json.RawMessage
+	usage      *usageFrame
+	errorCode  string
+}
+
+// PostToConnection collects one envelope of the answer
+func (c *httpCollector) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	var envelope struct {
+		Type string          `json:"type"`
+		Code string          `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("Can't decode envelope: %v", err)
+	}
+	switch envelope.Type {
+	case frameTypeChunk, frameTypeFinal:
+		var text string
+		if err := json.Unmarshal(envelope.Data, &text); err != nil {
+			return fmt.Errorf("Can't decode %s envelope: %v", envelope.Type, err)
+		}
+		c.body.WriteString(text)
+	case frameTypeCandidate:
+		var candidate candidateFrame
+		if err := json.Unmarshal(envelope.Data, &candidate); err != nil {
+			return fmt.Errorf("Can't decode candidate envelope: %v", err)
+		}
+		c.candidates = append(c.candidates, candidate.Content)
+	case frameTypeToolCalls:
+		c.toolCalls = envelope.Data
+	case frameTypeUsage:
+		c.usage = &usageFrame{}
+		if err := json.Unmarshal(envelope.Data, c.usage); err != nil {
+			return fmt.Errorf("Can't decode usage envelope: %v", err)
+		}
+	case frameTypeError:
+		c.errorCode = envelope.Code
+	}
+	// Control frames such as ack, end or votes have no place in a buffered response
+	return nil
+}
+
+// httpErrorBody is the body of a failed HTTP request
+type httpErrorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// handleHTTP serves a request received through an API Gateway HTTP API. It runs like a websocket request, with
+// the same authorization and status codes, but the answer is returned in the response body. The stream response
+// type and async requests need a websocket and are rejected.
+func (h *WebsocketHandler) handleHTTP(ctx context.Context, cfg *Config, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	ctx = withLogger(ctx, slog.Default().With(
+		"request_id", request.RequestContext.RequestID,
+		"route_key", request.RouteKey,
+		"model", cfg.OpenAIModel,
+	))
+	ctx = context.WithValue(ctx, httpRequestKey{}, true)
+
+	ctx, err := h.authorizeHTTP(ctx, cfg, request.QueryStringParameters, request.Headers)
+	if errors.Is(err, errJWKSUnavailable) {
+		loggerFrom(ctx).Error("Can't verify id_token", "error", err)
+		return httpError(statusCodeUnavailable, errorCodeInternal, err.Error())
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("HTTP request rejected", "error", err)
+		return httpError(statusCodeUnauthorized, errorCodeInvalidRequest, err.Error())
+	}
+
+	body, err := decodeBody(cfg, request.Body, request.IsBase64Encoded)
+	if err != nil {
+		return httpError(statusCodeBadRequest, errorCodeInvalidRequest, err.Error())
+	}
+	reqBody, err := parseRequestBody(body)
+	if err != nil {
+		loggerFrom(ctx).Warn("Can't parse request JSON", "error", err)
+		return httpError(statusCodeBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Error parsing request JSON: %s", err))
+	}
+	switch {
+	case reqBody.ResponseType == responseTypeStream:
+		return httpError(statusCodeBadRequest, errorCodeInvalidRequest, fmt.Sprintf("The %s response type is not supported over HTTP", responseTypeStream))
+	case reqBody.Async:
+		return httpError(statusCodeBadRequest, errorCodeInvalidRequest, "async is not supported over HTTP")
+	case reqBody.AcceptEncoding != "":
+		return httpError(statusCodeBadRequest, errorCodeInvalidRequest, "accept_encoding is not supported over HTTP")
+	}
+	reqBody.Protocol = protocolV2
+
+	collector := &httpCollector{}
+	// The source IP stands in for the connection in the rate limits and quotas of unauthenticated callers, so
+	// their requests share a bucket rather than each getting a fresh one
+	response, _ := h.serveRequest(ctx, cfg, reqBody, "http#"+request.RequestContext.HTTP.SourceIP, collector)
+	if response.StatusCode != statusCodeOK {
+		code := collector.errorCode
+		if code == "" {
+			code = httpErrorCode(response.StatusCode)
+		}
+		return httpError(response.StatusCode, code, response.Body)
+	}
+	return collector.response(reqBody)
+}
+
+// response returns the HTTP response of the collected answer
+func (c *httpCollector) response(request Request) events.APIGatewayV2HTTPResponse {
+	response := events.APIGatewayV2HTTPResponse{StatusCode: statusCodeOK, Headers: map[string]string{"Content-Type": contentTypeText}}
+	switch {
+	case c.toolCalls != nil:
+		response.Body = string(c.toolCalls)
+		response.Headers["Content-Type"] = contentTypeJSON
+	case c.candidates != nil:
+		data, _ := json.Marshal(c.candidates)
+		response.Body = string(data)
+		response.Headers["Content-Type"] = contentTypeJSON
+	default:
+		response.Body = c.body.String()
+		if request.ResponseType == responseTypeJSON || request.ResponseType == responseTypeList || request.IncludeMetadata || len(request.PromptTemplates) > 0 {
+			response.Headers["Content-Type"] = contentTypeJSON
+		}
+	}
+	if c.usage != nil {
+		response.Headers["X-Usage-Prompt-Tokens"] = strconv.Itoa(c.usage.PromptTokens)
+		response.Headers["X-Usage-Completion-Tokens"] = strconv.Itoa(c.usage.CompletionTokens)
+		response.Headers["X-Usage-Total-Tokens"] = strconv.Itoa(c.usage.TotalTokens)
+		if c.usage.Model != "" {
+			response.Headers["X-Model"] = c.usage.Model
+		}
+	}
+	return response
+}
+
+// authorizeHTTP applies the authorization of $connect to an HTTP request, which has no connection to look up:
+// the token comes from the auth query string parameter or the Authorization header, the Cognito ID token from
+// the id_token query string parameter
+func (h *WebsocketHandler) authorizeHTTP(ctx context.Context, cfg *Config, query map[string]string, headers map[string]string) (context.Context, error) {
+	now := h.getClock().Now()
+	if cfg.AuthMode == authModeToken {
+		principal, err := validateAuthToken(cfg.AuthSecret, requestToken(query, headers), now)
+		if err != nil {
+			return ctx, err
+		}
+		ctx = withPrincipal(ctx, principal.Subject)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("principal", principal.Subject))
+	}
+	if cfg.CognitoPoolID != "" {
+		identity, err := verifyIDToken(ctx, cfg, query[idTokenQueryParameter], now)
+		if err != nil {
+			return ctx, err
+		}
+		ctx = withIdentity(ctx, identity)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("user_sub", identity.Sub))
+	}
+	return ctx, nil
+}
+
+// httpErrorCode returns the error code of a request that failed before posting an error frame
+func httpErrorCode(statusCode int) string {
+	switch statusCode {
+	case statusCodeBadRequest, statusCodeTooMany:
+		return errorCodeInvalidRequest
+	case statusCodeBadGateway:
+		return errorCodeOpenAI
+	case statusCodeGatewayTimeout:
+		return errorCodeTimeout
+	case statusCodeUnavailable:
+		return errorCodeProviderUnavailable
+	case statusCodeConflict:
+		return errorCodeDuplicateInProgress
+	case statusCodeForbidden:
+		return errorCodeTenantKeyInvalid
+	default:
+		return errorCodeInternal
+	}
+}
+
+// httpError returns a JSON error response
+func httpError(statusCode int, code string, message string) events.APIGatewayV2HTTPResponse {
+	var body httpErrorBody
+	body.Error.Code = code
+	body.Error.Message = message
+	data, _ := json.Marshal(body)
+	return events.APIGatewayV2HTTPResponse{StatusCode: statusCode, Headers: map[string]string{"Content-Type": contentTypeJSON}, Body: string(data)}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// httpRequest is the HTTP API request http-1 of 203.0.113.7 posting body
+func httpRequest(body string) events.APIGatewayV2HTTPRequest {
+	return events.APIGatewayV2HTTPRequest{
+		RouteKey: "POST /chat",
+		Body:     body,
+		RequestContext: events.APIGatewayV2HTTPRequestContext{
+			RequestID: "http-1",
+			HTTP:      events.APIGatewayV2HTTPRequestContextHTTPDescription{Method: "POST", SourceIP: "203.0.113.7"},
+		},
+	}
+}
+
+// runHTTPRequest serves request with a handler answering with chat. Frames posted to a websocket fail the test.
+func runHTTPRequest(t *testing.T, cfg *Config, chat ChatCompleter, request events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	t.Helper()
+	poster := testsupport.NewRecordingPoster()
+	response := newTestHandler(cfg, chat, poster, nil, testsupport.NewClock(testStart)).handleHTTP(context.Background(), cfg, request)
+	if texts := poster.Texts(); len(texts) != 0 {
+		t.Errorf("HTTP request posted frames %q", texts)
+	}
+	return response
+}
+
+func TestIsHTTPEvent(t *testing.T) {
+	httpPayload, _ := json.Marshal(httpRequest(`{}`))
+	websocketPayload, _ := json.Marshal(testMessage(`{}`))
+	tests := []struct {
+		name    string
+		payload []byte
+		want    bool
+	}{
+		{name: "HTTP API", payload: httpPayload, want: true},
+		{name: "websocket", payload: websocketPayload},
+		{name: "SQS", payload: []byte(`{"Records":[{"eventSource":"aws:sqs"}]}`)},
+		{name: "not JSON", payload: []byte(`POST /chat`)},
+	}
+	for _, tt := range tests {
+		if got := isHTTPEvent(tt.payload); got != tt.want {
+			t.Errorf("isHTTPEvent(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestHTTPResponses checks the body and the content type of every kind of answer
+func TestHTTPResponses(t *testing.T) {
+	usage := openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}
+	withUsage := func(turn testsupport.Turn) testsupport.Turn {
+		turn.Response.Usage = usage
+		return turn
+	}
+	tests := []struct {
+		name        string
+		request     string
+		turn        testsupport.Turn
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{name: "full", request: `"response_type":"full"`, turn: testsupport.Reply("Hello"), wantBody: "Hello", wantHeaders: map[string]string{"Content-Type": contentTypeText}},
+		{name: "int", request: `"response_type":"int"`, turn: testsupport.Reply("It is [[4]]"), wantBody: "4", wantHeaders: map[string]string{"Content-Type": contentTypeText}},
+		{name: "json", request: `"response_type":"json"`, turn: testsupport.Reply(`{"a":1}`), wantBody: `{"a":1}`, wantHeaders: map[string]string{"Content-Type": contentTypeJSON}},
+		{name: "candidates", request: `"response_type":"full","n":2`, turn: candidatesTurn("Roses", "Violets"), wantBody: `["Roses","Violets"]`, wantHeaders: map[string]string{"Content-Type": contentTypeJSON}},
+		{
+			name:        "tool calls",
+			request:     `"response_type":"full",` + testTools,
+			turn:        toolCallsTurn(),
+			wantBody:    `[{"id":"call-1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"},{"id":"call-2","name":"get_weather","arguments":"{\"city\":\"Oslo\"}"}]`,
+			wantHeaders: map[string]string{"Content-Type": contentTypeJSON},
+		},
+		{
+			name:     "usage",
+			request:  `"response_type":"full","include_usage":true`,
+			turn:     withUsage(testsupport.Reply("Hello")),
+			wantBody: "Hello",
+			wantHeaders: map[string]string{
+				"Content-Type":              contentTypeText,
+				"X-Usage-Prompt-Tokens":     "10",
+				"X-Usage-Completion-Tokens": "2",
+				"X-Usage-Total-Tokens":      "12",
+				"X-Model":                   "gpt-test",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.MaxN = defaultMaxN
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{` + tt.request + `,"prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response := runHTTPRequest(t, cfg, chat, httpRequest(body))
+			if response.StatusCode != statusCodeOK || response.Body != tt.wantBody {
+				t.Fatalf("handleHTTP() = %d %s, want 200 %s", response.StatusCode, response.Body, tt.wantBody)
+			}
+			if !reflect.DeepEqual(response.Headers, tt.wantHeaders) {
+				t.Errorf("headers = %v, want %v", response.Headers, tt.wantHeaders)
+			}
+		})
+	}
+}
+
+// TestHTTPErrors checks that failures get the status codes of the websocket route and a JSON error body
+func TestHTTPErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		turn       testsupport.Turn
+		quota      int
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "stream", body: `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[]}`, wantStatus: statusCodeBadRequest, wantCode: errorCodeInvalidRequest},
+		{name: "async", body: `{"response_type":"full","prompt_template":"PROMPT_TEST","async":true,"messages":[]}`, wantStatus: statusCodeBadRequest, wantCode: errorCodeInvalidRequest},
+		{name: "malformed JSON", body: `{"response_type":`, wantStatus: statusCodeBadRequest, wantCode: errorCodeInvalidRequest},
+		{name: "invalid parameters", body: `{"response_type":"full","prompt_template":"PROMPT_TEST","temperature":5,"messages":[]}`, wantStatus: statusCodeBadRequest, wantCode: errorCodeInvalidRequest},
+		{
+			name:       "OpenAI failure",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:       testsupport.Fail(errors.New("connection reset")),
+			wantStatus: statusCodeServerError,
+			wantCode:   errorCodeOpenAI,
+		},
+		{
+			name:       "no answer",
+			body:       `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turn:       testsupport.Reply("no idea"),
+			wantStatus: statusCodeBadGateway,
+			wantCode:   errorCodeParse,
+		},
+		{
+			name:       "quota exceeded",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			quota:      10,
+			wantStatus: statusCodeTooMany,
+			wantCode:   errorCodeQuotaExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIMaxRetries = 0
+				cfg.UsageTable = "usage"
+				cfg.DailyTokenQuota = tt.quota
+			})
+			// Without authentication the source IP stands in for the connection
+			db := newFakeDynamoDB().table("usage", "usage_key")
+			item := usageKey("connection#http#203.0.113.7", usageDay(testStart))
+			item["tokens"] = &dynamodb.AttributeValue{N: aws.String("10")}
+			db.put("usage", item)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			response := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, testsupport.NewClock(testStart)).handleHTTP(context.Background(), cfg, httpRequest(tt.body))
+			var body httpErrorBody
+			if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+				t.Fatalf("handleHTTP() body %s: %v", response.Body, err)
+			}
+			if response.StatusCode != tt.wantStatus || body.Error.Code != tt.wantCode || body.Error.Message == "" {
+				t.Errorf("handleHTTP() = %d %s, want %d with code %s", response.StatusCode, response.Body, tt.wantStatus, tt.wantCode)
+			}
+			if response.Headers["Content-Type"] != contentTypeJSON {
+				t.Errorf("Content-Type = %q, want %s", response.Headers["Content-Type"], contentTypeJSON)
+			}
+		})
+	}
+}
+
+func TestHTTPTokenAuth(t *testing.T) {
+	// The token expires by the clock of the handler, long before the system clock
+	valid := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Add(time.Hour).Unix()})
+	expired := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: testStart.Add(-time.Minute).Unix()})
+	tests := []struct {
+		name       string
+		query      map[string]string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{name: "query string", query: map[string]string{authQueryParameter: valid}, wantStatus: statusCodeOK},
+		{name: "bearer header", headers: map[string]string{"authorization": "Bearer " + valid}, wantStatus: statusCodeOK},
+		{name: "invalid token", headers: map[string]string{"Authorization": "Bearer " + valid[:len(valid)-2] + "xx"}, wantStatus: statusCodeUnauthorized},
+		{name: "expired token", headers: map[string]string{"Authorization": "Bearer " + expired}, wantStatus: statusCodeUnauthorized},
+		{name: "no token", wantStatus: statusCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.AuthMode = authModeToken
+				cfg.AuthSecret = testAuthSecret
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			request := httpRequest(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+			request.QueryStringParameters, request.Headers = tt.query, tt.headers
+			response := runHTTPRequest(t, cfg, chat, request)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("handleHTTP() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != statusCodeOK && len(chat.Requests()) != 0 {
+				t.Error("the unauthorized request reached OpenAI")
+			}
+		})
+	}
+}
+
+func TestInvokeHTTPRequest(t *testing.T) {
+	cfg := testConfig(t, nil)
+	payload, _ := json.Marshal(httpRequest(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+	poster := testsupport.NewRecordingPoster()
+	got, err := newTestHandler(cfg, testsupport.NewScriptedCompleter(testsupport.Reply("Hello")), poster, nil, nil).Invoke(context.Background(), payload)
+	response, ok := got.(events.APIGatewayV2HTTPResponse)
+	if err != nil || !ok || response.StatusCode != statusCodeOK || response.Body != "Hello" {
+		t.Fatalf("Invoke() = %#v, %v, want the HTTP response", got, err)
+	}
+	if texts := poster.Texts(); len(texts) != 0 {
+		t.Errorf("HTTP request posted frames %q", texts)
+	}
+}
+
+// TestHTTPRequestsShareQuota checks that unauthenticated requests of one source IP are accounted together,
+// whatever their request IDs
+func TestHTTPRequestsShareQuota(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.UsageTable = "usage"
+		cfg.DailyTokenQuota = 20
+	})
+	db := newFakeDynamoDB().table("usage", "usage_key")
+	turn := testsupport.Reply("Hello")
+	turn.Response.Usage = openai.Usage{PromptTokens: 15, CompletionTokens: 5, TotalTokens: 20}
+	chat := testsupport.NewScriptedCompleter(turn, turn, turn)
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, testsupport.NewClock(testStart))
+	body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		requestID  string
+		sourceIP   string
+		wantStatus int
+	}{
+		{requestID: "http-1", sourceIP: "203.0.113.7", wantStatus: statusCodeOK},
+		{requestID: "http-2", sourceIP: "203.0.113.7", wantStatus: statusCodeTooMany},
+		{requestID: "http-3", sourceIP: "198.51.100.2", wantStatus: statusCodeOK},
+	}
+	for _, tt := range tests {
+		request := httpRequest(body)
+		request.RequestContext.RequestID, request.RequestContext.HTTP.SourceIP = tt.requestID, tt.sourceIP
+		if response := h.handleHTTP(context.Background(), cfg, request); response.StatusCode != tt.wantStatus {
+			t.Errorf("handleHTTP(%s from %s) = %d %s, want %d", tt.requestID, tt.sourceIP, response.StatusCode, response.Body, tt.wantStatus)
+		}
+	}
+}
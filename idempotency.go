@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	errorCodeDuplicateInProgress = "duplicate_in_progress"
+	// frameTypePreviouslyCompleted answers a retry of a request whose frames weren't stored, such as a stream
+	frameTypePreviouslyCompleted = "previously_completed"
+	statusCodeConflict           = 409
+	defaultIdempotencyTTL        = 24 * time.Hour
+	// maxIdempotencyPayloadBytes keeps the stored frames well below the 400KB DynamoDB item limit
+	maxIdempotencyPayloadBytes = 256 * 1024
+	idempotencyStateInProgress = "in_progress"
+	idempotencyStateCompleted  = "completed"
+	idempotencyWriteTimeout    = 2 * time.Second
+)
+
+// idempotencyClaimKey is the context key of the idempotency claim of a request
+type idempotencyClaimKey struct{}
+
+// idempotencyClaimFrom returns the idempotency claim of the request of ctx, nil when it set no idempotency_key
+func idempotencyClaimFrom(ctx context.Context) *idempotencyClaim {
+	claim, _ := ctx.Value(idempotencyClaimKey{}).(*idempotencyClaim)
+	return claim
+}
+
+// idempotencyClaim is held by the invocation answering a request with an idempotency_key. It wraps the
+// poster of the request to keep the frames the handler posts, so a retry can be answered with them.
+type idempotencyClaim struct {
+	poster    ConnectionPoster
+	recording bool
+	frames    []string
+	size      int
+	overflow  bool // Set when the frames grew past maxIdempotencyPayloadBytes and are no longer kept
+	completed bool
+}
+
+// PostToConnection posts data and keeps it while recording. Frames that didn't reach a departed client
+// are kept too, the retry is what delivers them.
+func (c *idempotencyClaim) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	err := c.poster.PostToConnection(ctx, connectionID, data)
+	if c.recording && !c.overflow && (err == nil || isGoneError(err)) {
+		c.size += len(data)
+		c.frames = append(c.frames, string(data))
+		if c.size > maxIdempotencyPayloadBytes {
+			c.overflow, c.frames = true, nil
+		}
+	}
+	return err
+}
+
+// startRecording drops the frames posted so far, such as the ack, and keeps the frames of the answer
+func (c *idempotencyClaim) startRecording() {
+	c.recording, c.frames, c.size = true, nil, 0
+}
+
+// handled notes the outcome of the handler. A request is completed when it was answered, even if the client
+// left before receiving the answer; a failed request releases its key so the client can try again.
+func (c *idempotencyClaim) handled(err error) {
+	c.completed = err == nil || errors.Is(err, ErrClientGone)
+}
+
+// idempotencyKey returns the DynamoDB key of the idempotency_key of a request, scoped to its subject
+// so clients can't collide with or replay each other's requests
+func idempotencyKey(openAIRequest openAIRequest) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"idempotency_key": {S: aws.String(requestSubject(openAIRequest) + "#" + openAIRequest.request.IdempotencyKey)},
+	}
+}
+
+// serveIdempotent serves a request with an idempotency_key. The first invocation claims the key with a
+// conditional write, so of two retries arriving at the same time only one calls OpenAI. Until the claim
+// is settled retries get a duplicate_in_progress error, and afterwards the stored frames are replayed.
+// Asynchronous workers serve the claim of the invocation that queued the request.
+func (h *WebsocketHandler) serveIdempotent(ctx context.Context, cfg *Config, reqBody Request, connectionID string, poster ConnectionPoster) (events.APIGatewayProxyResponse, error) {
+	openAIReq := h.createOpenAIRequest(ctx, cfg, reqBody, connectionID)
+	openAIReq.poster = poster
+
+	if !isAsyncWorker(ctx) {
+		claimed, err := claimIdempotencyKey(openAIReq)
+		if err != nil {
+			openAIReq.logger().Error("Can't claim idempotency key", "error", err)
+			postErrorFrame(openAIReq, errorCodeInternal, "Can't claim idempotency key")
+			return errorResponse(err.Error(), statusCodeServerError)
+		}
+		if !claimed {
+			return replayIdempotent(openAIReq)
+		}
+	}
+
+	claim := &idempotencyClaim{poster: poster}
+	response, err := h.serveRequest(context.WithValue(ctx, idempotencyClaimKey{}, claim), cfg, reqBody, connectionID, claim)
+	switch {
+	case claim.completed:
+		completeIdempotencyKey(openAIReq, claim)
+	case response.StatusCode == statusCodeAccepted:
+		// The async worker answers the request and settles the claim
+	default:
+		releaseIdempotencyKey(openAIReq)
+	}
+	return response, err
+}
+
+// claimIdempotencyKey records the key of the request as in progress, returning false when another invocation
+// holds it or completed it. A claim left in progress for longer than a Lambda can run belonged to an invocation
+// that crashed, and is taken over.
+func claimIdempotencyKey(openAIRequest openAIRequest) (bool, error) {
+	cfg := openAIRequest.config
+	now := time.Now()
+	item := idempotencyKey(openAIRequest)
+	item["state"] = &dynamodb.AttributeValue{S: aws.String(idempotencyStateInProgress)}
+	item["started_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(cfg.IdempotencyTTL).Unix(), 10))}
+	_, err := openAIRequest.dynamoDBClient.PutItemWithContext(openAIRequest.ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(cfg.IdempotencyTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(idempotency_key) OR expires_at < :now OR (#state = :in_progress AND started_at < :stale)"),
+		ExpressionAttributeNames: map[string]*string{"#state": aws.String("state")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now":         {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":stale":       {N: aws.String(strconv.FormatInt(now.Add(-defaultInflightStaleAfter).Unix(), 10))},
+			":in_progress": {S: aws.String(idempotencyStateInProgress)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Can't claim idempotency key: %v", err)
+	}
+	return true, nil
+}
+
+// replayIdempotent answers a retry of a request claimed by another invocation, without calling OpenAI
+func replayIdempotent(openAIRequest openAIRequest) (events.APIGatewayProxyResponse, error) {
+	output, err := openAIRequest.dynamoDBClient.GetItemWithContext(openAIRequest.ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(openAIRequest.config.IdempotencyTable),
+		Key:            idempotencyKey(openAIRequest),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't read idempotency record", "error", err)
+		postErrorFrame(openAIRequest, errorCodeInternal, "Can't read idempotency record")
+		return errorResponse(fmt.Sprintf("Can't read idempotency record: %s", err), statusCodeServerError)
+	}
+	// The claim may have been released in between, the client retrying again gets a fresh claim
+	if state, ok := output.Item["state"]; !ok || aws.StringValue(state.S) != idempotencyStateCompleted {
+		openAIRequest.logger().Info("Duplicate of a request in progress")
+		postErrorFrame(openAIRequest, errorCodeDuplicateInProgress, "A request with this idempotency_key is in progress")
+		return errorResponse("Duplicate of a request in progress", statusCodeConflict)
+	}
+
+	openAIRequest.logger().Info("Replaying completed request")
+	var frames []string
+	if payload, ok := output.Item["frames"]; ok {
+		if err := json.Unmarshal([]byte(aws.StringValue(payload.S)), &frames); err != nil {
+			openAIRequest.logger().Warn("Can't decode stored frames", "error", err)
+			frames = nil
+		}
+	}
+	if len(frames) == 0 {
+		err = postControlFrame(openAIRequest, frameTypePreviouslyCompleted)
+	}
+	for _, frame := range frames {
+		if err = postToConnection(openAIRequest, []byte(frame)); err != nil {
+			break
+		}
+	}
+	if err != nil && !errors.Is(err, ErrClientGone) {
+		openAIRequest.logger().Error("Can't replay completed request", "error", err)
+		return errorResponse(fmt.Sprintf("Can't replay completed request: %s", err), statusCodeServerError)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
+
+// completeIdempotencyKey marks the claim completed, keeping the frames of the answer when they are small enough.
+// Streams only keep the completed marker, their frames are replayed as a previously_completed notice.
+func completeIdempotencyKey(openAIRequest openAIRequest, claim *idempotencyClaim) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(openAIRequest.ctx), idempotencyWriteTimeout)
+	defer cancel()
+	item := idempotencyKey(openAIRequest)
+	item["state"] = &dynamodb.AttributeValue{S: aws.String(idempotencyStateCompleted)}
+	item["expires_at"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(openAIRequest.config.IdempotencyTTL).Unix(), 10))}
+	if openAIRequest.request.ResponseType != responseTypeStream && !claim.overflow && len(claim.frames) > 0 {
+		data, err := json.Marshal(claim.frames)
+		if err != nil {
+			openAIRequest.logger().Warn("Can't encode frames for the idempotency record", "error", err)
+		} else {
+			item["frames"] = &dynamodb.AttributeValue{S: aws.String(string(data))}
+		}
+	}
+	_, err := openAIRequest.dynamoDBClient.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(openAIRequest.config.IdempotencyTable),
+		Item:      item,
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't complete idempotency record", "error", err)
+	}
+}
+
+// releaseIdempotencyKey deletes the claim of a failed request, so a retry is served again
+func releaseIdempotencyKey(openAIRequest openAIRequest) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(openAIRequest.ctx), idempotencyWriteTimeout)
+	defer cancel()
+	_, err := openAIRequest.dynamoDBClient.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 aws.String(openAIRequest.config.IdempotencyTable),
+		Key:                       idempotencyKey(openAIRequest),
+		ConditionExpression:       aws.String("#state = :in_progress"),
+		ExpressionAttributeNames:  map[string]*string{"#state": aws.String("state")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":in_progress": {S: aws.String(idempotencyStateInProgress)}},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		openAIRequest.logger().Error("Can't release idempotency key", "error", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testIdempotencyKey = "connection#conn-1#key-1"
+
+// idempotencyRecord builds the stored record of testIdempotencyKey in state, started at startedAt and expiring at
+// expiresAt, with the encoded frames when they are set
+func idempotencyRecord(state string, startedAt, expiresAt time.Time, frames string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{
+		"idempotency_key": {S: aws.String(testIdempotencyKey)},
+		"state":           {S: aws.String(state)},
+		"started_at":      {N: aws.String(strconv.FormatInt(startedAt.Unix(), 10))},
+		"expires_at":      {N: aws.String(strconv.FormatInt(expiresAt.Unix(), 10))},
+	}
+	if frames != "" {
+		item["frames"] = &dynamodb.AttributeValue{S: aws.String(frames)}
+	}
+	return item
+}
+
+// idempotencyConfig is a test configuration with the idempotency table, answering every delta in its own frame
+func idempotencyConfig(t *testing.T) *Config {
+	return testConfig(t, func(cfg *Config) {
+		cfg.IdempotencyTable = "idempotency"
+		cfg.IdempotencyTTL = time.Hour
+		cfg.OpenAIMaxRetries = 0
+		cfg.EndStreamMessage = "<END>"
+		cfg.StreamFlushInterval, cfg.StreamFlushBytes = 0, 1
+	})
+}
+
+func TestIdempotency(t *testing.T) {
+	now := time.Now()
+	const fullBody = `{"response_type":"full","prompt_template":"PROMPT_TEST","idempotency_key":"key-1","messages":[{"role":"user","content":"hi"}]}`
+	const streamBody = `{"response_type":"stream","prompt_template":"PROMPT_TEST","idempotency_key":"key-1","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name       string
+		stored     map[string]*dynamodb.AttributeValue
+		body       string
+		turn       testsupport.Turn
+		putErr     error
+		wantStatus int
+		wantFrames []string
+		wantCalls  int
+		wantState  string // State of the record after the request, empty when there is none
+		wantStored string // Frames kept in the record
+	}{
+		{
+			name:       "first request",
+			body:       fullBody,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hello"},
+			wantCalls:  1,
+			wantState:  idempotencyStateCompleted,
+			wantStored: `["Hello"]`,
+		},
+		{
+			// Streams only keep the completed marker
+			name:       "first stream",
+			body:       streamBody,
+			turn:       testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...),
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hel", "lo", "<END>"},
+			wantCalls:  1,
+			wantState:  idempotencyStateCompleted,
+		},
+		{
+			name:       "retry in progress",
+			stored:     idempotencyRecord(idempotencyStateInProgress, now, now.Add(time.Hour), ""),
+			body:       fullBody,
+			wantStatus: statusCodeConflict,
+			wantFrames: []string{`{"type":"error","code":"duplicate_in_progress","message":"A request with this idempotency_key is in progress"}`},
+			wantState:  idempotencyStateInProgress,
+		},
+		{
+			// The invocation holding the claim crashed, the retry takes it over
+			name:       "stale claim",
+			stored:     idempotencyRecord(idempotencyStateInProgress, now.Add(-time.Hour), now.Add(time.Hour), ""),
+			body:       fullBody,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hello"},
+			wantCalls:  1,
+			wantState:  idempotencyStateCompleted,
+			wantStored: `["Hello"]`,
+		},
+		{
+			name:       "retry after completion",
+			stored:     idempotencyRecord(idempotencyStateCompleted, now, now.Add(time.Hour), `["Hello before"]`),
+			body:       fullBody,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hello before"},
+			wantState:  idempotencyStateCompleted,
+			wantStored: `["Hello before"]`,
+		},
+		{
+			name:       "retry after a completed stream",
+			stored:     idempotencyRecord(idempotencyStateCompleted, now, now.Add(time.Hour), ""),
+			body:       streamBody,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{`{"type":"previously_completed"}`},
+			wantState:  idempotencyStateCompleted,
+		},
+		{
+			name:       "expired record",
+			stored:     idempotencyRecord(idempotencyStateCompleted, now.Add(-2*time.Hour), now.Add(-time.Hour), `["Hello before"]`),
+			body:       fullBody,
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"Hello"},
+			wantCalls:  1,
+			wantState:  idempotencyStateCompleted,
+			wantStored: `["Hello"]`,
+		},
+		{
+			// A failed request releases its key, so the client can try again
+			name:       "failure releases the key",
+			body:       fullBody,
+			turn:       testsupport.Fail(&openai.APIError{HTTPStatusCode: 500, Message: "boom"}),
+			wantStatus: statusCodeServerError,
+			wantCalls:  1,
+		},
+		{
+			name:       "claim failure",
+			body:       fullBody,
+			putErr:     errors.New("throttled"),
+			wantStatus: statusCodeServerError,
+			wantFrames: []string{`{"type":"error","code":"internal_error","message":"Can't claim idempotency key"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := idempotencyConfig(t)
+			db := newFakeDynamoDB().table("idempotency", "idempotency_key")
+			if tt.stored != nil {
+				db.put("idempotency", tt.stored)
+			}
+			if tt.putErr != nil {
+				db.fail("PutItem", tt.putErr)
+			}
+			turn := tt.turn
+			if turn.Chunks == nil && turn.Err == nil {
+				turn = testsupport.Reply("Hello")
+			}
+			chat := testsupport.NewScriptedCompleter(turn)
+			poster := testsupport.NewRecordingPoster()
+			response, err := newTestHandler(cfg, chat, poster, db, nil).Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			if got := len(chat.Requests()); got != tt.wantCalls {
+				t.Errorf("OpenAI requests = %d, want %d", got, tt.wantCalls)
+			}
+			if tt.putErr != nil {
+				return
+			}
+			record := db.item("idempotency", map[string]*dynamodb.AttributeValue{"idempotency_key": {S: aws.String(testIdempotencyKey)}})
+			var state, stored string
+			if record != nil {
+				state = aws.StringValue(record["state"].S)
+				if frames, ok := record["frames"]; ok {
+					stored = aws.StringValue(frames.S)
+				}
+			}
+			if state != tt.wantState || stored != tt.wantStored {
+				t.Errorf("record = %q with frames %q, want %q with %q", state, stored, tt.wantState, tt.wantStored)
+			}
+		})
+	}
+}
+
+// gatedCompleter answers chat completions only once release is closed
+type gatedCompleter struct {
+	*testsupport.ScriptedCompleter
+	release chan struct{}
+}
+
+func (c gatedCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	<-c.release
+	return c.ScriptedCompleter.CreateChatCompletion(ctx, request)
+}
+
+// TestIdempotencyConcurrentRetries sends the same request several times at once. The conditional claim lets a
+// single one call OpenAI while the others are told it's in progress, and a later retry replays its answer.
+func TestIdempotencyConcurrentRetries(t *testing.T) {
+	const retries = 5
+	const body = `{"response_type":"full","prompt_template":"PROMPT_TEST","idempotency_key":"key-1","messages":[{"role":"user","content":"hi"}]}`
+	cfg := idempotencyConfig(t)
+	db := newFakeDynamoDB().table("idempotency", "idempotency_key")
+	chat := gatedCompleter{
+		ScriptedCompleter: testsupport.NewScriptedCompleter(testsupport.Reply("Hello")),
+		release:           make(chan struct{}),
+	}
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+
+	statuses := make(chan int, retries)
+	var wg sync.WaitGroup
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, _ := h.Handler(context.Background(), testMessage(body))
+			statuses <- response.StatusCode
+		}()
+	}
+	// The duplicates are answered while the claim holder waits for OpenAI
+	for i := 0; i < retries-1; i++ {
+		select {
+		case status := <-statuses:
+			if status != statusCodeConflict {
+				t.Errorf("duplicate answered %d, want %d", status, statusCodeConflict)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of the duplicates were answered while a request was in progress", i)
+		}
+	}
+	close(chat.release)
+	wg.Wait()
+	if status := <-statuses; status != statusCodeOK {
+		t.Errorf("claim holder answered %d, want %d", status, statusCodeOK)
+	}
+	if got := len(chat.Requests()); got != 1 {
+		t.Fatalf("OpenAI requests = %d, want 1", got)
+	}
+
+	poster := testsupport.NewRecordingPoster()
+	h.localPoster = poster
+	response, err := h.Handler(context.Background(), testMessage(body))
+	if err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+	}
+	if !reflect.DeepEqual(poster.Texts(), []string{"Hello"}) || len(chat.Requests()) != 1 {
+		t.Errorf("replay frames = %q after %d OpenAI requests, want the stored answer without a new request", poster.Texts(), len(chat.Requests()))
+	}
+}
+
+func TestValidateIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		table   string
+		key     string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "with a table", table: "idempotency", key: "key-1"},
+		{name: "without a table", key: "key-1", wantErr: "idempotency_key is not supported without an idempotency table"},
+		{name: "too long", table: "idempotency", key: strings.Repeat("k", maxRequestIDLength+1), wantErr: "idempotency_key is longer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRequestParams(testConfig(t, func(cfg *Config) { cfg.IdempotencyTable = tt.table }), Request{ResponseType: responseTypeFull, PromptTemplate: "PROMPT_TEST", Messages: []chatMessage{{Role: "user", Content: "hi"}}, IdempotencyKey: tt.key})
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("validateRequestParams() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	errorCodeTooManyInflight  = "too_many_inflight"
+	defaultMaxInflight        = 3
+	defaultInflightStaleAfter = 15 * time.Minute // The longest Lambda timeout
+	inflightReleaseTimeout    = 2 * time.Second
+)
+
+// acquireInflight counts a request against MAX_INFLIGHT_PER_CONNECTION in the connection record. A counter
+// untouched for longer than INFLIGHT_STALE_SECONDS is reset, since Lambdas that crashed never released it.
+// It returns false when the connection is at the cap.
+func acquireInflight(openAIRequest openAIRequest) (bool, error) {
+	cfg := openAIRequest.config
+	now := openAIRequest.getClock().Now()
+	values := map[string]*dynamodb.AttributeValue{
+		":one":     {N: aws.String("1")},
+		":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		":expires": {N: aws.String(strconv.FormatInt(now.Add(connectionRecordTTL).Unix(), 10))},
+	}
+
+	incrementValues := map[string]*dynamodb.AttributeValue{":zero": {N: aws.String("0")}, ":max": {N: aws.String(strconv.Itoa(cfg.MaxInflight))}}
+	maps.Copy(incrementValues, values)
+	_, err := openAIRequest.dynamoDBClient.UpdateItemWithContext(openAIRequest.ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(cfg.ConnectionsTable),
+		Key:                       connectionKey(openAIRequest.ConnectionId),
+		UpdateExpression:          aws.String("SET inflight = if_not_exists(inflight, :zero) + :one, inflight_started = :now, expires_at = if_not_exists(expires_at, :expires)"),
+		ConditionExpression:       aws.String("attribute_not_exists(inflight) OR inflight < :max"),
+		ExpressionAttributeValues: incrementValues,
+	})
+	if !isConditionalCheckFailed(err) {
+		return err == nil, err
+	}
+
+	// At the cap: take over the counter if no request started for longer than a Lambda can run
+	values[":stale"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(-cfg.InflightStaleAfter).Unix(), 10))}
+	_, err = openAIRequest.dynamoDBClient.UpdateItemWithContext(openAIRequest.ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(cfg.ConnectionsTable),
+		Key:                       connectionKey(openAIRequest.ConnectionId),
+		UpdateExpression:          aws.String("SET inflight = :one, inflight_started = :now, expires_at = if_not_exists(expires_at, :expires)"),
+		ConditionExpression:       aws.String("inflight_started < :stale"),
+		ExpressionAttributeValues: values,
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err == nil {
+		openAIRequest.logger().Warn("Reset stale in-flight counter")
+	}
+	return err == nil, err
+}
+
+// releaseInflight decrements the in-flight counter of the connection. It runs after the request is done,
+// so it gets its own short deadline rather than the possibly expired one of the invocation.
+func releaseInflight(openAIRequest openAIRequest) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(openAIRequest.ctx), inflightReleaseTimeout)
+	defer cancel()
+	_, err := openAIRequest.dynamoDBClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(openAIRequest.config.ConnectionsTable),
+		Key:                       connectionKey(openAIRequest.ConnectionId),
+		UpdateExpression:          aws.String("SET inflight = inflight - :one"),
+		ConditionExpression:       aws.String("inflight > :zero"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":one": {N: aws.String("1")}, ":zero": {N: aws.String("0")}},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		openAIRequest.logger().Error("Can't release in-flight counter", "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// inflightCount returns the in-flight counter of the record of conn-1
+func inflightCount(t *testing.T, db *fakeDynamoDB) int {
+	t.Helper()
+	record := db.item("connections", connectionKey("conn-1"))
+	if record == nil || record["inflight"] == nil {
+		return 0
+	}
+	count, err := strconv.Atoi(aws.StringValue(record["inflight"].N))
+	if err != nil {
+		t.Fatalf("inflight = %v: %v", record["inflight"], err)
+	}
+	return count
+}
+
+func TestAcquireInflight(t *testing.T) {
+	tests := []struct {
+		name         string
+		inflight     int
+		startedAgo   time.Duration
+		wantAcquired bool
+		wantInflight int
+	}{
+		{name: "first request", wantAcquired: true, wantInflight: 1},
+		{name: "below the cap", inflight: 2, startedAgo: time.Minute, wantAcquired: true, wantInflight: 3},
+		{name: "at the cap", inflight: 3, startedAgo: time.Minute, wantInflight: 3},
+		{name: "stale counter", inflight: 3, startedAgo: 20 * time.Minute, wantAcquired: true, wantInflight: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{ConnectionsTable: "connections", MaxInflight: 3, InflightStaleAfter: defaultInflightStaleAfter}
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			if tt.inflight > 0 {
+				item := connectionKey("conn-1")
+				item["inflight"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(tt.inflight))}
+				item["inflight_started"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(testStart.Add(-tt.startedAgo).Unix(), 10))}
+				db.put("connections", item)
+			}
+			openAIRequest := openAIRequest{ctx: context.Background(), config: cfg, ConnectionId: "conn-1", dynamoDBClient: db, clock: testsupport.NewClock(testStart)}
+
+			acquired, err := acquireInflight(openAIRequest)
+			if err != nil || acquired != tt.wantAcquired {
+				t.Fatalf("acquireInflight() = %v, %v, want %v", acquired, err, tt.wantAcquired)
+			}
+			if got := inflightCount(t, db); got != tt.wantInflight {
+				t.Fatalf("inflight after acquiring = %d, want %d", got, tt.wantInflight)
+			}
+			if !acquired {
+				return
+			}
+			releaseInflight(openAIRequest)
+			if got := inflightCount(t, db); got != tt.wantInflight-1 {
+				t.Errorf("inflight after releasing = %d, want %d", got, tt.wantInflight-1)
+			}
+		})
+	}
+}
+
+func TestReleaseInflightStopsAtZero(t *testing.T) {
+	db := newFakeDynamoDB().table("connections", "connection_id")
+	item := connectionKey("conn-1")
+	item["inflight"] = &dynamodb.AttributeValue{N: aws.String("0")}
+	db.put("connections", item)
+	releaseInflight(openAIRequest{ctx: context.Background(), config: &Config{ConnectionsTable: "connections"}, ConnectionId: "conn-1", dynamoDBClient: db})
+	if got := inflightCount(t, db); got != 0 {
+		t.Errorf("inflight = %d, want 0", got)
+	}
+}
+
+func TestInflightRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		inflight     int
+		turn         testsupport.Turn
+		wantStatus   int
+		wantCode     string
+		wantRequests int
+	}{
+		{name: "released after success", turn: testsupport.Reply("Hello"), wantStatus: statusCodeOK, wantRequests: 1},
+		{name: "released after a failure", turn: testsupport.Fail(&openai.APIError{HTTPStatusCode: 400, Message: "bad request"}), wantStatus: statusCodeServerError, wantRequests: 1},
+		{name: "rejected at the cap", inflight: 3, turn: testsupport.Reply("Hello"), wantStatus: statusCodeTooMany, wantCode: errorCodeTooManyInflight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.ConnectionsTable = "connections"
+				cfg.MaxInflight = 3
+			})
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			if tt.inflight > 0 {
+				item := connectionKey("conn-1")
+				item["inflight"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(tt.inflight))}
+				item["inflight_started"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(testStart.Unix(), 10))}
+				db.put("connections", item)
+			}
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			poster := testsupport.NewRecordingPoster()
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","protocol":"v2","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart)).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d, %v, want %d", response.StatusCode, err, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("OpenAI got %d requests, want %d", got, tt.wantRequests)
+			}
+			if got := inflightCount(t, db); got != tt.inflight {
+				t.Errorf("inflight after the request = %d, want %d", got, tt.inflight)
+			}
+			if tt.wantCode != "" {
+				envelopes := decodeEnvelopes(t, poster.Texts())
+				if len(envelopes) != 1 || envelopes[0].Code != tt.wantCode {
+					t.Errorf("frames = %q, want a %s error", poster.Texts(), tt.wantCode)
+				}
+			}
+		})
+	}
+}
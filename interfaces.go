@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	"github.com/sashabaranov/go-openai"
+)
+
+// ConnectionPoster posts frames to websocket connections
+type ConnectionPoster interface {
+	PostToConnection(ctx context.Context, connectionID string, data []byte) error
+}
+
+// DeadLetterSink keeps the payloads that couldn't be posted to their connection
+type DeadLetterSink interface {
+	SendFailedDelivery(ctx context.Context, delivery failedDelivery) error
+}
+
+// ChatCompleter sends chat completion requests to the OpenAI API, and lists the models for the model validation
+type ChatCompleter interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error)
+	ListModels(ctx context.Context) (openai.ModelsList, error)
+	Moderations(ctx context.Context, request openai.ModerationRequest) (openai.ModerationResponse, error)
+}
+
+// ChatStream receives the chunks of a streamed chat completion. It is an alias of the interface literal rather
+// than a named type, so ChatCompleter implementations outside this package, like the testsupport fakes, can
+// return a stream without importing package main.
+type ChatStream = interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// Clock tells the time for the stream timeouts, the flush timing and the pong frames, so tests can drive them
+// with a controlled clock. AfterFunc calls f once d has passed, unless the returned stop function is called first.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// systemClock is the Clock of the time package
+type systemClock struct{}
+
+// Now returns the current time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// AfterFunc starts a timer calling f in its own goroutine
+func (systemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// apiGatewayPoster is the ConnectionPoster backed by the API Gateway Management API
+type apiGatewayPoster struct {
+	client *apigatewaymanagementapi.Client
+}
+
+// PostToConnection posts data to the connection, returning the API Gateway error unchanged
+func (p apiGatewayPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	_, err := p.client.PostToConnection(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         data,
+	})
+	return err
+}
+
+// openAIChatCompleter is the ChatCompleter backed by the OpenAI client
+type openAIChatCompleter struct {
+	*openai.Client
+}
+
+// CreateChatCompletionStream opens a chat completion stream
+func (c openAIChatCompleter) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := c.Client.CreateChatCompletionStream(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// newTestAPIGatewayPoster returns the v2 SDK backed poster sending its calls to server, without retries
+func newTestAPIGatewayPoster(server *httptest.Server) apiGatewayPoster {
+	client := apigatewaymanagementapi.New(apigatewaymanagementapi.Options{
+		Region:       "eu-west-1",
+		BaseEndpoint: awsv2.String(server.URL),
+		HTTPClient:   server.Client(),
+		Retryer:      awsv2.NopRetryer{},
+		Credentials: awsv2.CredentialsProviderFunc(func(ctx context.Context) (awsv2.Credentials, error) {
+			return awsv2.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return apiGatewayPoster{client: client}
+}
+
+// TestAPIGatewayPosterErrors checks the classification of the errors the v2 SDK returns for the failures of
+// PostToConnection, as API Gateway reports them
+func TestAPIGatewayPosterErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		errorType     string // X-Amzn-ErrorType of the response
+		wantGone      bool
+		wantThrottled bool
+		wantTooLarge  bool
+	}{
+		{name: "posted", status: http.StatusOK},
+		{name: "gone exception", status: http.StatusGone, errorType: "GoneException", wantGone: true},
+		{name: "limit exceeded exception", status: http.StatusTooManyRequests, errorType: "LimitExceededException", wantThrottled: true},
+		{name: "payload too large exception", status: http.StatusRequestEntityTooLarge, errorType: "PayloadTooLargeException", wantTooLarge: true},
+		// Without a known exception type the status still tells
+		{name: "bare 410", status: http.StatusGone, wantGone: true},
+		{name: "bare 429", status: http.StatusTooManyRequests, wantThrottled: true},
+		{name: "forbidden", status: http.StatusForbidden, errorType: "ForbiddenException"},
+		{name: "server error", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				path, body = r.URL.Path, string(data)
+				if tt.errorType != "" {
+					w.Header().Set("X-Amzn-ErrorType", tt.errorType)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				if tt.status != http.StatusOK {
+					fmt.Fprint(w, `{"message":"failed"}`)
+				}
+			}))
+			defer server.Close()
+
+			err := newTestAPIGatewayPoster(server).PostToConnection(context.Background(), "conn-1", []byte("Hello"))
+			if path != "/@connections/conn-1" || body != "Hello" {
+				t.Errorf("posted %q to %s, want Hello to /@connections/conn-1", body, path)
+			}
+			if (err != nil) != (tt.status != http.StatusOK) {
+				t.Fatalf("PostToConnection() error = %v, want one for status %d", err, tt.status)
+			}
+			if got := isGoneError(err); got != tt.wantGone {
+				t.Errorf("isGoneError(%v) = %v, want %v", err, got, tt.wantGone)
+			}
+			if got := isThrottlingError(err); got != tt.wantThrottled {
+				t.Errorf("isThrottlingError(%v) = %v, want %v", err, got, tt.wantThrottled)
+			}
+			if got := isPayloadTooLargeError(err); got != tt.wantTooLarge {
+				t.Errorf("isPayloadTooLargeError(%v) = %v, want %v", err, got, tt.wantTooLarge)
+			}
+		})
+	}
+}
+
+func TestPostErrorClassification(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantGone      bool
+		wantThrottled bool
+		wantTooLarge  bool
+		wantStatus    int
+	}{
+		{name: "gone exception", err: &apigwtypes.GoneException{}, wantGone: true},
+		{name: "wrapped limit exceeded exception", err: fmt.Errorf("post: %w", &apigwtypes.LimitExceededException{}), wantThrottled: true},
+		{name: "payload too large exception", err: &apigwtypes.PayloadTooLargeException{}, wantTooLarge: true},
+		{name: "410 status", err: testsupport.ErrGone, wantGone: true, wantStatus: http.StatusGone},
+		{name: "429 status", err: &testsupport.StatusError{Code: http.StatusTooManyRequests}, wantThrottled: true, wantStatus: http.StatusTooManyRequests},
+		{name: "413 status", err: &testsupport.StatusError{Code: http.StatusRequestEntityTooLarge}, wantTooLarge: true, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "wrapped status", err: &postError{err: &testsupport.StatusError{Code: http.StatusGone}}, wantGone: true, wantStatus: http.StatusGone},
+		{name: "no response", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isGoneError(tt.err); got != tt.wantGone {
+				t.Errorf("isGoneError() = %v, want %v", got, tt.wantGone)
+			}
+			if got := isThrottlingError(tt.err); got != tt.wantThrottled {
+				t.Errorf("isThrottlingError() = %v, want %v", got, tt.wantThrottled)
+			}
+			if got := isPayloadTooLargeError(tt.err); got != tt.wantTooLarge {
+				t.Errorf("isPayloadTooLargeError() = %v, want %v", got, tt.wantTooLarge)
+			}
+			if got := postErrorStatus(tt.err); got != tt.wantStatus {
+				t.Errorf("postErrorStatus() = %d, want %d", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// TestPostToConnectionV2 checks that postToConnection treats the v2 SDK errors of a real client as before:
+// a gone connection ends the request, a throttled post is retried
+func TestPostToConnectionV2(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []int // Status of each call, the last one repeating
+		wantErr   error
+		wantCalls int
+	}{
+		{name: "gone", responses: []int{http.StatusGone}, wantErr: ErrClientGone, wantCalls: 1},
+		{name: "throttled once", responses: []int{http.StatusTooManyRequests, http.StatusOK}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tt.responses[min(calls, len(tt.responses)-1)]
+				calls++
+				switch status {
+				case http.StatusGone:
+					w.Header().Set("X-Amzn-ErrorType", "GoneException")
+				case http.StatusTooManyRequests:
+					w.Header().Set("X-Amzn-ErrorType", "LimitExceededException")
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			cfg := testConfig(t, nil)
+			openAIReq := newTestHandler(cfg, testsupport.NewScriptedCompleter(), newTestAPIGatewayPoster(server), nil, nil).
+				createOpenAIRequest(context.Background(), cfg, Request{ResponseType: responseTypeFull}, "conn-1")
+			err := postToConnection(openAIReq, []byte("Hello"))
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("postToConnection() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("PostToConnection calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
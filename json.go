@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+)
+
+// errSchemaMismatch is returned when the JSON output doesn't match the schema supplied in the request
+var errSchemaMismatch = errors.New("output does not match the JSON schema")
+
+// getJSONOpenAIResponse gets a JSON response from OpenAI, validates it and sends it to the client.
+// Invalid output is sent back to the model with a corrective message up to OPENAI_JSON_RETRIES times.
+func getJSONOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	reply, info, err := generateJSON(ctx, openAIRequest, openAIRequest.request)
+	if err != nil {
+		return err
+	}
+	return deliverAnswer(openAIRequest, []byte(reply), reply, info)
+}
+
+// generateJSON returns the valid JSON output of the model for request along with its completion info,
+// whose usage covers the corrective attempts
+func generateJSON(ctx context.Context, openAIRequest openAIRequest, request Request) (string, completionInfo, error) {
+	// Copy the messages so the corrective turns don't leak into the caller's request
+	request.Messages = append([]chatMessage(nil), request.Messages...)
+	var usage openai.Usage
+
+	for attempt := 0; ; attempt++ {
+		response, err := initPrefilledRequest(ctx, openAIRequest, request)
+		if err != nil {
+			return "", completionInfo{}, err
+		}
+		addUsage(&usage, response.Usage)
+		if len(response.Choices) == 0 {
+			return "", completionInfo{}, ErrNoChoices
+		}
+
+		reply := response.Choices[0].Message.Content
+		err = validateJSONReply(reply, request.Schema)
+		if err == nil {
+			info, err := newCompletionInfo(response)
+			if err != nil {
+				return "", completionInfo{}, err
+			}
+			info.Usage = usage
+			return reply, info, nil
+		}
+
+		openAIRequest.logger().Warn("Invalid JSON output", "attempt", attempt+1, "error", err)
+		if attempt >= openAIRequest.config.OpenAIJSONRetries {
+			return "", completionInfo{}, fmt.Errorf("%w after %d attempts: %v", ErrUnparsableResponse, attempt+1, err)
+		}
+
+		request.Messages = append(request.Messages,
+			chatMessage{Role: openai.ChatMessageRoleAssistant, Content: reply},
+			chatMessage{Role: openai.ChatMessageRoleUser, Content: fmt.Sprintf("Your previous output was invalid: %v", err)},
+		)
+	}
+}
+
+// validateJSONReply checks that reply is valid JSON and, when a schema is given, that it matches the schema
+func validateJSONReply(reply string, schema *jsonschema.Definition) error {
+	var value any
+	if err := json.Unmarshal([]byte(reply), &value); err != nil {
+		return fmt.Errorf("output is not valid JSON: %v", err)
+	}
+	if schema != nil && !jsonschema.Validate(*schema, value) {
+		return errSchemaMismatch
+	}
+	return nil
+}
+
+// checkSchemaDefinition rejects schemas the validator can't evaluate, such as arrays without an items schema
+func checkSchemaDefinition(schema jsonschema.Definition) error {
+	if schema.Type == "" && schema.Ref == "" {
+		return fmt.Errorf("schema type is required")
+	}
+	if schema.Type == jsonschema.Array {
+		if schema.Items == nil {
+			return fmt.Errorf("array schema requires items")
+		}
+		if err := checkSchemaDefinition(*schema.Items); err != nil {
+			return err
+		}
+	}
+	for name, property := range schema.Properties {
+		if err := checkSchemaDefinition(property); err != nil {
+			return fmt.Errorf("property %s: %v", name, err)
+		}
+	}
+	for name, def := range schema.Defs {
+		if err := checkSchemaDefinition(def); err != nil {
+			return fmt.Errorf("definition %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/sashabaranov/go-openai/jsonschema"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestValidateJSONReply(t *testing.T) {
+	schema := &jsonschema.Definition{
+		Type:       jsonschema.Object,
+		Properties: map[string]jsonschema.Definition{"score": {Type: jsonschema.Integer}},
+		Required:   []string{"score"},
+	}
+	tests := []struct {
+		name    string
+		reply   string
+		schema  *jsonschema.Definition
+		wantErr string
+	}{
+		{name: "valid without schema", reply: `{"anything":[1,2]}`},
+		{name: "valid with schema", reply: `{"score":3}`, schema: schema},
+		{name: "not JSON", reply: `score: 3`, wantErr: "output is not valid JSON"},
+		{name: "missing property", reply: `{"points":3}`, schema: schema, wantErr: errSchemaMismatch.Error()},
+		{name: "wrong type", reply: `{"score":"three"}`, schema: schema, wantErr: errSchemaMismatch.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJSONReply(tt.reply, tt.schema)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("validateJSONReply() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSchemaDefinition(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  jsonschema.Definition
+		wantErr string
+	}{
+		{name: "object", schema: jsonschema.Definition{Type: jsonschema.Object, Properties: map[string]jsonschema.Definition{"a": {Type: jsonschema.String}}}},
+		{name: "no type", schema: jsonschema.Definition{}, wantErr: "schema type is required"},
+		{name: "array without items", schema: jsonschema.Definition{Type: jsonschema.Array}, wantErr: "array schema requires items"},
+		{name: "bad property", schema: jsonschema.Definition{Type: jsonschema.Object, Properties: map[string]jsonschema.Definition{"a": {}}}, wantErr: "property a"},
+	}
+	for _, tt := range tests {
+		err := checkSchemaDefinition(tt.schema)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("checkSchemaDefinition(%s) error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJSONResponseRetries(t *testing.T) {
+	const schema = `"schema":{"type":"object","properties":{"score":{"type":"integer"}},"required":["score"]}`
+	tests := []struct {
+		name         string
+		turns        []testsupport.Turn
+		wantStatus   int
+		wantAnswer   string
+		wantRequests int
+	}{
+		{name: "first try", turns: []testsupport.Turn{testsupport.Reply(`{"score":4}`)}, wantStatus: statusCodeOK, wantAnswer: `{"score":4}`, wantRequests: 1},
+		{
+			name:         "retry then success",
+			turns:        []testsupport.Turn{testsupport.Reply(`score 4`), testsupport.Reply(`{"score":"4"}`), testsupport.Reply(`{"score":4}`)},
+			wantStatus:   statusCodeOK,
+			wantAnswer:   `{"score":4}`,
+			wantRequests: 3,
+		},
+		{name: "retries exhausted", turns: []testsupport.Turn{testsupport.Reply(`not JSON`)}, wantStatus: statusCodeBadGateway, wantRequests: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.OpenAIJSONRetries = 2 })
+			chat := testsupport.NewScriptedCompleter(tt.turns...)
+			body := `{"response_type":"json","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Rate it"}],` + schema + `}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if len(requests) != tt.wantRequests {
+				t.Fatalf("%d requests, want %d", len(requests), tt.wantRequests)
+			}
+			for i, request := range requests {
+				if request.ResponseFormat == nil || request.ResponseFormat.Type != openai.ChatCompletionResponseFormatTypeJSONObject {
+					t.Fatalf("request %d has response format %v, want json_object", i, request.ResponseFormat)
+				}
+				// Every retry carries the invalid output and a corrective message
+				if want := 2 + 2*i; len(request.Messages) != want {
+					t.Fatalf("request %d has %d messages, want %d", i, len(request.Messages), want)
+				}
+				if i > 0 && !strings.HasPrefix(request.Messages[len(request.Messages)-1].Content, "Your previous output was invalid: ") {
+					t.Fatalf("request %d ends with %q", i, request.Messages[len(request.Messages)-1].Content)
+				}
+			}
+			if tt.wantAnswer != "" && (len(poster.Texts()) == 0 || poster.Texts()[0] != tt.wantAnswer) {
+				t.Fatalf("frames = %q, want %s", poster.Texts(), tt.wantAnswer)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// languagePattern matches BCP-47 tags of a 2 or 3 letter language and optional script, region or variant subtags
+var languagePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// languageNames names the languages the answer language instruction is available for. Tags with subtags
+// that aren't listed fall back to their primary language.
+var languageNames = map[string]string{
+	"ar":      "Arabic",
+	"cs":      "Czech",
+	"da":      "Danish",
+	"de":      "German",
+	"el":      "Greek",
+	"en":      "English",
+	"en-gb":   "British English",
+	"en-us":   "American English",
+	"es":      "Spanish",
+	"fi":      "Finnish",
+	"fr":      "French",
+	"he":      "Hebrew",
+	"hi":      "Hindi",
+	"hu":      "Hungarian",
+	"id":      "Indonesian",
+	"it":      "Italian",
+	"ja":      "Japanese",
+	"ko":      "Korean",
+	"nl":      "Dutch",
+	"no":      "Norwegian",
+	"pl":      "Polish",
+	"pt":      "Portuguese",
+	"pt-br":   "Brazilian Portuguese",
+	"ro":      "Romanian",
+	"ru":      "Russian",
+	"sv":      "Swedish",
+	"th":      "Thai",
+	"tr":      "Turkish",
+	"uk":      "Ukrainian",
+	"vi":      "Vietnamese",
+	"zh":      "Chinese",
+	"zh-hans": "Simplified Chinese",
+	"zh-hant": "Traditional Chinese",
+}
+
+// languageName returns the name of the language of a BCP-47 tag, and false when the tag is malformed or its
+// language isn't in languageNames
+func languageName(tag string) (string, bool) {
+	if !languagePattern.MatchString(tag) {
+		return "", false
+	}
+	tag = strings.ToLower(tag)
+	if name, ok := languageNames[tag]; ok {
+		return name, true
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	name, ok := languageNames[primary]
+	return name, ok
+}
+
+// parseAllowedLanguages parses ALLOWED_LANGUAGES, a comma separated list of BCP-47 tags. An empty list allows
+// every language of languageNames.
+func parseAllowedLanguages(value string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	for _, tag := range splitList(value, nil) {
+		if _, ok := languageName(tag); !ok {
+			return nil, fmt.Errorf("Invalid language in environment variable ALLOWED_LANGUAGES: %s", tag)
+		}
+		allowed[strings.ToLower(tag)] = true
+	}
+	return allowed, nil
+}
+
+// checkLanguage checks that the language of the request is a known BCP-47 tag listed in ALLOWED_LANGUAGES
+func checkLanguage(cfg *Config, request Request) error {
+	if request.Language == "" {
+		return nil
+	}
+	if _, ok := languageName(request.Language); !ok {
+		return fmt.Errorf("language %q is not a supported BCP-47 language tag", request.Language)
+	}
+	if len(cfg.AllowedLanguages) > 0 && !cfg.AllowedLanguages[strings.ToLower(request.Language)] {
+		return fmt.Errorf("language %q is not allowed", request.Language)
+	}
+	return nil
+}
+
+// withLanguageInstruction appends the instruction to answer in the language of the request to the system
+// prompt. Extracting response types are left alone, their bracketed answers don't depend on the language.
+func withLanguageInstruction(systemPrompt string, request Request) string {
+	if request.Language == "" || isExtractorResponseType(request.ResponseType) || request.ResponseType == responseTypeList {
+		return systemPrompt
+	}
+	name, ok := languageName(request.Language)
+	if !ok {
+		return systemPrompt
+	}
+	instruction := fmt.Sprintf("Respond only in %s.", name)
+	if systemPrompt == "" {
+		return instruction
+	}
+	return systemPrompt + "\n\n" + instruction
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestLanguageName(t *testing.T) {
+	tests := []struct {
+		tag    string
+		want   string
+		wantOK bool
+	}{
+		{tag: "de", want: "German", wantOK: true},
+		{tag: "DE", want: "German", wantOK: true},
+		{tag: "pt-BR", want: "Brazilian Portuguese", wantOK: true},
+		{tag: "zh-Hant", want: "Traditional Chinese", wantOK: true},
+		// Subtags without a name of their own fall back to the primary language
+		{tag: "de-AT", want: "German", wantOK: true},
+		{tag: "sr-Latn-RS"},
+		{tag: "xx"},
+		{tag: "german"},
+		{tag: "d"},
+		{tag: "de_DE"},
+		{tag: "de-"},
+		{tag: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			got, ok := languageName(tt.tag)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("languageName(%q) = %q, %v, want %q, %v", tt.tag, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseAllowedLanguages(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{value: "", want: map[string]bool{}},
+		{value: "en, de,pt-BR", want: map[string]bool{"en": true, "de": true, "pt-br": true}},
+		{value: "en,klingon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAllowedLanguages(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAllowedLanguages() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseAllowedLanguages() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckLanguage(t *testing.T) {
+	sixLanguages := map[string]bool{"en": true, "de": true, "fr": true, "es": true, "it": true, "pt-br": true}
+	tests := []struct {
+		name     string
+		language string
+		allowed  map[string]bool
+		wantErr  bool
+	}{
+		{name: "no language", allowed: sixLanguages},
+		{name: "any known language", language: "ja"},
+		{name: "unknown language", language: "xx", wantErr: true},
+		{name: "malformed tag", language: "de_DE", wantErr: true},
+		{name: "allowed", language: "pt-BR", allowed: sixLanguages},
+		{name: "not allowed", language: "ja", allowed: sixLanguages, wantErr: true},
+		// The allow list names exact tags, a region of an allowed language isn't allowed with it
+		{name: "region not allowed", language: "de-AT", allowed: sixLanguages, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkLanguage(&Config{AllowedLanguages: tt.allowed}, Request{Language: tt.language})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLanguage() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestLanguageInstruction checks the system prompt that reaches OpenAI for each response type: the instruction
+// is appended for free text answers, and the extracting response types get the prompt they get without a language
+func TestLanguageInstruction(t *testing.T) {
+	const prompt = "You are a test assistant."
+	tests := []struct {
+		responseType string
+		reply        testsupport.Turn
+		wantPrompt   string // Empty for the system prompt of the same request without a language
+	}{
+		{responseType: responseTypeFull, reply: testsupport.Reply("Hallo"), wantPrompt: prompt + "\n\nRespond only in German."},
+		{responseType: responseTypeStream, reply: testsupport.Stream(testsupport.TextChunks(0, "Hal", "lo")...), wantPrompt: prompt + "\n\nRespond only in German."},
+		{responseType: responseTypeJSON, reply: testsupport.Reply(`{"gruss":"Hallo"}`), wantPrompt: prompt + "\n\nRespond only in German."},
+		{responseType: responseTypeInt, reply: testsupport.Reply("[[1]]")},
+		{responseType: responseTypeString, reply: testsupport.Reply("[[Hallo]]")},
+		{responseType: responseTypeBool, reply: testsupport.Reply("[[yes]]")},
+		{responseType: responseTypeFloat, reply: testsupport.Reply("[[0.5]]")},
+		{responseType: responseTypeList, reply: testsupport.Reply("[[a]] [[b]]")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			systemPrompt := func(language string) string {
+				t.Helper()
+				cfg := testConfig(t, func(cfg *Config) { cfg.StreamFlushInterval = 0 })
+				chat := testsupport.NewScriptedCompleter(tt.reply)
+				body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","language":"` + language + `","messages":[{"role":"user","content":"Greet me"}]}`
+				response, _ := runTestRequest(t, cfg, chat, body)
+				if response.StatusCode != statusCodeOK {
+					t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+				}
+				requests := chat.Requests()
+				if len(requests) != 1 {
+					t.Fatalf("%d requests, want 1", len(requests))
+				}
+				return requests[0].Messages[0].Content
+			}
+			want := tt.wantPrompt
+			if want == "" {
+				want = systemPrompt("")
+			}
+			if got := systemPrompt("de"); got != want {
+				t.Errorf("system prompt = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLanguageRejected(t *testing.T) {
+	tests := []struct {
+		name     string
+		language string
+		allowed  map[string]bool
+	}{
+		{name: "unknown", language: "xx"},
+		{name: "malformed", language: "Deutsch"},
+		{name: "not allowed", language: "ja", allowed: map[string]bool{"en": true, "de": true, "fr": true, "es": true, "it": true, "pt-br": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.AllowedLanguages = tt.allowed })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, _ := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","language":"`+tt.language+`","messages":[{"role":"user","content":"hi"}]}`)
+			if response.StatusCode != statusCodeBadRequest {
+				t.Errorf("Handler() = %d %s, want 400", response.StatusCode, response.Body)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the invalid request reached OpenAI")
+			}
+		})
+	}
+}
+
+func TestLoadConfigAllowedLanguages(t *testing.T) {
+	t.Setenv("ALLOWED_LANGUAGES", "en,DE")
+	cfg, err := loadConfig()
+	if err != nil || !reflect.DeepEqual(cfg.AllowedLanguages, map[string]bool{"en": true, "de": true}) {
+		t.Fatalf("loadConfig() = %v, %v, want en and de", cfg.AllowedLanguages, err)
+	}
+	t.Setenv("ALLOWED_LANGUAGES", "en,xx")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted an unknown language in ALLOWED_LANGUAGES")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	defaultLocalPort = 8080
+	localRouteKey    = "$default"
+	// localRequestTimeout stands in for the Lambda deadline, which is at most 15 minutes
+	localRequestTimeout = 15 * time.Minute
+)
+
+// localPoster is the ConnectionPoster of local development mode, writing frames to the sockets of the
+// local server. Posts to closed connections fail like a GoneException of the API Gateway Management API.
+type localPoster struct {
+	mu    sync.Mutex
+	conns map[string]*websocket.Conn
+}
+
+// PostToConnection writes data as a text message on the socket of connectionID
+func (p *localPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	p.mu.Lock()
+	conn, ok := p.conns[connectionID]
+	p.mu.Unlock()
+	if !ok {
+		return &apigwtypes.GoneException{Message: aws.String("connection closed")}
+	}
+	return websocket.Message.Send(conn, string(data))
+}
+
+func (p *localPoster) add(connectionID string, conn *websocket.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[connectionID] = conn
+}
+
+func (p *localPoster) remove(connectionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, connectionID)
+}
+
+// serveLocal runs a websocket server on LOCAL_PORT, so the proxy can be tried without deploying it.
+// Socket opens and closes go through the $connect and $disconnect routes, and every message through the
+// same Handler as on Lambda, with frames written back on the socket instead of posted to API Gateway.
+func (h *WebsocketHandler) serveLocal(cfg *Config) error {
+	poster := &localPoster{conns: map[string]*websocket.Conn{}}
+	h.localPoster = poster
+	addr := fmt.Sprintf(":%d", cfg.LocalPort)
+	slog.Info("Local development server listening", "address", addr)
+	return http.ListenAndServe(addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serveLocalConnection(w, r, poster)
+	}))
+}
+
+// serveLocalConnection runs the $connect route for an upgrade request, and serves the socket when it is accepted
+func (h *WebsocketHandler) serveLocalConnection(w http.ResponseWriter, r *http.Request, poster *localPoster) {
+	connectionID := localID()
+	response, err := h.Handler(r.Context(), localRequest(r, connectRouteKey, connectionID, ""))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if response.StatusCode != statusCodeOK {
+		http.Error(w, response.Body, response.StatusCode)
+		return
+	}
+
+	server := websocket.Server{
+		// Local clients are rarely browsers, so the Origin header isn't required
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(conn *websocket.Conn) {
+			poster.add(connectionID, conn)
+			// Requests still in flight when the socket closes are cancelled, like a disconnected client on Lambda
+			ctx, cancel := context.WithCancel(context.Background())
+			var inflight sync.WaitGroup
+			defer func() {
+				poster.remove(connectionID)
+				cancel()
+				inflight.Wait()
+				if _, err := h.Handler(context.Background(), localRequest(r, disconnectRouteKey, connectionID, "")); err != nil {
+					slog.Warn("Local $disconnect failed", "connection_id", connectionID, "error", err)
+				}
+			}()
+			for {
+				var message string
+				if err := websocket.Message.Receive(conn, &message); err != nil {
+					if !errors.Is(err, io.EOF) {
+						slog.Warn("Can't read from local connection", "connection_id", connectionID, "error", err)
+					}
+					return
+				}
+				// Messages are handled concurrently, as separate Lambda invocations would be
+				inflight.Add(1)
+				go func() {
+					defer inflight.Done()
+					requestCtx, cancelRequest := context.WithTimeout(ctx, localRequestTimeout)
+					defer cancelRequest()
+					response, err := h.Handler(requestCtx, localRequest(r, localRouteKey, connectionID, message))
+					if err != nil {
+						slog.Error("Local request failed", "connection_id", connectionID, "error", err)
+						return
+					}
+					slog.Debug("Local request done", "connection_id", connectionID, "status", response.StatusCode)
+				}()
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// localRequest builds the API Gateway websocket event of route for a connection of the local server
+func localRequest(r *http.Request, route string, connectionID string, body string) events.APIGatewayWebsocketProxyRequest {
+	query := map[string]string{}
+	for name, values := range r.URL.Query() {
+		query[name] = values[0]
+	}
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		headers[name] = values[0]
+	}
+	return events.APIGatewayWebsocketProxyRequest{
+		Body:                  body,
+		Headers:               headers,
+		QueryStringParameters: query,
+		RequestContext: events.APIGatewayWebsocketProxyRequestContext{
+			RouteKey:     route,
+			ConnectionID: connectionID,
+			RequestID:    localID(),
+			Identity:     events.APIGatewayRequestIdentity{SourceIP: r.RemoteAddr},
+		},
+	}
+}
+
+// localID returns a random identifier for the connections and requests of the local server
+func localID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+	"golang.org/x/net/websocket"
+)
+
+// startLocalServer runs the local development server of a handler answering with chat on a test listener and
+// returns its websocket URL
+func startLocalServer(t *testing.T, cfg *Config, chat ChatCompleter, db *fakeDynamoDB) string {
+	t.Helper()
+	poster := &localPoster{conns: map[string]*websocket.Conn{}}
+	h := newTestHandler(cfg, chat, poster, db, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.serveLocalConnection(w, r, poster)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// receiveLocal reads the messages of conn until one equals last, failing the test when none arrives in time
+func receiveLocal(t *testing.T, conn *websocket.Conn, last string) []string {
+	t.Helper()
+	var messages []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var message string
+		if err := websocket.Message.Receive(conn, &message); err != nil {
+			t.Fatalf("received %q, then %v", messages, err)
+		}
+		messages = append(messages, message)
+		if message == last {
+			return messages
+		}
+	}
+}
+
+func TestLocalServer(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.EndStreamMessage = "<END>"
+		cfg.StreamFlushInterval, cfg.StreamFlushBytes = 0, 1
+	})
+	db := newFakeDynamoDB().table("connections", "connection_id")
+	chat := testsupport.NewScriptedCompleter(
+		testsupport.Reply("Hello"),
+		testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...),
+	)
+	url := startLocalServer(t, cfg, chat, db)
+
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if db.count("PutItem") != 1 {
+		t.Errorf("$connect stored %d connection records, want 1", db.count("PutItem"))
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{name: "full", body: `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`, want: []string{"Hello"}},
+		{name: "stream", body: `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`, want: []string{"Hel", "lo", "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := websocket.Message.Send(conn, tt.body); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+			if got := receiveLocal(t, conn, tt.want[len(tt.want)-1]); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("messages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if len(chat.Requests()) != 2 {
+		t.Errorf("OpenAI requests = %d, want 2", len(chat.Requests()))
+	}
+
+	// Closing the socket runs $disconnect, which removes the connection record
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.count("DeleteItem") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("$disconnect didn't run after the socket closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLocalServerRejectsConnect(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.AuthMode, cfg.AuthSecret = authModeToken, testAuthSecret
+	})
+	url := startLocalServer(t, cfg, testsupport.NewScriptedCompleter(), newFakeDynamoDB().table("connections", "connection_id"))
+	if conn, err := websocket.Dial(url, "", "http://localhost/"); err == nil {
+		conn.Close()
+		t.Fatal("Dial() without a token succeeded, want the $connect route to reject it")
+	}
+	valid := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	conn, err := websocket.Dial(url+"?"+authQueryParameter+"="+valid, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("Dial() with a token error = %v", err)
+	}
+	conn.Close()
+}
+
+func TestLocalPosterGone(t *testing.T) {
+	poster := &localPoster{conns: map[string]*websocket.Conn{}}
+	err := poster.PostToConnection(context.Background(), "closed", []byte("Hello"))
+	if !isGoneError(err) {
+		t.Errorf("PostToConnection() to a closed connection error = %v, want a gone connection", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// logLevel is the level of the JSON logger, updated with every stored configuration snapshot
+var logLevel slog.LevelVar
+
+// loggerKey is the context key of the request logger
+type loggerKey struct{}
+
+// setupLogging makes a JSON logger writing to stdout the default logger
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: &logLevel})))
+}
+
+// parseLogLevel parses the LOG_LEVEL value, defaulting to info
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("Invalid log level in environment variable LOG_LEVEL: %s", value)
+	}
+	return level, nil
+}
+
+// withLogger returns a context carrying logger
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the request logger of ctx, or the default logger outside of a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return logger
+		}
+	}
+	return slog.Default()
+}
+
+// requestLogger returns a logger attaching the correlation IDs of the invocation to every line
+func requestLogger(cfg *Config, request events.APIGatewayWebsocketProxyRequest) *slog.Logger {
+	return slog.Default().With(
+		"request_id", request.RequestContext.RequestID,
+		"connection_id", request.RequestContext.ConnectionID,
+		"route_key", request.RequestContext.RouteKey,
+		"model", cfg.OpenAIModel,
+	)
+}
+
+// logger returns the request logger
+func (r openAIRequest) logger() *slog.Logger {
+	return loggerFrom(r.ctx)
+}
+
+// loggedPayload returns s for logging when LOG_PROMPTS is enabled and only its size otherwise,
+// so prompts and model output don't end up in CloudWatch by default
+func loggedPayload(cfg *Config, s string) string {
+	if cfg.LogPrompts {
+		return s
+	}
+	return fmt.Sprintf("[%d bytes redacted]", len(s))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{value: "", want: slog.LevelInfo},
+		{value: "debug", want: slog.LevelDebug},
+		{value: "WARN", want: slog.LevelWarn},
+		{value: "error", want: slog.LevelError},
+		{value: "verbose", want: slog.LevelInfo, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLogLevel(tt.value)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("parseLogLevel(%q) = %v, %v, want %v, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// captureLogs makes a debug level JSON logger writing to the returned buffer the default logger for the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	original := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(original) })
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	return &buffer
+}
+
+func TestPromptsAreNotLogged(t *testing.T) {
+	const prompt, reply = "my secret diagnosis", "a secret reply without an answer"
+	tests := []struct {
+		logPrompts bool
+		wantLogged bool
+	}{
+		{logPrompts: false, wantLogged: false},
+		{logPrompts: true, wantLogged: true},
+	}
+	for _, tt := range tests {
+		t.Run("LOG_PROMPTS="+strconv.FormatBool(tt.logPrompts), func(t *testing.T) {
+			logs := captureLogs(t)
+			cfg := testConfig(t, func(cfg *Config) { cfg.LogPrompts = tt.logPrompts })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+			body := `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"` + prompt + `"}]}`
+			if response, _ := runTestRequest(t, cfg, chat, body); response.StatusCode != statusCodeBadGateway {
+				t.Fatalf("StatusCode = %d, want %d", response.StatusCode, statusCodeBadGateway)
+			}
+
+			output := logs.String()
+			for _, payload := range []string{prompt, reply} {
+				if logged := strings.Contains(output, payload); logged != tt.wantLogged {
+					t.Errorf("%q logged = %v, want %v", payload, logged, tt.wantLogged)
+				}
+			}
+			lines := strings.Split(strings.TrimSpace(output), "\n")
+			for _, line := range lines {
+				var record map[string]any
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("log line %q isn't JSON: %v", line, err)
+				}
+				for _, key := range []string{"request_id", "connection_id", "route_key", "model"} {
+					if _, ok := record[key]; !ok {
+						t.Errorf("log line %q has no %s", line, key)
+					}
+				}
+			}
+			if !strings.Contains(output, `"level":"ERROR"`) || !strings.Contains(output, ErrUnparsableResponse.Error()) {
+				t.Errorf("logs %s don't report the failure with its cause", output)
+			}
+		})
+	}
+}
@@ -6,80 +6,306 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
-	"regexp"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdaurl"
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-sdk-go/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/firehose/firehoseiface"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/sashabaranov/go-openai"
-
+	"github.com/sashabaranov/go-openai/jsonschema"
 )
 
 const (
-	defaultModel          = "gpt-3.5-turbo"
-	statusCodeOK          = 200
-	statusCodeBadRequest  = 400
-	statusCodeServerError = 500
-	connectRouteKey       = "$connect"
-	disconnectRouteKey    = "$disconnect"
-	responseTypeInt       = "int"
-	responseTypeString    = "string"
-	responseTypeFull      = "full"
-	responseTypeStream    = "stream"
-	endStreamMessage      = "<END>"
+	defaultModel            = "gpt-3.5-turbo"
+	statusCodeOK            = 200
+	statusCodeBadRequest    = 400
+	statusCodeUnauthorized  = 401
+	statusCodeNotFound      = 404
+	statusCodeTooMany       = 429
+	statusCodeServerError   = 500
+	statusCodeBadGateway    = 502
+	statusCodeUnavailable   = 503
+	connectRouteKey         = "$connect"
+	disconnectRouteKey      = "$disconnect"
+	responseTypeInt         = "int"
+	responseTypeString      = "string"
+	responseTypeFull        = "full"
+	responseTypeStream      = "stream"
+	responseTypeJSON        = "json"
+	responseTypeBool        = "bool"
+	responseTypeFloat       = "float"
+	responseTypeChoice      = "choice"
+	responseTypeList        = "list"
+	defaultEndStreamMessage = "<END>"
+	defaultJSONRetries      = 2
+	openAIDialTimeout       = 5 * time.Second
+	// openAIResponseHeaderTimeout allows for long non-stream completions, whose headers only arrive with the answer
+	openAIResponseHeaderTimeout = 3 * time.Minute
+	openAIMaxIdleConnsPerHost   = 16
 )
 
 type chatMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Name tells apart the speakers of a role, such as the users of a group chat
+	Name string `json:"name,omitempty"`
+	// Parts holds the content when it was sent as an array of text and image_url parts
+	Parts []contentPart `json:"-"`
+	// ToolCalls are the tool invocations of an assistant message, sent back along with their results
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+	// ToolCallID names the tool call a message with the tool role is the result of
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 type Request struct {
-	PromptTemplate string        `json:"prompt_template"`
-	Messages       []chatMessage `json:"messages"`
-	ResponseType   string        `json:"response_type"`
+	PromptTemplate   string        `json:"prompt_template"`
+	Messages         []chatMessage `json:"messages"`
+	ResponseType     string        `json:"response_type"`
+	Temperature      *float32      `json:"temperature,omitempty"`
+	TopP             *float32      `json:"top_p,omitempty"`
+	MaxTokens        *int          `json:"max_tokens,omitempty"`
+	PresencePenalty  *float32      `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32      `json:"frequency_penalty,omitempty"`
+	RawOutput        bool          `json:"raw_output,omitempty"`
+	// NormalizeText set to false skips the text normalization of the output and the inline system prompt
+	NormalizeText *bool `json:"normalize_text,omitempty"`
+	// Seed makes OpenAI sample deterministically on a best effort basis
+	Seed *int `json:"seed,omitempty"`
+	// Stop lists up to 4 sequences that end the answer
+	Stop []string `json:"stop,omitempty"`
+	// N requests that many answers, returned as candidates by the full response type and voted on by the extractors
+	N int `json:"n,omitempty"`
+	// Votes runs that many completions of the int response type and returns the most common integer
+	Votes int `json:"votes,omitempty"`
+	// LogitBias maps token IDs to a bias between -100 and 100, out of range values are clamped
+	LogitBias map[string]int `json:"logit_bias,omitempty"`
+	// IncludeMetadata makes the full response type return the complete OpenAI response JSON instead of the text
+	IncludeMetadata bool `json:"include_metadata,omitempty"`
+	// IncludeUsage posts a usage frame with the token counts after the answer
+	IncludeUsage bool `json:"include_usage,omitempty"`
+	// Protocol selects the frame format, "v2" wraps every frame in a JSON envelope
+	Protocol string `json:"protocol,omitempty"`
+	// ExtractPattern optionally replaces the [[...]] pattern of the int and string response types
+	ExtractPattern string `json:"extract_pattern,omitempty"`
+	// Choices lists the answers allowed for the choice response type, defaulting to A, B, C and D
+	Choices []string `json:"choices,omitempty"`
+	// MaxItems caps the number of items returned by the list response type
+	MaxItems int `json:"max_items,omitempty"`
+	// RequestID is an optional client supplied ID echoed in control frames, and used to cancel a stream
+	RequestID string `json:"request_id,omitempty"`
+	// StructuredEnd ends legacy streams with a JSON end frame carrying the finish reason instead of the end stream message
+	StructuredEnd bool `json:"structured_end,omitempty"`
+	// ReportFinishReason posts a finish_reason frame to legacy clients when the answer didn't end with a regular stop
+	ReportFinishReason bool `json:"report_finish_reason,omitempty"`
+	// Ack posts an ack frame before the OpenAI API is called, so the client can show a typing indicator
+	Ack bool `json:"ack,omitempty"`
+	// StreamGranularity selects when streamed text is posted: "token" (default), "sentence" or "paragraph"
+	StreamGranularity string `json:"stream_granularity,omitempty"`
+	// Schema is an optional JSON Schema the output of the json response type is validated against
+	Schema *jsonschema.Definition `json:"schema,omitempty"`
+	// TemplateVars fills the {{key}} placeholders of the prompt template
+	TemplateVars map[string]string `json:"template_vars,omitempty"`
+	// SystemPrompt replaces the prompt template when ALLOW_INLINE_PROMPTS is set
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// Async queues the request to ASYNC_QUEUE_URL and answers it from another invocation, past the API Gateway timeout
+	Async bool `json:"async,omitempty"`
+	// PromptTemplates runs each of the named templates against the messages, answering with one object keyed by template
+	PromptTemplates []string `json:"prompt_templates,omitempty"`
+	// Action is the route selection key of the API Gateway, accepted so regular requests may set it
+	Action string `json:"action,omitempty"`
+	// ConversationID selects a conversation stored in CONVERSATIONS_TABLE, so only the new messages need to be sent
+	ConversationID string `json:"conversation_id,omitempty"`
+	// Reset starts the conversation over, dropping its stored history
+	Reset bool `json:"reset,omitempty"`
+	// SkipModeration skips the moderation of the input when ALLOW_MODERATION_BYPASS is set
+	SkipModeration bool `json:"skip_moderation,omitempty"`
+	// Cache serves identical non-stream requests from CACHE_TABLE instead of calling OpenAI again
+	Cache bool `json:"cache,omitempty"`
+	// Tools are the OpenAI tool definitions the model may invoke instead of answering in prose
+	Tools []openai.Tool `json:"tools,omitempty"`
+	// ToolChoice is passed through to OpenAI: "none", "auto", "required" or an object naming a function
+	ToolChoice any `json:"tool_choice,omitempty"`
+	// Provider selects the completion backend, "openai" (default), "anthropic" or "bedrock", out of ALLOWED_PROVIDERS
+	Provider string `json:"provider,omitempty"`
+	// IdempotencyKey makes retries of the request replay its answer from IDEMPOTENCY_TABLE instead of calling OpenAI again
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// HistoryStrategy selects how messages that don't fit the context window are handled: "trim" (default) or "summarize"
+	HistoryStrategy string `json:"history_strategy,omitempty"`
+	// StrictPrefill fails extracted answers whose completion doesn't begin with the trailing assistant message
+	StrictPrefill bool `json:"strict_prefill,omitempty"`
+	// AcceptEncoding set to "gzip" compresses answer frames of at least COMPRESS_MIN_BYTES
+	AcceptEncoding string `json:"accept_encoding,omitempty"`
+	// Language is the BCP-47 tag of the language the answer must be in, out of ALLOWED_LANGUAGES
+	Language string `json:"language,omitempty"`
 }
 
 type openAIRequest struct {
-	request          Request
-	apiGatewayClient *apigatewaymanagementapi.ApiGatewayManagementApi
-	ConnectionId     string
+	ctx            context.Context // Lambda invocation context, bounding retries of websocket posts
+	config         *Config         // Configuration snapshot captured when the request started
+	request        Request
+	chat           ChatCompleter
+	poster         ConnectionPoster
+	dynamoDBClient dynamodbiface.DynamoDBAPI
+	ConnectionId   string
+	sequence       *frameSequence  // Shared by all copies so v2 sequence numbers keep increasing
+	metrics        *requestMetrics // Shared by all copies, nil when the request doesn't collect metrics
+	identity       *userIdentity   // Cognito user of the connection, nil when Cognito isn't configured
+	injection      []string        // Injection patterns matched by the user input of an annotated request
+	deadLetters    DeadLetterSink  // Receives payloads that couldn't be posted, nil without FAILED_DELIVERY_QUEUE_URL
+	audit          *auditTrail     // Shared by all copies, nil without AUDIT_FIREHOSE_STREAM
+	apiKey         string          // Key picked from OPENAI_API_KEYS, empty when the request uses OPENAI_API_KEY
+	tenantKey      string          // OpenAI API key of the tenant, empty when the request uses a platform key
+	// moderation is the moderation result of the user input, nil when it wasn't moderated
+	moderation *openai.ModerationResponse
+	// quotaUtilization is the used fraction of DAILY_TOKEN_QUOTA when the request started, selecting economy mode
+	quotaUtilization float64
+	clock            Clock // Times the stream, the system clock when nil
 }
 
+// WebsocketHandler holds the clients shared by all invocations of an execution environment, so warm invocations
+// reuse open connections. Clients depending on the configuration are rebuilt per snapshot on the shared transports.
 type WebsocketHandler struct {
-	apiGatewayClient *apigatewaymanagementapi.ApiGatewayManagementApi
-	apiGatewayStage  string
+	awsSession        *session.Session
+	awsConfig         awsv2.Config // Used by the API Gateway Management API client, the other clients use awsSession
+	httpClient        *http.Client // Used by the OpenAI clients
+	openAIClients     snapshotCache[ChatCompleter]
+	openAIKeyClients  snapshotCache[map[string]ChatCompleter] // One client per key of OPENAI_API_KEYS
+	bedrockClients    snapshotCache[ChatCompleter]
+	anthropicClients  snapshotCache[ChatCompleter]
+	apiGatewayClients snapshotCache[*connectionPosters] // One client per management API endpoint
+	dynamoDBClients   snapshotCache[dynamodbiface.DynamoDBAPI]
+	sqsClients        snapshotCache[*sqs.SQS]
+	deadLetterSinks   snapshotCache[DeadLetterSink]
+	firehoseClients   snapshotCache[firehoseiface.FirehoseAPI]
+	kmsClients        snapshotCache[kmsiface.KMSAPI]
+	tenantClients     snapshotCache[*tenantCompleters]
+	localPoster       ConnectionPoster // Replaces the API Gateway Management API in local development mode
+	clock             Clock            // The system clock unless a test sets another
+}
+
+// newWebsocketHandler creates the AWS session and the HTTP client shared by all invocations
+func newWebsocketHandler() *WebsocketHandler {
+	return &WebsocketHandler{
+		awsSession: sharedAWSSession(),
+		awsConfig:  sharedAWSConfig(),
+		httpClient: newOpenAIHTTPClient(),
+	}
 }
 
-type Config struct {
-	OpenAIKey          string
-	OpenAIModel        string
-	APIGatewayEndpoint string
+// getClock returns the clock of the handler
+func (h *WebsocketHandler) getClock() Clock {
+	if h.clock == nil {
+		return systemClock{}
+	}
+	return h.clock
+}
+
+// newOpenAIHTTPClient creates the HTTP client for the OpenAI API. It sets no overall timeout, since streams
+// stay open for as long as the model writes; the Lambda context deadline bounds every request instead.
+func newOpenAIHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: openAIDialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   openAIDialTimeout,
+			ResponseHeaderTimeout: openAIResponseHeaderTimeout,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   openAIMaxIdleConnsPerHost,
+			ForceAttemptHTTP2:     true,
+		},
+	}
 }
 
-var config Config // Global configuration variable
+// ErrUnparsableResponse is returned when the OpenAI response doesn't contain the expected answer
+var ErrUnparsableResponse = errors.New("Can't parse OpenAI API response")
+
+// ErrNoChoices is returned when the OpenAI response has no choice to take the answer from
+var ErrNoChoices = fmt.Errorf("%w: response has no choices", ErrUnparsableResponse)
+
+// ErrContentFiltered is returned when the OpenAI content filter stopped the answer of an extracting response type
+var ErrContentFiltered = errors.New("OpenAI API stopped the answer with its content filter")
+
+// ErrClientGone is returned when the websocket client disconnected before the response was delivered
+var ErrClientGone = errors.New("Websocket client has disconnected")
+
+// ErrOpenAIRequest is returned when the OpenAI API rejects or fails a request
+var ErrOpenAIRequest = errors.New("Error sending OpenAI API request")
+
+// ErrStreamAborted is returned when the OpenAI API stream breaks off before it is complete
+var ErrStreamAborted = errors.New("Stream error")
+
+// ErrTemplateVarsMissing is returned when the request doesn't supply a value for every placeholder of the prompt template
+var ErrTemplateVarsMissing = errors.New("Missing template_vars for prompt template placeholders")
 
 // getConfusables returns a read-only map of confusable characters to their ASCII replacements to imitate const map.
-func getConfusables() map[rune]rune {
-	return map[rune]rune{
-		'“': '"',
-		'”': '"',
-		'‘': '\'',
-		'’': '\'',
-		'΄': '\'',
+// An empty replacement strips the character.
+func getConfusables() map[rune]string {
+	return map[rune]string{
+		'“':      "\"",
+		'”':      "\"",
+		'„':      "\"",
+		'«':      "\"",
+		'»':      "\"",
+		'″':      "\"",
+		'＂':      "\"",
+		'‘':      "'",
+		'’':      "'",
+		'‚':      "'",
+		'΄':      "'",
+		'‹':      "'",
+		'›':      "'",
+		'′':      "'",
+		'＇':      "'",
+		'–':      "-",
+		'—':      "--",
+		'…':      "...",
+		'，':      ",",
+		'．':      ".",
+		'：':      ":",
+		'；':      ";",
+		'！':      "!",
+		'？':      "?",
+		'（':      "(",
+		'）':      ")",
+		'［':      "[",
+		'］':      "]",
+		'⟦':      "[[",
+		'⟧':      "]]",
+		'〚':      "[[",
+		'〛':      "]]",
+		'\u00a0': " ", // No-break space
+		'\u2009': " ", // Thin space
+		'\u202f': " ", // Narrow no-break space
+		'\u200b': "",  // Zero width space
+		'\u2060': "",  // Word joiner
+		'\ufeff': "",  // Zero width no-break space
 	}
 }
 
 // Replace confusable UTF-8 characters in s with their ASCII replacements.
-func replaceConfusables(s string) string {
-	confusables := getConfusables()
+func replaceConfusables(confusables map[rune]string, s string) string {
 	var builder strings.Builder
 	for _, ch := range s {
 		if replacement, ok := confusables[ch]; ok {
-			builder.WriteRune(replacement)
+			builder.WriteString(replacement)
 		} else {
 			builder.WriteRune(ch)
 		}
@@ -89,90 +315,360 @@ func replaceConfusables(s string) string {
 
 // init is called to load configuration from environment variables
 func init() {
-	var err error
-	config, err = loadConfig()
+	setupLogging()
+	setupTracing()
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Printf("Failed to load configuration: %v", err)
+		slog.Error("Failed to load configuration", "error", err)
 		os.Exit(1)
 	}
+	storeConfig(cfg)
 }
 
 func main() {
-	lambda.Start(Handler)
-}
-
-// loadConfig loads configuration from environment variables
-func loadConfig() (Config, error) {
-	cfg := Config{
-		OpenAIKey:          os.Getenv("OPENAI_API_KEY"),
-		OpenAIModel:        os.Getenv("OPENAI_MODEL"),
-		APIGatewayEndpoint: os.Getenv("API_GW_ENDPOINT"),
-	}
-
-	if cfg.OpenAIKey == "" {
-		return cfg, fmt.Errorf("OpenAI API key not found in environment variable OPENAI_API_KEY")
-	}
-
-	if cfg.OpenAIModel == "" {
-		cfg.OpenAIModel = defaultModel
+	handler := newWebsocketHandler()
+	if getConfig().LocalDev {
+		if err := handler.serveLocal(getConfig()); err != nil {
+			slog.Error("Local development server failed", "error", err)
+			os.Exit(1)
+		}
+		return
 	}
-
-	if cfg.APIGatewayEndpoint == "" {
-		return cfg, fmt.Errorf("API Gateway Endpoint not found in environment variable API_GW_ENDPOINT")
+	if getConfig().FunctionURLStream {
+		lambda.StartWithOptions(lambdaurl.Wrap(handler.sseHandler()))
+		return
 	}
-
-	return cfg, nil
+	lambda.Start(handler.Invoke)
 }
 
 // Handler is the main handler for AWS Lambda functions
-func Handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
-
-	/* 	fmt.Printf("request.Resource: %v\n", request.Resource)
-	   	fmt.Printf("request.Path: %v\n", request.Path)
-	   	fmt.Printf("request.HTTPMethod: %v\n", request.HTTPMethod)
-	   	fmt.Printf("request.Body: %v\n", request.Body)
-	   	fmt.Printf("request.RequestContext: %v\n", request.RequestContext)
-	   	fmt.Printf("request.RequestContext.RouteKey: %v\n", request.RequestContext.RouteKey) */
+func (h *WebsocketHandler) Handler(ctx context.Context, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Capture one configuration snapshot for the whole request
+	cfg := refreshStaleConfig(ctx)
+	ctx = withLogger(ctx, requestLogger(cfg, request))
+	ctx = withAPIGatewayEndpoint(ctx, requestContextEndpoint(request.RequestContext))
 
 	routeKey := request.RequestContext.RouteKey
 	switch routeKey {
 	case connectRouteKey, disconnectRouteKey:
-		return handleConnection(routeKey)
+		return h.handleConnection(ctx, cfg, request)
 	default:
-		return handleRequest(request)
+		body, err := decodeBody(cfg, request.Body, request.IsBase64Encoded)
+		if err != nil {
+			loggerFrom(ctx).Warn("Can't decode request body", "error", err, "bytes", len(request.Body))
+			return errorResponse(err.Error(), statusCodeBadRequest)
+		}
+		request.Body, request.IsBase64Encoded = body, false
+		action := parseAction(request.Body)
+		// A ping only keeps the connection alive, so it skips the authorization lookup
+		if action == actionPing {
+			return h.handlePing(ctx, cfg, request)
+		}
+		// A relay comes from a backend service with its own credential, not from the user of the connection
+		if action == actionRelay {
+			return h.handleRelay(ctx, cfg, request)
+		}
+		if requiresConnectionAuth(cfg) {
+			auth, err := h.authorizeMessage(ctx, cfg, request.RequestContext.ConnectionID)
+			if errors.Is(err, errUnauthorized) {
+				loggerFrom(ctx).Warn("Message rejected", "error", err)
+				return errorResponse(err.Error(), statusCodeUnauthorized)
+			}
+			if err != nil {
+				loggerFrom(ctx).Error("Can't authorize message", "error", err)
+				return errorResponse(err.Error(), statusCodeServerError)
+			}
+			if auth.principal.Subject != "" {
+				ctx = withPrincipal(ctx, auth.principal.Subject)
+				ctx = withLogger(ctx, loggerFrom(ctx).With("principal", auth.principal.Subject))
+			}
+			if auth.identity != nil {
+				ctx = withIdentity(ctx, auth.identity)
+				ctx = withLogger(ctx, loggerFrom(ctx).With("user_sub", auth.identity.Sub))
+			}
+			if auth.tenant != "" {
+				ctx = withTenant(ctx, auth.tenant)
+				ctx = withLogger(ctx, loggerFrom(ctx).With("tenant", auth.tenant))
+			}
+		}
+		switch action {
+		case actionCancel:
+			return h.handleCancel(ctx, cfg, request)
+		case actionUsage:
+			return h.handleUsage(ctx, cfg, request)
+		case actionSessionSummary:
+			return h.handleSessionSummary(ctx, cfg, request)
+		case actionExportState, actionImportState:
+			return h.handleState(ctx, cfg, request)
+		case actionBroadcast:
+			return h.handleBroadcast(ctx, cfg, request)
+		}
+		if isBatchBody(request.Body) {
+			return h.handleBatch(ctx, cfg, request)
+		}
+		return h.handleRequest(ctx, cfg, request)
 	}
 }
 
-// handleConnection handles connection and disconnection events
-func handleConnection(routeKey string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
-}
-
 // handleRequest handles requests other than connection/disconnection
-func handleRequest(request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+func (h *WebsocketHandler) handleRequest(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
 	reqBody, err := parseRequestBody(request.Body)
 	if err != nil {
+		loggerFrom(ctx).Warn("Can't parse request JSON", "error", err)
 		return errorResponse(fmt.Sprintf("Error parsing request JSON: %s", err), statusCodeBadRequest)
 	}
+	reqBody, err = withRouteResponseType(cfg, request.RequestContext.RouteKey, reqBody)
+	if err != nil {
+		loggerFrom(ctx).Warn("Response type conflicts with the route", "error", err)
+		return errorResponse(fmt.Sprintf("Invalid request parameters: %s", err), statusCodeBadRequest)
+	}
+	return h.serveRequest(ctx, cfg, reqBody, request.RequestContext.ConnectionID, h.getConnectionPoster(ctx, cfg))
+}
+
+// serveRequest runs a parsed request, on its own or as an item of a batch, posting its frames with poster
+func (h *WebsocketHandler) serveRequest(ctx context.Context, cfg *Config, reqBody Request, connectionID string, poster ConnectionPoster) (events.APIGatewayProxyResponse, error) {
+	var err error
+	ctx = withLogger(ctx, loggerFrom(ctx).With("response_type", reqBody.ResponseType))
+	reqBody = withPromptProfile(cfg, reqBody)
+
+	if err := validateRequestParams(cfg, reqBody); err != nil {
+		loggerFrom(ctx).Warn("Invalid request parameters", "error", err)
+		return errorResponse(fmt.Sprintf("Invalid request parameters: %s", err), statusCodeBadRequest)
+	}
+
+	claim := idempotencyClaimFrom(ctx)
+	if reqBody.IdempotencyKey != "" && claim == nil {
+		return h.serveIdempotent(ctx, cfg, reqBody, connectionID, poster)
+	}
+
+	openAIReq := h.createOpenAIRequest(ctx, cfg, reqBody, connectionID)
+	openAIReq.poster = poster
+
+	// Requests from the async queue took their rate limit token when they were queued
+	if cfg.RateLimitTable != "" && !isAsyncWorker(ctx) {
+		if allowed, retryAfter := checkRateLimit(openAIReq); !allowed {
+			openAIReq.logger().Warn("Request rate limited", "retry_after_ms", retryAfter.Milliseconds())
+			if err := postRateLimited(openAIReq, retryAfter); err != nil && !errors.Is(err, ErrClientGone) {
+				openAIReq.logger().Error("Can't post rate limited frame", "error", err)
+			}
+			return errorResponse("Rate limit exceeded", statusCodeTooMany)
+		}
+	}
+
+	if cfg.DailyTokenQuota > 0 {
+		utilization, exceeded := checkDailyQuota(openAIReq)
+		if exceeded {
+			openAIReq.logger().Warn("Daily token quota exceeded", "quota", cfg.DailyTokenQuota)
+			postErrorFrame(openAIReq, errorCodeQuotaExceeded, fmt.Sprintf("Daily token quota of %d exceeded", cfg.DailyTokenQuota))
+			return errorResponse("Daily token quota exceeded", statusCodeTooMany)
+		}
+		openAIReq.quotaUtilization = utilization
+		if openAIReq.economyMode() {
+			openAIReq.logger().Info("Economy mode", "utilization", utilization, "soft_cap_percent", cfg.SoftCapPercent)
+			openAIReq.metrics.markEconomyMode()
+		}
+	}
+
+	// The queued request is answered by another invocation, which runs the checks below and loads the history itself
+	if reqBody.Async {
+		return h.enqueueAsync(openAIReq, reqBody)
+	}
+
+	if reqBody.ConversationID != "" {
+		openAIReq, err = withConversationHistory(ctx, openAIReq)
+		if err != nil {
+			openAIReq.logger().Error("Can't load conversation history", "error", err)
+			return errorResponse(err.Error(), statusCodeServerError)
+		}
+	}
+
+	// HTTP requests have no connection to count against
+	if cfg.ConnectionsTable != "" && cfg.MaxInflight > 0 && !isHTTPRequest(ctx) {
+		acquired, err := acquireInflight(openAIReq)
+		if err != nil {
+			openAIReq.logger().Error("Can't count in-flight request", "error", err)
+			return errorResponse(fmt.Sprintf("Can't count in-flight request: %s", err), statusCodeServerError)
+		}
+		if !acquired {
+			openAIReq.logger().Warn("Too many in-flight requests", "max_inflight", cfg.MaxInflight)
+			postErrorFrame(openAIReq, errorCodeTooManyInflight, fmt.Sprintf("At most %d requests may be in flight per connection", cfg.MaxInflight))
+			return errorResponse("Too many in-flight requests", statusCodeTooMany)
+		}
+		defer releaseInflight(openAIReq)
+	}
 
-	apiGatewayClient := getAPIGatewayClient()
-	openAIReq := createOpenAIRequest(reqBody, apiGatewayClient, request.RequestContext.ConnectionID)
+	if shouldModerate(cfg, reqBody) {
+		moderation, err := moderateInput(ctx, openAIReq)
+		if err != nil {
+			openAIReq.logger().Error("Can't moderate request input", "error", err)
+			postErrorFrame(openAIReq, errorCodeOpenAI, err.Error())
+			return errorResponse(fmt.Sprintf("Can't moderate request input: %s", err), statusCodeBadGateway)
+		}
+		openAIReq.moderation = moderation
+		if moderation != nil {
+			if categories := flaggedCategories(moderation); len(categories) > 0 {
+				openAIReq.logger().Warn("Request input flagged by moderation", "categories", categories)
+				if err := postContentFlagged(openAIReq, categories); err != nil && !errors.Is(err, ErrClientGone) {
+					openAIReq.logger().Error("Can't post content flagged frame", "error", err)
+				}
+				return errorResponse("Request input flagged by moderation", statusCodeBadRequest)
+			}
+		}
+	}
 
-	var handlerFunc func(openAIRequest) error
+	if cfg.InjectionCheck != "" {
+		if matched := scanInjection(cfg, reqBody); len(matched) > 0 {
+			// Only the pattern names are logged, the user input may be sensitive
+			openAIReq.logger().Warn("Request input matches injection patterns", "patterns", matched, "mode", cfg.InjectionCheck)
+			if cfg.InjectionCheck == injectionCheckBlock {
+				postErrorFrame(openAIReq, errorCodeInjection, "Request input looks like a prompt injection")
+				return errorResponse("Request input looks like a prompt injection", statusCodeBadRequest)
+			}
+			openAIReq.injection = matched
+		}
+	}
+
+	// Acknowledge the request before the OpenAI call, and skip the call if the client can't be reached
+	if reqBody.Ack {
+		err := postControlFrame(openAIReq, frameTypeAck)
+		if errors.Is(err, ErrClientGone) {
+			emitMetrics(openAIReq, err)
+			openAIReq.logger().Info("Connection closed before the request was acknowledged")
+			return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+		}
+		if err != nil {
+			emitMetrics(openAIReq, err)
+			openAIReq.logger().Error("Can't post acknowledgment to websocket", "error", err)
+			return errorResponse(fmt.Sprintf("Can't post acknowledgment to websocket: %s", err), statusCodeServerError)
+		}
+	}
+
+	var handlerFunc func(context.Context, openAIRequest) error
 	switch reqBody.ResponseType {
-	case "int":
+	case responseTypeInt:
 		handlerFunc = getIntOpenAIResponse
-	case "string":
+	case responseTypeString:
 		handlerFunc = getStringOpenAIResponse
-	case "full":
+	case responseTypeFull:
 		handlerFunc = getFullOpenAIResponse
-	case "stream":
+	case responseTypeStream:
 		handlerFunc = getStreamOpenAIResponse
+	case responseTypeJSON:
+		handlerFunc = getJSONOpenAIResponse
+	case responseTypeBool:
+		handlerFunc = getBoolOpenAIResponse
+	case responseTypeFloat:
+		handlerFunc = getFloatOpenAIResponse
+	case responseTypeChoice:
+		handlerFunc = getChoiceOpenAIResponse
+	case responseTypeList:
+		handlerFunc = getListOpenAIResponse
 	default:
-		return errorResponse(fmt.Sprintf("Incorrect response type: %s", reqBody.ResponseType), statusCodeServerError)
+		message := fmt.Sprintf("Incorrect response type: %s", reqBody.ResponseType)
+		openAIReq.logger().Warn("Incorrect response type")
+		postErrorFrame(openAIReq, errorCodeInvalidRequest, message)
+		return errorResponse(message, statusCodeServerError)
+	}
+
+	// The response type picks how each template's answer is extracted
+	if len(reqBody.PromptTemplates) > 0 {
+		handlerFunc = getMultiPromptResponse
+	}
+
+	// With TENANT_KEYS_TABLE the tenant of the connection pays for its requests with its own key
+	openAIProvider := reqBody.Provider != providerAnthropic && reqBody.Provider != providerBedrock
+	if cfg.TenantKeysTable != "" && openAIProvider && !cfg.OpenAIMock {
+		openAIReq, err = h.withTenantKey(openAIReq, false)
+		if errors.Is(err, ErrTenantKeyInvalid) {
+			emitMetrics(openAIReq, err)
+			openAIReq.logger().Warn("Tenant has no usable OpenAI API key", "error", err)
+			postErrorFrame(openAIReq, errorCodeTenantKeyInvalid, err.Error())
+			return errorResponse(err.Error(), statusCodeForbidden)
+		}
+		if err != nil {
+			emitMetrics(openAIReq, err)
+			openAIReq.logger().Error("Can't resolve tenant key", "error", err)
+			postErrorFrame(openAIReq, errorCodeInternal, "Can't resolve tenant key")
+			return errorResponse(err.Error(), statusCodeServerError)
+		}
 	}
 
-	if err := handlerFunc(openAIReq); err != nil {
+	// With several keys in OPENAI_API_KEYS every request of the platform takes the next key that isn't cooling down
+	keyCtx := ctx
+	if key := openAIKeys.pick(cfg); key != "" && openAIProvider && !cfg.OpenAIMock && openAIReq.tenantKey == "" {
+		ctx = withLogger(keyCtx, loggerFrom(keyCtx).With("openai_key", openAIKeySuffix(key)))
+		openAIReq = h.withOpenAIKey(ctx, openAIReq, key)
+	}
+
+	runHandler := func() error {
+		return traceSubsegment(ctx, "HandleRequest", func(ctx context.Context) error {
+			annotateTrace(ctx, cfg, reqBody)
+			traced := openAIReq
+			traced.ctx = ctx
+			return handlerFunc(ctx, traced)
+		})
+	}
+	// While the OpenAI API is down the request fails fast instead of waiting out its timeouts and retries
+	breaker := cfg.CircuitFailureThreshold > 0 && openAIProvider
+	if breaker && !openAIBreaker.allow(cfg) {
+		emitMetrics(openAIReq, ErrProviderUnavailable)
+		openAIReq.logger().Warn("OpenAI API circuit open, failing the request fast")
+		postErrorFrame(openAIReq, errorCodeProviderUnavailable, ErrProviderUnavailable.Error())
+		return errorResponse(ErrProviderUnavailable.Error(), statusCodeUnavailable)
+	}
+	if claim != nil {
+		claim.startRecording()
+	}
+	err = runHandler()
+	// A 401 fails before anything is posted, so after a key rotation the request can simply run again
+	if isUnauthorizedError(err) {
+		if openAIReq.tenantKey != "" {
+			err = h.retryTenantKey(&openAIReq, runHandler, err)
+		} else if refreshed, ok := refreshOpenAIKey(ctx, cfg); ok {
+			openAIReq.logger().Warn("OpenAI API key rejected, retrying with the refreshed key")
+			cfg = refreshed
+			openAIReq.config = cfg
+			openAIReq.chat = h.getProviderCompleter(cfg, reqBody.Provider)
+			err = runHandler()
+		} else if openAIReq.apiKey != "" {
+			openAIKeys.record(openAIReq.apiKey, err)
+			if key := openAIKeys.pick(cfg); key != openAIReq.apiKey {
+				openAIReq.logger().Warn("OpenAI API key rejected, retrying with another key")
+				ctx = withLogger(keyCtx, loggerFrom(keyCtx).With("openai_key", openAIKeySuffix(key)))
+				openAIReq = h.withOpenAIKey(ctx, openAIReq, key)
+				err = runHandler()
+			}
+		}
+	}
+	openAIKeys.record(openAIReq.apiKey, err)
+	if breaker {
+		openAIBreaker.record(cfg, err)
+	}
+	if claim != nil {
+		claim.handled(err)
+	}
+	emitMetrics(openAIReq, err)
+	sendAudit(openAIReq, err)
+	if err != nil {
+		if errors.Is(err, ErrClientGone) {
+			// The client closing the websocket is expected, so only note it
+			openAIReq.logger().Info("Connection closed before the response was delivered")
+			return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+		}
+		openAIReq.logger().Error("Error handling request", "error", err)
+		reportError(openAIReq, err)
+		if errors.Is(err, ErrTemplateVarsMissing) || errors.Is(err, ErrContextTooLarge) {
+			return errorResponse(fmt.Sprintf("Error handling request: %s", err), statusCodeBadRequest)
+		}
+		if errors.Is(err, ErrUnparsableResponse) || errors.Is(err, ErrContentFiltered) {
+			return errorResponse(fmt.Sprintf("Error handling request: %s", err), statusCodeBadGateway)
+		}
+		if errors.Is(err, ErrTenantKeyInvalid) {
+			return errorResponse(fmt.Sprintf("Error handling request: %s", err), statusCodeForbidden)
+		}
+		if isTimeoutError(err) {
+			return errorResponse(fmt.Sprintf("Error handling request: %s", err), statusCodeGatewayTimeout)
+		}
 		return errorResponse(fmt.Sprintf("Error handling request: %s", err), statusCodeServerError)
 	}
 
@@ -180,10 +676,118 @@ func handleRequest(request events.APIGatewayWebsocketProxyRequest) (events.APIGa
 }
 
 // parseRequestBody parses the request body from JSON to Request struct
+// Unknown fields are rejected, so a typo such as "respones_type" fails instead of being silently ignored.
+// The error names the field, suggests the accepted field it was probably meant to be and lists all of them.
+// Anything but white space after the request object is rejected too.
 func parseRequestBody(body string) (Request, error) {
 	var reqBody Request
-	err := json.Unmarshal([]byte(body), &reqBody)
-	return reqBody, err
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqBody); err != nil {
+		return reqBody, explainUnknownField(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return reqBody, fmt.Errorf("unexpected data after the request object")
+	}
+	if err := checkRequestKeys(body); err != nil {
+		return reqBody, err
+	}
+	return reqBody, nil
+}
+
+// checkRequestKeys walks the tokens of a decoded request body, which the JSON decoder accepts with duplicate
+// keys, keeping the last value, and with field names in any case. Both are rejected: a duplicate key at any
+// depth, and a request field not spelled exactly like its JSON name, such as "Response_Type".
+func checkRequestKeys(body string) error {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	return checkValueKeys(decoder, "", true)
+}
+
+// checkValueKeys reads the next value from decoder, checking the keys of the objects in it. path names the
+// value in errors, and top marks the request object, whose keys have to be request fields.
+func checkValueKeys(decoder *json.Decoder, path string, top bool) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		seen := make(map[string]bool)
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key := token.(string)
+			name := key
+			if path != "" {
+				name = path + "." + key
+			}
+			if seen[key] {
+				return fmt.Errorf("duplicate field %q", name)
+			}
+			seen[key] = true
+			if top && !slices.Contains(requestFields(), key) {
+				return explainUnknownField(fmt.Errorf("json: unknown field %q", key))
+			}
+			if err := checkValueKeys(decoder, name, false); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	case json.Delim('['):
+		for i := 0; decoder.More(); i++ {
+			if err := checkValueKeys(decoder, fmt.Sprintf("%s[%d]", path, i), false); err != nil {
+				return err
+			}
+		}
+		_, err = decoder.Token()
+		return err
+	}
+	return nil
+}
+
+// requestFields lists the JSON field names of Request in alphabetical order
+var requestFields = sync.OnceValue(func() []string {
+	var fields []string
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(Request{})) {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.IsExported() && name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	slices.Sort(fields)
+	return fields
+})
+
+// explainUnknownField adds the closest accepted field and the list of accepted fields to the unknown field
+// error of the JSON decoder. Other errors are returned unchanged.
+func explainUnknownField(err error) error {
+	name, found := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !found {
+		return err
+	}
+	name, _ = strconv.Unquote(name)
+	fields := requestFields()
+	normalized := strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+	for _, field := range fields {
+		if strings.ReplaceAll(field, "_", "") == normalized {
+			return fmt.Errorf("unknown field %q, did you mean %q? Accepted fields: %s", name, field, strings.Join(fields, ", "))
+		}
+	}
+	return fmt.Errorf("unknown field %q. Accepted fields: %s", name, strings.Join(fields, ", "))
+}
+
+// parseAction returns the action field of a JSON request body, or an empty string for regular OpenAI requests
+func parseAction(body string) string {
+	var envelope struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		return ""
+	}
+	return envelope.Action
 }
 
 // errorResponse creates an error response with a specified message and status code
@@ -194,19 +798,112 @@ func errorResponse(message string, statusCode int) (events.APIGatewayProxyRespon
 	}, nil
 }
 
-// getAPIGatewayClient initializes and returns an API Gateway client
-func getAPIGatewayClient() *apigatewaymanagementapi.ApiGatewayManagementApi {
-	apiEndpoint := config.APIGatewayEndpoint
-	return apigatewaymanagementapi.New(session.Must(session.NewSession()), aws.NewConfig().WithEndpoint(apiEndpoint))
+// getDynamoDBClient returns the DynamoDB client for the configuration snapshot
+func (h *WebsocketHandler) getDynamoDBClient(cfg *Config) dynamodbiface.DynamoDBAPI {
+	return h.dynamoDBClients.get(cfg, func(cfg *Config) dynamodbiface.DynamoDBAPI {
+		return dynamodb.New(h.awsSession)
+	})
 }
 
 // createOpenAIRequest creates an OpenAIRequest object from the given input
-func createOpenAIRequest(reqBody Request, apiGatewayClient *apigatewaymanagementapi.ApiGatewayManagementApi, connectionID string) openAIRequest {
-	return openAIRequest{
-		request:          reqBody,
-		apiGatewayClient: apiGatewayClient,
-		ConnectionId:     connectionID,
+func (h *WebsocketHandler) createOpenAIRequest(ctx context.Context, cfg *Config, reqBody Request, connectionID string) openAIRequest {
+	chat := h.getProviderCompleter(cfg, reqBody.Provider)
+	// The mock answers int requests differently, so it has to know the response type
+	if mock, ok := chat.(mockChatCompleter); ok {
+		chat = mock.withResponseType(reqBody.ResponseType)
 	}
+	request := openAIRequest{
+		ctx:            ctx,
+		config:         cfg,
+		request:        reqBody,
+		chat:           chat,
+		poster:         h.getConnectionPoster(ctx, cfg),
+		dynamoDBClient: h.getDynamoDBClient(cfg),
+		ConnectionId:   connectionID,
+		sequence:       &frameSequence{},
+		identity:       identityFrom(ctx),
+		deadLetters:    h.getDeadLetterSink(cfg),
+		audit:          h.newAuditTrail(cfg),
+		clock:          h.getClock(),
+	}
+	request.metrics = newRequestMetrics(request.getClock())
+	return request
+}
+
+// getClock returns the clock the stream of the request is timed with
+func (r openAIRequest) getClock() Clock {
+	if r.clock == nil {
+		return systemClock{}
+	}
+	return r.clock
+}
+
+// postError marks a failed PostToConnection call, so the failure isn't reported over the same connection
+type postError struct {
+	err error
+}
+
+func (e *postError) Error() string { return e.err.Error() }
+
+func (e *postError) Unwrap() error { return e.err }
+
+// postToConnection posts data to the websocket connection of the request, returning ErrClientGone if the client has disconnected.
+// Throttled posts are retried a few times with short jittered delays, as long as the Lambda deadline allows.
+func postToConnection(openAIRequest openAIRequest, data []byte) error {
+	ctx := openAIRequest.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	for attempt := 0; ; attempt++ {
+		openAIRequest.metrics.countPost()
+		err := openAIRequest.poster.PostToConnection(ctx, openAIRequest.ConnectionId, data)
+		if err == nil {
+			return nil
+		}
+		if isGoneError(err) {
+			return ErrClientGone
+		}
+		if isPayloadTooLargeError(err) {
+			openAIRequest.logger().Error("PostToConnection payload too large", "target", openAIRequest.ConnectionId, "bytes", len(data))
+		}
+		if !isThrottlingError(err) || attempt >= postMaxRetries {
+			return deadLetter(openAIRequest, data, &postError{err: err})
+		}
+		delay := backoffDelay(attempt, postRetryBaseDelay, postRetryMaxDelay)
+		openAIRequest.logger().Warn("PostToConnection throttled, retrying", "target", openAIRequest.ConnectionId, "attempt", attempt+1, "delay", delay)
+		if !sleepContext(ctx, delay) {
+			return deadLetter(openAIRequest, data, &postError{err: err})
+		}
+	}
+}
+
+// isGoneError checks if the error returned by PostToConnection means the connection no longer exists
+func isGoneError(err error) bool {
+	var gone *apigwtypes.GoneException
+	return errors.As(err, &gone) || postErrorStatus(err) == http.StatusGone
+}
+
+// isThrottlingError checks if the error returned by PostToConnection means the post was throttled
+func isThrottlingError(err error) bool {
+	var limitExceeded *apigwtypes.LimitExceededException
+	return errors.As(err, &limitExceeded) || postErrorStatus(err) == http.StatusTooManyRequests
+}
+
+// isPayloadTooLargeError checks if the error returned by PostToConnection means the frame exceeded the
+// message size limit of API Gateway
+func isPayloadTooLargeError(err error) bool {
+	var tooLarge *apigwtypes.PayloadTooLargeException
+	return errors.As(err, &tooLarge) || postErrorStatus(err) == http.StatusRequestEntityTooLarge
+}
+
+// postErrorStatus returns the HTTP status code of a failed PostToConnection call, or 0 when it got no response
+func postErrorStatus(err error) int {
+	// Implemented by the response errors of the AWS SDK, and by the failures the testsupport poster injects
+	var responseErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &responseErr) {
+		return responseErr.HTTPStatusCode()
+	}
+	return 0
 }
 
 // isValidModel checks if the specified model ID is valid
@@ -219,120 +916,252 @@ func isValidModel(models []openai.Model, id string) bool {
 	return false
 }
 
-// getOpenAIClient initializes and returns an OpenAI client
-func getOpenAIClient() *openai.Client {
-	return openai.NewClient(config.OpenAIKey)
+// getChatCompleter returns the OpenAI client backed ChatCompleter for the configuration snapshot
+func (h *WebsocketHandler) getChatCompleter(cfg *Config) ChatCompleter {
+	return h.openAIClients.get(cfg, func(cfg *Config) ChatCompleter {
+		if cfg.OpenAIMock {
+			return newMockChatCompleter(cfg)
+		}
+		clientConfig := newOpenAIClientConfig(cfg, h.httpClient)
+		return openAIChatCompleter{Client: openai.NewClientWithConfig(clientConfig)}
+	})
+}
+
+// getProviderCompleter returns the ChatCompleter of the provider selected by the request
+func (h *WebsocketHandler) getProviderCompleter(cfg *Config, provider string) ChatCompleter {
+	switch provider {
+	case providerAnthropic:
+		return h.anthropicClients.get(cfg, func(cfg *Config) ChatCompleter {
+			return anthropicChatCompleter{
+				httpClient: h.httpClient,
+				apiKey:     cfg.AnthropicKey,
+				model:      cfg.AnthropicModel,
+				maxTokens:  cfg.ReservedCompletionTokens,
+				moderator:  h.getChatCompleter(cfg),
+			}
+		})
+	case providerBedrock:
+		return h.bedrockClients.get(cfg, func(cfg *Config) ChatCompleter {
+			awsConfig := aws.NewConfig()
+			if cfg.BedrockRegion != "" {
+				awsConfig = awsConfig.WithRegion(cfg.BedrockRegion)
+			}
+			return bedrockChatCompleter{
+				client:    bedrockruntime.New(h.awsSession, awsConfig),
+				modelID:   cfg.BedrockModelID,
+				maxTokens: cfg.ReservedCompletionTokens,
+				moderator: h.getChatCompleter(cfg),
+			}
+		})
+	}
+	return h.getChatCompleter(cfg)
+}
+
+// resolveModel returns the model the request is sent to: BEDROCK_MODEL_ID for Bedrock, ANTHROPIC_MODEL for
+// Anthropic, and the model of the prompt profile or the validated OpenAI model otherwise
+func resolveModel(ctx context.Context, openAIRequest openAIRequest, request Request) (string, error) {
+	switch request.Provider {
+	case providerBedrock:
+		return openAIRequest.config.BedrockModelID, nil
+	case providerAnthropic:
+		return openAIRequest.config.AnthropicModel, nil
+	}
+	// Profile models are checked against ALLOWED_MODELS when the configuration is loaded
+	if model := promptProfileFor(openAIRequest.config, request).Model; model != "" {
+		return model, nil
+	}
+	return getModel(ctx, openAIRequest.config, openAIRequest.chat)
 }
 
+// validatedModels caches the model checked against ListModels per configuration snapshot,
+// so ListModels is called once per execution environment instead of on every request
+var validatedModels snapshotCache[string]
+
 // getModel gets the OpenAI model ID either from environment variables or defaults
-func getModel() (string, error) {
+func getModel(ctx context.Context, cfg *Config, client ChatCompleter) (string, error) {
 
 	// Get the value of the "OPENAI_MODEL" environment variable
-	model := config.OpenAIModel
+	model := cfg.OpenAIModel
 	// Check if the model value is empty
 	if model == "" {
 		// If the model value is empty, set it to the default model
 		return defaultModel, nil
 	}
-	// Otherwise, retrieve a list of available models
-	client := getOpenAIClient()
-	availableModels, err := client.ListModels(context.Background())
+	// Fine-tuned models don't always show up in ListModels, so validation can be switched off.
+	// Azure lists the models of the resource rather than the deployments requests are sent to, so it is never validated.
+	if !cfg.ModelValidation || cfg.OpenAIProvider == providerAzure {
+		return model, nil
+	}
+	model, err := validatedModels.getChecked(cfg, func(cfg *Config) (string, error) {
+		return validateModel(ctx, cfg, client)
+	})
 	if err != nil {
-		// Print an error message and set the model to the default model
-		fmt.Printf("Error getting list of available models: %s\n Defaulting to %s", err, defaultModel)
+		// Print an error message and set the model to the default model, the next request validates again
+		loggerFrom(ctx).Error("Error getting list of available models", "error", err, "default_model", defaultModel)
 		return defaultModel, nil
 	}
+	return model, nil
+}
+
+// validateModel checks the configured model against the list of available models, resolving an unknown one to the default model
+func validateModel(ctx context.Context, cfg *Config, client ChatCompleter) (string, error) {
+	availableModels, err := client.ListModels(ctx)
+	if isNotFoundError(err) {
+		// OpenAI-compatible gateways don't always implement /models, which says nothing about the model
+		loggerFrom(ctx).Warn("The OpenAI API doesn't list models, skipping the model validation", "configured_model", cfg.OpenAIModel)
+		return cfg.OpenAIModel, nil
+	}
+	if err != nil {
+		return "", err
+	}
 	// Check if the provided model is valid
-	if !isValidModel(availableModels.Models, model) {
+	if !isValidModel(availableModels.Models, cfg.OpenAIModel) {
 		// If it's not a valid model, print a message and set the model to the default model
-		fmt.Printf("Model %s is not a valid model\n Defaulting to %s", model, defaultModel)
+		loggerFrom(ctx).Warn("Model is not a valid model", "configured_model", cfg.OpenAIModel, "default_model", defaultModel)
 		return defaultModel, nil
 	}
-	return model, nil
+	return cfg.OpenAIModel, nil
 }
 
 // initOpenAIRequest initializes an OpenAI request and sends it to OpenAI
-func initOpenAIRequest(promptEnvVariable string, chatMessages []chatMessage) (openai.ChatCompletionResponse, error) {
+// request is passed separately from openAIRequest so handlers can send modified copies, e.g. with corrective turns.
+func initOpenAIRequest(ctx context.Context, openAIRequest openAIRequest, request Request) (openai.ChatCompletionResponse, error) {
+
+	cfg := openAIRequest.config
+	client := openAIRequest.chat
+	model, err := resolveModel(ctx, openAIRequest, request)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't get the OpenAI model: %w", err)
+	}
 
-	client := getOpenAIClient()
-	model, err := getModel()
+	// Get the inline system prompt, or the one named by prompt_template from the prompt table or the environment
+	promptTemplate, err := getSystemPrompt(ctx, openAIRequest, request)
 	if err != nil {
-		return openai.ChatCompletionResponse{}, fmt.Errorf("Can't get the OpenAI model: %v", err)
+		return openai.ChatCompletionResponse{}, err
 	}
+	promptTemplate = withLanguageInstruction(promptTemplate, request)
 
-	// Get the value of the promptEnvVariable environment variable to use as a system prompt in the API request
-	promptTemplate := os.Getenv(promptEnvVariable)
-	if promptTemplate == "" {
-		return openai.ChatCompletionResponse{}, fmt.Errorf("Prompt not found in the environment variable %s", promptEnvVariable)
+	// Drop the oldest messages the context window of the model has no room for
+	messages, err := fitContextWindow(ctx, openAIRequest, model, promptTemplate, request)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
 	}
 
-	//Add prompt from environment variable as default system prompt
+	//Add the prompt template as default system prompt
 	chatCompletionMessages := []openai.ChatCompletionMessage{{Role: "system", Content: promptTemplate}}
 
-	// Copy chatMessages to ChatCompletionMessages
-	for _, v := range chatMessages {
-		chatCompletionMessages = append(chatCompletionMessages, openai.ChatCompletionMessage{Role: v.Role, Content: v.Content})
+	// Copy request messages to ChatCompletionMessages
+	for _, v := range messages {
+		chatCompletionMessages = append(chatCompletionMessages, openai.ChatCompletionMessage{
+			Role:         v.Role,
+			Content:      v.Content,
+			Name:         v.openAIName(),
+			MultiContent: toOpenAIParts(v.Parts),
+			ToolCalls:    toOpenAIToolCalls(v.ToolCalls),
+			ToolCallID:   v.ToolCallID,
+		})
 	}
 
-	fmt.Printf("chatCompletionMessages: %v\n", chatCompletionMessages)
-
-	// Send the prompt to OpenAI API and get the response
-	response, err := client.CreateChatCompletion(
-		context.Background(),
+	openAIRequest.logger().Debug("Chat completion messages", "count", len(chatCompletionMessages), "messages", loggedPayload(cfg, fmt.Sprint(chatCompletionMessages)))
 
-		openai.ChatCompletionRequest{
-			Model:    model,
-			Messages: chatCompletionMessages,
-		},
-	)
+	chatRequest := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: chatCompletionMessages,
+	}
+	applyRequestParams(&chatRequest, request)
+	applyEconomyMode(openAIRequest, &chatRequest)
+	applyProfileResponseFormat(cfg, &chatRequest, request)
+	adaptReasoningRequest(cfg, &chatRequest)
+
+	// Send the prompt to OpenAI API and get the response, unless the response cache has it
+	response, err := createCachedChatCompletion(ctx, openAIRequest, chatRequest, func() (openai.ChatCompletionResponse, error) {
+		start := time.Now()
+		defer func() { openAIRequest.metrics.addOpenAILatency(time.Since(start)) }()
+		return withModelFallback(ctx, cfg, &chatRequest, func() (response openai.ChatCompletionResponse, err error) {
+			err = traceSubsegment(ctx, "CreateChatCompletion", func(ctx context.Context) error {
+				response, err = withOpenAITimeout(ctx, cfg, func(ctx context.Context) (openai.ChatCompletionResponse, error) {
+					return client.CreateChatCompletion(ctx, chatRequest)
+				})
+				return err
+			})
+			return response, err
+		})
+	})
 	if err != nil {
-		return openai.ChatCompletionResponse{}, fmt.Errorf("Error sending OpenAI API request: %v", err)
+		return openai.ChatCompletionResponse{}, fmt.Errorf("%w: %w", ErrOpenAIRequest, err)
 	}
 
+	// The cache keeps the completion as received, so the output pipeline runs on cached answers too
+	jsonReply := chatRequest.ResponseFormat != nil && chatRequest.ResponseFormat.Type != openai.ChatCompletionResponseFormatTypeText
+	postProcessResponse(cfg, request, &response, jsonReply)
 	return response, nil
 
 }
 
 // initOpenAIStream initializes an OpenAI request for stream response and sends it to OpenAI
-func initOpenAIStream(promptEnvVariable string, chatMessages []chatMessage) (*openai.ChatCompletionStream, error) {
+func initOpenAIStream(ctx context.Context, openAIRequest openAIRequest, request Request) (ChatStream, error) {
 
-	client := getOpenAIClient()
-	model, err := getModel()
+	cfg := openAIRequest.config
+	client := openAIRequest.chat
+	model, err := resolveModel(ctx, openAIRequest, request)
 	if err != nil {
-		return nil, fmt.Errorf("Can't get the OpenAI model: %v", err)
+		return nil, fmt.Errorf("Can't get the OpenAI model: %w", err)
 	}
 
-	// Get the value of the promptEnvVariable environment variable to use as a system prompt in the API request
-	promptTemplate := os.Getenv(promptEnvVariable)
-	if promptTemplate == "" {
-		return nil, fmt.Errorf("Prompt not found in the environment variable %s", promptEnvVariable)
+	// Get the inline system prompt, or the one named by prompt_template from the prompt table or the environment
+	promptTemplate, err := getSystemPrompt(ctx, openAIRequest, request)
+	if err != nil {
+		return nil, err
 	}
+	promptTemplate = withLanguageInstruction(promptTemplate, request)
 
-	//Add prompt from environment variable as default system prompt
+	// Drop the oldest messages the context window of the model has no room for
+	messages, err := fitContextWindow(ctx, openAIRequest, model, promptTemplate, request)
+	if err != nil {
+		return nil, err
+	}
+
+	//Add the prompt template as default system prompt
 	chatCompletionMessages := []openai.ChatCompletionMessage{{Role: "system", Content: promptTemplate}}
 
-	// Copy chatMessages to ChatCompletionMessages
-	for _, v := range chatMessages {
-		chatCompletionMessages = append(chatCompletionMessages, openai.ChatCompletionMessage{Role: v.Role, Content: v.Content})
+	// Copy request messages to ChatCompletionMessages
+	for _, v := range messages {
+		chatCompletionMessages = append(chatCompletionMessages, openai.ChatCompletionMessage{
+			Role:         v.Role,
+			Content:      v.Content,
+			Name:         v.openAIName(),
+			MultiContent: toOpenAIParts(v.Parts),
+			ToolCalls:    toOpenAIToolCalls(v.ToolCalls),
+			ToolCallID:   v.ToolCallID,
+		})
 	}
 
-	fmt.Printf("chatCompletionMessages: %v\n", chatCompletionMessages)
+	openAIRequest.logger().Debug("Chat completion messages", "count", len(chatCompletionMessages), "messages", loggedPayload(cfg, fmt.Sprint(chatCompletionMessages)))
 
-	//PresencePenalty:  2,
-	//FrequencyPenalty: 2,
+	chatRequest := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: chatCompletionMessages,
+		Stream:   true,
+	}
+	applyRequestParams(&chatRequest, request)
+	applyEconomyMode(openAIRequest, &chatRequest)
+	applyProfileResponseFormat(cfg, &chatRequest, request)
+	adaptReasoningRequest(cfg, &chatRequest)
+	// The daily usage is tracked from the usage chunk, which is only posted to clients that set include_usage
+	if request.IncludeUsage || cfg.UsageTable != "" {
+		chatRequest.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 
 	// Send the prompt to OpenAI API and get the response
-	stream, err := client.CreateChatCompletionStream(
-		context.Background(),
-
-		openai.ChatCompletionRequest{
-			Model:    model,
-			Messages: chatCompletionMessages,
-			Stream:   true,
-		},
-	)
+	stream, err := withModelFallback(ctx, cfg, &chatRequest, func() (stream ChatStream, err error) {
+		err = traceSubsegment(ctx, "CreateChatCompletionStream", func(ctx context.Context) error {
+			stream, err = client.CreateChatCompletionStream(ctx, chatRequest)
+			return err
+		})
+		return stream, err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("Error sending OpenAI API request: %v", err)
+		return nil, fmt.Errorf("%w: %w", ErrOpenAIRequest, err)
 	}
 
 	return stream, nil
@@ -340,116 +1169,185 @@ func initOpenAIStream(promptEnvVariable string, chatMessages []chatMessage) (*op
 }
 
 // getFullOpenAIResponse gets a full response from OpenAI and sends it to the client
-func getFullOpenAIResponse(openAIRequest openAIRequest) error {
-	response, err := initOpenAIRequest(openAIRequest.request.PromptTemplate, openAIRequest.request.Messages)
-	reply := response.Choices[0].Message.Content
+func getFullOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) error {
+	response, err := initOpenAIRequest(ctx, openAIRequest, openAIRequest.request)
 	if err != nil {
-		return fmt.Errorf("Error sending OpenAI API request: %s", err)
+		return err
 	}
-	// Post full answer to websocket
-	postInput := &apigatewaymanagementapi.PostToConnectionInput{
-		ConnectionId: aws.String(openAIRequest.ConnectionId),
-		Data:         []byte(reply),
+	if len(response.Choices) == 0 {
+		return ErrNoChoices
 	}
-	_, err = openAIRequest.apiGatewayClient.PostToConnection(postInput)
-	if err != nil {
-		return fmt.Errorf("Can't post response to websocket: %s\nError: %v", reply, err)
+	if len(response.Choices) > 1 && !openAIRequest.request.IncludeMetadata {
+		return deliverCandidates(openAIRequest, response)
 	}
-
-	return fmt.Errorf("Can't get OpenAI API response: %s", reply)
-}
-
-// getIntOpenAIResponse gets an integer response from OpenAI, extracts the integer, and sends it to the client
-func getIntOpenAIResponse(openAIRequest openAIRequest) error {
-	response, err := initOpenAIRequest(openAIRequest.request.PromptTemplate, openAIRequest.request.Messages)
-	if err != nil {
-		return fmt.Errorf("Error sending OpenAI API request: %v", err)
-	}
-
-	// Parse the response and extract integer answer
 	reply := response.Choices[0].Message.Content
-	fmt.Printf("response.Choices[0].Message.Content: %v\n", response.Choices[0].Message.Content)
-	re := regexp.MustCompile(`\[\[(\d+)\]\]`)
-	matchInt := re.FindStringSubmatch(reply)
-	fmt.Println("matchInt=", matchInt)
-	if len(matchInt) > 1 {
-		fmt.Println("Number:", matchInt[1])
-		postInput := &apigatewaymanagementapi.PostToConnectionInput{
-			ConnectionId: aws.String(openAIRequest.ConnectionId),
-			Data:         []byte(matchInt[1]),
-		}
-		_, err = openAIRequest.apiGatewayClient.PostToConnection(postInput)
+	data := []byte(reply)
+	if openAIRequest.request.IncludeMetadata {
+		data, err = json.Marshal(response)
 		if err != nil {
-			return fmt.Errorf("Can't post response to websocket: %s\nError: %v", reply, err)
+			return fmt.Errorf("Can't encode OpenAI API response: %v", err)
 		}
 	}
 
-	return fmt.Errorf("Can't parse OpenAI API response: %s", reply)
-}
-
-// getStringOpenAIResponse gets a string response from OpenAI, extracts the string, and sends it to the client
-func getStringOpenAIResponse(openAIRequest openAIRequest) error {
-	response, err := initOpenAIRequest(openAIRequest.request.PromptTemplate, openAIRequest.request.Messages)
+	info, err := newCompletionInfo(response)
 	if err != nil {
-		return fmt.Errorf("Error sending OpenAI API request: %s", err)
-	}
-
-	// Parse the response and extract string answer
-	reply := response.Choices[0].Message.Content
-	fmt.Printf("response.Choices[0].Message.Content: %v\n", response.Choices[0].Message.Content)
-	re := regexp.MustCompile(`\[\[((\w+\s*)+)\]\]`)
-	matchString := re.FindStringSubmatch(reply)
-	fmt.Println("matchString=", matchString)
-	if len(matchString) > 1 {
-		fmt.Println("String:", matchString[1])
-		postInput := &apigatewaymanagementapi.PostToConnectionInput{
-			ConnectionId: aws.String(openAIRequest.ConnectionId),
-			Data:         []byte(matchString[1]),
-		}
-		_, err = openAIRequest.apiGatewayClient.PostToConnection(postInput)
-		if err != nil {
-			return fmt.Errorf("Can't post response to websocket: %s\nError: %v", reply, err)
-		}
+		return err
 	}
 
-	return fmt.Errorf("Can't parse OpenAI API response: %s", reply)
+	// Post full answer to websocket
+	return deliverAnswer(openAIRequest, data, reply, info)
 }
 
 // getStreamOpenAIResponse streams responses from OpenAI to the client
-func getStreamOpenAIResponse(openAIRequest openAIRequest) error {
-	stream, err := initOpenAIStream(openAIRequest.request.PromptTemplate, openAIRequest.request.Messages)
+func getStreamOpenAIResponse(ctx context.Context, openAIRequest openAIRequest) (err error) {
+	// Cancelling the context aborts the OpenAI request as soon as the client is gone. The context also ends
+	// STREAM_DEADLINE_MARGIN_MS before the Lambda deadline, leaving time to tell the client the answer is truncated.
+	requestCtx := ctx
+	ctx, cancel := context.WithCancel(requestCtx)
+	if deadline, ok := requestCtx.Deadline(); ok {
+		ctx, cancel = context.WithDeadline(requestCtx, deadline.Add(-openAIRequest.config.DeadlineMargin))
+	}
+	defer cancel()
+	clock := openAIRequest.getClock()
+	ctx, watchdog := newStreamWatchdog(ctx, openAIRequest.config, clock)
+	defer watchdog.stop()
+
+	if openAIRequest.isCancellable() && isCancelled(ctx, openAIRequest) {
+		return postCancelled(openAIRequest)
+	}
+
+	// The OpenAI latency of a stream covers everything from opening it to its last chunk
+	streamStart := clock.Now()
+	defer func() { openAIRequest.metrics.addOpenAILatency(clock.Now().Sub(streamStart)) }()
+	stream, err := initOpenAIStream(ctx, openAIRequest, openAIRequest.request)
+	if timeout := watchdog.timedOut(); err != nil && timeout != nil {
+		return timeout
+	}
 	if err != nil {
-		return fmt.Errorf("Error requesting OpenAI API stream: %v", err)
+		return fmt.Errorf("Error requesting OpenAI API stream: %w", err)
 	}
 
 	defer stream.Close()
 
-	postInput := &apigatewaymanagementapi.PostToConnectionInput{
-		ConnectionId: aws.String(openAIRequest.ConnectionId),
-		Data:         make([]byte, 0),
+	// Time spent consuming the stream shows up as its own subsegment, next to the posts to the connection
+	_, consumeSegment := beginSubsegment(ctx, "ConsumeStream")
+	defer func() { endSubsegment(consumeSegment, err) }()
+
+	deltaPipeline, flushPipeline := newStreamPipelines(openAIRequest.config, openAIRequest.request)
+	batcher := newStreamBatcher(openAIRequest.config, openAIRequest.request.StreamGranularity, clock.Now())
+	batcher.wholeLines = len(flushPipeline) > 0
+
+	// Accumulate the streamed text only when it is needed for the output annotations, the conversation history or the audit
+	accumulate := openAIRequest.config.AnnotateLanguage || openAIRequest.config.AnnotateSafety || openAIRequest.request.ConversationID != "" ||
+		openAIRequest.audit != nil && openAIRequest.audit.includeContent
+	var streamed strings.Builder
+	var info completionInfo
+	var toolCalls toolCallAccumulator
+
+	// flush posts the buffered deltas as one frame. The text normalization already ran on every delta, so the
+	// flush size and the frame limits see the text as it is delivered. The output filters run on the batch.
+	flush := func(final bool) error {
+		// Check for a cancellation once per flush rather than per delta to keep DynamoDB reads down
+		if openAIRequest.isCancellable() && isCancelled(requestCtx, openAIRequest) {
+			cancel()
+			stream.Close()
+			return errStreamCancelled
+		}
+		data := []byte(flushPipeline.apply(batcher.take(clock.Now(), final)))
+		if accumulate {
+			streamed.Write(data)
+		}
+		start := clock.Now()
+		err := postChunk(openAIRequest, data)
+		batcher.observe(clock.Now().Sub(start))
+		if errors.Is(err, ErrClientGone) {
+			// Stop pulling tokens from OpenAI for a client that will never read them
+			cancel()
+			stream.Close()
+			return ErrClientGone
+		}
+		if err != nil {
+			return fmt.Errorf("Can't post stream chunk to websocket: %w", err)
+		}
+		return nil
 	}
 
 	for {
 		response, err := stream.Recv()
 		//isDone := false
 		if errors.Is(err, io.EOF) {
-			postInput.Data = []byte(endStreamMessage)
-			_, err := openAIRequest.apiGatewayClient.PostToConnection(postInput)
-			if err != nil {
-				return fmt.Errorf("Error requesting OpenAI API stream: %v", err)
+			if batcher.pending() {
+				err := flush(true)
+				if errors.Is(err, errStreamCancelled) {
+					return postCancelled(openAIRequest)
+				}
+				if err != nil {
+					return err
+				}
 			}
-			return nil
+			openAIRequest.logger().Info("Stream finished", "deltas", batcher.deltas, "frames", batcher.flushes, "flush_interval", batcher.interval, "flush_bytes", batcher.bytes)
+			openAIRequest.metrics.recordFlush(batcher.interval, batcher.bytes)
+			info.ToolCalls = toolCalls.calls
+			return finishStream(openAIRequest, streamed.String(), info)
 		}
 
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && requestCtx.Err() == nil {
+			// Deliver what arrived so far as a truncated answer rather than being killed mid-stream
+			openAIRequest.logger().Warn("Stream truncated before the Lambda deadline", "margin", openAIRequest.config.DeadlineMargin)
+			if batcher.pending() {
+				err := flush(true)
+				if errors.Is(err, errStreamCancelled) {
+					return postCancelled(openAIRequest)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			openAIRequest.metrics.recordFlush(batcher.interval, batcher.bytes)
+			// Tool call arguments cut short aren't valid JSON, so they are dropped
+			info.Truncated = true
+			return finishStream(openAIRequest, streamed.String(), info)
+		}
+		if timeout := watchdog.timedOut(); err != nil && timeout != nil {
+			openAIRequest.logger().Warn("Stream aborted by its timeout", "error", timeout, "deltas", batcher.deltas)
+			return timeout
+		}
 		if err != nil {
-			return fmt.Errorf("Stream error: %v", err)
+			return fmt.Errorf("%w: %v", ErrStreamAborted, err)
 		}
 
-		postInput.Data = []byte(replaceConfusables(response.Choices[0].Delta.Content))
-		_, err = openAIRequest.apiGatewayClient.PostToConnection(postInput)
-		if err != nil {
-			return fmt.Errorf("Error requesting OpenAI API stream: %v", err)
+		// The usage chunk requested with include_usage comes last and has no choices
+		if response.Usage != nil {
+			info.Usage = *response.Usage
+		}
+		if response.Model != "" {
+			info.Model = response.Model
+		}
+		if response.SystemFingerprint != "" {
+			info.SystemFingerprint = response.SystemFingerprint
+		}
+		if len(response.Choices) == 0 {
+			continue
 		}
 
+		if response.Choices[0].FinishReason != "" {
+			info.FinishReason = response.Choices[0].FinishReason
+		}
+		token := response.Choices[0].Delta.Content != "" || len(response.Choices[0].Delta.ToolCalls) > 0
+		if token {
+			openAIRequest.metrics.markFirstToken(clock.Now())
+		}
+		watchdog.chunkArrived(token)
+		toolCalls.add(response.Choices[0].Delta.ToolCalls)
+		batcher.add(deltaPipeline.apply(response.Choices[0].Delta.Content))
+		if batcher.due(clock.Now()) {
+			err := flush(false)
+			if errors.Is(err, errStreamCancelled) {
+				return postCancelled(openAIRequest)
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 }
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	apigwtypes "github.com/aws/aws-sdk-go-v2/service/apigatewaymanagementapi/types"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// The configuration is loaded by init, which exits without an OpenAI API key. Package variables are
+// initialized before it, so the tests run against the mock.
+var _ = func() bool {
+	os.Setenv("OPENAI_MOCK", "true")
+	return true
+}()
+
+func TestParseRequestBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "valid", body: `{"response_type":"full","messages":[{"role":"user","content":"hi"}]}`},
+		{name: "action", body: `{"action":"sendmessage","response_type":"full"}`},
+		{name: "unknown field", body: `{"response_type":"full","responseType":"full"}`, wantErr: `unknown field "responseType", did you mean "response_type"?`},
+		{name: "wrong case", body: `{"Response_Type":"full"}`, wantErr: `unknown field "Response_Type", did you mean "response_type"?`},
+		{name: "duplicate field", body: `{"response_type":"full","response_type":"stream"}`, wantErr: `duplicate field "response_type"`},
+		{name: "duplicate nested field", body: `{"response_type":"full","messages":[{"role":"user","role":"system","content":"hi"}]}`, wantErr: `duplicate field "messages[0].role"`},
+		{name: "duplicate map key", body: `{"response_type":"full","template_vars":{"a":"1","a":"2"}}`, wantErr: `duplicate field "template_vars.a"`},
+		{name: "trailing data", body: `{"response_type":"full"} {}`, wantErr: "unexpected data after the request object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseRequestBody(tt.body)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("parseRequestBody() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("parseRequestBody() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateRequestParamsRequiresResponseType(t *testing.T) {
+	request, err := parseRequestBody(`{"messages":[{"role":"user","content":"hi"}]}`)
+	if err != nil {
+		t.Fatalf("parseRequestBody() error = %v", err)
+	}
+	err = validateRequestParams(getConfig(), request)
+	if err == nil || err.Error() != "missing required field response_type" {
+		t.Fatalf("validateRequestParams() error = %v, want missing required field response_type", err)
+	}
+}
+
+func TestIsGoneError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "gone exception", err: &apigwtypes.GoneException{}, want: true},
+		{name: "wrapped gone exception", err: fmt.Errorf("post: %w", &apigwtypes.GoneException{}), want: true},
+		{name: "410 status", err: testsupport.ErrGone, want: true},
+		{name: "throttled", err: &testsupport.StatusError{Code: 429}},
+		{name: "other error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		if got := isGoneError(tt.err); got != tt.want {
+			t.Errorf("isGoneError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreamStopsWhenClientGone(t *testing.T) {
+	tests := []struct {
+		name       string
+		failAt     int
+		wantChunks int
+	}{
+		{name: "connected", failAt: -1, wantChunks: 10},
+		{name: "gone at the first chunk", failAt: 0, wantChunks: 1},
+		{name: "gone at the second chunk", failAt: 1, wantChunks: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			texts := make([]string, 10)
+			for i := range texts {
+				texts[i] = fmt.Sprintf("chunk %d ", i)
+			}
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(time.Second, texts...)...))
+			clock := testsupport.NewClock(testStart)
+			chat.Clock = clock
+			poster := testsupport.NewRecordingPoster()
+			if tt.failAt >= 0 {
+				poster.FailAt(tt.failAt, testsupport.ErrGone)
+			}
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, nil, clock).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d, %v", response.StatusCode, err)
+			}
+			// Every chunk read from the stream advanced the clock by its delay
+			if read := int(clock.Now().Sub(testStart) / time.Second); read != tt.wantChunks {
+				t.Fatalf("read %d chunks, want %d", read, tt.wantChunks)
+			}
+			if tt.failAt >= 0 && len(poster.Frames()) != tt.failAt {
+				t.Fatalf("posted %q after the client was gone", poster.Texts())
+			}
+		})
+	}
+}
+
+func TestPostToConnectionRetriesThrottling(t *testing.T) {
+	throttled := &testsupport.StatusError{Code: 429}
+	failed := &testsupport.StatusError{Code: 500}
+	tests := []struct {
+		name      string
+		failures  []error
+		deadline  time.Duration
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "posted", wantCalls: 1},
+		{name: "throttled twice", failures: []error{throttled, throttled}, wantCalls: 3},
+		{name: "throttle exception", failures: []error{&apigwtypes.LimitExceededException{}}, wantCalls: 2},
+		{name: "throttled too often", failures: []error{throttled, throttled, throttled, throttled}, wantCalls: 4, wantErr: throttled},
+		{name: "gone", failures: []error{testsupport.ErrGone}, wantCalls: 1, wantErr: ErrClientGone},
+		{name: "throttled then gone", failures: []error{throttled, testsupport.ErrGone}, wantCalls: 2, wantErr: ErrClientGone},
+		{name: "other error", failures: []error{failed}, wantCalls: 1, wantErr: failed},
+		{name: "deadline passed", failures: []error{throttled}, deadline: time.Millisecond, wantCalls: 1, wantErr: throttled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poster := testsupport.NewRecordingPoster()
+			for i, err := range tt.failures {
+				poster.FailAt(i, err)
+			}
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			err := postToConnection(openAIRequest{ctx: ctx, poster: poster, ConnectionId: "conn-1"}, []byte("Hello"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("postToConnection() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && tt.wantErr != ErrClientGone {
+				var postErr *postError
+				if !errors.As(err, &postErr) {
+					t.Errorf("postToConnection() error = %T, want a *postError", err)
+				}
+			}
+			if got := poster.Calls(); got != tt.wantCalls {
+				t.Errorf("PostToConnection calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStreamSurvivesThrottling(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.StreamFlushInterval = 0 })
+	texts := []string{"one ", "two ", "three ", "four"}
+	chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(time.Second, texts...)...))
+	clock := testsupport.NewClock(testStart)
+	chat.Clock = clock
+	// The second chunk is throttled twice before it is posted
+	throttled := &testsupport.StatusError{Code: 429}
+	poster := testsupport.NewRecordingPoster().FailAt(1, throttled).FailAt(2, throttled)
+	body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	response, err := newTestHandler(cfg, chat, poster, nil, clock).Handler(context.Background(), testMessage(body))
+	if err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d, %v", response.StatusCode, err)
+	}
+	want := append(texts, defaultEndStreamMessage)
+	if got := poster.Texts(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("frames = %q, want %q", got, want)
+	}
+}
+
+func TestModelValidationIsCached(t *testing.T) {
+	tests := []struct {
+		name         string
+		validation   bool
+		models       []string
+		modelsErr    error
+		wantModel    string
+		wantListings int
+	}{
+		{name: "listed model", validation: true, models: []string{"gpt-test", defaultModel}, wantModel: "gpt-test", wantListings: 1},
+		{name: "unknown model", validation: true, models: []string{defaultModel}, wantModel: defaultModel, wantListings: 1},
+		{name: "models not listed", validation: true, modelsErr: &openai.APIError{HTTPStatusCode: 404}, wantModel: "gpt-test", wantListings: 1},
+		{name: "listing fails", validation: true, modelsErr: &openai.APIError{HTTPStatusCode: 500}, wantModel: defaultModel, wantListings: 3},
+		{name: "validation off", validation: false, wantModel: "gpt-test", wantListings: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.ModelValidation = tt.validation
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			chat.Models, chat.ModelsErr = tt.models, tt.modelsErr
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			for i := 0; i < 3; i++ {
+				if response, _ := runTestRequest(t, cfg, chat, body); response.StatusCode != statusCodeOK {
+					t.Fatalf("request %d: StatusCode = %d, want %d", i, response.StatusCode, statusCodeOK)
+				}
+			}
+			for i, request := range chat.Requests() {
+				if request.Model != tt.wantModel {
+					t.Errorf("request %d: model = %q, want %q", i, request.Model, tt.wantModel)
+				}
+			}
+			if got := chat.ListModelsCalls(); got != tt.wantListings {
+				t.Errorf("ListModels calls = %d, want %d", got, tt.wantListings)
+			}
+		})
+	}
+}
+
+func TestClientsAreReused(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.OpenAIMock = false
+		cfg.APIGatewayEndpoint = "abc123.execute-api.eu-west-1.amazonaws.com/prod"
+	})
+	h := newWebsocketHandler()
+	first := h.getChatCompleter(cfg).(openAIChatCompleter)
+	if second := h.getChatCompleter(cfg).(openAIChatCompleter); second.Client != first.Client {
+		t.Error("getChatCompleter() created a new OpenAI client for the same configuration")
+	}
+	if h.getDynamoDBClient(cfg) != h.getDynamoDBClient(cfg) {
+		t.Error("getDynamoDBClient() created a new DynamoDB client for the same configuration")
+	}
+	poster := h.getConnectionPoster(context.Background(), cfg).(apiGatewayPoster)
+	if again := h.getConnectionPoster(context.Background(), cfg).(apiGatewayPoster); again.client != poster.client {
+		t.Error("getConnectionPoster() created a new API Gateway client for the same configuration")
+	}
+
+	// A reloaded configuration gets its own clients, sharing the HTTP client and its idle connections
+	reloaded := testConfig(t, func(cfg *Config) { cfg.OpenAIMock = false })
+	if h.getChatCompleter(reloaded).(openAIChatCompleter).Client == first.Client {
+		t.Error("getChatCompleter() reused the OpenAI client of an earlier configuration")
+	}
+	transport := h.httpClient.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != openAIMaxIdleConnsPerHost || transport.ResponseHeaderTimeout != openAIResponseHeaderTimeout {
+		t.Errorf("HTTP transport keeps %d idle connections per host and waits %v for headers", transport.MaxIdleConnsPerHost, transport.ResponseHeaderTimeout)
+	}
+}
+
+// TestStreamTruncatedBeforeDeadline runs a stream under a Lambda deadline that it would overrun, so it ends
+// as truncated STREAM_DEADLINE_MARGIN_MS before the deadline with the text received so far
+func TestStreamTruncatedBeforeDeadline(t *testing.T) {
+	tests := []struct {
+		name       string
+		params     string
+		deadline   time.Duration
+		wantFrames []string
+	}{
+		{name: "legacy", deadline: time.Second + 200*time.Millisecond, wantFrames: []string{"Hel", "lo", truncatedMarker, "<END>"}},
+		{name: "structured end", params: `,"structured_end":true`, deadline: time.Second + 200*time.Millisecond, wantFrames: []string{"Hel", "lo", `{"type":"end","truncated":true}`}},
+		{
+			name:     "v2",
+			params:   `,"protocol":"v2"`,
+			deadline: time.Second + 200*time.Millisecond,
+			wantFrames: []string{
+				`{"type":"chunk","seq":0,"data":"Hel"}`,
+				`{"type":"chunk","seq":1,"data":"lo"}`,
+				`{"type":"end","seq":2,"model":"gpt-test","truncated":true}`,
+			},
+		},
+		// The stream finishes long before the deadline, so it isn't truncated
+		{name: "deadline far away", deadline: time.Minute, wantFrames: []string{"Hel", "lo", " world", "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.DeadlineMargin = time.Second
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval, cfg.StreamFlushBytes = 0, 1
+			})
+			// The last delta arrives 300ms in, which is past the margin of the short deadline
+			chunks := testsupport.TextChunks(0, "Hel", "lo", " world")
+			chunks[2].Delay = 300 * time.Millisecond
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(chunks...))
+			poster := testsupport.NewRecordingPoster()
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+			body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]` + tt.params + `}`
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(ctx, testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, want a successful truncated answer", response.StatusCode, response.Body, err)
+			}
+			if got := poster.Texts(); strings.Join(got, "|") != strings.Join(tt.wantFrames, "|") {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestIncludeMetadata(t *testing.T) {
+	turn := testsupport.Reply("Hello")
+	turn.Response.ID, turn.Response.Model = "chatcmpl-1", "gpt-test-0613"
+	turn.Response.Usage = openai.Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9}
+	tests := []struct {
+		name            string
+		responseType    string
+		includeMetadata bool
+		wantStatus      int
+	}{
+		{name: "text by default", responseType: responseTypeFull, wantStatus: statusCodeOK},
+		{name: "metadata", responseType: responseTypeFull, includeMetadata: true, wantStatus: statusCodeOK},
+		{name: "not full", responseType: responseTypeInt, includeMetadata: true, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(turn)
+			body := fmt.Sprintf(`{"response_type":%q,"prompt_template":"PROMPT_TEST","include_metadata":%v,"messages":[{"role":"user","content":"hi"}]}`, tt.responseType, tt.includeMetadata)
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			texts := poster.Texts()
+			switch {
+			case tt.wantStatus != statusCodeOK:
+				if len(chat.Requests()) != 0 {
+					t.Error("the invalid request reached OpenAI")
+				}
+			case !tt.includeMetadata:
+				if len(texts) != 1 || texts[0] != "Hello" {
+					t.Errorf("frames = %q, want the bare text", texts)
+				}
+			default:
+				if len(texts) != 1 {
+					t.Fatalf("frames = %q, want the response JSON", texts)
+				}
+				var got openai.ChatCompletionResponse
+				if err := json.Unmarshal([]byte(texts[0]), &got); err != nil {
+					t.Fatalf("frame %q isn't a chat completion response: %v", texts[0], err)
+				}
+				if got.ID != "chatcmpl-1" || got.Model != "gpt-test-0613" || got.Usage != turn.Response.Usage {
+					t.Errorf("response = %+v, want the id, served model and usage", got)
+				}
+				if len(got.Choices) != 1 || got.Choices[0].Message.Content != "Hello" || got.Choices[0].FinishReason != openai.FinishReasonStop {
+					t.Errorf("choices = %+v, want Hello finishing with stop", got.Choices)
+				}
+			}
+		})
+	}
+}
+
+// TestIncludeMetadataSplit checks that a response JSON too large for one frame is split and followed by the end marker
+func TestIncludeMetadataSplit(t *testing.T) {
+	reply := largeReply()
+	cfg := testConfig(t, func(cfg *Config) { cfg.EndStreamMessage = "<END>" })
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply(reply))
+	response, poster := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","include_metadata":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+	}
+	texts := poster.Texts()
+	if len(texts) < 3 || texts[len(texts)-1] != "<END>" {
+		t.Fatalf("%d frames, want several followed by <END>", len(texts))
+	}
+	for _, text := range texts {
+		if len(text) > maxFrameBytes {
+			t.Fatalf("frame of %d bytes is over the limit", len(text))
+		}
+	}
+	var got openai.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(strings.Join(texts[:len(texts)-1], "")), &got); err != nil {
+		t.Fatalf("reassembled frames aren't a chat completion response: %v", err)
+	}
+	if got.Choices[0].Message.Content != reply {
+		t.Errorf("reassembled content of %d bytes, want the %d bytes of the reply", len(got.Choices[0].Message.Content), len(reply))
+	}
+}
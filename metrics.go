@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	metricsNamespace    = "OpenAIProxyLambda"
+	metricResultSuccess = "success"
+	metricResultOpenAI  = "openai_error"
+	metricResultParse   = "parse_error"
+	metricResultPost    = "post_error"
+	metricResultOther   = "internal_error"
+)
+
+// requestMetrics collects the metrics of one request, emitted as a single CloudWatch embedded metric format blob
+type requestMetrics struct {
+	start            time.Time
+	firstToken       time.Time
+	openAILatency    time.Duration
+	promptTokens     int
+	completionTokens int
+	posts            int
+	droppedMessages  int
+	cacheHits        int
+	cacheMisses      int
+	economyMode      bool // max_tokens was reduced because the daily usage passed SOFT_CAP_PERCENT
+	model            string
+	apiKey           string // Suffix of the key picked from OPENAI_API_KEYS
+	streamed         bool   // A stream recorded its final flush settings
+	flushInterval    time.Duration
+	flushBytes       int
+}
+
+// newRequestMetrics starts collecting the metrics of a request timed by clock
+func newRequestMetrics(clock Clock) *requestMetrics {
+	return &requestMetrics{start: clock.Now()}
+}
+
+// addOpenAILatency records time spent waiting for the OpenAI API
+func (m *requestMetrics) addOpenAILatency(latency time.Duration) {
+	if m != nil {
+		m.openAILatency += latency
+	}
+}
+
+// markFirstToken records the arrival of the first streamed token at now
+func (m *requestMetrics) markFirstToken(now time.Time) {
+	if m != nil && m.firstToken.IsZero() {
+		m.firstToken = now
+	}
+}
+
+// recordFlush records the flush interval and size a stream ended with, adapted when STREAM_FLUSH_ADAPTIVE is set
+func (m *requestMetrics) recordFlush(interval time.Duration, bytes int) {
+	if m != nil {
+		m.streamed = true
+		m.flushInterval, m.flushBytes = interval, bytes
+	}
+}
+
+// addDroppedMessages records messages trimmed to fit the context window
+func (m *requestMetrics) addDroppedMessages(count int) {
+	if m != nil {
+		m.droppedMessages += count
+	}
+}
+
+// countCache records a response cache lookup
+func (m *requestMetrics) countCache(hit bool) {
+	if m == nil {
+		return
+	}
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+// markEconomyMode records that the request runs in economy mode
+func (m *requestMetrics) markEconomyMode() {
+	if m != nil {
+		m.economyMode = true
+	}
+}
+
+// countPost records one PostToConnection call
+func (m *requestMetrics) countPost() {
+	if m != nil {
+		m.posts++
+	}
+}
+
+// recordCompletion records the token usage and the model of an answer
+func (m *requestMetrics) recordCompletion(info completionInfo) {
+	if m == nil {
+		return
+	}
+	m.promptTokens += info.Usage.PromptTokens
+	m.completionTokens += info.Usage.CompletionTokens
+	if info.Model != "" {
+		m.model = info.Model
+	}
+}
+
+// metricResult classifies the outcome of a request for the Result dimension
+func metricResult(err error) string {
+	var postErr *postError
+	switch {
+	case err == nil:
+		return metricResultSuccess
+	case errors.Is(err, ErrClientGone), errors.As(err, &postErr):
+		return metricResultPost
+	case errors.Is(err, ErrUnparsableResponse), errors.Is(err, ErrContentFiltered):
+		return metricResultParse
+	case errors.Is(err, ErrOpenAIRequest), errors.Is(err, ErrStreamAborted), isTimeoutError(err), errors.Is(err, ErrProviderUnavailable):
+		return metricResultOpenAI
+	default:
+		return metricResultOther
+	}
+}
+
+// emitMetrics writes the metrics of the request to stdout in the CloudWatch embedded metric format when METRICS_ENABLED is set
+func emitMetrics(openAIRequest openAIRequest, err error) {
+	m := openAIRequest.metrics
+	if m == nil || !openAIRequest.config.MetricsEnabled {
+		return
+	}
+	model := m.model
+	if model == "" {
+		model = openAIRequest.config.OpenAIModel
+	}
+
+	metrics := []map[string]string{
+		{"Name": "OpenAILatencyMs", "Unit": "Milliseconds"},
+		{"Name": "PromptTokens", "Unit": "Count"},
+		{"Name": "CompletionTokens", "Unit": "Count"},
+		{"Name": "PostCount", "Unit": "Count"},
+		{"Name": "DroppedMessages", "Unit": "Count"},
+		{"Name": "CacheHits", "Unit": "Count"},
+		{"Name": "CacheMisses", "Unit": "Count"},
+		{"Name": "EconomyMode", "Unit": "Count"},
+	}
+	economyMode := 0
+	if m.economyMode {
+		economyMode = 1
+	}
+	blob := map[string]any{
+		"ResponseType":     openAIRequest.request.ResponseType,
+		"Model":            model,
+		"Result":           metricResult(err),
+		"OpenAILatencyMs":  m.openAILatency.Milliseconds(),
+		"PromptTokens":     m.promptTokens,
+		"CompletionTokens": m.completionTokens,
+		"PostCount":        m.posts,
+		"DroppedMessages":  m.droppedMessages,
+		"CacheHits":        m.cacheHits,
+		"CacheMisses":      m.cacheMisses,
+		"EconomyMode":      economyMode,
+	}
+	// The user is a property rather than a dimension, so it can be queried without multiplying the metrics
+	if openAIRequest.identity != nil {
+		blob["UserSub"] = openAIRequest.identity.Sub
+	}
+	if tenant := tenantFrom(openAIRequest.ctx); tenant != "" {
+		blob["Tenant"] = tenant
+	}
+	if !m.firstToken.IsZero() {
+		metrics = append(metrics, map[string]string{"Name": "TimeToFirstTokenMs", "Unit": "Milliseconds"})
+		blob["TimeToFirstTokenMs"] = m.firstToken.Sub(m.start).Milliseconds()
+	}
+	if m.streamed {
+		metrics = append(metrics, map[string]string{"Name": "FlushIntervalMs", "Unit": "Milliseconds"}, map[string]string{"Name": "FlushBytes", "Unit": "Bytes"})
+		blob["FlushIntervalMs"] = m.flushInterval.Milliseconds()
+		blob["FlushBytes"] = m.flushBytes
+	}
+	dimensions := [][]string{{"ResponseType", "Model", "Result"}}
+	if m.apiKey != "" {
+		blob["OpenAIKey"] = m.apiKey
+		dimensions = append(dimensions, []string{"OpenAIKey"})
+	}
+	blob["_aws"] = map[string]any{
+		"Timestamp": openAIRequest.getClock().Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": dimensions,
+			"Metrics":    metrics,
+		}},
+	}
+
+	data, marshalErr := json.Marshal(blob)
+	if marshalErr != nil {
+		openAIRequest.logger().Error("Can't encode metrics", "error", marshalErr)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+}
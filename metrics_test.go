@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestMetricResult(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: metricResultSuccess},
+		{err: ErrClientGone, want: metricResultPost},
+		{err: &postError{err: &testsupport.StatusError{Code: 500}}, want: metricResultPost},
+		{err: ErrUnparsableResponse, want: metricResultParse},
+		{err: ErrNoChoices, want: metricResultParse},
+		{err: ErrContentFiltered, want: metricResultParse},
+		{err: fmt.Errorf("%w: bad request", ErrOpenAIRequest), want: metricResultOpenAI},
+		{err: ErrStreamAborted, want: metricResultOpenAI},
+		{err: fmt.Errorf("building the prompt: %w", os.ErrNotExist), want: metricResultOther},
+	}
+	for _, tt := range tests {
+		if got := metricResult(tt.err); got != tt.want {
+			t.Errorf("metricResult(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// captureStdout returns what run writes to stdout
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = original }()
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+	run()
+	writer.Close()
+	return <-output
+}
+
+// emfBlob is the part of an embedded metric format blob the tests check
+type emfBlob struct {
+	AWS struct {
+		Timestamp         int64
+		CloudWatchMetrics []struct {
+			Namespace  string
+			Dimensions [][]string
+			Metrics    []struct{ Name, Unit string }
+		}
+	} `json:"_aws"`
+	ResponseType string
+	Model        string
+	Result       string
+}
+
+func TestEmitMetrics(t *testing.T) {
+	usage := testsupport.Reply("[[42]]")
+	usage.Response.Usage = openai.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}
+	tests := []struct {
+		name         string
+		disabled     bool
+		responseType string
+		turn         testsupport.Turn
+		wantResult   string
+		wantMetrics  []string
+		wantValues   map[string]float64
+	}{
+		{
+			name:         "int",
+			responseType: responseTypeInt,
+			turn:         usage,
+			wantResult:   metricResultSuccess,
+			wantMetrics:  []string{"OpenAILatencyMs", "PromptTokens", "CompletionTokens", "PostCount"},
+			wantValues:   map[string]float64{"PromptTokens": 12, "CompletionTokens": 3, "PostCount": 1},
+		},
+		{
+			name:         "stream",
+			responseType: responseTypeStream,
+			turn:         testsupport.Stream(testsupport.TextChunks(time.Millisecond, "Hel", "lo")...),
+			wantResult:   metricResultSuccess,
+			wantMetrics:  []string{"OpenAILatencyMs", "TimeToFirstTokenMs", "PostCount", "FlushIntervalMs", "FlushBytes"},
+			wantValues:   map[string]float64{"FlushIntervalMs": 150, "FlushBytes": 4096},
+		},
+		{
+			name:         "unparsable",
+			responseType: responseTypeInt,
+			turn:         testsupport.Reply("no number"),
+			wantResult:   metricResultParse,
+		},
+		{
+			name:         "OpenAI failure",
+			responseType: responseTypeFull,
+			turn:         testsupport.Fail(&openai.APIError{HTTPStatusCode: 400, Message: "bad request"}),
+			wantResult:   metricResultOpenAI,
+		},
+		{name: "disabled", disabled: true, responseType: responseTypeFull, turn: testsupport.Reply("Hello")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.MetricsEnabled = !tt.disabled
+				cfg.OpenAIModel = "gpt-test"
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			output := captureStdout(t, func() { runTestRequest(t, cfg, chat, body) })
+
+			var blobs []string
+			for _, line := range strings.Split(output, "\n") {
+				if strings.Contains(line, `"_aws"`) {
+					blobs = append(blobs, line)
+				}
+			}
+			if tt.disabled {
+				if len(blobs) != 0 {
+					t.Fatalf("metrics emitted with METRICS_ENABLED off: %q", blobs)
+				}
+				return
+			}
+			if len(blobs) != 1 {
+				t.Fatalf("got %d metric blobs, want 1: %q", len(blobs), output)
+			}
+			var blob emfBlob
+			var values map[string]any
+			if err := json.Unmarshal([]byte(blobs[0]), &blob); err != nil {
+				t.Fatalf("metric blob %s: %v", blobs[0], err)
+			}
+			json.Unmarshal([]byte(blobs[0]), &values)
+			if len(blob.AWS.CloudWatchMetrics) != 1 || blob.AWS.Timestamp == 0 {
+				t.Fatalf("metric blob %s has no CloudWatchMetrics directive", blobs[0])
+			}
+			directive := blob.AWS.CloudWatchMetrics[0]
+			if directive.Namespace != metricsNamespace || strings.Join(directive.Dimensions[0], ",") != "ResponseType,Model,Result" {
+				t.Errorf("directive = %+v, want namespace %s and dimensions ResponseType, Model, Result", directive, metricsNamespace)
+			}
+			if blob.ResponseType != tt.responseType || blob.Model != "gpt-test" || blob.Result != tt.wantResult {
+				t.Errorf("dimensions = %s, %s, %s, want %s, gpt-test, %s", blob.ResponseType, blob.Model, blob.Result, tt.responseType, tt.wantResult)
+			}
+			// Every declared metric needs a value of the same name, or CloudWatch drops the blob
+			declared := map[string]bool{}
+			for _, metric := range directive.Metrics {
+				declared[metric.Name] = true
+				if _, ok := values[metric.Name].(float64); !ok {
+					t.Errorf("metric %s has no numeric value in %s", metric.Name, blobs[0])
+				}
+			}
+			for _, name := range tt.wantMetrics {
+				if !declared[name] {
+					t.Errorf("metric %s isn't declared in %s", name, blobs[0])
+				}
+			}
+			for name, want := range tt.wantValues {
+				if values[name] != want {
+					t.Errorf("%s = %v, want %v", name, values[name], want)
+				}
+			}
+		})
+	}
+}
+
+// TestMetricsUseRequestClock checks that the latencies are measured on the clock of the request
+func TestMetricsUseRequestClock(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.MetricsEnabled = true })
+	clock := testsupport.NewClock(testStart)
+	chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(250*time.Millisecond, "Hel", "lo")...))
+	chat.Clock = clock
+	body := `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	output := captureStdout(t, func() {
+		newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), nil, clock).Handler(context.Background(), testMessage(body))
+	})
+	var values map[string]any
+	for _, line := range strings.Split(output, "\n") {
+		if strings.Contains(line, `"_aws"`) {
+			json.Unmarshal([]byte(line), &values)
+		}
+	}
+	if values["TimeToFirstTokenMs"] != float64(250) || values["OpenAILatencyMs"] != float64(500) {
+		t.Errorf("TimeToFirstTokenMs = %v, OpenAILatencyMs = %v, want 250 and 500 of the request clock", values["TimeToFirstTokenMs"], values["OpenAILatencyMs"])
+	}
+	if aws, _ := values["_aws"].(map[string]any); aws == nil || aws["Timestamp"] != float64(clock.Now().UnixMilli()) {
+		t.Errorf("metrics timestamp = %v, want the time of the request clock", values["_aws"])
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	// mockErrorPrefix makes the mock fail the request, with the status code following it or a 500
+	mockErrorPrefix = "ERROR:"
+	mockIntReply    = "[[42]]"
+	mockStreamDelay = 20 * time.Millisecond
+)
+
+// mockDeltaPattern splits a reply into words keeping the whitespace around them, so the deltas concatenate to the reply
+var mockDeltaPattern = regexp.MustCompile(`\s*\S+\s*`)
+
+// mockChatCompleter is the ChatCompleter of OPENAI_MOCK mode. It answers without calling OpenAI, so clients
+// can be tested deterministically against the real request handling: replies echo the user messages, int
+// requests are answered with 42, and a last user message starting with ERROR: fails like an OpenAI API error.
+type mockChatCompleter struct {
+	models       []string
+	responseType string
+}
+
+// newMockChatCompleter creates the mock, listing every model the configuration refers to
+func newMockChatCompleter(cfg *Config) mockChatCompleter {
+	models := []string{cfg.OpenAIModel, cfg.SummaryModel}
+	if cfg.OpenAIFallbackModel != "" {
+		models = append(models, cfg.OpenAIFallbackModel)
+	}
+	for _, profile := range cfg.PromptProfiles {
+		if profile.Model != "" {
+			models = append(models, profile.Model)
+		}
+	}
+	return mockChatCompleter{models: models}
+}
+
+// withResponseType returns a copy of the mock answering requests of responseType
+func (c mockChatCompleter) withResponseType(responseType string) mockChatCompleter {
+	c.responseType = responseType
+	return c
+}
+
+// reply returns the canned reply to request, or the simulated API error its last user message asks for
+func (c mockChatCompleter) reply(request openai.ChatCompletionRequest) (string, error) {
+	var userContent []string
+	last := ""
+	for _, message := range request.Messages {
+		if message.Role != openai.ChatMessageRoleUser {
+			continue
+		}
+		last = mockMessageText(message)
+		userContent = append(userContent, last)
+	}
+	if strings.HasPrefix(last, mockErrorPrefix) {
+		return "", mockAPIError(strings.TrimPrefix(last, mockErrorPrefix))
+	}
+	if c.responseType == responseTypeInt {
+		return mockIntReply, nil
+	}
+	return strings.Join(userContent, "\n"), nil
+}
+
+// mockMessageText returns the text of a message, joining the text parts of multi part content
+func mockMessageText(message openai.ChatCompletionMessage) string {
+	if len(message.MultiContent) == 0 {
+		return message.Content
+	}
+	var texts []string
+	for _, part := range message.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// mockAPIError builds the API error of an ERROR: message. A status code right after the prefix selects
+// the HTTP status, e.g. "ERROR:429 slow down", so retries and fallbacks can be exercised too.
+func mockAPIError(rest string) error {
+	status := http.StatusInternalServerError
+	rest = strings.TrimSpace(rest)
+	if code, message, _ := strings.Cut(rest, " "); len(code) == 3 {
+		if parsed, err := strconv.Atoi(code); err == nil {
+			status, rest = parsed, message
+		}
+	}
+	if rest == "" {
+		rest = "Simulated OpenAI API error"
+	}
+	return &openai.APIError{Type: "mock_error", Message: rest, HTTPStatusCode: status}
+}
+
+// mockUsage counts words as tokens, which is close enough for the usage frames and the quota
+func mockUsage(request openai.ChatCompletionRequest, reply string) openai.Usage {
+	prompt := 0
+	for _, message := range request.Messages {
+		prompt += len(strings.Fields(mockMessageText(message)))
+	}
+	completion := len(strings.Fields(reply))
+	return openai.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
+
+// CreateChatCompletion returns the canned reply as one choice
+func (c mockChatCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	reply, err := c.reply(request)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	choices := max(request.N, 1)
+	response := openai.ChatCompletionResponse{
+		ID:      "mock-" + localID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   request.Model,
+		Usage:   mockUsage(request, strings.Repeat(reply+" ", choices)),
+	}
+	for i := 0; i < choices; i++ {
+		response.Choices = append(response.Choices, openai.ChatCompletionChoice{
+			Index:        i,
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply},
+			FinishReason: openai.FinishReasonStop,
+		})
+	}
+	return response, nil
+}
+
+// CreateChatCompletionStream streams the canned reply in word sized deltas
+func (c mockChatCompleter) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error) {
+	reply, err := c.reply(request)
+	if err != nil {
+		return nil, err
+	}
+	deltas := mockDeltaPattern.FindAllString(reply, -1)
+	if len(deltas) == 0 && reply != "" {
+		deltas = []string{reply}
+	}
+	stream := &mockStream{ctx: ctx, model: request.Model, deltas: deltas}
+	if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		usage := mockUsage(request, reply)
+		stream.usage = &usage
+	}
+	return stream, nil
+}
+
+// ListModels lists the models of the configuration, so the model validation passes
+func (c mockChatCompleter) ListModels(ctx context.Context) (openai.ModelsList, error) {
+	var list openai.ModelsList
+	for _, model := range c.models {
+		list.Models = append(list.Models, openai.Model{ID: model, Object: "model", OwnedBy: "mock"})
+	}
+	return list, nil
+}
+
+// Moderations flags nothing
+func (c mockChatCompleter) Moderations(ctx context.Context, request openai.ModerationRequest) (openai.ModerationResponse, error) {
+	return openai.ModerationResponse{ID: "mock-" + localID(), Model: request.Model, Results: []openai.Result{{}}}, nil
+}
+
+// mockStream returns the deltas of a mock reply with a short delay each, then the finish chunk and the usage
+type mockStream struct {
+	ctx      context.Context
+	model    string
+	deltas   []string
+	usage    *openai.Usage
+	finished bool
+}
+
+// Recv returns the next chunk, or io.EOF after the last one
+func (s *mockStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	chunk := openai.ChatCompletionStreamResponse{Object: "chat.completion.chunk", Model: s.model}
+	switch {
+	case len(s.deltas) > 0:
+		select {
+		case <-s.ctx.Done():
+			return chunk, s.ctx.Err()
+		case <-time.After(mockStreamDelay):
+		}
+		chunk.Choices = []openai.ChatCompletionStreamChoice{{Delta: openai.ChatCompletionStreamChoiceDelta{Content: s.deltas[0]}}}
+		s.deltas = s.deltas[1:]
+	case !s.finished:
+		s.finished = true
+		chunk.Choices = []openai.ChatCompletionStreamChoice{{FinishReason: openai.FinishReasonStop}}
+	case s.usage != nil:
+		chunk.Usage, s.usage = s.usage, nil
+	default:
+		return chunk, io.EOF
+	}
+	return chunk, nil
+}
+
+// Close does nothing, the mock holds no connection
+func (s *mockStream) Close() error {
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestMockReply(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		messages     []openai.ChatCompletionMessage
+		want         string
+		wantStatus   int // HTTP status of the simulated API error, 0 for none
+		wantMessage  string
+	}{
+		{
+			name:         "echoes the user messages",
+			responseType: responseTypeStream,
+			messages: []openai.ChatCompletionMessage{
+				{Role: openai.ChatMessageRoleSystem, Content: "You are a test assistant."},
+				{Role: openai.ChatMessageRoleUser, Content: "Hello there"},
+				{Role: openai.ChatMessageRoleAssistant, Content: "Hi"},
+				{Role: openai.ChatMessageRoleUser, Content: "How are you?"},
+			},
+			want: "Hello there\nHow are you?",
+		},
+		{
+			name:         "multi part content",
+			responseType: responseTypeFull,
+			messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, MultiContent: []openai.ChatMessagePart{
+				{Type: openai.ChatMessagePartTypeText, Text: "Describe"},
+				{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: "https://example.com/cat.png"}},
+				{Type: openai.ChatMessagePartTypeText, Text: "this"},
+			}}},
+			want: "Describe\nthis",
+		},
+		{name: "int", responseType: responseTypeInt, messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "Rate it"}}, want: mockIntReply},
+		{name: "error", responseType: responseTypeInt, messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ERROR:"}}, wantStatus: 500, wantMessage: "Simulated OpenAI API error"},
+		{name: "error with status", responseType: responseTypeStream, messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ERROR:429 slow down"}}, wantStatus: 429, wantMessage: "slow down"},
+		{name: "error with message", responseType: responseTypeStream, messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ERROR: model overloaded"}}, wantStatus: 500, wantMessage: "model overloaded"},
+		{
+			// Only the last user message decides, so the history of an earlier error doesn't fail the conversation
+			name:         "earlier error",
+			responseType: responseTypeFull,
+			messages:     []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "ERROR:503"}, {Role: openai.ChatMessageRoleUser, Content: "again"}},
+			want:         "ERROR:503\nagain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockChatCompleter(&Config{OpenAIModel: "gpt-test"}).withResponseType(tt.responseType)
+			got, err := mock.reply(openai.ChatCompletionRequest{Messages: tt.messages})
+			if tt.wantStatus != 0 {
+				var apiErr *openai.APIError
+				if !errors.As(err, &apiErr) || apiErr.HTTPStatusCode != tt.wantStatus || apiErr.Message != tt.wantMessage {
+					t.Fatalf("reply() error = %v, want an API error %d %q", err, tt.wantStatus, tt.wantMessage)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("reply() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMockStream(t *testing.T) {
+	mock := newMockChatCompleter(&Config{OpenAIModel: "gpt-test"}).withResponseType(responseTypeStream)
+	request := openai.ChatCompletionRequest{
+		Model:         "gpt-test",
+		Messages:      []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "one two  three"}},
+		StreamOptions: &openai.StreamOptions{IncludeUsage: true},
+	}
+	stream, err := mock.CreateChatCompletionStream(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	var deltas []string
+	var finish openai.FinishReason
+	var usage *openai.Usage
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				deltas = append(deltas, choice.Delta.Content)
+			}
+			if choice.FinishReason != "" {
+				finish = choice.FinishReason
+			}
+		}
+	}
+	if want := []string{"one ", "two  ", "three"}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("deltas = %q, want %q", deltas, want)
+	}
+	if finish != openai.FinishReasonStop {
+		t.Errorf("finish reason = %q, want stop", finish)
+	}
+	if want := (openai.Usage{PromptTokens: 3, CompletionTokens: 3, TotalTokens: 6}); usage == nil || *usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+
+	// A canceled request stops the stream between deltas
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream, _ = mock.CreateChatCompletionStream(ctx, request)
+	if _, err := stream.Recv(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Recv() after cancel error = %v, want context.Canceled", err)
+	}
+}
+
+func TestMockListModels(t *testing.T) {
+	mock := newMockChatCompleter(&Config{
+		OpenAIModel:         "gpt-test",
+		SummaryModel:        "gpt-summary",
+		OpenAIFallbackModel: "gpt-fallback",
+		PromptProfiles:      map[string]promptProfile{"PROMPT_SCORER": {Model: "gpt-scorer"}, "PROMPT_CHAT": {}},
+	})
+	list, err := mock.ListModels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, model := range list.Models {
+		got = append(got, model.ID)
+	}
+	if want := []string{"gpt-test", "gpt-summary", "gpt-fallback", "gpt-scorer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("models = %q, want %q", got, want)
+	}
+}
+
+// TestMockMode checks that OPENAI_MOCK replaces only the OpenAI client, the answers still go through the
+// extraction, the end marker and the error frames of the handler
+func TestMockMode(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		content      string
+		wantStatus   int
+		wantFrames   []string
+	}{
+		{name: "stream", responseType: responseTypeStream, content: "Hello mock world", wantStatus: statusCodeOK, wantFrames: []string{"Hello ", "mock ", "world", "<END>"}},
+		{name: "int", responseType: responseTypeInt, content: "Rate it", wantStatus: statusCodeOK, wantFrames: []string{"42"}},
+		{name: "full", responseType: responseTypeFull, content: "Echo this", wantStatus: statusCodeOK, wantFrames: []string{"Echo this"}},
+		{name: "simulated error", responseType: responseTypeFull, content: "ERROR:400 bad prompt", wantStatus: statusCodeServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIMock = true
+				cfg.OpenAIMaxRetries = 0
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval, cfg.StreamFlushBytes = 0, 1
+			})
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, nil, poster, nil, nil)
+			// The OpenAI client is built from the configuration, like on Lambda
+			h.openAIClients.generation = 0
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"` + tt.content + `"}]}`
+			response, err := h.Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if _, ok := h.getChatCompleter(cfg).(mockChatCompleter); !ok {
+				t.Fatalf("OpenAI client = %T, want the mock", h.getChatCompleter(cfg))
+			}
+			if tt.wantFrames == nil {
+				texts := poster.Texts()
+				if len(texts) != 1 || !strings.Contains(texts[0], `"type":"error"`) || !strings.Contains(texts[0], "bad prompt") {
+					t.Errorf("frames = %q, want the error frame of the simulated error", texts)
+				}
+				return
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestLoadConfigOpenAIMock(t *testing.T) {
+	tests := []struct {
+		name    string
+		mock    string
+		wantErr bool
+	}{
+		// The mock never calls OpenAI, so it needs no API key
+		{name: "mock", mock: "1"},
+		{name: "no mock", mock: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OPENAI_MOCK", tt.mock)
+			t.Setenv("OPENAI_API_KEY", "")
+			t.Setenv("OPENAI_API_KEY_SECRET_ARN", "")
+			t.Setenv("OPENAI_API_KEY_SSM_PARAM", "")
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !cfg.OpenAIMock {
+				t.Error("OpenAIMock = false, want the mock enabled")
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// parseModelAliases parses the alias=model JSON object of MODEL_ALIASES. An alias may not point at another
+// alias, so every name resolves in one step.
+func parseModelAliases(value string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return aliases, nil
+	}
+	if err := json.Unmarshal([]byte(value), &aliases); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable MODEL_ALIASES, expected a JSON object of model names: %v", err)
+	}
+	for alias, model := range aliases {
+		if alias == "" || model == "" {
+			return nil, fmt.Errorf("Invalid value for environment variable MODEL_ALIASES, aliases and models can't be empty")
+		}
+		if _, ok := aliases[model]; ok {
+			return nil, fmt.Errorf("Invalid value for environment variable MODEL_ALIASES, alias %q points at the alias %q", alias, model)
+		}
+	}
+	return aliases, nil
+}
+
+// resolveModelAlias returns the model an alias stands for. Names that aren't aliases are model IDs themselves.
+func resolveModelAlias(aliases map[string]string, name string) string {
+	if model, ok := aliases[name]; ok {
+		return model
+	}
+	return name
+}
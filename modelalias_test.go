@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseModelAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "unset", want: map[string]string{}},
+		{name: "aliases", value: `{"fast":"gpt-4o-mini","smart":"gpt-4o-2024-08-06"}`, want: map[string]string{"fast": "gpt-4o-mini", "smart": "gpt-4o-2024-08-06"}},
+		{name: "malformed", value: `{"fast":"gpt-4o-mini"`, wantErr: "expected a JSON object of model names"},
+		{name: "not strings", value: `{"fast":4}`, wantErr: "expected a JSON object of model names"},
+		{name: "empty model", value: `{"fast":""}`, wantErr: "can't be empty"},
+		{name: "nested alias", value: `{"fast":"cheap","cheap":"gpt-4o-mini"}`, wantErr: `alias "fast" points at the alias "cheap"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseModelAliases(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseModelAliases() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseModelAliases() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveModelAlias(t *testing.T) {
+	aliases := map[string]string{"fast": "gpt-4o-mini", "smart": "gpt-4o-2024-08-06"}
+	tests := map[string]string{
+		"fast":        "gpt-4o-mini",
+		"smart":       "gpt-4o-2024-08-06",
+		"gpt-4o-mini": "gpt-4o-mini",
+		"quick":       "quick",
+		"":            "",
+	}
+	for name, want := range tests {
+		if got := resolveModelAlias(aliases, name); got != want {
+			t.Errorf("resolveModelAlias(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigModelAliases(t *testing.T) {
+	tests := []struct {
+		name         string
+		aliases      string
+		model        string
+		fallback     string
+		wantModel    string
+		wantFallback string
+		wantErr      bool
+	}{
+		{name: "alias hit", aliases: `{"fast":"gpt-4o-mini","smart":"gpt-4o-2024-08-06"}`, model: "smart", fallback: "fast", wantModel: "gpt-4o-2024-08-06", wantFallback: "gpt-4o-mini"},
+		{name: "literal model", aliases: `{"fast":"gpt-4o-mini"}`, model: "gpt-4o", wantModel: "gpt-4o"},
+		{name: "malformed", aliases: `{"fast":`, model: "fast", wantErr: true},
+		{name: "nested alias", aliases: `{"fast":"cheap","cheap":"gpt-4o-mini"}`, model: "fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MODEL_ALIASES", tt.aliases)
+			t.Setenv("OPENAI_MODEL", tt.model)
+			t.Setenv("OPENAI_FALLBACK_MODEL", tt.fallback)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cfg.OpenAIModel != tt.wantModel || cfg.OpenAIFallbackModel != tt.wantFallback {
+				t.Errorf("models = %q, %q, want %q, %q", cfg.OpenAIModel, cfg.OpenAIFallbackModel, tt.wantModel, tt.wantFallback)
+			}
+		})
+	}
+}
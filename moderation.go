@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	errorCodeContentFlagged = "content_flagged"
+	moderationFailOpen      = "open"
+	moderationFailClosed    = "closed"
+)
+
+// contentFlaggedFrame is posted to legacy clients when moderation flagged their input
+type contentFlaggedFrame struct {
+	Type       string   `json:"type"`
+	Code       string   `json:"code"`
+	Categories []string `json:"categories"`
+}
+
+// moderationScores returns the category scores of a moderation result by category name
+func moderationScores(result openai.Result) map[string]float32 {
+	return map[string]float32{
+		"hate":                   result.CategoryScores.Hate,
+		"hate/threatening":       result.CategoryScores.HateThreatening,
+		"harassment":             result.CategoryScores.Harassment,
+		"harassment/threatening": result.CategoryScores.HarassmentThreatening,
+		"self-harm":              result.CategoryScores.SelfHarm,
+		"self-harm/intent":       result.CategoryScores.SelfHarmIntent,
+		"self-harm/instructions": result.CategoryScores.SelfHarmInstructions,
+		"sexual":                 result.CategoryScores.Sexual,
+		"sexual/minors":          result.CategoryScores.SexualMinors,
+		"violence":               result.CategoryScores.Violence,
+		"violence/graphic":       result.CategoryScores.ViolenceGraphic,
+	}
+}
+
+// flaggedCategories returns the sorted names of the categories flagged in any moderation result
+func flaggedCategories(moderation *openai.ModerationResponse) []string {
+	flagged := make(map[string]bool)
+	for _, result := range moderation.Results {
+		categories := result.Categories
+		for category, isFlagged := range map[string]bool{
+			"hate":                   categories.Hate,
+			"hate/threatening":       categories.HateThreatening,
+			"harassment":             categories.Harassment,
+			"harassment/threatening": categories.HarassmentThreatening,
+			"self-harm":              categories.SelfHarm,
+			"self-harm/intent":       categories.SelfHarmIntent,
+			"self-harm/instructions": categories.SelfHarmInstructions,
+			"sexual":                 categories.Sexual,
+			"sexual/minors":          categories.SexualMinors,
+			"violence":               categories.Violence,
+			"violence/graphic":       categories.ViolenceGraphic,
+		} {
+			if isFlagged {
+				flagged[category] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(flagged))
+	for category := range flagged {
+		names = append(names, category)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// userInput concatenates the contents of the user messages of the request, so one moderation call covers them all
+func userInput(messages []chatMessage) string {
+	var contents []string
+	for _, message := range messages {
+		if message.Role == openai.ChatMessageRoleUser {
+			contents = append(contents, message.text())
+		}
+	}
+	return strings.Join(contents, "\n\n")
+}
+
+// shouldModerate checks if the input of the request has to pass moderation before the chat call
+func shouldModerate(cfg *Config, request Request) bool {
+	return cfg.Moderation && !(request.SkipModeration && cfg.AllowModerationBypass)
+}
+
+// moderateInput runs the user messages of the request through the OpenAI moderation endpoint with the same
+// retries as the chat calls. A moderation failure lets the request through or rejects it depending on
+// MODERATION_FAIL_MODE; the returned error is only set in closed mode.
+func moderateInput(ctx context.Context, openAIRequest openAIRequest) (*openai.ModerationResponse, error) {
+	input := userInput(openAIRequest.request.Messages)
+	if input == "" {
+		return nil, nil
+	}
+	moderation, err := withOpenAIRetries(ctx, openAIRequest.config, func() (moderation openai.ModerationResponse, err error) {
+		err = traceSubsegment(ctx, "Moderation", func(ctx context.Context) error {
+			moderation, err = openAIRequest.chat.Moderations(ctx, openai.ModerationRequest{Input: input})
+			return err
+		})
+		return moderation, err
+	})
+	if err == nil {
+		return &moderation, nil
+	}
+	openAIRequest.logger().Error("Moderation failed", "fail_mode", openAIRequest.config.ModerationFailMode, "error", err)
+	if openAIRequest.config.ModerationFailMode == moderationFailClosed {
+		return nil, fmt.Errorf("%w: %w", ErrOpenAIRequest, err)
+	}
+	return nil, nil
+}
+
+// postContentFlagged tells the client which moderation categories its input was flagged for
+func postContentFlagged(openAIRequest openAIRequest, categories []string) error {
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeError, Code: errorCodeContentFlagged, Data: map[string][]string{"categories": categories}})
+	}
+	payload, err := json.Marshal(contentFlaggedFrame{Type: frameTypeError, Code: errorCodeContentFlagged, Categories: categories})
+	if err != nil {
+		return fmt.Errorf("Can't encode content flagged frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
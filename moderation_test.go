@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestFlaggedCategories(t *testing.T) {
+	moderation := &openai.ModerationResponse{Results: []openai.Result{
+		{Flagged: true, Categories: openai.ResultCategories{Violence: true, Harassment: true}},
+		{Flagged: false},
+		{Flagged: true, Categories: openai.ResultCategories{Violence: true, SelfHarmIntent: true}},
+	}}
+	want := []string{"harassment", "self-harm/intent", "violence"}
+	if got := flaggedCategories(moderation); !reflect.DeepEqual(got, want) {
+		t.Errorf("flaggedCategories() = %q, want %q", got, want)
+	}
+	if got := flaggedCategories(&openai.ModerationResponse{}); len(got) != 0 {
+		t.Errorf("flaggedCategories() of no results = %q, want none", got)
+	}
+}
+
+func TestUserInput(t *testing.T) {
+	messages := []chatMessage{
+		{Role: openai.ChatMessageRoleSystem, Content: "Be nice."},
+		{Role: openai.ChatMessageRoleUser, Content: "first"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "reply"},
+		{Role: openai.ChatMessageRoleUser, Parts: []contentPart{{Type: contentPartText, Text: "second"}}},
+	}
+	if got := userInput(messages); got != "first\n\nsecond" {
+		t.Errorf("userInput() = %q, want the user messages only", got)
+	}
+}
+
+func TestShouldModerate(t *testing.T) {
+	tests := []struct {
+		moderation bool
+		bypass     bool
+		skip       bool
+		want       bool
+	}{
+		{moderation: false, want: false},
+		{moderation: true, want: true},
+		{moderation: true, skip: true, want: true},
+		{moderation: true, bypass: true, want: true},
+		{moderation: true, bypass: true, skip: true, want: false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{Moderation: tt.moderation, AllowModerationBypass: tt.bypass}
+		if got := shouldModerate(cfg, Request{SkipModeration: tt.skip}); got != tt.want {
+			t.Errorf("shouldModerate() with MODERATION=%v, bypass %v, skip %v = %v, want %v", tt.moderation, tt.bypass, tt.skip, got, tt.want)
+		}
+	}
+}
+
+func TestInputModeration(t *testing.T) {
+	flagged := openai.ModerationResponse{Results: []openai.Result{{Flagged: true, Categories: openai.ResultCategories{Violence: true, Harassment: true}}}}
+	unavailable := &openai.APIError{HTTPStatusCode: 400, Message: "moderation unavailable"}
+	tests := []struct {
+		name            string
+		failMode        string
+		bypass          bool
+		skip            bool
+		moderation      openai.ModerationResponse
+		moderationErr   error
+		wantStatus      int
+		wantModerations int
+		wantFrames      []string
+	}{
+		{name: "clean", wantStatus: statusCodeOK, wantModerations: 1, wantFrames: []string{"Hello"}},
+		{
+			name:            "flagged",
+			moderation:      flagged,
+			wantStatus:      statusCodeBadRequest,
+			wantModerations: 1,
+			wantFrames:      []string{`{"type":"error","code":"content_flagged","categories":["harassment","violence"]}`},
+		},
+		{name: "failing open", failMode: moderationFailOpen, moderationErr: unavailable, wantStatus: statusCodeOK, wantModerations: 1, wantFrames: []string{"Hello"}},
+		{name: "failing closed", failMode: moderationFailClosed, moderationErr: unavailable, wantStatus: statusCodeBadGateway, wantModerations: 1},
+		// Parameter validation rejects skip_moderation before the moderation call
+		{name: "skip not allowed", skip: true, moderation: flagged, wantStatus: statusCodeBadRequest},
+		{name: "skip allowed", bypass: true, skip: true, moderation: flagged, wantStatus: statusCodeOK, wantFrames: []string{"Hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.Moderation = true
+				cfg.AllowModerationBypass = tt.bypass
+				if tt.failMode != "" {
+					cfg.ModerationFailMode = tt.failMode
+				}
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			chat.Moderation, chat.ModerationErr = tt.moderation, tt.moderationErr
+			skip := ""
+			if tt.skip {
+				skip = `"skip_moderation":true,`
+			}
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST",` + skip + `"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"yes?"},{"role":"user","content":"there"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			moderations := chat.ModerationRequests()
+			if len(moderations) != tt.wantModerations {
+				t.Fatalf("moderation requests = %d, want %d", len(moderations), tt.wantModerations)
+			}
+			if len(moderations) > 0 && moderations[0].Input != "hi\n\nthere" {
+				t.Errorf("moderation input = %q, want all user messages in one call", moderations[0].Input)
+			}
+			if tt.wantStatus != statusCodeOK && len(chat.Requests()) != 0 {
+				t.Error("rejected input reached the chat model")
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	textNormalizationOff         = "off"
+	textNormalizationConfusables = "confusables"
+	// textNormalizationAggressive composes the text to Unicode NFC before replacing the confusables
+	textNormalizationAggressive = "aggressive"
+)
+
+// outputStage transforms text before it is posted to the client
+type outputStage func(string) string
+
+// outputPipeline is the ordered list of stages applied to outgoing text
+type outputPipeline []outputStage
+
+// apply runs text through every stage of the pipeline
+func (p outputPipeline) apply(text string) string {
+	for _, stage := range p {
+		text = stage(text)
+	}
+	return text
+}
+
+// newOutputPipeline returns the output pipeline for a request. Raw output requests get an empty pipeline,
+// so the model output is delivered exactly as produced.
+func newOutputPipeline(cfg *Config, request Request) outputPipeline {
+	deltaStages, flushStages := newStreamPipelines(cfg, request)
+	return append(deltaStages, flushStages...)
+}
+
+// newStreamPipelines splits the output pipeline of a stream in the stages run on every delta and the stages
+// run on every flushed batch. The text normalization works on single characters, while the output filters
+// need whole lines to catch a phone number or an email address split over several deltas.
+func newStreamPipelines(cfg *Config, request Request) (outputPipeline, outputPipeline) {
+	if request.RawOutput {
+		return outputPipeline{}, outputPipeline{}
+	}
+	return textNormalizationStages(cfg, request), outputFilterStages(cfg)
+}
+
+// postProcessResponse runs the content of every choice of a completion through the output pipeline, before
+// any answer is extracted from it, so a completion is delivered the same by every response type. Streams run
+// the pipeline on their deltas and flushed batches instead. JSON replies only get their string values processed, so the
+// replacement of typographic quotes can't break the JSON.
+func postProcessResponse(cfg *Config, request Request, response *openai.ChatCompletionResponse, jsonReply bool) {
+	pipeline := newOutputPipeline(cfg, request)
+	if len(pipeline) == 0 {
+		return
+	}
+	for i := range response.Choices {
+		content := response.Choices[i].Message.Content
+		if jsonReply {
+			response.Choices[i].Message.Content = postProcessJSON(pipeline, content)
+		} else {
+			response.Choices[i].Message.Content = pipeline.apply(content)
+		}
+	}
+}
+
+// postProcessJSON runs the string values of the JSON document reply through pipeline. Object keys are kept,
+// so they still match the schema, and so is everything around the strings. Invalid JSON is returned unchanged
+// for the JSON validation to report.
+func postProcessJSON(pipeline outputPipeline, reply string) string {
+	if !json.Valid([]byte(reply)) {
+		return reply
+	}
+	var builder strings.Builder
+	for i := 0; i < len(reply); {
+		if reply[i] != '"' {
+			builder.WriteByte(reply[i])
+			i++
+			continue
+		}
+		// The document is valid, so every string literal is terminated
+		end := i + 1
+		for reply[end] != '"' {
+			if reply[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		literal := reply[i : end+1]
+		i = end + 1
+		if strings.HasPrefix(strings.TrimLeft(reply[i:], " \t\r\n"), ":") {
+			builder.WriteString(literal)
+			continue
+		}
+		var value string
+		_ = json.Unmarshal([]byte(literal), &value)
+		builder.WriteString(encodeJSONString(pipeline.apply(value)))
+	}
+	return builder.String()
+}
+
+// encodeJSONString returns s as a JSON string literal, leaving <, > and & unescaped like the model wrote them
+func encodeJSONString(s string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(s)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// textNormalizationStages returns the stages TEXT_NORMALIZATION selects, or none for requests with normalize_text set to false
+func textNormalizationStages(cfg *Config, request Request) outputPipeline {
+	if request.NormalizeText != nil && !*request.NormalizeText {
+		return outputPipeline{}
+	}
+	confusables := func(text string) string { return replaceConfusables(cfg.Confusables, text) }
+	switch cfg.TextNormalization {
+	case textNormalizationOff:
+		return outputPipeline{}
+	case textNormalizationAggressive:
+		return outputPipeline{norm.NFC.String, confusables}
+	default:
+		return outputPipeline{confusables}
+	}
+}
+
+// parseConfusables returns the built-in confusables extended by CONFUSABLES_JSON, a JSON object mapping single
+// characters to their replacements. Its entries take precedence over the built-in ones, and an empty
+// replacement strips the character.
+func parseConfusables(value string) (map[rune]string, error) {
+	confusables := getConfusables()
+	if strings.TrimSpace(value) == "" {
+		return confusables, nil
+	}
+	var overrides map[string]string
+	if err := json.Unmarshal([]byte(value), &overrides); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable CONFUSABLES_JSON, expected a JSON object of replacements: %v", err)
+	}
+	for from, to := range overrides {
+		if utf8.RuneCountInString(from) != 1 {
+			return nil, fmt.Errorf("Invalid value for environment variable CONFUSABLES_JSON, %q is not a single character", from)
+		}
+		ch, _ := utf8.DecodeRuneInString(from)
+		confusables[ch] = to
+	}
+	return confusables, nil
+}
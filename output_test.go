@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// smartFixture is a model answer with typographic quotes and markdown
+const smartFixture = "“Hello” — it’s **bold** and `code`"
+
+func TestRawOutput(t *testing.T) {
+	processed := newOutputPipeline(getConfig(), Request{}).apply(smartFixture)
+	if processed == smartFixture {
+		t.Fatalf("the default pipeline leaves %q unchanged", smartFixture)
+	}
+	tests := []struct {
+		name         string
+		responseType string
+		raw          bool
+		want         string
+	}{
+		{name: "full processed", responseType: "full", want: processed},
+		{name: "full raw", responseType: "full", raw: true, want: smartFixture},
+		{name: "stream processed", responseType: "stream", want: processed},
+		{name: "stream raw", responseType: "stream", raw: true, want: smartFixture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.DebugRawAllowed = true })
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(0, "“Hello” — ", "it’s **bold** ", "and `code`")...))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","protocol":"v2","messages":[{"role":"user","content":"hi"}]`
+			if tt.raw {
+				body += `,"raw_output":true`
+			}
+			response, poster := runTestRequest(t, cfg, chat, body+"}")
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			var text strings.Builder
+			for _, frame := range poster.Texts() {
+				var envelope frameEnvelope
+				if err := json.Unmarshal([]byte(frame), &envelope); err != nil {
+					t.Fatalf("can't decode envelope %s: %v", frame, err)
+				}
+				if envelope.Raw != tt.raw {
+					t.Fatalf("envelope %s has raw %v, want %v", frame, envelope.Raw, tt.raw)
+				}
+				if data, ok := envelope.Data.(string); ok && envelope.Type != frameTypeEnd {
+					text.WriteString(data)
+				}
+			}
+			if text.String() != tt.want {
+				t.Fatalf("delivered %q, want %q", text.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRawOutputValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		allowed      bool
+		responseType string
+		wantErr      string
+	}{
+		{name: "allowed", allowed: true, responseType: "stream"},
+		{name: "not allowed", responseType: "full", wantErr: "raw_output is not allowed"},
+		{name: "extractor", allowed: true, responseType: "int", wantErr: "raw_output can't be combined with the int response type"},
+		{name: "json", allowed: true, responseType: "json", wantErr: "raw_output can't be combined with the json response type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.DebugRawAllowed = tt.allowed })
+			request := Request{ResponseType: tt.responseType, PromptTemplate: "PROMPT_TEST", RawOutput: true, Messages: []chatMessage{{Role: "user", Content: "hi"}}}
+			err := validateRequestParams(cfg, request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("validateRequestParams() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetConfusables(t *testing.T) {
+	want := map[rune]string{
+		'“': `"`, '”': `"`, '„': `"`, '«': `"`, '»': `"`, '″': `"`, '＂': `"`,
+		'‘': "'", '’': "'", '‚': "'", '΄': "'", '‹': "'", '›': "'", '′': "'", '＇': "'",
+		'–': "-", '—': "--", '…': "...",
+		'，': ",", '．': ".", '：': ":", '；': ";", '！': "!", '？': "?", '（': "(", '）': ")",
+		'［': "[", '］': "]", '⟦': "[[", '⟧': "]]", '〚': "[[", '〛': "]]",
+		'\u00a0': " ", '\u2009': " ", '\u202f': " ",
+		'\u200b': "", '\u2060': "", '\ufeff': "",
+	}
+	if got := getConfusables(); !reflect.DeepEqual(got, want) {
+		t.Errorf("getConfusables() = %q, want %q", got, want)
+	}
+}
+
+func TestReplaceConfusables(t *testing.T) {
+	tests := map[string]string{
+		"“Hello” ‘world’":             `"Hello" 'world'`,
+		"«Bonjour» ‹toi›":             `"Bonjour" 'toi'`,
+		"5′ 11″":                      `5' 11"`,
+		"2–3 — or so…":                "2-3 -- or so...",
+		"a\u00a0b\u2009c\u202fd":      "a b c d",
+		"zero\u200bwidth\u2060\ufeff": "zerowidth",
+		"ＡＢ，．：；！？（）＂＇":                `ＡＢ,.:;!?()"'`,
+		"⟦7⟧ 〚8〛 ［9］":                 "[[7]] [[8]] [9]",
+		"plain ascii":                 "plain ascii",
+	}
+	for input, want := range tests {
+		if got := replaceConfusables(getConfusables(), input); got != want {
+			t.Errorf("replaceConfusables(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestTextNormalizationStages(t *testing.T) {
+	// The e and the combining acute accent compose to é under NFC
+	const decomposed = "Cafe\u0301 — “ok”"
+	disabled := false
+	tests := []struct {
+		name          string
+		normalization string
+		request       Request
+		want          string
+	}{
+		{name: "off", normalization: textNormalizationOff, want: decomposed},
+		{name: "confusables", normalization: textNormalizationConfusables, want: "Cafe\u0301 -- \"ok\""},
+		{name: "aggressive", normalization: textNormalizationAggressive, want: "Caf\u00e9 -- \"ok\""},
+		{name: "normalize_text false", normalization: textNormalizationAggressive, request: Request{NormalizeText: &disabled}, want: decomposed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{TextNormalization: tt.normalization, Confusables: getConfusables()}
+			if got := textNormalizationStages(cfg, tt.request).apply(decomposed); got != tt.want {
+				t.Errorf("normalized = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTextNormalization(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: textNormalizationConfusables},
+		{value: "off", want: textNormalizationOff},
+		{value: "confusables", want: textNormalizationConfusables},
+		{value: "aggressive", want: textNormalizationAggressive},
+		{value: "nfkc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEXT_NORMALIZATION", tt.value)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && cfg.TextNormalization != tt.want {
+				t.Errorf("TextNormalization = %q, want %q", cfg.TextNormalization, tt.want)
+			}
+		})
+	}
+}
+
+// TestStreamFlushAfterNormalization checks that the flush size counts the bytes delivered, not the bytes
+// the model streamed: "— " is 4 bytes but becomes the 3 bytes "-- ", which stay below the limit
+func TestStreamFlushAfterNormalization(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.StreamFlushInterval = time.Hour
+		cfg.StreamFlushBytes = 4
+		cfg.EndStreamMessage = "<END>"
+	})
+	chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(0, "— ", "…", "x")...))
+	response, poster := runTestRequest(t, cfg, chat, `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+	if response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+	}
+	if want := []string{"-- ...", "x", "<END>"}; !reflect.DeepEqual(poster.Texts(), want) {
+		t.Errorf("frames = %q, want %q", poster.Texts(), want)
+	}
+}
+
+func TestParseConfusables(t *testing.T) {
+	builtIn := getConfusables()
+	tests := []struct {
+		name    string
+		value   string
+		want    map[rune]string // Entries expected on top of or instead of the built-in ones
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "override", value: `{"’":"’","—":"-"}`, want: map[rune]string{'’': "’", '—': "-"}},
+		{name: "extend", value: `{"ʻ":"'","→":"->"}`, want: map[rune]string{'ʻ': "'", '→': "->"}},
+		{name: "strip", value: `{"\u00ad":""}`, want: map[rune]string{'\u00ad': ""}},
+		{name: "malformed", value: `{"’":`, wantErr: "Invalid value for environment variable CONFUSABLES_JSON, expected a JSON object"},
+		{name: "not strings", value: `{"’":1}`, wantErr: "expected a JSON object"},
+		{name: "several characters", value: `{"->":"→"}`, wantErr: `"->" is not a single character`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfusables(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseConfusables() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			want := getConfusables()
+			for from, to := range tt.want {
+				want[from] = to
+			}
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Fatalf("parseConfusables() = %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+	// The built-in map is a fresh copy for every caller, overrides never leak into it
+	if !reflect.DeepEqual(getConfusables(), builtIn) {
+		t.Error("parseConfusables() changed the built-in confusables")
+	}
+}
+
+func TestLoadConfigConfusablesJSON(t *testing.T) {
+	t.Setenv("CONFUSABLES_JSON", `{"’":"’"`)
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "CONFUSABLES_JSON") {
+		t.Fatalf("loadConfig() error = %v, want the invalid CONFUSABLES_JSON rejected", err)
+	}
+	t.Setenv("CONFUSABLES_JSON", `{"’":"’"}`)
+	cfg, err := loadConfig()
+	if err != nil || cfg.Confusables['’'] != "’" || cfg.Confusables['“'] != `"` {
+		t.Fatalf("loadConfig() = %q, %v, want the override on top of the built-in confusables", cfg.Confusables, err)
+	}
+}
+
+// TestNormalizeText checks the CONFUSABLES_JSON overrides and the normalize_text switch on the stream and
+// full paths
+func TestNormalizeText(t *testing.T) {
+	const completion = "“Aloha” — the ʻokina’s place"
+	tests := []struct {
+		name         string
+		responseType string
+		normalize    string
+		want         string
+	}{
+		{name: "stream", responseType: responseTypeStream, want: `"Aloha" -- the 'okina’s place`},
+		{name: "stream without normalization", responseType: responseTypeStream, normalize: `,"normalize_text":false`, want: completion},
+		{name: "stream with normalization", responseType: responseTypeStream, normalize: `,"normalize_text":true`, want: `"Aloha" -- the 'okina’s place`},
+		{name: "full", responseType: responseTypeFull, want: `"Aloha" -- the 'okina’s place`},
+		{name: "full without normalization", responseType: responseTypeFull, normalize: `,"normalize_text":false`, want: completion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				// The override keeps ’ and adds the ʻokina
+				cfg.Confusables, _ = parseConfusables(`{"’":"’","ʻ":"'"}`)
+				cfg.EndStreamMessage = "<END>"
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(0, "“Aloha” — ", "the ʻokina’s ", "place")...))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]` + tt.normalize + `}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			got := strings.TrimSuffix(strings.Join(poster.Texts(), ""), "<END>")
+			if got != tt.want {
+				t.Errorf("delivered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostProcessJSON(t *testing.T) {
+	pipeline := outputPipeline{func(text string) string { return replaceConfusables(getConfusables(), text) }}
+	tests := []struct {
+		name  string
+		reply string
+		want  string
+	}{
+		{name: "string values", reply: `{"title":"“Hi” — there","tags":["it’s","…"]}`, want: `{"title":"\"Hi\" -- there","tags":["it's","..."]}`},
+		{name: "keys are kept", reply: `{"“key”" : "“value”"}`, want: `{"“key”" : "\"value\""}`},
+		{name: "escapes", reply: `{"a":"line\nbreak \"quoted\" ’"}`, want: `{"a":"line\nbreak \"quoted\" '"}`},
+		{name: "html is not escaped", reply: `{"a":"<b>&’</b>"}`, want: `{"a":"<b>&'</b>"}`},
+		{name: "other values", reply: `{"n":1,"ok":true,"none":null}`, want: `{"n":1,"ok":true,"none":null}`},
+		{name: "invalid", reply: `{"a":"“unterminated`, want: `{"a":"“unterminated`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postProcessJSON(pipeline, tt.reply); got != tt.want {
+				t.Errorf("postProcessJSON(%s) = %s, want %s", tt.reply, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestResponseTypesNormalizeAlike checks that one completion is normalized to the same bytes whatever the
+// response type, and that the extractors see the normalized text
+func TestResponseTypesNormalizeAlike(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		completion   string
+		want         string
+	}{
+		{name: "full", responseType: responseTypeFull, completion: "“Hi” — it’s… ⟦fine⟧", want: `"Hi" -- it's... [[fine]]`},
+		{name: "stream", responseType: responseTypeStream, completion: "“Hi” — it’s… ⟦fine⟧", want: `"Hi" -- it's... [[fine]]`},
+		{name: "string in smart brackets", responseType: responseTypeString, completion: "“Hi” — it’s… ⟦fine⟧", want: "fine"},
+		{name: "int in smart brackets", responseType: responseTypeInt, completion: "The score is ⟦7⟧", want: "7"},
+		{name: "int in full width brackets", responseType: responseTypeInt, completion: "The score is ［［7］］", want: "7"},
+		{name: "json", responseType: responseTypeJSON, completion: `{"answer":"it’s “fine”"}`, want: `{"answer":"it's \"fine\""}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = "<END>"
+				cfg.OpenAIJSONRetries = 0
+			})
+			var turn testsupport.Turn
+			if tt.responseType == responseTypeStream {
+				turn = testsupport.Stream(testsupport.TextChunks(0, strings.SplitAfter(tt.completion, " ")...)...)
+			} else {
+				turn = testsupport.Reply(tt.completion)
+			}
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, testsupport.NewScriptedCompleter(turn), body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			if got := strings.TrimSuffix(strings.Join(poster.Texts(), ""), "<END>"); got != tt.want {
+				t.Errorf("delivered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	minTemperature = 0
+	maxTemperature = 2
+	minTopP        = 0
+	maxTopP        = 1
+	minPenalty     = -2
+	maxPenalty     = 2
+	// OpenAI limits of the stop sequences and the logit bias
+	maxStopSequences    = 4
+	maxLogitBiasEntries = 300
+	minLogitBias        = -100
+	maxLogitBias        = 100
+	// Defaults of the conversation size limits
+	defaultMaxMessages     = 50
+	defaultMaxMessageChars = 32 * 1024
+	defaultMaxTotalChars   = 128 * 1024
+	// maxMessageNameLength is the OpenAI limit of the name of a message
+	maxMessageNameLength = 64
+)
+
+var messageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// checkMessages checks the conversation against the size limits and requires a known role and content for every message
+func checkMessages(cfg *Config, messages []chatMessage) error {
+	if len(messages) > cfg.MaxMessages {
+		return fmt.Errorf("messages has %d entries, at most %d are allowed", len(messages), cfg.MaxMessages)
+	}
+	total := 0
+	for i, message := range messages {
+		switch message.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+			if message.ToolCallID != "" {
+				return fmt.Errorf("messages[%d].tool_call_id is only allowed for the tool role", i)
+			}
+		case openai.ChatMessageRoleTool:
+			if message.ToolCallID == "" {
+				return fmt.Errorf("messages[%d].tool_call_id is required for the tool role", i)
+			}
+		case "":
+			return fmt.Errorf("messages[%d].role is required", i)
+		default:
+			return fmt.Errorf("messages[%d].role must be system, user, assistant or tool, got %q", i, message.Role)
+		}
+		if err := checkMessageName(cfg, i, message); err != nil {
+			return err
+		}
+		if len(message.ToolCalls) > 0 && message.Role != openai.ChatMessageRoleAssistant {
+			return fmt.Errorf("messages[%d].tool_calls is only allowed for the assistant role", i)
+		}
+		if message.Parts != nil {
+			if err := checkContentParts(i, message); err != nil {
+				return err
+			}
+		} else if message.Content == "" && len(message.ToolCalls) == 0 {
+			// An assistant message calling tools has no content of its own
+			return fmt.Errorf("messages[%d].content is required", i)
+		}
+		// Images don't count towards the character limits
+		chars := utf8.RuneCountInString(message.text())
+		if chars > cfg.MaxMessageChars {
+			return fmt.Errorf("messages[%d].content has %d characters, at most %d are allowed", i, chars, cfg.MaxMessageChars)
+		}
+		total += chars
+	}
+	if total > cfg.MaxTotalChars {
+		return fmt.Errorf("messages have %d characters in total, at most %d are allowed", total, cfg.MaxTotalChars)
+	}
+	return nil
+}
+
+// checkMessageName checks the name of a message against the OpenAI constraints. Tool messages can't have a
+// name; with STRICT_VALIDATION one is rejected, otherwise it is dropped when the request is built.
+func checkMessageName(cfg *Config, i int, message chatMessage) error {
+	if message.Name == "" {
+		return nil
+	}
+	if len(message.Name) > maxMessageNameLength || !messageNamePattern.MatchString(message.Name) {
+		return fmt.Errorf("messages[%d].name must be 1 to %d letters, digits, underscores or hyphens", i, maxMessageNameLength)
+	}
+	if message.Role == openai.ChatMessageRoleTool && cfg.StrictValidation {
+		return fmt.Errorf("messages[%d].name is not allowed for the tool role", i)
+	}
+	return nil
+}
+
+// openAIName returns the name sent to OpenAI, none for the roles OpenAI doesn't accept one for
+func (m chatMessage) openAIName() string {
+	if m.Role == openai.ChatMessageRoleTool {
+		return ""
+	}
+	return m.Name
+}
+
+// validateRequestParams checks that the optional parameters of the request are within the OpenAI ranges
+func validateRequestParams(cfg *Config, request Request) error {
+	// An empty response type would only fail after the request was set up, as an incorrect one
+	if request.ResponseType == "" {
+		return fmt.Errorf("missing required field response_type")
+	}
+	if len(request.PromptTemplates) > 0 {
+		if err := checkPromptTemplates(cfg, request); err != nil {
+			return err
+		}
+	} else if request.SystemPrompt != "" {
+		if err := checkSystemPrompt(cfg, request.SystemPrompt); err != nil {
+			return err
+		}
+	} else if err := checkPromptTemplateName(cfg, request.PromptTemplate); err != nil {
+		return err
+	}
+	if err := checkTemplateVars(request.TemplateVars); err != nil {
+		return err
+	}
+	if err := checkMessages(cfg, request.Messages); err != nil {
+		return err
+	}
+	if err := checkProvider(cfg, request); err != nil {
+		return err
+	}
+	if err := checkVisionModel(cfg, request); err != nil {
+		return err
+	}
+	if err := checkReasoningParams(cfg, request); err != nil {
+		return err
+	}
+	if err := checkTools(request); err != nil {
+		return err
+	}
+	if err := checkCandidates(cfg, request); err != nil {
+		return err
+	}
+	if err := checkVotes(request); err != nil {
+		return err
+	}
+	if err := checkStrictPrefill(request); err != nil {
+		return err
+	}
+	if err := checkAcceptEncoding(request); err != nil {
+		return err
+	}
+	if err := checkLanguage(cfg, request); err != nil {
+		return err
+	}
+	if request.SkipModeration && !cfg.AllowModerationBypass {
+		return fmt.Errorf("skip_moderation is not allowed")
+	}
+	if request.Async && cfg.AsyncQueueURL == "" {
+		return fmt.Errorf("async is not supported without an async queue")
+	}
+	if request.Cache && cfg.CacheTable == "" {
+		return fmt.Errorf("cache is not supported without a cache table")
+	}
+	if request.IdempotencyKey != "" {
+		if cfg.IdempotencyTable == "" {
+			return fmt.Errorf("idempotency_key is not supported without an idempotency table")
+		}
+		if len(request.IdempotencyKey) > maxRequestIDLength {
+			return fmt.Errorf("idempotency_key is longer than %d characters", maxRequestIDLength)
+		}
+	}
+	if request.HistoryStrategy != "" && request.HistoryStrategy != historyStrategyTrim && request.HistoryStrategy != historyStrategySummarize {
+		return fmt.Errorf("history_strategy must be %s or %s", historyStrategyTrim, historyStrategySummarize)
+	}
+	if request.ConversationID != "" {
+		if cfg.ConversationsTable == "" {
+			return fmt.Errorf("conversation_id is not supported without a conversations table")
+		}
+		if len(request.ConversationID) > maxRequestIDLength {
+			return fmt.Errorf("conversation_id is longer than %d characters", maxRequestIDLength)
+		}
+	} else if request.Reset {
+		return fmt.Errorf("reset requires a conversation_id")
+	}
+	if request.Temperature != nil && (*request.Temperature < minTemperature || *request.Temperature > maxTemperature) {
+		return fmt.Errorf("temperature must be between %d and %d, got %v", minTemperature, maxTemperature, *request.Temperature)
+	}
+	if request.TopP != nil && (*request.TopP < minTopP || *request.TopP > maxTopP) {
+		return fmt.Errorf("top_p must be between %d and %d, got %v", minTopP, maxTopP, *request.TopP)
+	}
+	if request.MaxTokens != nil && *request.MaxTokens <= 0 {
+		return fmt.Errorf("max_tokens must be greater than 0, got %d", *request.MaxTokens)
+	}
+	if request.PresencePenalty != nil && (*request.PresencePenalty < minPenalty || *request.PresencePenalty > maxPenalty) {
+		return fmt.Errorf("presence_penalty must be between %d and %d, got %v", minPenalty, maxPenalty, *request.PresencePenalty)
+	}
+	if request.FrequencyPenalty != nil && (*request.FrequencyPenalty < minPenalty || *request.FrequencyPenalty > maxPenalty) {
+		return fmt.Errorf("frequency_penalty must be between %d and %d, got %v", minPenalty, maxPenalty, *request.FrequencyPenalty)
+	}
+	if len(request.Stop) > maxStopSequences {
+		return fmt.Errorf("stop has %d entries, at most %d are allowed", len(request.Stop), maxStopSequences)
+	}
+	for i, stop := range request.Stop {
+		if stop == "" {
+			return fmt.Errorf("stop[%d] must not be empty", i)
+		}
+	}
+	if len(request.LogitBias) > maxLogitBiasEntries {
+		return fmt.Errorf("logit_bias has %d entries, at most %d are allowed", len(request.LogitBias), maxLogitBiasEntries)
+	}
+	for token := range request.LogitBias {
+		if id, err := strconv.Atoi(token); err != nil || id < 0 {
+			return fmt.Errorf("logit_bias keys must be token IDs, got %q", token)
+		}
+	}
+	if request.IncludeMetadata && request.ResponseType != responseTypeFull {
+		return fmt.Errorf("include_metadata is only supported for the %s response type", responseTypeFull)
+	}
+	if request.Protocol != "" && request.Protocol != protocolV2 {
+		return fmt.Errorf("unsupported protocol %q", request.Protocol)
+	}
+	if request.RawOutput {
+		if !cfg.DebugRawAllowed {
+			return fmt.Errorf("raw_output is not allowed")
+		}
+		if request.ResponseType != responseTypeFull && request.ResponseType != responseTypeStream {
+			return fmt.Errorf("raw_output can't be combined with the %s response type", request.ResponseType)
+		}
+	}
+	if request.ExtractPattern != "" {
+		if request.ResponseType != responseTypeInt && request.ResponseType != responseTypeString {
+			return fmt.Errorf("extract_pattern is only supported for the %s and %s response types", responseTypeInt, responseTypeString)
+		}
+		if _, err := compileExtractPattern(request.ExtractPattern); err != nil {
+			return err
+		}
+	}
+	if len(request.Choices) > 0 {
+		if request.ResponseType != responseTypeChoice {
+			return fmt.Errorf("choices is only supported for the %s response type", responseTypeChoice)
+		}
+		if err := validateChoices(request.Choices); err != nil {
+			return err
+		}
+	}
+	if request.StructuredEnd && request.ResponseType != responseTypeStream {
+		return fmt.Errorf("structured_end is only supported for the %s response type", responseTypeStream)
+	}
+	if len(request.RequestID) > maxRequestIDLength {
+		return fmt.Errorf("request_id is longer than %d characters", maxRequestIDLength)
+	}
+	if request.StreamGranularity != "" {
+		if request.ResponseType != responseTypeStream {
+			return fmt.Errorf("stream_granularity is only supported for the %s response type", responseTypeStream)
+		}
+		if !isValidGranularity(request.StreamGranularity) {
+			return fmt.Errorf("stream_granularity must be %s, %s or %s", granularityToken, granularitySentence, granularityParagraph)
+		}
+	}
+	if request.MaxItems < 0 {
+		return fmt.Errorf("max_items must not be negative, got %d", request.MaxItems)
+	}
+	if request.Schema != nil {
+		if request.ResponseType != responseTypeJSON {
+			return fmt.Errorf("schema is only supported for the %s response type", responseTypeJSON)
+		}
+		if err := checkSchemaDefinition(*request.Schema); err != nil {
+			return fmt.Errorf("invalid schema: %v", err)
+		}
+	}
+	return nil
+}
+
+// isExtractorResponseType checks if the answers of responseType are parsed into a single value
+func isExtractorResponseType(responseType string) bool {
+	switch responseType {
+	case responseTypeInt, responseTypeString, responseTypeBool, responseTypeFloat, responseTypeChoice:
+		return true
+	}
+	return false
+}
+
+// applyRequestParams copies the sampling parameters set in the request to the OpenAI request, leaving unset ones out.
+// Extractor response types default to temperature 0, so the same prompt keeps giving the same value,
+// except when voting, which needs the answers to vary.
+func applyRequestParams(chatRequest *openai.ChatCompletionRequest, request Request) {
+	if request.Temperature != nil {
+		chatRequest.Temperature = nonZeroFloat(*request.Temperature)
+	} else if isExtractorResponseType(request.ResponseType) && request.Votes == 0 {
+		chatRequest.Temperature = nonZeroFloat(0)
+	}
+	chatRequest.Seed = request.Seed
+	chatRequest.Stop = request.Stop
+	if request.N > 1 {
+		chatRequest.N = request.N
+	}
+	if len(request.LogitBias) > 0 {
+		chatRequest.LogitBias = make(map[string]int, len(request.LogitBias))
+		for token, bias := range request.LogitBias {
+			chatRequest.LogitBias[token] = min(max(bias, minLogitBias), maxLogitBias)
+		}
+	}
+	if request.TopP != nil {
+		chatRequest.TopP = nonZeroFloat(*request.TopP)
+	}
+	if request.MaxTokens != nil {
+		chatRequest.MaxTokens = *request.MaxTokens
+	}
+	if request.PresencePenalty != nil {
+		chatRequest.PresencePenalty = *request.PresencePenalty
+	}
+	if request.FrequencyPenalty != nil {
+		chatRequest.FrequencyPenalty = *request.FrequencyPenalty
+	}
+	chatRequest.Tools = request.Tools
+	chatRequest.ToolChoice = request.ToolChoice
+	if request.ResponseType == responseTypeJSON {
+		chatRequest.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+}
+
+// nonZeroFloat replaces an explicit 0 with the smallest float32, because the OpenAI client drops zero values
+// from the request JSON and the API would then apply its non-zero default
+func nonZeroFloat(v float32) float32 {
+	if v == 0 {
+		return math.SmallestNonzeroFloat32
+	}
+	return v
+}
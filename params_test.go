@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// logitBias returns a logit_bias field banning the first entries token IDs
+func logitBias(entries int) string {
+	biases := make([]string, entries)
+	for i := range biases {
+		biases[i] = fmt.Sprintf(`"%d":-100`, i)
+	}
+	return `"logit_bias":{` + strings.Join(biases, ",") + `}`
+}
+
+func TestValidateSamplingParams(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "in range", params: `"temperature":2,"top_p":0,"max_tokens":1,"presence_penalty":-2,"frequency_penalty":2`},
+		{name: "temperature too high", params: `"temperature":2.5`, wantErr: "temperature must be between 0 and 2"},
+		{name: "negative temperature", params: `"temperature":-0.1`, wantErr: "temperature must be between 0 and 2"},
+		{name: "top_p too high", params: `"top_p":1.1`, wantErr: "top_p must be between 0 and 1"},
+		{name: "zero max_tokens", params: `"max_tokens":0`, wantErr: "max_tokens must be greater than 0"},
+		{name: "presence_penalty too low", params: `"presence_penalty":-3`, wantErr: "presence_penalty must be between -2 and 2"},
+		{name: "frequency_penalty too high", params: `"frequency_penalty":2.1`, wantErr: "frequency_penalty must be between -2 and 2"},
+		{name: "stop and logit_bias", params: `"stop":["\n\nHuman:","END","###","---"],"logit_bias":{"50256":-100,"1000":250}`},
+		{name: "too many stop sequences", params: `"stop":["a","b","c","d","e"]`, wantErr: "stop has 5 entries, at most 4 are allowed"},
+		{name: "empty stop sequence", params: `"stop":["END",""]`, wantErr: "stop[1] must not be empty"},
+		{name: "too many logit_bias entries", params: logitBias(301), wantErr: "logit_bias has 301 entries, at most 300 are allowed"},
+		{name: "logit_bias at the limit", params: logitBias(300)},
+		{name: "logit_bias key not a token ID", params: `"logit_bias":{"hello":-100}`, wantErr: `logit_bias keys must be token IDs, got "hello"`},
+	}
+	cfg := testConfig(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]`
+			if tt.params != "" {
+				body += "," + tt.params
+			}
+			request, err := parseRequestBody(body + "}")
+			if err != nil {
+				t.Fatalf("parseRequestBody() error = %v", err)
+			}
+			err = validateRequestParams(cfg, request)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("validateRequestParams() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyRequestParams(t *testing.T) {
+	float := func(v float32) *float32 { return &v }
+	integer := func(v int) *int { return &v }
+	tests := []struct {
+		name    string
+		request Request
+		want    openai.ChatCompletionRequest
+	}{
+		{name: "unset", request: Request{ResponseType: responseTypeFull}},
+		{
+			name:    "all set",
+			request: Request{ResponseType: responseTypeFull, Temperature: float(0.7), TopP: float(0.9), MaxTokens: integer(100), PresencePenalty: float(-1), FrequencyPenalty: float(1.5)},
+			want:    openai.ChatCompletionRequest{Temperature: 0.7, TopP: 0.9, MaxTokens: 100, PresencePenalty: -1, FrequencyPenalty: 1.5},
+		},
+		{
+			name:    "explicit zeros are sent",
+			request: Request{ResponseType: responseTypeFull, Temperature: float(0), TopP: float(0)},
+			want:    openai.ChatCompletionRequest{Temperature: math.SmallestNonzeroFloat32, TopP: math.SmallestNonzeroFloat32},
+		},
+		{
+			name:    "only max_tokens",
+			request: Request{ResponseType: responseTypeStream, MaxTokens: integer(5)},
+			want:    openai.ChatCompletionRequest{MaxTokens: 5},
+		},
+		{
+			name:    "extractors default to temperature 0",
+			request: Request{ResponseType: responseTypeInt, Seed: integer(7)},
+			want:    openai.ChatCompletionRequest{Temperature: math.SmallestNonzeroFloat32, Seed: integer(7)},
+		},
+		{
+			name:    "explicit extractor temperature",
+			request: Request{ResponseType: responseTypeChoice, Temperature: float(0.8)},
+			want:    openai.ChatCompletionRequest{Temperature: 0.8},
+		},
+		{
+			name:    "stop and clamped logit_bias",
+			request: Request{ResponseType: responseTypeFull, Stop: []string{"\n\nHuman:"}, LogitBias: map[string]int{"50256": -250, "1000": 250, "42": 5}},
+			want:    openai.ChatCompletionRequest{Stop: []string{"\n\nHuman:"}, LogitBias: map[string]int{"50256": -100, "1000": 100, "42": 5}},
+		},
+		{
+			name:    "full keeps the OpenAI default",
+			request: Request{ResponseType: responseTypeFull, Seed: integer(7)},
+			want:    openai.ChatCompletionRequest{Seed: integer(7)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got openai.ChatCompletionRequest
+			applyRequestParams(&got, tt.request)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("applyRequestParams() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSamplingParamsReachOpenAI(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		params       string
+		wantStatus   int
+		want         openai.ChatCompletionRequest
+	}{
+		{name: "full", responseType: "full", params: `"temperature":0.5,"max_tokens":64`, wantStatus: statusCodeOK, want: openai.ChatCompletionRequest{Temperature: 0.5, MaxTokens: 64}},
+		{name: "stream", responseType: "stream", params: `"top_p":0.5,"frequency_penalty":1`, wantStatus: statusCodeOK, want: openai.ChatCompletionRequest{TopP: 0.5, FrequencyPenalty: 1}},
+		{name: "out of range", responseType: "stream", params: `"temperature":3`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("ok"))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}],` + tt.params + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if tt.wantStatus != statusCodeOK {
+				if len(requests) != 0 {
+					t.Fatal("OpenAI was called for an invalid request")
+				}
+				return
+			}
+			if len(requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(requests))
+			}
+			got := requests[0]
+			params := openai.ChatCompletionRequest{Temperature: got.Temperature, TopP: got.TopP, MaxTokens: got.MaxTokens, PresencePenalty: got.PresencePenalty, FrequencyPenalty: got.FrequencyPenalty}
+			if !reflect.DeepEqual(params, tt.want) {
+				t.Fatalf("sampling parameters = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeterministicExtractorRequests(t *testing.T) {
+	seed := 42
+	tests := []struct {
+		responseType    string
+		params          string
+		wantTemperature float32
+		wantSeed        *int
+	}{
+		{responseType: responseTypeInt, params: `,"seed":42`, wantTemperature: math.SmallestNonzeroFloat32, wantSeed: &seed},
+		{responseType: responseTypeInt, params: `,"temperature":0.7`, wantTemperature: 0.7},
+		{responseType: responseTypeFull},
+		{responseType: responseTypeStream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType+tt.params, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("[[3]]"))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]` + tt.params + `}`
+			if response, _ := runTestRequest(t, cfg, chat, body); response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			got := chat.Requests()[0]
+			if got.Temperature != tt.wantTemperature || !reflect.DeepEqual(got.Seed, tt.wantSeed) {
+				t.Errorf("temperature, seed = %v, %v, want %v, %v", got.Temperature, got.Seed, tt.wantTemperature, tt.wantSeed)
+			}
+		})
+	}
+}
+
+// TestStopSequencesReachOpenAI checks that both paths pass stop and logit_bias through, and that a stream ended by
+// a stop sequence still reports its finish reason in the structured end frame
+func TestStopSequencesReachOpenAI(t *testing.T) {
+	tests := []struct {
+		responseType string
+		extra        string
+		turn         testsupport.Turn
+		wantFrames   []string
+	}{
+		{responseType: "full", turn: testsupport.Reply("Hello"), wantFrames: []string{"Hello"}},
+		{
+			responseType: "stream",
+			extra:        `,"structured_end":true`,
+			turn:         testsupport.Stream(testsupport.Chunk{Content: "Hello"}, testsupport.Chunk{FinishReason: openai.FinishReasonStop}),
+			wantFrames:   []string{"Hello", `{"type":"end","finish_reason":"stop"}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}],"stop":["\n\nHuman:"],"logit_bias":{"50256":-300}` + tt.extra + `}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			got := chat.Requests()[0]
+			if !reflect.DeepEqual(got.Stop, []string{"\n\nHuman:"}) || !reflect.DeepEqual(got.LogitBias, map[string]int{"50256": -100}) {
+				t.Errorf("stop, logit_bias = %q, %v, want the stop sequence and the clamped bias", got.Stop, got.LogitBias)
+			}
+			if !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestCheckMessageName(t *testing.T) {
+	tests := []struct {
+		name        string
+		messageName string
+		role        string
+		strict      bool
+		wantErr     string
+	}{
+		{name: "no name", role: openai.ChatMessageRoleUser},
+		{name: "user", messageName: "alice_01-b", role: openai.ChatMessageRoleUser},
+		{name: "assistant", messageName: "helper", role: openai.ChatMessageRoleAssistant},
+		{name: "system", messageName: "moderator", role: openai.ChatMessageRoleSystem, strict: true},
+		{name: "longest", messageName: strings.Repeat("a", maxMessageNameLength), role: openai.ChatMessageRoleUser},
+		{name: "too long", messageName: strings.Repeat("a", maxMessageNameLength+1), role: openai.ChatMessageRoleUser, wantErr: "messages[0].name must be"},
+		{name: "space", messageName: "alice smith", role: openai.ChatMessageRoleUser, wantErr: "messages[0].name must be"},
+		{name: "dot", messageName: "alice.smith", role: openai.ChatMessageRoleUser, wantErr: "messages[0].name must be"},
+		{name: "not ascii", messageName: "zoë", role: openai.ChatMessageRoleUser, wantErr: "messages[0].name must be"},
+		// A name on a tool message is dropped when the request is built, unless STRICT_VALIDATION rejects it
+		{name: "tool", messageName: "weather", role: openai.ChatMessageRoleTool},
+		{name: "strict tool", messageName: "weather", role: openai.ChatMessageRoleTool, strict: true, wantErr: "messages[0].name is not allowed for the tool role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMessageName(&Config{StrictValidation: tt.strict}, 0, chatMessage{Role: tt.role, Name: tt.messageName})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkMessageName() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkMessageName() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// messageNames returns the names of the messages of request, in order
+func messageNames(request openai.ChatCompletionRequest) []string {
+	names := make([]string, len(request.Messages))
+	for i, message := range request.Messages {
+		names[i] = message.Name
+	}
+	return names
+}
+
+// TestMessageNameReachesOpenAI checks that both request builders put the names in the ChatCompletionRequest
+func TestMessageNameReachesOpenAI(t *testing.T) {
+	const groupChat = `[{"role":"user","name":"alice","content":"Hi"},{"role":"user","name":"bob","content":"Hello"},{"role":"assistant","name":"helper","content":"Hi both"},{"role":"user","content":"Who spoke first?"}]`
+	const toolResult = `[{"role":"user","content":"Weather?"},{"role":"assistant","content":"","tool_calls":[{"id":"call-1","name":"weather","arguments":"{}"}]},{"role":"tool","tool_call_id":"call-1","name":"weather","content":"sunny"}]`
+	tests := []struct {
+		name         string
+		responseType string
+		messages     string
+		strict       bool
+		wantStatus   int
+		wantNames    []string // Names of the messages after the system prompt
+	}{
+		{name: "full", responseType: responseTypeFull, messages: groupChat, wantStatus: statusCodeOK, wantNames: []string{"alice", "bob", "helper", ""}},
+		{name: "stream", responseType: responseTypeStream, messages: groupChat, wantStatus: statusCodeOK, wantNames: []string{"alice", "bob", "helper", ""}},
+		{name: "extractor", responseType: responseTypeInt, messages: groupChat, wantStatus: statusCodeOK, wantNames: []string{"alice", "bob", "helper", ""}},
+		{name: "tool name dropped", responseType: responseTypeFull, messages: toolResult, wantStatus: statusCodeOK, wantNames: []string{"", "", ""}},
+		{name: "tool name dropped from a stream", responseType: responseTypeStream, messages: toolResult, wantStatus: statusCodeOK, wantNames: []string{"", "", ""}},
+		{name: "tool name rejected", responseType: responseTypeFull, messages: toolResult, strict: true, wantStatus: statusCodeBadRequest},
+		{name: "invalid name", responseType: responseTypeFull, messages: `[{"role":"user","name":"alice smith","content":"Hi"}]`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.StrictValidation = tt.strict
+				cfg.StreamFlushInterval = 0
+			})
+			turn := testsupport.Reply("[[1]]")
+			if tt.responseType == responseTypeStream {
+				turn = testsupport.Stream(testsupport.TextChunks(0, "Alice")...)
+			}
+			chat := testsupport.NewScriptedCompleter(turn)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":` + tt.messages + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if tt.wantStatus != statusCodeOK {
+				if len(requests) != 0 {
+					t.Fatal("OpenAI was called for an invalid request")
+				}
+				return
+			}
+			if len(requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(requests))
+			}
+			if names := messageNames(requests[0]); !reflect.DeepEqual(names[1:], tt.wantNames) {
+				t.Errorf("message names = %q, want %q after the system prompt", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+// TestMessageNameRoundTrips checks that a stored conversation keeps the speakers of its messages
+func TestMessageNameRoundTrips(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = "conversations" })
+	db := newFakeDynamoDB().table("conversations", "conversation_key")
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hi Alice"), testsupport.Reply("Hi Bob"))
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+	for _, speaker := range []string{"alice", "bob"} {
+		body := `{"response_type":"full","prompt_template":"PROMPT_TEST","conversation_id":"chat-1","messages":[{"role":"user","name":"` + speaker + `","content":"Hi"}]}`
+		if response, err := h.Handler(context.Background(), testMessage(body)); err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("turn of %s = %d %s, %v", speaker, response.StatusCode, response.Body, err)
+		}
+	}
+	requests := chat.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(requests))
+	}
+	if names := messageNames(requests[1]); !reflect.DeepEqual(names, []string{"", "alice", "", "bob"}) {
+		t.Errorf("message names of the second turn = %q, want the stored alice in front of bob", names)
+	}
+}
+
+func TestMessageNameTokens(t *testing.T) {
+	estimator := promptEstimator
+	plain := estimateChatMessageTokens(estimator, chatMessage{Role: openai.ChatMessageRoleUser, Content: "Hello there"})
+	named := estimateChatMessageTokens(estimator, chatMessage{Role: openai.ChatMessageRoleUser, Content: "Hello there", Name: "alice"})
+	if named <= plain {
+		t.Errorf("estimated %d tokens with a name, %d without, want the name counted", named, plain)
+	}
+}
+
+func TestLoadConfigStrictValidation(t *testing.T) {
+	t.Setenv("STRICT_VALIDATION", "")
+	if cfg, err := loadConfig(); err != nil || cfg.StrictValidation {
+		t.Fatalf("loadConfig() = %v, %v, want StrictValidation off by default", cfg.StrictValidation, err)
+	}
+	t.Setenv("STRICT_VALIDATION", "true")
+	if cfg, err := loadConfig(); err != nil || !cfg.StrictValidation {
+		t.Errorf("loadConfig() = %v, %v, want StrictValidation on", cfg.StrictValidation, err)
+	}
+}
+
+func TestCheckMessages(t *testing.T) {
+	cfg := &Config{MaxMessages: 3, MaxMessageChars: 10, MaxTotalChars: 15}
+	tests := []struct {
+		name     string
+		messages string
+		wantErr  string
+	}{
+		{name: "valid", messages: `[{"role":"system","content":"Be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"}]`},
+		{name: "too many messages", messages: `[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"c"},{"role":"assistant","content":"d"}]`, wantErr: "messages has 4 entries, at most 3 are allowed"},
+		{name: "missing role", messages: `[{"role":"user","content":"hi"},{"content":"hi"}]`, wantErr: "messages[1].role is required"},
+		{name: "unknown role", messages: `[{"role":"developer","content":"hi"}]`, wantErr: `messages[0].role must be system, user, assistant or tool, got "developer"`},
+		{name: "missing content", messages: `[{"role":"user","content":"hi"},{"role":"assistant","content":""}]`, wantErr: "messages[1].content is required"},
+		{name: "message at the limit", messages: `[{"role":"user","content":"0123456789"}]`},
+		// The limits count characters, not bytes
+		{name: "multi-byte characters", messages: `[{"role":"user","content":"ééééééééé"}]`},
+		{name: "long message", messages: `[{"role":"user","content":"hi"},{"role":"user","content":"0123456789a"}]`, wantErr: "messages[1].content has 11 characters, at most 10 are allowed"},
+		{name: "long conversation", messages: `[{"role":"user","content":"0123456789"},{"role":"assistant","content":"012345"}]`, wantErr: "messages have 16 characters in total, at most 15 are allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseRequestBody(`{"response_type":"full","messages":` + tt.messages + `}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkMessages(cfg, request.Messages)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("checkMessages() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestConversationLimitsRejectRequests checks that an oversized conversation is rejected before OpenAI is called
+func TestConversationLimitsRejectRequests(t *testing.T) {
+	request := func(messages string) string {
+		return `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[` + messages + `]}`
+	}
+	message := func(content string) string { return `{"role":"user","content":"` + content + `"}` }
+	tests := []struct {
+		name     string
+		body     string
+		wantBody string
+	}{
+		{name: "too many messages", body: request(strings.Repeat(message("hi")+",", 50) + message("hi")), wantBody: "messages has 51 entries"},
+		{name: "long message", body: request(message(strings.Repeat("a", defaultMaxMessageChars+1))), wantBody: "messages[0].content has"},
+		{name: "long conversation", body: request(strings.Repeat(message(strings.Repeat("a", defaultMaxMessageChars))+",", 4) + message("a")), wantBody: "messages have"},
+		{name: "unknown field", body: `{"respones_type":"full","prompt_template":"PROMPT_TEST","messages":[` + message("hi") + `]}`, wantBody: `unknown field "respones_type"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, _ := runTestRequest(t, cfg, chat, tt.body)
+			if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, tt.wantBody) {
+				t.Errorf("Handler() = %d %s, want 400 with %q", response.StatusCode, response.Body, tt.wantBody)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the invalid request reached OpenAI")
+			}
+		})
+	}
+}
+
+func TestLoadConfigConversationLimits(t *testing.T) {
+	for _, name := range []string{"MAX_MESSAGES", "MAX_MESSAGE_CHARS", "MAX_TOTAL_CHARS"} {
+		t.Setenv(name, "")
+	}
+	cfg, err := loadConfig()
+	if err != nil || cfg.MaxMessages != 50 || cfg.MaxMessageChars != 32*1024 || cfg.MaxTotalChars != 128*1024 {
+		t.Fatalf("loadConfig() = %d, %d, %d, %v, want the defaults", cfg.MaxMessages, cfg.MaxMessageChars, cfg.MaxTotalChars, err)
+	}
+	t.Setenv("MAX_MESSAGES", "10")
+	t.Setenv("MAX_MESSAGE_CHARS", "100")
+	t.Setenv("MAX_TOTAL_CHARS", "500")
+	cfg, err = loadConfig()
+	if err != nil || cfg.MaxMessages != 10 || cfg.MaxMessageChars != 100 || cfg.MaxTotalChars != 500 {
+		t.Fatalf("loadConfig() = %d, %d, %d, %v, want 10, 100 and 500", cfg.MaxMessages, cfg.MaxMessageChars, cfg.MaxTotalChars, err)
+	}
+	t.Setenv("MAX_MESSAGES", "many")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted MAX_MESSAGES=many")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestPing(t *testing.T) {
+	pong := `{"type":"pong","ts":` + strconv.FormatInt(testStart.UnixMilli(), 10) + `}`
+	tests := []struct {
+		name        string
+		noTable     bool
+		recorded    bool
+		updateErr   error
+		postErr     error
+		auth        bool
+		wantStatus  int
+		wantFrames  []string
+		wantRefresh bool // The connection record gets the time of the ping
+		wantRecord  bool
+	}{
+		{name: "recorded connection", recorded: true, wantStatus: statusCodeOK, wantFrames: []string{pong}, wantRefresh: true, wantRecord: true},
+		// A ping doesn't create the record of a connection that has none
+		{name: "unrecorded connection", wantStatus: statusCodeOK, wantFrames: []string{pong}},
+		{name: "no connections table", noTable: true, wantStatus: statusCodeOK, wantFrames: []string{pong}},
+		{name: "refresh failure", recorded: true, updateErr: errors.New("throttled"), wantStatus: statusCodeOK, wantFrames: []string{pong}, wantRecord: true},
+		// The ping skips the authorization lookup, so it's answered even for a connection without a token record
+		{name: "authorized mode", auth: true, wantStatus: statusCodeOK, wantFrames: []string{pong}},
+		{name: "client gone", recorded: true, postErr: testsupport.ErrGone, wantStatus: statusCodeOK, wantFrames: []string{}, wantRefresh: true, wantRecord: true},
+		{name: "post failure", recorded: true, postErr: &testsupport.StatusError{Code: http.StatusInternalServerError}, wantStatus: statusCodeServerError, wantFrames: []string{}, wantRefresh: true, wantRecord: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.ConnectionsTable = "connections"
+				if tt.noTable {
+					cfg.ConnectionsTable = ""
+				}
+				// A ping must stay cheap even when every request validates its model
+				cfg.ModelValidation = true
+				if tt.auth {
+					cfg.AuthMode, cfg.AuthSecret = authModeToken, testAuthSecret
+				}
+			})
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			if tt.recorded {
+				item := connectionKey("conn-1")
+				item["expires_at"] = &dynamodb.AttributeValue{N: aws.String("1")}
+				db.put("connections", item)
+			}
+			if tt.updateErr != nil {
+				db.fail("UpdateItem", tt.updateErr)
+			}
+			poster := testsupport.NewRecordingPoster()
+			if tt.postErr != nil {
+				poster.FailAt(0, tt.postErr)
+			}
+			chat := testsupport.NewScriptedCompleter()
+			h := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart))
+			// The OpenAI client would be built from the configuration on first use
+			h.openAIClients.generation = 0
+
+			response, err := h.Handler(context.Background(), testMessage(`{"action":"ping"}`))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			if len(chat.Requests()) != 0 || len(chat.ModerationRequests()) != 0 || chat.ListModelsCalls() != 0 || h.openAIClients.generation != 0 {
+				t.Error("the ping reached the OpenAI client")
+			}
+
+			record := db.item("connections", connectionKey("conn-1"))
+			if (record != nil) != tt.wantRecord {
+				t.Fatalf("connection record = %v, want one %v", record, tt.wantRecord)
+			}
+			if record == nil {
+				return
+			}
+			lastSeen, refreshed := record["last_seen"]
+			if refreshed != tt.wantRefresh {
+				t.Fatalf("last_seen set = %v, want %v", refreshed, tt.wantRefresh)
+			}
+			if !refreshed {
+				return
+			}
+			if got := aws.StringValue(lastSeen.N); got != strconv.FormatInt(testStart.Unix(), 10) {
+				t.Errorf("last_seen = %s, want the time of the ping", got)
+			}
+			if got := aws.StringValue(record["expires_at"].N); got != strconv.FormatInt(testStart.Add(connectionRecordTTL).Unix(), 10) {
+				t.Errorf("expires_at = %s, want %v after the ping", got, connectionRecordTTL)
+			}
+		})
+	}
+}
+
+// TestPingExtendsRecord checks that every ping pushes the expiry of the connection record further out
+func TestPingExtendsRecord(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConnectionsTable = "connections" })
+	db := newFakeDynamoDB().table("connections", "connection_id")
+	db.put("connections", connectionKey("conn-1"))
+	clock := testsupport.NewClock(testStart)
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), db, clock)
+	for i := 0; i < 3; i++ {
+		h.Handler(context.Background(), testMessage(`{"action":"ping"}`))
+		want := strconv.FormatInt(clock.Now().Add(connectionRecordTTL).Unix(), 10)
+		if got := aws.StringValue(db.item("connections", connectionKey("conn-1"))["expires_at"].N); got != want {
+			t.Fatalf("ping %d: expires_at = %s, want %s", i, got, want)
+		}
+		clock.Advance(9 * time.Minute)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ErrPrefillMismatch is returned with strict_prefill when the completion doesn't begin with the assistant prefill
+var ErrPrefillMismatch = fmt.Errorf("%w: completion doesn't begin with the assistant prefill", ErrUnparsableResponse)
+
+// requestPrefill returns the text of the assistant message ending the messages of request, the prefix the
+// answer is meant to start with, or an empty string when the last message is from another role
+func requestPrefill(request Request) string {
+	if len(request.Messages) == 0 {
+		return ""
+	}
+	last := request.Messages[len(request.Messages)-1]
+	if last.Role != openai.ChatMessageRoleAssistant || len(last.ToolCalls) > 0 {
+		return ""
+	}
+	return last.text()
+}
+
+// applyPrefill returns reply starting with prefill. OpenAI models given a trailing assistant message either
+// repeat it or continue after it; a repeated prefix is kept as it is, possibly after white space, and a
+// continuation gets the prefix put in front. With strict, a continuation fails with ErrPrefillMismatch.
+func applyPrefill(prefill string, strict bool, reply string) (string, error) {
+	if prefill == "" || strings.HasPrefix(strings.TrimLeft(reply, " \t\r\n"), strings.TrimSpace(prefill)) {
+		return reply, nil
+	}
+	if strict {
+		return "", ErrPrefillMismatch
+	}
+	return prefill + reply, nil
+}
+
+// initPrefilledRequest sends request like initOpenAIRequest, with the choices of the response starting with
+// the assistant prefill of the request, so the extracting response types parse continuations too
+func initPrefilledRequest(ctx context.Context, openAIRequest openAIRequest, request Request) (openai.ChatCompletionResponse, error) {
+	response, err := initOpenAIRequest(ctx, openAIRequest, request)
+	if err != nil {
+		return response, err
+	}
+	prefill := requestPrefill(request)
+	if prefill == "" {
+		return response, nil
+	}
+	for i := range response.Choices {
+		content, err := applyPrefill(prefill, request.StrictPrefill, response.Choices[i].Message.Content)
+		if err != nil {
+			openAIRequest.logger().Warn("OpenAI API response doesn't begin with the prefill", "reply", loggedPayload(openAIRequest.config, response.Choices[i].Message.Content))
+			return response, err
+		}
+		response.Choices[i].Message.Content = content
+	}
+	return response, nil
+}
+
+// checkStrictPrefill rejects strict_prefill on requests without a trailing assistant message to check against
+func checkStrictPrefill(request Request) error {
+	if request.StrictPrefill && requestPrefill(request) == "" {
+		return fmt.Errorf("strict_prefill requires the messages to end with an assistant message")
+	}
+	return nil
+}
+
+// anthropicPrefill returns the assistant message ending a chat request, which Anthropic models continue from.
+// Anthropic rejects a final assistant message ending in white space, so it is trimmed.
+func anthropicPrefill(request openai.ChatCompletionRequest) string {
+	if len(request.Messages) == 0 {
+		return ""
+	}
+	last := request.Messages[len(request.Messages)-1]
+	if last.Role != openai.ChatMessageRoleAssistant {
+		return ""
+	}
+	return strings.TrimRight(last.Content, " \t\r\n")
+}
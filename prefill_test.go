@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestApplyPrefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefill string
+		strict  bool
+		reply   string
+		want    string
+		wantErr error
+	}{
+		{name: "no prefill", reply: `"a":1}`, want: `"a":1}`},
+		{name: "repetition", prefill: "{", reply: `{"a":1}`, want: `{"a":1}`},
+		{name: "repetition after white space", prefill: "{", reply: "\n {\"a\":1}", want: "\n {\"a\":1}"},
+		{name: "continuation", prefill: "{", reply: `"a":1}`, want: `{"a":1}`},
+		// A prefill ending in white space still matches a repetition without it
+		{name: "repetition without the trailing space", prefill: "Answer: ", reply: "Answer:[[42]]", want: "Answer:[[42]]"},
+		{name: "continuation after a trailing space", prefill: "Answer: ", reply: "[[42]]", want: "Answer: [[42]]"},
+		{name: "strict repetition", prefill: "Answer:", strict: true, reply: "Answer: [[42]]", want: "Answer: [[42]]"},
+		{name: "strict continuation", prefill: "Answer:", strict: true, reply: " [[42]]", wantErr: ErrPrefillMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyPrefill(tt.prefill, tt.strict, tt.reply)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("applyPrefill() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("applyPrefill() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestPrefill(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+		want     string
+	}{
+		{name: "assistant last", messages: `[{"role":"user","content":"Grade it"},{"role":"assistant","content":"Answer: [["}]`, want: "Answer: [["},
+		{name: "user last", messages: `[{"role":"assistant","content":"Answer:"},{"role":"user","content":"Grade it"}]`},
+		{name: "tool call", messages: `[{"role":"user","content":"Grade it"},{"role":"assistant","content":"","tool_calls":[{"id":"call-1","name":"grade","arguments":"{}"}]}]`},
+		{name: "no messages", messages: `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseRequestBody(`{"response_type":"int","messages":` + tt.messages + `}`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := requestPrefill(request); got != tt.want {
+				t.Errorf("requestPrefill() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPrefillResponses checks that the extracting response types parse a model that continues after the
+// prefill as well as one that repeats it
+func TestPrefillResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		prefill      string
+		strict       bool
+		reply        string
+		wantStatus   int
+		wantFrames   []string
+	}{
+		{name: "int continuation", responseType: responseTypeInt, prefill: "Answer: [[", reply: "42]]", wantStatus: statusCodeOK, wantFrames: []string{"42"}},
+		{name: "int repetition", responseType: responseTypeInt, prefill: "Answer: [[", reply: "Answer: [[42]]", wantStatus: statusCodeOK, wantFrames: []string{"42"}},
+		{name: "string continuation", responseType: responseTypeString, prefill: "Colour: [[", reply: "deep blue]]", wantStatus: statusCodeOK, wantFrames: []string{"deep blue"}},
+		{name: "json continuation", responseType: responseTypeJSON, prefill: "{", reply: `"grade": 42}`, wantStatus: statusCodeOK, wantFrames: []string{`{"grade": 42}`}},
+		{name: "json repetition", responseType: responseTypeJSON, prefill: "{", reply: `{"grade": 42}`, wantStatus: statusCodeOK, wantFrames: []string{`{"grade": 42}`}},
+		{name: "strict repetition", responseType: responseTypeInt, prefill: "Answer: [[", strict: true, reply: "Answer: [[42]]", wantStatus: statusCodeOK, wantFrames: []string{"42"}},
+		{name: "strict continuation", responseType: responseTypeInt, prefill: "Answer: [[", strict: true, reply: "42]]", wantStatus: statusCodeBadGateway},
+		// The full response type answers with the completion as the model sent it
+		{name: "full continuation", responseType: responseTypeFull, prefill: "Dear", reply: " Sir,", wantStatus: statusCodeOK, wantFrames: []string{" Sir,"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.StreamFlushInterval = 0
+				cfg.OpenAIMaxRetries = 0
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(tt.reply))
+			messages, _ := json.Marshal([]map[string]string{{"role": "user", "content": "Grade it"}, {"role": "assistant", "content": tt.prefill}})
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","strict_prefill":` + jsonBool(tt.strict) + `,"messages":` + string(messages) + `}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			// The trailing assistant message reaches OpenAI unchanged
+			requests := chat.Requests()
+			if len(requests) == 0 {
+				t.Fatal("no request reached OpenAI")
+			}
+			last := requests[0].Messages[len(requests[0].Messages)-1]
+			if last.Role != openai.ChatMessageRoleAssistant || last.Content != tt.prefill {
+				t.Errorf("last message = %s %q, want the assistant prefill %q", last.Role, last.Content, tt.prefill)
+			}
+		})
+	}
+}
+
+// jsonBool returns the JSON literal of b
+func jsonBool(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func TestStrictPrefillRequiresAssistantMessage(t *testing.T) {
+	cfg := testConfig(t, nil)
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("[[42]]"))
+	response, _ := runTestRequest(t, cfg, chat, `{"response_type":"int","prompt_template":"PROMPT_TEST","strict_prefill":true,"messages":[{"role":"user","content":"Grade it"}]}`)
+	if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, "strict_prefill requires") {
+		t.Errorf("Handler() = %d %s, want 400 for strict_prefill without a prefill", response.StatusCode, response.Body)
+	}
+	if len(chat.Requests()) != 0 {
+		t.Error("the invalid request reached OpenAI")
+	}
+}
+
+// TestAnthropicPrefill checks the true prefill of the Anthropic messages API: the model only sends the
+// continuation, which is answered with the prefill in front
+func TestAnthropicPrefill(t *testing.T) {
+	request := openai.ChatCompletionRequest{Messages: []openai.ChatCompletionMessage{
+		{Role: openai.ChatMessageRoleUser, Content: "Grade it"},
+		{Role: openai.ChatMessageRoleAssistant, Content: "Answer: [[ \n"},
+	}}
+	body := newAnthropicRequest(request, 256)
+	// Anthropic rejects a final assistant message ending in white space
+	if last := body.Messages[len(body.Messages)-1]; last.Role != openai.ChatMessageRoleAssistant || last.Content != "Answer: [[" {
+		t.Errorf("last message = %+v, want the trimmed prefill", last)
+	}
+
+	response, err := parseAnthropicResponse([]byte(`{"content":[{"type":"text","text":"42]]"}],"stop_reason":"end_turn"}`), anthropicPrefill(request))
+	if err != nil || response.Choices[0].Message.Content != "Answer: [[42]]" {
+		t.Errorf("parseAnthropicResponse() = %+v, %v, want the prefill in front", response.Choices, err)
+	}
+
+	state := anthropicStreamState{prefill: anthropicPrefill(request)}
+	var texts []string
+	for _, event := range []string{
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"42"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"]]"}}`,
+	} {
+		chunk, ok, err := state.handleEvent([]byte(event))
+		if err != nil || !ok {
+			t.Fatalf("handleEvent(%s) = %v, %v", event, ok, err)
+		}
+		texts = append(texts, chunk.Choices[0].Delta.Content)
+	}
+	if !reflect.DeepEqual(texts, []string{"Answer: [[42", "]]"}) {
+		t.Errorf("stream deltas = %q, want the prefill in front of the first", texts)
+	}
+
+	if got := anthropicPrefill(openai.ChatCompletionRequest{Messages: request.Messages[:1]}); got != "" {
+		t.Errorf("anthropicPrefill() = %q without a trailing assistant message", got)
+	}
+}
+
+// TestBedrockPrefill sends a prefilled request to Bedrock, which continues after the prefill
+func TestBedrockPrefill(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.AllowedProviders = map[string]bool{providerOpenAI: true, providerBedrock: true}
+		cfg.BedrockModelID = testBedrockModel
+	})
+	fixture := newBedrockFixture(t, `"grade": 42}`)
+	chat := testsupport.NewScriptedCompleter()
+	poster := testsupport.NewRecordingPoster()
+	h := newTestHandler(cfg, chat, poster, nil, nil)
+	h.bedrockClients.generation, h.bedrockClients.value = cfg.Generation, fixture.completer(chat)
+	body := `{"provider":"bedrock","response_type":"json","prompt_template":"PROMPT_TEST","strict_prefill":true,"messages":[{"role":"user","content":"Grade it"},{"role":"assistant","content":"{"}]}`
+	response, err := h.Handler(context.Background(), testMessage(body))
+	if err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+	}
+	if !reflect.DeepEqual(poster.Texts(), []string{`{"grade": 42}`}) {
+		t.Errorf("frames = %q, want the prefilled JSON", poster.Texts())
+	}
+	_, requests := fixture.requests()
+	if len(requests) != 1 {
+		t.Fatalf("Bedrock requests = %d, want 1", len(requests))
+	}
+	if last := requests[0].Messages[len(requests[0].Messages)-1]; last.Role != openai.ChatMessageRoleAssistant || last.Content != "{" {
+		t.Errorf("last Bedrock message = %+v, want the prefill", last)
+	}
+}
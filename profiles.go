@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// promptProfile holds the defaults of the requests using one prompt template. Fields set in the request win.
+type promptProfile struct {
+	Model          string   `json:"model,omitempty"`
+	Temperature    *float32 `json:"temperature,omitempty"`
+	MaxTokens      *int     `json:"max_tokens,omitempty"`
+	ResponseFormat string   `json:"response_format,omitempty"` // "text" or "json_object"
+}
+
+// parsePromptProfiles parses the template=profile JSON object of PROMPT_PROFILES. Models are resolved through the
+// aliases and checked against ALLOWED_MODELS here, so a broken profile fails the cold start rather than a request.
+func parsePromptProfiles(cfg *Config, value string, allowedModels []string) (map[string]promptProfile, error) {
+	profiles := make(map[string]promptProfile)
+	if strings.TrimSpace(value) == "" {
+		return profiles, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable PROMPT_PROFILES: %v", err)
+	}
+	for name, profile := range profiles {
+		if profile.Model != "" {
+			profile.Model = resolveModelAlias(cfg.ModelAliases, profile.Model)
+			if len(allowedModels) > 0 && !slices.Contains(allowedModels, profile.Model) {
+				return nil, fmt.Errorf("Invalid profile %s in environment variable PROMPT_PROFILES, model %s is not listed in ALLOWED_MODELS", name, profile.Model)
+			}
+		}
+		model := profile.Model
+		if model == "" {
+			model = cfg.OpenAIModel
+		}
+		if profile.Temperature != nil {
+			if *profile.Temperature < minTemperature || *profile.Temperature > maxTemperature {
+				return nil, fmt.Errorf("Invalid profile %s in environment variable PROMPT_PROFILES, temperature must be between %d and %d", name, minTemperature, maxTemperature)
+			}
+			if isReasoningModel(cfg, model) {
+				return nil, fmt.Errorf("Invalid profile %s in environment variable PROMPT_PROFILES, temperature is not supported by the reasoning model %s", name, model)
+			}
+		}
+		if profile.MaxTokens != nil && *profile.MaxTokens <= 0 {
+			return nil, fmt.Errorf("Invalid profile %s in environment variable PROMPT_PROFILES, max_tokens must be greater than 0", name)
+		}
+		switch openai.ChatCompletionResponseFormatType(profile.ResponseFormat) {
+		case "", openai.ChatCompletionResponseFormatTypeText, openai.ChatCompletionResponseFormatTypeJSONObject:
+		default:
+			return nil, fmt.Errorf("Invalid profile %s in environment variable PROMPT_PROFILES, response_format must be text or json_object", name)
+		}
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// promptProfileFor returns the profile of the prompt template of the request. Inline system prompts have none.
+func promptProfileFor(cfg *Config, request Request) promptProfile {
+	if request.SystemPrompt != "" {
+		return promptProfile{}
+	}
+	return cfg.PromptProfiles[request.PromptTemplate]
+}
+
+// withPromptProfile fills the sampling parameters the request leaves unset from the profile of its prompt template
+func withPromptProfile(cfg *Config, request Request) Request {
+	profile := promptProfileFor(cfg, request)
+	if request.Temperature == nil {
+		request.Temperature = profile.Temperature
+	}
+	if request.MaxTokens == nil {
+		request.MaxTokens = profile.MaxTokens
+	}
+	return request
+}
+
+// requestModel returns the OpenAI model the request is meant for: the model of its profile, or OPENAI_MODEL
+func requestModel(cfg *Config, request Request) string {
+	if model := promptProfileFor(cfg, request).Model; model != "" {
+		return model
+	}
+	return cfg.OpenAIModel
+}
+
+// applyProfileResponseFormat sets the response format of the profile unless the response type already chose one
+func applyProfileResponseFormat(cfg *Config, chatRequest *openai.ChatCompletionRequest, request Request) {
+	format := promptProfileFor(cfg, request).ResponseFormat
+	if format != "" && chatRequest.ResponseFormat == nil {
+		chatRequest.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatType(format)}
+	}
+}
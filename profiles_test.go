@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParsePromptProfiles(t *testing.T) {
+	cfg := &Config{OpenAIModel: "gpt-4o", ModelAliases: map[string]string{"fast": "gpt-4o-mini"}, ReasoningModels: defaultReasoningModels}
+	temperature, maxTokens := float32(0.2), 50
+	tests := []struct {
+		name    string
+		value   string
+		allowed []string
+		want    map[string]promptProfile
+		wantErr string
+	}{
+		{name: "unset", want: map[string]promptProfile{}},
+		{
+			name:    "profiles",
+			value:   `{"PROMPT_SCORER":{"model":"fast","temperature":0.2,"max_tokens":50,"response_format":"json_object"},"PROMPT_CHAT":{}}`,
+			allowed: []string{"gpt-4o", "gpt-4o-mini"},
+			want: map[string]promptProfile{
+				"PROMPT_SCORER": {Model: "gpt-4o-mini", Temperature: &temperature, MaxTokens: &maxTokens, ResponseFormat: "json_object"},
+				"PROMPT_CHAT":   {},
+			},
+		},
+		{name: "malformed", value: `{"PROMPT_SCORER":`, wantErr: "Invalid value for environment variable PROMPT_PROFILES"},
+		{name: "unknown field", value: `{"PROMPT_SCORER":{"top_p":0.5}}`, wantErr: `unknown field "top_p"`},
+		{name: "model not allowed", value: `{"PROMPT_SCORER":{"model":"gpt-4"}}`, allowed: []string{"gpt-4o"}, wantErr: "model gpt-4 is not listed in ALLOWED_MODELS"},
+		{name: "alias not allowed", value: `{"PROMPT_SCORER":{"model":"fast"}}`, allowed: []string{"gpt-4o"}, wantErr: "model gpt-4o-mini is not listed in ALLOWED_MODELS"},
+		{name: "temperature out of range", value: `{"PROMPT_SCORER":{"temperature":2.5}}`, wantErr: "temperature must be between"},
+		{name: "temperature of a reasoning model", value: `{"PROMPT_SCORER":{"model":"o3-mini","temperature":0.2}}`, wantErr: "temperature is not supported by the reasoning model o3-mini"},
+		{name: "max_tokens", value: `{"PROMPT_SCORER":{"max_tokens":0}}`, wantErr: "max_tokens must be greater than 0"},
+		{name: "response_format", value: `{"PROMPT_SCORER":{"response_format":"xml"}}`, wantErr: "response_format must be text or json_object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePromptProfiles(cfg, tt.value, tt.allowed)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePromptProfiles() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parsePromptProfiles() = %+v, %v, want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsProfileModels(t *testing.T) {
+	t.Setenv("OPENAI_MODEL", "gpt-4o")
+	t.Setenv("ALLOWED_MODELS", "gpt-4o,gpt-4o-mini")
+	t.Setenv("PROMPT_PROFILES", `{"PROMPT_SCORER":{"model":"gpt-4-turbo"}}`)
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "gpt-4-turbo is not listed in ALLOWED_MODELS") {
+		t.Fatalf("loadConfig() error = %v, want the profile model rejected", err)
+	}
+}
+
+// TestPromptProfilePrecedence checks that request fields win over the profile of the template, which wins over
+// the global defaults
+func TestPromptProfilePrecedence(t *testing.T) {
+	temperature, maxTokens := float32(0.2), 50
+	tests := []struct {
+		name     string
+		template string
+		params   string
+		want     openai.ChatCompletionRequest
+	}{
+		{name: "global defaults", template: "PROMPT_TEST", want: openai.ChatCompletionRequest{Model: "gpt-4o"}},
+		{
+			name:     "profile",
+			template: "PROMPT_SCORER",
+			want:     openai.ChatCompletionRequest{Model: "gpt-4o-mini", Temperature: 0.2, MaxTokens: 50, ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}},
+		},
+		{
+			name:     "request fields",
+			template: "PROMPT_SCORER",
+			params:   `,"temperature":0.9,"max_tokens":10`,
+			want:     openai.ChatCompletionRequest{Model: "gpt-4o-mini", Temperature: 0.9, MaxTokens: 10, ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PROMPT_SCORER", "Score the essay.")
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-4o"
+				cfg.PromptProfiles = map[string]promptProfile{
+					"PROMPT_SCORER": {Model: "gpt-4o-mini", Temperature: &temperature, MaxTokens: &maxTokens, ResponseFormat: "json_object"},
+				}
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply(`{"score":3}`))
+			body := `{"response_type":"full","prompt_template":"` + tt.template + `","messages":[{"role":"user","content":"hi"}]` + tt.params + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK || len(chat.Requests()) != 1 {
+				t.Fatalf("Handler() = %d %s with %d OpenAI requests", response.StatusCode, response.Body, len(chat.Requests()))
+			}
+			got := chat.Requests()[0]
+			params := openai.ChatCompletionRequest{Model: got.Model, Temperature: got.Temperature, MaxTokens: got.MaxTokens, ResponseFormat: got.ResponseFormat}
+			if !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("request = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
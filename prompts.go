@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// promptCacheTTL is how long a template read from PROMPT_TABLE, or its absence, is reused before it is read again
+	promptCacheTTL          = 60 * time.Second
+	defaultPromptEnvPrefix  = "PROMPT_"
+	maxPromptTemplateLength = 128
+	// maxTemplateVarBytes bounds every template_vars value to keep the room for prompt injection small
+	maxTemplateVarBytes = 2 * 1024
+	// maxInlinePromptBytes bounds the system_prompt of a request
+	maxInlinePromptBytes = 16 * 1024
+)
+
+// templatePlaceholder matches the {{key}} placeholders filled from template_vars
+var templatePlaceholder = regexp.MustCompile(`\{\{([A-Za-z0-9_]+)\}\}`)
+
+// templateVarKey matches the template_vars keys a placeholder can name
+var templateVarKey = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// deniedPromptTemplatePrefixes are environment variables never used as prompt templates, whatever PROMPT_ENV_PREFIX allows
+var deniedPromptTemplatePrefixes = []string{"OPENAI_API_KEY", "API_GW_ENDPOINT", "RELAY_CREDENTIALS", "AWS_"}
+
+// checkPromptTemplateName rejects template names outside PROMPT_ENV_PREFIX, so clients can't read arbitrary
+// environment variables. Names are limited to upper case letters, digits and underscores.
+func checkPromptTemplateName(cfg *Config, name string) error {
+	if name == "" {
+		return fmt.Errorf("prompt_template is required")
+	}
+	if len(name) > maxPromptTemplateLength {
+		return fmt.Errorf("prompt_template is longer than %d characters", maxPromptTemplateLength)
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '_' {
+			return fmt.Errorf("prompt_template may only contain upper case letters, digits and underscores")
+		}
+	}
+	if !strings.HasPrefix(name, cfg.PromptEnvPrefix) {
+		return fmt.Errorf("prompt_template must start with %s", cfg.PromptEnvPrefix)
+	}
+	for _, denied := range deniedPromptTemplatePrefixes {
+		if strings.HasPrefix(name, denied) {
+			return fmt.Errorf("prompt_template %s is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// cachedPrompt is a PROMPT_TABLE lookup result. An empty prompt records a miss.
+type cachedPrompt struct {
+	prompt  string
+	expires time.Time
+}
+
+// promptCache holds the templates read from PROMPT_TABLE, keyed by table and template name
+type promptCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedPrompt
+	nowFunc func() time.Time
+}
+
+var promptTemplates = &promptCache{entries: make(map[string]cachedPrompt), nowFunc: time.Now}
+
+// lookup returns the cached prompt for key and whether the entry is still fresh
+func (c *promptCache) lookup(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !c.nowFunc().Before(entry.expires) {
+		return "", false
+	}
+	return entry.prompt, true
+}
+
+// store caches prompt for key for promptCacheTTL
+func (c *promptCache) store(key string, prompt string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cachedPrompt{prompt: prompt, expires: c.nowFunc().Add(promptCacheTTL)}
+}
+
+// checkTemplateVars checks the keys and the size of the template_vars values
+func checkTemplateVars(vars map[string]string) error {
+	for key, value := range vars {
+		if !templateVarKey.MatchString(key) {
+			return fmt.Errorf("template_vars key %q may only contain letters, digits and underscores", key)
+		}
+		if len(value) > maxTemplateVarBytes {
+			return fmt.Errorf("template_vars value of %s is longer than %d bytes", key, maxTemplateVarBytes)
+		}
+	}
+	return nil
+}
+
+// fillPromptTemplate replaces the {{key}} placeholders of prompt with the values of vars in one pass, so braces
+// in the values are inserted verbatim. Extra values are ignored, and missing ones are reported together.
+func fillPromptTemplate(prompt string, vars map[string]string) (string, error) {
+	var missing []string
+	filled := templatePlaceholder.ReplaceAllStringFunc(prompt, func(placeholder string) string {
+		key := placeholder[2 : len(placeholder)-2]
+		value, ok := vars[key]
+		if !ok {
+			missing = append(missing, key)
+			return placeholder
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return "", fmt.Errorf("%w: %s", ErrTemplateVarsMissing, strings.Join(slices.Compact(missing), ", "))
+	}
+	return filled, nil
+}
+
+// checkSystemPrompt checks that an inline system_prompt is allowed and within maxInlinePromptBytes
+func checkSystemPrompt(cfg *Config, prompt string) error {
+	if !cfg.AllowInlinePrompts {
+		return fmt.Errorf("system_prompt is not allowed")
+	}
+	if len(prompt) > maxInlinePromptBytes {
+		return fmt.Errorf("system_prompt is longer than %d bytes", maxInlinePromptBytes)
+	}
+	return nil
+}
+
+// getSystemPrompt returns the system prompt of the request with its placeholders filled. An inline system_prompt
+// gets the text normalization of the output and takes the place of the prompt template.
+func getSystemPrompt(ctx context.Context, openAIRequest openAIRequest, request Request) (string, error) {
+	var prompt string
+	var err error
+	if request.SystemPrompt != "" {
+		prompt = textNormalizationStages(openAIRequest.config, request).apply(request.SystemPrompt)
+	} else {
+		prompt, err = getPromptTemplate(ctx, openAIRequest, request.PromptTemplate)
+		if err != nil {
+			return "", err
+		}
+	}
+	prompt, err = fillPromptTemplate(prompt, request.TemplateVars)
+	if err != nil || len(openAIRequest.injection) == 0 {
+		return prompt, err
+	}
+	// Annotated requests tell the model that the user input looks like an injection
+	return prompt + "\n\n" + injectionWarning, nil
+}
+
+// getPromptTemplate returns the system prompt named by the prompt_template field. With PROMPT_TABLE set the
+// template is read from the table first, and the environment variable of the same name is only a fallback.
+func getPromptTemplate(ctx context.Context, openAIRequest openAIRequest, name string) (string, error) {
+	table := openAIRequest.config.PromptTable
+	if table != "" {
+		prompt, err := getTablePrompt(ctx, openAIRequest, table, name)
+		if err != nil {
+			return "", err
+		}
+		if prompt != "" {
+			return prompt, nil
+		}
+	}
+
+	prompt := os.Getenv(name)
+	if prompt == "" {
+		return "", fmt.Errorf("Prompt not found in the environment variable %s", name)
+	}
+	return prompt, nil
+}
+
+// getTablePrompt reads a template from the prompt table through the cache, returning an empty prompt on a miss
+func getTablePrompt(ctx context.Context, openAIRequest openAIRequest, table string, name string) (string, error) {
+	key := table + "/" + name
+	if prompt, ok := promptTemplates.lookup(key); ok {
+		return prompt, nil
+	}
+
+	output, err := openAIRequest.dynamoDBClient.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"name": {S: aws.String(name)},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Can't read prompt template %s from table %s: %v", name, table, err)
+	}
+
+	var prompt string
+	if attribute, ok := output.Item["prompt"]; ok {
+		prompt = aws.StringValue(attribute.S)
+	}
+	promptTemplates.store(key, prompt)
+	return prompt, nil
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// testPromptCache replaces the PROMPT_TABLE cache for the test with one timed by the returned clock
+func testPromptCache(t *testing.T) *testsupport.Clock {
+	t.Helper()
+	clock := testsupport.NewClock(testStart)
+	original := promptTemplates
+	t.Cleanup(func() { promptTemplates = original })
+	promptTemplates = &promptCache{entries: make(map[string]cachedPrompt), nowFunc: clock.Now}
+	return clock
+}
+
+// runPromptRequest sends a full request with body fields extra to a handler keeping its tables in db and
+// returns the response and the system prompt OpenAI got
+func runPromptRequest(t *testing.T, cfg *Config, db *fakeDynamoDB, extra string) (events.APIGatewayProxyResponse, string) {
+	t.Helper()
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+	h := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil)
+	body := `{"response_type":"full","messages":[{"role":"user","content":"hi"}]` + extra + `}`
+	response, err := h.Handler(context.Background(), testMessage(body))
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	var system string
+	if requests := chat.Requests(); len(requests) > 0 && len(requests[0].Messages) > 0 {
+		system = requests[0].Messages[0].Content
+	}
+	return response, system
+}
+
+func TestPromptTable(t *testing.T) {
+	t.Setenv("PROMPT_ENV_ONLY", "Prompt from the environment.")
+	tests := []struct {
+		name         string
+		template     string
+		advance      time.Duration
+		wantStatus   int
+		wantPrompts  []string
+		wantGetItems int
+	}{
+		{
+			name:         "cache hit",
+			template:     "PROMPT_TABLE_ONE",
+			wantStatus:   statusCodeOK,
+			wantPrompts:  []string{"Prompt from the table.", "Prompt from the table."},
+			wantGetItems: 1,
+		},
+		{
+			name:         "cache expiry",
+			template:     "PROMPT_TABLE_ONE",
+			advance:      promptCacheTTL + time.Second,
+			wantStatus:   statusCodeOK,
+			wantPrompts:  []string{"Prompt from the table.", "Prompt from the table."},
+			wantGetItems: 2,
+		},
+		{
+			name:         "miss falls back to the environment",
+			template:     "PROMPT_ENV_ONLY",
+			wantStatus:   statusCodeOK,
+			wantPrompts:  []string{"Prompt from the environment.", "Prompt from the environment."},
+			wantGetItems: 1,
+		},
+		{
+			// A miss is cached too, so the second request doesn't read the table again
+			name:         "missing everywhere",
+			template:     "PROMPT_NOWHERE",
+			wantStatus:   statusCodeServerError,
+			wantGetItems: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testPromptCache(t)
+			cfg := testConfig(t, func(cfg *Config) { cfg.PromptTable = "prompts" })
+			db := newFakeDynamoDB().table("prompts", "name")
+			db.put("prompts", map[string]*dynamodb.AttributeValue{
+				"name":   {S: aws.String("PROMPT_TABLE_ONE")},
+				"prompt": {S: aws.String("Prompt from the table.")},
+			})
+			for i := 0; i < 2; i++ {
+				response, system := runPromptRequest(t, cfg, db, `,"prompt_template":"`+tt.template+`"`)
+				if response.StatusCode != tt.wantStatus {
+					t.Fatalf("request %d: StatusCode = %d, want %d", i, response.StatusCode, tt.wantStatus)
+				}
+				if tt.wantStatus != statusCodeOK && !strings.Contains(response.Body, "Prompt not found in the environment variable "+tt.template) {
+					t.Errorf("request %d: Body = %q, want the missing template", i, response.Body)
+				}
+				if tt.wantPrompts != nil && !strings.HasPrefix(system, tt.wantPrompts[i]) {
+					t.Errorf("request %d: system prompt = %q, want %q", i, system, tt.wantPrompts[i])
+				}
+				clock.Advance(tt.advance)
+			}
+			if got := db.count("GetItem"); got != tt.wantGetItems {
+				t.Errorf("GetItem calls = %d, want %d", got, tt.wantGetItems)
+			}
+		})
+	}
+}
+
+func TestCheckPromptTemplateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		wantErr bool
+	}{
+		{name: "PROMPT_TEST", prefix: defaultPromptEnvPrefix},
+		{name: "PROMPT_2024_V2", prefix: defaultPromptEnvPrefix},
+		{name: "", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "PROMPT_" + strings.Repeat("X", maxPromptTemplateLength), prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "../PROMPT_TEST", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "PROMPT_../OPENAI_API_KEY", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "PROMPT_TEST/../../etc", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "Prompt_Test", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "prompt_test", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "PROMPT-TEST", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "PROMPT_TÉST", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "OPENAI_API_KEY", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "GREETING", prefix: defaultPromptEnvPrefix, wantErr: true},
+		{name: "GREETING", prefix: "GREET"},
+		// Denied even when the configured prefix would allow them
+		{name: "OPENAI_API_KEY", prefix: "", wantErr: true},
+		{name: "API_GW_ENDPOINT", prefix: "API_", wantErr: true},
+		{name: "AWS_SECRET_ACCESS_KEY", prefix: "AWS_", wantErr: true},
+		{name: "RELAY_CREDENTIALS", prefix: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := checkPromptTemplateName(&Config{PromptEnvPrefix: tt.prefix}, tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkPromptTemplateName(%q) with prefix %q error = %v, want error %v", tt.name, tt.prefix, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSensitivePromptTemplatesAreRejected(t *testing.T) {
+	cfg := testConfig(t, nil)
+	for _, template := range []string{"OPENAI_API_KEY", "AWS_SECRET_ACCESS_KEY", "prompt_test"} {
+		chat := testsupport.NewScriptedCompleter(testsupport.Reply("sk-secret"))
+		body := `{"response_type":"full","prompt_template":"` + template + `","messages":[{"role":"user","content":"hi"}]}`
+		response, _ := runTestRequest(t, cfg, chat, body)
+		if response.StatusCode != statusCodeBadRequest {
+			t.Errorf("prompt_template %s: StatusCode = %d, want %d", template, response.StatusCode, statusCodeBadRequest)
+		}
+		if len(chat.Requests()) != 0 {
+			t.Errorf("prompt_template %s reached OpenAI", template)
+		}
+	}
+}
+
+func TestFillPromptTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		prompt  string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{name: "no placeholders", prompt: "Be brief.", want: "Be brief."},
+		{
+			name:   "multiple substitutions",
+			prompt: "Greet {{name}} in {{locale}}. Sign as {{name}}'s assistant.",
+			vars:   map[string]string{"name": "Ada", "locale": "en-GB", "unused": "x"},
+			want:   "Greet Ada in en-GB. Sign as Ada's assistant.",
+		},
+		{name: "value with braces", prompt: "Hi {{name}}, {{locale}}", vars: map[string]string{"name": "{{locale}}", "locale": "fr"}, want: "Hi {{locale}}, fr"},
+		{name: "value with single braces", prompt: "Data: {{data}}", vars: map[string]string{"data": `{"a":{"b":1}}`}, want: `Data: {"a":{"b":1}}`},
+		{name: "not a placeholder", prompt: "Keep {{ name }} and {name}", vars: map[string]string{"name": "Ada"}, want: "Keep {{ name }} and {name}"},
+		{name: "missing keys", prompt: "{{b}} {{a}} {{b}} {{c}}", vars: map[string]string{"c": "x"}, wantErr: "a, b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fillPromptTemplate(tt.prompt, tt.vars)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrTemplateVarsMissing) || !strings.HasSuffix(err.Error(), ": "+tt.wantErr) {
+					t.Fatalf("fillPromptTemplate() error = %v, want missing %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("fillPromptTemplate() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTemplateVars(t *testing.T) {
+	tests := []struct {
+		name    string
+		vars    map[string]string
+		wantErr bool
+	}{
+		{name: "valid", vars: map[string]string{"display_name": "Ada", "locale2": "en"}},
+		{name: "value at the cap", vars: map[string]string{"bio": strings.Repeat("x", maxTemplateVarBytes)}},
+		{name: "value over the cap", vars: map[string]string{"bio": strings.Repeat("x", maxTemplateVarBytes+1)}, wantErr: true},
+		{name: "key with braces", vars: map[string]string{"a}}{{b": "x"}, wantErr: true},
+		{name: "key with a dash", vars: map[string]string{"display-name": "x"}, wantErr: true},
+		{name: "empty key", vars: map[string]string{"": "x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkTemplateVars(tt.vars); (err != nil) != tt.wantErr {
+			t.Errorf("checkTemplateVars(%s) error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestTemplateVarsRequests(t *testing.T) {
+	t.Setenv("PROMPT_GREETING", "Greet {{name}} in {{locale}}.")
+	tests := []struct {
+		name       string
+		vars       string
+		wantStatus int
+		wantPrompt string
+		wantBody   string
+	}{
+		{name: "filled", vars: `{"name":"Ada","locale":"{{fr}}"}`, wantStatus: statusCodeOK, wantPrompt: "Greet Ada in {{fr}}."},
+		{name: "missing", vars: `{"name":"Ada"}`, wantStatus: statusCodeBadRequest, wantBody: ErrTemplateVarsMissing.Error() + ": locale"},
+		{name: "too long", vars: `{"name":"` + strings.Repeat("a", maxTemplateVarBytes+1) + `","locale":"fr"}`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			response, system := runPromptRequest(t, cfg, nil, `,"prompt_template":"PROMPT_GREETING","template_vars":`+tt.vars)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("StatusCode = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if !strings.Contains(response.Body, tt.wantBody) {
+				t.Errorf("Body = %q, want %q", response.Body, tt.wantBody)
+			}
+			if !strings.HasPrefix(system, tt.wantPrompt) {
+				t.Errorf("system prompt = %q, want %q", system, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestCheckSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed bool
+		prompt  string
+		wantErr bool
+	}{
+		{name: "not allowed", prompt: "Be brief.", wantErr: true},
+		{name: "allowed", allowed: true, prompt: "Be brief."},
+		{name: "at the limit", allowed: true, prompt: strings.Repeat("a", maxInlinePromptBytes)},
+		{name: "over the limit", allowed: true, prompt: strings.Repeat("a", maxInlinePromptBytes+1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSystemPrompt(&Config{AllowInlinePrompts: tt.allowed}, tt.prompt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSystemPrompt() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestInlineSystemPrompt checks the system prompt that reaches OpenAI for an inline system_prompt, for both
+// the full and the stream response types
+func TestInlineSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    bool
+		extra      string
+		wantStatus int
+		wantPrompt string
+	}{
+		{name: "replaces the template", allowed: true, extra: `,"system_prompt":"Be brief."`, wantStatus: statusCodeOK, wantPrompt: "Be brief."},
+		{name: "confusables", allowed: true, extra: `,"system_prompt":"Answer in “quotes” — briefly…"`, wantStatus: statusCodeOK, wantPrompt: `Answer in "quotes" -- briefly...`},
+		{name: "template_vars", allowed: true, extra: `,"system_prompt":"Talk about {{topic}}.","template_vars":{"topic":"bees"}`, wantStatus: statusCodeOK, wantPrompt: "Talk about bees."},
+		{name: "not allowed", extra: `,"system_prompt":"Be brief."`, wantStatus: statusCodeBadRequest},
+		{name: "too long", allowed: true, extra: `,"system_prompt":"` + strings.Repeat("a", maxInlinePromptBytes+1) + `"`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		for _, responseType := range []string{responseTypeFull, responseTypeStream} {
+			t.Run(tt.name+" "+responseType, func(t *testing.T) {
+				cfg := testConfig(t, func(cfg *Config) {
+					cfg.AllowInlinePrompts = tt.allowed
+					cfg.StreamFlushInterval = 0
+				})
+				turn := testsupport.Reply("Hello")
+				if responseType == responseTypeStream {
+					turn = testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...)
+				}
+				chat := testsupport.NewScriptedCompleter(turn)
+				body := `{"response_type":"` + responseType + `","messages":[{"role":"user","content":"hi"}]` + tt.extra + `}`
+				response, _ := runTestRequest(t, cfg, chat, body)
+				if response.StatusCode != tt.wantStatus {
+					t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+				}
+				requests := chat.Requests()
+				if tt.wantStatus != statusCodeOK {
+					if len(requests) != 0 {
+						t.Error("the invalid request reached OpenAI")
+					}
+					return
+				}
+				if len(requests) != 1 {
+					t.Fatalf("%d requests, want 1", len(requests))
+				}
+				if got := requests[0].Messages[0].Content; got != tt.wantPrompt {
+					t.Errorf("system prompt = %q, want %q", got, tt.wantPrompt)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadConfigAllowInlinePrompts(t *testing.T) {
+	t.Setenv("ALLOW_INLINE_PROMPTS", "true")
+	cfg, err := loadConfig()
+	if err != nil || !cfg.AllowInlinePrompts {
+		t.Fatalf("loadConfig() = %v, %v, want inline prompts allowed", cfg.AllowInlinePrompts, err)
+	}
+	t.Setenv("ALLOW_INLINE_PROMPTS", "sometimes")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted ALLOW_INLINE_PROMPTS=sometimes")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	providerOpenAI = "openai"
+	providerAzure  = "azure"
+	// openAIProjectHeader attributes requests to an OpenAI project, which the OpenAI client has no setting for
+	openAIProjectHeader = "OpenAI-Project"
+)
+
+// azureDeploymentName strips the characters Azure doesn't allow in deployment names, as the OpenAI client does
+var azureDeploymentName = strings.NewReplacer(".", "", ":", "")
+
+// headerDoer adds fixed headers to every request sent through doer
+type headerDoer struct {
+	doer    openai.HTTPDoer
+	headers map[string]string
+}
+
+// Do sets the headers and sends the request
+func (d headerDoer) Do(req *http.Request) (*http.Response, error) {
+	for name, value := range d.headers {
+		req.Header.Set(name, value)
+	}
+	return d.doer.Do(req)
+}
+
+// parseExtraHeaders parses the JSON object of header names and values in OPENAI_EXTRA_HEADERS
+func parseExtraHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return headers, nil
+	}
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable OPENAI_EXTRA_HEADERS, expected a JSON object of strings: %v", err)
+	}
+	return headers, nil
+}
+
+// checkProvider checks the provider of the request against ALLOWED_PROVIDERS and the features it supports
+func checkProvider(cfg *Config, request Request) error {
+	provider := request.Provider
+	if provider == "" {
+		provider = providerOpenAI
+	}
+	if !cfg.AllowedProviders[provider] {
+		return fmt.Errorf("provider %q is not allowed", provider)
+	}
+	if provider == providerOpenAI {
+		return nil
+	}
+	switch {
+	case len(request.Tools) > 0:
+		return fmt.Errorf("tools are not supported by the %s provider", provider)
+	case request.PresencePenalty != nil:
+		return fmt.Errorf("presence_penalty is not supported by the %s provider", provider)
+	case request.FrequencyPenalty != nil:
+		return fmt.Errorf("frequency_penalty is not supported by the %s provider", provider)
+	case request.N > 1:
+		return fmt.Errorf("n greater than 1 is not supported by the %s provider", provider)
+	case len(request.LogitBias) > 0:
+		return fmt.Errorf("logit_bias is not supported by the %s provider", provider)
+	case request.Seed != nil:
+		return fmt.Errorf("seed is not supported by the %s provider", provider)
+	}
+	for _, message := range request.Messages {
+		if message.imageCount() > 0 {
+			return fmt.Errorf("images are not supported by the %s provider", provider)
+		}
+	}
+	return nil
+}
+
+// newOpenAIClientConfig returns the OpenAI client configuration for OPENAI_PROVIDER, sending requests through
+// httpClient. Azure requests for OPENAI_MODEL go to AZURE_OPENAI_DEPLOYMENT, other models such as the fallback
+// or the summary model go to the deployment named like the model.
+func newOpenAIClientConfig(cfg *Config, httpClient openai.HTTPDoer) openai.ClientConfig {
+	var clientConfig openai.ClientConfig
+	if cfg.OpenAIProvider == providerAzure {
+		clientConfig = openai.DefaultAzureConfig(cfg.OpenAIKey, cfg.AzureEndpoint)
+		if cfg.AzureAPIVersion != "" {
+			clientConfig.APIVersion = cfg.AzureAPIVersion
+		}
+		clientConfig.AzureModelMapperFunc = func(model string) string {
+			if model == cfg.OpenAIModel {
+				return cfg.AzureDeployment
+			}
+			return azureDeploymentName.Replace(model)
+		}
+	} else {
+		clientConfig = openai.DefaultConfig(cfg.OpenAIKey)
+		if cfg.OpenAIBaseURL != "" {
+			clientConfig.BaseURL = cfg.OpenAIBaseURL
+		}
+		clientConfig.OrgID = cfg.OpenAIOrgID
+	}
+
+	headers := make(map[string]string)
+	maps.Copy(headers, cfg.OpenAIExtraHeaders)
+	if cfg.OpenAIProjectID != "" {
+		headers[openAIProjectHeader] = cfg.OpenAIProjectID
+	}
+	clientConfig.HTTPClient = httpClient
+	if len(headers) > 0 {
+		clientConfig.HTTPClient = headerDoer{doer: httpClient, headers: headers}
+	}
+	return clientConfig
+}
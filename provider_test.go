@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParseExtraHeaders(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: `{"X-Team":"search","HTTP-Referer":"https://example.com"}`, want: map[string]string{"X-Team": "search", "HTTP-Referer": "https://example.com"}},
+		{value: `{"X-Retries":3}`, wantErr: true},
+		{value: `X-Team: search`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseExtraHeaders(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExtraHeaders(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExtraHeaders(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewOpenAIClientConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		baseURL     bool
+		orgID       string
+		projectID   string
+		extra       map[string]string
+		wantHeaders map[string]string
+	}{
+		{name: "defaults"},
+		{name: "base URL", baseURL: true},
+		{name: "organization", orgID: "org-test", wantHeaders: map[string]string{"OpenAI-Organization": "org-test"}},
+		{name: "project", projectID: "proj-test", wantHeaders: map[string]string{"OpenAI-Project": "proj-test"}},
+		{name: "extra headers", extra: map[string]string{"X-Team": "search"}, wantHeaders: map[string]string{"X-Team": "search"}},
+		{
+			name:        "everything",
+			baseURL:     true,
+			orgID:       "org-test",
+			projectID:   "proj-test",
+			extra:       map[string]string{"X-Team": "search", "OpenAI-Project": "proj-other"},
+			wantHeaders: map[string]string{"OpenAI-Organization": "org-test", "OpenAI-Project": "proj-test", "X-Team": "search"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"object":"list","data":[]}`))
+			}))
+			defer server.Close()
+
+			cfg := &Config{OpenAIKey: "sk-test", OpenAIProvider: providerOpenAI, OpenAIOrgID: tt.orgID, OpenAIProjectID: tt.projectID, OpenAIExtraHeaders: tt.extra}
+			wantBaseURL := openai.DefaultConfig("").BaseURL
+			if tt.baseURL {
+				cfg.OpenAIBaseURL = server.URL + "/gateway/v1"
+				wantBaseURL = cfg.OpenAIBaseURL
+			}
+			clientConfig := newOpenAIClientConfig(cfg, server.Client())
+			if clientConfig.BaseURL != wantBaseURL || clientConfig.OrgID != tt.orgID || clientConfig.APIType != openai.APITypeOpenAI {
+				t.Fatalf("client config = %s %q %s, want %s %q %s", clientConfig.BaseURL, clientConfig.OrgID, clientConfig.APIType, wantBaseURL, tt.orgID, openai.APITypeOpenAI)
+			}
+			if tt.extra["OpenAI-Project"] == tt.projectID && tt.projectID != "" {
+				t.Error("newOpenAIClientConfig() changed OPENAI_EXTRA_HEADERS")
+			}
+
+			// Every request goes to the test server, whatever the base URL
+			clientConfig.BaseURL = server.URL + "/gateway/v1"
+			if _, err := openai.NewClientWithConfig(clientConfig).ListModels(context.Background()); err != nil {
+				t.Fatalf("ListModels() error = %v", err)
+			}
+			if got.URL.Path != "/gateway/v1/models" || got.Header.Get("Authorization") != "Bearer sk-test" {
+				t.Errorf("request = %s with Authorization %q", got.URL.Path, got.Header.Get("Authorization"))
+			}
+			for _, name := range []string{"OpenAI-Organization", "OpenAI-Project", "X-Team"} {
+				if value := got.Header.Get(name); value != tt.wantHeaders[name] {
+					t.Errorf("%s header = %q, want %q", name, value, tt.wantHeaders[name])
+				}
+			}
+		})
+	}
+}
+
+func TestNewAzureClientConfig(t *testing.T) {
+	cfg := &Config{
+		OpenAIKey:       "azure-key",
+		OpenAIModel:     "gpt-4o",
+		OpenAIProvider:  providerAzure,
+		AzureEndpoint:   "https://test.openai.azure.com/",
+		AzureDeployment: "prod-gpt4o",
+		AzureAPIVersion: "2024-06-01",
+		OpenAIBaseURL:   "https://gateway.example.com/v1",
+		OpenAIProjectID: "proj-test",
+	}
+	clientConfig := newOpenAIClientConfig(cfg, http.DefaultClient)
+	if clientConfig.APIType != openai.APITypeAzure || clientConfig.BaseURL != "https://test.openai.azure.com/" || clientConfig.APIVersion != "2024-06-01" {
+		t.Errorf("client config = %s %s %s, want the Azure endpoint and version", clientConfig.APIType, clientConfig.BaseURL, clientConfig.APIVersion)
+	}
+	deployments := map[string]string{"gpt-4o": "prod-gpt4o", "gpt-3.5-turbo": "gpt-35-turbo", "gpt-4o-mini": "gpt-4o-mini"}
+	for model, want := range deployments {
+		if got := clientConfig.AzureModelMapperFunc(model); got != want {
+			t.Errorf("deployment of %s = %q, want %q", model, got, want)
+		}
+	}
+	if doer, ok := clientConfig.HTTPClient.(headerDoer); !ok || doer.headers[openAIProjectHeader] != "proj-test" {
+		t.Errorf("HTTPClient = %T, want one adding the project header", clientConfig.HTTPClient)
+	}
+}
+
+// TestAzureRequests sends full and stream requests through the Azure client to a fake Azure OpenAI resource
+func TestAzureRequests(t *testing.T) {
+	tests := []struct {
+		responseType string
+		wantFrames   []string
+	}{
+		{responseType: responseTypeFull, wantFrames: []string{"Hello"}},
+		{responseType: responseTypeStream, wantFrames: []string{"Hel", "lo", "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			var got *http.Request
+			var body map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				json.NewDecoder(r.Body).Decode(&body)
+				if body["stream"] == true {
+					w.Header().Set("Content-Type", "text/event-stream")
+					for _, text := range []string{"Hel", "lo"} {
+						fmt.Fprintf(w, "data: {\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{\"content\":%q}}]}\n\n", text)
+					}
+					fmt.Fprint(w, "data: {\"object\":\"chat.completion.chunk\",\"choices\":[{\"index\":0,\"delta\":{},\"finish_reason\":\"stop\"}]}\n\ndata: [DONE]\n\n")
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`)
+			}))
+			defer server.Close()
+
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIKey = "azure-key"
+				cfg.OpenAIModel = "gpt-4o"
+				cfg.OpenAIProvider = providerAzure
+				cfg.AzureEndpoint = server.URL + "/"
+				cfg.AzureDeployment = "prod-gpt4o"
+				cfg.AzureAPIVersion = "2024-06-01"
+				cfg.ModelValidation = true
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval = 0
+			})
+			chat := openAIChatCompleter{Client: openai.NewClientWithConfig(newOpenAIClientConfig(cfg, server.Client()))}
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, nil, nil)
+			response, err := h.Handler(context.Background(), testMessage(`{"response_type":"`+tt.responseType+`","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+			}
+			if !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+			// The model listing of Azure isn't used, the one request goes to the deployment
+			if got.URL.Path != "/openai/deployments/prod-gpt4o/chat/completions" || got.URL.Query().Get("api-version") != "2024-06-01" {
+				t.Errorf("request = %s, want the chat completions of the deployment", got.URL)
+			}
+			if got.Header.Get("api-key") != "azure-key" || got.Header.Get("Authorization") != "" {
+				t.Errorf("api-key = %q, Authorization = %q, want the key in api-key", got.Header.Get("api-key"), got.Header.Get("Authorization"))
+			}
+			if body["model"] != "gpt-4o" {
+				t.Errorf("model = %v, want OPENAI_MODEL unvalidated", body["model"])
+			}
+		})
+	}
+}
+
+func TestAzureSkipsModelValidation(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.OpenAIModel = "gpt-4o"
+		cfg.OpenAIProvider = providerAzure
+		cfg.ModelValidation = true
+	})
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+	chat.Models = []string{defaultModel}
+	response, _ := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`)
+	if response.StatusCode != statusCodeOK {
+		t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+	}
+	if chat.ListModelsCalls() != 0 || chat.Requests()[0].Model != "gpt-4o" {
+		t.Errorf("ListModels calls = %d, model = %q, want no validation of gpt-4o", chat.ListModelsCalls(), chat.Requests()[0].Model)
+	}
+}
+
+func TestLoadConfigAzure(t *testing.T) {
+	azure := map[string]string{"OPENAI_PROVIDER": "azure", "AZURE_OPENAI_ENDPOINT": "https://test.openai.azure.com/", "AZURE_OPENAI_DEPLOYMENT": "prod-gpt4o"}
+	with := func(name string, value string) map[string]string {
+		env := make(map[string]string)
+		for k, v := range azure {
+			env[k] = v
+		}
+		env[name] = value
+		return env
+	}
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantProvider string
+		wantErr      string
+	}{
+		{name: "default", env: map[string]string{}, wantProvider: providerOpenAI},
+		{name: "azure", env: azure, wantProvider: providerAzure},
+		{name: "no endpoint", env: with("AZURE_OPENAI_ENDPOINT", ""), wantErr: "AZURE_OPENAI_ENDPOINT"},
+		{name: "no deployment", env: with("AZURE_OPENAI_DEPLOYMENT", ""), wantErr: "AZURE_OPENAI_DEPLOYMENT"},
+		{name: "moderation", env: with("MODERATION", "true"), wantErr: "MODERATION is not supported"},
+		{name: "unknown provider", env: map[string]string{"OPENAI_PROVIDER": "azur"}, wantErr: "OPENAI_PROVIDER: azur"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"OPENAI_PROVIDER", "AZURE_OPENAI_ENDPOINT", "AZURE_OPENAI_DEPLOYMENT", "MODERATION"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadConfig() error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || cfg.OpenAIProvider != tt.wantProvider {
+				t.Errorf("loadConfig() = %q, %v, want %q", cfg.OpenAIProvider, err, tt.wantProvider)
+			}
+		})
+	}
+}
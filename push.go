@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	actionPush                 = "push"
+	errorCodeUnknownConnection = "unknown_connection"
+)
+
+// pushEvent is the payload of a direct invocation by another AWS service, such as a Step Functions task,
+// pushing data to an open connection and optionally running a request addressed to it
+type pushEvent struct {
+	Action       string          `json:"action"`
+	ConnectionID string          `json:"connection_id"`
+	Data         string          `json:"data,omitempty"`
+	AlsoOpenAI   bool            `json:"also_openai,omitempty"`
+	Request      json.RawMessage `json:"request,omitempty"` // Request run when also_openai is set
+}
+
+// pushError describes why a push failed
+type pushError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// pushResponse is the invocation response to a push. Failures carry the status code of the equivalent
+// websocket response and an error, instead of failing the invocation.
+type pushResponse struct {
+	StatusCode int        `json:"status_code"`
+	Error      *pushError `json:"error,omitempty"`
+}
+
+// newPushError returns the response of a failed push
+func newPushError(statusCode int, code string, message string) pushResponse {
+	return pushResponse{StatusCode: statusCode, Error: &pushError{Code: code, Message: message}}
+}
+
+// isPushEvent checks if a Lambda invocation payload is a push. API Gateway events always carry a request
+// context, so a websocket message with the push action is never taken for one.
+func isPushEvent(payload json.RawMessage) bool {
+	var event struct {
+		Action         string          `json:"action"`
+		RequestContext json.RawMessage `json:"requestContext"`
+	}
+	return json.Unmarshal(payload, &event) == nil && event.Action == actionPush && len(event.RequestContext) == 0
+}
+
+// handlePush posts the data of a push to its connection, then runs the embedded request for also_openai.
+// The connection must be recorded in CONNECTIONS_TABLE when the table is configured, and be open either way.
+// The request is accounted to the user or principal stored with the connection, as if the client had sent it.
+func (h *WebsocketHandler) handlePush(ctx context.Context, cfg *Config, event pushEvent) pushResponse {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("connection_id", event.ConnectionID, "action", actionPush, "model", cfg.OpenAIModel))
+	if event.ConnectionID == "" {
+		return newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "connection_id is required")
+	}
+	if event.Data == "" && !event.AlsoOpenAI {
+		return newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "data or also_openai is required")
+	}
+	var request Request
+	if event.AlsoOpenAI {
+		if len(event.Request) == 0 {
+			return newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "also_openai requires a request")
+		}
+		var err error
+		request, err = parseRequestBody(string(event.Request))
+		if err != nil {
+			return newPushError(statusCodeBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Error parsing request JSON: %s", err))
+		}
+	}
+
+	if cfg.ConnectionsTable != "" {
+		output, err := h.getDynamoDBClient(cfg).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(cfg.ConnectionsTable),
+			Key:            connectionKey(event.ConnectionID),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			loggerFrom(ctx).Error("Can't look up connection record", "error", err)
+			return newPushError(statusCodeServerError, errorCodeInternal, fmt.Sprintf("Can't look up connection record: %s", err))
+		}
+		if len(output.Item) == 0 {
+			loggerFrom(ctx).Warn("Push to unknown connection")
+			return newPushError(statusCodeNotFound, errorCodeUnknownConnection, fmt.Sprintf("Unknown connection: %s", event.ConnectionID))
+		}
+		ctx = withConnectionRecord(ctx, output.Item)
+	}
+
+	if event.Data != "" {
+		target := openAIRequest{ctx: ctx, config: cfg, poster: h.getConnectionPoster(ctx, cfg), ConnectionId: event.ConnectionID}
+		err := postToConnection(target, []byte(event.Data))
+		if errors.Is(err, ErrClientGone) {
+			loggerFrom(ctx).Warn("Push to closed connection")
+			return newPushError(statusCodeNotFound, errorCodeUnknownConnection, fmt.Sprintf("Unknown connection: %s", event.ConnectionID))
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Can't post push data", "error", err)
+			return newPushError(statusCodeServerError, errorCodeInternal, fmt.Sprintf("Can't post push data: %s", err))
+		}
+		loggerFrom(ctx).Info("Push data posted", "bytes", len(event.Data))
+	}
+
+	if event.AlsoOpenAI {
+		response, _ := h.serveRequest(ctx, cfg, request, event.ConnectionID, h.getConnectionPoster(ctx, cfg))
+		if response.StatusCode != statusCodeOK {
+			return newPushError(response.StatusCode, httpErrorCode(response.StatusCode), response.Body)
+		}
+	}
+	return pushResponse{StatusCode: statusCodeOK}
+}
+
+// withConnectionRecord returns a copy of ctx carrying the principal, the user identity, the tenant and the
+// management API endpoint stored in a connection record
+func withConnectionRecord(ctx context.Context, item map[string]*dynamodb.AttributeValue) context.Context {
+	if principal, ok := item["principal"]; ok && aws.StringValue(principal.S) != "" {
+		ctx = withPrincipal(ctx, aws.StringValue(principal.S))
+	}
+	if sub, ok := item["user_sub"]; ok && aws.StringValue(sub.S) != "" {
+		identity := &userIdentity{Sub: aws.StringValue(sub.S)}
+		if email, ok := item["user_email"]; ok {
+			identity.Email = aws.StringValue(email.S)
+		}
+		ctx = withIdentity(ctx, identity)
+	}
+	if tenant, ok := item["tenant"]; ok && aws.StringValue(tenant.S) != "" {
+		ctx = withTenant(ctx, aws.StringValue(tenant.S))
+	}
+	if endpoint, ok := item["endpoint"]; ok && aws.StringValue(endpoint.S) != "" {
+		ctx = withAPIGatewayEndpoint(ctx, aws.StringValue(endpoint.S))
+	}
+	return ctx
+}
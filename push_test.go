@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestIsPushEvent(t *testing.T) {
+	tests := map[string]bool{
+		`{"action":"push","connection_id":"conn-2","data":"hello"}`: true,
+		// A websocket message with the push action is still a websocket message
+		`{"action":"push","requestContext":{"routeKey":"$default","connectionId":"conn-1"},"body":"{}"}`: false,
+		`{"action":"warmup"}`: false,
+		`{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`: false,
+		`not json`:          false,
+		`{"action":"Push"}`: false,
+	}
+	for payload, want := range tests {
+		if got := isPushEvent(json.RawMessage(payload)); got != want {
+			t.Errorf("isPushEvent(%s) = %v, want %v", payload, got, want)
+		}
+	}
+}
+
+func TestInvokePush(t *testing.T) {
+	const answer = `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	tests := []struct {
+		name       string
+		event      string
+		noTable    bool
+		lookupErr  error
+		postErr    error
+		turn       testsupport.Turn
+		want       pushResponse
+		wantPosts  []string
+		wantLookup bool
+	}{
+		{
+			name:       "data",
+			event:      `{"action":"push","connection_id":"conn-2","data":"workflow done"}`,
+			want:       pushResponse{StatusCode: statusCodeOK},
+			wantPosts:  []string{"conn-2 workflow done"},
+			wantLookup: true,
+		},
+		{
+			name:       "unknown connection",
+			event:      `{"action":"push","connection_id":"conn-9","data":"workflow done"}`,
+			want:       newPushError(statusCodeNotFound, errorCodeUnknownConnection, "Unknown connection: conn-9"),
+			wantLookup: true,
+		},
+		{
+			// A recorded connection that closed without $disconnect is unknown too
+			name:       "closed connection",
+			event:      `{"action":"push","connection_id":"conn-2","data":"workflow done"}`,
+			postErr:    testsupport.ErrGone,
+			want:       newPushError(statusCodeNotFound, errorCodeUnknownConnection, "Unknown connection: conn-2"),
+			wantLookup: true,
+		},
+		{
+			name:       "post failure",
+			event:      `{"action":"push","connection_id":"conn-2","data":"workflow done"}`,
+			postErr:    &testsupport.StatusError{Code: http.StatusInternalServerError},
+			want:       newPushError(statusCodeServerError, errorCodeInternal, "Can't post push data: post failed with HTTP status 500 Internal Server Error"),
+			wantLookup: true,
+		},
+		{
+			name:       "lookup failure",
+			event:      `{"action":"push","connection_id":"conn-2","data":"workflow done"}`,
+			lookupErr:  errors.New("throttled"),
+			want:       newPushError(statusCodeServerError, errorCodeInternal, "Can't look up connection record: throttled"),
+			wantLookup: true,
+		},
+		{
+			// Without a connections table the connection only has to be open
+			name:      "no connections table",
+			event:     `{"action":"push","connection_id":"conn-9","data":"workflow done"}`,
+			noTable:   true,
+			want:      pushResponse{StatusCode: statusCodeOK},
+			wantPosts: []string{"conn-9 workflow done"},
+		},
+		{
+			name:       "data and OpenAI",
+			event:      `{"action":"push","connection_id":"conn-2","data":"workflow done","also_openai":true,"request":` + answer + `}`,
+			want:       pushResponse{StatusCode: statusCodeOK},
+			wantPosts:  []string{"conn-2 workflow done", "conn-2 Hello"},
+			wantLookup: true,
+		},
+		{
+			name:       "OpenAI only",
+			event:      `{"action":"push","connection_id":"conn-2","also_openai":true,"request":` + answer + `}`,
+			want:       pushResponse{StatusCode: statusCodeOK},
+			wantPosts:  []string{"conn-2 Hello"},
+			wantLookup: true,
+		},
+		{
+			name:       "OpenAI failure",
+			event:      `{"action":"push","connection_id":"conn-2","also_openai":true,"request":` + answer + `}`,
+			turn:       testsupport.Fail(&openai.APIError{HTTPStatusCode: 500, Message: "boom"}),
+			want:       newPushError(statusCodeServerError, errorCodeInternal, "Error handling request: Error sending OpenAI API request: error, status code: 500, status: , message: boom"),
+			wantPosts:  []string{`conn-2 {"type":"error","code":"openai_error","message":"Error sending OpenAI API request: error, status code: 500, status: , message: boom"}`},
+			wantLookup: true,
+		},
+		{name: "no connection", event: `{"action":"push","data":"workflow done"}`, want: newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "connection_id is required")},
+		{name: "nothing to push", event: `{"action":"push","connection_id":"conn-2"}`, want: newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "data or also_openai is required")},
+		{name: "no request", event: `{"action":"push","connection_id":"conn-2","also_openai":true}`, want: newPushError(statusCodeBadRequest, errorCodeInvalidRequest, "also_openai requires a request")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.ConnectionsTable = "connections"
+				if tt.noTable {
+					cfg.ConnectionsTable = ""
+				}
+				cfg.OpenAIMaxRetries = 0
+			})
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			db.put("connections", connectionKey("conn-2"))
+			if tt.lookupErr != nil {
+				db.fail("GetItem", tt.lookupErr)
+			}
+			poster := testsupport.NewRecordingPoster()
+			if tt.postErr != nil {
+				poster.FailAt(0, tt.postErr)
+			}
+			turn := tt.turn
+			if turn.Err == nil {
+				turn = testsupport.Reply("Hello")
+			}
+			got, err := newTestHandler(cfg, testsupport.NewScriptedCompleter(turn), poster, db, nil).Invoke(context.Background(), json.RawMessage(tt.event))
+			if err != nil {
+				t.Fatalf("Invoke() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Invoke() = %+v, want %+v", got, tt.want)
+			}
+			if posts := postedTo(poster); !reflect.DeepEqual(posts, tt.wantPosts) {
+				t.Errorf("frames = %q, want %q", posts, tt.wantPosts)
+			}
+			if looked := db.count("GetItem") > 0; looked != tt.wantLookup {
+				t.Errorf("connection looked up = %v, want %v", looked, tt.wantLookup)
+			}
+		})
+	}
+}
+
+// TestPushEventResponse pins the invocation response the calling workflow reads
+func TestPushEventResponse(t *testing.T) {
+	tests := []struct {
+		response pushResponse
+		want     string
+	}{
+		{response: pushResponse{StatusCode: statusCodeOK}, want: `{"status_code":200}`},
+		{
+			response: newPushError(statusCodeNotFound, errorCodeUnknownConnection, "Unknown connection: conn-9"),
+			want:     `{"status_code":404,"error":{"code":"unknown_connection","message":"Unknown connection: conn-9"}}`,
+		},
+	}
+	for _, tt := range tests {
+		data, err := json.Marshal(tt.response)
+		if err != nil || string(data) != tt.want {
+			t.Errorf("json.Marshal(%+v) = %s, %v, want %s", tt.response, data, err, tt.want)
+		}
+	}
+}
+
+func TestWithConnectionRecord(t *testing.T) {
+	item := connectionKey("conn-2")
+	item["principal"] = &dynamodb.AttributeValue{S: aws.String("service-a")}
+	item["user_sub"] = &dynamodb.AttributeValue{S: aws.String("user-1")}
+	item["user_email"] = &dynamodb.AttributeValue{S: aws.String("user@example.com")}
+	item["tenant"] = &dynamodb.AttributeValue{S: aws.String("acme")}
+	item["endpoint"] = &dynamodb.AttributeValue{S: aws.String("https://abc.execute-api.eu-west-1.amazonaws.com/prod")}
+	ctx := withConnectionRecord(context.Background(), item)
+	if got := principalFrom(ctx); got != "service-a" {
+		t.Errorf("principal = %q, want service-a", got)
+	}
+	if got := identityFrom(ctx); got == nil || *got != (userIdentity{Sub: "user-1", Email: "user@example.com"}) {
+		t.Errorf("identity = %+v, want user-1", got)
+	}
+	if got := tenantFrom(ctx); got != "acme" {
+		t.Errorf("tenant = %q, want acme", got)
+	}
+	if got := apiGatewayEndpointFrom(ctx); got != "https://abc.execute-api.eu-west-1.amazonaws.com/prod" {
+		t.Errorf("endpoint = %q", got)
+	}
+
+	// A bare record leaves the context as it is
+	ctx = withConnectionRecord(context.Background(), connectionKey("conn-2"))
+	if principalFrom(ctx) != "" || identityFrom(ctx) != nil || tenantFrom(ctx) != "" || apiGatewayEndpointFrom(ctx) != "" {
+		t.Error("a record without identity changed the context")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	actionUsage            = "usage"
+	frameTypeUsageReport   = "usage_report"
+	errorCodeQuotaExceeded = "quota_exceeded"
+	usageDayLayout         = "2006-01-02"
+	// usageRecordTTL is how long a daily usage record is kept past its day before DynamoDB expires it
+	usageRecordTTL = 48 * time.Hour
+)
+
+// usageReportFrame answers a usage action with the consumption of the current UTC day
+type usageReportFrame struct {
+	Type       string `json:"type"`
+	Date       string `json:"date"`
+	UsedTokens int64  `json:"used_tokens"`
+	Quota      int64  `json:"quota,omitempty"`     // Omitted when the quota is unlimited
+	Remaining  *int64 `json:"remaining,omitempty"` // Omitted when the quota is unlimited
+}
+
+// usageDay returns the UTC day usage at now is counted on
+func usageDay(now time.Time) string {
+	return now.UTC().Format(usageDayLayout)
+}
+
+// usageKey returns the DynamoDB key of the daily usage of subject
+func usageKey(subject string, day string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"usage_key": {S: aws.String(subject + "#" + day)},
+	}
+}
+
+// getDailyUsage returns the tokens subject used on day
+func getDailyUsage(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, subject string, day string) (int64, error) {
+	output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(cfg.UsageTable),
+		Key:       usageKey(subject, day),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Can't read daily usage: %v", err)
+	}
+	tokens, ok := output.Item["tokens"]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(aws.StringValue(tokens.N), 10, 64)
+}
+
+// recordTokenUsage adds the tokens of a completion to the daily usage of the request subject. Requests still
+// in flight when the quota is reached are counted too, so the quota can be overshot slightly.
+// A failure is only logged, since the answer has already been produced.
+func recordTokenUsage(openAIRequest openAIRequest, info completionInfo) {
+	cfg := openAIRequest.config
+	tokens := info.Usage.PromptTokens + info.Usage.CompletionTokens
+	if cfg.UsageTable == "" || tokens == 0 {
+		return
+	}
+	now := openAIRequest.getClock().Now()
+	dayEnd := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	_, err := openAIRequest.dynamoDBClient.UpdateItemWithContext(openAIRequest.ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(cfg.UsageTable),
+		Key:              usageKey(requestSubject(openAIRequest), usageDay(now)),
+		UpdateExpression: aws.String("ADD tokens :tokens SET expires_at = :expires"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":tokens":  {N: aws.String(strconv.Itoa(tokens))},
+			":expires": {N: aws.String(strconv.FormatInt(dayEnd.Add(usageRecordTTL).Unix(), 10))},
+		},
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't record token usage", "tokens", tokens, "error", err)
+	}
+}
+
+// checkDailyQuota returns the fraction of DAILY_TOKEN_QUOTA the request subject used today, and whether the
+// quota is used up. A lookup failure is logged and lets the request through, without economy mode.
+func checkDailyQuota(openAIRequest openAIRequest) (float64, bool) {
+	cfg := openAIRequest.config
+	used, err := getDailyUsage(openAIRequest.ctx, openAIRequest.dynamoDBClient, cfg, requestSubject(openAIRequest), usageDay(openAIRequest.getClock().Now()))
+	if err != nil {
+		openAIRequest.logger().Error("Can't check daily token quota", "error", err)
+		return 0, false
+	}
+	return float64(used) / float64(cfg.DailyTokenQuota), used >= int64(cfg.DailyTokenQuota)
+}
+
+// handleUsage answers a usage action with the consumption and the remaining quota of the caller, without calling OpenAI
+func (h *WebsocketHandler) handleUsage(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if cfg.UsageTable == "" {
+		return errorResponse("Usage tracking is not enabled", statusCodeBadRequest)
+	}
+	target := openAIRequest{
+		ctx:          ctx,
+		config:       cfg,
+		poster:       h.getConnectionPoster(ctx, cfg),
+		ConnectionId: request.RequestContext.ConnectionID,
+		identity:     identityFrom(ctx),
+		clock:        h.getClock(),
+	}
+
+	day := usageDay(target.getClock().Now())
+	used, err := getDailyUsage(ctx, h.getDynamoDBClient(cfg), cfg, requestSubject(target), day)
+	if err != nil {
+		loggerFrom(ctx).Error("Can't read daily usage", "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+
+	frame := usageReportFrame{Type: frameTypeUsageReport, Date: day, UsedTokens: used}
+	if cfg.DailyTokenQuota > 0 {
+		frame.Quota = int64(cfg.DailyTokenQuota)
+		remaining := max(frame.Quota-used, 0)
+		frame.Remaining = &remaining
+	}
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode usage report: %s", err), statusCodeServerError)
+	}
+	if err := postToConnection(target, payload); err != nil {
+		loggerFrom(ctx).Warn("Can't post usage report", "error", err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
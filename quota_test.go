@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// usageTable returns a fake usage table where the test connection used tokens today, or nothing when tokens is empty
+func usageTable(tokens string) *fakeDynamoDB {
+	db := newFakeDynamoDB().table("usage", "usage_key")
+	if tokens != "" {
+		item := usageKey("connection#conn-1", usageDay(testStart))
+		item["tokens"] = &dynamodb.AttributeValue{N: aws.String(tokens)}
+		db.put("usage", item)
+	}
+	return db
+}
+
+// usedTokens returns the tokens the test connection used today according to db
+func usedTokens(t *testing.T, db *fakeDynamoDB) int64 {
+	t.Helper()
+	used, err := getDailyUsage(context.Background(), db, &Config{UsageTable: "usage"}, "connection#conn-1", usageDay(testStart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func TestUsageDay(t *testing.T) {
+	// Past 22:00 UTC the day has already changed in UTC+2
+	local := time.Date(2024, 3, 9, 23, 30, 0, 0, time.FixedZone("UTC+2", 2*60*60))
+	if got := usageDay(local); got != "2024-03-09" {
+		t.Errorf("usageDay(%v) = %s, want 2024-03-09", local, got)
+	}
+	if got := usageDay(time.Date(2024, 3, 9, 23, 59, 59, 0, time.UTC)); got != "2024-03-09" {
+		t.Errorf("usageDay() = %s, want 2024-03-09", got)
+	}
+}
+
+// TestRecordTokenUsage checks that the prompt and completion tokens of full answers and streams are added to the
+// daily usage, and that streams request the usage chunk without include_usage
+func TestRecordTokenUsage(t *testing.T) {
+	tests := []struct {
+		name         string
+		responseType string
+		used         string
+		turn         testsupport.Turn
+		wantUsed     int64
+	}{
+		{name: "full", responseType: responseTypeFull, turn: usageTurn(), wantUsed: 12},
+		{name: "full adds to the day", responseType: responseTypeFull, used: "100", turn: usageTurn(), wantUsed: 112},
+		{name: "stream", responseType: responseTypeStream, turn: usageTurn(), wantUsed: 12},
+		{name: "no usage", responseType: responseTypeFull, turn: testsupport.Reply("Hi"), wantUsed: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.UsageTable = "usage"
+				cfg.StreamFlushInterval = 0
+			})
+			db := usageTable(tt.used)
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			poster := testsupport.NewRecordingPoster()
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart)).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+			}
+			if got := usedTokens(t, db); got != tt.wantUsed {
+				t.Errorf("used tokens = %d, want %d", got, tt.wantUsed)
+			}
+			if tt.responseType == responseTypeStream {
+				if options := chat.Requests()[0].StreamOptions; options == nil || !options.IncludeUsage {
+					t.Errorf("stream options = %+v, want include_usage with usage tracking on", options)
+				}
+			}
+			// The usage frame is still only posted to clients that ask for it
+			for _, text := range poster.Texts() {
+				if strings.Contains(text, `"type":"usage"`) {
+					t.Errorf("usage frame %s posted without include_usage", text)
+				}
+			}
+			if tt.wantUsed == 0 {
+				return
+			}
+			record := db.item("usage", usageKey("connection#conn-1", usageDay(testStart)))
+			// The record expires usageRecordTTL after the end of the day
+			dayEnd := time.Date(testStart.Year(), testStart.Month(), testStart.Day()+1, 0, 0, 0, 0, time.UTC)
+			if wantExpiry := strconv.FormatInt(dayEnd.Add(usageRecordTTL).Unix(), 10); aws.StringValue(record["expires_at"].N) != wantExpiry {
+				t.Errorf("expires_at = %s, want %s", aws.StringValue(record["expires_at"].N), wantExpiry)
+			}
+		})
+	}
+}
+
+func TestDailyQuota(t *testing.T) {
+	const exceeded = `{"type":"error","code":"quota_exceeded","message":"Daily token quota of 1000 exceeded"}`
+	tests := []struct {
+		name       string
+		quota      int
+		used       string
+		failing    bool
+		wantStatus int
+		wantFrames []string
+	}{
+		{name: "no usage yet", quota: 1000, wantStatus: statusCodeOK, wantFrames: []string{"Hi"}},
+		{name: "under the quota", quota: 1000, used: "999", wantStatus: statusCodeOK, wantFrames: []string{"Hi"}},
+		{name: "quota reached", quota: 1000, used: "1000", wantStatus: statusCodeTooMany, wantFrames: []string{exceeded}},
+		{name: "quota overshot", quota: 1000, used: "1012", wantStatus: statusCodeTooMany, wantFrames: []string{exceeded}},
+		{name: "unlimited", used: "1000000", wantStatus: statusCodeOK, wantFrames: []string{"Hi"}},
+		// A failed lookup lets the request through
+		{name: "lookup failure", quota: 1000, used: "1000", failing: true, wantStatus: statusCodeOK, wantFrames: []string{"Hi"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.UsageTable = "usage"
+				cfg.DailyTokenQuota = tt.quota
+			})
+			db := usageTable(tt.used)
+			if tt.failing {
+				db.fail("GetItem", errors.New("ProvisionedThroughputExceededException"))
+			}
+			chat := testsupport.NewScriptedCompleter(usageTurn())
+			poster := testsupport.NewRecordingPoster()
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, poster, db, testsupport.NewClock(testStart)).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			if tt.wantStatus != statusCodeOK && len(chat.Requests()) != 0 {
+				t.Error("the request over the quota reached OpenAI")
+			}
+		})
+	}
+}
+
+func TestHandleUsage(t *testing.T) {
+	remaining := func(n int64) *int64 { return &n }
+	tests := []struct {
+		name       string
+		table      string
+		quota      int
+		used       string
+		wantStatus int
+		want       *usageReportFrame
+	}{
+		{name: "no usage yet", table: "usage", quota: 1000, wantStatus: statusCodeOK, want: &usageReportFrame{UsedTokens: 0, Quota: 1000, Remaining: remaining(1000)}},
+		{name: "under the quota", table: "usage", quota: 1000, used: "400", wantStatus: statusCodeOK, want: &usageReportFrame{UsedTokens: 400, Quota: 1000, Remaining: remaining(600)}},
+		{name: "quota overshot", table: "usage", quota: 1000, used: "1012", wantStatus: statusCodeOK, want: &usageReportFrame{UsedTokens: 1012, Quota: 1000, Remaining: remaining(0)}},
+		{name: "unlimited", table: "usage", used: "400", wantStatus: statusCodeOK, want: &usageReportFrame{UsedTokens: 400}},
+		{name: "tracking disabled", wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.UsageTable = tt.table
+				cfg.DailyTokenQuota = tt.quota
+			})
+			chat := testsupport.NewScriptedCompleter()
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, usageTable(tt.used), testsupport.NewClock(testStart))
+			response, err := h.Handler(context.Background(), testMessage(`{"action":"usage"}`))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the usage action reached OpenAI")
+			}
+			texts := poster.Texts()
+			if tt.want == nil {
+				if len(texts) != 0 {
+					t.Errorf("frames = %q, want none", texts)
+				}
+				return
+			}
+			if len(texts) != 1 {
+				t.Fatalf("frames = %q, want a usage report", texts)
+			}
+			var got usageReportFrame
+			if err := json.Unmarshal([]byte(texts[0]), &got); err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Type, tt.want.Date = frameTypeUsageReport, usageDay(testStart)
+			if !reflect.DeepEqual(&got, tt.want) {
+				t.Errorf("usage report = %s, want %+v", texts[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigDailyTokenQuota(t *testing.T) {
+	t.Setenv("USAGE_TABLE", "usage")
+	t.Setenv("DAILY_TOKEN_QUOTA", "5000")
+	cfg, err := loadConfig()
+	if err != nil || cfg.UsageTable != "usage" || cfg.DailyTokenQuota != 5000 {
+		t.Fatalf("loadConfig() = %q, %d, %v, want usage and 5000", cfg.UsageTable, cfg.DailyTokenQuota, err)
+	}
+	t.Setenv("USAGE_TABLE", "")
+	if _, err := loadConfig(); err == nil {
+		t.Error("loadConfig() accepted DAILY_TOKEN_QUOTA without USAGE_TABLE")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	errorCodeRateLimited  = "rate_limited"
+	defaultRateLimitRPM   = 60
+	defaultRateLimitBurst = 10
+	rateLimitFailOpen     = "open"
+	rateLimitFailClosed   = "closed"
+	// rateLimitMaxAttempts bounds the optimistic updates of a bucket that concurrent requests keep changing
+	rateLimitMaxAttempts = 3
+	// rateLimitClosedRetryAfter is what a client rejected by a failed limiter in closed mode is told to wait
+	rateLimitClosedRetryAfter = time.Second
+	// rateLimitRecordTTL is how long a bucket is kept past its full refill before DynamoDB expires it
+	rateLimitRecordTTL = time.Hour
+)
+
+// rateLimitedFrame is posted to legacy clients when their bucket is empty
+type rateLimitedFrame struct {
+	Type         string `json:"type"`
+	Code         string `json:"code"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+// rateLimiter implements a token bucket per identity in RATE_LIMIT_TABLE. Buckets are updated with conditional
+// writes, so concurrent Lambdas never hand out the same token twice.
+type rateLimiter struct {
+	nowFunc func() time.Time
+}
+
+var requestRateLimiter = &rateLimiter{nowFunc: time.Now}
+
+// refillBucket returns the tokens of a bucket last updated at last, refilled at rpm tokens per minute up to burst
+func refillBucket(tokens float64, last time.Time, now time.Time, rpm int, burst int) float64 {
+	elapsed := now.Sub(last)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(burst), tokens+elapsed.Minutes()*float64(rpm))
+}
+
+// timeToNextToken returns how long a bucket holding tokens takes to refill to one token
+func timeToNextToken(tokens float64, rpm int) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) * float64(time.Minute) / float64(rpm)))
+}
+
+// take removes one token from the bucket of key. It returns false and the time until the next token when
+// the bucket is empty.
+func (l *rateLimiter) take(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, key string) (bool, time.Duration, error) {
+	for attempt := 0; attempt < rateLimitMaxAttempts; attempt++ {
+		output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(cfg.RateLimitTable),
+			Key:            map[string]*dynamodb.AttributeValue{"bucket_key": {S: aws.String(key)}},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return false, 0, fmt.Errorf("Can't read rate limit bucket: %v", err)
+		}
+
+		now := l.nowFunc()
+		tokens := float64(cfg.RateLimitBurst)
+		var lastUpdate string
+		if updatedAt, ok := output.Item["updated_at"]; ok {
+			lastUpdate = aws.StringValue(updatedAt.N)
+			lastMs, _ := strconv.ParseInt(lastUpdate, 10, 64)
+			stored, _ := strconv.ParseFloat(aws.StringValue(output.Item["tokens"].N), 64)
+			tokens = refillBucket(stored, time.UnixMilli(lastMs), now, cfg.RateLimitRPM, cfg.RateLimitBurst)
+		}
+		if tokens < 1 {
+			return false, timeToNextToken(tokens, cfg.RateLimitRPM), nil
+		}
+
+		fullRefill := time.Duration(float64(cfg.RateLimitBurst) * float64(time.Minute) / float64(cfg.RateLimitRPM))
+		input := &dynamodb.UpdateItemInput{
+			TableName:        aws.String(cfg.RateLimitTable),
+			Key:              map[string]*dynamodb.AttributeValue{"bucket_key": {S: aws.String(key)}},
+			UpdateExpression: aws.String("SET tokens = :tokens, updated_at = :now, expires_at = :expires"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":tokens":  {N: aws.String(strconv.FormatFloat(tokens-1, 'f', -1, 64))},
+				":now":     {N: aws.String(strconv.FormatInt(now.UnixMilli(), 10))},
+				":expires": {N: aws.String(strconv.FormatInt(now.Add(fullRefill+rateLimitRecordTTL).Unix(), 10))},
+			},
+			ConditionExpression: aws.String("attribute_not_exists(updated_at)"),
+		}
+		if lastUpdate != "" {
+			// Only write if nobody took a token since the bucket was read
+			input.ConditionExpression = aws.String("updated_at = :last")
+			input.ExpressionAttributeValues[":last"] = &dynamodb.AttributeValue{N: aws.String(lastUpdate)}
+		}
+		_, err = client.UpdateItemWithContext(ctx, input)
+		if isConditionalCheckFailed(err) {
+			continue
+		}
+		if err != nil {
+			return false, 0, fmt.Errorf("Can't update rate limit bucket: %v", err)
+		}
+		return true, 0, nil
+	}
+	return false, 0, fmt.Errorf("Rate limit bucket changed concurrently %d times", rateLimitMaxAttempts)
+}
+
+// isConditionalCheckFailed checks if a conditional DynamoDB write was rejected
+func isConditionalCheckFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// requestSubject returns who a request is accounted to, for rate limits and quotas: the authenticated user
+// when there is one, the connection otherwise
+func requestSubject(openAIRequest openAIRequest) string {
+	if openAIRequest.identity != nil {
+		return "user#" + openAIRequest.identity.Sub
+	}
+	// Every connection authorized with the shared secret has the same principal, so it doesn't identify anyone
+	if principal := principalFrom(openAIRequest.ctx); principal != "" && principal != sharedSecretPrincipal {
+		return "principal#" + principal
+	}
+	return "connection#" + openAIRequest.ConnectionId
+}
+
+// checkRateLimit takes a token for the request, returning the time to wait when the bucket is empty.
+// A limiter failure lets the request through or rejects it depending on RATE_LIMIT_FAIL_MODE.
+func checkRateLimit(openAIRequest openAIRequest) (bool, time.Duration) {
+	allowed, retryAfter, err := requestRateLimiter.take(openAIRequest.ctx, openAIRequest.dynamoDBClient, openAIRequest.config, requestSubject(openAIRequest))
+	if err == nil {
+		return allowed, retryAfter
+	}
+	openAIRequest.logger().Error("Rate limiter failed", "fail_mode", openAIRequest.config.RateLimitFailMode, "error", err)
+	if openAIRequest.config.RateLimitFailMode == rateLimitFailClosed {
+		return false, rateLimitClosedRetryAfter
+	}
+	return true, 0
+}
+
+// postRateLimited tells the client that its bucket is empty and when to try again
+func postRateLimited(openAIRequest openAIRequest, retryAfter time.Duration) error {
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeError, Code: errorCodeRateLimited, Data: map[string]int64{"retry_after_ms": retryAfter.Milliseconds()}})
+	}
+	payload, err := json.Marshal(rateLimitedFrame{Type: frameTypeError, Code: errorCodeRateLimited, RetryAfterMs: retryAfter.Milliseconds()})
+	if err != nil {
+		return fmt.Errorf("Can't encode rate limited frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestRefillBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{name: "no time passed", tokens: 0.5, want: 0.5},
+		{name: "one token", tokens: 0, elapsed: time.Second, want: 1},
+		{name: "partial token", tokens: 0.25, elapsed: 500 * time.Millisecond, want: 0.75},
+		{name: "capped at the burst", tokens: 1, elapsed: time.Hour, want: 5},
+		{name: "clock skew", tokens: 2, elapsed: -time.Minute, want: 2},
+	}
+	for _, tt := range tests {
+		if got := refillBucket(tt.tokens, testStart, testStart.Add(tt.elapsed), 60, 5); got != tt.want {
+			t.Errorf("refillBucket(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTimeToNextToken(t *testing.T) {
+	tests := []struct {
+		tokens float64
+		rpm    int
+		want   time.Duration
+	}{
+		{tokens: 0, rpm: 60, want: time.Second},
+		{tokens: 0.5, rpm: 60, want: 500 * time.Millisecond},
+		{tokens: 0, rpm: 1, want: time.Minute},
+		{tokens: 0.9, rpm: 6, want: time.Second},
+	}
+	for _, tt := range tests {
+		if got := timeToNextToken(tt.tokens, tt.rpm); got != tt.want {
+			t.Errorf("timeToNextToken(%v, %d) = %v, want %v", tt.tokens, tt.rpm, got, tt.want)
+		}
+	}
+}
+
+// testRateLimiter times the request rate limiter with the returned clock for the test
+func testRateLimiter(t *testing.T) *testsupport.Clock {
+	t.Helper()
+	clock := testsupport.NewClock(testStart)
+	original := requestRateLimiter.nowFunc
+	t.Cleanup(func() { requestRateLimiter.nowFunc = original })
+	requestRateLimiter.nowFunc = clock.Now
+	return clock
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	clock := testRateLimiter(t)
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.RateLimitTable = "rate_limits"
+		cfg.RateLimitRPM = 60
+		cfg.RateLimitBurst = 2
+	})
+	db := newFakeDynamoDB().table("rate_limits", "bucket_key")
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+	poster := testsupport.NewRecordingPoster()
+	h := newTestHandler(cfg, chat, poster, db, nil)
+	steps := []struct {
+		advance        time.Duration
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{wantStatus: statusCodeOK},
+		{wantStatus: statusCodeOK},
+		{wantStatus: statusCodeTooMany, wantRetryAfter: "1000"},
+		{advance: 400 * time.Millisecond, wantStatus: statusCodeTooMany, wantRetryAfter: "600"},
+		{advance: 600 * time.Millisecond, wantStatus: statusCodeOK},
+		{wantStatus: statusCodeTooMany, wantRetryAfter: "1000"},
+		// A long pause refills the bucket up to the burst only
+		{advance: time.Hour, wantStatus: statusCodeOK},
+		{wantStatus: statusCodeOK},
+		{wantStatus: statusCodeTooMany, wantRetryAfter: "1000"},
+	}
+	body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+	requests := 0
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		posted := len(poster.Frames())
+		response, err := h.Handler(context.Background(), testMessage(body))
+		if err != nil || response.StatusCode != step.wantStatus {
+			t.Fatalf("step %d: Handler() = %d, %v, want %d", i, response.StatusCode, err, step.wantStatus)
+		}
+		if step.wantStatus == statusCodeOK {
+			requests++
+			continue
+		}
+		texts := poster.Texts()[posted:]
+		want := `{"type":"error","code":"rate_limited","retry_after_ms":` + step.wantRetryAfter + `}`
+		if len(texts) != 1 || texts[0] != want {
+			t.Errorf("step %d: frames = %q, want %s", i, texts, want)
+		}
+	}
+	if got := len(chat.Requests()); got != requests {
+		t.Errorf("OpenAI got %d requests, want the %d allowed ones", got, requests)
+	}
+}
+
+func TestRateLimitFailMode(t *testing.T) {
+	tests := []struct {
+		failMode   string
+		wantStatus int
+	}{
+		{failMode: rateLimitFailOpen, wantStatus: statusCodeOK},
+		{failMode: rateLimitFailClosed, wantStatus: statusCodeTooMany},
+	}
+	for _, tt := range tests {
+		t.Run(tt.failMode, func(t *testing.T) {
+			testRateLimiter(t)
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.RateLimitTable = "rate_limits"
+				cfg.RateLimitFailMode = tt.failMode
+			})
+			db := newFakeDynamoDB().table("rate_limits", "bucket_key").fail("GetItem", errors.New("ProvisionedThroughputExceededException"))
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			body := `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, err := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), db, nil).Handler(context.Background(), testMessage(body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d, %v, want %d", response.StatusCode, err, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequestSubject(t *testing.T) {
+	tests := []struct {
+		name      string
+		identity  *userIdentity
+		principal string
+		want      string
+	}{
+		{name: "anonymous", want: "connection#conn-1"},
+		{name: "token principal", principal: "user-1", want: "principal#user-1"},
+		{name: "shared secret", principal: sharedSecretPrincipal, want: "connection#conn-1"},
+		{name: "cognito user", identity: &userIdentity{Sub: "sub-1"}, principal: "user-1", want: "user#sub-1"},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.principal != "" {
+			ctx = withPrincipal(ctx, tt.principal)
+		}
+		if got := requestSubject(openAIRequest{ctx: ctx, identity: tt.identity, ConnectionId: "conn-1"}); got != tt.want {
+			t.Errorf("requestSubject(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultReasoningModels are the model prefixes treated as reasoning models when REASONING_MODELS isn't set
+var defaultReasoningModels = []string{"o1", "o3", "o4"}
+
+// userRoleReasoningModels are the reasoning models accepting neither system nor developer messages,
+// so the system prompt becomes a user message for them
+var userRoleReasoningModels = []string{openai.O1Mini, openai.O1Preview}
+
+// isReasoningModel checks if model starts with one of the REASONING_MODELS prefixes
+func isReasoningModel(cfg *Config, model string) bool {
+	for _, prefix := range cfg.ReasoningModels {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReasoningParams rejects the sampling parameters reasoning models don't support, so the client learns which
+// field to drop instead of getting an OpenAI error
+func checkReasoningParams(cfg *Config, request Request) error {
+	model := requestModel(cfg, request)
+	if (request.Provider != "" && request.Provider != providerOpenAI) || !isReasoningModel(cfg, model) {
+		return nil
+	}
+	unsupported := map[string]bool{
+		"temperature":       request.Temperature != nil,
+		"top_p":             request.TopP != nil,
+		"presence_penalty":  request.PresencePenalty != nil,
+		"frequency_penalty": request.FrequencyPenalty != nil,
+		"logit_bias":        len(request.LogitBias) > 0,
+	}
+	for _, field := range []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "logit_bias"} {
+		if unsupported[field] {
+			return fmt.Errorf("%s is not supported by the reasoning model %s", field, model)
+		}
+	}
+	return nil
+}
+
+// adaptReasoningRequest rewrites a chat request for a reasoning model: system messages become developer
+// messages, or user messages for the models that accept neither, the unsupported sampling parameters are
+// dropped, and max_tokens is sent as max_completion_tokens. Requests for other models are left alone.
+func adaptReasoningRequest(cfg *Config, chatRequest *openai.ChatCompletionRequest) {
+	if !isReasoningModel(cfg, chatRequest.Model) {
+		return
+	}
+	role := openai.ChatMessageRoleDeveloper
+	for _, model := range userRoleReasoningModels {
+		if strings.HasPrefix(chatRequest.Model, model) {
+			role = openai.ChatMessageRoleUser
+		}
+	}
+	// Copy the messages so the caller's request isn't rewritten behind its back
+	chatRequest.Messages = append([]openai.ChatCompletionMessage(nil), chatRequest.Messages...)
+	for i := range chatRequest.Messages {
+		if chatRequest.Messages[i].Role == openai.ChatMessageRoleSystem {
+			chatRequest.Messages[i].Role = role
+		}
+	}
+	chatRequest.Temperature = 0
+	chatRequest.TopP = 0
+	chatRequest.PresencePenalty = 0
+	chatRequest.FrequencyPenalty = 0
+	chatRequest.LogitBias = nil
+	if chatRequest.MaxTokens > 0 {
+		chatRequest.MaxCompletionTokens = chatRequest.MaxTokens
+		chatRequest.MaxTokens = 0
+	}
+}
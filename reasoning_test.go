@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestIsReasoningModel(t *testing.T) {
+	cfg := &Config{ReasoningModels: defaultReasoningModels}
+	tests := map[string]bool{
+		"o1":          true,
+		"o1-mini":     true,
+		"o3-mini":     true,
+		"o4-mini":     true,
+		"gpt-4o":      false,
+		"gpt-4o-mini": false,
+	}
+	for model, want := range tests {
+		if got := isReasoningModel(cfg, model); got != want {
+			t.Errorf("isReasoningModel(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
+
+func TestCheckReasoningParams(t *testing.T) {
+	temperature, topP, penalty := float32(0.5), float32(0.9), float32(1)
+	tests := []struct {
+		name    string
+		model   string
+		request Request
+		wantErr string
+	}{
+		{name: "no sampling parameters", model: "o1-mini", request: Request{MaxTokens: new(int)}},
+		{name: "temperature", model: "o1-mini", request: Request{Temperature: &temperature}, wantErr: "temperature is not supported by the reasoning model o1-mini"},
+		{name: "top_p", model: "o3-mini", request: Request{TopP: &topP}, wantErr: "top_p is not supported"},
+		{name: "presence_penalty", model: "o3-mini", request: Request{PresencePenalty: &penalty}, wantErr: "presence_penalty is not supported"},
+		{name: "frequency_penalty", model: "o3-mini", request: Request{FrequencyPenalty: &penalty}, wantErr: "frequency_penalty is not supported"},
+		{name: "logit_bias", model: "o3-mini", request: Request{LogitBias: map[string]int{"50256": -100}}, wantErr: "logit_bias is not supported"},
+		{name: "standard model", model: "gpt-4o", request: Request{Temperature: &temperature, TopP: &topP}},
+		{name: "other provider", model: "o1-mini", request: Request{Provider: "bedrock", Temperature: &temperature}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{OpenAIModel: tt.model, ReasoningModels: defaultReasoningModels}
+			err := checkReasoningParams(cfg, tt.request)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkReasoningParams() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkReasoningParams() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdaptReasoningRequest(t *testing.T) {
+	request := func(model string) openai.ChatCompletionRequest {
+		return openai.ChatCompletionRequest{
+			Model:            model,
+			Messages:         []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: "Grade it."}, {Role: openai.ChatMessageRoleUser, Content: "hi"}},
+			Temperature:      0.5,
+			TopP:             0.9,
+			PresencePenalty:  1,
+			FrequencyPenalty: 1,
+			LogitBias:        map[string]int{"50256": -100},
+			MaxTokens:        64,
+		}
+	}
+	adapted := func(model, systemRole string) openai.ChatCompletionRequest {
+		return openai.ChatCompletionRequest{
+			Model:               model,
+			Messages:            []openai.ChatCompletionMessage{{Role: systemRole, Content: "Grade it."}, {Role: openai.ChatMessageRoleUser, Content: "hi"}},
+			MaxCompletionTokens: 64,
+		}
+	}
+	tests := []struct {
+		model string
+		want  openai.ChatCompletionRequest
+	}{
+		{model: "gpt-4o", want: request("gpt-4o")},
+		{model: "o3-mini", want: adapted("o3-mini", openai.ChatMessageRoleDeveloper)},
+		{model: "o1", want: adapted("o1", openai.ChatMessageRoleDeveloper)},
+		{model: "o1-mini", want: adapted("o1-mini", openai.ChatMessageRoleUser)},
+		{model: "o1-preview-2024-09-12", want: adapted("o1-preview-2024-09-12", openai.ChatMessageRoleUser)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			chatRequest := request(tt.model)
+			original := chatRequest.Messages
+			adaptReasoningRequest(&Config{ReasoningModels: defaultReasoningModels}, &chatRequest)
+			if !reflect.DeepEqual(chatRequest, tt.want) {
+				t.Fatalf("adaptReasoningRequest() = %+v, want %+v", chatRequest, tt.want)
+			}
+			if original[0].Role != openai.ChatMessageRoleSystem {
+				t.Error("adaptReasoningRequest() rewrote the caller's messages")
+			}
+		})
+	}
+}
+
+func TestReasoningRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		model        string
+		responseType string
+		params       string
+		wantStatus   int
+		wantRole     string
+		want         openai.ChatCompletionRequest
+	}{
+		{
+			name:         "standard model",
+			model:        "gpt-4o",
+			responseType: "full",
+			params:       `,"temperature":0.5,"max_tokens":64`,
+			wantStatus:   statusCodeOK,
+			wantRole:     openai.ChatMessageRoleSystem,
+			want:         openai.ChatCompletionRequest{Temperature: 0.5, MaxTokens: 64},
+		},
+		{
+			name:         "reasoning model",
+			model:        "o3-mini",
+			responseType: "full",
+			params:       `,"max_tokens":64`,
+			wantStatus:   statusCodeOK,
+			wantRole:     openai.ChatMessageRoleDeveloper,
+			want:         openai.ChatCompletionRequest{MaxCompletionTokens: 64},
+		},
+		{
+			// Extractors pin the temperature, which reasoning models don't accept
+			name:         "reasoning model extractor",
+			model:        "o1-mini",
+			responseType: "int",
+			wantStatus:   statusCodeOK,
+			wantRole:     openai.ChatMessageRoleUser,
+		},
+		{
+			name:         "reasoning model stream",
+			model:        "o3-mini",
+			responseType: "stream",
+			params:       `,"max_tokens":64`,
+			wantStatus:   statusCodeOK,
+			wantRole:     openai.ChatMessageRoleDeveloper,
+			want:         openai.ChatCompletionRequest{MaxCompletionTokens: 64},
+		},
+		{
+			name:         "unsupported parameter",
+			model:        "o3-mini",
+			responseType: "full",
+			params:       `,"temperature":0.5`,
+			wantStatus:   statusCodeBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = tt.model
+				cfg.ReasoningModels = defaultReasoningModels
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("[[42]]"))
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]` + tt.params + `}`
+			response, _ := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if tt.wantStatus != statusCodeOK {
+				if len(requests) != 0 || !strings.Contains(response.Body, "temperature is not supported") {
+					t.Fatalf("body %q with %d OpenAI requests, want the unsupported field named and no request", response.Body, len(requests))
+				}
+				return
+			}
+			if len(requests) != 1 {
+				t.Fatalf("%d requests, want 1", len(requests))
+			}
+			got := requests[0]
+			if got.Messages[0].Role != tt.wantRole || got.Messages[0].Content != "You are a test assistant." {
+				t.Errorf("first message = %s %q, want the prompt template as %s", got.Messages[0].Role, got.Messages[0].Content, tt.wantRole)
+			}
+			params := openai.ChatCompletionRequest{Temperature: got.Temperature, TopP: got.TopP, MaxTokens: got.MaxTokens, MaxCompletionTokens: got.MaxCompletionTokens}
+			if !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("parameters = %+v, want %+v", params, tt.want)
+			}
+		})
+	}
+}
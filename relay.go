@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	actionRelay            = "relay"
+	relayTypeNotification  = "notification"
+	relayTypeSystemMessage = "system_message"
+	maxRelayPayloadBytes   = 32 * 1024
+	defaultRelayRateLimit  = 60
+	relayRateWindow        = time.Minute
+)
+
+// relayRequest is sent by trusted backends to push a frame into an existing websocket connection, or into
+// every connection of a user. Protocol and AcceptEncoding select the framing the target client expects,
+// as the fields of the same name do for requests.
+type relayRequest struct {
+	Action         string       `json:"action"`
+	Service        string       `json:"service"`
+	Credential     string       `json:"credential"`
+	ConnectionID   string       `json:"connection_id,omitempty"`
+	UserID         string       `json:"user_id,omitempty"` // Principal or Cognito sub stored with the target connections
+	Protocol       string       `json:"protocol,omitempty"`
+	AcceptEncoding string       `json:"accept_encoding,omitempty"`
+	Payload        relayPayload `json:"payload"`
+}
+
+// relayTarget is a connection a relay is posted to, with the management API endpoint it was opened on
+type relayTarget struct {
+	connectionID string
+	endpoint     string
+}
+
+// relayPayload is the frame envelope posted to the target connection
+type relayPayload struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// relayLimiter counts relays per service in fixed windows. The state lives in the execution environment,
+// so the limit applies per Lambda container rather than globally.
+type relayLimiter struct {
+	mu      sync.Mutex
+	window  time.Time
+	counts  map[string]int
+	nowFunc func() time.Time
+}
+
+var relayRateLimiter = &relayLimiter{counts: make(map[string]int), nowFunc: time.Now}
+
+// allow records a relay for service and reports whether it is within limit relays per window
+func (l *relayLimiter) allow(service string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.nowFunc()
+	if now.Sub(l.window) >= relayRateWindow {
+		l.window = now
+		l.counts = make(map[string]int)
+	}
+	if l.counts[service] >= limit {
+		return false
+	}
+	l.counts[service]++
+	return true
+}
+
+// parseRelayCredentials parses the comma separated service=credential pairs of RELAY_CREDENTIALS
+func parseRelayCredentials(value string) (map[string]string, error) {
+	credentials := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		service, credential, found := strings.Cut(pair, "=")
+		if !found || service == "" || credential == "" {
+			return nil, fmt.Errorf("Invalid service=credential pair in environment variable RELAY_CREDENTIALS: %s", service)
+		}
+		credentials[service] = credential
+	}
+	return credentials, nil
+}
+
+// isValidRelayCredential checks the credential of a service in constant time
+func isValidRelayCredential(cfg *Config, service string, credential string) bool {
+	expected, ok := cfg.RelayCredentials[service]
+	if !ok || credential == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(credential)) == 1
+}
+
+// validateRelayPayload checks the payload against the allowed frame types and the size limit
+func validateRelayPayload(payload relayPayload) error {
+	switch payload.Type {
+	case relayTypeNotification, relayTypeSystemMessage:
+	default:
+		return fmt.Errorf("payload type %q is not allowed", payload.Type)
+	}
+	if len(payload.Data) == 0 {
+		return fmt.Errorf("payload data is required")
+	}
+	return nil
+}
+
+// resolveRelayTargets returns the connection of the relay, or the connections recorded in CONNECTIONS_TABLE
+// for its user, matched on the principal of the token or the Cognito sub
+func resolveRelayTargets(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, relay relayRequest) ([]relayTarget, error) {
+	if relay.UserID == "" {
+		return []relayTarget{{connectionID: relay.ConnectionID}}, nil
+	}
+	var targets []relayTarget
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(cfg.ConnectionsTable),
+		ProjectionExpression: aws.String("connection_id, endpoint"),
+		FilterExpression:     aws.String("principal = :user OR user_sub = :user"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":user": {S: aws.String(relay.UserID)},
+		},
+	}
+	err := client.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if id, ok := item["connection_id"]; ok && aws.StringValue(id.S) != "" {
+				target := relayTarget{connectionID: aws.StringValue(id.S)}
+				if endpoint, ok := item["endpoint"]; ok {
+					target.endpoint = aws.StringValue(endpoint.S)
+				}
+				targets = append(targets, target)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Can't look up the connections of the user: %v", err)
+	}
+	return targets, nil
+}
+
+// postRelay posts the payload of a relay to one connection through the frame path of requests: an envelope
+// of the payload type for v2 clients, the payload as it is otherwise, and compressed for accept_encoding
+func postRelay(target openAIRequest, relay relayRequest, data []byte) error {
+	if target.compresses(data) {
+		pieces, err := compressPieces(data)
+		if err != nil {
+			return err
+		}
+		for _, piece := range pieces {
+			if target.isV2() {
+				err = postEnvelope(target, frameEnvelope{Type: relay.Payload.Type, Encoding: frameEncodingGzip, Data: piece})
+			} else {
+				var frame []byte
+				frame, err = json.Marshal(compressedFrame{Type: relay.Payload.Type, Encoding: frameEncodingGzip, Data: piece})
+				if err != nil {
+					return fmt.Errorf("Can't encode relay frame: %v", err)
+				}
+				err = postToConnection(target, frame)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if target.isV2() {
+		return postEnvelope(target, frameEnvelope{Type: relay.Payload.Type, Data: relay.Payload.Data})
+	}
+	return postFrames(target, data)
+}
+
+// handleRelay posts a frame from a trusted backend to the target connection, or to every connection of the
+// target user. It is authorized by the service credential alone, so it skips the connection authorization.
+func (h *WebsocketHandler) handleRelay(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var relay relayRequest
+	if err := json.Unmarshal([]byte(request.Body), &relay); err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing relay JSON: %s", err), statusCodeBadRequest)
+	}
+
+	if !isValidRelayCredential(cfg, relay.Service, relay.Credential) {
+		loggerFrom(ctx).Warn("Relay audit", "service", relay.Service, "result", "unauthorized")
+		return errorResponse("Invalid relay credential", statusCodeUnauthorized)
+	}
+
+	if (relay.ConnectionID == "") == (relay.UserID == "") {
+		return errorResponse("Relay target requires either connection_id or user_id", statusCodeBadRequest)
+	}
+	if relay.UserID != "" && cfg.ConnectionsTable == "" {
+		return errorResponse("Relay to user_id is not supported without a connections table", statusCodeBadRequest)
+	}
+	if relay.Protocol != "" && relay.Protocol != protocolV2 {
+		return errorResponse(fmt.Sprintf("Unsupported relay protocol %q", relay.Protocol), statusCodeBadRequest)
+	}
+	if err := checkAcceptEncoding(Request{AcceptEncoding: relay.AcceptEncoding}); err != nil {
+		return errorResponse(fmt.Sprintf("Invalid relay: %s", err), statusCodeBadRequest)
+	}
+
+	if err := validateRelayPayload(relay.Payload); err != nil {
+		return errorResponse(fmt.Sprintf("Invalid relay payload: %s", err), statusCodeBadRequest)
+	}
+
+	data, err := json.Marshal(relay.Payload)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Error encoding relay payload: %s", err), statusCodeServerError)
+	}
+	if len(data) > maxRelayPayloadBytes {
+		return errorResponse(fmt.Sprintf("Relay payload exceeds %d bytes", maxRelayPayloadBytes), statusCodeBadRequest)
+	}
+
+	recipient := relay.ConnectionID
+	if relay.UserID != "" {
+		recipient = "user:" + relay.UserID
+	}
+	if !relayRateLimiter.allow(relay.Service, cfg.RelayRateLimit) {
+		loggerFrom(ctx).Warn("Relay audit", "service", relay.Service, "target", recipient, "result", "rate_limited")
+		return errorResponse("Relay rate limit exceeded", statusCodeTooMany)
+	}
+
+	var client dynamodbiface.DynamoDBAPI
+	if relay.UserID != "" {
+		client = h.getDynamoDBClient(cfg)
+	}
+	targets, err := resolveRelayTargets(ctx, client, cfg, relay)
+	if err != nil {
+		loggerFrom(ctx).Error("Relay audit", "service", relay.Service, "target", recipient, "type", relay.Payload.Type, "result", "error", "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+
+	sent := 0
+	for _, target := range targets {
+		targetCtx := ctx
+		if target.endpoint != "" {
+			targetCtx = withAPIGatewayEndpoint(ctx, target.endpoint)
+		}
+		targetRequest := openAIRequest{
+			ctx:          targetCtx,
+			config:       cfg,
+			request:      Request{Protocol: relay.Protocol, AcceptEncoding: relay.AcceptEncoding},
+			poster:       h.getConnectionPoster(targetCtx, cfg),
+			ConnectionId: target.connectionID,
+			sequence:     &frameSequence{},
+			deadLetters:  h.getDeadLetterSink(cfg),
+		}
+		err := postRelay(targetRequest, relay, data)
+		if errors.Is(err, ErrClientGone) {
+			continue
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Relay audit", "service", relay.Service, "target", target.connectionID, "type", relay.Payload.Type, "result", "error", "error", err)
+			return errorResponse(fmt.Sprintf("Can't relay payload: %s", err), statusCodeServerError)
+		}
+		sent++
+	}
+	if sent == 0 {
+		loggerFrom(ctx).Warn("Relay audit", "service", relay.Service, "target", recipient, "type", relay.Payload.Type, "result", "unknown_target")
+		return errorResponse(fmt.Sprintf("Unknown relay target: %s", recipient), statusCodeNotFound)
+	}
+
+	loggerFrom(ctx).Info("Relay audit", "service", relay.Service, "target", recipient, "type", relay.Payload.Type, "bytes", len(data), "connections", sent, "result", "sent")
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParseRelayCredentials(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: "notify=abc, billing=def", want: map[string]string{"notify": "abc", "billing": "def"}},
+		{value: "notify", wantErr: true},
+		{value: "=abc", wantErr: true},
+		{value: "notify=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRelayCredentials(tt.value)
+		if (err != nil) != tt.wantErr || !tt.wantErr && len(got) != len(tt.want) {
+			t.Errorf("parseRelayCredentials(%q) = %v, %v", tt.value, got, err)
+		}
+		for service, credential := range tt.want {
+			if got[service] != credential {
+				t.Errorf("parseRelayCredentials(%q)[%s] = %q, want %q", tt.value, service, got[service], credential)
+			}
+		}
+	}
+}
+
+func TestRelayLimiter(t *testing.T) {
+	now := testStart
+	limiter := &relayLimiter{counts: make(map[string]int), nowFunc: func() time.Time { return now }}
+	for i := 0; i < 3; i++ {
+		if !limiter.allow("notify", 3) {
+			t.Fatalf("relay %d refused within the limit", i+1)
+		}
+	}
+	if limiter.allow("notify", 3) {
+		t.Fatal("relay over the limit allowed")
+	}
+	if !limiter.allow("billing", 3) {
+		t.Fatal("the limit of one service applied to another")
+	}
+	now = now.Add(relayRateWindow)
+	if !limiter.allow("notify", 3) {
+		t.Fatal("relay refused in the next window")
+	}
+}
+
+// resetRelayLimiter gives the test a fresh relay rate limiter, restoring the shared one after it
+func resetRelayLimiter(t *testing.T) {
+	original := relayRateLimiter
+	relayRateLimiter = &relayLimiter{counts: make(map[string]int), nowFunc: time.Now}
+	t.Cleanup(func() { relayRateLimiter = original })
+}
+
+func TestHandleRelay(t *testing.T) {
+	large := strings.Repeat("report ready ", 200)
+	tests := []struct {
+		name       string
+		body       string
+		goneAt     int
+		wantStatus int
+		wantFrames map[string]string // Connection to the frame it gets
+		wantGzip   bool
+	}{
+		{
+			name:       "wrong credential",
+			body:       `{"action":"relay","service":"notify","credential":"guess","connection_id":"conn-2","payload":{"type":"notification","data":"hi"}}`,
+			wantStatus: statusCodeUnauthorized,
+		},
+		{
+			name:       "unknown service",
+			body:       `{"action":"relay","service":"other","credential":"secret","connection_id":"conn-2","payload":{"type":"notification","data":"hi"}}`,
+			wantStatus: statusCodeUnauthorized,
+		},
+		{
+			name:       "disallowed type",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","payload":{"type":"delta","data":"hi"}}`,
+			wantStatus: statusCodeBadRequest,
+		},
+		{
+			name:       "both targets",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","user_id":"user-1","payload":{"type":"notification","data":"hi"}}`,
+			wantStatus: statusCodeBadRequest,
+		},
+		{
+			name:       "too large",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","payload":{"type":"notification","data":"` + strings.Repeat("x", maxRelayPayloadBytes) + `"}}`,
+			wantStatus: statusCodeBadRequest,
+		},
+		{
+			name:       "connection gone",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-gone","payload":{"type":"notification","data":"hi"}}`,
+			goneAt:     0,
+			wantStatus: statusCodeNotFound,
+		},
+		{
+			name:       "unknown user",
+			body:       `{"action":"relay","service":"notify","credential":"secret","user_id":"user-9","payload":{"type":"notification","data":"hi"}}`,
+			wantStatus: statusCodeNotFound,
+		},
+		{
+			name:       "legacy connection",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","payload":{"type":"notification","data":"Report ready"}}`,
+			wantStatus: statusCodeOK,
+			wantFrames: map[string]string{"conn-2": `{"type":"notification","data":"Report ready"}`},
+		},
+		{
+			name:       "v2 connection",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","protocol":"v2","payload":{"type":"system_message","data":{"text":"Maintenance"}}}`,
+			wantStatus: statusCodeOK,
+			wantFrames: map[string]string{"conn-2": `{"type":"system_message","seq":0,"data":{"text":"Maintenance"}}`},
+		},
+		{
+			name:       "connections of a user",
+			body:       `{"action":"relay","service":"notify","credential":"secret","user_id":"user-1","payload":{"type":"notification","data":"Report ready"}}`,
+			wantStatus: statusCodeOK,
+			wantFrames: map[string]string{"conn-2": `{"type":"notification","data":"Report ready"}`, "conn-3": `{"type":"notification","data":"Report ready"}`},
+		},
+		{
+			name:       "compressed",
+			body:       `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","protocol":"v2","accept_encoding":"gzip","payload":{"type":"notification","data":"` + large + `"}}`,
+			wantStatus: statusCodeOK,
+			wantFrames: map[string]string{"conn-2": `{"type":"notification","data":"` + large + `"}`},
+			wantGzip:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetRelayLimiter(t)
+			// Connection authorization is on, and doesn't apply to relays
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.AuthMode = authModeToken
+				cfg.ConnectionsTable = "connections"
+				cfg.RelayCredentials = map[string]string{"notify": "secret"}
+				cfg.RelayRateLimit = 10
+				cfg.CompressMinBytes = 1024
+			})
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			for _, id := range []string{"conn-2", "conn-3"} {
+				db.put("connections", map[string]*dynamodb.AttributeValue{"connection_id": {S: aws.String(id)}, "principal": {S: aws.String("user-1")}})
+			}
+			poster := testsupport.NewRecordingPoster()
+			if strings.Contains(tt.body, "conn-gone") {
+				poster.FailAt(tt.goneAt, testsupport.ErrGone)
+			}
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), poster, db, nil)
+			response, err := h.Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+
+			got := make(map[string]string)
+			for _, frame := range poster.Frames() {
+				data := string(frame.Data)
+				if tt.wantGzip {
+					var envelope frameEnvelope
+					if err := json.Unmarshal(frame.Data, &envelope); err != nil || envelope.Encoding != frameEncodingGzip {
+						t.Fatalf("frame %s isn't compressed", frame.Data)
+					}
+					data = gunzipBase64(t, envelope.Data.(string))
+				}
+				got[frame.ConnectionID] += data
+			}
+			if len(got) != len(tt.wantFrames) {
+				t.Fatalf("frames = %v, want %v", got, tt.wantFrames)
+			}
+			for connectionID, want := range tt.wantFrames {
+				if got[connectionID] != want {
+					t.Fatalf("%s got %s, want %s", connectionID, got[connectionID], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	resetRelayLimiter(t)
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.RelayCredentials = map[string]string{"notify": "secret"}
+		cfg.RelayRateLimit = 2
+	})
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), nil, nil)
+	body := `{"action":"relay","service":"notify","credential":"secret","connection_id":"conn-2","payload":{"type":"notification","data":"hi"}}`
+	var mu sync.Mutex
+	statuses := make(map[int]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, _ := h.Handler(context.Background(), testMessage(body))
+			mu.Lock()
+			statuses[response.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if statuses[statusCodeOK] != 2 || statuses[statusCodeTooMany] != 3 {
+		t.Fatalf("statuses = %v, want 2 relays and 3 rate limited", statuses)
+	}
+}
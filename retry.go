@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	defaultOpenAIMaxRetries = 3
+	openAIRetryBaseDelay    = 500 * time.Millisecond
+	openAIRetryMaxDelay     = 8 * time.Second
+	postMaxRetries          = 3
+	postRetryBaseDelay      = 50 * time.Millisecond
+	postRetryMaxDelay       = 400 * time.Millisecond
+	defaultDeadlineMargin   = 2 * time.Second
+	// openAIQuotaErrorCode marks a 429 that won't go away by waiting
+	openAIQuotaErrorCode         = "insufficient_quota"
+	openAIModelNotFoundCode      = "model_not_found"
+	openAIContextLengthErrorCode = "context_length_exceeded"
+)
+
+// isRetryableOpenAIError checks if err is a transient OpenAI API failure: a rate limit or a server side error.
+// Client errors such as invalid requests, bad credentials or an exceeded context length are never retried.
+func isRetryableOpenAIError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		if code, ok := apiErr.Code.(string); ok && code == openAIQuotaErrorCode {
+			return false
+		}
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return isRetryableStatus(requestErr.HTTPStatusCode)
+	}
+	return false
+}
+
+// isNotFoundError checks if err is a 404 returned by the OpenAI API
+func isNotFoundError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusNotFound
+	}
+	var requestErr *openai.RequestError
+	return errors.As(err, &requestErr) && requestErr.HTTPStatusCode == http.StatusNotFound
+}
+
+// isRetryableStatus checks if an HTTP status code returned by the OpenAI API is worth retrying
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns the jittered exponential delay before retry number attempt, starting at base and capped at max
+func backoffDelay(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := base << attempt
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+	// Spread the delay over its upper half so concurrent retries don't line up
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleepContext waits for delay, returning false without waiting when the context deadline would pass first
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// nearDeadline checks if waiting for d would leave less than STREAM_DEADLINE_MARGIN_MS before the Lambda deadline
+func nearDeadline(ctx context.Context, cfg *Config, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < d+cfg.DeadlineMargin
+}
+
+// withOpenAIRetries runs call, retrying transient OpenAI API failures up to OPENAI_MAX_RETRIES times with
+// exponential backoff. Retrying stops early when the next attempt would start within STREAM_DEADLINE_MARGIN_MS
+// of the Lambda deadline.
+// The OpenAI client doesn't expose the Retry-After header of failed requests, so the backoff can't honour it.
+func withOpenAIRetries[T any](ctx context.Context, cfg *Config, call func() (T, error)) (T, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := call()
+		if err == nil || !isRetryableOpenAIError(err) || attempt >= cfg.OpenAIMaxRetries {
+			return result, err
+		}
+		delay := backoffDelay(attempt, openAIRetryBaseDelay, openAIRetryMaxDelay)
+		if nearDeadline(ctx, cfg, delay) {
+			loggerFrom(ctx).Warn("Not retrying the OpenAI API request, the Lambda deadline is too close", "error", err)
+			return result, err
+		}
+		loggerFrom(ctx).Warn("OpenAI API request failed, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		if !sleepContext(ctx, delay) {
+			loggerFrom(ctx).Warn("Not retrying the OpenAI API request, the Lambda deadline is too close")
+			return result, err
+		}
+	}
+}
+
+// shouldFallback checks if a request to model that failed with err is worth one more attempt with OPENAI_FALLBACK_MODEL.
+// That is the case for rate limits, server errors and unknown models, and for an exceeded context length
+// only when the fallback model is configured to have a larger context window.
+func shouldFallback(cfg *Config, model string, err error) bool {
+	if cfg.OpenAIFallbackModel == "" || cfg.OpenAIFallbackModel == model {
+		return false
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case openAIModelNotFoundCode:
+			return true
+		case openAIContextLengthErrorCode:
+			return cfg.OpenAIFallbackLargerContext
+		}
+		return isRetryableStatus(apiErr.HTTPStatusCode)
+	}
+	return isRetryableOpenAIError(err)
+}
+
+// withModelFallback runs call with retries and, when shouldFallback allows it, once more after switching
+// chatRequest to the fallback model, adapted to it when it is a reasoning model. call must read the model from chatRequest.
+func withModelFallback[T any](ctx context.Context, cfg *Config, chatRequest *openai.ChatCompletionRequest, call func() (T, error)) (T, error) {
+	result, err := withOpenAIRetries(ctx, cfg, call)
+	if err == nil || !shouldFallback(cfg, chatRequest.Model, err) || nearDeadline(ctx, cfg, 0) {
+		return result, err
+	}
+	loggerFrom(ctx).Warn("Falling back to the fallback model", "primary_model", chatRequest.Model, "fallback_model", cfg.OpenAIFallbackModel, "error", err)
+	chatRequest.Model = cfg.OpenAIFallbackModel
+	adaptReasoningRequest(cfg, chatRequest)
+	return call()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestIsRetryableOpenAIError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "rate limited", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}, want: true},
+		{name: "bad gateway", err: &openai.APIError{HTTPStatusCode: http.StatusBadGateway}, want: true},
+		{name: "unavailable", err: &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "request error", err: &openai.RequestError{HTTPStatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "wrapped", err: fmt.Errorf("creating completion: %w", &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}), want: true},
+		{name: "quota exceeded", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Code: openAIQuotaErrorCode}},
+		{name: "bad request", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}},
+		{name: "unauthorized", err: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}},
+		{name: "context length", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Code: openAIContextLengthErrorCode}},
+		{name: "request not found", err: &openai.RequestError{HTTPStatusCode: http.StatusNotFound}},
+		{name: "other error", err: errors.New("connection reset")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableOpenAIError(tt.err); got != tt.want {
+				t.Errorf("isRetryableOpenAIError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNotFoundError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "api error", err: &openai.APIError{HTTPStatusCode: http.StatusNotFound}, want: true},
+		{name: "request error", err: &openai.RequestError{HTTPStatusCode: http.StatusNotFound}, want: true},
+		{name: "wrapped", err: fmt.Errorf("listing models: %w", &openai.RequestError{HTTPStatusCode: http.StatusNotFound}), want: true},
+		{name: "server error", err: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}},
+		{name: "other error", err: errors.New("connection reset")},
+		{name: "no error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFoundError(tt.err); got != tt.want {
+				t.Errorf("isNotFoundError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		wantMax time.Duration
+	}{
+		{attempt: 0, wantMax: 500 * time.Millisecond},
+		{attempt: 1, wantMax: time.Second},
+		{attempt: 2, wantMax: 2 * time.Second},
+		{attempt: 4, wantMax: 8 * time.Second},
+		{attempt: 5, wantMax: 8 * time.Second},
+		{attempt: 70, wantMax: 8 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoffDelay(tt.attempt, openAIRetryBaseDelay, openAIRetryMaxDelay)
+				if got < tt.wantMax/2 || got > tt.wantMax {
+					t.Fatalf("backoffDelay(%d) = %v, want between %v and %v", tt.attempt, got, tt.wantMax/2, tt.wantMax)
+				}
+			}
+		})
+	}
+}
+
+func TestWithOpenAIRetries(t *testing.T) {
+	transient := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+	permanent := &openai.APIError{HTTPStatusCode: http.StatusBadRequest}
+	tests := []struct {
+		name         string
+		maxRetries   int
+		deadline     time.Duration
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "success", maxRetries: 2, errs: []error{nil}, wantAttempts: 1},
+		{name: "success after a transient failure", maxRetries: 2, errs: []error{transient, nil}, wantAttempts: 2},
+		{name: "retries exhausted", maxRetries: 1, errs: []error{transient, transient, nil}, wantAttempts: 2, wantErr: transient},
+		{name: "retries disabled", maxRetries: 0, errs: []error{transient, nil}, wantAttempts: 1, wantErr: transient},
+		{name: "not retryable", maxRetries: 2, errs: []error{permanent, nil}, wantAttempts: 1, wantErr: permanent},
+		{name: "deadline too close", maxRetries: 2, deadline: time.Second, errs: []error{transient, nil}, wantAttempts: 1, wantErr: transient},
+		// The backoff would end before the deadline, but within the margin kept free before it
+		{name: "deadline within the margin", maxRetries: 2, deadline: defaultDeadlineMargin + 100*time.Millisecond, errs: []error{transient, nil}, wantAttempts: 1, wantErr: transient},
+		{name: "deadline far away", maxRetries: 2, deadline: time.Minute, errs: []error{transient, nil}, wantAttempts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{OpenAIMaxRetries: tt.maxRetries, DeadlineMargin: defaultDeadlineMargin}
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			attempts := 0
+			got, err := withOpenAIRetries(ctx, cfg, func() (int, error) {
+				err := tt.errs[attempts]
+				attempts++
+				return attempts, err
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if err != tt.wantErr {
+				t.Errorf("withOpenAIRetries() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != attempts {
+				t.Errorf("withOpenAIRetries() = %d, want the result of the last attempt %d", got, attempts)
+			}
+		})
+	}
+}
+
+func TestOpenAIRequestsAreRetried(t *testing.T) {
+	rateLimited := &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "slow down"}
+	tests := []struct {
+		responseType string
+		retry        testsupport.Turn
+		wantFrames   []string
+	}{
+		{responseType: "full", retry: testsupport.Reply("Hello"), wantFrames: []string{"Hello"}},
+		{responseType: "stream", retry: testsupport.Stream(testsupport.TextChunks(0, "Hello")...), wantFrames: []string{"Hello", defaultEndStreamMessage}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.OpenAIMaxRetries = 1 })
+			chat := testsupport.NewScriptedCompleter(testsupport.Fail(rateLimited), tt.retry)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("StatusCode = %d, want %d", response.StatusCode, http.StatusOK)
+			}
+			if got := len(chat.Requests()); got != 2 {
+				t.Errorf("OpenAI requests = %d, want 2", got)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+		})
+	}
+}
+
+func TestNearDeadline(t *testing.T) {
+	cfg := &Config{DeadlineMargin: time.Second}
+	tests := []struct {
+		name     string
+		deadline time.Duration // 0 for a context without a deadline
+		wait     time.Duration
+		want     bool
+	}{
+		{name: "no deadline", wait: time.Hour},
+		{name: "far away", deadline: time.Minute, wait: time.Second},
+		{name: "within the margin", deadline: 500 * time.Millisecond, want: true},
+		{name: "wait runs into the margin", deadline: 3 * time.Second, wait: 2500 * time.Millisecond, want: true},
+		{name: "wait ends before the margin", deadline: 3 * time.Second, wait: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			if got := nearDeadline(ctx, cfg, tt.wait); got != tt.want {
+				t.Errorf("nearDeadline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldFallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		fallback      string
+		largerContext bool
+		model         string
+		err           error
+		want          bool
+	}{
+		{name: "rate limited", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusInternalServerError}, want: true},
+		{name: "model not found", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusNotFound, Code: openAIModelNotFoundCode}, want: true},
+		{name: "wrapped model not found", fallback: "gpt-fallback", err: fmt.Errorf("creating completion: %w", &openai.APIError{HTTPStatusCode: http.StatusNotFound, Code: openAIModelNotFoundCode}), want: true},
+		{name: "request error", fallback: "gpt-fallback", err: &openai.RequestError{HTTPStatusCode: http.StatusBadGateway}, want: true},
+		{name: "context length", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Code: openAIContextLengthErrorCode}},
+		{name: "context length with a larger fallback", fallback: "gpt-fallback", largerContext: true, err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest, Code: openAIContextLengthErrorCode}, want: true},
+		{name: "bad request", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusBadRequest}},
+		{name: "unauthorized", fallback: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}},
+		{name: "no fallback model", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}},
+		// A request already made to the fallback model isn't repeated
+		{name: "already the fallback model", fallback: "gpt-fallback", model: "gpt-fallback", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := tt.model
+			if model == "" {
+				model = "gpt-primary"
+			}
+			cfg := &Config{OpenAIFallbackModel: tt.fallback, OpenAIFallbackLargerContext: tt.largerContext}
+			if got := shouldFallback(cfg, model, tt.err); got != tt.want {
+				t.Errorf("shouldFallback(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestModelFallback checks that a request failing on the primary model is answered by the fallback model, and
+// that the model reported to the client is the one that answered
+func TestModelFallback(t *testing.T) {
+	overloaded := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Message: "overloaded"}
+	tests := []struct {
+		name         string
+		responseType string
+		turns        []testsupport.Turn
+		wantStatus   int
+		wantModels   []string
+		wantModel    string // Model of the final or end envelope
+	}{
+		{
+			name:         "full",
+			responseType: responseTypeFull,
+			turns:        []testsupport.Turn{testsupport.Fail(overloaded), testsupport.Reply("Hello")},
+			wantStatus:   statusCodeOK,
+			wantModels:   []string{"gpt-primary", "gpt-fallback"},
+			wantModel:    "gpt-fallback",
+		},
+		{
+			name:         "stream",
+			responseType: responseTypeStream,
+			turns:        []testsupport.Turn{testsupport.Fail(overloaded), testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...)},
+			wantStatus:   statusCodeOK,
+			wantModels:   []string{"gpt-primary", "gpt-fallback"},
+			wantModel:    "gpt-fallback",
+		},
+		{
+			name:         "primary answers",
+			responseType: responseTypeFull,
+			turns:        []testsupport.Turn{testsupport.Reply("Hello")},
+			wantStatus:   statusCodeOK,
+			wantModels:   []string{"gpt-primary"},
+			wantModel:    "gpt-primary",
+		},
+		{
+			name:         "not worth a fallback",
+			responseType: responseTypeFull,
+			turns:        []testsupport.Turn{testsupport.Fail(&openai.APIError{HTTPStatusCode: http.StatusBadRequest, Message: "bad request"})},
+			wantStatus:   statusCodeServerError,
+			wantModels:   []string{"gpt-primary"},
+		},
+		{
+			name:         "fallback fails too",
+			responseType: responseTypeFull,
+			turns:        []testsupport.Turn{testsupport.Fail(overloaded), testsupport.Fail(overloaded)},
+			wantStatus:   statusCodeServerError,
+			wantModels:   []string{"gpt-primary", "gpt-fallback"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-primary"
+				cfg.OpenAIFallbackModel = "gpt-fallback"
+				cfg.OpenAIMaxRetries = 0
+				cfg.StreamFlushInterval = 0
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turns...)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","protocol":"v2","messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			var models []string
+			for _, request := range chat.Requests() {
+				models = append(models, request.Model)
+			}
+			if !reflect.DeepEqual(models, tt.wantModels) {
+				t.Errorf("requested models %q, want %q", models, tt.wantModels)
+			}
+			if tt.wantModel == "" {
+				return
+			}
+			envelopes := decodeEnvelopes(t, poster.Texts())
+			if last := envelopes[len(envelopes)-1]; last.Model != tt.wantModel {
+				t.Errorf("%s envelope model = %q, want %q", last.Type, last.Model, tt.wantModel)
+			}
+		})
+	}
+}
+
+func TestModelFallbackNearDeadline(t *testing.T) {
+	overloaded := &openai.APIError{HTTPStatusCode: http.StatusServiceUnavailable}
+	tests := []struct {
+		name      string
+		deadline  time.Duration
+		wantCalls int
+	}{
+		{name: "deadline far away", deadline: time.Minute, wantCalls: 2},
+		{name: "deadline within the margin", deadline: defaultDeadlineMargin / 2, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{OpenAIFallbackModel: "gpt-fallback", DeadlineMargin: defaultDeadlineMargin}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.deadline)
+			defer cancel()
+			chatRequest := &openai.ChatCompletionRequest{Model: "gpt-primary"}
+			var models []string
+			_, _ = withModelFallback(ctx, cfg, chatRequest, func() (int, error) {
+				models = append(models, chatRequest.Model)
+				return 0, overloaded
+			})
+			if len(models) != tt.wantCalls {
+				t.Errorf("called with %q, want %d calls", models, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// routeResponseTypes are the response types a route of ROUTE_MAP may serve
+var routeResponseTypes = map[string]bool{
+	responseTypeInt: true, responseTypeString: true, responseTypeFull: true, responseTypeStream: true, responseTypeJSON: true,
+	responseTypeBool: true, responseTypeFloat: true, responseTypeChoice: true, responseTypeList: true,
+}
+
+// parseRouteMap parses the route key=response type JSON object of ROUTE_MAP
+func parseRouteMap(value string) (map[string]string, error) {
+	routes := make(map[string]string)
+	if strings.TrimSpace(value) == "" {
+		return routes, nil
+	}
+	if err := json.Unmarshal([]byte(value), &routes); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable ROUTE_MAP, expected a JSON object of response types: %v", err)
+	}
+	for route, responseType := range routes {
+		if route == "" || route == connectRouteKey || route == disconnectRouteKey {
+			return nil, fmt.Errorf("Invalid value for environment variable ROUTE_MAP, route %q can't serve requests", route)
+		}
+		if !routeResponseTypes[responseType] {
+			return nil, fmt.Errorf("Invalid value for environment variable ROUTE_MAP, route %q has the unknown response type %q", route, responseType)
+		}
+	}
+	return routes, nil
+}
+
+// withRouteResponseType sets the response type of a request that came in on a route of ROUTE_MAP. The body
+// may leave response_type out, but one that differs from the route's is rejected rather than silently replaced.
+// Requests on other routes keep the response_type of their body.
+func withRouteResponseType(cfg *Config, routeKey string, reqBody Request) (Request, error) {
+	responseType, ok := cfg.RouteMap[routeKey]
+	if !ok {
+		return reqBody, nil
+	}
+	if reqBody.ResponseType != "" && reqBody.ResponseType != responseType {
+		return reqBody, fmt.Errorf("response_type %q conflicts with the response type %q of route %s", reqBody.ResponseType, responseType, routeKey)
+	}
+	reqBody.ResponseType = responseType
+	return reqBody, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestParseRouteMap(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{value: "", want: map[string]string{}},
+		{value: `{"chat":"stream","score":"int","classify":"json"}`, want: map[string]string{"chat": responseTypeStream, "score": responseTypeInt, "classify": responseTypeJSON}},
+		{value: `{"poem":"sonnet"}`, wantErr: true},
+		{value: `{"$connect":"full"}`, wantErr: true},
+		{value: `{"$disconnect":"full"}`, wantErr: true},
+		{value: `{"":"full"}`, wantErr: true},
+		{value: `["chat"]`, wantErr: true},
+		{value: `{"chat":1}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRouteMap(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRouteMap(%s) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRouteMap(%s) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWithRouteResponseType(t *testing.T) {
+	cfg := &Config{RouteMap: map[string]string{"score": responseTypeInt}}
+	tests := []struct {
+		name     string
+		routeKey string
+		body     string // response_type of the body
+		want     string
+		wantErr  bool
+	}{
+		{name: "mapped route", routeKey: "score", want: responseTypeInt},
+		{name: "mapped route with the same type", routeKey: "score", body: responseTypeInt, want: responseTypeInt},
+		{name: "conflicting type", routeKey: "score", body: responseTypeFull, wantErr: true},
+		{name: "unmapped route", routeKey: "chat", body: responseTypeFull, want: responseTypeFull},
+		{name: "default route", routeKey: "$default", body: responseTypeStream, want: responseTypeStream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withRouteResponseType(cfg, tt.routeKey, Request{ResponseType: tt.body})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("withRouteResponseType() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.ResponseType != tt.want {
+				t.Errorf("response type = %q, want %q", got.ResponseType, tt.want)
+			}
+		})
+	}
+}
+
+// TestRouteMapHandler checks the response type Handler serves on mapped and unmapped route keys
+func TestRouteMapHandler(t *testing.T) {
+	const messages = `"prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Grade it"}]`
+	tests := []struct {
+		name         string
+		routeKey     string
+		body         string
+		wantStatus   int
+		wantRequests int
+		wantFrames   []string
+	}{
+		{name: "mapped route", routeKey: "score", body: `{` + messages + `}`, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"42"}},
+		{name: "mapped route with the same type", routeKey: "score", body: `{"response_type":"int",` + messages + `}`, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"42"}},
+		{name: "conflicting type", routeKey: "score", body: `{"response_type":"full",` + messages + `}`, wantStatus: statusCodeBadRequest},
+		// Unmapped routes keep serving the response_type of the body
+		{name: "unmapped route", routeKey: "summarize", body: `{"response_type":"full",` + messages + `}`, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"The grade is [[42]]."}},
+		{name: "default route", routeKey: "$default", body: `{"response_type":"full",` + messages + `}`, wantStatus: statusCodeOK, wantRequests: 1, wantFrames: []string{"The grade is [[42]]."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.RouteMap = map[string]string{"score": responseTypeInt, "chat": responseTypeStream}
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("The grade is [[42]]."))
+			poster := testsupport.NewRecordingPoster()
+			request := testMessage(tt.body)
+			request.RequestContext.RouteKey = tt.routeKey
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(context.Background(), request)
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("completer got %d requests, want %d", got, tt.wantRequests)
+			}
+			if tt.wantFrames != nil && !reflect.DeepEqual(poster.Texts(), tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", poster.Texts(), tt.wantFrames)
+			}
+		})
+	}
+}
+
+// TestRouteMapBatch checks that the items of a batch sent on a mapped route get the route's response type
+func TestRouteMapBatch(t *testing.T) {
+	tests := []struct {
+		name         string
+		item         string
+		wantStatus   int
+		wantRequests int
+	}{
+		{name: "item without a type", item: `{"request_id":"a","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Grade it"}]}`, wantStatus: statusCodeOK, wantRequests: 1},
+		{name: "conflicting item", item: `{"request_id":"a","response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"Grade it"}]}`, wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.RouteMap = map[string]string{"score": responseTypeInt} })
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("The grade is [[42]]."))
+			request := testMessage(`{"batch":[` + tt.item + `]}`)
+			request.RequestContext.RouteKey = "score"
+			response, err := newTestHandler(cfg, chat, testsupport.NewRecordingPoster(), nil, nil).Handler(context.Background(), request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("StatusCode = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			if got := len(chat.Requests()); got != tt.wantRequests {
+				t.Errorf("completer got %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/sashabaranov/go-openai"
+)
+
+// secretFetchTimeout bounds one fetch of the OpenAI API key from Secrets Manager or SSM
+const secretFetchTimeout = 10 * time.Second
+
+// sharedAWSSession is the AWS session of the execution environment, used by the clients of the handler
+// and for loading the OpenAI API key at cold start
+var sharedAWSSession = sync.OnceValue(newTracedSession)
+
+// sharedAWSConfig is the AWS SDK v2 configuration of the execution environment, loaded once at cold start
+// for the API Gateway Management API client
+var sharedAWSConfig = sync.OnceValue(newTracedAWSConfig)
+
+// openAIKeyCache keeps the OpenAI API key fetched from Secrets Manager or SSM for the lifetime of the
+// execution environment, so configuration refreshes don't fetch it again
+var openAIKeyCache struct {
+	mu    sync.Mutex
+	key   string
+	valid bool
+}
+
+// openAIKeyFromSecret checks if the OpenAI API key comes from Secrets Manager or SSM rather than OPENAI_API_KEY
+func openAIKeyFromSecret() bool {
+	return os.Getenv("OPENAI_API_KEY_SECRET_ARN") != "" || os.Getenv("OPENAI_API_KEY_SSM_PARAM") != ""
+}
+
+// loadOpenAIKey returns the OpenAI API key. When OPENAI_API_KEY_SECRET_ARN or OPENAI_API_KEY_SSM_PARAM is set
+// the key is fetched once and cached, unless refresh forces a new fetch. OPENAI_API_KEY is used otherwise.
+func loadOpenAIKey(refresh bool) (string, error) {
+	secretARN := os.Getenv("OPENAI_API_KEY_SECRET_ARN")
+	ssmParam := os.Getenv("OPENAI_API_KEY_SSM_PARAM")
+	if secretARN == "" && ssmParam == "" {
+		key := os.Getenv("OPENAI_API_KEY")
+		if key == "" {
+			return "", fmt.Errorf("OpenAI API key not found in environment variable OPENAI_API_KEY")
+		}
+		return key, nil
+	}
+	if secretARN != "" && ssmParam != "" {
+		return "", fmt.Errorf("Only one of the environment variables OPENAI_API_KEY_SECRET_ARN and OPENAI_API_KEY_SSM_PARAM can be set")
+	}
+
+	openAIKeyCache.mu.Lock()
+	defer openAIKeyCache.mu.Unlock()
+	if openAIKeyCache.valid && !refresh {
+		return openAIKeyCache.key, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	var key string
+	var err error
+	if secretARN != "" {
+		key, err = fetchSecretsManagerKey(ctx, sharedAWSSession(), secretARN)
+	} else {
+		key, err = fetchSSMKey(ctx, sharedAWSSession(), ssmParam)
+	}
+	if err != nil {
+		return "", err
+	}
+	openAIKeyCache.key = key
+	openAIKeyCache.valid = true
+	return key, nil
+}
+
+// fetchSecretsManagerKey reads the OpenAI API key from the plain text value of a Secrets Manager secret
+func fetchSecretsManagerKey(ctx context.Context, sess *session.Session, secretARN string) (string, error) {
+	output, err := secretsmanager.New(sess).GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretARN),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Can't fetch OpenAI API key from Secrets Manager secret %s: %v", secretARN, err)
+	}
+	key := strings.TrimSpace(aws.StringValue(output.SecretString))
+	if key == "" {
+		return "", fmt.Errorf("Secrets Manager secret %s has no string value for the OpenAI API key", secretARN)
+	}
+	return key, nil
+}
+
+// fetchSSMKey reads the OpenAI API key from an SSM SecureString parameter
+func fetchSSMKey(ctx context.Context, sess *session.Session, name string) (string, error) {
+	output, err := ssm.New(sess).GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Can't fetch OpenAI API key from SSM parameter %s: %v", name, err)
+	}
+	key := strings.TrimSpace(aws.StringValue(output.Parameter.Value))
+	if key == "" {
+		return "", fmt.Errorf("SSM parameter %s has no value for the OpenAI API key", name)
+	}
+	return key, nil
+}
+
+// isUnauthorizedError checks if the OpenAI API rejected the API key
+func isUnauthorizedError(err error) bool {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode == http.StatusUnauthorized
+	}
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+// refreshOpenAIKey fetches the OpenAI API key again after a 401, so a rotated key is picked up without a redeploy.
+// It returns the snapshot with the new key, or false when the key doesn't come from a secret or hasn't changed.
+func refreshOpenAIKey(ctx context.Context, cfg *Config) (*Config, bool) {
+	if !openAIKeyFromSecret() {
+		return nil, false
+	}
+	key, err := loadOpenAIKey(true)
+	if err != nil {
+		loggerFrom(ctx).Error("Can't refresh OpenAI API key", "error", err)
+		return nil, false
+	}
+	if key == cfg.OpenAIKey {
+		return nil, false
+	}
+	refreshed := *cfg
+	refreshed.OpenAIKey = key
+	return storeConfig(refreshed), true
+}
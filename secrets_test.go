@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const (
+	testSecretARN = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:openai-key"
+	testSSMParam  = "/proxy/openai-key"
+)
+
+// fakeSecretStore answers the Secrets Manager GetSecretValue and SSM GetParameter calls of the AWS session
+// with the values it holds, failing with ResourceNotFoundException for unknown names
+type fakeSecretStore struct {
+	mu     sync.Mutex
+	values map[string]string
+	calls  int
+}
+
+func (s *fakeSecretStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SecretID       string `json:"SecretId"`
+		Name           string `json:"Name"`
+		WithDecryption bool   `json:"WithDecryption"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	if err := json.Unmarshal(body, &input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.calls++
+	value, ok := s.values[input.SecretID+input.Name]
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"ResourceNotFoundException","message":"not found"}`)
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "secretsmanager.GetSecretValue":
+		json.NewEncoder(w).Encode(map[string]any{"SecretString": value})
+	case "AmazonSSM.GetParameter":
+		if !input.WithDecryption {
+			value = "encrypted"
+		}
+		json.NewEncoder(w).Encode(map[string]any{"Parameter": map[string]any{"Name": input.Name, "Value": value}})
+	default:
+		http.Error(w, "unexpected call "+r.Header.Get("X-Amz-Target"), http.StatusBadRequest)
+	}
+}
+
+func (s *fakeSecretStore) set(name string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[name] = value
+}
+
+func (s *fakeSecretStore) fetches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// useFakeSecretStore points the shared AWS session at a fake secret store holding values, with an empty key
+// cache and no key variables set, restoring both after the test
+func useFakeSecretStore(t *testing.T, values map[string]string) *fakeSecretStore {
+	t.Helper()
+	store := &fakeSecretStore{values: values}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+
+	originalSession := sharedAWSSession
+	sharedAWSSession = func() *session.Session {
+		return session.Must(session.NewSession(aws.NewConfig().
+			WithEndpoint(server.URL).
+			WithRegion("eu-west-1").
+			WithCredentials(credentials.NewStaticCredentials("AKIDTEST", "secret", "")).
+			WithMaxRetries(0)))
+	}
+	resetOpenAIKeyCache := func() {
+		openAIKeyCache.mu.Lock()
+		openAIKeyCache.key, openAIKeyCache.valid = "", false
+		openAIKeyCache.mu.Unlock()
+	}
+	resetOpenAIKeyCache()
+	t.Cleanup(func() {
+		sharedAWSSession = originalSession
+		resetOpenAIKeyCache()
+	})
+	for _, name := range []string{"OPENAI_API_KEY", "OPENAI_API_KEY_SECRET_ARN", "OPENAI_API_KEY_SSM_PARAM"} {
+		t.Setenv(name, "")
+	}
+	return store
+}
+
+func TestLoadOpenAIKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		want      string
+		wantErr   string
+		wantFetch int
+	}{
+		{name: "environment variable", env: map[string]string{"OPENAI_API_KEY": "sk-env"}, want: "sk-env"},
+		{name: "no key", wantErr: "not found in environment variable OPENAI_API_KEY"},
+		// A secret takes precedence over the plain text variable
+		{name: "secrets manager", env: map[string]string{"OPENAI_API_KEY": "sk-env", "OPENAI_API_KEY_SECRET_ARN": testSecretARN}, want: "sk-secret", wantFetch: 1},
+		{name: "ssm parameter", env: map[string]string{"OPENAI_API_KEY_SSM_PARAM": testSSMParam}, want: "sk-parameter", wantFetch: 1},
+		{name: "both", env: map[string]string{"OPENAI_API_KEY_SECRET_ARN": testSecretARN, "OPENAI_API_KEY_SSM_PARAM": testSSMParam}, wantErr: "Only one of"},
+		{name: "missing secret", env: map[string]string{"OPENAI_API_KEY_SECRET_ARN": testSecretARN + "-old"}, wantErr: "Can't fetch OpenAI API key from Secrets Manager secret", wantFetch: 1},
+		{name: "missing parameter", env: map[string]string{"OPENAI_API_KEY_SSM_PARAM": "/proxy/old"}, wantErr: "Can't fetch OpenAI API key from SSM parameter", wantFetch: 1},
+		{name: "empty secret", env: map[string]string{"OPENAI_API_KEY_SECRET_ARN": testSecretARN + "-empty"}, wantErr: "has no string value", wantFetch: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useFakeSecretStore(t, map[string]string{
+				testSecretARN:            " sk-secret\n",
+				testSSMParam:             "sk-parameter",
+				testSecretARN + "-empty": "",
+			})
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			got, err := loadOpenAIKey(false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("loadOpenAIKey() error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil || got != tt.want {
+				t.Errorf("loadOpenAIKey() = %q, %v, want %q", got, err, tt.want)
+			}
+			if store.fetches() != tt.wantFetch {
+				t.Errorf("fetched %d times, want %d", store.fetches(), tt.wantFetch)
+			}
+		})
+	}
+}
+
+// TestOpenAIKeyCache checks that the key is fetched once per execution environment unless a refresh is forced
+func TestOpenAIKeyCache(t *testing.T) {
+	store := useFakeSecretStore(t, map[string]string{testSecretARN: "sk-old"})
+	t.Setenv("OPENAI_API_KEY_SECRET_ARN", testSecretARN)
+	for i := 0; i < 3; i++ {
+		if key, err := loadOpenAIKey(false); err != nil || key != "sk-old" {
+			t.Fatalf("loadOpenAIKey() = %q, %v, want sk-old", key, err)
+		}
+	}
+	if store.fetches() != 1 {
+		t.Errorf("fetched %d times, want once", store.fetches())
+	}
+
+	store.set(testSecretARN, "sk-new")
+	if key, err := loadOpenAIKey(true); err != nil || key != "sk-new" {
+		t.Fatalf("loadOpenAIKey(refresh) = %q, %v, want sk-new", key, err)
+	}
+	if key, _ := loadOpenAIKey(false); key != "sk-new" || store.fetches() != 2 {
+		t.Errorf("loadOpenAIKey() = %q after %d fetches, want the cached sk-new after 2", key, store.fetches())
+	}
+}
+
+func TestLoadConfigOpenAIKeySecret(t *testing.T) {
+	useFakeSecretStore(t, map[string]string{testSecretARN: "sk-secret"})
+	t.Setenv("OPENAI_MOCK", "false")
+	t.Setenv("OPENAI_API_KEYS", "")
+	t.Setenv("OPENAI_API_KEY_SECRET_ARN", testSecretARN)
+	cfg, err := loadConfig()
+	if err != nil || cfg.OpenAIKey != "sk-secret" {
+		t.Fatalf("loadConfig() = %q, %v, want the key of the secret", cfg.OpenAIKey, err)
+	}
+	// A secret that can't be fetched at cold start fails the startup rather than a request with a 401 later
+	openAIKeyCache.mu.Lock()
+	openAIKeyCache.valid = false
+	openAIKeyCache.mu.Unlock()
+	t.Setenv("OPENAI_API_KEY_SECRET_ARN", testSecretARN+"-deleted")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "Can't fetch OpenAI API key") {
+		t.Errorf("loadConfig() error = %v, want the fetch failure", err)
+	}
+	t.Setenv("OPENAI_API_KEYS", "sk-a,sk-b")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "Only one of") {
+		t.Errorf("loadConfig() error = %v, want OPENAI_API_KEYS and the secret rejected together", err)
+	}
+}
+
+func TestIsUnauthorizedError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "api error", err: &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}, want: true},
+		{name: "request error", err: &openai.RequestError{HTTPStatusCode: http.StatusUnauthorized}, want: true},
+		{name: "wrapped", err: fmt.Errorf("%w: %w", ErrOpenAIRequest, &openai.APIError{HTTPStatusCode: http.StatusUnauthorized}), want: true},
+		{name: "forbidden", err: &openai.APIError{HTTPStatusCode: http.StatusForbidden}},
+		{name: "rate limited", err: &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests}},
+		{name: "no error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isUnauthorizedError(tt.err); got != tt.want {
+				t.Errorf("isUnauthorizedError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOpenAIKeyRefreshedAfter401 rotates the key in Secrets Manager: the 401 of the old key makes the request
+// fetch the secret again and run once more with the new key
+func TestOpenAIKeyRefreshedAfter401(t *testing.T) {
+	tests := []struct {
+		name        string
+		secret      string // Value of the secret when the 401 arrives
+		fromSecret  bool
+		wantStatus  int
+		wantFetches int
+		wantKeys    []string // Keys the OpenAI API was called with after the 401
+	}{
+		{name: "rotated", secret: "sk-new", fromSecret: true, wantStatus: statusCodeOK, wantFetches: 2, wantKeys: []string{"Bearer sk-new"}},
+		{name: "not rotated", secret: "sk-old", fromSecret: true, wantStatus: statusCodeServerError, wantFetches: 2},
+		{name: "environment variable", secret: "sk-new", wantStatus: statusCodeServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useFakeSecretStore(t, map[string]string{testSecretARN: "sk-old"})
+			if tt.fromSecret {
+				t.Setenv("OPENAI_API_KEY_SECRET_ARN", testSecretARN)
+				if _, err := loadOpenAIKey(false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.set(testSecretARN, tt.secret)
+
+			var mu sync.Mutex
+			var keys []string
+			openAI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				keys = append(keys, r.Header.Get("Authorization"))
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"Hello"},"finish_reason":"stop"}]}`)
+			}))
+			defer openAI.Close()
+
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIMock = false
+				cfg.OpenAIKey = "sk-old"
+				cfg.OpenAIBaseURL = openAI.URL
+				cfg.OpenAIMaxRetries = 0
+			})
+			// The client of the old key is rejected, the one built for the refreshed configuration calls the server
+			rejected := testsupport.NewScriptedCompleter(testsupport.Fail(&openai.APIError{HTTPStatusCode: http.StatusUnauthorized, Message: "invalid key"}))
+			h := newTestHandler(cfg, rejected, testsupport.NewRecordingPoster(), nil, nil)
+			h.httpClient = openAI.Client()
+			response, err := h.Handler(context.Background(), testMessage(`{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			if store.fetches() != tt.wantFetches {
+				t.Errorf("fetched the secret %d times, want %d", store.fetches(), tt.wantFetches)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(keys, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("OpenAI called with %q, want %q", keys, tt.wantKeys)
+			}
+			if tt.wantKeys != nil && getConfig().OpenAIKey != "sk-new" {
+				t.Errorf("configuration key = %q, want the refreshed key kept", getConfig().OpenAIKey)
+			}
+		})
+	}
+}
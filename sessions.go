@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+const (
+	actionSessionSummary    = "session_summary"
+	frameTypeSessionSummary = "session_summary"
+	// maxSessionTurns is how many turns of a session are kept for the per-turn breakdown, the aggregates
+	// count every turn
+	maxSessionTurns = 100
+	// sessionSummaryRetention is how long the summary of a session is kept after its connection closed
+	sessionSummaryRetention = 30 * 24 * time.Hour
+)
+
+// modelPrice is the price of a model in US dollars per million tokens
+type modelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// sessionSummaryRequest asks for the usage of a conversation
+type sessionSummaryRequest struct {
+	Action         string `json:"action"`
+	ConversationID string `json:"conversation_id"`
+}
+
+// sessionTurn is one turn of the breakdown of a session summary
+type sessionTurn struct {
+	Turn             int64   `json:"turn"`
+	Model            string  `json:"model,omitempty"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+	At               int64   `json:"at"` // Unix seconds
+}
+
+// sessionSummaryFrame answers a session_summary action with the aggregates of a conversation and its first turns
+type sessionSummaryFrame struct {
+	Type             string        `json:"type"`
+	ConversationID   string        `json:"conversation_id"`
+	Turns            int64         `json:"turns"`
+	PromptTokens     int64         `json:"prompt_tokens"`
+	CompletionTokens int64         `json:"completion_tokens"`
+	TotalTokens      int64         `json:"total_tokens"`
+	CostUSD          float64       `json:"cost_usd"`
+	StartedAt        int64         `json:"started_at,omitempty"`
+	UpdatedAt        int64         `json:"updated_at,omitempty"`
+	ClosedAt         int64         `json:"closed_at,omitempty"` // Set once the connection of the session closed
+	Breakdown        []sessionTurn `json:"breakdown"`
+	Truncated        bool          `json:"truncated,omitempty"` // The breakdown holds the first turns only
+}
+
+// parseModelPrices parses the JSON object of MODEL_PRICES, keyed by model or model alias
+func parseModelPrices(value string, aliases map[string]string) (map[string]modelPrice, error) {
+	prices := make(map[string]modelPrice)
+	if strings.TrimSpace(value) == "" {
+		return prices, nil
+	}
+	var parsed map[string]modelPrice
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		return nil, fmt.Errorf("Invalid value for environment variable MODEL_PRICES, expected a JSON object of prompt and completion prices: %v", err)
+	}
+	for model, price := range parsed {
+		if model == "" || price.Prompt < 0 || price.Completion < 0 {
+			return nil, fmt.Errorf("Invalid value for environment variable MODEL_PRICES, model %q needs a name and prices of at least 0", model)
+		}
+		prices[resolveModelAlias(aliases, model)] = price
+	}
+	return prices, nil
+}
+
+// lookupModelPrice returns the price of model. A dated snapshot like gpt-4o-2024-08-06 is priced like the
+// longest priced model it extends, so prices don't have to list every snapshot.
+func lookupModelPrice(prices map[string]modelPrice, model string) (modelPrice, bool) {
+	if price, ok := prices[model]; ok {
+		return price, true
+	}
+	var found modelPrice
+	longest := 0
+	for name, price := range prices {
+		if len(name) > longest && strings.HasPrefix(model, name+"-") {
+			found, longest = price, len(name)
+		}
+	}
+	return found, longest > 0
+}
+
+// costMicros returns the cost of a completion in millionths of a US dollar, 0 for models without a price.
+// Whole numbers keep the atomic sums of the session summaries exact.
+func costMicros(cfg *Config, info completionInfo) int64 {
+	price, ok := lookupModelPrice(cfg.ModelPrices, info.Model)
+	if !ok {
+		return 0
+	}
+	return int64(math.Round(float64(info.Usage.PromptTokens)*price.Prompt + float64(info.Usage.CompletionTokens)*price.Completion))
+}
+
+// sessionSummaryKey returns the DynamoDB key of the summary of a conversation in CONVERSATIONS_TABLE. The
+// prefix keeps it apart from the histories, whose keys start with the request subject.
+func sessionSummaryKey(subject string, conversationID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"conversation_key": {S: aws.String("summary#" + subject + "#" + conversationID)},
+	}
+}
+
+// recordSessionTurn adds a completed turn to the summary of the conversation of the request. The aggregates
+// are DynamoDB ADDs, so concurrent turns of a session are all counted. The turn is appended to the breakdown
+// while it holds less than maxSessionTurns turns, and the session is noted in the connection record, so the
+// disconnect can close it. Failures are only logged, since the answer has already been produced.
+func recordSessionTurn(openAIRequest openAIRequest, info completionInfo) {
+	cfg := openAIRequest.config
+	conversationID := openAIRequest.request.ConversationID
+	if conversationID == "" || cfg.ConversationsTable == "" {
+		return
+	}
+	ctx := context.WithoutCancel(openAIRequest.ctx)
+	client := openAIRequest.dynamoDBClient
+	now := openAIRequest.getClock().Now()
+	key := sessionSummaryKey(requestSubject(openAIRequest), conversationID)
+	cost := costMicros(cfg, info)
+	values := map[string]*dynamodb.AttributeValue{
+		":one":        {N: aws.String("1")},
+		":prompt":     {N: aws.String(strconv.Itoa(info.Usage.PromptTokens))},
+		":completion": {N: aws.String(strconv.Itoa(info.Usage.CompletionTokens))},
+		":cost":       {N: aws.String(strconv.FormatInt(cost, 10))},
+		":id":         {S: aws.String(conversationID)},
+		":now":        {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		":expires":    {N: aws.String(strconv.FormatInt(now.Add(conversationTTL).Unix(), 10))},
+	}
+	set := "SET conversation_id = :id, started_at = if_not_exists(started_at, :now), updated_at = :now, expires_at = :expires"
+	// The template is kept so a state export can pin the version the session runs on
+	if template := openAIRequest.request.PromptTemplate; template != "" {
+		set += ", prompt_template = :template"
+		values[":template"] = &dynamodb.AttributeValue{S: aws.String(template)}
+	}
+	output, err := client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(cfg.ConversationsTable),
+		Key:                       key,
+		UpdateExpression:          aws.String("ADD turn_count :one, prompt_tokens :prompt, completion_tokens :completion, cost_micros :cost " + set + " REMOVE closed_at"),
+		ExpressionAttributeValues: values,
+		ReturnValues:              aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		openAIRequest.logger().Error("Can't record session turn", "conversation_id", conversationID, "error", err)
+		return
+	}
+
+	turn := map[string]*dynamodb.AttributeValue{
+		"turn":              {N: aws.String(strconv.FormatInt(numberAttribute(output.Attributes, "turn_count"), 10))},
+		"model":             {S: aws.String(info.Model)},
+		"prompt_tokens":     {N: aws.String(strconv.Itoa(info.Usage.PromptTokens))},
+		"completion_tokens": {N: aws.String(strconv.Itoa(info.Usage.CompletionTokens))},
+		"cost_micros":       {N: aws.String(strconv.FormatInt(cost, 10))},
+		"at":                {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+	}
+	_, err = client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(cfg.ConversationsTable),
+		Key:                 key,
+		UpdateExpression:    aws.String("SET turns = list_append(if_not_exists(turns, :empty), :turn)"),
+		ConditionExpression: aws.String("attribute_not_exists(turns) OR size(turns) < :max"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":empty": {L: []*dynamodb.AttributeValue{}},
+			":turn":  {L: []*dynamodb.AttributeValue{{M: turn}}},
+			":max":   {N: aws.String(strconv.Itoa(maxSessionTurns))},
+		},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		openAIRequest.logger().Warn("Can't add turn to session breakdown", "conversation_id", conversationID, "error", err)
+	}
+
+	if cfg.ConnectionsTable == "" || isHTTPRequest(openAIRequest.ctx) {
+		return
+	}
+	_, err = client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(cfg.ConnectionsTable),
+		Key:                 connectionKey(openAIRequest.ConnectionId),
+		UpdateExpression:    aws.String("ADD sessions :session"),
+		ConditionExpression: aws.String("attribute_exists(connection_id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":session": {SS: []*string{key["conversation_key"].S}},
+		},
+	})
+	// A connection without a record has nothing to close its sessions on disconnect
+	if err != nil && !isConditionalCheckFailed(err) {
+		openAIRequest.logger().Warn("Can't note session in connection record", "conversation_id", conversationID, "error", err)
+	}
+}
+
+// closeSessions writes the final state of the sessions of a closed connection: each summary is marked closed
+// and kept for sessionSummaryRetention, so it can be queried after the conversation history expired.
+// Failures are only logged, the connection is gone either way.
+func closeSessions(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, connectionID string, sessions []*string, now time.Time) {
+	if cfg.ConversationsTable == "" {
+		return
+	}
+	for _, session := range sessions {
+		_, err := client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(cfg.ConversationsTable),
+			Key:                 map[string]*dynamodb.AttributeValue{"conversation_key": {S: session}},
+			UpdateExpression:    aws.String("SET closed_at = :now, last_connection_id = :connection, expires_at = :expires"),
+			ConditionExpression: aws.String("attribute_exists(conversation_key)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":now":        {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+				":connection": {S: aws.String(connectionID)},
+				":expires":    {N: aws.String(strconv.FormatInt(now.Add(sessionSummaryRetention).Unix(), 10))},
+			},
+		})
+		if err != nil && !isConditionalCheckFailed(err) {
+			loggerFrom(ctx).Warn("Can't close session summary", "session", aws.StringValue(session), "error", err)
+		}
+	}
+}
+
+// numberAttribute returns the integer of a number attribute, 0 when it is missing
+func numberAttribute(item map[string]*dynamodb.AttributeValue, name string) int64 {
+	value, ok := item[name]
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	return n
+}
+
+// stringAttribute returns the string of a string attribute, empty when it is missing
+func stringAttribute(item map[string]*dynamodb.AttributeValue, name string) string {
+	value, ok := item[name]
+	if !ok {
+		return ""
+	}
+	return aws.StringValue(value.S)
+}
+
+// newSessionSummaryFrame builds the session_summary frame of a stored summary
+func newSessionSummaryFrame(conversationID string, item map[string]*dynamodb.AttributeValue) sessionSummaryFrame {
+	frame := sessionSummaryFrame{
+		Type:             frameTypeSessionSummary,
+		ConversationID:   conversationID,
+		Turns:            numberAttribute(item, "turn_count"),
+		PromptTokens:     numberAttribute(item, "prompt_tokens"),
+		CompletionTokens: numberAttribute(item, "completion_tokens"),
+		CostUSD:          float64(numberAttribute(item, "cost_micros")) / 1e6,
+		StartedAt:        numberAttribute(item, "started_at"),
+		UpdatedAt:        numberAttribute(item, "updated_at"),
+		ClosedAt:         numberAttribute(item, "closed_at"),
+		Breakdown:        []sessionTurn{},
+	}
+	frame.TotalTokens = frame.PromptTokens + frame.CompletionTokens
+	if turns, ok := item["turns"]; ok {
+		for _, turn := range turns.L {
+			frame.Breakdown = append(frame.Breakdown, sessionTurn{
+				Turn:             numberAttribute(turn.M, "turn"),
+				Model:            stringAttribute(turn.M, "model"),
+				PromptTokens:     numberAttribute(turn.M, "prompt_tokens"),
+				CompletionTokens: numberAttribute(turn.M, "completion_tokens"),
+				CostUSD:          float64(numberAttribute(turn.M, "cost_micros")) / 1e6,
+				At:               numberAttribute(turn.M, "at"),
+			})
+		}
+	}
+	frame.Truncated = int64(len(frame.Breakdown)) < frame.Turns
+	return frame
+}
+
+// handleSessionSummary answers a session_summary action with the usage of a conversation of the caller.
+// The frame is split like any large payload when the breakdown doesn't fit one frame.
+func (h *WebsocketHandler) handleSessionSummary(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var summary sessionSummaryRequest
+	if err := json.Unmarshal([]byte(request.Body), &summary); err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing session summary JSON: %s", err), statusCodeBadRequest)
+	}
+	if cfg.ConversationsTable == "" {
+		return errorResponse("Session summaries are not supported without a conversations table", statusCodeBadRequest)
+	}
+	if summary.ConversationID == "" || len(summary.ConversationID) > maxRequestIDLength {
+		return errorResponse(fmt.Sprintf("Session summary conversation_id must be 1 to %d characters", maxRequestIDLength), statusCodeBadRequest)
+	}
+	target := openAIRequest{
+		ctx:          ctx,
+		config:       cfg,
+		poster:       h.getConnectionPoster(ctx, cfg),
+		ConnectionId: request.RequestContext.ConnectionID,
+		identity:     identityFrom(ctx),
+	}
+
+	output, err := h.getDynamoDBClient(cfg).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.ConversationsTable),
+		Key:            sessionSummaryKey(requestSubject(target), summary.ConversationID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("Can't read session summary", "conversation_id", summary.ConversationID, "error", err)
+		return errorResponse(fmt.Sprintf("Can't read session summary: %s", err), statusCodeServerError)
+	}
+	if len(output.Item) == 0 {
+		return errorResponse(fmt.Sprintf("Unknown session: %s", summary.ConversationID), statusCodeNotFound)
+	}
+
+	payload, err := json.Marshal(newSessionSummaryFrame(summary.ConversationID, output.Item))
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode session summary: %s", err), statusCodeServerError)
+	}
+	if err := postFrames(target, payload); err != nil {
+		loggerFrom(ctx).Warn("Can't post session summary", "error", err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
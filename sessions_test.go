@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestLookupModelPrice(t *testing.T) {
+	prices, err := parseModelPrices(`{"gpt-4o":{"prompt":2.5,"completion":10},"gpt-4o-mini":{"prompt":0.15,"completion":0.6},"fast":{"prompt":1,"completion":2}}`, map[string]string{"fast": "gpt-3.5-turbo"})
+	if err != nil {
+		t.Fatalf("parseModelPrices() error = %v", err)
+	}
+	tests := []struct {
+		model string
+		want  modelPrice
+		found bool
+	}{
+		{model: "gpt-4o", want: modelPrice{Prompt: 2.5, Completion: 10}, found: true},
+		{model: "gpt-4o-2024-08-06", want: modelPrice{Prompt: 2.5, Completion: 10}, found: true},
+		{model: "gpt-4o-mini-2024-07-18", want: modelPrice{Prompt: 0.15, Completion: 0.6}, found: true},
+		{model: "gpt-3.5-turbo", want: modelPrice{Prompt: 1, Completion: 2}, found: true},
+		{model: "gpt-4o1"},
+		{model: "o1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			got, found := lookupModelPrice(prices, tt.model)
+			if got != tt.want || found != tt.found {
+				t.Fatalf("lookupModelPrice() = %+v, %v, want %+v, %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+
+	for _, value := range []string{`[]`, `{"gpt-4o":{"prompt":-1}}`, `{"":{}}`} {
+		if _, err := parseModelPrices(value, nil); err == nil {
+			t.Errorf("parseModelPrices(%s) succeeded, want an error", value)
+		}
+	}
+}
+
+// TestSessionSummary runs three turns of a conversation on one connection, asks for the summary and closes
+// the connection, which keeps the summary past the history
+func TestSessionSummary(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConversationsTable = "conversations"
+		cfg.ConnectionsTable = "connections"
+		cfg.ModelPrices = map[string]modelPrice{"gpt-4o": {Prompt: 2.5, Completion: 10}}
+	})
+	var turns []testsupport.Turn
+	for i, usage := range []openai.Usage{
+		{PromptTokens: 100, CompletionTokens: 20},
+		{PromptTokens: 220, CompletionTokens: 40},
+		{PromptTokens: 400, CompletionTokens: 80},
+	} {
+		turn := testsupport.Reply("answer " + string(rune('A'+i)))
+		turn.Response.Model = "gpt-4o-2024-08-06"
+		turn.Response.Usage = usage
+		turns = append(turns, turn)
+	}
+	clock := testsupport.NewClock(testStart)
+	db := newFakeDynamoDB().table("conversations", "conversation_key").table("connections", "connection_id")
+	poster := testsupport.NewRecordingPoster()
+	h := newTestHandler(cfg, testsupport.NewScriptedCompleter(turns...), poster, db, clock)
+	ctx := context.Background()
+
+	connect := testMessage("")
+	connect.RequestContext.RouteKey = connectRouteKey
+	if response, err := h.Handler(ctx, connect); err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("$connect = %d, %v", response.StatusCode, err)
+	}
+	for i := 0; i < 3; i++ {
+		body := `{"response_type":"full","prompt_template":"PROMPT_TEST","conversation_id":"chat-1","messages":[{"role":"user","content":"next"}]}`
+		if response, err := h.Handler(ctx, testMessage(body)); err != nil || response.StatusCode != statusCodeOK {
+			t.Fatalf("turn %d = %d, %v", i+1, response.StatusCode, err)
+		}
+		clock.Advance(time.Minute)
+	}
+
+	posted := len(poster.Frames())
+	if response, err := h.Handler(ctx, testMessage(`{"action":"session_summary","conversation_id":"chat-1"}`)); err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("session_summary = %d, %v", response.StatusCode, err)
+	}
+	frames := poster.Texts()[posted:]
+	if len(frames) != 1 {
+		t.Fatalf("session_summary posted %q, want one frame", frames)
+	}
+	var summary sessionSummaryFrame
+	if err := json.Unmarshal([]byte(frames[0]), &summary); err != nil {
+		t.Fatalf("can't decode %s: %v", frames[0], err)
+	}
+	// 720 prompt tokens at $2.50 and 140 completion tokens at $10 per million
+	want := sessionSummaryFrame{
+		Type: frameTypeSessionSummary, ConversationID: "chat-1", Turns: 3,
+		PromptTokens: 720, CompletionTokens: 140, TotalTokens: 860, CostUSD: 0.0032,
+		StartedAt: testStart.Unix(), UpdatedAt: testStart.Add(2 * time.Minute).Unix(),
+	}
+	if summary.Type != want.Type || summary.ConversationID != want.ConversationID || summary.Turns != want.Turns ||
+		summary.PromptTokens != want.PromptTokens || summary.CompletionTokens != want.CompletionTokens ||
+		summary.TotalTokens != want.TotalTokens || summary.CostUSD != want.CostUSD ||
+		summary.StartedAt != want.StartedAt || summary.UpdatedAt != want.UpdatedAt || summary.ClosedAt != 0 || summary.Truncated {
+		t.Fatalf("summary = %+v, want %+v", summary, want)
+	}
+	if len(summary.Breakdown) != 3 {
+		t.Fatalf("breakdown = %+v, want 3 turns", summary.Breakdown)
+	}
+	for i, turn := range summary.Breakdown {
+		if turn.Turn != int64(i+1) || turn.Model != "gpt-4o-2024-08-06" || turn.At != testStart.Add(time.Duration(i)*time.Minute).Unix() {
+			t.Fatalf("breakdown turn %d = %+v", i, turn)
+		}
+	}
+	if summary.Breakdown[2].PromptTokens != 400 || summary.Breakdown[2].CostUSD != 0.0018 {
+		t.Fatalf("third turn = %+v, want 400 prompt tokens costing $0.0018", summary.Breakdown[2])
+	}
+
+	disconnect := testMessage("")
+	disconnect.RequestContext.RouteKey = disconnectRouteKey
+	if response, err := h.Handler(ctx, disconnect); err != nil || response.StatusCode != statusCodeOK {
+		t.Fatalf("$disconnect = %d, %v", response.StatusCode, err)
+	}
+	item := db.item("conversations", sessionSummaryKey("connection#conn-1", "chat-1"))
+	closedAt := testStart.Add(3 * time.Minute)
+	if numberAttribute(item, "closed_at") != closedAt.Unix() || numberAttribute(item, "turn_count") != 3 ||
+		numberAttribute(item, "expires_at") != closedAt.Add(sessionSummaryRetention).Unix() ||
+		aws.StringValue(item["last_connection_id"].S) != "conn-1" {
+		t.Fatalf("summary after disconnect = %v", item)
+	}
+	if db.item("connections", connectionKey("conn-1")) != nil {
+		t.Fatal("connection record kept after disconnect")
+	}
+}
+
+func TestSessionSummaryBreakdownIsCapped(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = "conversations" })
+	db := newFakeDynamoDB()
+	openAIRequest := openAIRequest{
+		ctx: context.Background(), config: cfg, dynamoDBClient: db, ConnectionId: "conn-1",
+		request: Request{ConversationID: "chat-1"},
+	}
+	for i := 0; i < maxSessionTurns+5; i++ {
+		recordSessionTurn(openAIRequest, completionInfo{Usage: openai.Usage{PromptTokens: 1, CompletionTokens: 1}})
+	}
+	item := db.item("conversations", sessionSummaryKey("connection#conn-1", "chat-1"))
+	frame := newSessionSummaryFrame("chat-1", item)
+	if frame.Turns != maxSessionTurns+5 || len(frame.Breakdown) != maxSessionTurns || !frame.Truncated {
+		t.Fatalf("summary has %d turns and %d in the breakdown, truncated %v", frame.Turns, len(frame.Breakdown), frame.Truncated)
+	}
+}
+
+func TestSessionSummaryRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		table      string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "no table", body: `{"action":"session_summary","conversation_id":"chat-1"}`, wantStatus: statusCodeBadRequest, wantError: "not supported"},
+		{name: "no conversation", table: "conversations", body: `{"action":"session_summary"}`, wantStatus: statusCodeBadRequest, wantError: "conversation_id"},
+		{name: "unknown", table: "conversations", body: `{"action":"session_summary","conversation_id":"chat-1"}`, wantStatus: statusCodeNotFound, wantError: "Unknown session"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.ConversationsTable = tt.table })
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(), testsupport.NewRecordingPoster(), nil, nil)
+			response, err := h.Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus || !strings.Contains(response.Body, tt.wantError) {
+				t.Fatalf("Handler() = %d %q, %v, want %d containing %q", response.StatusCode, response.Body, err, tt.wantStatus, tt.wantError)
+			}
+		})
+	}
+}
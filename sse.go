@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdaurl"
+	"github.com/sashabaranov/go-openai"
+)
+
+const contentTypeEventStream = "text/event-stream"
+
+// sseWriter is the ConnectionPoster of Lambda Function URL requests. The request is answered with protocol v2
+// envelopes, which the writer turns into Server-Sent Events: answer text becomes unnamed data events,
+// everything else an event named after the envelope type. The response only starts with the first event,
+// so a request failing before it still gets its HTTP status.
+type sseWriter struct {
+	w            http.ResponseWriter
+	started      bool
+	ended        bool
+	errorCode    string // Code of an error posted before the response started
+	finishReason openai.FinishReason
+	model        string
+}
+
+// sseEnd is the data of the end event
+type sseEnd struct {
+	FinishReason openai.FinishReason `json:"finish_reason,omitempty"`
+	Model        string              `json:"model,omitempty"`
+}
+
+// PostToConnection writes one envelope of the answer as an event
+func (s *sseWriter) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	var envelope struct {
+		Type         string              `json:"type"`
+		Code         string              `json:"code"`
+		Data         json.RawMessage     `json:"data"`
+		FinishReason openai.FinishReason `json:"finish_reason"`
+		Model        string              `json:"model"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return fmt.Errorf("Can't decode envelope: %v", err)
+	}
+	switch envelope.Type {
+	case frameTypeChunk, frameTypeFinal:
+		var text string
+		if err := json.Unmarshal(envelope.Data, &text); err != nil {
+			return fmt.Errorf("Can't decode %s envelope: %v", envelope.Type, err)
+		}
+		s.finishReason, s.model = envelope.FinishReason, envelope.Model
+		return s.event("", text)
+	case frameTypeEnd:
+		s.finishReason, s.model = envelope.FinishReason, envelope.Model
+		return s.end()
+	case frameTypeError:
+		if !s.started {
+			s.errorCode = envelope.Code
+			return nil
+		}
+		var message string
+		if json.Unmarshal(envelope.Data, &message) != nil {
+			message = string(envelope.Data)
+		}
+		payload, _ := json.Marshal(map[string]string{"code": envelope.Code, "message": message})
+		return s.event(frameTypeError, string(payload))
+	default:
+		return s.event(envelope.Type, string(envelope.Data))
+	}
+}
+
+// event writes one event, splitting data over several data lines where it contains line breaks
+func (s *sseWriter) event(name string, data string) error {
+	if !s.started {
+		s.w.Header().Set("Content-Type", contentTypeEventStream)
+		s.w.Header().Set("Cache-Control", "no-cache")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	var event strings.Builder
+	if name != "" {
+		fmt.Fprintf(&event, "event: %s\n", name)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&event, "data: %s\n", line)
+	}
+	event.WriteString("\n")
+	if _, err := io.WriteString(s.w, event.String()); err != nil {
+		// The client closed the response, which is what a gone websocket connection means too
+		return fmt.Errorf("%w: %v", ErrClientGone, err)
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// end writes the end event once
+func (s *sseWriter) end() error {
+	if s.ended {
+		return nil
+	}
+	s.ended = true
+	payload, _ := json.Marshal(sseEnd{FinishReason: s.finishReason, Model: s.model})
+	return s.event(frameTypeEnd, string(payload))
+}
+
+// sseHandler serves requests to a Lambda Function URL with RESPONSE_STREAM invoke mode. The body is a regular
+// request, served like a websocket message with the same authorization, and the answer is streamed as Server-Sent
+// Events. Non-stream response types send their answer as a single event. Every answer ends with an end event.
+func (h *WebsocketHandler) sseHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := refreshStaleConfig(r.Context())
+		requestID := ""
+		if request, ok := lambdaurl.RequestFromContext(r.Context()); ok {
+			requestID = request.RequestContext.RequestID
+		}
+		ctx := withLogger(r.Context(), slog.Default().With("request_id", requestID, "model", cfg.OpenAIModel))
+		ctx = context.WithValue(ctx, httpRequestKey{}, true)
+		h.serveSSE(ctx, cfg, w, r, requestID)
+	})
+}
+
+// serveSSE answers one Function URL request
+func (h *WebsocketHandler) serveSSE(ctx context.Context, cfg *Config, w http.ResponseWriter, r *http.Request, requestID string) {
+	query := make(map[string]string)
+	for name := range r.URL.Query() {
+		query[name] = r.URL.Query().Get(name)
+	}
+	headers := make(map[string]string)
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+	ctx, err := h.authorizeHTTP(ctx, cfg, query, headers)
+	if errors.Is(err, errJWKSUnavailable) {
+		loggerFrom(ctx).Error("Can't verify id_token", "error", err)
+		writeHTTPError(w, httpError(statusCodeUnavailable, errorCodeInternal, err.Error()))
+		return
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("Function URL request rejected", "error", err)
+		writeHTTPError(w, httpError(statusCodeUnauthorized, errorCodeInvalidRequest, err.Error()))
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeHTTPError(w, httpError(statusCodeBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Error reading request body: %s", err)))
+		return
+	}
+	reqBody, err := parseRequestBody(string(body))
+	if err != nil {
+		loggerFrom(ctx).Warn("Can't parse request JSON", "error", err)
+		writeHTTPError(w, httpError(statusCodeBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Error parsing request JSON: %s", err)))
+		return
+	}
+	if reqBody.Async {
+		writeHTTPError(w, httpError(statusCodeBadRequest, errorCodeInvalidRequest, "async is not supported by a Function URL"))
+		return
+	}
+	reqBody.Protocol = protocolV2
+
+	writer := &sseWriter{w: w}
+	// The request ID of the invocation stands in for the connection in rate limits and quotas
+	response, _ := h.serveRequest(ctx, cfg, reqBody, "url#"+requestID, writer)
+	switch {
+	case !writer.started && response.StatusCode != statusCodeOK:
+		code := writer.errorCode
+		if code == "" {
+			code = httpErrorCode(response.StatusCode)
+		}
+		writeHTTPError(w, httpError(response.StatusCode, code, response.Body))
+	case response.StatusCode == statusCodeOK:
+		if err := writer.end(); err != nil {
+			loggerFrom(ctx).Info("Function URL response closed before the end event", "error", err)
+		}
+	}
+}
+
+// writeHTTPError writes an error response built by httpError
+func writeHTTPError(w http.ResponseWriter, response events.APIGatewayV2HTTPResponse) {
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(response.StatusCode)
+	io.WriteString(w, response.Body)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdaurl"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// serveTestSSE sends body through the Function URL entry point of a handler answering with chat and returns the
+// status, headers and body of the streamed response
+func serveTestSSE(t *testing.T, cfg *Config, chat ChatCompleter, body string, headers map[string]string) (int, map[string]string, string) {
+	t.Helper()
+	request := &events.LambdaFunctionURLRequest{
+		RawPath: "/",
+		Headers: headers,
+		Body:    body,
+		RequestContext: events.LambdaFunctionURLRequestContext{
+			RequestID:  "inv-1",
+			DomainName: "abc.lambda-url.eu-west-1.on.aws",
+			HTTP:       events.LambdaFunctionURLRequestContextHTTPDescription{Method: http.MethodPost},
+		},
+	}
+	response, err := lambdaurl.Wrap(newTestHandler(cfg, chat, nil, nil, nil).sseHandler())(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Function URL handler error = %v", err)
+	}
+	streamed, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("reading the response body: %v", err)
+	}
+	return response.StatusCode, response.Headers, string(streamed)
+}
+
+func TestSSEHandler(t *testing.T) {
+	token := signTestToken(t, testAuthSecret, authClaims{Subject: "user-1", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	tests := []struct {
+		name            string
+		body            string
+		turns           []testsupport.Turn
+		auth            bool
+		headers         map[string]string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "stream",
+			body:            `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turns:           []testsupport.Turn{testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo", " world")...)},
+			wantStatus:      http.StatusOK,
+			wantContentType: contentTypeEventStream,
+			wantBody:        "data: Hel\n\ndata: lo\n\ndata:  world\n\nevent: end\ndata: {\"finish_reason\":\"stop\",\"model\":\"gpt-test\"}\n\n",
+		},
+		{
+			name:            "multi-line delta",
+			body:            `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turns:           []testsupport.Turn{testsupport.Stream(testsupport.TextChunks(0, "one\ntwo")...)},
+			wantStatus:      http.StatusOK,
+			wantContentType: contentTypeEventStream,
+			wantBody:        "data: one\ndata: two\n\nevent: end\ndata: {\"finish_reason\":\"stop\",\"model\":\"gpt-test\"}\n\n",
+		},
+		{
+			name:            "extractor answers with one event",
+			body:            `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turns:           []testsupport.Turn{testsupport.Reply("The score is [[4]]")},
+			wantStatus:      http.StatusOK,
+			wantContentType: contentTypeEventStream,
+			wantBody:        "data: 4\n\nevent: end\ndata: {\"finish_reason\":\"stop\",\"model\":\"gpt-test\"}\n\n",
+		},
+		{
+			name:       "failure before the first event",
+			body:       `{"response_type":"int","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turns:      []testsupport.Turn{testsupport.Reply("no idea")},
+			wantStatus: http.StatusBadGateway,
+			wantBody:   `"code":"parse_error"`,
+		},
+		{name: "malformed body", body: `{"response_type":`, wantStatus: http.StatusBadRequest, wantBody: "Error parsing request JSON"},
+		{
+			name:       "async",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","async":true,"messages":[{"role":"user","content":"hi"}]}`,
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "async is not supported by a Function URL",
+		},
+		{
+			name:       "missing token",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			auth:       true,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:            "bearer token",
+			body:            `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			turns:           []testsupport.Turn{testsupport.Reply("Hello")},
+			auth:            true,
+			headers:         map[string]string{"Authorization": "Bearer " + token},
+			wantStatus:      http.StatusOK,
+			wantContentType: contentTypeEventStream,
+			wantBody:        "data: Hello\n\nevent: end\ndata: {\"finish_reason\":\"stop\",\"model\":\"gpt-test\"}\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.OpenAIMaxRetries = 0
+				cfg.OpenAIJSONRetries = 0
+				// Every delta is its own event
+				cfg.StreamFlushInterval, cfg.StreamFlushBytes = 0, 1
+				if tt.auth {
+					cfg.AuthMode, cfg.AuthSecret = authModeToken, testAuthSecret
+				}
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turns...)
+			status, headers, body := serveTestSSE(t, cfg, chat, tt.body, tt.headers)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d %s, want %d", status, body, tt.wantStatus)
+			}
+			if tt.wantContentType != "" {
+				if headers["Content-Type"] != tt.wantContentType {
+					t.Errorf("Content-Type = %q, want %q", headers["Content-Type"], tt.wantContentType)
+				}
+				if body != tt.wantBody {
+					t.Errorf("body = %q, want %q", body, tt.wantBody)
+				}
+				return
+			}
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSSEWriterEnvelopes(t *testing.T) {
+	tests := []struct {
+		name      string
+		envelopes []string
+		want      string
+	}{
+		{
+			name:      "named events",
+			envelopes: []string{`{"type":"usage","seq":0,"data":{"total_tokens":12}}`, `{"type":"end","seq":1,"finish_reason":"length","model":"gpt-test"}`},
+			want:      "event: usage\ndata: {\"total_tokens\":12}\n\nevent: end\ndata: {\"finish_reason\":\"length\",\"model\":\"gpt-test\"}\n\n",
+		},
+		{
+			name:      "error after the first event",
+			envelopes: []string{`{"type":"chunk","seq":0,"data":"Hel"}`, `{"type":"error","seq":1,"code":"openai_error","data":"stream broke"}`},
+			want:      "data: Hel\n\nevent: error\ndata: {\"code\":\"openai_error\",\"message\":\"stream broke\"}\n\n",
+		},
+		{
+			// The end event is only written once, however many end envelopes arrive
+			name:      "repeated end",
+			envelopes: []string{`{"type":"final","seq":0,"data":"Hello","finish_reason":"stop"}`, `{"type":"end","seq":1,"finish_reason":"stop"}`, `{"type":"end","seq":2,"finish_reason":"stop"}`},
+			want:      "data: Hello\n\nevent: end\ndata: {\"finish_reason\":\"stop\"}\n\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			writer := &sseWriter{w: recorder}
+			for _, envelope := range tt.envelopes {
+				if err := writer.PostToConnection(context.Background(), "url#inv-1", []byte(envelope)); err != nil {
+					t.Fatalf("PostToConnection(%s) error = %v", envelope, err)
+				}
+			}
+			if got := recorder.Body.String(); got != tt.want {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// An error before the first event is kept for the HTTP error response instead of being streamed
+	recorder := httptest.NewRecorder()
+	writer := &sseWriter{w: recorder}
+	if err := writer.PostToConnection(context.Background(), "url#inv-1", []byte(`{"type":"error","seq":0,"code":"content_flagged","data":"flagged"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if writer.started || writer.errorCode != "content_flagged" || recorder.Body.Len() != 0 {
+		t.Errorf("writer = %+v with body %q, want the error code kept and nothing written", writer, recorder.Body)
+	}
+}
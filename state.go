@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	actionExportState    = "export_state"
+	actionImportState    = "import_state"
+	frameTypeStateExport = "state_export"
+	frameTypeStateImport = "state_import"
+	// stateFormatVersion is the version of the exported state, imports of other versions are refused
+	stateFormatVersion = 1
+)
+
+// errStateIdentity refuses state whose user isn't the user of the target connection
+var errStateIdentity = errors.New("state belongs to another user")
+
+// stateRequest is sent by an admin connection to export the state of a connection, or to import state into one
+type stateRequest struct {
+	Action       string           `json:"action"`
+	ConnectionID string           `json:"connection_id"`
+	Secret       string           `json:"secret,omitempty"` // Authorizes connections without the admin flag when it matches BROADCAST_SECRET
+	State        *connectionState `json:"state,omitempty"`  // State to import
+}
+
+// connectionState is the versioned state of the user of a connection, moved between stacks on a cutover
+type connectionState struct {
+	Version    int               `json:"version"`
+	Subject    string            `json:"subject"` // User the state belongs to, as the rate limits and quotas account it
+	ExportedAt int64             `json:"exported_at"`
+	Settings   map[string]string `json:"settings,omitempty"` // Query string parameters the connection was opened with
+	Usage      *stateUsage       `json:"usage,omitempty"`
+	Sessions   []stateSession    `json:"sessions"`
+}
+
+// stateUsage is the daily token usage of the user on the day of the export
+type stateUsage struct {
+	Date   string `json:"date"`
+	Tokens int64  `json:"tokens"`
+}
+
+// stateSession is one conversation of the user: its history, its summary and the prompt template it uses
+type stateSession struct {
+	ConversationID string         `json:"conversation_id"`
+	Messages       []chatMessage  `json:"messages"`
+	Summary        stateSummary   `json:"summary"`
+	Template       *stateTemplate `json:"template,omitempty"`
+}
+
+// stateSummary holds the counters of a session summary
+type stateSummary struct {
+	Turns            int64       `json:"turns"`
+	PromptTokens     int64       `json:"prompt_tokens"`
+	CompletionTokens int64       `json:"completion_tokens"`
+	CostMicros       int64       `json:"cost_micros"`
+	StartedAt        int64       `json:"started_at,omitempty"`
+	UpdatedAt        int64       `json:"updated_at,omitempty"`
+	Breakdown        []stateTurn `json:"breakdown,omitempty"`
+}
+
+// stateTurn is one turn of the breakdown of a session summary
+type stateTurn struct {
+	Turn             int64  `json:"turn"`
+	Model            string `json:"model,omitempty"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	CostMicros       int64  `json:"cost_micros"`
+	At               int64  `json:"at"`
+}
+
+// stateTemplate pins the prompt template of a session to the version the old stack served, identified by
+// the SHA-256 digest of its text
+type stateTemplate struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+}
+
+// stateExportFrame answers an export_state action
+type stateExportFrame struct {
+	Type  string          `json:"type"`
+	State connectionState `json:"state"`
+}
+
+// stateImportFailure is a session an import refused
+type stateImportFailure struct {
+	ConversationID string `json:"conversation_id"`
+	Error          string `json:"error"`
+}
+
+// stateImportFrame answers an import_state action. Each session is imported completely or not at all.
+type stateImportFrame struct {
+	Type             string               `json:"type"`
+	Imported         []string             `json:"imported"`
+	Failed           []stateImportFailure `json:"failed,omitempty"`
+	UsageImported    bool                 `json:"usage_imported,omitempty"`
+	SettingsImported bool                 `json:"settings_imported,omitempty"`
+	ChangedTemplates []string             `json:"changed_templates,omitempty"` // Templates whose text differs from the exported version
+}
+
+// connectionStateTarget loads the record of the connection whose state is moved, returning a request of the
+// connection carrying its user, and the record. A connection without an authenticated user has no state that
+// could be matched to the same user on another stack.
+func connectionStateTarget(ctx context.Context, client dynamodbiface.DynamoDBAPI, cfg *Config, connectionID string) (openAIRequest, map[string]*dynamodb.AttributeValue, error) {
+	output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.ConnectionsTable),
+		Key:            connectionKey(connectionID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return openAIRequest{}, nil, fmt.Errorf("Can't look up connection record: %v", err)
+	}
+	if len(output.Item) == 0 {
+		return openAIRequest{}, nil, nil
+	}
+	ctx = withConnectionRecord(ctx, output.Item)
+	target := openAIRequest{ctx: ctx, config: cfg, dynamoDBClient: client, ConnectionId: connectionID, identity: identityFrom(ctx)}
+	return target, output.Item, nil
+}
+
+// templateDigest returns the SHA-256 digest of the text of a prompt template
+func templateDigest(ctx context.Context, openAIRequest openAIRequest, name string) (string, error) {
+	prompt, err := getPromptTemplate(ctx, openAIRequest, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// exportConnectionState reads the sessions noted in the connection record, their histories and summaries,
+// and the daily usage of the user
+func exportConnectionState(ctx context.Context, target openAIRequest, record map[string]*dynamodb.AttributeValue) (connectionState, error) {
+	cfg := target.config
+	client := target.dynamoDBClient
+	now := target.getClock().Now()
+	subject := requestSubject(target)
+	state := connectionState{Version: stateFormatVersion, Subject: subject, ExportedAt: now.Unix(), Sessions: []stateSession{}}
+	if params, ok := record["query_params"]; ok {
+		state.Settings = make(map[string]string, len(params.M))
+		for name, value := range params.M {
+			state.Settings[name] = aws.StringValue(value.S)
+		}
+	}
+
+	var sessions []*string
+	if noted, ok := record["sessions"]; ok {
+		sessions = noted.SS
+	}
+	prefix := "summary#" + subject + "#"
+	for _, key := range sessions {
+		conversationID, ok := strings.CutPrefix(aws.StringValue(key), prefix)
+		if !ok || cfg.ConversationsTable == "" {
+			continue
+		}
+		session := stateSession{ConversationID: conversationID, Messages: []chatMessage{}}
+		summary, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(cfg.ConversationsTable),
+			Key:            sessionSummaryKey(subject, conversationID),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return state, fmt.Errorf("Can't read summary of session %s: %v", conversationID, err)
+		}
+		if len(summary.Item) == 0 {
+			// The summary expired, the history expired before it
+			continue
+		}
+		session.Summary = newStateSummary(summary.Item)
+		// A name that isn't a prompt template is left out rather than digested, it could be any variable
+		if name := stringAttribute(summary.Item, "prompt_template"); name != "" && checkPromptTemplateName(cfg, name) == nil {
+			digest, err := templateDigest(ctx, target, name)
+			if err != nil {
+				return state, fmt.Errorf("Can't read prompt template of session %s: %v", conversationID, err)
+			}
+			session.Template = &stateTemplate{Name: name, Digest: digest}
+		}
+		historyRequest := target
+		historyRequest.request.ConversationID = conversationID
+		messages, err := loadConversation(ctx, historyRequest)
+		if err != nil {
+			return state, err
+		}
+		if messages != nil {
+			session.Messages = messages
+		}
+		state.Sessions = append(state.Sessions, session)
+	}
+
+	if cfg.UsageTable != "" {
+		day := usageDay(now)
+		tokens, err := getDailyUsage(ctx, client, cfg, subject, day)
+		if err != nil {
+			return state, err
+		}
+		state.Usage = &stateUsage{Date: day, Tokens: tokens}
+	}
+	return state, nil
+}
+
+// newStateSummary copies the counters of a stored session summary
+func newStateSummary(item map[string]*dynamodb.AttributeValue) stateSummary {
+	summary := stateSummary{
+		Turns:            numberAttribute(item, "turn_count"),
+		PromptTokens:     numberAttribute(item, "prompt_tokens"),
+		CompletionTokens: numberAttribute(item, "completion_tokens"),
+		CostMicros:       numberAttribute(item, "cost_micros"),
+		StartedAt:        numberAttribute(item, "started_at"),
+		UpdatedAt:        numberAttribute(item, "updated_at"),
+	}
+	if turns, ok := item["turns"]; ok {
+		for _, turn := range turns.L {
+			summary.Breakdown = append(summary.Breakdown, stateTurn{
+				Turn:             numberAttribute(turn.M, "turn"),
+				Model:            stringAttribute(turn.M, "model"),
+				PromptTokens:     numberAttribute(turn.M, "prompt_tokens"),
+				CompletionTokens: numberAttribute(turn.M, "completion_tokens"),
+				CostMicros:       numberAttribute(turn.M, "cost_micros"),
+				At:               numberAttribute(turn.M, "at"),
+			})
+		}
+	}
+	return summary
+}
+
+// checkConnectionState validates the envelope of imported state
+func checkConnectionState(state *connectionState) error {
+	if state == nil {
+		return fmt.Errorf("state is required")
+	}
+	if state.Version != stateFormatVersion {
+		return fmt.Errorf("state version %d is not supported, expected %d", state.Version, stateFormatVersion)
+	}
+	if state.Subject == "" {
+		return fmt.Errorf("state subject is required")
+	}
+	return nil
+}
+
+// checkStateSession validates a session before any of it is written
+func checkStateSession(cfg *Config, session stateSession) error {
+	if session.ConversationID == "" || len(session.ConversationID) > maxRequestIDLength {
+		return fmt.Errorf("conversation_id must be 1 to %d characters", maxRequestIDLength)
+	}
+	if len(session.Messages) > cfg.MaxMessages {
+		return fmt.Errorf("messages has %d entries, at most %d are allowed", len(session.Messages), cfg.MaxMessages)
+	}
+	for i, message := range session.Messages {
+		switch message.Role {
+		case openai.ChatMessageRoleSystem, openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant, openai.ChatMessageRoleTool:
+		default:
+			return fmt.Errorf("messages[%d].role %q is not valid", i, message.Role)
+		}
+	}
+	summary := session.Summary
+	if summary.Turns < 0 || summary.PromptTokens < 0 || summary.CompletionTokens < 0 || summary.CostMicros < 0 {
+		return fmt.Errorf("summary counters can't be negative")
+	}
+	if len(summary.Breakdown) > maxSessionTurns || int64(len(summary.Breakdown)) > summary.Turns {
+		return fmt.Errorf("summary breakdown has %d turns for %d turns of at most %d kept", len(summary.Breakdown), summary.Turns, maxSessionTurns)
+	}
+	if session.Template != nil {
+		if err := checkPromptTemplateName(cfg, session.Template.Name); err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+	}
+	return nil
+}
+
+// stateSessionWrites returns the writes importing a session: its history, its summary, and the note of the
+// session in the connection record. None of them overwrites a session the new stack already has.
+func stateSessionWrites(target openAIRequest, session stateSession, now time.Time) ([]*dynamodb.TransactWriteItem, error) {
+	cfg := target.config
+	subject := requestSubject(target)
+	expires := &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Add(conversationTTL).Unix(), 10))}
+	notExists := aws.String("attribute_not_exists(conversation_key)")
+
+	history, err := json.Marshal(session.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("Can't encode conversation: %v", err)
+	}
+	historyItem := conversationKey(target, session.ConversationID)
+	historyItem["messages"] = &dynamodb.AttributeValue{S: aws.String(string(history))}
+	historyItem["expires_at"] = expires
+
+	summaryKey := sessionSummaryKey(subject, session.ConversationID)
+	summaryItem := map[string]*dynamodb.AttributeValue{
+		"conversation_key":  summaryKey["conversation_key"],
+		"conversation_id":   {S: aws.String(session.ConversationID)},
+		"turn_count":        {N: aws.String(strconv.FormatInt(session.Summary.Turns, 10))},
+		"prompt_tokens":     {N: aws.String(strconv.FormatInt(session.Summary.PromptTokens, 10))},
+		"completion_tokens": {N: aws.String(strconv.FormatInt(session.Summary.CompletionTokens, 10))},
+		"cost_micros":       {N: aws.String(strconv.FormatInt(session.Summary.CostMicros, 10))},
+		"started_at":        {N: aws.String(strconv.FormatInt(session.Summary.StartedAt, 10))},
+		"updated_at":        {N: aws.String(strconv.FormatInt(session.Summary.UpdatedAt, 10))},
+		"expires_at":        expires,
+	}
+	if session.Template != nil {
+		summaryItem["prompt_template"] = &dynamodb.AttributeValue{S: aws.String(session.Template.Name)}
+	}
+	turns := make([]*dynamodb.AttributeValue, 0, len(session.Summary.Breakdown))
+	for _, turn := range session.Summary.Breakdown {
+		turns = append(turns, &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+			"turn":              {N: aws.String(strconv.FormatInt(turn.Turn, 10))},
+			"model":             {S: aws.String(turn.Model)},
+			"prompt_tokens":     {N: aws.String(strconv.FormatInt(turn.PromptTokens, 10))},
+			"completion_tokens": {N: aws.String(strconv.FormatInt(turn.CompletionTokens, 10))},
+			"cost_micros":       {N: aws.String(strconv.FormatInt(turn.CostMicros, 10))},
+			"at":                {N: aws.String(strconv.FormatInt(turn.At, 10))},
+		}})
+	}
+	summaryItem["turns"] = &dynamodb.AttributeValue{L: turns}
+
+	return []*dynamodb.TransactWriteItem{
+		{Put: &dynamodb.Put{TableName: aws.String(cfg.ConversationsTable), Item: historyItem, ConditionExpression: notExists}},
+		{Put: &dynamodb.Put{TableName: aws.String(cfg.ConversationsTable), Item: summaryItem, ConditionExpression: notExists}},
+		{Update: &dynamodb.Update{
+			TableName:           aws.String(cfg.ConnectionsTable),
+			Key:                 connectionKey(target.ConnectionId),
+			UpdateExpression:    aws.String("ADD sessions :session"),
+			ConditionExpression: aws.String("attribute_exists(connection_id)"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":session": {SS: []*string{summaryKey["conversation_key"].S}},
+			},
+		}},
+	}, nil
+}
+
+// importStateSession writes one session in a transaction, so it is imported completely or not at all
+func importStateSession(ctx context.Context, target openAIRequest, session stateSession, now time.Time) error {
+	if err := checkStateSession(target.config, session); err != nil {
+		return err
+	}
+	writes, err := stateSessionWrites(target, session, now)
+	if err != nil {
+		return err
+	}
+	_, err = target.dynamoDBClient.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeTransactionCanceledException {
+		return fmt.Errorf("session exists already or the connection closed")
+	}
+	if err != nil {
+		return fmt.Errorf("Can't write session: %v", err)
+	}
+	return nil
+}
+
+// importStateUsage adds the exported usage of the day to the daily usage of the user. The import is recorded
+// with the usage, so importing the same state again doesn't count it twice.
+func importStateUsage(ctx context.Context, target openAIRequest, usage stateUsage, now time.Time) (bool, error) {
+	cfg := target.config
+	if cfg.UsageTable == "" || usage.Date != usageDay(now) || usage.Tokens <= 0 {
+		return false, nil
+	}
+	dayEnd := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	_, err := target.dynamoDBClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(cfg.UsageTable),
+		Key:                 usageKey(requestSubject(target), usage.Date),
+		UpdateExpression:    aws.String("ADD tokens :tokens SET imported_at = :now, expires_at = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(imported_at)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":tokens":  {N: aws.String(strconv.FormatInt(usage.Tokens, 10))},
+			":now":     {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+			":expires": {N: aws.String(strconv.FormatInt(dayEnd.Add(usageRecordTTL).Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Can't import daily usage: %v", err)
+	}
+	return true, nil
+}
+
+// importStateSettings replaces the query string parameters of the target connection record with the exported
+// settings. Tokens an export of an older stack may carry are dropped, they are never stored.
+func importStateSettings(ctx context.Context, target openAIRequest, settings map[string]string) (bool, error) {
+	params := make(map[string]*dynamodb.AttributeValue, len(settings))
+	for name, value := range settings {
+		if name == authQueryParameter || name == idTokenQueryParameter {
+			continue
+		}
+		params[name] = &dynamodb.AttributeValue{S: aws.String(value)}
+	}
+	if len(params) == 0 {
+		return false, nil
+	}
+	_, err := target.dynamoDBClient.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(target.config.ConnectionsTable),
+		Key:                       connectionKey(target.ConnectionId),
+		UpdateExpression:          aws.String("SET query_params = :settings"),
+		ConditionExpression:       aws.String("attribute_exists(connection_id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":settings": {M: params}},
+	})
+	if isConditionalCheckFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Can't import settings: %v", err)
+	}
+	return true, nil
+}
+
+// importConnectionState imports the sessions, the settings and the usage of state for the user of target. Sessions are
+// imported one by one, the ones that fail are reported with their error and leave nothing behind.
+func importConnectionState(ctx context.Context, target openAIRequest, state connectionState) (stateImportFrame, error) {
+	frame := stateImportFrame{Type: frameTypeStateImport, Imported: []string{}}
+	if requestSubject(target) != state.Subject {
+		return frame, errStateIdentity
+	}
+	now := target.getClock().Now()
+	for _, session := range state.Sessions {
+		if err := importStateSession(ctx, target, session, now); err != nil {
+			frame.Failed = append(frame.Failed, stateImportFailure{ConversationID: session.ConversationID, Error: err.Error()})
+			continue
+		}
+		frame.Imported = append(frame.Imported, session.ConversationID)
+		if session.Template != nil {
+			digest, err := templateDigest(ctx, target, session.Template.Name)
+			if err != nil || digest != session.Template.Digest {
+				frame.ChangedTemplates = append(frame.ChangedTemplates, session.Template.Name)
+			}
+		}
+	}
+	imported, err := importStateSettings(ctx, target, state.Settings)
+	if err != nil {
+		return frame, err
+	}
+	frame.SettingsImported = imported
+	if state.Usage != nil {
+		imported, err := importStateUsage(ctx, target, *state.Usage, now)
+		if err != nil {
+			return frame, err
+		}
+		frame.UsageImported = imported
+	}
+	return frame, nil
+}
+
+// handleState exports or imports the state of a connection for an admin connection. The answer is posted
+// to the admin connection, split into several frames when it is large.
+func (h *WebsocketHandler) handleState(ctx context.Context, cfg *Config, request events.APIGatewayWebsocketProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var stateReq stateRequest
+	if err := json.Unmarshal([]byte(request.Body), &stateReq); err != nil {
+		return errorResponse(fmt.Sprintf("Error parsing state JSON: %s", err), statusCodeBadRequest)
+	}
+	if cfg.ConnectionsTable == "" || cfg.ConversationsTable == "" {
+		return errorResponse("State export and import are not supported without connections and conversations tables", statusCodeBadRequest)
+	}
+	sender := request.RequestContext.ConnectionID
+	client := h.getDynamoDBClient(cfg)
+
+	authorized, err := isBroadcastAuthorized(ctx, client, cfg, sender, stateReq.Secret)
+	if err != nil {
+		loggerFrom(ctx).Error("Can't authorize state transfer", "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+	if !authorized {
+		loggerFrom(ctx).Warn("State audit", "action", stateReq.Action, "target", stateReq.ConnectionID, "result", "unauthorized")
+		return errorResponse("State export and import require an admin connection", statusCodeUnauthorized)
+	}
+	if stateReq.ConnectionID == "" {
+		return errorResponse("State connection_id is required", statusCodeBadRequest)
+	}
+	if stateReq.Action == actionImportState {
+		if err := checkConnectionState(stateReq.State); err != nil {
+			return errorResponse(fmt.Sprintf("Invalid state: %s", err), statusCodeBadRequest)
+		}
+	}
+
+	target, record, err := connectionStateTarget(ctx, client, cfg, stateReq.ConnectionID)
+	if err != nil {
+		loggerFrom(ctx).Error("Can't load state target", "target", stateReq.ConnectionID, "error", err)
+		return errorResponse(err.Error(), statusCodeServerError)
+	}
+	if record == nil {
+		return errorResponse(fmt.Sprintf("Unknown connection: %s", stateReq.ConnectionID), statusCodeNotFound)
+	}
+	target.clock = h.getClock()
+	if strings.HasPrefix(requestSubject(target), "connection#") {
+		return errorResponse("Connection has no authenticated user, its state can't be moved", statusCodeBadRequest)
+	}
+
+	var reply any
+	if stateReq.Action == actionExportState {
+		state, err := exportConnectionState(ctx, target, record)
+		if err != nil {
+			loggerFrom(ctx).Error("Can't export state", "target", stateReq.ConnectionID, "error", err)
+			return errorResponse(err.Error(), statusCodeServerError)
+		}
+		loggerFrom(ctx).Info("State audit", "action", stateReq.Action, "target", stateReq.ConnectionID, "sessions", len(state.Sessions), "result", "exported")
+		reply = stateExportFrame{Type: frameTypeStateExport, State: state}
+	} else {
+		frame, err := importConnectionState(ctx, target, *stateReq.State)
+		if errors.Is(err, errStateIdentity) {
+			loggerFrom(ctx).Warn("State audit", "action", stateReq.Action, "target", stateReq.ConnectionID, "result", "identity_mismatch")
+			return errorResponse(fmt.Sprintf("Can't import state: %s", err), statusCodeUnauthorized)
+		}
+		if err != nil {
+			loggerFrom(ctx).Error("Can't import state", "target", stateReq.ConnectionID, "error", err)
+			return errorResponse(err.Error(), statusCodeServerError)
+		}
+		loggerFrom(ctx).Info("State audit", "action", stateReq.Action, "target", stateReq.ConnectionID, "imported", len(frame.Imported), "failed", len(frame.Failed), "result", "imported")
+		reply = frame
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return errorResponse(fmt.Sprintf("Can't encode state: %s", err), statusCodeServerError)
+	}
+	senderRequest := openAIRequest{ctx: ctx, config: cfg, poster: h.getConnectionPoster(ctx, cfg), ConnectionId: sender}
+	if err := postFrames(senderRequest, data); err != nil {
+		loggerFrom(ctx).Warn("Can't post state answer", "error", err)
+	}
+	return events.APIGatewayProxyResponse{StatusCode: statusCodeOK}, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// stateStack is one stack of a cutover: its tables, with an admin connection and connections of users
+type stateStack struct {
+	db     *fakeDynamoDB
+	poster *testsupport.RecordingPoster
+	h      *WebsocketHandler
+}
+
+// newStateStack creates a stack holding an admin connection and a connection of each user
+func newStateStack(cfg *Config, users map[string]string) *stateStack {
+	db := newFakeDynamoDB().table("connections", "connection_id").table("conversations", "conversation_key").table("usage", "usage_key")
+	db.put("connections", map[string]*dynamodb.AttributeValue{"connection_id": {S: aws.String("admin-1")}, "admin": {BOOL: aws.Bool(true)}})
+	for connectionID, sub := range users {
+		db.put("connections", map[string]*dynamodb.AttributeValue{
+			"connection_id": {S: aws.String(connectionID)},
+			"user_sub":      {S: aws.String(sub)},
+			"query_params":  {M: map[string]*dynamodb.AttributeValue{"protocol": {S: aws.String("v2")}}},
+		})
+	}
+	poster := testsupport.NewRecordingPoster()
+	return &stateStack{db: db, poster: poster, h: newTestHandler(cfg, testsupport.NewScriptedCompleter(), poster, db, testsupport.NewClock(testStart))}
+}
+
+// send posts body from connectionID and returns the response and the reassembled answer posted back
+func (s *stateStack) send(t *testing.T, cfg *Config, connectionID string, body string) (events.APIGatewayProxyResponse, string) {
+	t.Helper()
+	posted := len(s.poster.Frames())
+	message := testMessage(body)
+	message.RequestContext.ConnectionID = connectionID
+	response, err := s.h.Handler(context.Background(), message)
+	if err != nil {
+		t.Fatalf("Handler() error = %v", err)
+	}
+	frames := s.poster.Texts()[posted:]
+	if len(frames) > 1 && frames[len(frames)-1] == cfg.EndStreamMessage {
+		frames = frames[:len(frames)-1]
+	}
+	return response, strings.Join(frames, "")
+}
+
+// seedSessions runs conversation turns for the user of connectionID, so the stack holds histories, summaries
+// and usage the way requests leave them
+func (s *stateStack) seedSessions(t *testing.T, cfg *Config, connectionID string, sub string, conversations map[string][]chatMessage) {
+	t.Helper()
+	for conversationID, messages := range conversations {
+		request := openAIRequest{
+			ctx: context.Background(), config: cfg, dynamoDBClient: s.db, ConnectionId: connectionID,
+			identity: &userIdentity{Sub: sub}, clock: s.h.getClock(),
+			request: Request{ConversationID: conversationID, PromptTemplate: "PROMPT_TEST"},
+		}
+		for i := 0; i+1 < len(messages); i += 2 {
+			request.request.Messages = messages[:i+1]
+			info := completionInfo{Model: "gpt-4o"}
+			info.Usage.PromptTokens, info.Usage.CompletionTokens = 50*(i+1), 10
+			recordTokenUsage(request, info)
+			recordSessionTurn(request, info)
+			saveConversation(request, messages[i+1])
+		}
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.ConversationsTable = "conversations"
+		cfg.UsageTable = "usage"
+		cfg.ModelPrices = map[string]modelPrice{"gpt-4o": {Prompt: 2.5, Completion: 10}}
+	})
+	large := strings.Repeat("long answer ", 12*1024)
+	oldStack := newStateStack(cfg, map[string]string{"conn-old": "user-1"})
+	oldStack.seedSessions(t, cfg, "conn-old", "user-1", map[string][]chatMessage{
+		"chat-1": {{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}, {Role: "user", Content: "more"}, {Role: "assistant", Content: large}},
+		"chat-2": {{Role: "user", Content: "question"}, {Role: "assistant", Content: "answer"}},
+	})
+
+	oldRecord := oldStack.db.item("connections", connectionKey("conn-old"))
+	oldRecord["query_params"].M["lang"] = &dynamodb.AttributeValue{S: aws.String("fr")}
+	oldStack.db.put("connections", oldRecord)
+
+	response, answer := oldStack.send(t, cfg, "admin-1", `{"action":"export_state","connection_id":"conn-old"}`)
+	if response.StatusCode != statusCodeOK {
+		t.Fatalf("export_state = %d %s", response.StatusCode, response.Body)
+	}
+	if len(oldStack.poster.Frames()) < 3 {
+		t.Fatalf("export of %d bytes posted in %d frames, want it split", len(answer), len(oldStack.poster.Frames()))
+	}
+	var exported stateExportFrame
+	if err := json.Unmarshal([]byte(answer), &exported); err != nil {
+		t.Fatalf("can't decode export: %v", err)
+	}
+	state := exported.State
+	if state.Version != stateFormatVersion || state.Subject != "user#user-1" || len(state.Sessions) != 2 ||
+		state.Usage == nil || state.Usage.Tokens != 280 || !reflect.DeepEqual(state.Settings, map[string]string{"protocol": "v2", "lang": "fr"}) {
+		t.Fatalf("exported state version %d, subject %q, %d sessions, usage %+v, settings %v", state.Version, state.Subject, len(state.Sessions), state.Usage, state.Settings)
+	}
+
+	newStack := newStateStack(cfg, map[string]string{"conn-new": "user-1", "conn-other": "user-2"})
+	// An export of a stack that stored the token still carries it
+	withToken := state
+	withToken.Settings = map[string]string{"protocol": "v2", "lang": "fr", authQueryParameter: "token"}
+	data, _ := json.Marshal(stateRequest{Action: actionImportState, ConnectionID: "conn-new", State: &withToken})
+	response, answer = newStack.send(t, cfg, "admin-1", string(data))
+	var imported stateImportFrame
+	if err := json.Unmarshal([]byte(answer), &imported); response.StatusCode != statusCodeOK || err != nil {
+		t.Fatalf("import_state = %d %s, %v", response.StatusCode, response.Body, err)
+	}
+	if len(imported.Imported) != 2 || len(imported.Failed) != 0 || !imported.UsageImported || !imported.SettingsImported || len(imported.ChangedTemplates) != 0 {
+		t.Fatalf("import = %+v", imported)
+	}
+	record := newStack.db.item("connections", connectionKey("conn-new"))
+	wantRecord := map[string]*dynamodb.AttributeValue{
+		"connection_id": {S: aws.String("conn-new")},
+		"user_sub":      {S: aws.String("user-1")},
+		"query_params":  {M: map[string]*dynamodb.AttributeValue{"protocol": {S: aws.String("v2")}, "lang": {S: aws.String("fr")}}},
+		"sessions":      {SS: []*string{sessionSummaryKey("user#user-1", "chat-1")["conversation_key"].S, sessionSummaryKey("user#user-1", "chat-2")["conversation_key"].S}},
+	}
+	if sessions := record["sessions"]; sessions != nil && len(sessions.SS) == 2 && aws.StringValue(sessions.SS[0]) > aws.StringValue(sessions.SS[1]) {
+		sessions.SS[0], sessions.SS[1] = sessions.SS[1], sessions.SS[0]
+	}
+	if !reflect.DeepEqual(record, wantRecord) {
+		t.Fatalf("connection record after the import = %v, want %v", record, wantRecord)
+	}
+
+	// The new stack exports what the old one did
+	_, answer = newStack.send(t, cfg, "admin-1", `{"action":"export_state","connection_id":"conn-new"}`)
+	var reexported stateExportFrame
+	if err := json.Unmarshal([]byte(answer), &reexported); err != nil {
+		t.Fatalf("can't decode export of the new stack: %v", err)
+	}
+	sortSessions := func(state *connectionState) {
+		sessions := state.Sessions
+		if len(sessions) == 2 && sessions[0].ConversationID > sessions[1].ConversationID {
+			sessions[0], sessions[1] = sessions[1], sessions[0]
+		}
+	}
+	sortSessions(&state)
+	sortSessions(&reexported.State)
+	if !reflect.DeepEqual(reexported.State, state) {
+		t.Fatalf("state after the round trip = %+v, want %+v", reexported.State, state)
+	}
+
+	// Importing again changes nothing: the sessions exist already and the usage was counted
+	data, _ = json.Marshal(stateRequest{Action: actionImportState, ConnectionID: "conn-new", State: &state})
+	_, answer = newStack.send(t, cfg, "admin-1", string(data))
+	imported = stateImportFrame{}
+	json.Unmarshal([]byte(answer), &imported)
+	if len(imported.Imported) != 0 || len(imported.Failed) != 2 || imported.UsageImported {
+		t.Fatalf("second import = %+v", imported)
+	}
+	if tokens, _ := getDailyUsage(context.Background(), newStack.db, cfg, "user#user-1", usageDay(testStart)); tokens != 280 {
+		t.Fatalf("usage after the second import = %d, want 280", tokens)
+	}
+}
+
+func TestStateImportIsAllOrNothingPerSession(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.ConversationsTable = "conversations"
+	})
+	stack := newStateStack(cfg, map[string]string{"conn-new": "user-1"})
+	// The summary of chat-2 exists on the new stack, its history doesn't
+	stack.db.put("conversations", map[string]*dynamodb.AttributeValue{
+		"conversation_key": sessionSummaryKey("user#user-1", "chat-2")["conversation_key"],
+		"turn_count":       {N: aws.String("7")},
+	})
+	state := connectionState{Version: stateFormatVersion, Subject: "user#user-1", Sessions: []stateSession{
+		{ConversationID: "chat-1", Messages: []chatMessage{{Role: "user", Content: "hi"}}, Summary: stateSummary{Turns: 1}},
+		{ConversationID: "chat-2", Messages: []chatMessage{{Role: "user", Content: "hi"}}, Summary: stateSummary{Turns: 1}},
+		{ConversationID: "chat-3", Messages: []chatMessage{{Role: "robot", Content: "hi"}}, Summary: stateSummary{Turns: 1}},
+	}}
+	data, _ := json.Marshal(stateRequest{Action: actionImportState, ConnectionID: "conn-new", State: &state})
+	_, answer := stack.send(t, cfg, "admin-1", string(data))
+	var imported stateImportFrame
+	if err := json.Unmarshal([]byte(answer), &imported); err != nil {
+		t.Fatalf("can't decode %s: %v", answer, err)
+	}
+	if !reflect.DeepEqual(imported.Imported, []string{"chat-1"}) || len(imported.Failed) != 2 {
+		t.Fatalf("import = %+v", imported)
+	}
+
+	owner := openAIRequest{ctx: context.Background(), identity: &userIdentity{Sub: "user-1"}}
+	for _, conversationID := range []string{"chat-2", "chat-3"} {
+		if item := stack.db.item("conversations", conversationKey(owner, conversationID)); item != nil {
+			t.Errorf("history of the refused session %s was written: %v", conversationID, item)
+		}
+	}
+	if turns := numberAttribute(stack.db.item("conversations", sessionSummaryKey("user#user-1", "chat-2")), "turn_count"); turns != 7 {
+		t.Errorf("summary of chat-2 has %d turns, want the 7 it had", turns)
+	}
+	record := stack.db.item("connections", connectionKey("conn-new"))
+	if sessions := record["sessions"]; sessions == nil || len(sessions.SS) != 1 {
+		t.Errorf("connection notes sessions %v, want chat-1 only", sessions)
+	}
+}
+
+func TestStateRequestsAreChecked(t *testing.T) {
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.ConversationsTable = "conversations"
+	})
+	tests := []struct {
+		name       string
+		sender     string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "not admin", sender: "conn-new", body: `{"action":"export_state","connection_id":"conn-new"}`, wantStatus: statusCodeUnauthorized, wantError: "admin"},
+		{name: "unknown connection", sender: "admin-1", body: `{"action":"export_state","connection_id":"conn-gone"}`, wantStatus: statusCodeNotFound, wantError: "Unknown connection"},
+		{name: "anonymous connection", sender: "admin-1", body: `{"action":"export_state","connection_id":"admin-1"}`, wantStatus: statusCodeBadRequest, wantError: "no authenticated user"},
+		{name: "missing state", sender: "admin-1", body: `{"action":"import_state","connection_id":"conn-new"}`, wantStatus: statusCodeBadRequest, wantError: "state is required"},
+		{name: "wrong version", sender: "admin-1", body: `{"action":"import_state","connection_id":"conn-new","state":{"version":2,"subject":"user#user-1","sessions":[]}}`, wantStatus: statusCodeBadRequest, wantError: "version 2 is not supported"},
+		{name: "other user", sender: "admin-1", body: `{"action":"import_state","connection_id":"conn-new","state":{"version":1,"subject":"user#user-2","sessions":[]}}`, wantStatus: statusCodeUnauthorized, wantError: "another user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stack := newStateStack(cfg, map[string]string{"conn-new": "user-1"})
+			response, _ := stack.send(t, cfg, tt.sender, tt.body)
+			if response.StatusCode != tt.wantStatus || !strings.Contains(response.Body, tt.wantError) {
+				t.Fatalf("Handler() = %d %q, want %d containing %q", response.StatusCode, response.Body, tt.wantStatus, tt.wantError)
+			}
+			if stack.db.count("TransactWriteItems") != 0 {
+				t.Fatal("refused state was written")
+			}
+		})
+	}
+}
+
+// TestStateTemplateNamesAreChecked checks that only prompt templates are digested, so neither an export nor an
+// import reveals the digest of another environment variable
+func TestStateTemplateNamesAreChecked(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-test")
+	cfg := testConfig(t, func(cfg *Config) {
+		cfg.ConnectionsTable = "connections"
+		cfg.ConversationsTable = "conversations"
+	})
+	stack := newStateStack(cfg, map[string]string{"conn-1": "user-1"})
+	state := connectionState{Version: stateFormatVersion, Subject: "user#user-1", Sessions: []stateSession{
+		{ConversationID: "chat-1", Messages: []chatMessage{{Role: "user", Content: "hi"}}, Summary: stateSummary{Turns: 1}, Template: &stateTemplate{Name: "OPENAI_API_KEY", Digest: "00"}},
+		{ConversationID: "chat-2", Messages: []chatMessage{{Role: "user", Content: "hi"}}, Summary: stateSummary{Turns: 1}, Template: &stateTemplate{Name: "PROMPT_TEST", Digest: "00"}},
+	}}
+	data, _ := json.Marshal(stateRequest{Action: actionImportState, ConnectionID: "conn-1", State: &state})
+	_, answer := stack.send(t, cfg, "admin-1", string(data))
+	var imported stateImportFrame
+	if err := json.Unmarshal([]byte(answer), &imported); err != nil {
+		t.Fatalf("can't decode %s: %v", answer, err)
+	}
+	if !reflect.DeepEqual(imported.Imported, []string{"chat-2"}) || len(imported.Failed) != 1 || !strings.Contains(imported.Failed[0].Error, "must start with PROMPT_") ||
+		!reflect.DeepEqual(imported.ChangedTemplates, []string{"PROMPT_TEST"}) {
+		t.Fatalf("import = %+v, want chat-1 refused", imported)
+	}
+
+	// A summary naming another variable, as a stack without the check could have stored it
+	stack.db.put("conversations", map[string]*dynamodb.AttributeValue{
+		"conversation_key": sessionSummaryKey("user#user-1", "chat-3")["conversation_key"],
+		"turn_count":       {N: aws.String("1")},
+		"prompt_template":  {S: aws.String("OPENAI_API_KEY")},
+	})
+	record := stack.db.item("connections", connectionKey("conn-1"))
+	record["sessions"].SS = append(record["sessions"].SS, sessionSummaryKey("user#user-1", "chat-3")["conversation_key"].S)
+	stack.db.put("connections", record)
+	_, answer = stack.send(t, cfg, "admin-1", `{"action":"export_state","connection_id":"conn-1"}`)
+	var exported stateExportFrame
+	if err := json.Unmarshal([]byte(answer), &exported); err != nil || len(exported.State.Sessions) != 2 {
+		t.Fatalf("export = %s, %v, want chat-2 and chat-3", answer, err)
+	}
+	for _, session := range exported.State.Sessions {
+		if session.ConversationID == "chat-3" && session.Template != nil {
+			t.Errorf("export digested %+v", session.Template)
+		}
+	}
+}
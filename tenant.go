@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	errorCodeTenantKeyInvalid = "tenant_key_invalid"
+	statusCodeForbidden       = 403
+	// tenantKeyCacheTTL is how long a decrypted tenant key is used before it's read from TENANT_KEYS_TABLE again
+	tenantKeyCacheTTL = 5 * time.Minute
+)
+
+// ErrTenantKeyInvalid is returned when the tenant of a connection has no usable OpenAI API key
+var ErrTenantKeyInvalid = errors.New("Tenant OpenAI API key is missing or revoked")
+
+var (
+	errTenantKeyMissing = fmt.Errorf("%w: tenant has no key", ErrTenantKeyInvalid)
+	errTenantKeyRevoked = fmt.Errorf("%w: tenant key is revoked", ErrTenantKeyInvalid)
+)
+
+// tenantKey is the context key of the tenant of a request
+type tenantKey struct{}
+
+// withTenant returns a copy of ctx carrying the tenant of the connection
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant of ctx, or an empty string when the connection has none
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// tenantKeyCache keeps the decrypted OpenAI API keys of tenants for tenantKeyCacheTTL, so only the first request
+// of a tenant in an execution environment pays for the DynamoDB read and the KMS decryption
+type tenantKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]tenantKeyEntry
+}
+
+type tenantKeyEntry struct {
+	key       string
+	fetchedAt time.Time
+}
+
+var tenantKeys = &tenantKeyCache{entries: map[string]tenantKeyEntry{}}
+
+// tenantCompleters holds an OpenAI client per tenant key of a configuration snapshot
+type tenantCompleters struct {
+	mu    sync.Mutex
+	byKey map[string]ChatCompleter
+}
+
+// resolveTenantKey returns the OpenAI API key of a tenant, read from TENANT_KEYS_TABLE and decrypted with KMS
+// unless it's cached. refresh skips the cache, for a key the OpenAI API rejected. A tenant without a record
+// gets errTenantKeyMissing, and one whose record is revoked errTenantKeyRevoked.
+func (h *WebsocketHandler) resolveTenantKey(ctx context.Context, cfg *Config, tenant string, refresh bool) (string, error) {
+	tenantKeys.mu.Lock()
+	entry, ok := tenantKeys.entries[tenant]
+	tenantKeys.mu.Unlock()
+	if ok && !refresh && time.Since(entry.fetchedAt) < tenantKeyCacheTTL {
+		return entry.key, nil
+	}
+
+	output, err := h.getDynamoDBClient(cfg).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(cfg.TenantKeysTable),
+		Key:       map[string]*dynamodb.AttributeValue{"tenant_id": {S: aws.String(tenant)}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Can't read tenant key: %v", err)
+	}
+	encrypted, ok := output.Item["encrypted_key"]
+	if !ok || len(encrypted.B) == 0 {
+		tenantKeys.forget(tenant)
+		return "", errTenantKeyMissing
+	}
+	if revoked, ok := output.Item["revoked"]; ok && aws.BoolValue(revoked.BOOL) {
+		tenantKeys.forget(tenant)
+		return "", errTenantKeyRevoked
+	}
+	decrypted, err := h.getKMSClient(cfg).DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: encrypted.B})
+	if err != nil {
+		return "", fmt.Errorf("Can't decrypt tenant key: %v", err)
+	}
+
+	key := strings.TrimSpace(string(decrypted.Plaintext))
+	tenantKeys.mu.Lock()
+	tenantKeys.entries[tenant] = tenantKeyEntry{key: key, fetchedAt: time.Now()}
+	tenantKeys.mu.Unlock()
+	return key, nil
+}
+
+// forget drops the cached key of a tenant
+func (c *tenantKeyCache) forget(tenant string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, tenant)
+}
+
+// getKMSClient returns the KMS client decrypting tenant keys for the configuration snapshot
+func (h *WebsocketHandler) getKMSClient(cfg *Config) kmsiface.KMSAPI {
+	return h.kmsClients.get(cfg, func(cfg *Config) kmsiface.KMSAPI {
+		return kms.New(h.awsSession)
+	})
+}
+
+// getTenantChatCompleter returns the OpenAI client backed ChatCompleter sending requests with a tenant key.
+// Clients are kept per key until the configuration changes, so a rotated key gets a client of its own.
+func (h *WebsocketHandler) getTenantChatCompleter(cfg *Config, key string) ChatCompleter {
+	completers := h.tenantClients.get(cfg, func(cfg *Config) *tenantCompleters {
+		return &tenantCompleters{byKey: map[string]ChatCompleter{}}
+	})
+	completers.mu.Lock()
+	defer completers.mu.Unlock()
+	if chat, ok := completers.byKey[key]; ok {
+		return chat
+	}
+	keyed := *cfg
+	keyed.OpenAIKey = key
+	chat := openAIChatCompleter{Client: openai.NewClientWithConfig(newOpenAIClientConfig(&keyed, h.httpClient))}
+	completers.byKey[key] = chat
+	return chat
+}
+
+// withTenantKey returns a copy of the request sent with the OpenAI API key of its tenant. It returns
+// ErrTenantKeyInvalid when the tenant has no usable key and FALLBACK_TO_PLATFORM_KEY doesn't apply:
+// connections without a tenant and tenants without a record may fall back to the platform key, a
+// revoked record never does.
+func (h *WebsocketHandler) withTenantKey(openAIRequest openAIRequest, refresh bool) (openAIRequest, error) {
+	cfg := openAIRequest.config
+	tenant := tenantFrom(openAIRequest.ctx)
+	if tenant == "" {
+		if cfg.FallbackToPlatformKey {
+			return h.withPlatformKey(openAIRequest), nil
+		}
+		return openAIRequest, fmt.Errorf("%w: connection has no tenant", ErrTenantKeyInvalid)
+	}
+	key, err := h.resolveTenantKey(openAIRequest.ctx, cfg, tenant, refresh)
+	if errors.Is(err, errTenantKeyMissing) && cfg.FallbackToPlatformKey {
+		openAIRequest.logger().Warn("Tenant has no OpenAI API key, using the platform key")
+		return h.withPlatformKey(openAIRequest), nil
+	}
+	if err != nil {
+		return openAIRequest, err
+	}
+	openAIRequest.tenantKey = key
+	openAIRequest.chat = h.getTenantChatCompleter(cfg, key)
+	return openAIRequest, nil
+}
+
+// withPlatformKey returns a copy of the request sent with the platform key
+func (h *WebsocketHandler) withPlatformKey(openAIRequest openAIRequest) openAIRequest {
+	openAIRequest.tenantKey = ""
+	openAIRequest.chat = h.getProviderCompleter(openAIRequest.config, openAIRequest.request.Provider)
+	return openAIRequest
+}
+
+// retryTenantKey handles a 401 for a tenant key: the cached key is dropped and read again, in case the tenant
+// rotated it, and the request runs once more with a new key. A key rejected again is reported as ErrTenantKeyInvalid.
+func (h *WebsocketHandler) retryTenantKey(openAIRequest *openAIRequest, run func() error, err error) error {
+	tenant := tenantFrom(openAIRequest.ctx)
+	refreshed, refreshErr := h.withTenantKey(*openAIRequest, true)
+	if refreshErr != nil {
+		return refreshErr
+	}
+	if refreshed.tenantKey != openAIRequest.tenantKey {
+		openAIRequest.logger().Warn("Tenant OpenAI API key rejected, retrying with the refreshed key")
+		*openAIRequest = refreshed
+		if err = run(); !isUnauthorizedError(err) {
+			return err
+		}
+	}
+	tenantKeys.forget(tenant)
+	return fmt.Errorf("%w: %w", ErrTenantKeyInvalid, err)
+}
@@ -0,0 +1,110 @@
+package testsupport
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a controllable clock. Time stands still until Advance or Set moves it, and the functions of
+// AfterFunc run synchronously in Advance once their time has come. It is safe for concurrent use.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*clockTimer
+}
+
+// clockTimer is a function waiting for the clock to reach its time
+type clockTimer struct {
+	at time.Time
+	f  func()
+}
+
+// NewClock creates a clock standing at start
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the time of the clock
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, running the timers due by then in the order of their time
+func (c *Clock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set moves the clock to t, running the timers due by then in the order of their time. The clock never
+// moves backwards, so a t before the current time only runs the timers that are already due.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	if t.After(c.now) {
+		c.now = t
+	}
+	var due, pending []*clockTimer
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	// The functions run outside the lock, so they can use the clock themselves
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+// AfterFunc calls f once the clock has advanced by d. The returned function cancels the call, reporting
+// whether it was still pending.
+func (c *Clock) AfterFunc(d time.Duration, f func()) func() bool {
+	c.mu.Lock()
+	timer := &clockTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	c.mu.Unlock()
+	if d <= 0 {
+		c.Set(c.Now())
+	}
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, pending := range c.timers {
+			if pending == timer {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Pending returns the number of timers waiting for the clock
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// sleep waits for d on the clock when it is set, or in real time otherwise, returning early when done closes
+func sleep(clock *Clock, d time.Duration, done <-chan struct{}) {
+	if d <= 0 {
+		return
+	}
+	if clock != nil {
+		clock.Advance(d)
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,234 @@
+package testsupport
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ChatStream is the stream CreateChatCompletionStream returns. It is an alias of an interface literal, the
+// same as the ChatStream of the handler, so the completer satisfies the ChatCompleter of the handler.
+type ChatStream = interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// Turn is one scripted answer of a ScriptedCompleter. A turn with Err fails the call, a turn with Chunks
+// streams them, and Response answers completions that aren't streamed. Reply and Stream build turns
+// answering both kinds of calls.
+type Turn struct {
+	Response openai.ChatCompletionResponse
+	Chunks   []Chunk
+	Err      error
+}
+
+// Chunk is one chunk of a scripted stream. Recv waits Delay before returning it, then returns Err when it
+// is set, or a chunk carrying Content, ToolCalls, FinishReason, Usage and SystemFingerprint otherwise.
+type Chunk struct {
+	Delay             time.Duration
+	Content           string
+	ToolCalls         []openai.ToolCall // Tool call deltas, only the first of a call has its ID and name
+	FinishReason      openai.FinishReason
+	Usage             *openai.Usage
+	SystemFingerprint string
+	Err               error
+}
+
+// Reply builds a turn answering with content, in one choice of a completion or as one chunk of a stream
+func Reply(content string) Turn {
+	return Turn{
+		Response: openai.ChatCompletionResponse{
+			Object: "chat.completion",
+			Choices: []openai.ChatCompletionChoice{{
+				Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content},
+				FinishReason: openai.FinishReasonStop,
+			}},
+		},
+		Chunks: []Chunk{{Content: content}, {FinishReason: openai.FinishReasonStop}},
+	}
+}
+
+// Stream builds a turn streaming chunks. Completions that aren't streamed are answered with the content
+// of the chunks in one choice.
+func Stream(chunks ...Chunk) Turn {
+	var content strings.Builder
+	finish := openai.FinishReasonStop
+	for _, chunk := range chunks {
+		content.WriteString(chunk.Content)
+		if chunk.FinishReason != "" {
+			finish = chunk.FinishReason
+		}
+	}
+	turn := Reply(content.String())
+	turn.Response.Choices[0].FinishReason = finish
+	turn.Chunks = chunks
+	return turn
+}
+
+// Fail builds a turn failing the call with err
+func Fail(err error) Turn {
+	return Turn{Err: err}
+}
+
+// TextChunks splits texts into chunks arriving delay apart, followed by a stop chunk
+func TextChunks(delay time.Duration, texts ...string) []Chunk {
+	chunks := make([]Chunk, 0, len(texts)+1)
+	for _, text := range texts {
+		chunks = append(chunks, Chunk{Delay: delay, Content: text})
+	}
+	return append(chunks, Chunk{FinishReason: openai.FinishReasonStop})
+}
+
+// ScriptedCompleter answers chat completions with the turns of its script, one per call and in order,
+// repeating the last turn once the script runs out. Delays of stream chunks advance Clock when it is set,
+// and pass in real time otherwise. A ScriptedCompleter is safe for concurrent use.
+type ScriptedCompleter struct {
+	Clock         *Clock
+	Models        []string // Listed by ListModels
+	ModelsErr     error    // Returned by ListModels instead of Models when set
+	Moderation    openai.ModerationResponse
+	ModerationErr error
+
+	mu          sync.Mutex
+	script      []Turn
+	calls       int
+	listings    int
+	requests    []openai.ChatCompletionRequest
+	moderations []openai.ModerationRequest
+}
+
+// NewScriptedCompleter creates a completer answering with turns
+func NewScriptedCompleter(turns ...Turn) *ScriptedCompleter {
+	return &ScriptedCompleter{script: turns}
+}
+
+// next records request and returns the turn answering it
+func (c *ScriptedCompleter) next(request openai.ChatCompletionRequest) Turn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, request)
+	if len(c.script) == 0 {
+		return Reply("")
+	}
+	turn := c.script[min(c.calls, len(c.script)-1)]
+	c.calls++
+	return turn
+}
+
+// Requests returns the chat completion requests received so far, in order
+func (c *ScriptedCompleter) Requests() []openai.ChatCompletionRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]openai.ChatCompletionRequest(nil), c.requests...)
+}
+
+// ModerationRequests returns the moderation requests received so far, in order
+func (c *ScriptedCompleter) ModerationRequests() []openai.ModerationRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]openai.ModerationRequest(nil), c.moderations...)
+}
+
+// ListModelsCalls returns how often ListModels was called so far
+func (c *ScriptedCompleter) ListModelsCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.listings
+}
+
+// CreateChatCompletion answers with the response of the next turn, completing the request model
+func (c *ScriptedCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	turn := c.next(request)
+	if turn.Err != nil {
+		return openai.ChatCompletionResponse{}, turn.Err
+	}
+	response := turn.Response
+	if response.Model == "" {
+		response.Model = request.Model
+	}
+	return response, nil
+}
+
+// CreateChatCompletionStream streams the chunks of the next turn
+func (c *ScriptedCompleter) CreateChatCompletionStream(ctx context.Context, request openai.ChatCompletionRequest) (ChatStream, error) {
+	turn := c.next(request)
+	if turn.Err != nil {
+		return nil, turn.Err
+	}
+	return &scriptedStream{ctx: ctx, clock: c.Clock, model: request.Model, chunks: turn.Chunks}, nil
+}
+
+// ListModels lists Models, or fails with ModelsErr
+func (c *ScriptedCompleter) ListModels(ctx context.Context) (openai.ModelsList, error) {
+	c.mu.Lock()
+	c.listings++
+	c.mu.Unlock()
+	if c.ModelsErr != nil {
+		return openai.ModelsList{}, c.ModelsErr
+	}
+	var list openai.ModelsList
+	for _, model := range c.Models {
+		list.Models = append(list.Models, openai.Model{ID: model, Object: "model"})
+	}
+	return list, nil
+}
+
+// Moderations records request and answers with Moderation, or fails with ModerationErr. An unset
+// Moderation flags nothing.
+func (c *ScriptedCompleter) Moderations(ctx context.Context, request openai.ModerationRequest) (openai.ModerationResponse, error) {
+	c.mu.Lock()
+	c.moderations = append(c.moderations, request)
+	c.mu.Unlock()
+	if c.ModerationErr != nil {
+		return openai.ModerationResponse{}, c.ModerationErr
+	}
+	if c.Moderation.Results == nil {
+		return openai.ModerationResponse{Model: request.Model, Results: []openai.Result{{}}}, nil
+	}
+	return c.Moderation, nil
+}
+
+// scriptedStream returns the chunks of a turn, then io.EOF
+type scriptedStream struct {
+	ctx    context.Context
+	clock  *Clock
+	model  string
+	chunks []Chunk
+	closed bool
+}
+
+// Recv waits for the delay of the next chunk and returns it, or the error of the context once it is done
+func (s *scriptedStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	response := openai.ChatCompletionStreamResponse{Object: "chat.completion.chunk", Model: s.model}
+	if s.closed || len(s.chunks) == 0 {
+		return response, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	sleep(s.clock, chunk.Delay, s.ctx.Done())
+	if err := s.ctx.Err(); err != nil {
+		return response, err
+	}
+	if chunk.Err != nil {
+		return response, chunk.Err
+	}
+	if chunk.Content != "" || len(chunk.ToolCalls) > 0 || chunk.FinishReason != "" {
+		response.Choices = []openai.ChatCompletionStreamChoice{{
+			Delta:        openai.ChatCompletionStreamChoiceDelta{Content: chunk.Content, ToolCalls: chunk.ToolCalls},
+			FinishReason: chunk.FinishReason,
+		}}
+	}
+	response.Usage = chunk.Usage
+	response.SystemFingerprint = chunk.SystemFingerprint
+	return response, nil
+}
+
+// Close ends the stream
+func (s *scriptedStream) Close() error {
+	s.closed = true
+	return nil
+}
@@ -0,0 +1,7 @@
+// Package testsupport provides fakes for testing code built on the proxy handler without AWS or network
+// access: a ScriptedCompleter answering chat completions from a script, a RecordingPoster recording the
+// frames posted to websocket connections, and a Clock that only moves when the test advances it.
+//
+// The fakes satisfy the ChatCompleter, ConnectionPoster and Clock interfaces of the handler structurally,
+// so the package only depends on the standard library and go-openai.
+package testsupport
@@ -0,0 +1,79 @@
+package testsupport_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func ExampleScriptedCompleter() {
+	completer := testsupport.NewScriptedCompleter(
+		testsupport.Reply("Hello"),
+		testsupport.Fail(errors.New("rate limited")),
+	)
+	request := openai.ChatCompletionRequest{Model: "gpt-4o-mini"}
+
+	response, err := completer.CreateChatCompletion(context.Background(), request)
+	fmt.Println(response.Choices[0].Message.Content, err)
+	_, err = completer.CreateChatCompletion(context.Background(), request)
+	fmt.Println(err)
+	fmt.Println(len(completer.Requests()))
+	// Output:
+	// Hello <nil>
+	// rate limited
+	// 2
+}
+
+func ExampleTextChunks() {
+	clock := testsupport.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	completer := testsupport.NewScriptedCompleter(testsupport.Stream(testsupport.TextChunks(time.Second, "Hel", "lo")...))
+	completer.Clock = clock
+
+	stream, _ := completer.CreateChatCompletionStream(context.Background(), openai.ChatCompletionRequest{})
+	defer stream.Close()
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		fmt.Printf("%q %q\n", chunk.Choices[0].Delta.Content, chunk.Choices[0].FinishReason)
+	}
+	fmt.Println(clock.Now().Format(time.TimeOnly))
+	// Output:
+	// "Hel" ""
+	// "lo" ""
+	// "" "stop"
+	// 00:00:02
+}
+
+func ExampleRecordingPoster() {
+	poster := testsupport.NewRecordingPoster().FailAt(1, testsupport.ErrGone)
+
+	fmt.Println(poster.PostToConnection(context.Background(), "conn-1", []byte("first")))
+	fmt.Println(poster.PostToConnection(context.Background(), "conn-1", []byte("second")))
+	fmt.Println(poster.Texts(), poster.Calls())
+	// Output:
+	// <nil>
+	// post failed with HTTP status 410 Gone
+	// [first] 2
+}
+
+func ExampleClock() {
+	clock := testsupport.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	clock.AfterFunc(time.Minute, func() { fmt.Println("timer fired") })
+	stop := clock.AfterFunc(time.Hour, func() { fmt.Println("never") })
+
+	clock.Advance(30 * time.Second)
+	fmt.Println(clock.Pending())
+	clock.Advance(30 * time.Second)
+	fmt.Println(stop(), clock.Pending())
+	// Output:
+	// 2
+	// timer fired
+	// true 0
+}
@@ -0,0 +1,109 @@
+package testsupport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrGone is the failure of a post to a connection that no longer exists, reported with HTTP status 410
+// the way the API Gateway Management API reports it
+var ErrGone = &StatusError{Code: http.StatusGone}
+
+// StatusError is a failed post with an HTTP status code, like the response errors of the AWS SDK
+type StatusError struct {
+	Code int
+}
+
+// Error describes the status
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("post failed with HTTP status %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// HTTPStatusCode returns the status code, which the handler reads to tell gone and throttled posts apart
+func (e *StatusError) HTTPStatusCode() int {
+	return e.Code
+}
+
+// Frame is one frame posted to a connection
+type Frame struct {
+	ConnectionID string
+	Data         []byte
+	At           time.Time // Time of the post on Clock, or in real time without one
+}
+
+// RecordingPoster records the frames posted to connections. Each post advances Clock by Latency when
+// both are set, and posts can be made to fail with FailAt. A RecordingPoster is safe for concurrent use.
+type RecordingPoster struct {
+	Clock   *Clock
+	Latency time.Duration
+
+	mu       sync.Mutex
+	calls    int
+	failures map[int]error
+	frames   []Frame
+}
+
+// NewRecordingPoster creates a poster accepting every post
+func NewRecordingPoster() *RecordingPoster {
+	return &RecordingPoster{}
+}
+
+// FailAt makes the post with the given zero based index fail with err instead of being recorded.
+// It returns the poster, so failures can be chained when it is created.
+func (p *RecordingPoster) FailAt(index int, err error) *RecordingPoster {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures == nil {
+		p.failures = make(map[int]error)
+	}
+	p.failures[index] = err
+	return p
+}
+
+// PostToConnection records data as a frame of connectionID, or fails with the error set for the post
+func (p *RecordingPoster) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	if p.Clock != nil {
+		p.Clock.Advance(p.Latency)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	index := p.calls
+	p.calls++
+	if err, ok := p.failures[index]; ok {
+		return err
+	}
+	at := time.Now()
+	if p.Clock != nil {
+		at = p.Clock.Now()
+	}
+	p.frames = append(p.frames, Frame{ConnectionID: connectionID, Data: append([]byte(nil), data...), At: at})
+	return nil
+}
+
+// Frames returns the recorded frames, in the order they were posted
+func (p *RecordingPoster) Frames() []Frame {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Frame(nil), p.frames...)
+}
+
+// Texts returns the data of the recorded frames as strings
+func (p *RecordingPoster) Texts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	texts := make([]string, len(p.frames))
+	for i, frame := range p.frames {
+		texts[i] = string(frame.Data)
+	}
+	return texts
+}
+
+// Calls returns the number of posts, failed ones included
+func (p *RecordingPoster) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	errorCodeTimeout         = "timeout"
+	statusCodeGatewayTimeout = 504
+)
+
+// ErrOpenAITimeout is returned when a blocking OpenAI API call takes longer than OPENAI_TIMEOUT_MS
+var ErrOpenAITimeout = errors.New("OpenAI API request timed out, try again")
+
+// ErrFirstTokenTimeout is returned when a stream delivers no token within OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS
+var ErrFirstTokenTimeout = errors.New("OpenAI API stream sent no token in time, try again")
+
+// ErrStreamStalled is returned when a stream delivers no chunk within OPENAI_STREAM_STALL_TIMEOUT_MS after its first token
+var ErrStreamStalled = errors.New("OpenAI API stream stalled, try again")
+
+// isTimeoutError checks if err is one of the OpenAI API timeouts
+func isTimeoutError(err error) bool {
+	return errors.Is(err, ErrOpenAITimeout) || errors.Is(err, ErrFirstTokenTimeout) || errors.Is(err, ErrStreamStalled)
+}
+
+// withOpenAITimeout runs one blocking OpenAI API call bounded by OPENAI_TIMEOUT_MS. Every attempt of the
+// retries gets the full timeout, and the call failing because of it returns ErrOpenAITimeout.
+func withOpenAITimeout[T any](ctx context.Context, cfg *Config, call func(context.Context) (T, error)) (T, error) {
+	if cfg.OpenAITimeout <= 0 {
+		return call(ctx)
+	}
+	callCtx, cancel := context.WithTimeout(ctx, cfg.OpenAITimeout)
+	defer cancel()
+	result, err := call(callCtx)
+	if err != nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return result, ErrOpenAITimeout
+	}
+	return result, err
+}
+
+// streamWatchdog aborts a stream that delivers no token within OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS, or that
+// goes quiet for OPENAI_STREAM_STALL_TIMEOUT_MS after its first token. The aborted context carries the reason.
+type streamWatchdog struct {
+	ctx       context.Context
+	abort     context.CancelCauseFunc
+	clock     Clock
+	stopTimer func() bool // Stops the running timer, nil when none runs
+	stall     time.Duration
+	tokens    bool // Set once the first token arrived
+}
+
+// newStreamWatchdog starts the first token timer on clock, returning the context the stream must be read with
+func newStreamWatchdog(ctx context.Context, cfg *Config, clock Clock) (context.Context, *streamWatchdog) {
+	w := &streamWatchdog{clock: clock, stall: cfg.StreamStallTimeout}
+	if cfg.StreamFirstTokenTimeout <= 0 && w.stall <= 0 {
+		return ctx, w
+	}
+	w.ctx, w.abort = context.WithCancelCause(ctx)
+	if cfg.StreamFirstTokenTimeout > 0 {
+		w.stopTimer = clock.AfterFunc(cfg.StreamFirstTokenTimeout, func() { w.abort(ErrFirstTokenTimeout) })
+	}
+	return w.ctx, w
+}
+
+// restartStall stops the running timer and starts the stall timer
+func (w *streamWatchdog) restartStall() {
+	if w.stopTimer != nil {
+		w.stopTimer()
+	}
+	w.stopTimer = w.clock.AfterFunc(w.stall, func() { w.abort(ErrStreamStalled) })
+}
+
+// chunkArrived restarts the stall timer. The first token stops the first token timer.
+func (w *streamWatchdog) chunkArrived(token bool) {
+	if w.abort == nil || !token && !w.tokens {
+		return
+	}
+	if !w.tokens {
+		w.tokens = true
+		if w.stall > 0 {
+			w.restartStall()
+		} else if w.stopTimer != nil {
+			w.stopTimer()
+			w.stopTimer = nil
+		}
+		return
+	}
+	if w.stopTimer != nil {
+		w.restartStall()
+	}
+}
+
+// timedOut returns the timeout that aborted the stream, or nil when the watchdog didn't abort it
+func (w *streamWatchdog) timedOut() error {
+	if w.abort == nil {
+		return nil
+	}
+	if cause := context.Cause(w.ctx); errors.Is(cause, ErrFirstTokenTimeout) || errors.Is(cause, ErrStreamStalled) {
+		return cause
+	}
+	return nil
+}
+
+// stop releases the timer and the context of the watchdog
+func (w *streamWatchdog) stop() {
+	if w.abort == nil {
+		return
+	}
+	if w.stopTimer != nil {
+		w.stopTimer()
+	}
+	w.abort(nil)
+}
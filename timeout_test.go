@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// hangingCompleter answers chat completions only once their context is done, like an OpenAI API that never replies
+type hangingCompleter struct {
+	*testsupport.ScriptedCompleter
+}
+
+func (c hangingCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	<-ctx.Done()
+	return openai.ChatCompletionResponse{}, ctx.Err()
+}
+
+func TestWithOpenAITimeout(t *testing.T) {
+	errAPI := errors.New("API error")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ctx     context.Context
+		call    func(context.Context) (string, error)
+		want    string
+		wantErr error
+	}{
+		{name: "no timeout", ctx: context.Background(), call: func(context.Context) (string, error) { return "ok", nil }, want: "ok"},
+		{name: "in time", timeout: time.Minute, ctx: context.Background(), call: func(context.Context) (string, error) { return "ok", nil }, want: "ok"},
+		{
+			name:    "too slow",
+			timeout: 10 * time.Millisecond,
+			ctx:     context.Background(),
+			call: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			wantErr: ErrOpenAITimeout,
+		},
+		{name: "other error", timeout: time.Minute, ctx: context.Background(), call: func(context.Context) (string, error) { return "", errAPI }, wantErr: errAPI},
+		{
+			// A request canceled by its caller didn't time out
+			name:    "canceled request",
+			timeout: time.Minute,
+			ctx:     canceled,
+			call: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			wantErr: context.Canceled,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withOpenAITimeout(tt.ctx, &Config{OpenAITimeout: tt.timeout}, tt.call)
+			if !errors.Is(err, tt.wantErr) || tt.wantErr == nil && err != nil {
+				t.Fatalf("withOpenAITimeout() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("withOpenAITimeout() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamWatchdog(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		chunk   *bool // Token flag of the chunk arriving after advance, nil for none
+	}
+	token, role := true, false
+	tests := []struct {
+		name       string
+		firstToken time.Duration
+		stall      time.Duration
+		steps      []step
+		want       error
+	}{
+		{name: "first token in time", firstToken: 5 * time.Second, steps: []step{{advance: 4 * time.Second, chunk: &token}, {advance: time.Hour}}},
+		{name: "first token late", firstToken: 5 * time.Second, steps: []step{{advance: 5 * time.Second}}, want: ErrFirstTokenTimeout},
+		{
+			// A chunk carrying only the role isn't a token
+			name:       "role chunk",
+			firstToken: 5 * time.Second,
+			stall:      2 * time.Second,
+			steps:      []step{{advance: 3 * time.Second, chunk: &role}, {advance: 2 * time.Second}},
+			want:       ErrFirstTokenTimeout,
+		},
+		{
+			name:       "chunks in time",
+			firstToken: 5 * time.Second,
+			stall:      2 * time.Second,
+			steps:      []step{{advance: 4 * time.Second, chunk: &token}, {advance: time.Second, chunk: &role}, {advance: 1900 * time.Millisecond, chunk: &token}, {advance: 1900 * time.Millisecond}},
+		},
+		{
+			name:       "stall",
+			firstToken: 5 * time.Second,
+			stall:      2 * time.Second,
+			steps:      []step{{advance: time.Second, chunk: &token}, {advance: time.Second, chunk: &token}, {advance: 2 * time.Second}},
+			want:       ErrStreamStalled,
+		},
+		{
+			// Without a first token timeout, the stall timer starts with the first token
+			name:  "stall only",
+			stall: 2 * time.Second,
+			steps: []step{{advance: time.Hour, chunk: &token}, {advance: 2 * time.Second}},
+			want:  ErrStreamStalled,
+		},
+		{name: "disabled", steps: []step{{advance: time.Hour, chunk: &token}, {advance: time.Hour}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testsupport.NewClock(testStart)
+			ctx, watchdog := newStreamWatchdog(context.Background(), &Config{StreamFirstTokenTimeout: tt.firstToken, StreamStallTimeout: tt.stall}, clock)
+			for _, step := range tt.steps {
+				clock.Advance(step.advance)
+				if step.chunk != nil {
+					watchdog.chunkArrived(*step.chunk)
+				}
+			}
+			if got := watchdog.timedOut(); got != tt.want {
+				t.Fatalf("timedOut() = %v, want %v", got, tt.want)
+			}
+			if aborted := ctx.Err() != nil; aborted != (tt.want != nil) {
+				t.Errorf("stream context aborted = %v, want %v", aborted, tt.want != nil)
+			}
+			watchdog.stop()
+			if clock.Pending() != 0 {
+				t.Errorf("%d timers left running after stop", clock.Pending())
+			}
+		})
+	}
+}
+
+// TestTimeoutFrames checks that every timeout reaches the client as a timeout error frame, which tells it to retry
+func TestTimeoutFrames(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		chat       func(*testsupport.ScriptedCompleter) ChatCompleter
+		chunks     []testsupport.Chunk
+		wantStatus int
+		wantFrame  string
+	}{
+		{
+			name:       "blocking call",
+			body:       `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			chat:       func(chat *testsupport.ScriptedCompleter) ChatCompleter { return hangingCompleter{chat} },
+			wantStatus: statusCodeGatewayTimeout,
+			wantFrame:  `{"type":"error","code":"timeout","message":"Error sending OpenAI API request: ` + ErrOpenAITimeout.Error() + `"}`,
+		},
+		{
+			name:       "first token",
+			body:       `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			chunks:     testsupport.TextChunks(6*time.Second, "a"),
+			wantStatus: statusCodeGatewayTimeout,
+			wantFrame:  `{"type":"error","code":"timeout","message":"` + ErrFirstTokenTimeout.Error() + `"}`,
+		},
+		{
+			name:       "stall",
+			body:       `{"response_type":"stream","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`,
+			chunks:     []testsupport.Chunk{{Delay: time.Second, Content: "a"}, {Delay: 3 * time.Second, Content: "b"}},
+			wantStatus: statusCodeGatewayTimeout,
+			wantFrame:  `{"type":"error","code":"timeout","message":"` + ErrStreamStalled.Error() + `"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIMaxRetries = 0
+				cfg.OpenAITimeout = 10 * time.Millisecond
+				cfg.StreamFirstTokenTimeout = 5 * time.Second
+				cfg.StreamStallTimeout = 2 * time.Second
+			})
+			clock := testsupport.NewClock(testStart)
+			scripted := testsupport.NewScriptedCompleter(testsupport.Stream(tt.chunks...))
+			scripted.Clock = clock
+			var chat ChatCompleter = scripted
+			if tt.chat != nil {
+				chat = tt.chat(scripted)
+			}
+			poster := testsupport.NewRecordingPoster()
+			response, err := newTestHandler(cfg, chat, poster, nil, clock).Handler(context.Background(), testMessage(tt.body))
+			if err != nil || response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, %v, want %d", response.StatusCode, response.Body, err, tt.wantStatus)
+			}
+			texts := poster.Texts()
+			if len(texts) == 0 || texts[len(texts)-1] != tt.wantFrame {
+				t.Errorf("frames = %q, want them to end with %s", texts, tt.wantFrame)
+			}
+		})
+	}
+}
+
+func TestLoadConfigTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    [3]time.Duration // OpenAITimeout, StreamFirstTokenTimeout, StreamStallTimeout
+		wantErr string
+	}{
+		{name: "defaults"},
+		{
+			name: "set",
+			env:  map[string]string{"OPENAI_TIMEOUT_MS": "30000", "OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS": "8000", "OPENAI_STREAM_STALL_TIMEOUT_MS": "20000"},
+			want: [3]time.Duration{30 * time.Second, 8 * time.Second, 20 * time.Second},
+		},
+		{name: "invalid call timeout", env: map[string]string{"OPENAI_TIMEOUT_MS": "soon"}, wantErr: "OPENAI_TIMEOUT_MS"},
+		{name: "invalid first token timeout", env: map[string]string{"OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS": "1s"}, wantErr: "OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS"},
+		{name: "invalid stall timeout", env: map[string]string{"OPENAI_STREAM_STALL_TIMEOUT_MS": "x"}, wantErr: "OPENAI_STREAM_STALL_TIMEOUT_MS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"OPENAI_TIMEOUT_MS", "OPENAI_STREAM_FIRST_TOKEN_TIMEOUT_MS", "OPENAI_STREAM_STALL_TIMEOUT_MS"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig() error = %v, want one naming %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := [3]time.Duration{cfg.OpenAITimeout, cfg.StreamFirstTokenTimeout, cfg.StreamStallTimeout}; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("timeouts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
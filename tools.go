@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const frameTypeToolCalls = "tool_calls"
+
+// toolCall is a tool invocation requested by the model. Clients send it back in the tool_calls of the
+// assistant message preceding their tool results.
+type toolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// toolCallsFrame is posted to legacy clients instead of the answer when the model invokes tools
+type toolCallsFrame struct {
+	Type  string     `json:"type"`
+	Calls []toolCall `json:"calls"`
+}
+
+// fromOpenAIToolCalls converts the tool calls of a completion message
+func fromOpenAIToolCalls(calls []openai.ToolCall) []toolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	converted := make([]toolCall, len(calls))
+	for i, call := range calls {
+		converted[i] = toolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+	}
+	return converted
+}
+
+// toOpenAIToolCalls converts the tool calls of a request message
+func toOpenAIToolCalls(calls []toolCall) []openai.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	converted := make([]openai.ToolCall, len(calls))
+	for i, call := range calls {
+		converted[i] = openai.ToolCall{ID: call.ID, Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments}}
+	}
+	return converted
+}
+
+// toolCallAccumulator joins the tool call deltas of a stream. Only the first delta of a call carries its ID
+// and name, the following ones add fragments of the arguments.
+type toolCallAccumulator struct {
+	calls []toolCall
+}
+
+// add merges the tool call deltas of one stream chunk
+func (a *toolCallAccumulator) add(deltas []openai.ToolCall) {
+	for _, delta := range deltas {
+		index := len(a.calls)
+		if delta.Index != nil {
+			index = *delta.Index
+		}
+		for len(a.calls) <= index {
+			a.calls = append(a.calls, toolCall{})
+		}
+		call := &a.calls[index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Function.Name != "" {
+			call.Name = delta.Function.Name
+		}
+		call.Arguments += delta.Function.Arguments
+	}
+}
+
+// checkTools checks the tool definitions and the tool choice of the request
+func checkTools(request Request) error {
+	if len(request.Tools) == 0 {
+		if request.ToolChoice != nil {
+			return fmt.Errorf("tool_choice requires tools")
+		}
+		return nil
+	}
+	if request.ResponseType != responseTypeFull && request.ResponseType != responseTypeStream {
+		return fmt.Errorf("tools are only supported by the full and stream response types")
+	}
+	for i, tool := range request.Tools {
+		if tool.Type != openai.ToolTypeFunction {
+			return fmt.Errorf("tools[%d].type must be function, got %q", i, tool.Type)
+		}
+		if tool.Function == nil || tool.Function.Name == "" {
+			return fmt.Errorf("tools[%d].function.name is required", i)
+		}
+	}
+	return nil
+}
+
+// postToolCalls posts the tool calls of the model in place of the answer
+func postToolCalls(openAIRequest openAIRequest, info completionInfo) error {
+	if openAIRequest.isV2() {
+		return postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeToolCalls, Data: info.ToolCalls, FinishReason: info.FinishReason, Model: info.Model})
+	}
+	payload, err := json.Marshal(toolCallsFrame{Type: frameTypeToolCalls, Calls: info.ToolCalls})
+	if err != nil {
+		return fmt.Errorf("Can't encode tool calls frame: %v", err)
+	}
+	return postToConnection(openAIRequest, payload)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testTools = `"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]`
+
+// toolCallDelta is a stream delta of the tool call at index
+func toolCallDelta(index int, id string, name string, arguments string) openai.ToolCall {
+	return openai.ToolCall{Index: &index, ID: id, Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: name, Arguments: arguments}}
+}
+
+// toolCallsTurn answers a completion with calls, and streams them with their arguments split in fragments
+func toolCallsTurn() testsupport.Turn {
+	turn := testsupport.Stream(
+		testsupport.Chunk{ToolCalls: []openai.ToolCall{toolCallDelta(0, "call-1", "get_weather", `{"ci`)}},
+		testsupport.Chunk{ToolCalls: []openai.ToolCall{toolCallDelta(0, "", "", `ty":"Paris"}`), toolCallDelta(1, "call-2", "get_weather", `{"city":`)}},
+		testsupport.Chunk{ToolCalls: []openai.ToolCall{toolCallDelta(1, "", "", `"Oslo"}`)}},
+		testsupport.Chunk{FinishReason: openai.FinishReasonToolCalls},
+	)
+	turn.Response.Choices[0].Message.ToolCalls = []openai.ToolCall{
+		{ID: "call-1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call-2", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Oslo"}`}},
+	}
+	return turn
+}
+
+func TestToolCallAccumulator(t *testing.T) {
+	var accumulator toolCallAccumulator
+	for _, chunk := range toolCallsTurn().Chunks {
+		accumulator.add(chunk.ToolCalls)
+	}
+	want := []toolCall{
+		{ID: "call-1", Name: "get_weather", Arguments: `{"city":"Paris"}`},
+		{ID: "call-2", Name: "get_weather", Arguments: `{"city":"Oslo"}`},
+	}
+	if !reflect.DeepEqual(accumulator.calls, want) {
+		t.Errorf("calls = %+v, want %+v", accumulator.calls, want)
+	}
+}
+
+func TestCheckTools(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{name: "no tools", body: `{"response_type":"full"}`},
+		{name: "full", body: `{"response_type":"full",` + testTools + `,"tool_choice":"auto"}`},
+		{name: "stream", body: `{"response_type":"stream",` + testTools + `,"tool_choice":{"type":"function","function":{"name":"get_weather"}}}`},
+		{name: "extractor", body: `{"response_type":"int",` + testTools + `}`, wantErr: "tools are only supported by the full and stream response types"},
+		{name: "tool_choice without tools", body: `{"response_type":"full","tool_choice":"required"}`, wantErr: "tool_choice requires tools"},
+		{name: "unknown type", body: `{"response_type":"full","tools":[{"type":"retrieval","function":{"name":"search"}}]}`, wantErr: `tools[0].type must be function, got "retrieval"`},
+		{name: "no name", body: `{"response_type":"full","tools":[{"type":"function","function":{"description":"Weather"}}]}`, wantErr: "tools[0].function.name is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseRequestBody(tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkTools(request)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("checkTools() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestToolCalls checks that the tools reach OpenAI and that the calls of the model are posted as one frame
+func TestToolCalls(t *testing.T) {
+	const frame = `{"type":"tool_calls","calls":[{"id":"call-1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"},{"id":"call-2","name":"get_weather","arguments":"{\"city\":\"Oslo\"}"}]}`
+	tests := []struct {
+		responseType string
+		wantFrames   []string
+	}{
+		{responseType: responseTypeFull, wantFrames: []string{frame}},
+		// The argument fragments of the stream aren't posted on their own
+		{responseType: responseTypeStream, wantFrames: []string{frame, "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = "<END>"
+				cfg.StreamFlushInterval = 0
+			})
+			chat := testsupport.NewScriptedCompleter(toolCallsTurn())
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST",` + testTools + `,"tool_choice":"auto","messages":[{"role":"user","content":"Weather in Paris and Oslo?"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, want 200", response.StatusCode, response.Body)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			request := chat.Requests()[0]
+			if len(request.Tools) != 1 || request.Tools[0].Function.Name != "get_weather" || request.ToolChoice != "auto" {
+				t.Errorf("tools = %+v, tool_choice = %v, want get_weather and auto", request.Tools, request.ToolChoice)
+			}
+		})
+	}
+}
+
+// TestToolResults sends the results of the tool calls back on the next turn
+func TestToolResults(t *testing.T) {
+	cfg := testConfig(t, nil)
+	chat := testsupport.NewScriptedCompleter(testsupport.Reply("Sunny in Paris"))
+	body := `{"response_type":"full","prompt_template":"PROMPT_TEST",` + testTools + `,"messages":[` +
+		`{"role":"user","content":"Weather in Paris?"},` +
+		`{"role":"assistant","tool_calls":[{"id":"call-1","name":"get_weather","arguments":"{\"city\":\"Paris\"}"}]},` +
+		`{"role":"tool","tool_call_id":"call-1","content":"{\"sky\":\"sunny\"}"}]}`
+	response, poster := runTestRequest(t, cfg, chat, body)
+	if response.StatusCode != statusCodeOK || !reflect.DeepEqual(poster.Texts(), []string{"Sunny in Paris"}) {
+		t.Fatalf("Handler() = %d %s, frames %q", response.StatusCode, response.Body, poster.Texts())
+	}
+	messages := chat.Requests()[0].Messages
+	if len(messages) != 4 {
+		t.Fatalf("%d messages, want the system prompt and 3", len(messages))
+	}
+	wantCalls := []openai.ToolCall{{ID: "call-1", Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}
+	if !reflect.DeepEqual(messages[2].ToolCalls, wantCalls) {
+		t.Errorf("assistant tool calls = %+v, want %+v", messages[2].ToolCalls, wantCalls)
+	}
+	if messages[3].Role != openai.ChatMessageRoleTool || messages[3].ToolCallID != "call-1" || messages[3].Content != `{"sky":"sunny"}` {
+		t.Errorf("tool message = %+v, want the result of call-1", messages[3])
+	}
+}
+
+func TestToolMessagesValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages string
+		wantBody string
+	}{
+		{name: "tool result without a call ID", messages: `{"role":"tool","content":"sunny"}`, wantBody: "messages[0].tool_call_id is required for the tool role"},
+		{name: "call ID of a user message", messages: `{"role":"user","tool_call_id":"call-1","content":"sunny"}`, wantBody: "messages[0].tool_call_id is only allowed for the tool role"},
+		{name: "tool calls of a user message", messages: `{"role":"user","content":"hi","tool_calls":[{"id":"call-1","name":"get_weather","arguments":"{}"}]}`, wantBody: "messages[0].tool_calls is only allowed for the assistant role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, nil)
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			response, _ := runTestRequest(t, cfg, chat, `{"response_type":"full","prompt_template":"PROMPT_TEST","messages":[`+tt.messages+`]}`)
+			if response.StatusCode != statusCodeBadRequest || !strings.Contains(response.Body, tt.wantBody) {
+				t.Errorf("Handler() = %d %s, want 400 with %q", response.StatusCode, response.Body, tt.wantBody)
+			}
+			if len(chat.Requests()) != 0 {
+				t.Error("the invalid request reached OpenAI")
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	awsv2 "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go/aws/session"
+	xrayawsv2 "github.com/aws/aws-xray-sdk-go/instrumentation/awsv2"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// setupTracing keeps the X-Ray SDK quiet outside Lambda, where there is no segment to attach subsegments to.
+// An explicit AWS_XRAY_CONTEXT_MISSING setting takes precedence.
+func setupTracing() {
+	if os.Getenv("AWS_XRAY_CONTEXT_MISSING") != "" {
+		return
+	}
+	xray.Configure(xray.Config{ContextMissingStrategy: ctxmissing.NewDefaultIgnoreErrorStrategy()})
+}
+
+// newTracedSession returns an AWS session whose calls appear as X-Ray subsegments of the invocation
+func newTracedSession() *session.Session {
+	return xray.AWSSession(session.Must(session.NewSession()))
+}
+
+// newTracedAWSConfig loads the AWS SDK v2 configuration, whose calls appear as X-Ray subsegments of the
+// invocation like those of the session. It panics on a broken shared configuration, like session.Must.
+func newTracedAWSConfig() awsv2.Config {
+	awsConfig, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		panic(fmt.Sprintf("Can't load AWS configuration: %s", err))
+	}
+	xrayawsv2.AWSV2Instrumentor(&awsConfig.APIOptions)
+	return awsConfig
+}
+
+// isTraced checks if ctx belongs to a traced Lambda invocation or already carries a segment
+func isTraced(ctx context.Context) bool {
+	return xray.GetSegment(ctx) != nil || ctx.Value(xray.LambdaTraceHeaderKey) != nil
+}
+
+// traceSubsegment runs fn inside an X-Ray subsegment named name, or simply runs it when ctx isn't traced
+func traceSubsegment(ctx context.Context, name string, fn func(context.Context) error) error {
+	if !isTraced(ctx) {
+		return fn(ctx)
+	}
+	return xray.Capture(ctx, name, fn)
+}
+
+// beginSubsegment starts an X-Ray subsegment for work that doesn't fit in one function. The returned
+// subsegment is nil when ctx isn't traced, which endSubsegment accepts.
+func beginSubsegment(ctx context.Context, name string) (context.Context, *xray.Segment) {
+	if !isTraced(ctx) {
+		return ctx, nil
+	}
+	return xray.BeginSubsegment(ctx, name)
+}
+
+// endSubsegment closes a subsegment started by beginSubsegment, recording err on it
+func endSubsegment(seg *xray.Segment, err error) {
+	if seg != nil {
+		seg.Close(err)
+	}
+}
+
+// annotateTrace adds the filterable request attributes to the current subsegment
+func annotateTrace(ctx context.Context, cfg *Config, request Request) {
+	if xray.GetSegment(ctx) == nil {
+		return
+	}
+	for key, value := range map[string]string{
+		"model":           cfg.OpenAIModel,
+		"response_type":   request.ResponseType,
+		"prompt_template": request.PromptTemplate,
+	} {
+		if err := xray.AddAnnotation(ctx, key, value); err != nil {
+			loggerFrom(ctx).Debug("Can't annotate trace", "key", key, "error", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-xray-sdk-go/strategy/sampling"
+	"github.com/aws/aws-xray-sdk-go/xray"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// traceDocument is the part of an emitted X-Ray segment the tests look at
+type traceDocument struct {
+	Name        string            `json:"name"`
+	Annotations map[string]any    `json:"annotations"`
+	Subsegments []json.RawMessage `json:"subsegments"`
+}
+
+// subsegments returns the subsegments of the document by name, at any depth
+func (d traceDocument) subsegments(t *testing.T) map[string]traceDocument {
+	t.Helper()
+	found := make(map[string]traceDocument)
+	for _, raw := range d.Subsegments {
+		var sub traceDocument
+		if err := json.Unmarshal(raw, &sub); err != nil {
+			t.Fatalf("subsegment %s isn't JSON: %v", raw, err)
+		}
+		found[sub.Name] = sub
+		for name, nested := range sub.subsegments(t) {
+			found[name] = nested
+		}
+	}
+	return found
+}
+
+// tracedContext returns a context carrying a sampled segment named test, emitted to a local daemon when closed.
+// The returned function closes the segment and returns the emitted document.
+func tracedContext(t *testing.T) (context.Context, func() traceDocument) {
+	t.Helper()
+	daemon, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { daemon.Close() })
+	emitter, err := xray.NewDefaultEmitter(daemon.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strategy, err := sampling.NewLocalizedStrategyFromJSONBytes([]byte(`{"version":2,"default":{"fixed_target":1,"rate":1}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := xray.ContextWithConfig(context.Background(), xray.Config{DaemonAddr: daemon.LocalAddr().String(), Emitter: emitter, SamplingStrategy: strategy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, segment := xray.BeginSegment(ctx, "test")
+	return ctx, func() traceDocument {
+		t.Helper()
+		segment.Close(nil)
+		buffer := make([]byte, 64*1024)
+		for {
+			if err := daemon.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			n, err := daemon.Read(buffer)
+			if err != nil {
+				t.Fatalf("no segment emitted: %v", err)
+			}
+			// Every packet is a header line followed by the document
+			_, body, _ := bytes.Cut(buffer[:n], []byte("\n"))
+			var document traceDocument
+			if err := json.Unmarshal(body, &document); err != nil {
+				t.Fatalf("emitted %q isn't a segment: %v", body, err)
+			}
+			if document.Name == "test" {
+				return document
+			}
+		}
+	}
+}
+
+// TestTracedRequest checks that a traced invocation records the OpenAI calls as annotated subsegments
+func TestTracedRequest(t *testing.T) {
+	tests := []struct {
+		responseType    string
+		turn            testsupport.Turn
+		wantSubsegments []string
+	}{
+		{responseType: responseTypeFull, turn: testsupport.Reply("Hello"), wantSubsegments: []string{"HandleRequest", "CreateChatCompletion"}},
+		{responseType: responseTypeStream, turn: testsupport.Stream(testsupport.TextChunks(0, "Hel", "lo")...), wantSubsegments: []string{"HandleRequest", "CreateChatCompletionStream", "ConsumeStream"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.OpenAIModel = "gpt-test" })
+			h := newTestHandler(cfg, testsupport.NewScriptedCompleter(tt.turn), testsupport.NewRecordingPoster(), nil, nil)
+			ctx, closeSegment := tracedContext(t)
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]}`
+			if response, err := h.Handler(ctx, testMessage(body)); err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v, want 200", response.StatusCode, response.Body, err)
+			}
+			subsegments := closeSegment().subsegments(t)
+			for _, name := range tt.wantSubsegments {
+				if _, ok := subsegments[name]; !ok {
+					t.Errorf("no %s subsegment in %v", name, subsegments)
+				}
+			}
+			want := map[string]any{"model": "gpt-test", "response_type": tt.responseType, "prompt_template": "PROMPT_TEST"}
+			for key, value := range want {
+				if got := subsegments["HandleRequest"].Annotations[key]; got != value {
+					t.Errorf("HandleRequest annotation %s = %v, want %v", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+// TestTracingOutsideLambda checks that the helpers are no-ops without a trace context
+func TestTracingOutsideLambda(t *testing.T) {
+	ctx := context.Background()
+	if isTraced(ctx) {
+		t.Fatal("isTraced() = true without a trace context")
+	}
+	failure := errors.New("failed")
+	called := false
+	err := traceSubsegment(ctx, "Work", func(got context.Context) error {
+		called = got == ctx
+		return failure
+	})
+	if !called || err != failure {
+		t.Errorf("traceSubsegment() = %v, called with the context %v, want the error of fn", err, called)
+	}
+	subCtx, segment := beginSubsegment(ctx, "Work")
+	if subCtx != ctx || segment != nil {
+		t.Errorf("beginSubsegment() = %v, %v, want the context and no subsegment", subCtx, segment)
+	}
+	endSubsegment(segment, failure)
+	annotateTrace(ctx, &Config{OpenAIModel: "gpt-test"}, Request{ResponseType: responseTypeFull})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const frameTypeUsage = "usage"
+
+// usageFrame is posted after the answer when the request sets include_usage
+type usageFrame struct {
+	Type              string             `json:"type,omitempty"`
+	PromptTokens      int                `json:"prompt_tokens"`
+	CompletionTokens  int                `json:"completion_tokens"`
+	TotalTokens       int                `json:"total_tokens"`
+	Model             string             `json:"model,omitempty"`
+	SystemFingerprint string             `json:"system_fingerprint,omitempty"`
+	User              *userIdentity      `json:"user,omitempty"`
+	Tenant            string             `json:"tenant,omitempty"`
+	Annotations       *outputAnnotations `json:"annotations,omitempty"`
+}
+
+// addUsage adds the token counts of usage to total
+func addUsage(total *openai.Usage, usage openai.Usage) {
+	total.PromptTokens += usage.PromptTokens
+	total.CompletionTokens += usage.CompletionTokens
+	total.TotalTokens += usage.TotalTokens
+}
+
+// postUsage posts the usage frame when the request sets include_usage. Legacy clients get the annotations
+// in this frame, v2 clients on the terminal envelope instead.
+func postUsage(openAIRequest openAIRequest, info completionInfo, annotations *outputAnnotations) error {
+	if !openAIRequest.request.IncludeUsage {
+		return nil
+	}
+	frame := usageFrame{
+		PromptTokens:      info.Usage.PromptTokens,
+		CompletionTokens:  info.Usage.CompletionTokens,
+		TotalTokens:       info.Usage.TotalTokens,
+		Model:             info.Model,
+		SystemFingerprint: info.SystemFingerprint,
+		User:              openAIRequest.identity,
+		Tenant:            tenantFrom(openAIRequest.ctx),
+	}
+
+	var err error
+	if openAIRequest.isV2() {
+		err = postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeUsage, Data: frame})
+	} else {
+		frame.Type = frameTypeUsage
+		frame.Annotations = annotations
+		var data []byte
+		data, err = json.Marshal(frame)
+		if err != nil {
+			return fmt.Errorf("Can't encode usage frame: %v", err)
+		}
+		err = postToConnection(openAIRequest, data)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't post usage to websocket: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// usageTurn answers with "Hi" and the token counts 10, 2 and 12
+func usageTurn() testsupport.Turn {
+	usage := openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}
+	turn := testsupport.Stream(testsupport.Chunk{Content: "Hi"}, testsupport.Chunk{FinishReason: openai.FinishReasonStop}, testsupport.Chunk{Usage: &usage})
+	turn.Response.Usage = usage
+	return turn
+}
+
+func TestUsageFrames(t *testing.T) {
+	const usage = `{"type":"usage","prompt_tokens":10,"completion_tokens":2,"total_tokens":12,"model":"gpt-3.5-turbo"}`
+	tests := []struct {
+		name             string
+		responseType     string
+		includeUsage     bool
+		wantFrames       []string
+		wantStreamOption bool
+	}{
+		{name: "full", responseType: "full", includeUsage: true, wantFrames: []string{"Hi", usage}},
+		{name: "full without usage", responseType: "full", wantFrames: []string{"Hi"}},
+		{name: "stream", responseType: "stream", includeUsage: true, wantFrames: []string{"Hi", usage, "<END>"}, wantStreamOption: true},
+		{name: "stream without usage", responseType: "stream", wantFrames: []string{"Hi", "<END>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = "<END>"
+				cfg.OpenAIModel = "gpt-3.5-turbo"
+			})
+			chat := testsupport.NewScriptedCompleter(usageTurn())
+			body := `{"response_type":"` + tt.responseType + `","prompt_template":"PROMPT_TEST","messages":[{"role":"user","content":"hi"}]`
+			if tt.includeUsage {
+				body += `,"include_usage":true`
+			}
+			response, poster := runTestRequest(t, cfg, chat, body+"}")
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Fatalf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			if tt.responseType == "stream" {
+				options := chat.Requests()[0].StreamOptions
+				if (options != nil && options.IncludeUsage) != tt.wantStreamOption {
+					t.Fatalf("stream options = %+v, want include_usage %v", options, tt.wantStreamOption)
+				}
+			}
+		})
+	}
+}
+
+func TestUsageFrameOfV2Clients(t *testing.T) {
+	cfg := testConfig(t, nil)
+	chat := testsupport.NewScriptedCompleter(usageTurn())
+	body := `{"response_type":"full","prompt_template":"PROMPT_TEST","protocol":"v2","include_usage":true,"messages":[{"role":"user","content":"hi"}]}`
+	_, poster := runTestRequest(t, cfg, chat, body)
+	var types []string
+	var usage usageFrame
+	for _, text := range poster.Texts() {
+		var envelope struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(text), &envelope); err != nil {
+			t.Fatalf("can't decode envelope %s: %v", text, err)
+		}
+		types = append(types, envelope.Type)
+		if envelope.Type == frameTypeUsage {
+			if err := json.Unmarshal(envelope.Data, &usage); err != nil {
+				t.Fatalf("can't decode usage %s: %v", envelope.Data, err)
+			}
+		}
+	}
+	if strings.Join(types, ",") != "final,usage" || usage.TotalTokens != 12 || usage.Type != "" {
+		t.Fatalf("envelopes %v with usage %+v", types, usage)
+	}
+}
+
+func TestUsageFrameSystemFingerprint(t *testing.T) {
+	const want = `{"type":"usage","prompt_tokens":10,"completion_tokens":2,"total_tokens":12,"model":"gpt-3.5-turbo","system_fingerprint":"fp_test"}`
+	for _, responseType := range []string{"full", "stream"} {
+		t.Run(responseType, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.EndStreamMessage = "<END>"
+				cfg.OpenAIModel = "gpt-3.5-turbo"
+			})
+			turn := usageTurn()
+			turn.Response.SystemFingerprint = "fp_test"
+			turn.Chunks[0].SystemFingerprint = "fp_test"
+			chat := testsupport.NewScriptedCompleter(turn)
+			body := `{"response_type":"` + responseType + `","prompt_template":"PROMPT_TEST","include_usage":true,"messages":[{"role":"user","content":"hi"}]}`
+			response, poster := runTestRequest(t, cfg, chat, body)
+			if response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s", response.StatusCode, response.Body)
+			}
+			if texts := poster.Texts(); len(texts) < 2 || texts[1] != want {
+				t.Errorf("frames = %q, want the usage frame %s", texts, want)
+			}
+		})
+	}
+}
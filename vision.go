@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	contentPartText     = "text"
+	contentPartImageURL = "image_url"
+	// maxImageBytes caps the decoded size of an image sent as a data URI
+	maxImageBytes = 20 * 1024 * 1024
+	// imageTokenEstimate is what an image is assumed to cost when fitting the context window, the cost of
+	// a high detail image of typical size
+	imageTokenEstimate = 765
+)
+
+// defaultVisionModels are the models accepting image content when VISION_MODELS isn't set
+var defaultVisionModels = []string{openai.GPT4o, openai.GPT4oMini, openai.GPT4Turbo, openai.GPT4Dot1, openai.GPT4Dot1Mini}
+
+// contentPart is one part of the multi-part content of a message
+type contentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *imageURLSource `json:"image_url,omitempty"`
+}
+
+// imageURLSource is the image of an image_url content part, either an https URL or a data URI
+type imageURLSource struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// plainChatMessage has the fields of chatMessage without its JSON methods
+type plainChatMessage chatMessage
+
+// UnmarshalJSON accepts the content of a message either as a string or as an array of content parts
+func (m *chatMessage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		plainChatMessage
+		Content json.RawMessage `json:"content"`
+	}
+	// Custom unmarshalers don't inherit the settings of the outer decoder, so reject unknown fields here too
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	*m = chatMessage(raw.plainChatMessage)
+	content := bytes.TrimSpace(raw.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+		return nil
+	case content[0] == '[':
+		return json.Unmarshal(content, &m.Parts)
+	default:
+		return json.Unmarshal(content, &m.Content)
+	}
+}
+
+// MarshalJSON writes multi-part content as an array, so stored conversations keep their images
+func (m chatMessage) MarshalJSON() ([]byte, error) {
+	if m.Parts == nil {
+		return json.Marshal(plainChatMessage(m))
+	}
+	return json.Marshal(struct {
+		plainChatMessage
+		Content []contentPart `json:"content"`
+	}{plainChatMessage(m), m.Parts})
+}
+
+// text returns the text content of the message, joining the text parts of multi-part content
+func (m chatMessage) text() string {
+	if m.Parts == nil {
+		return m.Content
+	}
+	var texts []string
+	for _, part := range m.Parts {
+		if part.Type == contentPartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// imageCount returns the number of image parts of the message
+func (m chatMessage) imageCount() int {
+	count := 0
+	for _, part := range m.Parts {
+		if part.Type == contentPartImageURL {
+			count++
+		}
+	}
+	return count
+}
+
+// toOpenAIParts converts multi-part content
+func toOpenAIParts(parts []contentPart) []openai.ChatMessagePart {
+	if parts == nil {
+		return nil
+	}
+	converted := make([]openai.ChatMessagePart, len(parts))
+	for i, part := range parts {
+		converted[i] = openai.ChatMessagePart{Type: openai.ChatMessagePartType(part.Type), Text: part.Text}
+		if part.ImageURL != nil {
+			converted[i].ImageURL = &openai.ChatMessageImageURL{URL: part.ImageURL.URL, Detail: openai.ImageURLDetail(part.ImageURL.Detail)}
+		}
+	}
+	return converted
+}
+
+// parseVisionModels parses the comma separated VISION_MODELS value, falling back to the default vision models
+func parseVisionModels(value string) map[string]bool {
+	models := make(map[string]bool)
+	for _, name := range splitList(value, defaultVisionModels) {
+		models[name] = true
+	}
+	return models
+}
+
+// checkContentParts checks the multi-part content of messages[index]
+func checkContentParts(index int, message chatMessage) error {
+	if len(message.Parts) == 0 {
+		return fmt.Errorf("messages[%d].content must not be an empty array", index)
+	}
+	for i, part := range message.Parts {
+		switch part.Type {
+		case contentPartText:
+			if part.Text == "" {
+				return fmt.Errorf("messages[%d].content[%d].text is required", index, i)
+			}
+		case contentPartImageURL:
+			if message.Role != openai.ChatMessageRoleUser {
+				return fmt.Errorf("messages[%d].content[%d] images are only allowed for the user role", index, i)
+			}
+			if part.ImageURL == nil {
+				return fmt.Errorf("messages[%d].content[%d].image_url is required", index, i)
+			}
+			if err := checkImageURL(part.ImageURL); err != nil {
+				return fmt.Errorf("messages[%d].content[%d].image_url.%w", index, i, err)
+			}
+		default:
+			return fmt.Errorf("messages[%d].content[%d].type must be text or image_url, got %q", index, i, part.Type)
+		}
+	}
+	return nil
+}
+
+// checkImageURL checks that an image is an https URL or a base64 data URI of at most maxImageBytes
+func checkImageURL(image *imageURLSource) error {
+	switch openai.ImageURLDetail(image.Detail) {
+	case "", openai.ImageURLDetailAuto, openai.ImageURLDetailLow, openai.ImageURLDetailHigh:
+	default:
+		return fmt.Errorf("detail must be auto, low or high, got %q", image.Detail)
+	}
+	if strings.HasPrefix(image.URL, "https://") {
+		return nil
+	}
+	header, data, found := strings.Cut(image.URL, ",")
+	if !strings.HasPrefix(header, "data:image/") || !found {
+		return fmt.Errorf("url must be an https URL or an image data URI")
+	}
+	if !strings.HasSuffix(header, ";base64") {
+		return fmt.Errorf("url data URI must be base64 encoded")
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > maxImageBytes {
+		return fmt.Errorf("url data URI exceeds %d bytes", maxImageBytes)
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		return fmt.Errorf("url data URI isn't valid base64: %v", err)
+	}
+	return nil
+}
+
+// checkVisionModel checks that the configured model accepts the images of the messages
+func checkVisionModel(cfg *Config, request Request) error {
+	model := requestModel(cfg, request)
+	for _, message := range request.Messages {
+		if message.imageCount() > 0 && !cfg.VisionModels[model] {
+			return fmt.Errorf("messages contain images, which the model %s doesn't accept; vision models are listed in VISION_MODELS", model)
+		}
+	}
+	return nil
+}
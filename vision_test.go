@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+const testImageURL = "https://example.com/cat.png"
+
+func TestChatMessageContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    chatMessage
+		wantErr bool
+	}{
+		{name: "string", json: `{"role":"user","content":"hi"}`, want: chatMessage{Role: "user", Content: "hi"}},
+		{name: "no content", json: `{"role":"assistant","content":null}`, want: chatMessage{Role: "assistant"}},
+		{
+			name: "parts",
+			json: `{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"` + testImageURL + `","detail":"low"}}]}`,
+			want: chatMessage{Role: "user", Parts: []contentPart{
+				{Type: contentPartText, Text: "What is this?"},
+				{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: testImageURL, Detail: "low"}},
+			}},
+		},
+		{name: "unknown field", json: `{"role":"user","content":"hi","contnet":"hi"}`, wantErr: true},
+		{name: "number", json: `{"role":"user","content":42}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got chatMessage
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Unmarshal() = %+v, want %+v", got, tt.want)
+			}
+			// Stored conversations keep the content in the same shape
+			data, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var roundTrip chatMessage
+			if err := json.Unmarshal(data, &roundTrip); err != nil || !reflect.DeepEqual(roundTrip, tt.want) {
+				t.Errorf("round trip of %s = %+v, %v, want %+v", data, roundTrip, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatMessageText(t *testing.T) {
+	message := chatMessage{Role: "user", Parts: []contentPart{
+		{Type: contentPartText, Text: "first"},
+		{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: testImageURL}},
+		{Type: contentPartText, Text: "second"},
+		{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: testImageURL}},
+	}}
+	if got := message.text(); got != "first\nsecond" {
+		t.Errorf("text() = %q, want the text parts joined", got)
+	}
+	if got := message.imageCount(); got != 2 {
+		t.Errorf("imageCount() = %d, want 2", got)
+	}
+	plain := chatMessage{Role: "user", Content: "hi"}
+	if plain.text() != "hi" || plain.imageCount() != 0 {
+		t.Errorf("text() = %q, imageCount() = %d of string content", plain.text(), plain.imageCount())
+	}
+}
+
+func TestCheckImageURL(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n"))
+	tests := []struct {
+		name    string
+		image   imageURLSource
+		wantErr bool
+	}{
+		{name: "https", image: imageURLSource{URL: testImageURL}},
+		{name: "detail", image: imageURLSource{URL: testImageURL, Detail: "high"}},
+		{name: "unknown detail", image: imageURLSource{URL: testImageURL, Detail: "ultra"}, wantErr: true},
+		{name: "data URI", image: imageURLSource{URL: "data:image/png;base64," + png}},
+		{name: "http", image: imageURLSource{URL: "http://example.com/cat.png"}, wantErr: true},
+		{name: "file", image: imageURLSource{URL: "file:///etc/passwd"}, wantErr: true},
+		{name: "not an image", image: imageURLSource{URL: "data:text/html;base64," + png}, wantErr: true},
+		{name: "not base64 encoded", image: imageURLSource{URL: "data:image/svg+xml,<svg/>"}, wantErr: true},
+		{name: "invalid base64", image: imageURLSource{URL: "data:image/png;base64,not base64!"}, wantErr: true},
+		{name: "too large", image: imageURLSource{URL: "data:image/png;base64," + strings.Repeat("A", base64.StdEncoding.EncodedLen(maxImageBytes+3))}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkImageURL(&tt.image); (err != nil) != tt.wantErr {
+				t.Errorf("checkImageURL() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckContentParts(t *testing.T) {
+	image := contentPart{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: testImageURL}}
+	tests := []struct {
+		name    string
+		message chatMessage
+		wantErr string
+	}{
+		{name: "text and image", message: chatMessage{Role: "user", Parts: []contentPart{{Type: contentPartText, Text: "What is this?"}, image}}},
+		{name: "empty array", message: chatMessage{Role: "user", Parts: []contentPart{}}, wantErr: "messages[2].content must not be an empty array"},
+		{name: "empty text", message: chatMessage{Role: "user", Parts: []contentPart{{Type: contentPartText}}}, wantErr: "messages[2].content[0].text is required"},
+		{name: "image of the assistant", message: chatMessage{Role: "assistant", Parts: []contentPart{image}}, wantErr: "messages[2].content[0] images are only allowed for the user role"},
+		{name: "no image", message: chatMessage{Role: "user", Parts: []contentPart{{Type: contentPartImageURL}}}, wantErr: "messages[2].content[0].image_url is required"},
+		{name: "http image", message: chatMessage{Role: "user", Parts: []contentPart{{Type: contentPartImageURL, ImageURL: &imageURLSource{URL: "http://example.com/cat.png"}}}}, wantErr: "messages[2].content[0].image_url.url must be an https URL or an image data URI"},
+		{name: "unknown type", message: chatMessage{Role: "user", Parts: []contentPart{{Type: "input_audio"}}}, wantErr: `messages[2].content[0].type must be text or image_url, got "input_audio"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkContentParts(2, tt.message)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("checkContentParts() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestImagePartsReachOpenAI checks that the parts are mapped onto the multi-part content of OpenAI for vision
+// models, and that images are rejected for the other models
+func TestImagePartsReachOpenAI(t *testing.T) {
+	const messages = `[{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"` + testImageURL + `","detail":"low"}}]}]`
+	want := []openai.ChatMessagePart{
+		{Type: openai.ChatMessagePartTypeText, Text: "What is this?"},
+		{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{URL: testImageURL, Detail: openai.ImageURLDetailLow}},
+	}
+	tests := []struct {
+		name         string
+		model        string
+		responseType string
+		turn         testsupport.Turn
+		wantStatus   int
+	}{
+		{name: "full", model: openai.GPT4o, responseType: responseTypeFull, turn: testsupport.Reply("A cat"), wantStatus: statusCodeOK},
+		{name: "stream", model: openai.GPT4o, responseType: responseTypeStream, turn: testsupport.Stream(testsupport.TextChunks(0, "A ", "cat")...), wantStatus: statusCodeOK},
+		{name: "other model", model: openai.GPT3Dot5Turbo, responseType: responseTypeFull, turn: testsupport.Reply("A cat"), wantStatus: statusCodeBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = tt.model
+				cfg.VisionModels = map[string]bool{openai.GPT4o: true}
+				cfg.StreamFlushInterval = 0
+			})
+			chat := testsupport.NewScriptedCompleter(tt.turn)
+			response, _ := runTestRequest(t, cfg, chat, `{"response_type":"`+tt.responseType+`","prompt_template":"PROMPT_TEST","messages":`+messages+`}`)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			requests := chat.Requests()
+			if tt.wantStatus != statusCodeOK {
+				if !strings.Contains(response.Body, "VISION_MODELS") || len(requests) != 0 {
+					t.Errorf("Handler() = %s with %d requests, want a 400 naming VISION_MODELS", response.Body, len(requests))
+				}
+				return
+			}
+			if got := requests[0].Messages[1]; got.Content != "" || !reflect.DeepEqual(got.MultiContent, want) {
+				t.Errorf("message = %q %+v, want the parts %+v", got.Content, got.MultiContent, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigVisionModels(t *testing.T) {
+	t.Setenv("VISION_MODELS", "")
+	cfg, err := loadConfig()
+	if err != nil || !cfg.VisionModels[openai.GPT4o] || cfg.VisionModels[openai.GPT3Dot5Turbo] {
+		t.Fatalf("loadConfig() = %v, %v, want the default vision models", cfg.VisionModels, err)
+	}
+	t.Setenv("VISION_MODELS", "my-vision, gpt-4o")
+	cfg, err = loadConfig()
+	if err != nil || !reflect.DeepEqual(cfg.VisionModels, map[string]bool{"my-vision": true, openai.GPT4o: true}) {
+		t.Errorf("loadConfig() = %v, %v, want my-vision and gpt-4o", cfg.VisionModels, err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	minVotes = 2
+	maxVotes = 7
+	// voteConcurrency bounds the completions of a voting request running at the same time
+	voteConcurrency = 4
+	// frameTypeVotes carries the vote distribution of a voting request to v2 clients
+	frameTypeVotes = "votes"
+)
+
+// votesFrame is the data of a votes envelope
+type votesFrame struct {
+	Requested    int            `json:"requested"`
+	Parsed       int            `json:"parsed"`
+	Distribution map[string]int `json:"distribution"`
+}
+
+// voteResult is the outcome of one completion of a voting request
+type voteResult struct {
+	response openai.ChatCompletionResponse
+	value    int
+	parsed   bool
+	metrics  *requestMetrics
+}
+
+// checkVotes checks that votes is within range and only used by the int response type
+func checkVotes(request Request) error {
+	if request.Votes == 0 {
+		return nil
+	}
+	if request.Votes < minVotes || request.Votes > maxVotes {
+		return fmt.Errorf("votes must be between %d and %d, got %d", minVotes, maxVotes, request.Votes)
+	}
+	switch {
+	case request.ResponseType != responseTypeInt:
+		return fmt.Errorf("votes is only supported for the %s response type", responseTypeInt)
+	case request.N > 1:
+		return fmt.Errorf("votes can't be combined with n")
+	case request.Cache:
+		// Identical completions would all be answered by the same cache entry
+		return fmt.Errorf("votes can't be combined with cache")
+	}
+	return nil
+}
+
+// getVotedIntResponse runs request.Votes completions concurrently, extracts the integer of each and sends the
+// most common one. Ties are broken by the median of all parsed values. Calls that fail to parse are discarded,
+// but fewer than half parsing fails the request. The first failing call cancels the outstanding ones.
+func getVotedIntResponse(ctx context.Context, openAIRequest openAIRequest, extract extractFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]voteResult, openAIRequest.request.Votes)
+	errs := runBounded(ctx, len(results), voteConcurrency, func(i int) error {
+		// Every call records into its own metrics, merged below, as requestMetrics isn't safe for concurrent use
+		voter := openAIRequest
+		voter.metrics = newRequestMetrics(openAIRequest.getClock())
+		results[i].metrics = voter.metrics
+		response, err := initPrefilledRequest(ctx, voter, voter.request)
+		if err != nil {
+			cancel()
+			return err
+		}
+		results[i].response = response
+		if checkContentFilter(voter, response) != nil {
+			return nil
+		}
+		if answer, ok := extract(response.Choices[0].Message.Content); ok {
+			value, err := strconv.Atoi(answer)
+			results[i].value, results[i].parsed = value, err == nil
+		}
+		return nil
+	})
+	metrics := make([]*requestMetrics, len(results))
+	for i, result := range results {
+		metrics[i] = result.metrics
+	}
+	mergeConcurrentMetrics(openAIRequest.metrics, metrics)
+	// Report the call that failed first rather than the cancellations it caused
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var usage openai.Usage
+	var values []int
+	distribution := make(map[string]int)
+	for _, result := range results {
+		addUsage(&usage, result.response.Usage)
+		if result.parsed {
+			values = append(values, result.value)
+			distribution[strconv.Itoa(result.value)]++
+		}
+	}
+	if len(values)*2 < len(results) {
+		openAIRequest.logger().Warn("Too few votes can be parsed", "parsed", len(values), "votes", len(results))
+		return ErrUnparsableResponse
+	}
+
+	winner := modalValue(values)
+	openAIRequest.logger().Debug("Voted answer", "answer", winner, "distribution", distribution)
+	if openAIRequest.isV2() {
+		if err := postEnvelope(openAIRequest, frameEnvelope{Type: frameTypeVotes, Data: votesFrame{Requested: len(results), Parsed: len(values), Distribution: distribution}}); err != nil {
+			return fmt.Errorf("Can't post votes to websocket: %w", err)
+		}
+	}
+	for _, result := range results {
+		if result.parsed && result.value == winner {
+			info, err := newCompletionInfo(result.response)
+			if err != nil {
+				return err
+			}
+			info.Usage = usage
+			return deliverAnswer(openAIRequest, []byte(strconv.Itoa(winner)), result.response.Choices[0].Message.Content, info)
+		}
+	}
+	return ErrUnparsableResponse
+}
+
+// modalValue returns the most common of values. Among equally common values the one closest to the median
+// of all values wins, and of two equally close the smaller one.
+func modalValue(values []int) int {
+	sorted := append([]int(nil), values...)
+	sort.Ints(sorted)
+	middle := len(sorted) / 2
+	median := float64(sorted[middle])
+	if len(sorted)%2 == 0 {
+		median = float64(sorted[middle-1]+sorted[middle]) / 2
+	}
+
+	counts := make(map[int]int)
+	for _, value := range sorted {
+		counts[value]++
+	}
+	best := sorted[0]
+	for _, value := range sorted {
+		distance, bestDistance := math.Abs(float64(value)-median), math.Abs(float64(best)-median)
+		if counts[value] > counts[best] || (counts[value] == counts[best] && distance < bestDistance) {
+			best = value
+		}
+	}
+	return best
+}
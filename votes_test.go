@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+// voteTurn answers one completion of a voting request with content, using 12 tokens
+func voteTurn(content string) testsupport.Turn {
+	turn := testsupport.Reply(content)
+	turn.Response.Usage = openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}
+	return turn
+}
+
+// votingBody is the body of an int request with votes and the extra fields
+func votingBody(votes string, extra string) string {
+	return `{"response_type":"int","prompt_template":"PROMPT_TEST","votes":` + votes + `,"messages":[{"role":"user","content":"Grade this"}]` + extra + `}`
+}
+
+// blockingCompleter holds every completion until its context is done, except that the first one fails with
+// err after a short delay when err is set
+type blockingCompleter struct {
+	*testsupport.ScriptedCompleter
+	err      error
+	calls    atomic.Int32
+	canceled atomic.Int32
+}
+
+func (c *blockingCompleter) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if c.calls.Add(1) == 1 && c.err != nil {
+		time.Sleep(20 * time.Millisecond)
+		return openai.ChatCompletionResponse{}, c.err
+	}
+	<-ctx.Done()
+	c.canceled.Add(1)
+	return openai.ChatCompletionResponse{}, ctx.Err()
+}
+
+func TestCheckVotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		request Request
+		wantErr string
+	}{
+		{name: "unset", request: Request{ResponseType: responseTypeFull}},
+		{name: "least", request: Request{ResponseType: responseTypeInt, Votes: minVotes}},
+		{name: "most", request: Request{ResponseType: responseTypeInt, Votes: maxVotes}},
+		{name: "one", request: Request{ResponseType: responseTypeInt, Votes: 1}, wantErr: "votes must be between 2 and 7, got 1"},
+		{name: "too many", request: Request{ResponseType: responseTypeInt, Votes: 8}, wantErr: "votes must be between 2 and 7, got 8"},
+		{name: "string", request: Request{ResponseType: responseTypeString, Votes: 3}, wantErr: "votes is only supported for the int response type"},
+		{name: "n", request: Request{ResponseType: responseTypeInt, Votes: 3, N: 2}, wantErr: "votes can't be combined with n"},
+		{name: "cache", request: Request{ResponseType: responseTypeInt, Votes: 3, Cache: true}, wantErr: "votes can't be combined with cache"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkVotes(tt.request)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("checkVotes() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestModalValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int
+		want   int
+	}{
+		{name: "one", values: []int{7}, want: 7},
+		{name: "majority", values: []int{3, 4, 4}, want: 4},
+		{name: "unsorted", values: []int{9, 1, 9, 5, 1, 9}, want: 9},
+		// The median of 1, 4, 5 and 9 is 4.5, so 4 and 5 are equally close and the smaller one wins
+		{name: "tie at the median", values: []int{9, 5, 1, 4}, want: 4},
+		{name: "tie closest to the median", values: []int{1, 1, 2, 8, 8, 9, 9}, want: 8},
+		{name: "tie of pairs", values: []int{10, 2, 10, 2}, want: 2},
+		{name: "negative", values: []int{-3, -1, -2}, want: -2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := modalValue(tt.values); got != tt.want {
+				t.Errorf("modalValue(%v) = %d, want %d", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestVotedIntRequests checks the voted answer, the usage summed across the completions and the votes envelope
+func TestVotedIntRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		votes      string
+		extra      string
+		contents   []string
+		wantStatus int
+		wantFrames []string
+	}{
+		{name: "majority", votes: "3", contents: []string{"[[3]]", "[[4]]", "[[4]]"}, wantStatus: statusCodeOK, wantFrames: []string{"4"}},
+		{name: "tie", votes: "2", contents: []string{"[[6]]", "[[2]]"}, wantStatus: statusCodeOK, wantFrames: []string{"2"}},
+		// Half of the votes parsing is enough
+		{name: "unparsable votes are discarded", votes: "4", contents: []string{"[[5]]", "no idea", "[[5]]", "maybe"}, wantStatus: statusCodeOK, wantFrames: []string{"5"}},
+		{name: "too few parse", votes: "3", contents: []string{"[[5]]", "no idea", "maybe"}, wantStatus: statusCodeBadGateway, wantFrames: []string{`{"type":"error","code":"parse_error","message":"Can't parse OpenAI API response"}`}},
+		{
+			name:       "usage of all completions",
+			votes:      "3",
+			extra:      `,"include_usage":true`,
+			contents:   []string{"[[4]]", "[[4]]", "[[4]]"},
+			wantStatus: statusCodeOK,
+			wantFrames: []string{"4", `{"type":"usage","prompt_tokens":30,"completion_tokens":6,"total_tokens":36,"model":"gpt-test"}`},
+		},
+		{
+			name:       "v2 clients",
+			votes:      "5",
+			extra:      `,"protocol":"v2"`,
+			contents:   []string{"[[3]]", "[[4]]", "[[3]]", "[[3]]", "none"},
+			wantStatus: statusCodeOK,
+			wantFrames: []string{
+				`{"type":"votes","seq":0,"data":{"requested":5,"parsed":4,"distribution":{"3":3,"4":1}}}`,
+				`{"type":"final","seq":1,"data":"3","finish_reason":"stop","model":"gpt-test"}`,
+			},
+		},
+		{name: "out of range", votes: "8", contents: []string{"[[4]]"}, wantStatus: statusCodeBadRequest, wantFrames: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.OpenAIModel = "gpt-test" })
+			turns := make([]testsupport.Turn, 0, len(tt.contents))
+			for _, content := range tt.contents {
+				turns = append(turns, voteTurn(content))
+			}
+			chat := testsupport.NewScriptedCompleter(turns...)
+			response, poster := runTestRequest(t, cfg, chat, votingBody(tt.votes, tt.extra))
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("Handler() = %d %s, want %d", response.StatusCode, response.Body, tt.wantStatus)
+			}
+			if got := poster.Texts(); !reflect.DeepEqual(got, tt.wantFrames) {
+				t.Errorf("frames = %q, want %q", got, tt.wantFrames)
+			}
+			requests := chat.Requests()
+			if tt.wantStatus == statusCodeBadRequest {
+				if len(requests) != 0 {
+					t.Error("the invalid request reached OpenAI")
+				}
+				return
+			}
+			if len(requests) != len(tt.contents) {
+				t.Fatalf("%d OpenAI requests, want %d", len(requests), len(tt.contents))
+			}
+			// The votes need varying answers, so the temperature 0 of the extractors isn't applied
+			for _, request := range requests {
+				if request.Temperature != 0 || request.N > 1 {
+					t.Errorf("temperature = %v, n = %d, want the model defaults", request.Temperature, request.N)
+				}
+			}
+		})
+	}
+}
+
+// TestVotesAreCanceled checks that a failing completion or the Lambda timeout cancels the outstanding calls
+func TestVotesAreCanceled(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		timeout      time.Duration
+		wantBody     string
+		wantCanceled int32
+	}{
+		// The error of the failing completion is reported rather than the cancellations it caused
+		{name: "failing completion", err: errors.New("connection reset"), timeout: time.Minute, wantBody: "connection reset", wantCanceled: 2},
+		{name: "timeout", timeout: 50 * time.Millisecond, wantBody: "context deadline exceeded", wantCanceled: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.OpenAIMaxRetries = 0 })
+			chat := &blockingCompleter{ScriptedCompleter: testsupport.NewScriptedCompleter(), err: tt.err}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			poster := testsupport.NewRecordingPoster()
+			response, err := newTestHandler(cfg, chat, poster, nil, nil).Handler(ctx, testMessage(votingBody("3", "")))
+			if err != nil || response.StatusCode != statusCodeServerError || !strings.Contains(response.Body, tt.wantBody) {
+				t.Fatalf("Handler() = %d %s, %v, want 500 with %q", response.StatusCode, response.Body, err, tt.wantBody)
+			}
+			if got := chat.canceled.Load(); got != tt.wantCanceled {
+				t.Errorf("%d completions canceled, want %d", got, tt.wantCanceled)
+			}
+			for _, text := range poster.Texts() {
+				if !strings.Contains(text, "error") {
+					t.Errorf("frame %s posted by a canceled vote", text)
+				}
+			}
+		})
+	}
+}
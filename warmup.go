@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	actionWarmup = "warmup"
+	actionHealth = "health"
+	// healthCheckTimeout bounds each dependency check, so a hanging dependency is reported rather than waited out
+	healthCheckTimeout  = 5 * time.Second
+	dependencyStatusOK  = "ok"
+	dependencyStatusErr = "error"
+	// healthCheckConnectionID is looked up in the connections table, no connection ever has this ID
+	healthCheckConnectionID = "$health"
+)
+
+// maintenanceResponse is the invocation response to a warm-up or a health check
+type maintenanceResponse struct {
+	StatusCode   int                         `json:"status_code"`
+	Action       string                      `json:"action"`
+	Dependencies map[string]dependencyStatus `json:"dependencies,omitempty"` // Set by health checks
+}
+
+// dependencyStatus is the outcome of the check of one dependency
+type dependencyStatus struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// maintenanceAction returns warmup or health for invocations by a warmer or a health checker, and an empty
+// string otherwise. The action may be top level, in the detail of an EventBridge event or in a body; a
+// scheduled EventBridge event without one is a warm-up. API Gateway events always carry a request context,
+// so websocket messages with these actions aren't taken for them.
+func maintenanceAction(payload json.RawMessage) string {
+	var event struct {
+		Action         string          `json:"action"`
+		Body           string          `json:"body"`
+		Detail         json.RawMessage `json:"detail"`
+		Source         string          `json:"source"`
+		DetailType     string          `json:"detail-type"`
+		RequestContext json.RawMessage `json:"requestContext"`
+	}
+	if json.Unmarshal(payload, &event) != nil || len(event.RequestContext) > 0 {
+		return ""
+	}
+	action := event.Action
+	if action == "" && len(event.Detail) > 0 {
+		action = parseAction(string(event.Detail))
+	}
+	if action == "" && event.Body != "" {
+		action = parseAction(event.Body)
+	}
+	if action == "" && event.Source == "aws.events" && event.DetailType == "Scheduled Event" {
+		action = actionWarmup
+	}
+	if action == actionWarmup || action == actionHealth {
+		return action
+	}
+	return ""
+}
+
+// handleWarmup builds the clients of the configuration snapshot and fills the caches the first request would
+// otherwise fill, the model validation and the templates of the prompt profiles in PROMPT_TABLE. Failures are
+// only logged, the requests retry them. Nothing is posted to any connection.
+func (h *WebsocketHandler) handleWarmup(ctx context.Context, cfg *Config) maintenanceResponse {
+	ctx = withLogger(ctx, loggerFrom(ctx).With("action", actionWarmup, "model", cfg.OpenAIModel))
+	chat := h.getChatCompleter(cfg)
+	h.getConnectionPoster(ctx, cfg)
+	client := h.getDynamoDBClient(cfg)
+
+	if _, err := getModel(ctx, cfg, chat); err != nil {
+		loggerFrom(ctx).Warn("Can't validate model during warm-up", "error", err)
+	}
+	if cfg.PromptTable != "" {
+		target := openAIRequest{ctx: ctx, config: cfg, dynamoDBClient: client}
+		for name := range cfg.PromptProfiles {
+			if _, err := getTablePrompt(ctx, target, cfg.PromptTable, name); err != nil {
+				loggerFrom(ctx).Warn("Can't prefetch prompt template during warm-up", "prompt_template", name, "error", err)
+			}
+		}
+	}
+	loggerFrom(ctx).Info("Warm-up invocation")
+	return maintenanceResponse{StatusCode: statusCodeOK, Action: actionWarmup}
+}
+
+// handleHealth warms the container up, then checks that the OpenAI API lists models and, when configured,
+// that the connections table can be read. Any failing dependency turns the status code into 503.
+func (h *WebsocketHandler) handleHealth(ctx context.Context, cfg *Config) maintenanceResponse {
+	response := h.handleWarmup(ctx, cfg)
+	response.Action = actionHealth
+	ctx = withLogger(ctx, loggerFrom(ctx).With("action", actionHealth))
+
+	names := []string{"openai"}
+	checks := []func(context.Context) error{
+		func(ctx context.Context) error {
+			_, err := h.getChatCompleter(cfg).ListModels(ctx)
+			// OpenAI-compatible gateways don't always implement /models, they still answered
+			if isNotFoundError(err) {
+				return nil
+			}
+			return err
+		},
+	}
+	if cfg.ConnectionsTable != "" {
+		names = append(names, "connections_table")
+		checks = append(checks, func(ctx context.Context) error {
+			_, err := h.getDynamoDBClient(cfg).GetItemWithContext(ctx, &dynamodb.GetItemInput{
+				TableName: aws.String(cfg.ConnectionsTable),
+				Key:       connectionKey(healthCheckConnectionID),
+			})
+			return err
+		})
+	}
+
+	statuses := make([]dependencyStatus, len(checks))
+	errs := runBounded(ctx, len(checks), len(checks), func(i int) error {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		start := time.Now()
+		err := checks[i](checkCtx)
+		statuses[i] = dependencyStatus{Status: dependencyStatusOK, LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			statuses[i].Status, statuses[i].Error = dependencyStatusErr, err.Error()
+		}
+		return err
+	})
+
+	response.Dependencies = make(map[string]dependencyStatus, len(names))
+	for i, name := range names {
+		// A check skipped because the invocation ran out of time only has its error
+		if statuses[i].Status == "" {
+			statuses[i] = dependencyStatus{Status: dependencyStatusErr, Error: errs[i].Error()}
+		}
+		response.Dependencies[name] = statuses[i]
+		if statuses[i].Status != dependencyStatusOK {
+			response.StatusCode = statusCodeUnavailable
+			loggerFrom(ctx).Warn("Health check failed", "dependency", name, "error", statuses[i].Error)
+		}
+	}
+	return response
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sashabaranov/go-openai"
+	"github.com/zerobugdebug/openai-proxy-lambda/testsupport"
+)
+
+func TestMaintenanceAction(t *testing.T) {
+	websocketPayload, _ := json.Marshal(testMessage(`{"action":"warmup"}`))
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "warmup", payload: `{"action":"warmup"}`, want: actionWarmup},
+		{name: "health", payload: `{"action":"health"}`, want: actionHealth},
+		{name: "EventBridge detail", payload: `{"source":"my.warmer","detail-type":"Warm","detail":{"action":"health"}}`, want: actionHealth},
+		{name: "body", payload: `{"body":"{\"action\":\"warmup\"}"}`, want: actionWarmup},
+		{name: "scheduled event", payload: `{"version":"0","source":"aws.events","detail-type":"Scheduled Event","detail":{}}`, want: actionWarmup},
+		// A websocket message with the action is a client request, not a warm-up
+		{name: "websocket message", payload: string(websocketPayload)},
+		{name: "other action", payload: `{"action":"push","connection_id":"conn-1","data":"hi"}`},
+		{name: "other EventBridge event", payload: `{"source":"aws.s3","detail-type":"Object Created","detail":{"bucket":{"name":"b"}}}`},
+		{name: "SQS", payload: `{"Records":[{"eventSource":"aws:sqs","body":"{}"}]}`},
+		{name: "not JSON", payload: `warmup`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := maintenanceAction(json.RawMessage(tt.payload)); got != tt.want {
+				t.Errorf("maintenanceAction(%s) = %q, want %q", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWarmup checks that a warm-up fills the model validation and the prompt template caches, so the request
+// after it neither lists the models nor reads the prompt table
+func TestWarmup(t *testing.T) {
+	tests := []struct {
+		name         string
+		modelsErr    error
+		wantListings int
+	}{
+		{name: "caches filled", wantListings: 1},
+		// The failed validation is only logged, and retried by the request
+		{name: "listing fails", modelsErr: &openai.APIError{HTTPStatusCode: 500}, wantListings: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPromptCache(t)
+			cfg := testConfig(t, func(cfg *Config) {
+				cfg.OpenAIModel = "gpt-test"
+				cfg.ModelValidation = true
+				cfg.PromptTable = "prompts"
+				cfg.PromptProfiles = map[string]promptProfile{"PROMPT_TABLE_ONE": {}}
+			})
+			db := newFakeDynamoDB().table("prompts", "name")
+			db.put("prompts", map[string]*dynamodb.AttributeValue{
+				"name":   {S: aws.String("PROMPT_TABLE_ONE")},
+				"prompt": {S: aws.String("Prompt from the table.")},
+			})
+			chat := testsupport.NewScriptedCompleter(testsupport.Reply("Hello"))
+			chat.Models, chat.ModelsErr = []string{"gpt-test"}, tt.modelsErr
+			poster := testsupport.NewRecordingPoster()
+			h := newTestHandler(cfg, chat, poster, db, nil)
+
+			got, err := h.Invoke(context.Background(), json.RawMessage(`{"action":"warmup"}`))
+			if want := (maintenanceResponse{StatusCode: statusCodeOK, Action: actionWarmup}); err != nil || !reflect.DeepEqual(got, want) {
+				t.Fatalf("Invoke() = %+v, %v, want %+v", got, err, want)
+			}
+			if len(poster.Texts()) != 0 || len(chat.Requests()) != 0 {
+				t.Fatalf("warm-up posted %q and sent %d completions", poster.Texts(), len(chat.Requests()))
+			}
+
+			body := `{"response_type":"full","prompt_template":"PROMPT_TABLE_ONE","messages":[{"role":"user","content":"hi"}]}`
+			if response, err := h.Handler(context.Background(), testMessage(body)); err != nil || response.StatusCode != statusCodeOK {
+				t.Fatalf("Handler() = %d %s, %v", response.StatusCode, response.Body, err)
+			}
+			if got := chat.ListModelsCalls(); got != tt.wantListings {
+				t.Errorf("ListModels calls = %d, want %d", got, tt.wantListings)
+			}
+			if got := db.count("GetItem"); got != 1 {
+				t.Errorf("GetItem calls = %d, want the one of the warm-up", got)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	throttled := errors.New("ProvisionedThroughputExceededException")
+	tests := []struct {
+		name         string
+		table        string
+		modelsErr    error
+		tableErr     error
+		wantStatus   int
+		wantStatuses map[string]dependencyStatus
+	}{
+		{
+			name:         "healthy",
+			table:        "connections",
+			wantStatus:   statusCodeOK,
+			wantStatuses: map[string]dependencyStatus{"openai": {Status: dependencyStatusOK}, "connections_table": {Status: dependencyStatusOK}},
+		},
+		{name: "no connections table", wantStatus: statusCodeOK, wantStatuses: map[string]dependencyStatus{"openai": {Status: dependencyStatusOK}}},
+		{
+			// Gateways without a models endpoint still answered
+			name:         "models not listed",
+			modelsErr:    &openai.APIError{HTTPStatusCode: 404, Message: "Not found"},
+			wantStatus:   statusCodeOK,
+			wantStatuses: map[string]dependencyStatus{"openai": {Status: dependencyStatusOK}},
+		},
+		{
+			name:         "OpenAI failing",
+			table:        "connections",
+			modelsErr:    errors.New("connection refused"),
+			wantStatus:   statusCodeUnavailable,
+			wantStatuses: map[string]dependencyStatus{"openai": {Status: dependencyStatusErr, Error: "connection refused"}, "connections_table": {Status: dependencyStatusOK}},
+		},
+		{
+			name:         "connections table failing",
+			table:        "connections",
+			tableErr:     throttled,
+			wantStatus:   statusCodeUnavailable,
+			wantStatuses: map[string]dependencyStatus{"openai": {Status: dependencyStatusOK}, "connections_table": {Status: dependencyStatusErr, Error: throttled.Error()}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, func(cfg *Config) { cfg.ConnectionsTable = tt.table })
+			db := newFakeDynamoDB().table("connections", "connection_id")
+			if tt.tableErr != nil {
+				db.fail("GetItem", tt.tableErr)
+			}
+			chat := testsupport.NewScriptedCompleter()
+			chat.ModelsErr = tt.modelsErr
+			poster := testsupport.NewRecordingPoster()
+			got, err := newTestHandler(cfg, chat, poster, db, nil).Invoke(context.Background(), json.RawMessage(`{"action":"health"}`))
+			response, ok := got.(maintenanceResponse)
+			if err != nil || !ok || response.StatusCode != tt.wantStatus || response.Action != actionHealth {
+				t.Fatalf("Invoke() = %+v, %v, want %d", got, err, tt.wantStatus)
+			}
+			for name, status := range response.Dependencies {
+				if status.LatencyMs < 0 {
+					t.Errorf("%s latency = %d ms", name, status.LatencyMs)
+				}
+				status.LatencyMs = 0
+				response.Dependencies[name] = status
+			}
+			if !reflect.DeepEqual(response.Dependencies, tt.wantStatuses) {
+				t.Errorf("dependencies = %+v, want %+v", response.Dependencies, tt.wantStatuses)
+			}
+			if len(poster.Texts()) != 0 {
+				t.Errorf("health check posted %q", poster.Texts())
+			}
+		})
+	}
+}